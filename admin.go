@@ -0,0 +1,169 @@
+package proxygo
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig enables the admin API on a separate listener
+type AdminConfig struct {
+	Address   string `json:"address"`         // e.g. "127.0.0.1:9901"
+	Token     string `json:"token,omitempty"` // bearer token required by every admin endpoint except /metrics and the dashboard views
+	Dashboard bool   `json:"dashboard"`       // serve the live traffic dashboard at /dashboard
+	Pprof     bool   `json:"pprof"`           // serve net/http/pprof profiles under /debug/pprof/, behind the token
+	Expvar    bool   `json:"expvar"`          // serve expvar's /debug/vars, behind the token
+	DryRun    bool   `json:"dry_run"`         // answer proxied requests carrying the token in X-Proxygo-Dry-Run or ?proxygo_dry_run= with what would be sent upstream
+
+	// CertExpiryWindow fails /readyz when a listener certificate expires sooner than this; default 7 days
+	CertExpiryWindow Duration `json:"cert_expiry_window"`
+}
+
+// adminAPI serves operational endpoints for a ProxyHandler
+type adminAPI struct {
+	proxy *ProxyHandler
+	token string
+	mux   *http.ServeMux
+}
+
+// newAdminAPI wires the admin endpoints
+func newAdminAPI(proxy *ProxyHandler, cfg *AdminConfig) *adminAPI {
+	a := &adminAPI{proxy: proxy, token: cfg.Token, mux: http.NewServeMux()}
+
+	// Metrics are meant to be scraped and stay unauthenticated
+	a.mux.Handle("GET /metrics", proxy.metrics)
+
+	// Probes are unauthenticated too, for load balancers and orchestrators
+	a.mux.HandleFunc("GET /healthz", a.handleHealthz)
+	a.mux.HandleFunc("GET /readyz", a.handleReadyz)
+
+	a.mux.HandleFunc("GET /keys", a.authorized(a.listKeys))
+	a.mux.HandleFunc("POST /keys", a.authorized(a.createKey))
+	a.mux.HandleFunc("DELETE /keys/{id}", a.authorized(a.revokeKey))
+	a.mux.HandleFunc("GET /usage", a.authorized(a.handleUsage))
+	a.mux.HandleFunc("DELETE /cache", a.authorized(a.purgeCache))
+	a.mux.HandleFunc("GET /pool", a.authorized(a.handlePool))
+	a.mux.HandleFunc("PUT /pool", a.authorized(a.tunePool))
+	a.mux.HandleFunc("GET /aliases", a.authorized(a.listAliases))
+	a.mux.HandleFunc("PUT /aliases/{name}", a.authorized(a.setAlias))
+	a.mux.HandleFunc("DELETE /aliases/{name}", a.authorized(a.deleteAlias))
+	a.mux.HandleFunc("POST /signed-urls", a.authorized(a.signURL))
+	a.mux.HandleFunc("GET /tenants", a.authorized(a.listTenants))
+	a.mux.HandleFunc("PUT /tenants/{id}", a.authorized(a.setTenant))
+	a.mux.HandleFunc("DELETE /tenants/{id}", a.authorized(a.deleteTenant))
+	a.mux.HandleFunc("GET /routes/trace", a.authorized(a.traceRoute))
+	a.mux.HandleFunc("GET /uploads", a.authorized(a.listUploads))
+	a.mux.HandleFunc("GET /maintenance", a.authorized(a.handleMaintenance))
+	a.mux.HandleFunc("PUT /maintenance", a.authorized(a.setMaintenance))
+	a.mux.HandleFunc("DELETE /maintenance", a.authorized(a.setMaintenance))
+	a.mux.HandleFunc("PUT /maintenance/{route}", a.authorized(a.setRouteMaintenance))
+	a.mux.HandleFunc("DELETE /maintenance/{route}", a.authorized(a.setRouteMaintenance))
+
+	// The dashboard views are read-only; its controls call the authorized endpoints above,
+	// and so does the config view, which shows routes and upstreams
+	a.mux.HandleFunc("GET /dashboard", a.serveDashboard)
+	a.mux.HandleFunc("GET /dashboard/events", a.dashboardEvents)
+	a.mux.HandleFunc("GET /dashboard/stats", a.dashboardStats)
+	a.mux.HandleFunc("GET /dashboard/config", a.authorized(a.dashboardConfig))
+
+	a.registerDebug(cfg)
+	return a
+}
+
+// ServeHTTP implements http.Handler
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// authorized rejects requests that lack the admin bearer token
+func (a *adminAPI) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			writeJSONError(w, http.StatusForbidden, "admin_disabled", "set admin.token to use the admin API")
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			a.proxy.audit(r, auditEvent{Event: auditAdminAuthFailed, Status: http.StatusUnauthorized})
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "a valid admin bearer token is required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// keysEnabled answers 404 when API keys are not configured
+func (a *adminAPI) keysEnabled(w http.ResponseWriter) bool {
+	if a.proxy.keys == nil {
+		writeJSONError(w, http.StatusNotFound, "keys_disabled", "api_keys is not configured")
+		return false
+	}
+	return true
+}
+
+// listKeys handles GET /keys
+func (a *adminAPI) listKeys(w http.ResponseWriter, r *http.Request) {
+	if !a.keysEnabled(w) {
+		return
+	}
+	keys := a.proxy.keys.list()
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// createKey handles POST /keys; the response is the only place the secret is ever shown
+func (a *adminAPI) createKey(w http.ResponseWriter, r *http.Request) {
+	if !a.keysEnabled(w) {
+		return
+	}
+
+	var spec APIKey
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&spec); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+
+	key, secret, err := a.proxy.keys.create(spec)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "create_failed", err.Error())
+		return
+	}
+
+	a.proxy.logger.Printf("Admin: created API key %q", key.ID)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusCreated, Reason: "key_created", Details: map[string]string{"key": key.ID}})
+	key.Hash = ""
+	writeJSON(w, http.StatusCreated, struct {
+		*APIKey
+		Key string `json:"key"`
+	}{key, secret})
+}
+
+// revokeKey handles DELETE /keys/{id}
+func (a *adminAPI) revokeKey(w http.ResponseWriter, r *http.Request) {
+	if !a.keysEnabled(w) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := a.proxy.keys.revoke(id); err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+
+	a.proxy.logger.Printf("Admin: revoked API key %q", id)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusNoContent, Reason: "key_revoked", Details: map[string]string{"key": id}})
+	w.WriteHeader(http.StatusNoContent)
+}
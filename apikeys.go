@@ -0,0 +1,402 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keyStoreFlushInterval is how often dirty usage counters are written to disk
+const keyStoreFlushInterval = 30 * time.Second
+
+// APIKeysConfig enables API key authentication backed by a JSON file
+type APIKeysConfig struct {
+	File     string `json:"file"`     // where keys and usage are persisted
+	Header   string `json:"header"`   // request header carrying the key, default X-API-Key
+	Required bool   `json:"required"` // reject requests that carry no key
+}
+
+// APIKey is a stored key; only a hash of the secret is kept
+type APIKey struct {
+	ID           string     `json:"id"`
+	Hash         string     `json:"hash,omitempty"`
+	RateLimit    float64    `json:"rate_limit"`    // requests per second, 0 for unlimited
+	Burst        int        `json:"burst"`         // request burst, defaults to the rate rounded up
+	AllowedHosts []string   `json:"allowed_hosts"` // upstream host patterns such as "api.example.com" or "*.example.com"
+	MonthlyQuota ByteSize   `json:"monthly_quota"` // response bytes per calendar month, 0 for unlimited
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	Usage        KeyUsage   `json:"usage"`
+}
+
+// KeyUsage counts what a key consumed in the current month
+type KeyUsage struct {
+	Month    string `json:"month"` // "2006-01"
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// keyError is an API key rejection with the HTTP status it maps to
+type keyError struct {
+	status     int
+	code       string
+	message    string
+	retryAfter time.Duration // set for rate limit rejections
+}
+
+// Error implements error
+func (e *keyError) Error() string {
+	return e.message
+}
+
+// keyStore holds the API keys in memory and persists them to a JSON file
+type keyStore struct {
+	path     string
+	header   string
+	required bool
+
+	mu       sync.Mutex
+	keys     map[string]*APIKey // by ID
+	byHash   map[string]*APIKey
+	limiters map[string]*tokenBucket
+	dirty    bool
+
+	cluster *clusterState // nil when rate limits are counted by this instance alone
+}
+
+// openKeyStore loads the key file, returning nil when API keys are disabled
+func openKeyStore(cfg *APIKeysConfig) (*keyStore, error) {
+	if cfg == nil || cfg.File == "" {
+		return nil, nil
+	}
+
+	s := &keyStore{
+		path:     cfg.File,
+		header:   cfg.Header,
+		required: cfg.Required,
+		keys:     make(map[string]*APIKey),
+		byHash:   make(map[string]*APIKey),
+		limiters: make(map[string]*tokenBucket),
+	}
+	if s.header == "" {
+		s.header = "X-API-Key"
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api key file: %w", err)
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse api key file: %w", err)
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+		s.byHash[k.Hash] = k
+	}
+	return s, nil
+}
+
+// hashKey returns the stored form of a secret
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// currentMonth returns the usage bucket for now
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// rollMonth resets usage when a new month has started; callers hold s.mu
+func rollMonth(k *APIKey) {
+	if month := currentMonth(); k.Usage.Month != month {
+		k.Usage = KeyUsage{Month: month}
+	}
+}
+
+// admit authenticates the key carried by r and checks its limits against the target host.
+// It returns nil without error for anonymous requests when keys are optional.
+func (s *keyStore) admit(r *http.Request, host string) (*APIKey, error) {
+	secret := r.Header.Get(s.header)
+	// Never leak the key to upstreams
+	r.Header.Del(s.header)
+
+	if secret == "" {
+		if s.required {
+			return nil, &keyError{http.StatusUnauthorized, "missing_api_key", "an API key is required in the " + s.header + " header", 0}
+		}
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	key, rate, burst, err := s.authorizeLocked(secret, host)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if rate > 0 {
+		if burst < 1 {
+			burst = math.Ceil(rate)
+		}
+		if ok, wait := s.allow(r.Context(), key.ID, rate, burst); !ok {
+			return nil, &keyError{http.StatusTooManyRequests, "rate_limited", "the request rate of this API key is exceeded", wait}
+		}
+	}
+	return key, nil
+}
+
+// reaches checks that key id may send requests to host, for an upstream chosen after
+// admit checked the first one
+func (s *keyStore) reaches(id, host string) *keyError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[id]; ok && !hostAllowed(key.AllowedHosts, host) {
+		return &keyError{http.StatusForbidden, "host_not_allowed", fmt.Sprintf("this API key may not reach %s", host), 0}
+	}
+	return nil
+}
+
+// authorizeLocked finds the key for secret and checks its host and quota, returning its
+// rate limit; callers hold s.mu
+func (s *keyStore) authorizeLocked(secret, host string) (*APIKey, float64, float64, error) {
+	key, ok := s.byHash[hashKey(secret)]
+	if !ok || key.RevokedAt != nil {
+		return nil, 0, 0, &keyError{http.StatusUnauthorized, "invalid_api_key", "the API key is invalid or revoked", 0}
+	}
+
+	if !hostAllowed(key.AllowedHosts, host) {
+		return nil, 0, 0, &keyError{http.StatusForbidden, "host_not_allowed", fmt.Sprintf("this API key may not reach %s", host), 0}
+	}
+
+	rollMonth(key)
+	if key.MonthlyQuota > 0 && key.Usage.Bytes >= int64(key.MonthlyQuota) {
+		return nil, 0, 0, &keyError{http.StatusTooManyRequests, "quota_exceeded", "the monthly transfer quota of this API key is exhausted", 0}
+	}
+	return key, key.RateLimit, float64(key.Burst), nil
+}
+
+// allow takes a token for key id from the cluster's shared bucket, or from a local one
+// when the instance runs alone or cannot reach Redis
+func (s *keyStore) allow(ctx context.Context, id string, rate, burst float64) (bool, time.Duration) {
+	if s.cluster != nil {
+		if ok, wait, err := s.cluster.allow(ctx, "apikey", id, rate, burst); err == nil {
+			return ok, wait
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.limiters[id]
+	if !ok {
+		bucket = newTokenBucket(rate, burst)
+		s.limiters[id] = bucket
+	}
+	n, wait := bucket.reserve(1)
+	return n > 0, wait
+}
+
+// keyID returns the ID of the valid key carried by r, or "", leaving the header in place
+func (s *keyStore) keyID(r *http.Request) string {
+	secret := r.Header.Get(s.header)
+	if secret == "" {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.byHash[hashKey(secret)]; ok && key.RevokedAt == nil {
+		return key.ID
+	}
+	return ""
+}
+
+// hostAllowed matches host against patterns; an empty list allows every host
+func hostAllowed(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a finished request to the key's usage
+func (s *keyStore) record(id string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return
+	}
+	rollMonth(key)
+	key.Usage.Requests++
+	key.Usage.Bytes += bytes
+	s.dirty = true
+}
+
+// create stores a new key and returns it with its plaintext secret, which is never stored
+func (s *keyStore) create(spec APIKey) (*APIKey, string, error) {
+	if spec.ID == "" {
+		return nil, "", fmt.Errorf("id is required")
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := "pgk_" + base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.keys[spec.ID]; exists {
+		return nil, "", fmt.Errorf("key %q already exists", spec.ID)
+	}
+
+	key := spec
+	key.Hash = hashKey(secret)
+	key.CreatedAt = time.Now().UTC()
+	key.RevokedAt = nil
+	key.Usage = KeyUsage{Month: currentMonth()}
+
+	s.keys[key.ID] = &key
+	s.byHash[key.Hash] = &key
+	if err := s.saveLocked(); err != nil {
+		return nil, "", err
+	}
+	created := key
+	return &created, secret, nil
+}
+
+// revoke marks a key unusable while keeping its usage history
+func (s *keyStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return fmt.Errorf("key %q not found", id)
+	}
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+	}
+	delete(s.limiters, id)
+	return s.saveLocked()
+}
+
+// list returns copies of all keys sorted by ID
+func (s *keyStore) list() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		rollMonth(k)
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// flush writes usage counters to disk if they changed
+func (s *keyStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// saveLocked atomically replaces the key file; callers hold s.mu
+func (s *keyStore) saveLocked() error {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save api keys: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// run periodically flushes usage until ctx is done
+func (s *keyStore) run(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(keyStoreFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				logger.Printf("API key usage flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// samples exposes per-key usage for the metrics endpoint
+func (s *keyStore) samples(field func(KeyUsage) int64) func() []sample {
+	return func() []sample {
+		var out []sample
+		for _, k := range s.list() {
+			out = append(out, sample{labels: []string{k.ID}, value: float64(field(k.Usage))})
+		}
+		return out
+	}
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
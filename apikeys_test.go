@@ -0,0 +1,139 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	revoked := time.Now().Add(-time.Hour)
+	keyFile := writeTestKeys(t,
+		&APIKey{ID: "open", Hash: hashKey("open-secret")},
+		&APIKey{ID: "hosts", Hash: hashKey("hosts-secret"), AllowedHosts: []string{"*.example.com"}},
+		&APIKey{ID: "revoked", Hash: hashKey("revoked-secret"), RevokedAt: &revoked},
+		&APIKey{ID: "spent", Hash: hashKey("spent-secret"), MonthlyQuota: 100, Usage: KeyUsage{Month: currentMonth(), Bytes: 100}},
+		&APIKey{ID: "last-month", Hash: hashKey("last-month-secret"), MonthlyQuota: 100, Usage: KeyUsage{Month: "2000-01", Bytes: 100}},
+		&APIKey{ID: "slow", Hash: hashKey("slow-secret"), RateLimit: 0.001, Burst: 1},
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "key header: "+r.Header.Get("X-API-Key"))
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"api_keys": {"file": "`+keyFile+`", "required": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	tests := []struct {
+		name   string
+		secret string
+		status int
+		code   string
+	}{
+		{name: "valid", secret: "open-secret", status: http.StatusOK},
+		{name: "missing", status: http.StatusUnauthorized, code: "missing_api_key"},
+		{name: "unknown", secret: "guess", status: http.StatusUnauthorized, code: "invalid_api_key"},
+		{name: "revoked", secret: "revoked-secret", status: http.StatusUnauthorized, code: "invalid_api_key"},
+		{name: "host not allowed", secret: "hosts-secret", status: http.StatusForbidden, code: "host_not_allowed"},
+		{name: "quota spent", secret: "spent-secret", status: http.StatusTooManyRequests, code: "quota_exceeded"},
+		{name: "quota of last month", secret: "last-month-secret", status: http.StatusOK},
+		{name: "within burst", secret: "slow-secret", status: http.StatusOK},
+		{name: "rate limited", secret: "slow-secret", status: http.StatusTooManyRequests, code: "rate_limited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			if tt.secret != "" {
+				r.Header.Set("X-API-Key", tt.secret)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			// The key never reaches the upstream
+			if tt.status == http.StatusOK && w.Body.String() != "key header: " {
+				t.Errorf("upstream saw %q", w.Body.String())
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), `"error":"`+tt.code+`"`) {
+				t.Errorf("body %s, want error %q", w.Body, tt.code)
+			}
+		})
+	}
+
+	// Usage starts over in the new month
+	for _, key := range h.keys.list() {
+		if key.ID == "last-month" && (key.Usage.Month != currentMonth() || key.Usage.Requests != 1 || key.Usage.Bytes == 0) {
+			t.Errorf("usage %+v, want one request this month", key.Usage)
+		}
+	}
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	path := writeTestKeys(t)
+	s, err := openKeyStore(&APIKeysConfig{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, secret, err := s.create(APIKey{ID: "new", AllowedHosts: []string{"api.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Hash != hashKey(secret) || key.Usage.Month != currentMonth() {
+		t.Errorf("created %+v", key)
+	}
+	if _, _, err := s.create(APIKey{ID: "new"}); err == nil {
+		t.Error("created a second key with the same ID")
+	}
+	if _, _, err := s.create(APIKey{}); err == nil {
+		t.Error("created a key without an ID")
+	}
+	s.record("new", 42)
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file holds the hash and usage, never the secret
+	reopened, err := openKeyStore(&APIKeysConfig{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", secret)
+	if got, err := reopened.admit(r, "api.example.com"); err != nil || got.Usage.Bytes != 42 {
+		t.Fatalf("admit after reopening = %+v, %v", got, err)
+	}
+	if err := reopened.revoke("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.revoke("missing"); err == nil {
+		t.Error("revoked a key that does not exist")
+	}
+	r.Header.Set("X-API-Key", secret)
+	if _, err := reopened.admit(r, "api.example.com"); err == nil {
+		t.Error("admitted a revoked key")
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{nil, "anything.test", true},
+		{[]string{"api.example.com"}, "api.example.com", true},
+		{[]string{"api.example.com"}, "www.example.com", false},
+		{[]string{"*.example.com"}, "cdn.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"api.example.com", "127.0.0.1:*"}, "127.0.0.1:8080", true},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.patterns, tt.host); got != tt.want {
+			t.Errorf("hostAllowed(%q, %q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package proxygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAuditEvents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+	}))
+	defer upstream.Close()
+	file := filepath.Join(t.TempDir(), "audit.log")
+	keyFile := writeTestKeys(t, &APIKey{ID: "ci", Hash: hashKey("ci-secret")})
+	h := newTestHandler(t, `{"audit": {"file": "`+file+`"},
+		"admin": {"address": "127.0.0.1:0", "token": "admin-secret"},
+		"api_keys": {"file": "`+keyFile+`", "required": true},
+		"content_filter": {"deny_types": ["video/*"]},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+
+	tests := []struct {
+		name   string
+		admin  bool
+		method string
+		target string
+		header []string // name, value pairs
+		status int
+		want   *auditEvent // Time is not compared; nil when nothing is recorded
+	}{
+		{
+			name: "missing key", method: http.MethodGet, target: "/api/items", status: http.StatusUnauthorized,
+			want: &auditEvent{Event: auditAuthFailed, ClientIP: "192.0.2.1", ClientID: "192.0.2.1", Method: "GET", Path: "/api/items", Status: 401, Reason: "missing_api_key"},
+		},
+		{
+			name: "invalid key", method: http.MethodGet, target: "/api/items", header: []string{"X-API-Key", "guess"}, status: http.StatusUnauthorized,
+			want: &auditEvent{Event: auditAuthFailed, ClientIP: "192.0.2.1", ClientID: "192.0.2.1", Method: "GET", Path: "/api/items", Status: 401, Reason: "invalid_api_key"},
+		},
+		{
+			name: "content blocked", method: http.MethodGet, target: "/api/movie", header: []string{"X-API-Key", "ci-secret"}, status: http.StatusForbidden,
+			want: &auditEvent{Event: auditRequestDenied, ClientIP: "192.0.2.1", ClientID: "ci", Method: "GET", Path: "/api/movie", Status: 403, Reason: "content_blocked",
+				Details: map[string]string{"detail": "content blocked: content type video/mp4 is not allowed"}},
+		},
+		{
+			name: "admin without token", admin: true, method: http.MethodGet, target: "/keys", status: http.StatusUnauthorized,
+			want: &auditEvent{Event: auditAdminAuthFailed, ClientIP: "192.0.2.1", ClientID: "192.0.2.1", Method: "GET", Path: "/keys", Status: 401},
+		},
+		{
+			name: "admin read", admin: true, method: http.MethodGet, target: "/keys", header: []string{"Authorization", "Bearer admin-secret"}, status: http.StatusOK,
+		},
+		{
+			name: "admin action", admin: true, method: http.MethodPut, target: "/maintenance/api", header: []string{"Authorization", "Bearer admin-secret"}, status: http.StatusOK,
+			want: &auditEvent{Event: auditAdminAction, ClientIP: "192.0.2.1", ClientID: "192.0.2.1", Method: "PUT", Path: "/maintenance/api", Status: 200, Reason: "maintenance_started",
+				Details: map[string]string{"route": "api"}},
+		},
+	}
+	seen := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			w := httptest.NewRecorder()
+			if tt.admin {
+				admin.ServeHTTP(w, r)
+			} else {
+				h.ServeHTTP(w, r)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			events := readAuditLog(t, file)
+			if tt.want == nil {
+				if len(events) != seen {
+					t.Errorf("recorded %+v", events[seen:])
+				}
+				return
+			}
+			if len(events) != seen+1 {
+				t.Fatalf("%d new events, want 1", len(events)-seen)
+			}
+			seen++
+			got := events[len(events)-1]
+			if got.Time.IsZero() {
+				t.Error("event has no time")
+			}
+			got.Time = tt.want.Time
+			if !reflect.DeepEqual(got, *tt.want) {
+				t.Errorf("recorded %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
+
+// readAuditLog parses every event in an audit log file
+func readAuditLog(t *testing.T, path string) []auditEvent {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
@@ -0,0 +1,178 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAuthLeeway tolerates clock skew between the proxy and the issuer
+	defaultAuthLeeway = 30 * time.Second
+	// authFetchTimeout bounds JWKS, discovery and token endpoint requests
+	authFetchTimeout = 10 * time.Second
+)
+
+// AuthConfig gates proxied requests on JWTs from an identity provider
+type AuthConfig struct {
+	JWKSURL      string            `json:"jwks_url"`      // signing keys; discovered from the issuer when OIDC is on
+	Issuer       string            `json:"issuer"`        // required iss claim, when set
+	Audience     []string          `json:"audience"`      // accepted aud values for bearer tokens, when set
+	Required     bool              `json:"required"`      // reject requests that carry no token
+	Leeway       Duration          `json:"leeway"`        // clock skew allowed on exp and nbf; default 30s
+	ClaimHeaders map[string]string `json:"claim_headers"` // claim to upstream header, e.g. {"sub": "X-User-Id"}
+	ForwardToken bool              `json:"forward_token"` // pass the Authorization header on to upstreams
+	OIDC         *OIDCConfig       `json:"oidc,omitempty"`
+}
+
+// authenticator validates bearer tokens and OIDC sessions
+type authenticator struct {
+	issuer       string
+	audience     []string
+	required     bool
+	leeway       time.Duration
+	claimHeaders map[string]string
+	forwardToken bool
+
+	client *http.Client
+	keys   *jwkSet
+	oidc   *oidcFlow // nil without browser login
+
+	rejects *metricVec
+}
+
+// newAuthenticator returns nil when JWT authentication is disabled
+func newAuthenticator(cfg *AuthConfig, metrics *metricsRegistry) (*authenticator, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.JWKSURL == "" && cfg.OIDC == nil {
+		return nil, errors.New("auth: jwks_url is required unless oidc is configured")
+	}
+
+	a := &authenticator{
+		issuer:       strings.TrimSuffix(cfg.Issuer, "/"),
+		audience:     cfg.Audience,
+		required:     cfg.Required,
+		leeway:       time.Duration(cfg.Leeway),
+		claimHeaders: cfg.ClaimHeaders,
+		forwardToken: cfg.ForwardToken,
+		client:       &http.Client{Timeout: authFetchTimeout},
+		rejects:      metrics.counter("proxygo_auth_rejections_total", "Requests rejected by JWT or OIDC authentication.", "reason"),
+	}
+	if a.leeway == 0 {
+		a.leeway = defaultAuthLeeway
+	}
+	a.keys = &jwkSet{client: a.client, locate: func(context.Context) (string, error) { return cfg.JWKSURL, nil }}
+
+	if cfg.OIDC != nil {
+		if cfg.Issuer == "" {
+			return nil, errors.New("auth: oidc requires issuer")
+		}
+		flow, err := newOIDCFlow(cfg.OIDC, a.issuer, a.client)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+		a.oidc = flow
+		if cfg.JWKSURL == "" {
+			a.keys.locate = flow.jwksURL
+		}
+	}
+	return a, nil
+}
+
+// admit authenticates r and copies the configured claims into its headers. It returns
+// nil claims without error for anonymous requests when tokens are optional.
+func (a *authenticator) admit(r *http.Request) (jwtClaims, error) {
+	// Clients must not be able to pose as an authenticated user
+	for _, header := range a.claimHeaders {
+		r.Header.Del(header)
+	}
+
+	token, fromCookie := a.token(r)
+	if token == "" {
+		if a.required {
+			return nil, a.reject("missing_token", http.StatusUnauthorized, "Authentication required")
+		}
+		return nil, nil
+	}
+
+	audience := a.audience
+	if fromCookie {
+		// Sessions hold ID tokens, which are issued to the OIDC client
+		audience = []string{a.oidc.clientID}
+	}
+	claims, err := a.validate(r.Context(), token, audience)
+	if err != nil {
+		var kerr *keyError
+		if errors.As(err, &kerr) {
+			return nil, err
+		}
+		return nil, a.reject("invalid_token", http.StatusUnauthorized, err.Error())
+	}
+
+	for claim, header := range a.claimHeaders {
+		if value, ok := claims.headerValue(claim); ok {
+			r.Header.Set(header, value)
+		}
+	}
+	return claims, nil
+}
+
+// token extracts the bearer token, falling back to the OIDC session cookie, and
+// removes it from the request unless it should reach the upstream
+func (a *authenticator) token(r *http.Request) (string, bool) {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if !a.forwardToken {
+			r.Header.Del("Authorization")
+		}
+		return strings.TrimSpace(token), false
+	}
+	if a.oidc != nil {
+		if token := a.oidc.takeSession(r); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// validate verifies the token signature and its registered claims
+func (a *authenticator) validate(ctx context.Context, token string, audience []string) (jwtClaims, error) {
+	claims, err := verifyJWT(ctx, token, a.keys)
+	if errors.Is(err, errKeysUnavailable) {
+		// Without keys no token can be checked; that is the proxy's problem, not the client's
+		return nil, a.reject("keys_unavailable", http.StatusServiceUnavailable, "Signing keys unavailable")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	exp, ok := claims.timeClaim("exp")
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(a.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims.timeClaim("nbf"); ok && now.Add(a.leeway).Before(nbf) {
+		return nil, errors.New("token not yet valid")
+	}
+	if a.issuer != "" && strings.TrimSuffix(claims.stringClaim("iss"), "/") != a.issuer {
+		return nil, errors.New("token issuer not accepted")
+	}
+	if len(audience) > 0 && !slices.ContainsFunc(claims.audiences(), func(aud string) bool { return slices.Contains(audience, aud) }) {
+		return nil, errors.New("token audience not accepted")
+	}
+	return claims, nil
+}
+
+// reject counts a rejection and builds the error the handler answers with
+func (a *authenticator) reject(code string, status int, message string) error {
+	a.rejects.inc(code)
+	return &keyError{status: status, code: code, message: message}
+}
@@ -0,0 +1,282 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSigningMaxBody = 10 << 20
+	unsignedPayload       = "UNSIGNED-PAYLOAD"
+	defaultIMDSEndpoint   = "http://169.254.169.254"
+	containerCredsHost    = "http://169.254.170.2"
+	// credentialRefreshLead renews temporary credentials this long before they expire
+	credentialRefreshLead = 5 * time.Minute
+)
+
+// errSigningBodyTooLarge is returned when a body is too large to be hashed for signing
+var errSigningBodyTooLarge = errors.New("request body is too large to sign")
+
+// AWSSigningConfig signs requests to a route's upstream with AWS Signature Version 4, so
+// clients without AWS credentials can reach AWS APIs through the proxy. Without static
+// keys, credentials come from the AWS_* environment variables, then the ECS container
+// endpoint, then the EC2 instance role. Static keys may refer to secrets as ${secret:name}.
+type AWSSigningConfig struct {
+	Service         string   `json:"service"`       // signing name, e.g. "execute-api", "s3", "es"
+	Region          string   `json:"region"`        // default AWS_REGION
+	AccessKeyID     string   `json:"access_key_id"` // static credentials; leave empty to use the environment or a role
+	SecretAccessKey string   `json:"secret_access_key"`
+	SessionToken    string   `json:"session_token"`    // for temporary static credentials
+	UnsignedPayload bool     `json:"unsigned_payload"` // S3 only: skip hashing so uploads stream instead of being buffered
+	MaxBody         ByteSize `json:"max_body"`         // bodies are buffered to be hashed; default 10MB
+}
+
+// awsSigner is a compiled AWSSigningConfig
+type awsSigner struct {
+	service, region string
+	unsigned        bool
+	maxBody         int64
+	credentials     *awsCredentialProvider
+	keys            *awsCredentials // static keys referring to secrets, expanded for every request
+}
+
+// newAWSSigner returns nil when the route does not sign its requests
+func newAWSSigner(cfg *AWSSigningConfig) (*awsSigner, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Service == "" {
+		return nil, fmt.Errorf("aws signing: service is required")
+	}
+	s := &awsSigner{service: cfg.Service, region: cfg.Region, unsigned: cfg.UnsignedPayload, maxBody: int64(cfg.MaxBody)}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		return nil, fmt.Errorf("aws signing: region is required when AWS_REGION is not set")
+	}
+	if s.maxBody <= 0 {
+		s.maxBody = defaultSigningMaxBody
+	}
+	switch {
+	case cfg.AccessKeyID != "" && cfg.SecretAccessKey != "" && secretRefs(cfg.AccessKeyID+cfg.SecretAccessKey+cfg.SessionToken) != nil:
+		s.keys = &awsCredentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken}
+	case cfg.AccessKeyID != "" && cfg.SecretAccessKey != "":
+		s.credentials = &awsCredentialProvider{static: &awsCredentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken}}
+	case cfg.AccessKeyID != "" || cfg.SecretAccessKey != "":
+		return nil, fmt.Errorf("aws signing: access_key_id and secret_access_key go together")
+	default:
+		s.credentials = defaultAWSCredentials
+	}
+	return s, nil
+}
+
+// signingTransport signs each request, and each hedged attempt, just before it is sent
+type signingTransport struct {
+	http.RoundTripper
+	signer  *awsSigner
+	secrets *secretStore
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := t.signer.retrieve(req.Context(), t.secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	payloadHash := emptyPayloadHash
+	switch {
+	case t.signer.unsigned:
+		payloadHash = unsignedPayload
+	case req.Body != nil && req.Body != http.NoBody:
+		body, err := io.ReadAll(io.LimitReader(req.Body, t.signer.maxBody+1))
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > t.signer.maxBody {
+			return nil, fmt.Errorf("%w: limit is %d bytes", errSigningBodyTooLarge, t.signer.maxBody)
+		}
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+		out.ContentLength = int64(len(body))
+	}
+
+	// Send the path exactly as it is signed; the client's own credentials give way to ours
+	out.URL.RawPath = awsURIEscape(out.URL.Path, false)
+	out.Header.Del("Authorization")
+	creds.signV4(out, t.signer.region, t.signer.service, payloadHash, time.Now())
+	return t.RoundTripper.RoundTrip(out)
+}
+
+// retrieve returns the credentials to sign the next request with
+func (s *awsSigner) retrieve(ctx context.Context, secrets *secretStore) (awsCredentials, error) {
+	if s.keys == nil {
+		return s.credentials.retrieve(ctx)
+	}
+	var creds awsCredentials
+	var err error
+	for _, key := range []struct {
+		dst *string
+		src string
+	}{
+		{&creds.AccessKeyID, s.keys.AccessKeyID},
+		{&creds.SecretAccessKey, s.keys.SecretAccessKey},
+		{&creds.SessionToken, s.keys.SessionToken},
+	} {
+		if *key.dst, err = secrets.expand(key.src); err != nil {
+			return awsCredentials{}, fmt.Errorf("aws credentials: %w", err)
+		}
+	}
+	return creds, nil
+}
+
+// defaultAWSCredentials is shared by every signer without static keys, so routes share
+// one cached set of role credentials
+var defaultAWSCredentials = &awsCredentialProvider{}
+
+// awsCredentialProvider hands out static credentials, or looks up and caches them
+type awsCredentialProvider struct {
+	static *awsCredentials
+
+	mu      sync.Mutex
+	cached  awsCredentials
+	expires time.Time // zero for credentials that do not expire
+	loaded  bool
+}
+
+// retrieve returns credentials valid for at least a few more minutes
+func (p *awsCredentialProvider) retrieve(ctx context.Context) (awsCredentials, error) {
+	if p.static != nil {
+		return *p.static, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loaded && (p.expires.IsZero() || time.Until(p.expires) > credentialRefreshLead) {
+		return p.cached, nil
+	}
+
+	creds, expires, err := lookupAWSCredentials(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("aws credentials: %w", err)
+	}
+	p.cached, p.expires, p.loaded = creds, expires, true
+	return creds, nil
+}
+
+// lookupAWSCredentials follows the usual AWS chain: environment, container endpoint, instance role
+func lookupAWSCredentials(ctx context.Context) (awsCredentials, time.Time, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, time.Time{}, nil
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{}}
+	if uri := containerCredentialsURI(); uri != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		return fetchRoleCredentials(client, req)
+	}
+
+	// EC2 instance metadata, IMDSv2: a session token first, then the role's credentials
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = defaultIMDSEndpoint
+	}
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	tokenReq.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := metadataText(client, tokenReq)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("no credentials in the environment and no instance metadata: %w", err)
+	}
+
+	rolesReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	rolesReq.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	roles, err := metadataText(client, rolesReq)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("instance role: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(roles), "\n")
+	if role == "" {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("the instance has no role attached")
+	}
+
+	credsReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/"+role, nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	credsReq.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	return fetchRoleCredentials(client, credsReq)
+}
+
+// containerCredentialsURI returns the ECS credentials endpoint, if the task has one
+func containerCredentialsURI() string {
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		return containerCredsHost + rel
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// metadataText returns the body of a successful metadata response
+func metadataText(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return string(body), nil
+}
+
+// fetchRoleCredentials reads the JSON credentials document that the container and
+// instance endpoints both serve
+func fetchRoleCredentials(client *http.Client, req *http.Request) (awsCredentials, time.Time, error) {
+	body, err := metadataText(client, req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	var doc struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("credentials document: %w", err)
+	}
+	if doc.AccessKeyID == "" || doc.SecretAccessKey == "" {
+		return awsCredentials{}, time.Time{}, fmt.Errorf("credentials document has no keys")
+	}
+	return awsCredentials{AccessKeyID: doc.AccessKeyID, SecretAccessKey: doc.SecretAccessKey, SessionToken: doc.Token}, doc.Expiration, nil
+}
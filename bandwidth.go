@@ -0,0 +1,190 @@
+package proxygo
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bucketIdleTTL is how long an unused client bucket is kept before being forgotten
+const bucketIdleTTL = 5 * time.Minute
+
+// BandwidthConfig caps response bandwidth per client
+type BandwidthConfig struct {
+	Rate    ByteSize            `json:"rate"`    // bytes per second per client, 0 disables the cap
+	Burst   ByteSize            `json:"burst"`   // bucket size, defaults to one second worth of Rate
+	Clients map[string]ByteSize `json:"clients"` // per-client rate overrides keyed by client ID
+}
+
+// rateFor returns the rate and burst that apply to client
+func (c *BandwidthConfig) rateFor(client string) (rate, burst float64) {
+	r := c.Rate
+	if override, ok := c.Clients[client]; ok {
+		r = override
+	}
+	b := c.Burst
+	if b < r {
+		b = r
+	}
+	return float64(r), float64(b)
+}
+
+// tokenBucket is a classic token bucket refilled continuously at rate tokens per second
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now, lastUsed: now}
+}
+
+// setRate changes the bucket parameters in place so in-flight responses pick them up
+func (b *tokenBucket) setRate(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate, b.burst = rate, burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// reserve takes up to max tokens, returning how many it got and how long to wait if none were available
+func (b *tokenBucket) reserve(max int) (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.lastUsed = now
+
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+
+	n := max
+	if float64(n) > b.tokens {
+		n = int(b.tokens)
+	}
+	b.tokens -= float64(n)
+	return n, 0
+}
+
+// bandwidthLimiter tracks one bucket per client; its limits can be swapped at runtime
+type bandwidthLimiter struct {
+	mu        sync.Mutex
+	cfg       BandwidthConfig
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newBandwidthLimiter creates a limiter for cfg, which may be nil
+func newBandwidthLimiter(cfg *BandwidthConfig) *bandwidthLimiter {
+	l := &bandwidthLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+	l.update(cfg)
+	return l
+}
+
+// update applies new limits, adjusting existing client buckets in place
+func (l *bandwidthLimiter) update(cfg *BandwidthConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg == nil {
+		cfg = &BandwidthConfig{}
+	}
+	l.cfg = *cfg
+
+	for client, b := range l.buckets {
+		rate, burst := l.cfg.rateFor(client)
+		if rate <= 0 {
+			delete(l.buckets, client)
+			continue
+		}
+		b.setRate(rate, burst)
+	}
+}
+
+// bucketFor returns the client's bucket, or nil when the client is unlimited
+func (l *bandwidthLimiter) bucketFor(client string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > bucketIdleTTL {
+		l.sweep(now)
+	}
+
+	if b, ok := l.buckets[client]; ok {
+		return b
+	}
+
+	rate, burst := l.cfg.rateFor(client)
+	if rate <= 0 {
+		return nil
+	}
+	b := newTokenBucket(rate, burst)
+	l.buckets[client] = b
+	return b
+}
+
+// sweep forgets buckets that have not been used recently; callers hold l.mu
+func (l *bandwidthLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		b.mu.Lock()
+		idle := now.Sub(b.lastUsed) > bucketIdleTTL
+		b.mu.Unlock()
+		if idle {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// limitedWriter paces response body writes through a token bucket
+type limitedWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+// Write sends p as fast as the bucket allows, giving up if the client goes away
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, wait := w.bucket.reserve(len(p) - written)
+		if n == 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-w.ctx.Done():
+				timer.Stop()
+				return written, w.ctx.Err()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		m, err := w.ResponseWriter.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *limitedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
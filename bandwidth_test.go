@@ -0,0 +1,90 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthRateFor(t *testing.T) {
+	cfg := &BandwidthConfig{Rate: 1000, Burst: 4000, Clients: map[string]ByteSize{"big": 8000, "free": 0, "small": 10}}
+	tests := []struct {
+		client       string
+		rate, burst  float64
+		hasBucket    bool
+		updatedRate  float64 // after the default rate is removed
+		updatedBurst float64
+	}{
+		{client: "192.0.2.1", rate: 1000, burst: 4000, hasBucket: true},
+		{client: "big", rate: 8000, burst: 8000, hasBucket: true, updatedRate: 8000, updatedBurst: 8000},
+		{client: "small", rate: 10, burst: 4000, hasBucket: true, updatedRate: 10, updatedBurst: 10},
+		{client: "free", burst: 4000},
+	}
+	l := newBandwidthLimiter(cfg)
+	for _, tt := range tests {
+		rate, burst := cfg.rateFor(tt.client)
+		if rate != tt.rate || burst != tt.burst {
+			t.Errorf("%s: rate %v burst %v, want %v and %v", tt.client, rate, burst, tt.rate, tt.burst)
+		}
+		if b := l.bucketFor(tt.client); (b != nil) != tt.hasBucket {
+			t.Errorf("%s: bucket %v, want one %v", tt.client, b, tt.hasBucket)
+		}
+	}
+
+	// A reload adjusts the buckets in place and drops those of clients now unlimited
+	l.update(&BandwidthConfig{Clients: map[string]ByteSize{"big": 8000, "small": 10}})
+	for _, tt := range tests {
+		l.mu.Lock()
+		b := l.buckets[tt.client]
+		l.mu.Unlock()
+		if (b != nil) != (tt.updatedRate > 0) {
+			t.Errorf("%s: bucket %v after reload, want one %v", tt.client, b, tt.updatedRate > 0)
+			continue
+		}
+		if b != nil && (b.rate != tt.updatedRate || b.burst != tt.updatedBurst || b.tokens > b.burst) {
+			t.Errorf("%s: rate %v burst %v tokens %v after reload, want %v and %v", tt.client, b.rate, b.burst, b.tokens, tt.updatedRate, tt.updatedBurst)
+		}
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(100, 10)
+	tests := []struct {
+		max  int
+		got  int
+		wait bool
+	}{
+		{max: 4, got: 4},
+		{max: 20, got: 6},
+		{max: 1, got: 0, wait: true},
+	}
+	for i, tt := range tests {
+		n, wait := b.reserve(tt.max)
+		if n != tt.got || (wait > 0) != tt.wait || wait > 10*time.Millisecond {
+			t.Errorf("reserve #%d(%d) = %d, %v; want %d, waiting %v", i, tt.max, n, wait, tt.got, tt.wait)
+		}
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	// 1KB of burst, then 10KB/s: 3KB takes at least 200ms
+	w := &limitedWriter{ResponseWriter: httptest.NewRecorder(), ctx: context.Background(), bucket: newTokenBucket(10<<10, 1<<10)}
+	start := time.Now()
+	if n, err := w.Write(make([]byte, 3<<10)); n != 3<<10 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("3KB written in %v, faster than the rate allows", elapsed)
+	}
+
+	// A client that goes away stops the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w = &limitedWriter{ResponseWriter: httptest.NewRecorder(), ctx: ctx, bucket: newTokenBucket(1, 1)}
+	n, err := w.Write(make([]byte, 100))
+	if n != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Write = %d, %v; want 1 byte and the context's error", n, err)
+	}
+}
@@ -0,0 +1,195 @@
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultBodySampleBytes is how much of each body is logged when max_bytes is not set
+const defaultBodySampleBytes = 1 << 10
+
+// redactedValue replaces sensitive values in sampled bodies and headers
+const redactedValue = "[redacted]"
+
+// BodySampleConfig adds the start of request and response bodies to access log lines,
+// for a share of requests and optionally for every error response
+type BodySampleConfig struct {
+	MaxBytes      ByteSize `json:"max_bytes"`      // bytes logged of each body; default 1KB
+	Percent       float64  `json:"percent"`        // share of requests sampled, 0 to 100
+	Errors        bool     `json:"errors"`         // also sample every response with a 4xx or 5xx status
+	Headers       bool     `json:"headers"`        // log the request and response headers of sampled requests too
+	RedactHeaders []string `json:"redact_headers"` // headers logged as [redacted], besides Authorization, Proxy-Authorization, Cookie, Set-Cookie and those carrying the proxy's credentials
+	RedactFields  []string `json:"redact_fields"`  // JSON and form fields whose values are logged as [redacted], e.g. ["password", "card_number"]
+}
+
+// Headers whose values are never logged
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// bodySampler decides which requests have their bodies logged and formats them
+type bodySampler struct {
+	limit         int
+	percent       float64
+	errors        bool
+	headers       bool
+	redactHeaders map[string]bool
+	redactFields  []fieldRedaction
+
+	// Headers carrying the proxy's own credentials, which follow config reloads
+	credentialHeaders atomic.Pointer[map[string]bool]
+}
+
+// fieldRedaction masks the value of one field wherever it appears in a body
+type fieldRedaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newBodySampler returns nil when body sampling is disabled
+func newBodySampler(cfg *BodySampleConfig) (*bodySampler, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return nil, fmt.Errorf("logging.body_sample: percent must be between 0 and 100")
+	}
+	if cfg.Percent == 0 && !cfg.Errors {
+		return nil, fmt.Errorf("logging.body_sample: set percent or errors")
+	}
+	if cfg.MaxBytes < 0 {
+		return nil, fmt.Errorf("logging.body_sample: max_bytes must not be negative")
+	}
+	s := &bodySampler{
+		limit:         int(cfg.MaxBytes),
+		percent:       cfg.Percent,
+		errors:        cfg.Errors,
+		headers:       cfg.Headers,
+		redactHeaders: make(map[string]bool),
+	}
+	if s.limit == 0 {
+		s.limit = defaultBodySampleBytes
+	}
+	s.credentialHeaders.Store(&map[string]bool{})
+	for _, name := range append(defaultRedactedHeaders, cfg.RedactHeaders...) {
+		s.redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, field := range cfg.RedactFields {
+		if field == "" {
+			return nil, fmt.Errorf("logging.body_sample: redact_fields must not be empty")
+		}
+		// Regular expressions rather than parsing, so bodies cut off at max_bytes are masked too
+		s.redactFields = append(s.redactFields,
+			fieldRedaction{
+				pattern:     regexp.MustCompile(`(?i)("` + regexp.QuoteMeta(field) + `"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`),
+				replacement: `${1}"` + redactedValue + `"`,
+			},
+			fieldRedaction{
+				pattern:     regexp.MustCompile(`(?i)((?:^|&)` + regexp.QuoteMeta(url.QueryEscape(field)) + `=)[^&]*`),
+				replacement: `${1}` + redactedValue,
+			})
+	}
+	return s, nil
+}
+
+// sample reports whether a starting request is sampled, and whether its bodies have to
+// be captured anyway because an error response would be sampled
+func (s *bodySampler) sample() (sampled, capture bool) {
+	sampled = s.percent >= 100 || rand.Float64()*100 < s.percent
+	return sampled, sampled || s.errors
+}
+
+// sampleReader keeps the first bytes the proxy reads from a request body
+type sampleReader struct {
+	io.ReadCloser
+	sample []byte
+	limit  int
+}
+
+// Read implements io.Reader
+func (r *sampleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if keep := min(n, r.limit-len(r.sample)); keep > 0 {
+		r.sample = append(r.sample, p[:keep]...)
+	}
+	return n, err
+}
+
+// format returns the access log fields for a sampled request. Only the part of the
+// request body the proxy read is known, which is all of it up to the limit for
+// requests that were forwarded.
+func (s *bodySampler) format(reqHeader http.Header, reqBody []byte, respHeader http.Header, respBody []byte) string {
+	var b strings.Builder
+	b.WriteString(" req_body=" + s.body(reqHeader, reqBody))
+	b.WriteString(" resp_body=" + s.body(respHeader, respBody))
+	if s.headers {
+		b.WriteString(" req_headers=" + s.header(reqHeader))
+		b.WriteString(" resp_headers=" + s.header(respHeader))
+	}
+	return b.String()
+}
+
+// body quotes a body sample with its sensitive fields masked
+func (s *bodySampler) body(header http.Header, sample []byte) string {
+	// Compressed bytes say nothing in a log line
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return "<" + encoding + ">"
+	}
+	text := string(sample)
+	for _, f := range s.redactFields {
+		text = f.pattern.ReplaceAllString(text, f.replacement)
+	}
+	return strconv.Quote(text)
+}
+
+// header quotes a header set as "Name: value; Name: value" with sensitive values masked
+func (s *bodySampler) header(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		canonical := http.CanonicalHeaderKey(name)
+		if s.redactHeaders[canonical] || (*s.credentialHeaders.Load())[canonical] {
+			value = redactedValue
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strconv.Quote(strings.Join(parts, "; "))
+}
+
+// updateSampleRedaction redacts the headers the proxy reads or sends credentials in: the
+// dry-run token, the API key header, forwarded identities and every route's
+// upstream_headers. Called again on reloads, as tenant routes change.
+func (h *ProxyHandler) updateSampleRedaction() {
+	if h.bodySample == nil {
+		return
+	}
+	names := map[string]bool{dryRunHeader: true}
+	if h.keys != nil {
+		names[http.CanonicalHeaderKey(h.keys.header)] = true
+	}
+	if h.identity != nil {
+		if h.identity.signedHeader != "" {
+			names[http.CanonicalHeaderKey(h.identity.signedHeader)] = true
+		}
+		for _, ih := range h.identity.headers {
+			names[http.CanonicalHeaderKey(ih.name)] = true
+		}
+	}
+	for _, route := range h.allRoutes() {
+		for _, uh := range route.UpstreamHeaders {
+			names[uh.name] = true
+		}
+	}
+	h.bodySample.credentialHeaders.Store(&names)
+}
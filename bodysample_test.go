@@ -0,0 +1,54 @@
+package proxygo
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodySampleRedactsCredentialHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An upstream echoing the credential it was sent
+		w.Header().Set("X-Upstream-Token", r.Header.Get("X-Upstream-Token"))
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	h := newTestHandler(t, `{
+		"logging": {"body_sample": {"percent": 100, "headers": true, "redact_headers": ["X-Custom-Secret"]}},
+		"identity": {"headers": {"X-Auth-User": "user"}, "signed_header": "X-Proxygo-Identity", "signing_key": "k"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`",
+			"upstream_headers": {"X-Upstream-Token": "upstream-secret"}}]
+	}`)
+	var logged bytes.Buffer
+	h.accessLog.SetOutput(&logged)
+
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	sent := map[string]string{
+		"Authorization":      "Bearer client-secret",
+		"X-Proxygo-Dry-Run":  "admin-secret",
+		"X-Auth-User":        "spoofed-secret",
+		"X-Proxygo-Identity": "forged-secret",
+		"X-Upstream-Token":   "client-copy-secret",
+		"X-Custom-Secret":    "custom-secret",
+		"X-Visible":          "shown",
+	}
+	for name, value := range sent {
+		req.Header.Set(name, value)
+	}
+	accessLogMiddleware(h)(h).ServeHTTP(httptest.NewRecorder(), req)
+
+	line := logged.String()
+	if !strings.Contains(line, "X-Visible: shown") {
+		t.Fatalf("no sampled headers in %q", line)
+	}
+	if strings.Contains(line, "secret") {
+		t.Errorf("a credential was logged: %s", line)
+	}
+	for name := range sent {
+		if name != "X-Visible" && !strings.Contains(line, name+": "+redactedValue) {
+			t.Errorf("%s is not logged as %s: %s", name, redactedValue, line)
+		}
+	}
+}
@@ -0,0 +1,711 @@
+package proxygo
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache size defaults
+const (
+	defaultCacheMaxSize      = 256 << 20
+	defaultCacheMaxEntrySize = 8 << 20
+)
+
+// identityEncoding names the cache variant of responses without Content-Encoding
+const identityEncoding = "identity"
+
+// CacheConfig enables the in-memory response cache
+type CacheConfig struct {
+	Enabled      bool            `json:"enabled"`
+	MaxSize      ByteSize        `json:"max_size"`       // total body bytes kept, default 256MB
+	MaxEntrySize ByteSize        `json:"max_entry_size"` // largest cacheable body, default 8MB
+	DefaultTTL   Duration        `json:"default_ttl"`    // freshness for responses without caching headers; 0 leaves them uncached
+	Revalidate   bool            `json:"revalidate"`     // always revalidate stored responses with the origin before serving them
+	Prewarm      []PrewarmConfig `json:"prewarm"`        // URLs fetched at startup and kept pinned in the cache
+
+	// Negative keeps 404, 429 and 5xx responses from the upstream briefly; routes can
+	// replace it with their own negative_cache
+	Negative *NegativeCacheConfig `json:"negative,omitempty"`
+}
+
+// cacheEntry is one stored response
+type cacheEntry struct {
+	key      string
+	base     string   // the resource, shared by its encoding variants
+	tags     []string // surrogate keys the origin labelled the response with
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+	pinned   bool          // pinned entries are never evicted and are served even when stale
+	negative bool          // an error response, served until it expires and never revalidated
+	elem     *list.Element // position in the LRU list; nil for pinned entries
+}
+
+// responseCache is a size-bounded LRU cache of upstream responses
+type responseCache struct {
+	maxSize    int64
+	maxEntry   int64
+	defaultTTL time.Duration
+	revalidate bool
+	negative   *negativePolicy // nil when error responses are not cached
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	variants map[string][]*cacheEntry // entries by resource
+	lru      *list.List               // unpinned entries, most recently used at the front
+	size     int64
+
+	lookups        *metricVec
+	notModified    *metricVec
+	negativeStored *metricVec
+}
+
+// newResponseCache returns nil when caching is disabled
+func newResponseCache(cfg *CacheConfig, metrics *metricsRegistry) (*responseCache, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	negative, err := newNegativePolicy(cfg.Negative)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+
+	c := &responseCache{
+		maxSize:    int64(cfg.MaxSize),
+		maxEntry:   int64(cfg.MaxEntrySize),
+		defaultTTL: time.Duration(cfg.DefaultTTL),
+		revalidate: cfg.Revalidate,
+		negative:   negative,
+		entries:    make(map[string]*cacheEntry),
+		variants:   make(map[string][]*cacheEntry),
+		lru:        list.New(),
+		lookups:    metrics.counter("proxygo_cache_lookups_total", "Cache lookups by result.", "result"),
+		notModified: metrics.counter("proxygo_cache_not_modified_total",
+			"Cached responses answered with 304 because the client already held them."),
+		negativeStored: metrics.counter("proxygo_cache_negative_stored_total",
+			"Upstream error responses stored by negative caching, by status class.", "class"),
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultCacheMaxSize
+	}
+	if c.maxEntry <= 0 {
+		c.maxEntry = defaultCacheMaxEntrySize
+	}
+
+	metrics.gaugeFunc("proxygo_cache_bytes", "Body bytes held in the response cache.", nil, func() []sample {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return []sample{{value: float64(c.size)}}
+	})
+	metrics.gaugeFunc("proxygo_cache_entries", "Responses held in the response cache.", nil, func() []sample {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return []sample{{value: float64(len(c.entries))}}
+	})
+	return c, nil
+}
+
+// cacheableRequest reports whether r may be answered from, or stored in, the shared cache.
+// Range requests qualify too: ranges are cut from the stored full response.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// Responses to credentialed requests are private to that client
+	return r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == ""
+}
+
+// cacheBaseKey identifies the upstream resource a request addresses, as route|socket|resource.
+// Routes to the same upstream keep separate entries, even when they share a name: each
+// may send its own credentials and filter or rewrite what comes back.
+func cacheBaseKey(r *http.Request, target *proxyTarget) string {
+	resource := target.URL.Scheme + "://" + target.URL.Host + target.Path + "?" + r.URL.RawQuery
+	return routeIdentity(target) + "|" + upstreamResource(target, resource)
+}
+
+// upstreamResource names a resource on target's upstream regardless of the route reaching it
+func upstreamResource(target *proxyTarget, resource string) string {
+	return target.Socket + "|" + resource
+}
+
+// cacheKeyFor names the stored variant of a resource for a content encoding
+func cacheKeyFor(base, encoding string) string {
+	return base + "|" + encoding
+}
+
+// acceptedEncodings lists the content codings r accepts, identity last
+func acceptedEncodings(r *http.Request) []string {
+	var out []string
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" || coding == identityEncoding || coding == "*" {
+			continue
+		}
+		// Skip codings the client explicitly refuses with q=0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		out = append(out, coding)
+	}
+	return append(out, identityEncoding)
+}
+
+// lookup finds the stored variant for r, preferring encodings the client accepts.
+// A stale entry is only returned when it can be revalidated, with fresh set to false.
+func (c *responseCache) lookup(r *http.Request, base string) (entry *cacheEntry, fresh bool) {
+	// Honor client requests for an end-to-end reload
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") || r.Header.Get("Pragma") == "no-cache" {
+		c.lookups.inc("bypass")
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, enc := range acceptedEncodings(r) {
+		e, ok := c.entries[cacheKeyFor(base, enc)]
+		if !ok {
+			continue
+		}
+
+		fresh := e.pinned || ((!c.revalidate || e.negative) && now.Before(e.expires))
+		if !fresh && (e.negative || !hasValidators(e.header)) {
+			c.removeLocked(e)
+			continue
+		}
+		if e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+		if fresh {
+			c.lookups.inc("hit")
+		}
+		return e, fresh
+	}
+	c.lookups.inc("miss")
+	return nil, false
+}
+
+// storeResponse caches a completed response if its headers allow it
+func (c *responseCache) storeResponse(base string, status int, header http.Header, body []byte) {
+	if status != http.StatusOK || int64(len(body)) > c.maxEntry {
+		return
+	}
+	// Stale-on-arrival responses are still worth keeping when they can be revalidated cheaply
+	ttl := freshnessLifetime(header, time.Now(), c.defaultTTL)
+	if !cacheStorable(header) || (ttl <= 0 && !hasValidators(header)) {
+		// The origin no longer lets the resource be cached, so older copies must not be served either
+		c.invalidate(base)
+		return
+	}
+	c.put(base, status, header, body, time.Now().Add(ttl), false)
+}
+
+// invalidate drops every unpinned variant of the resource base
+func (c *responseCache) invalidate(base string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateLocked(base)
+}
+
+// invalidateLocked is invalidate for callers holding c.mu
+func (c *responseCache) invalidateLocked(base string) {
+	for _, e := range slices.Clone(c.variants[base]) {
+		if !e.pinned {
+			c.removeLocked(e)
+		}
+	}
+}
+
+// invalidateUpstream drops the unpinned copies of upstream resources, as named by
+// upstreamResource, whichever routes stored them
+func (c *responseCache) invalidateUpstream(resources []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for base := range c.variants {
+		if _, resource, _ := strings.Cut(base, "|"); slices.Contains(resources, resource) {
+			c.invalidateLocked(base)
+		}
+	}
+}
+
+// put stores an entry under the variant named by its Content-Encoding
+func (c *responseCache) put(base string, status int, header http.Header, body []byte, expires time.Time, pinned bool) {
+	enc := strings.ToLower(header.Get("Content-Encoding"))
+	if enc == "" {
+		enc = identityEncoding
+	}
+	key := cacheKeyFor(base, enc)
+
+	e := &cacheEntry{
+		key:      key,
+		base:     base,
+		tags:     strings.Fields(header.Get("Surrogate-Key")),
+		status:   status,
+		header:   stripCacheHopHeaders(header),
+		body:     body,
+		storedAt: time.Now(),
+		expires:  expires,
+		pinned:   pinned,
+		negative: status >= http.StatusBadRequest,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		// A fetched response never displaces a pinned one; only the prewarmer refreshes those
+		if old.pinned && !pinned {
+			return
+		}
+		c.removeLocked(old)
+	}
+
+	c.entries[key] = e
+	c.variants[base] = append(c.variants[base], e)
+	c.size += int64(len(body))
+	if !pinned {
+		e.elem = c.lru.PushFront(e)
+	}
+
+	// Evict least recently used unpinned entries until we fit
+	for c.size > c.maxSize {
+		back := c.lru.Back()
+		if back == nil {
+			break
+		}
+		c.removeLocked(back.Value.(*cacheEntry))
+	}
+}
+
+// removeLocked drops e from the cache; callers hold c.mu
+func (c *responseCache) removeLocked(e *cacheEntry) {
+	if e.elem != nil {
+		c.lru.Remove(e.elem)
+		e.elem = nil
+	}
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.body))
+		if variants := slices.DeleteFunc(c.variants[e.base], func(v *cacheEntry) bool { return v == e }); len(variants) > 0 {
+			c.variants[e.base] = variants
+		} else {
+			delete(c.variants, e.base)
+		}
+	}
+}
+
+// serve writes a stored entry, answering 304 when the client already holds it.
+// result is reported in the X-Cache header.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, result string) {
+	for k, vv := range e.header {
+		w.Header()[k] = append([]string(nil), vv...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.storedAt).Seconds())))
+	w.Header().Set("X-Cache", result)
+
+	if !e.negative && clientHasCurrent(r, e.header) {
+		c.notModified.inc()
+		// A 304 carries the validators and caching headers but no body metadata
+		for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding", contentSHA256Header} {
+			w.Header().Del(name)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// ServeContent cuts the range, answers 416 for unsatisfiable ones and honours If-Range
+	if r.Header.Get("Range") != "" && e.status == http.StatusOK {
+		// The digest describes the whole body, not a slice of it
+		w.Header().Del(contentSHA256Header)
+		w.Header().Del("Content-Length")
+		modified, _ := http.ParseTime(e.header.Get("Last-Modified"))
+		http.ServeContent(w, r, "", modified, bytes.NewReader(e.body))
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// stripCacheHopHeaders copies h without the headers that must not be replayed from a cache
+func stripCacheHopHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Set-Cookie", "X-Cache", "Age"} {
+		out.Del(name)
+	}
+	return out
+}
+
+// cacheStorable reports whether a response may be kept in a shared cache at all
+func cacheStorable(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	// Variants beyond the content encoding are not tracked
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+
+	directives := parseCacheControl(h.Get("Cache-Control"))
+	_, noStore := directives["no-store"]
+	_, private := directives["private"]
+	return !noStore && !private
+}
+
+// freshnessLifetime derives how long a stored response may be served without revalidation
+func freshnessLifetime(h http.Header, now time.Time, defaultTTL time.Duration) time.Duration {
+	directives := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[name]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+
+	if exp := h.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return max(expires.Sub(date), 0)
+	}
+
+	return defaultTTL
+}
+
+// hasValidators reports whether a response can be revalidated with a conditional request
+func hasValidators(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// parseCacheControl splits a Cache-Control header into lower-cased directives
+func parseCacheControl(v string) map[string]string {
+	out := map[string]string{}
+	for _, part := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		out[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return out
+}
+
+// clientHasCurrent evaluates the client's conditional headers against a stored response
+func clientHasCurrent(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, h.Get("ETag"))
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(h.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// etagMatches applies the weak comparison If-None-Match requires
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh replaces e with a copy updated from a 304's headers, as RFC 9111 section 4.3.4 describes
+func (c *responseCache) refresh(e *cacheEntry, base string, notModified http.Header) *cacheEntry {
+	header := e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+		if vv := notModified.Values(name); len(vv) > 0 {
+			header[http.CanonicalHeaderKey(name)] = vv
+		}
+	}
+
+	expires := time.Now().Add(freshnessLifetime(header, time.Now(), c.defaultTTL))
+	c.put(base, e.status, header, e.body, expires, e.pinned)
+	return &cacheEntry{status: e.status, header: header, body: e.body, storedAt: time.Now(), expires: expires}
+}
+
+// revalidate asks the origin whether a stale entry is still current. A 304 refreshes
+// the entry and serves it; any other response is passed through and stored as usual.
+func (h *ProxyHandler) revalidate(w http.ResponseWriter, r *http.Request, target *proxyTarget, base string, entry *cacheEntry) {
+	// The origin is asked about our copy, not whatever the client holds
+	out := r.Clone(r.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if etag := entry.header.Get("ETag"); etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if modified := entry.header.Get("Last-Modified"); modified != "" {
+		out.Header.Set("If-Modified-Since", modified)
+	}
+
+	rw := &revalidateWriter{ResponseWriter: w, header: http.Header{}}
+	capture := &captureWriter{ResponseWriter: rw, limit: h.cache.maxEntry}
+	h.serveProxy(capture, out, target, false)
+	if r.Context().Err() != nil {
+		return
+	}
+
+	if rw.notModified {
+		h.cache.lookups.inc("revalidated")
+		h.cache.serve(w, r, h.cache.refresh(entry, base, rw.header), "REVALIDATED")
+		return
+	}
+	h.cache.lookups.inc("changed")
+	if r.Method == http.MethodGet && capture.shareable() {
+		h.cache.storeResponse(base, capture.status, capture.header, capture.buf.Bytes())
+	}
+}
+
+// revalidateWriter holds back the upstream response until its status is known,
+// swallowing a 304 so the cached body can be served in its place
+type revalidateWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	passthrough bool
+	notModified bool
+}
+
+// Header implements http.ResponseWriter
+func (rw *revalidateWriter) Header() http.Header {
+	if rw.passthrough {
+		return rw.ResponseWriter.Header()
+	}
+	return rw.header
+}
+
+// WriteHeader forwards every status except 304
+func (rw *revalidateWriter) WriteHeader(code int) {
+	if rw.passthrough || rw.notModified {
+		return
+	}
+	if code == http.StatusNotModified {
+		rw.notModified = true
+		return
+	}
+
+	rw.passthrough = true
+	for k, vv := range rw.header {
+		rw.ResponseWriter.Header()[k] = vv
+	}
+	rw.ResponseWriter.Header().Set("X-Cache", "MISS")
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (rw *revalidateWriter) Write(p []byte) (int, error) {
+	if !rw.passthrough && !rw.notModified {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.notModified {
+		return len(p), nil
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// FlushError keeps a swallowed 304 from reaching the client as an implicit 200
+func (rw *revalidateWriter) FlushError() error {
+	if !rw.passthrough {
+		return nil
+	}
+	return http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *revalidateWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// cacheStats summarizes cache effectiveness for the dashboard
+type cacheStats struct {
+	Entries  int     `json:"entries"`
+	Bytes    int64   `json:"bytes"`
+	Hits     float64 `json:"hits"`
+	Misses   float64 `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// stats reads the current cache size and lookup counters
+func (c *responseCache) stats() cacheStats {
+	c.mu.Lock()
+	s := cacheStats{Entries: len(c.entries), Bytes: c.size}
+	c.mu.Unlock()
+
+	// Revalidated entries still saved the body transfer
+	s.Hits = c.lookups.value("hit") + c.lookups.value("revalidated")
+	s.Misses = c.lookups.value("miss") + c.lookups.value("changed") + c.lookups.value("bypass")
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRatio = s.Hits / total
+	}
+	return s
+}
+
+// cachePurge selects the entries a purge drops: those matching any of its selectors, or
+// every unpinned entry when it has none. Selected entries go even when pinned.
+type cachePurge struct {
+	URLs     []string `json:"urls,omitempty"`     // exact upstream URLs, query included
+	Prefixes []string `json:"prefixes,omitempty"` // upstream URL prefixes such as "https://api.example.com/v1/"
+	Hosts    []string `json:"hosts,omitempty"`    // upstream hosts, with or without the port
+	Keys     []string `json:"keys,omitempty"`     // surrogate keys from the origin's Surrogate-Key header
+}
+
+// all reports whether p purges the whole cache
+func (p cachePurge) all() bool {
+	return len(p.URLs) == 0 && len(p.Prefixes) == 0 && len(p.Hosts) == 0 && len(p.Keys) == 0
+}
+
+// matches reports whether p selects e
+func (p cachePurge) matches(e *cacheEntry) bool {
+	// The base is route|socket|scheme://host/path?query
+	_, rest, _ := strings.Cut(e.base, "|")
+	_, resource, _ := strings.Cut(rest, "|")
+	if slices.Contains(p.URLs, resource) {
+		return true
+	}
+	if slices.ContainsFunc(p.Prefixes, func(prefix string) bool { return strings.HasPrefix(resource, prefix) }) {
+		return true
+	}
+	if len(p.Hosts) > 0 {
+		_, rest, _ := strings.Cut(resource, "://")
+		host, _, _ := strings.Cut(rest, "/")
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		if slices.ContainsFunc(p.Hosts, func(want string) bool {
+			return strings.EqualFold(want, host) || strings.EqualFold(want, hostname)
+		}) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(e.tags, func(tag string) bool { return slices.Contains(p.Keys, tag) })
+}
+
+// purge drops the entries p selects and reports how many were removed
+func (c *responseCache) purge(p cachePurge) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, e := range c.entries {
+		if (p.all() && !e.pinned) || (!p.all() && p.matches(e)) {
+			c.removeLocked(e)
+			n++
+		}
+	}
+	return n
+}
+
+// parseCachePurge reads the url, prefix, host and key selectors of a purge request.
+// URLs are normalized to the form entries are stored under.
+func parseCachePurge(query url.Values) (cachePurge, error) {
+	p := cachePurge{Prefixes: query["prefix"], Hosts: query["host"], Keys: query["key"]}
+	for _, raw := range query["url"] {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return cachePurge{}, fmt.Errorf("url %q is not an absolute URL", raw)
+		}
+		p.URLs = append(p.URLs, strings.ToLower(u.Scheme)+"://"+u.Host+u.Path+"?"+u.RawQuery)
+	}
+	return p, nil
+}
+
+// invalidateAfterWrite drops the stored copies of a resource a successful unsafe request
+// changed, and of the resources its Location and Content-Location name on the same
+// upstream, as RFC 9111 section 4.4 requires. Copies stored through other routes to the
+// upstream describe the same resources and go too.
+func (c *responseCache) invalidateAfterWrite(r *http.Request, target *proxyTarget, header http.Header) {
+	requested := &url.URL{Scheme: target.URL.Scheme, Host: target.URL.Host, Path: target.Path, RawQuery: r.URL.RawQuery}
+	resources := []string{upstreamResource(target, requested.Scheme+"://"+requested.Host+requested.Path+"?"+requested.RawQuery)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		ref, err := url.Parse(header.Get(name))
+		if err != nil || header.Get(name) == "" {
+			continue
+		}
+		if u := requested.ResolveReference(ref); u.Host == target.URL.Host {
+			resources = append(resources, upstreamResource(target, u.Scheme+"://"+u.Host+u.Path+"?"+u.RawQuery))
+		}
+	}
+	c.invalidateUpstream(resources)
+}
+
+// unsafeMethod reports whether a request may change the resource it targets
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// purgeCache handles DELETE /cache, optionally narrowed by url, prefix, host and key
+// parameters. The purge is repeated on every instance of a cluster.
+func (a *adminAPI) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if a.proxy.cache == nil {
+		writeJSONError(w, http.StatusNotFound, "cache_disabled", "cache is not configured")
+		return
+	}
+	p, err := parseCachePurge(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_purge", err.Error())
+		return
+	}
+
+	n := a.proxy.cache.purge(p)
+	if a.proxy.cluster != nil {
+		a.proxy.cluster.publish(clusterCachePurge, p)
+	}
+	a.proxy.logger.Printf("Admin: purged %d cache entries", n)
+	details := map[string]string{"entries": strconv.Itoa(n)}
+	if !p.all() {
+		selectors, _ := json.Marshal(p)
+		details["selectors"] = string(selectors)
+	}
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: "cache_purged", Details: details})
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
@@ -0,0 +1,423 @@
+package proxygo
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// cacheUpstream counts the requests it gets and answers them with handle, which a test
+// may replace between requests
+type cacheUpstream struct {
+	*httptest.Server
+	hits atomic.Int32
+
+	mu     sync.Mutex
+	handle http.HandlerFunc
+}
+
+func newCacheUpstream(t *testing.T, handle http.HandlerFunc) *cacheUpstream {
+	t.Helper()
+	u := &cacheUpstream{handle: handle}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		u.mu.Lock()
+		handle := u.handle
+		u.mu.Unlock()
+		handle(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// set replaces the upstream's handler
+func (u *cacheUpstream) set(handle http.HandlerFunc) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.handle = handle
+}
+
+// cacheGet sends a GET for path through h with the given header name and value pairs
+func cacheGet(h http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// checkCached fails unless w has status, body and X-Cache result
+func checkCached(t *testing.T, step string, w *httptest.ResponseRecorder, status int, body, result string) {
+	t.Helper()
+	if w.Code != status || w.Body.String() != body || w.Header().Get("X-Cache") != result {
+		t.Errorf("%s: %d %q with X-Cache %q, want %d %q with %q", step, w.Code, w.Body, w.Header().Get("X-Cache"), status, body, result)
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header // response headers of the upstream
+		// request headers of the second request, as name and value pairs
+		again  []string
+		cached bool
+	}{
+		{name: "max-age", header: http.Header{"Cache-Control": {"max-age=60"}}, cached: true},
+		{name: "s-maxage", header: http.Header{"Cache-Control": {"s-maxage=60, max-age=0"}}, cached: true},
+		{name: "vary accept-encoding", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, cached: true},
+		{name: "no caching headers", header: http.Header{}},
+		{name: "no-store", header: http.Header{"Cache-Control": {"max-age=60, no-store"}}},
+		{name: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{name: "set-cookie", header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"s=1"}}},
+		{name: "vary user-agent", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"User-Agent"}}},
+		{name: "client no-cache", header: http.Header{"Cache-Control": {"max-age=60"}}, again: []string{"Cache-Control", "no-cache"}},
+		{name: "authorization", header: http.Header{"Cache-Control": {"max-age=60"}}, again: []string{"Authorization", "Bearer x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				for k, vv := range tt.header {
+					w.Header()[k] = vv
+				}
+				io.WriteString(w, "body")
+			})
+			h := newTestHandler(t, `{"cache": {"enabled": true},
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+			checkCached(t, "first", cacheGet(h, "/api/items"), http.StatusOK, "body", "MISS")
+			w := cacheGet(h, "/api/items", tt.again...)
+			hits := int32(2)
+			if tt.cached {
+				hits = 1
+				checkCached(t, "second", w, http.StatusOK, "body", "HIT")
+			}
+			if n := upstream.hits.Load(); n != hits {
+				t.Errorf("%d upstream requests, want %d", n, hits)
+			}
+		})
+	}
+}
+
+func TestCacheWriteInvalidates(t *testing.T) {
+	serve := func(version string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				w.Header().Set("Location", "/items/2")
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, version+" "+r.URL.Path)
+		}
+	}
+	upstream := newCacheUpstream(t, serve("v1"))
+	h := newTestHandler(t, `{"cache": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	for _, path := range []string{"/api/items", "/api/items/2", "/api/other"} {
+		cacheGet(h, path)
+		checkCached(t, path, cacheGet(h, path), http.StatusOK, "v1 "+strings.TrimPrefix(path, "/api"), "HIT")
+	}
+
+	// A successful POST drops the resource it went to and the one its Location names
+	upstream.set(serve("v2"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader("{}")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d", w.Code)
+	}
+	checkCached(t, "posted", cacheGet(h, "/api/items"), http.StatusOK, "v2 /items", "MISS")
+	checkCached(t, "location", cacheGet(h, "/api/items/2"), http.StatusOK, "v2 /items/2", "MISS")
+	checkCached(t, "unrelated", cacheGet(h, "/api/other"), http.StatusOK, "v1 /other", "HIT")
+}
+
+func TestCacheIdempotentWriteInvalidates(t *testing.T) {
+	version := "v1"
+	var mu sync.Mutex
+	upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPost {
+			version = "v2"
+			w.Header().Set("Location", "/items/2")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, version+" "+r.URL.Path)
+	})
+	h := newTestHandler(t, `{"cache": {"enabled": true}, "idempotency": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	for _, path := range []string{"/api/items", "/api/items/2"} {
+		cacheGet(h, path)
+		checkCached(t, path, cacheGet(h, path), http.StatusOK, "v1 "+strings.TrimPrefix(path, "/api"), "HIT")
+	}
+
+	// A write answered through the idempotency store invalidates like any other
+	r := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader("{}"))
+	r.Header.Set("Idempotency-Key", "k1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d", w.Code)
+	}
+	checkCached(t, "posted", cacheGet(h, "/api/items"), http.StatusOK, "v2 /items", "MISS")
+	checkCached(t, "location", cacheGet(h, "/api/items/2"), http.StatusOK, "v2 /items/2", "MISS")
+}
+
+func TestCachePrewarmPinned(t *testing.T) {
+	serve := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Pinned entries are served even though the origin marks them stale
+			w.Header().Set("Cache-Control", "max-age=0")
+			io.WriteString(w, body)
+		}
+	}
+	upstream := newCacheUpstream(t, serve("pinned"))
+	h := newTestHandler(t, `{"cache": {"enabled": true, "max_size": 20},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	if err := h.prewarm(context.Background(), upstream.URL+"/app.js"); err != nil {
+		t.Fatal(err)
+	}
+	upstream.set(serve("fetched"))
+	checkCached(t, "pinned", cacheGet(h, "/api/app.js"), http.StatusOK, "pinned", "HIT")
+
+	// Filling the cache past max_size evicts fetched entries, never pinned ones
+	upstream.set(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "0123456789")
+	})
+	cacheGet(h, "/api/a")
+	cacheGet(h, "/api/b")
+	checkCached(t, "pinned after eviction", cacheGet(h, "/api/app.js"), http.StatusOK, "pinned", "HIT")
+	checkCached(t, "newest", cacheGet(h, "/api/b"), http.StatusOK, "0123456789", "HIT")
+	checkCached(t, "evicted", cacheGet(h, "/api/a"), http.StatusOK, "0123456789", "MISS")
+
+	// The next prewarm run replaces the pinned copy
+	upstream.set(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "refreshed") })
+	if err := h.prewarm(context.Background(), upstream.URL+"/app.js"); err != nil {
+		t.Fatal(err)
+	}
+	checkCached(t, "refreshed", cacheGet(h, "/api/app.js"), http.StatusOK, "refreshed", "HIT")
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	var conditional atomic.Value // If-None-Match of the last upstream request
+	serve := func(etag string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			conditional.Store(r.Header.Get("If-None-Match"))
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, "body "+etag)
+		}
+	}
+	upstream := newCacheUpstream(t, serve(`"v1"`))
+	h := newTestHandler(t, `{"cache": {"enabled": true, "revalidate": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	checkCached(t, "first", cacheGet(h, "/api/items"), http.StatusOK, `body "v1"`, "MISS")
+
+	// Every request asks the origin about the stored copy, not about the client's
+	w := cacheGet(h, "/api/items", "If-None-Match", `"client"`)
+	checkCached(t, "unchanged", w, http.StatusOK, `body "v1"`, "REVALIDATED")
+	if got := conditional.Load(); got != `"v1"` {
+		t.Errorf("upstream If-None-Match = %v, want the stored ETag", got)
+	}
+
+	// A client holding the stored version gets a 304 once the origin confirms it
+	w = cacheGet(h, "/api/items", "If-None-Match", `"v1"`)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != `"v1"` {
+		t.Errorf("conditional: %d %q with ETag %q, want an empty 304", w.Code, w.Body, w.Header().Get("ETag"))
+	}
+
+	// A changed resource is passed through and replaces the stored copy
+	upstream.set(serve(`"v2"`))
+	checkCached(t, "changed", cacheGet(h, "/api/items"), http.StatusOK, `body "v2"`, "MISS")
+	checkCached(t, "after change", cacheGet(h, "/api/items"), http.StatusOK, `body "v2"`, "REVALIDATED")
+	if n := upstream.hits.Load(); n != 5 {
+		t.Errorf("%d upstream requests, want one per request", n)
+	}
+}
+
+func TestCacheRevalidateStale(t *testing.T) {
+	// Without revalidate mode, fresh entries are hits and stale ones with validators are
+	// revalidated rather than dropped
+	upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		io.WriteString(w, "body")
+	})
+	h := newTestHandler(t, `{"cache": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	checkCached(t, "first", cacheGet(h, "/api/items"), http.StatusOK, "body", "MISS")
+	checkCached(t, "stale", cacheGet(h, "/api/items"), http.StatusOK, "body", "REVALIDATED")
+
+	// An If-Modified-Since the stored copy satisfies is answered from the cache
+	w := cacheGet(h, "/api/items", "If-Modified-Since", "Tue, 03 Jan 2006 00:00:00 GMT")
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status %d, want 304", w.Code)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	respond := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			w.Header().Set("Surrogate-Key", tag+" all")
+		}
+		io.WriteString(w, r.URL.Path)
+	}
+	one, two := newCacheUpstream(t, respond), newCacheUpstream(t, respond)
+	h := newTestHandler(t, `{"cache": {"enabled": true}, "admin": {"address": "127.0.0.1:0", "token": "secret"},
+		"routes": [{"name": "one", "prefix": "/one/", "upstream": "`+one.URL+`"},
+			{"name": "two", "prefix": "/two/", "upstream": "`+two.URL+`"}]}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+	oneHost := strings.TrimPrefix(one.URL, "http://")
+
+	// The resources each purge is applied to, with the pinned one prewarmed
+	resources := []string{"/one/v1/a", "/one/v1/b?tag=red", "/one/v2/c?tag=blue", "/two/v1/a"}
+	pinned := one.URL + "/pinned"
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		purged []string // the resources gone afterwards, including "/one/pinned"
+	}{
+		{name: "everything but pinned", purged: resources},
+		{name: "url", query: url.Values{"url": {one.URL + "/v1/a"}}, purged: []string{"/one/v1/a"}},
+		{name: "url with query", query: url.Values{"url": {one.URL + "/v1/b?tag=red"}}, purged: []string{"/one/v1/b?tag=red"}},
+		{name: "url without its query", query: url.Values{"url": {one.URL + "/v1/b"}}},
+		{name: "prefix", query: url.Values{"prefix": {one.URL + "/v1/"}}, purged: []string{"/one/v1/a", "/one/v1/b?tag=red"}},
+		{name: "host", query: url.Values{"host": {oneHost}}, purged: []string{"/one/v1/a", "/one/v1/b?tag=red", "/one/v2/c?tag=blue", "/one/pinned"}},
+		{name: "surrogate key", query: url.Values{"key": {"blue"}}, purged: []string{"/one/v2/c?tag=blue"}},
+		{name: "shared surrogate key", query: url.Values{"key": {"all"}}, purged: []string{"/one/v1/b?tag=red", "/one/v2/c?tag=blue"}},
+		{name: "any selector", query: url.Values{"key": {"red"}, "url": {two.URL + "/v1/a"}}, purged: []string{"/one/v1/b?tag=red", "/two/v1/a"}},
+		{name: "pinned by url", query: url.Values{"url": {pinned}}, purged: []string{"/one/pinned"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.cache.purge(cachePurge{Hosts: []string{oneHost, strings.TrimPrefix(two.URL, "http://")}})
+			if err := h.prewarm(context.Background(), pinned); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range resources {
+				cacheGet(h, path)
+			}
+
+			r := httptest.NewRequest(http.MethodDelete, "/cache?"+tt.query.Encode(), nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("purge: status %d: %s", w.Code, w.Body)
+			}
+
+			for _, path := range append(resources, "/one/pinned") {
+				result := cacheGet(h, path).Header().Get("X-Cache")
+				gone := false
+				for _, p := range tt.purged {
+					gone = gone || p == path
+				}
+				if want := map[bool]string{true: "MISS", false: "HIT"}[gone]; result != want {
+					t.Errorf("%s: X-Cache %q, want %q", path, result, want)
+				}
+			}
+		})
+	}
+
+	// Bad selectors are refused
+	r := httptest.NewRequest(http.MethodDelete, "/cache?url=/relative", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("relative url: status %d, want 400", w.Code)
+	}
+}
+
+func TestCacheRoutesSeparate(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string // routes a and b, as JSON after their upstream
+		// requests through each route: path, then header name and value pairs
+		a, b []string
+	}{
+		{
+			name:   "distinct names",
+			routes: `"name": "a", "prefix": "/a/"|"name": "b", "prefix": "/b/"`,
+			a:      []string{"/a/"}, b: []string{"/b/"},
+		},
+		{
+			name:   "same name",
+			routes: `"name": "api", "prefix": "/a/"|"name": "api", "prefix": "/b/"`,
+			a:      []string{"/a/"}, b: []string{"/b/"},
+		},
+		{
+			name:   "unnamed with the same prefix",
+			routes: `"prefix": "/api/", "headers": {"X-Env": "a"}|"prefix": "/api/", "headers": {"X-Env": "b"}`,
+			a:      []string{"/api/", "X-Env", "a"}, b: []string{"/api/", "X-Env", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				io.WriteString(w, "secret for "+r.Header.Get("Authorization"))
+			})
+			a, b, _ := strings.Cut(tt.routes, "|")
+			h := newTestHandler(t, `{"cache": {"enabled": true},
+				"routes": [{`+a+`, "upstream": "`+upstream.URL+`", "upstream_headers": {"Authorization": "Bearer A"}},
+					{`+b+`, "upstream": "`+upstream.URL+`", "upstream_headers": {"Authorization": "Bearer B"}}]}`)
+			getA := func(path string) *httptest.ResponseRecorder { return cacheGet(h, tt.a[0]+path, tt.a[1:]...) }
+			getB := func(path string) *httptest.ResponseRecorder { return cacheGet(h, tt.b[0]+path, tt.b[1:]...) }
+
+			// Both routes reach the same upstream URL but each sends its own credentials
+			checkCached(t, "route a", getA("x"), http.StatusOK, "secret for Bearer A", "MISS")
+			checkCached(t, "route b", getB("x"), http.StatusOK, "secret for Bearer B", "MISS")
+			checkCached(t, "route a again", getA("x"), http.StatusOK, "secret for Bearer A", "HIT")
+			checkCached(t, "route b again", getB("x"), http.StatusOK, "secret for Bearer B", "HIT")
+
+			// A write through one route changes the resource every route caches
+			r := httptest.NewRequest(http.MethodPost, tt.a[0]+"x", strings.NewReader("{}"))
+			for i := 1; i+1 < len(tt.a); i += 2 {
+				r.Header.Set(tt.a[i], tt.a[i+1])
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("POST: status %d", w.Code)
+			}
+			checkCached(t, "route b after write", getB("x"), http.StatusOK, "secret for Bearer B", "MISS")
+
+			// Prewarming pins a copy for each route, fetched with that route's headers
+			if err := h.prewarm(context.Background(), upstream.URL+"/pinned"); err != nil {
+				t.Fatal(err)
+			}
+			checkCached(t, "pinned a", getA("pinned"), http.StatusOK, "secret for Bearer A", "HIT")
+			checkCached(t, "pinned b", getB("pinned"), http.StatusOK, "secret for Bearer B", "HIT")
+		})
+	}
+}
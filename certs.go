@@ -0,0 +1,58 @@
+package proxygo
+
+import (
+	"crypto/tls"
+	"slices"
+	"sync/atomic"
+)
+
+// keyPair is a certificate loaded from files, replaceable while listeners keep presenting it
+type keyPair struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// loadKeyPair reads the certificate and key at the given paths
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	p := &keyPair{certFile: certFile, keyFile: keyFile}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reload reads the files again, keeping the current certificate when they do not load
+func (p *keyPair) reload() error {
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return err
+	}
+	p.cert.Store(&cert)
+	return nil
+}
+
+// get returns the current certificate
+func (p *keyPair) get() *tls.Certificate {
+	return p.cert.Load()
+}
+
+// keyPairs returns every certificate the listeners present: their own, then the virtual hosts'
+func (h *ProxyHandler) keyPairs() []*keyPair {
+	pairs := slices.Clone(h.listenerCerts)
+	if h.vhosts != nil {
+		for _, c := range h.vhosts.certs {
+			pairs = append(pairs, c.cert)
+		}
+	}
+	return pairs
+}
+
+// reloadCertificates rereads every certificate, so renewed ones are presented to new
+// connections without a restart
+func (h *ProxyHandler) reloadCertificates() {
+	for _, p := range h.keyPairs() {
+		if err := p.reload(); err != nil {
+			h.logger.Printf("Keeping previous certificate %s: %v", p.certFile, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package proxygo
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReloadCertificates(t *testing.T) {
+	h := newTestHandler(t, `{}`)
+	certFile, keyFile := writeTestCert(t)
+	pair, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.listenerCerts = []*keyPair{pair}
+	first := pair.get()
+
+	tests := []struct {
+		name    string
+		cert    []byte // written over the certificate file; nil for a renewed certificate
+		renewed bool
+	}{
+		{name: "unreadable", cert: []byte("not a certificate")},
+		{name: "renewed", renewed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := pair.get()
+			if tt.cert != nil {
+				if err := os.WriteFile(certFile, tt.cert, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				renewedCert, renewedKey := writeTestCert(t)
+				replaceFile(t, certFile, renewedCert)
+				replaceFile(t, keyFile, renewedKey)
+			}
+			h.reloadCertificates()
+			if changed := !bytes.Equal(pair.get().Certificate[0], before.Certificate[0]); changed != tt.renewed {
+				t.Errorf("certificate replaced: %v, want %v", changed, tt.renewed)
+			}
+		})
+	}
+	if bytes.Equal(pair.get().Certificate[0], first.Certificate[0]) {
+		t.Error("still presenting the first certificate")
+	}
+
+	if _, err := loadKeyPair(certFile, certFile); err == nil {
+		t.Error("loaded a key pair without a key")
+	}
+}
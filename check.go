@@ -0,0 +1,698 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how close to expiry a listener certificate draws a warning
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// diagnostic is one finding of `proxygo check`
+type diagnostic struct {
+	warning bool
+	path    string // config path such as routes[2].prefix; "" for the whole file
+	offset  int64  // byte offset in the file when there is no path to look up, else -1
+	message string
+}
+
+// configCheck collects the findings for one config file
+type configCheck struct {
+	file  string
+	data  []byte
+	pos   map[string]int64 // byte offset of every key and array element, by config path
+	diags []diagnostic
+}
+
+// runCheck implements `proxygo check`, validating a config file without starting the proxy.
+// Findings go to stdout and usage errors to stderr; the exit code is 0 when the file is
+// usable, 1 when it is not (or has warnings under -strict) and 2 for bad arguments.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "path to the proxy config file")
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" && fs.NArg() == 1 {
+		*configPath = fs.Arg(0)
+	}
+	if *configPath == "" || fs.NArg() > 1 || (fs.NArg() == 1 && fs.Arg(0) != *configPath) {
+		fmt.Fprintln(stderr, "usage: proxygo check [-strict] config.json")
+		return 2
+	}
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	c := &configCheck{file: *configPath, data: data, pos: make(map[string]int64)}
+	c.run()
+
+	errorCount, warningCount := c.print(stdout)
+	switch {
+	case errorCount > 0 || (*strict && warningCount > 0):
+		fmt.Fprintf(stdout, "%s: %d error(s), %d warning(s)\n", c.file, errorCount, warningCount)
+		return 1
+	case warningCount > 0:
+		fmt.Fprintf(stdout, "%s: OK with %d warning(s)\n", c.file, warningCount)
+	default:
+		fmt.Fprintf(stdout, "%s: OK\n", c.file)
+	}
+	return 0
+}
+
+// errorf records an error at path
+func (c *configCheck) errorf(path, format string, args ...any) {
+	c.diags = append(c.diags, diagnostic{path: path, offset: -1, message: fmt.Sprintf(format, args...)})
+}
+
+// warnf records a warning at path
+func (c *configCheck) warnf(path, format string, args ...any) {
+	c.diags = append(c.diags, diagnostic{warning: true, path: path, offset: -1, message: fmt.Sprintf(format, args...)})
+}
+
+// errorAt records an error at a byte offset of the file
+func (c *configCheck) errorAt(offset int64, format string, args ...any) {
+	c.diags = append(c.diags, diagnostic{offset: offset, message: fmt.Sprintf(format, args...)})
+}
+
+// run performs every check; later ones need the config to have decoded
+func (c *configCheck) run() {
+	if !c.walk() {
+		return
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(c.data, cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			c.errorf(fieldPath(typeErr.Field), "expected %s, found %s", typeErr.Type, typeErr.Value)
+		} else {
+			c.errorf("", "%v", err)
+		}
+		return
+	}
+	if err := cfg.normalize(); err != nil {
+		c.errorf("", "%v", err)
+	}
+
+	certsValid := c.checkCertificates(cfg)
+	c.checkRoutes(cfg)
+	c.checkClientLists(cfg)
+	c.compile(cfg, certsValid)
+}
+
+// fieldPath turns encoding/json's field "routes.0.prefix" into the path routes[0].prefix
+func fieldPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		switch {
+		case part != "" && strings.Trim(part, "0123456789") == "":
+			b.WriteString("[" + part + "]")
+		case i > 0:
+			b.WriteString("." + part)
+		default:
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+// walk parses the file, recording positions and keys the config does not know. It
+// returns false when the file is not valid JSON.
+func (c *configCheck) walk() bool {
+	// Unmarshal describes syntax errors better than the token stream does
+	var syntax any
+	if err := json.Unmarshal(c.data, &syntax); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			c.errorAt(syntaxErr.Offset-1, "invalid JSON: %v", err)
+		} else {
+			c.errorf("", "invalid JSON: %v", err)
+		}
+		return false
+	}
+	if err := c.value(json.NewDecoder(bytes.NewReader(c.data)), "", reflect.TypeOf(Config{})); err != nil {
+		c.errorf("", "invalid JSON: %v", err)
+		return false
+	}
+	return true
+}
+
+// jsonUnmarshalers are decoded by their own code, so their insides are not checked
+var (
+	jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// value walks one JSON value at path that decodes into t; t is nil for values whose
+// contents are not checked
+func (c *configCheck) value(dec *json.Decoder, path string, t reflect.Type) error {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t != nil && (t.Kind() == reflect.Interface || reflect.PointerTo(t).Implements(jsonUnmarshaler) || reflect.PointerTo(t).Implements(textUnmarshaler)) {
+		t = nil
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		if _, ok := c.pos[path]; !ok {
+			c.pos[path] = dec.InputOffset() - 1
+		}
+		var fields map[string]reflect.Type
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		for dec.More() {
+			offset := c.skipSeparators(dec.InputOffset())
+			keyTok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := keyTok.(string)
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			c.pos[child] = offset
+
+			var ft reflect.Type
+			switch {
+			case fields != nil:
+				var ok bool
+				if ft, ok = fields[strings.ToLower(key)]; !ok {
+					c.unknownKey(child, key, fields)
+				}
+			case t != nil && t.Kind() == reflect.Map:
+				ft = t.Elem()
+			}
+			if err := c.value(dec, child, ft); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	case json.Delim('['):
+		if _, ok := c.pos[path]; !ok {
+			c.pos[path] = dec.InputOffset() - 1
+		}
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := 0; dec.More(); i++ {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			c.pos[child] = c.skipSeparators(dec.InputOffset())
+			if err := c.value(dec, child, elem); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	}
+	return nil
+}
+
+// skipSeparators moves offset past the whitespace, commas and colons the decoder has not
+// consumed yet, to the start of the next token
+func (c *configCheck) skipSeparators(offset int64) int64 {
+	for offset < int64(len(c.data)) && strings.IndexByte(" \t\r\n,:", c.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// unknownKey reports a key that no field decodes, suggesting the closest one
+func (c *configCheck) unknownKey(path, key string, fields map[string]reflect.Type) {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if d := editDistance(strings.ToLower(key), name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	if best != "" {
+		c.errorf(path, "unknown key %q; did you mean %q?", key, best)
+		return
+	}
+	c.errorf(path, "unknown key %q", key)
+}
+
+// jsonFields maps the lowercased JSON names of t's fields, including those of embedded
+// structs, to their types, the way encoding/json matches keys
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for embedded, ft := range jsonFields(f.Type) {
+				if _, ok := fields[embedded]; !ok {
+					fields[embedded] = ft
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// checkCertificates loads every listener and virtual host certificate, reporting whether
+// all of them are usable
+func (c *configCheck) checkCertificates(cfg *Config) bool {
+	valid := true
+	check := func(path string, tc *TLSConfig) {
+		if tc == nil {
+			return
+		}
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			c.errorf(path, "cert_file and key_file are both required")
+			valid = false
+			return
+		}
+		readable := true
+		for _, file := range []struct{ key, name string }{{"cert_file", tc.CertFile}, {"key_file", tc.KeyFile}} {
+			if _, err := os.Stat(file.name); err != nil {
+				c.errorf(path+"."+file.key, "cannot read %s: %v", file.name, errors.Unwrap(err))
+				readable = false
+			}
+		}
+		if !readable {
+			valid = false
+			return
+		}
+		pair, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			c.errorf(path, "certificate %s and key %s do not load: %v", tc.CertFile, tc.KeyFile, err)
+			valid = false
+			return
+		}
+		if tc.ClientCAFile != "" {
+			if err := clientAuth(&tls.Config{}, tc); err != nil {
+				c.errorf(path+".client_ca_file", "%v", err)
+			}
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			c.errorf(path+".cert_file", "cannot parse %s: %v", tc.CertFile, err)
+			valid = false
+			return
+		}
+		switch now := time.Now(); {
+		case now.After(leaf.NotAfter):
+			c.errorf(path+".cert_file", "certificate %s expired on %s", tc.CertFile, leaf.NotAfter.Format(time.DateOnly))
+		case now.Before(leaf.NotBefore):
+			c.errorf(path+".cert_file", "certificate %s is not valid before %s", tc.CertFile, leaf.NotBefore.Format(time.DateOnly))
+		case leaf.NotAfter.Sub(now) < certExpiryWarning:
+			c.warnf(path+".cert_file", "certificate %s expires on %s", tc.CertFile, leaf.NotAfter.Format(time.DateOnly))
+		}
+	}
+	for i := range cfg.Listeners {
+		check(fmt.Sprintf("listeners[%d].tls", i), cfg.Listeners[i].TLS)
+	}
+	for i := range cfg.VirtualHosts {
+		check(fmt.Sprintf("virtual_hosts[%d].tls", i), cfg.VirtualHosts[i].TLS)
+	}
+	if cfg.GeoIP != nil && cfg.GeoIP.Database != "" {
+		if _, err := os.Stat(cfg.GeoIP.Database); err != nil {
+			c.errorf("geoip.database", "cannot read %s: %v", cfg.GeoIP.Database, errors.Unwrap(err))
+		}
+	}
+	return valid
+}
+
+// checkedRoute is a route with the config path it came from
+type checkedRoute struct {
+	path string
+	rc   RouteConfig
+}
+
+// checkRoutes reports routes that share a name or that an earlier route always wins over
+func (c *configCheck) checkRoutes(cfg *Config) {
+	names := make(map[string]string)
+	checkName := func(path, name string) {
+		if name == "" {
+			return
+		}
+		if first, ok := names[name]; ok {
+			c.errorf(path, "route name %q is already used by %s; names must be unique for maintenance, scripts and metrics", name, first)
+			return
+		}
+		names[name] = path
+	}
+
+	var global []checkedRoute
+	for i, rc := range cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		checkName(path, rc.Name)
+		global = append(global, checkedRoute{path, rc})
+	}
+	c.checkShadowing(global, "")
+
+	// Virtual hosts listing the same host share one router
+	byHost := make(map[string][]checkedRoute)
+	var hosts []string
+	for i, vc := range cfg.VirtualHosts {
+		path := fmt.Sprintf("virtual_hosts[%d]", i)
+		rc := vc.RouteConfig
+		if rc.Prefix == "" {
+			rc.Prefix = "/"
+		}
+		if rc.Name == "" && len(vc.Hosts) > 0 {
+			rc.Name = vc.Hosts[0]
+		}
+		checkName(path, rc.Name)
+		for _, host := range vc.Hosts {
+			host = normalizeHost(host)
+			if _, ok := byHost[host]; !ok {
+				hosts = append(hosts, host)
+			}
+			byHost[host] = append(byHost[host], checkedRoute{path, rc})
+		}
+	}
+	for _, host := range hosts {
+		c.checkShadowing(byHost[host], fmt.Sprintf(" for host %q", host))
+	}
+
+	// Tenant route names are prefixed with the tenant ID, so only clash within a tenant
+	for i, tc := range tenantConfigs(cfg) {
+		var routes []checkedRoute
+		for j, rc := range tc.Routes {
+			path := fmt.Sprintf("tenants.list[%d].routes[%d]", i, j)
+			if rc.Name != "" {
+				checkName(path, tc.ID+"/"+rc.Name)
+			}
+			routes = append(routes, checkedRoute{path, rc})
+		}
+		c.checkShadowing(routes, "")
+	}
+}
+
+// checkShadowing reports routes of one router that can never match, because a route tried
+// before them has the same prefix and accepts every request they would; scope names the
+// router in the message
+func (c *configCheck) checkShadowing(routes []checkedRoute, scope string) {
+	for j, later := range routes {
+		for _, earlier := range routes[:j] {
+			if earlier.rc.Prefix == later.rc.Prefix && routeCovers(earlier.rc, later.rc) {
+				c.errorf(later.path, "route never matches%s: %s has the same prefix %q and accepts every request it would", scope, earlier.path, later.rc.Prefix)
+				break
+			}
+		}
+	}
+}
+
+// routeCovers reports whether every request matching b's methods and headers matches a's
+func routeCovers(a, b RouteConfig) bool {
+	if len(a.Methods) > 0 {
+		if len(b.Methods) == 0 {
+			return false
+		}
+		for _, m := range b.Methods {
+			if !slices.ContainsFunc(a.Methods, func(am string) bool { return strings.EqualFold(am, m) }) {
+				return false
+			}
+		}
+	}
+	for name, value := range a.Headers {
+		bValue, ok := headerValue(b.Headers, name)
+		if !ok || (value != "*" && bValue != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerValue looks up a header condition case-insensitively
+func headerValue(headers map[string]string, name string) (string, bool) {
+	for n, v := range headers {
+		if strings.EqualFold(n, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// checkClientLists reports entries of a tenant's allowed_clients that another entry of the
+// same list already covers. Tenants' allowed_clients are the only client CIDR lists in the
+// config; rules elsewhere match clients with in_cidr expressions, which are not compared.
+func (c *configCheck) checkClientLists(cfg *Config) {
+	for i, tc := range tenantConfigs(cfg) {
+		var nets []*net.IPNet
+		for j, entry := range tc.AllowedClients {
+			path := fmt.Sprintf("tenants.list[%d].allowed_clients[%d]", i, j)
+			ipNet := parseClientEntry(entry)
+			if ipNet == nil {
+				c.errorf(path, "%q is neither an IP address nor a CIDR", entry)
+				nets = append(nets, nil)
+				continue
+			}
+			for k, other := range nets {
+				if other != nil && other.Contains(ipNet.IP) && networkSize(other) >= networkSize(ipNet) {
+					c.warnf(path, "%s overlaps allowed_clients[%d] (%s), which already covers it", entry, k, tc.AllowedClients[k])
+					break
+				}
+				if other != nil && ipNet.Contains(other.IP) {
+					c.warnf(path, "%s overlaps allowed_clients[%d] (%s), which it covers", entry, k, tc.AllowedClients[k])
+					break
+				}
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+}
+
+// parseClientEntry reads an IP or CIDR as a network, nil when it is neither
+func parseClientEntry(entry string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// networkSize is the number of host bits of n, comparable within one address family
+func networkSize(n *net.IPNet) int {
+	ones, bits := n.Mask.Size()
+	return bits - ones
+}
+
+// compile builds the parts of the handler that only read the config, so their own
+// validation runs; anything that opens files for writing or connects is left out
+func (c *configCheck) compile(cfg *Config, certsValid bool) {
+	rt, err := newRouter(cfg.Routes)
+	if err != nil {
+		c.errorf("routes", "%v", err)
+	}
+	var vhosts *vhostTable
+	if certsValid {
+		if vhosts, err = newVhostTable(cfg.VirtualHosts); err != nil {
+			c.errorf("virtual_hosts", "%v", err)
+		}
+	}
+	if _, err := newPACFile(cfg.PAC, cfg.VirtualHosts); err != nil {
+		c.errorf("pac", "%v", err)
+	}
+	if _, err := newScheduleTable(cfg.Schedules); err != nil {
+		c.errorf("schedules", "%v", err)
+	}
+	if _, err := newErrorRenderer(cfg.ErrorPages); err != nil {
+		c.errorf("error_pages", "%v", err)
+	}
+	if _, err := newMaintenanceMode(cfg.Maintenance); err != nil {
+		c.errorf("maintenance", "%v", err)
+	}
+	if _, err := newBodyRewriter(cfg.BodyRewrite); err != nil {
+		c.errorf("body_rewrite", "%v", err)
+	}
+	if _, err := newSecurityHeaders(cfg.SecurityHeaders); err != nil {
+		c.errorf("security_headers", "%v", err)
+	}
+	if _, err := newURLSigner(cfg.SignedURLs); err != nil {
+		c.errorf("signed_urls", "%v", err)
+	}
+	if _, err := newIdentityForwarder(cfg.Identity); err != nil {
+		c.errorf("identity", "%v", err)
+	}
+
+	// Scripts and maintenance name routes, which only exist once the routers compiled
+	if rt == nil {
+		return
+	}
+	routes := rt.routes
+	if vhosts != nil {
+		routes = append(slices.Clip(routes), vhosts.routes()...)
+	}
+	for i, tc := range tenantConfigs(cfg) {
+		// Bad allowed_clients entries were already reported one by one
+		if slices.ContainsFunc(tc.AllowedClients, func(entry string) bool { return parseClientEntry(entry) == nil }) {
+			continue
+		}
+		tn, err := compileTenant(tc, "config")
+		if err != nil {
+			c.errorf(fmt.Sprintf("tenants.list[%d]", i), "%v", err)
+			continue
+		}
+		routes = append(routes, tn.router.routes...)
+	}
+	if _, err := newScriptSet(cfg.Scripts, routes); err != nil {
+		c.errorf("scripts", "%v", err)
+	}
+	if _, err := newSLOTracker(cfg.SLOs, routes, newMetricsRegistry()); err != nil {
+		c.errorf("slos", "%v", err)
+	}
+	if secrets, err := newSecretStore(cfg.Secrets, log.New(io.Discard, "", 0), newMetricsRegistry()); err != nil {
+		c.errorf("secrets", "%v", err)
+	} else if err := secrets.checkRefs(routes); err != nil {
+		c.errorf("routes", "%v", err)
+	}
+	if _, err := newUploadTracker(cfg.Uploads, log.New(io.Discard, "", 0), nil, newMetricsRegistry()); err != nil {
+		c.errorf("uploads", "%v", err)
+	}
+	if cfg.Logging != nil {
+		if _, err := newBodySampler(cfg.Logging.BodySample); err != nil {
+			c.errorf("logging.body_sample", "%v", err)
+		}
+	}
+	if cfg.Maintenance != nil {
+		for i, name := range cfg.Maintenance.Routes {
+			if !slices.ContainsFunc(routes, func(route *Route) bool { return route.Name == name }) {
+				c.errorf(fmt.Sprintf("maintenance.routes[%d]", i), "unknown route %q", name)
+			}
+		}
+	}
+}
+
+// tenantConfigs returns the tenants defined in the config itself
+func tenantConfigs(cfg *Config) []TenantConfig {
+	if cfg.Tenants == nil {
+		return nil
+	}
+	return cfg.Tenants.List
+}
+
+// position returns the 1-based line and column of a byte offset in the file
+func (c *configCheck) position(offset int64) (line, col int) {
+	offset = min(max(offset, 0), int64(len(c.data)))
+	before := c.data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// print writes the findings in file order, "file:line:col: error: path: message", and
+// returns how many errors and warnings there were
+func (c *configCheck) print(w io.Writer) (errorCount, warningCount int) {
+	type located struct {
+		diagnostic
+		offset int64
+	}
+	var out []located
+	for _, d := range c.diags {
+		if d.offset >= 0 {
+			out = append(out, located{d, d.offset})
+			continue
+		}
+		offset, ok := c.pos[d.path]
+		// Paths the file does not spell out, such as a defaulted field, point at their parent
+		for p := d.path; !ok && p != ""; {
+			if i := strings.LastIndexAny(p, ".["); i >= 0 {
+				p = p[:i]
+			} else {
+				p = ""
+			}
+			offset, ok = c.pos[p]
+		}
+		if !ok {
+			offset = -1
+		}
+		out = append(out, located{d, offset})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].offset < out[j].offset })
+
+	for _, d := range out {
+		severity := "error"
+		if d.warning {
+			severity = "warning"
+			warningCount++
+		} else {
+			errorCount++
+		}
+		where := c.file
+		if d.offset >= 0 {
+			line, col := c.position(d.offset)
+			where = fmt.Sprintf("%s:%d:%d", c.file, line, col)
+		}
+		message := d.message
+		// Errors of the handler's own validation often already name their section
+		if d.path != "" {
+			last := d.path[strings.LastIndexAny(d.path, ".]")+1:]
+			message = strings.TrimPrefix(message, last+": ")
+			if !strings.HasPrefix(message, d.path+": ") {
+				message = d.path + ": " + message
+			}
+		}
+		fmt.Fprintf(w, "%s: %s: %s\n", where, severity, message)
+	}
+	return errorCount, warningCount
+}
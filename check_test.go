@@ -0,0 +1,200 @@
+package proxygo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	soonCert, soonKey := writeTestCertValid(t, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	oldCert, oldKey := writeTestCertValid(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	files := strings.NewReplacer("$SOON_CERT", soonCert, "$SOON_KEY", soonKey, "$OLD_CERT", oldCert, "$OLD_KEY", oldKey)
+
+	tests := []struct {
+		name   string
+		config string
+		args   []string // flags before the file
+		want   string   // stdout, with the certificate paths as in config
+		code   int
+	}{
+		{
+			name: "valid",
+			config: `{
+  "routes": [{"name": "api", "prefix": "/api/", "upstream": "http://api.internal"}]
+}`,
+			want: "config.json: OK\n",
+		},
+		{
+			name: "unknown keys",
+			config: `{
+  "routes": [
+    {"name": "api", "prefix": "/api/", "upstream": "http://api.internal",
+     "upstrem_headers": {"X-Key": "1"}}
+  ],
+  "cahce": {"enabled": true},
+  "zzzzzz": 1
+}`,
+			want: `config.json:4:6: error: routes[0].upstrem_headers: unknown key "upstrem_headers"; did you mean "upstream_headers"?
+config.json:6:3: error: cahce: unknown key "cahce"; did you mean "cache"?
+config.json:7:3: error: zzzzzz: unknown key "zzzzzz"
+config.json: 3 error(s), 0 warning(s)
+`,
+			code: 1,
+		},
+		{
+			name: "invalid JSON",
+			config: `{
+  "routes": [
+    {"name": "api",}
+  ]
+}`,
+			want: "config.json:3:20: error: invalid JSON: invalid character '}' looking for beginning of object key string\nconfig.json: 1 error(s), 0 warning(s)\n",
+			code: 1,
+		},
+		{
+			name: "wrong type",
+			config: `{
+  "routes": [{"name": "api", "prefix": 7}]
+}`,
+			want: "config.json:2:30: error: routes[0].prefix: expected string, found number\nconfig.json: 1 error(s), 0 warning(s)\n",
+			code: 1,
+		},
+		{
+			name: "route names and shadowing",
+			config: `{
+  "routes": [
+    {"name": "api", "prefix": "/api/", "upstream": "http://a.internal"},
+    {"name": "api", "prefix": "/v2/", "upstream": "http://b.internal"},
+    {"name": "get", "prefix": "/api/", "methods": ["GET"], "upstream": "http://c.internal"},
+    {"name": "post", "prefix": "/v2/", "methods": ["POST"], "upstream": "http://d.internal"}
+  ]
+}`,
+			want: `config.json:4:5: error: routes[1]: route name "api" is already used by routes[0]; names must be unique for maintenance, scripts and metrics
+config.json:5:5: error: routes[2]: route never matches: routes[0] has the same prefix "/api/" and accepts every request it would
+config.json:6:5: error: routes[3]: route never matches: routes[1] has the same prefix "/v2/" and accepts every request it would
+config.json: 3 error(s), 0 warning(s)
+`,
+			code: 1,
+		},
+		{
+			name: "overlapping clients",
+			config: `{
+  "tenants": {"list": [{"id": "acme", "hosts": ["acme.test"],
+    "allowed_clients": ["10.0.0.0/8", "10.1.0.0/16", "192.0.2.7", "192.0.2.0/24", "nonsense"]}]}
+}`,
+			want: `config.json:3:39: warning: tenants.list[0].allowed_clients[1]: 10.1.0.0/16 overlaps allowed_clients[0] (10.0.0.0/8), which already covers it
+config.json:3:67: warning: tenants.list[0].allowed_clients[3]: 192.0.2.0/24 overlaps allowed_clients[2] (192.0.2.7), which it covers
+config.json:3:83: error: tenants.list[0].allowed_clients[4]: "nonsense" is neither an IP address nor a CIDR
+config.json: 1 error(s), 2 warning(s)
+`,
+			code: 1,
+		},
+		{
+			name: "certificates",
+			config: `{
+  "listeners": [
+    {"name": "missing", "address": ":8443", "tls": {"cert_file": "/nonexistent/tls.crt", "key_file": "$SOON_KEY"}},
+    {"name": "expired", "address": ":8444", "tls": {"cert_file": "$OLD_CERT", "key_file": "$OLD_KEY"}},
+    {"name": "soon", "address": ":8445", "tls": {"cert_file": "$SOON_CERT", "key_file": "$SOON_KEY"}},
+    {"name": "mismatched", "address": ":8446", "tls": {"cert_file": "$SOON_CERT", "key_file": "$OLD_KEY"}}
+  ]
+}`,
+			want: `config.json:3:53: error: listeners[0].tls.cert_file: cannot read /nonexistent/tls.crt: no such file or directory
+config.json:4:53: error: listeners[1].tls.cert_file: certificate $OLD_CERT expired on 2021-01-01
+config.json:5:50: warning: listeners[2].tls.cert_file: certificate $SOON_CERT expires on ` + time.Now().Add(24*time.Hour).UTC().Format(time.DateOnly) + `
+config.json:6:48: error: listeners[3].tls: certificate $SOON_CERT and key $OLD_KEY do not load: tls: private key does not match public key
+config.json: 3 error(s), 1 warning(s)
+`,
+			code: 1,
+		},
+		{
+			name: "warning passes",
+			config: `{
+  "listeners": [{"name": "soon", "address": ":8445", "tls": {"cert_file": "$SOON_CERT", "key_file": "$SOON_KEY"}}]
+}`,
+			want: `config.json:2:62: warning: listeners[0].tls.cert_file: certificate $SOON_CERT expires on ` + time.Now().Add(24*time.Hour).UTC().Format(time.DateOnly) + `
+config.json: OK with 1 warning(s)
+`,
+		},
+		{
+			name: "warning fails under strict",
+			args: []string{"-strict"},
+			config: `{
+  "listeners": [{"name": "soon", "address": ":8445", "tls": {"cert_file": "$SOON_CERT", "key_file": "$SOON_KEY"}}]
+}`,
+			want: `config.json:2:62: warning: listeners[0].tls.cert_file: certificate $SOON_CERT expires on ` + time.Now().Add(24*time.Hour).UTC().Format(time.DateOnly) + `
+config.json: 0 error(s), 1 warning(s)
+`,
+			code: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile("config.json", []byte(files.Replace(tt.config)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var stdout, stderr bytes.Buffer
+			code := runCheck(append(tt.args, "config.json"), &stdout, &stderr)
+			if want := files.Replace(tt.want); stdout.String() != want {
+				t.Errorf("output:\n%s\nwant:\n%s", stdout.String(), want)
+			}
+			if code != tt.code {
+				t.Errorf("exit code %d, want %d; stderr: %s", code, tt.code, stderr.String())
+			}
+		})
+	}
+}
+
+func TestCheckUsage(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "file", args: []string{config}},
+		{name: "config flag", args: []string{"-config", config}},
+		{name: "no file", args: nil, code: 2},
+		{name: "two files", args: []string{config, config}, code: 2},
+		{name: "unknown flag", args: []string{"-fast", config}, code: 2},
+		{name: "missing file", args: []string{filepath.Join(t.TempDir(), "missing.json")}, code: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCheck(tt.args, &stdout, &stderr); code != tt.code {
+				t.Errorf("exit code %d, want %d; stderr: %s", code, tt.code, stderr.String())
+			}
+		})
+	}
+}
+
+func TestCheckPosition(t *testing.T) {
+	c := &configCheck{data: []byte("{\n  \"a\": 1,\n\n  \"b\": 2\n}")}
+	tests := []struct {
+		offset    int64
+		line, col int
+	}{
+		{0, 1, 1},
+		{1, 1, 2},
+		{2, 2, 1},
+		{4, 2, 3},
+		{12, 3, 1},
+		{15, 4, 3},
+		{-5, 1, 1},
+		{1000, 5, 2},
+	}
+	for _, tt := range tests {
+		if line, col := c.position(tt.offset); line != tt.line || col != tt.col {
+			t.Errorf("position(%d) = %d:%d, want %d:%d", tt.offset, line, col, tt.line, tt.col)
+		}
+	}
+}
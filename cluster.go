@@ -0,0 +1,235 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster defaults
+const (
+	defaultClusterPrefix  = "proxygo:"
+	defaultClusterTimeout = 500 * time.Millisecond
+	clusterMaxBackoff     = 30 * time.Second
+)
+
+// Cluster events published to the other instances
+const (
+	clusterCachePurge = "cache_purge"
+)
+
+// ClusterConfig shares state between proxygo instances behind one load balancer through
+// Redis: API key and tenant rate limits are counted across the cluster, and cache purges
+// reach every instance. While Redis is unreachable each instance enforces its limits on
+// its own, so a cluster allows up to one limit per instance until Redis is back.
+type ClusterConfig struct {
+	Redis     string   `json:"redis"`      // redis://[user:password@]host:port[/db], or rediss:// for TLS
+	Password  string   `json:"password"`   // overrides the password in the URL
+	KeyPrefix string   `json:"key_prefix"` // namespaces keys and the event channel; default "proxygo:"
+	Timeout   Duration `json:"timeout"`    // per command, after which the local limit decides; default 500ms
+}
+
+// rateLimitScript is a token bucket shared by every instance, timed by the Redis clock so
+// instances need not agree on the time. It returns whether a token was taken and, if not,
+// how many milliseconds until one is available.
+const rateLimitScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(state[1]), tonumber(state[2])
+if not tokens then tokens, last = burst, now end
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens, allowed = tokens - 1, 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`
+
+// rateLimitScriptSHA is what EVALSHA knows the script by once the server has seen it
+var rateLimitScriptSHA = func() string {
+	sum := sha1.Sum([]byte(rateLimitScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// clusterEvent is the message published on the event channel
+type clusterEvent struct {
+	Event    string          `json:"event"`
+	Instance string          `json:"instance"` // publisher, so it skips its own events
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// clusterState is this instance's link to the shared Redis
+type clusterState struct {
+	redis    *redisClient
+	prefix   string
+	instance string
+	logger   *log.Logger
+
+	up        atomic.Bool // whether the last command reached Redis
+	fallbacks *metricVec
+	events    *metricVec
+
+	mu       sync.Mutex
+	handlers map[string]func(data json.RawMessage)
+}
+
+// newClusterState returns nil when the instance runs alone
+func newClusterState(cfg *ClusterConfig, logger *log.Logger, metrics *metricsRegistry) (*clusterState, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Redis == "" {
+		return nil, fmt.Errorf("cluster: redis is required")
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultClusterTimeout
+	}
+	client, err := newRedisClient(cfg.Redis, cfg.Password, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: %w", err)
+	}
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = defaultClusterPrefix
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	c := &clusterState{
+		redis:     client,
+		prefix:    prefix,
+		instance:  hex.EncodeToString(id),
+		logger:    logger,
+		fallbacks: metrics.counter("proxygo_cluster_local_decisions_total", "Rate limit decisions made locally because Redis was unreachable, by limiter.", "limiter"),
+		events:    metrics.counter("proxygo_cluster_events_total", "Cluster events exchanged through Redis, by event and direction.", "event", "direction"),
+		handlers:  make(map[string]func(data json.RawMessage)),
+	}
+	c.up.Store(true)
+	metrics.gaugeFunc("proxygo_cluster_redis_up", "Whether the last command reached the cluster's Redis.", nil, func() []sample {
+		if c.up.Load() {
+			return []sample{{value: 1}}
+		}
+		return []sample{{value: 0}}
+	})
+	return c, nil
+}
+
+// track logs when Redis becomes unreachable and when it is back
+func (c *clusterState) track(err error) {
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		if c.up.Swap(false) {
+			c.logger.Printf("Cluster: Redis unreachable, enforcing limits locally: %v", err)
+		}
+		return
+	}
+	if !c.up.Swap(true) {
+		c.logger.Printf("Cluster: Redis reachable again")
+	}
+}
+
+// allow takes one token from the cluster-wide bucket of limiter and id. An error means
+// the caller should decide locally.
+func (c *clusterState) allow(ctx context.Context, limiter, id string, rate, burst float64) (bool, time.Duration, error) {
+	key := c.prefix + "ratelimit:" + limiter + ":" + id
+	args := []string{rateLimitScriptSHA, "1", key, strconv.FormatFloat(rate, 'g', -1, 64), strconv.FormatFloat(burst, 'g', -1, 64)}
+	reply, err := c.redis.do(ctx, append([]string{"EVALSHA"}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "redis: NOSCRIPT") {
+		args[0] = rateLimitScript
+		reply, err = c.redis.do(ctx, append([]string{"EVAL"}, args...)...)
+	}
+	c.track(err)
+	if err != nil {
+		c.fallbacks.inc(limiter)
+		return false, 0, err
+	}
+	result, ok := reply.([]any)
+	if !ok || len(result) != 2 {
+		c.fallbacks.inc(limiter)
+		return false, 0, fmt.Errorf("cluster: unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := result[0].(int64)
+	wait, _ := result[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// on registers the local action for an event published by another instance
+func (c *clusterState) on(event string, fn func(data json.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[event] = fn
+}
+
+// publish tells the other instances about event, with data for their handlers; failures
+// are logged, not returned, as the local action has already happened
+func (c *clusterState) publish(event string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		c.logger.Printf("Cluster: failed to encode %s: %v", event, err)
+		return
+	}
+	payload, _ := json.Marshal(clusterEvent{Event: event, Instance: c.instance, Data: raw})
+	_, err = c.redis.do(context.Background(), "PUBLISH", c.prefix+"events", string(payload))
+	c.track(err)
+	if err != nil {
+		c.logger.Printf("Cluster: failed to publish %s: %v", event, err)
+		return
+	}
+	c.events.inc(event, "published")
+}
+
+// run follows the event channel until ctx is done, reconnecting with backoff
+func (c *clusterState) run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := c.redis.subscribe(ctx, c.prefix+"events", c.handle)
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.Printf("Cluster: event subscription lost: %v", err)
+		if time.Since(start) > clusterMaxBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, clusterMaxBackoff)
+	}
+}
+
+// handle runs the local action for an event from another instance
+func (c *clusterState) handle(payload string) {
+	var ev clusterEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil || ev.Instance == c.instance {
+		return
+	}
+	c.mu.Lock()
+	fn := c.handlers[ev.Event]
+	c.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	c.events.inc(ev.Event, "received")
+	fn(ev.Data)
+}
@@ -0,0 +1,81 @@
+//go:build example_extension
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"proxygo"
+)
+
+// This file shows the shape of a compiled-in extension; build with
+// -tags example_extension to include it. Its settings go under "extensions":
+//
+//	"extensions": {"example": {"header": "X-Example", "deny_prefix": "/internal/"}}
+
+func init() {
+	proxygo.RegisterExtension(&exampleExtension{})
+}
+
+// exampleExtension tags proxied requests and responses and refuses one path prefix
+type exampleExtension struct {
+	Header     string `json:"header"`      // set on requests and responses; default X-Example
+	DenyPrefix string `json:"deny_prefix"` // requests under it are answered 403
+
+	h      *proxygo.ProxyHandler
+	errors atomic.Int64
+}
+
+// Name implements Extension
+func (e *exampleExtension) Name() string {
+	return "example"
+}
+
+// Start implements ExtensionStarter
+func (e *exampleExtension) Start(h *proxygo.ProxyHandler, config json.RawMessage) error {
+	e.h = h
+	e.Header = "X-Example"
+	if config != nil {
+		if err := json.Unmarshal(config, e); err != nil {
+			return err
+		}
+	}
+	if e.Header == "" {
+		return fmt.Errorf("header must not be empty")
+	}
+	return nil
+}
+
+// HandleRequest implements RequestExtension
+func (e *exampleExtension) HandleRequest(w http.ResponseWriter, r *http.Request, req proxygo.ExtensionRequest) bool {
+	if e.DenyPrefix != "" && strings.HasPrefix(r.URL.Path, e.DenyPrefix) {
+		e.h.WriteError(w, r, http.StatusForbidden, "denied_by_extension", "Denied by the example extension")
+		return true
+	}
+	r.Header.Set(e.Header, req.RequestID+" "+req.Upstream.Host)
+	return false
+}
+
+// ModifyResponse implements ResponseExtension
+func (e *exampleExtension) ModifyResponse(resp *http.Response) error {
+	resp.Header.Set(e.Header, "seen")
+	return nil
+}
+
+// ProxyError implements ErrorExtension
+func (e *exampleExtension) ProxyError(r *http.Request, err error) {
+	if errors.Is(err, proxygo.ErrUpstreamUnreachable) || errors.Is(err, proxygo.ErrUpstreamTimeout) || errors.Is(err, proxygo.ErrUpstreamFailed) {
+		e.errors.Add(1)
+	}
+}
+
+// Close implements io.Closer
+func (e *exampleExtension) Close() error {
+	e.h.Logger().Printf("Example extension saw %d upstream errors", e.errors.Load())
+	return nil
+}
@@ -0,0 +1,9 @@
+// Command proxygo runs the proxy server. The proxy itself lives in package proxygo;
+// builds with extensions import that package and call proxygo.Main, as this one does.
+package main
+
+import "proxygo"
+
+func main() {
+	proxygo.Main()
+}
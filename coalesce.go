@@ -0,0 +1,200 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultCoalesceMaxBody is the largest response fanned out to waiting clients
+const defaultCoalesceMaxBody = 4 << 20
+
+// coalesceKeyHeaders are the request headers that can change the upstream response
+// and therefore must match for two requests to share one
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range"}
+
+// CoalesceConfig collapses identical concurrent GET requests into a single upstream request
+type CoalesceConfig struct {
+	Enabled bool     `json:"enabled"`
+	MaxBody ByteSize `json:"max_body"` // responses larger than this are not shared; default 4MB
+}
+
+// coalescer tracks in-flight upstream requests by key
+type coalescer struct {
+	maxBody int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+
+	results *metricVec
+}
+
+// coalescedCall is one in-flight upstream request that others may wait on
+type coalescedCall struct {
+	done chan struct{}
+	resp *capturedResponse // nil when the response could not be shared
+}
+
+// capturedResponse is a complete response recorded for replay
+type capturedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// newCoalescer returns nil when coalescing is disabled
+func newCoalescer(cfg *CoalesceConfig, metrics *metricsRegistry) *coalescer {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	maxBody := int64(cfg.MaxBody)
+	if maxBody <= 0 {
+		maxBody = defaultCoalesceMaxBody
+	}
+	return &coalescer{
+		maxBody: maxBody,
+		calls:   make(map[string]*coalescedCall),
+		results: metrics.counter("proxygo_coalesced_requests_total",
+			"Requests that waited on an identical in-flight request, by whether the response could be shared.", "result"),
+	}
+}
+
+// coalescable reports whether r may share an upstream response with other requests
+func coalescable(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.Body == nil || r.Body == http.NoBody)
+}
+
+// coalesceKey identifies requests that would receive the same upstream response. The route
+// is part of it, whatever its name: routes to one upstream may sign, authenticate or
+// filter differently.
+func coalesceKey(r *http.Request, target *proxyTarget) string {
+	sum := sha256.New()
+	// target.URL carries any userinfo, which becomes the upstream Authorization header
+	sum.Write([]byte(routeIdentity(target) + "\x00" + target.Socket + "\x00" + target.URL.String() + target.Path + "?" + r.URL.RawQuery))
+	for _, name := range coalesceKeyHeaders {
+		for _, v := range r.Header.Values(name) {
+			sum.Write([]byte("\x00" + name + ":" + v))
+		}
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// serve either leads the upstream request for key or waits for the current leader.
+// It returns false when the caller must make its own upstream request because the
+// leader's response could not be shared.
+func (c *coalescer) serve(w http.ResponseWriter, r *http.Request, key string, lead func(http.ResponseWriter)) bool {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return true
+		}
+
+		if call.resp == nil {
+			c.results.inc("fallback")
+			return false
+		}
+		c.results.inc("shared")
+		call.resp.writeTo(w)
+		return true
+	}
+
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// Stream to the leader's own client while keeping a copy for the waiters
+	capture := &captureWriter{ResponseWriter: w, limit: c.maxBody}
+	completed := false
+	defer func() {
+		// A panicking or cancelled leader leaves a partial response that must not be replayed,
+		// and an error the proxy produced answers the leader alone, such as its download limit
+		_, info := withRequestInfo(r)
+		if completed && r.Context().Err() == nil && capture.shareable() && !info.proxyError {
+			call.resp = &capturedResponse{status: capture.status, header: capture.header, body: capture.buf.Bytes()}
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	lead(capture)
+	completed = true
+	return true
+}
+
+// writeTo replays the captured response
+func (cr *capturedResponse) writeTo(w http.ResponseWriter) {
+	for k, vv := range cr.header {
+		w.Header()[k] = append([]string(nil), vv...)
+	}
+	w.WriteHeader(cr.status)
+	w.Write(cr.body)
+}
+
+// captureWriter forwards a response while recording it up to limit bytes
+type captureWriter struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	header   http.Header
+	buf      bytes.Buffer
+	overflow bool
+}
+
+// WriteHeader snapshots the headers as they are sent
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+		c.header = c.ResponseWriter.Header().Clone()
+		// The request ID belongs to this request, not to whoever the response is replayed to
+		c.header.Del("X-Request-Id")
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// Write forwards p and keeps a copy while under the limit
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if int64(c.buf.Len()+len(p)) > c.limit {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// shareable reports whether the recorded response is complete and self-contained
+func (c *captureWriter) shareable() bool {
+	if c.status == 0 || c.overflow || c.status == http.StatusSwitchingProtocols {
+		return false
+	}
+	// Trailers and per-client cookies cannot be replayed faithfully
+	if len(c.header.Values("Trailer")) > 0 || len(c.header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	// Trailers the upstream did not announce are only set once the body is done
+	for name := range c.ResponseWriter.Header() {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []coalesceRequest // sent concurrently
+		upstream int32             // upstream requests expected
+		cookie   bool              // the upstream sets a cookie, so its response is not shared
+		sameName bool              // routes a and b are both named api
+	}{
+		{name: "identical", requests: []coalesceRequest{{path: "/a/x"}, {path: "/a/x"}, {path: "/a/x"}}, upstream: 1},
+		{name: "different query", requests: []coalesceRequest{{path: "/a/x?p=1"}, {path: "/a/x?p=2"}}, upstream: 2},
+		{name: "different accept", requests: []coalesceRequest{{path: "/a/x", header: []string{"Accept", "text/plain"}}, {path: "/a/x", header: []string{"Accept", "application/json"}}}, upstream: 2},
+		{name: "different routes", requests: []coalesceRequest{{path: "/a/x"}, {path: "/b/x"}, {path: "/a/x"}, {path: "/b/x"}}, upstream: 2},
+		{name: "routes sharing a name", requests: []coalesceRequest{{path: "/a/x"}, {path: "/b/x"}, {path: "/a/x"}, {path: "/b/x"}}, upstream: 2, sameName: true},
+		{name: "not shareable", requests: []coalesceRequest{{path: "/a/x"}, {path: "/a/x"}}, upstream: 2, cookie: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var hits atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				<-release
+				if tt.cookie {
+					w.Header().Set("Set-Cookie", "s=1")
+				}
+				io.WriteString(w, r.Header.Get("Authorization")+" "+r.URL.RequestURI()+" "+r.Header.Get("Accept"))
+			}))
+			t.Cleanup(upstream.Close)
+			nameA, nameB := "a", "b"
+			if tt.sameName {
+				nameA, nameB = "api", "api"
+			}
+			h := newTestHandler(t, `{"coalesce": {"enabled": true},
+				"routes": [{"name": "`+nameA+`", "prefix": "/a/", "upstream": "`+upstream.URL+`", "upstream_headers": {"Authorization": "Bearer A"}},
+					{"name": "`+nameB+`", "prefix": "/b/", "upstream": "`+upstream.URL+`", "upstream_headers": {"Authorization": "Bearer B"}}]}`)
+
+			// Every request is in flight before the upstream answers any of them
+			var wg sync.WaitGroup
+			responses := make([]*httptest.ResponseRecorder, len(tt.requests))
+			for i, req := range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					responses[i] = cacheGet(h, req.path, req.header...)
+				}()
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			for i, req := range tt.requests {
+				// The upstream echoes the route's credentials, the upstream URI and the Accept header
+				want := map[byte]string{'a': "Bearer A", 'b': "Bearer B"}[req.path[1]] + " " + req.path[2:] + " "
+				if len(req.header) == 2 {
+					want += req.header[1]
+				}
+				if w := responses[i]; w.Code != http.StatusOK || w.Body.String() != want {
+					t.Errorf("request %d: %d %q, want %q", i, w.Code, w.Body, want)
+				}
+			}
+			if n := hits.Load(); n != tt.upstream {
+				t.Errorf("%d upstream requests, want %d", n, tt.upstream)
+			}
+		})
+	}
+}
+
+// coalesceRequest is one of the concurrent requests of a TestCoalesce case
+type coalesceRequest struct {
+	path   string
+	header []string // name and value pairs
+}
+
+func TestCoalesceLeaderOwnError(t *testing.T) {
+	release, hold := make(chan struct{}), make(chan struct{})
+	var big atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			// A download that stays open, using up its client's one session
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, "hold")
+			w.(http.Flusher).Flush()
+			<-hold
+			return
+		}
+		big.Add(1)
+		<-release
+		io.WriteString(w, "big")
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(hold) })
+	h := newTestHandler(t, `{"coalesce": {"enabled": true}, "downloads": {"max_sessions": 1, "min_size": 1},
+		"routes": [{"name": "files", "prefix": "/files/", "upstream": "`+upstream.URL+`"}]}`)
+
+	get := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	go get("192.0.2.1:1000", "/files/hold")
+	waitFor("the held download", func() bool {
+		h.downloads.mu.Lock()
+		defer h.downloads.mu.Unlock()
+		return h.downloads.active["192.0.2.1"] == 1
+	})
+
+	// The client at its limit leads the request; the other one waits on it
+	leader, waiter := make(chan *httptest.ResponseRecorder), make(chan *httptest.ResponseRecorder)
+	go func() { leader <- get("192.0.2.1:1001", "/files/big") }()
+	waitFor("the leader's upstream request", func() bool { return big.Load() == 1 })
+	go func() { waiter <- get("198.51.100.7:1000", "/files/big") }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if w := <-leader; w.Code != http.StatusTooManyRequests {
+		t.Errorf("leader: status %d, want 429", w.Code)
+	}
+	// The leader's limit is not the waiter's: it makes its own request
+	if w := <-waiter; w.Code != http.StatusOK || w.Body.String() != "big" {
+		t.Errorf("waiter: %d %q, want the download", w.Code, w.Body)
+	}
+	if n := big.Load(); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+}
@@ -0,0 +1,315 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Config is the top-level proxygo configuration, loaded from a JSON file
+type Config struct {
+	// Listeners declares every address the proxy accepts connections on
+	Listeners []ListenerConfig `json:"listeners"`
+
+	// Profiles maps a profile name to an ordered list of middleware names
+	Profiles map[string][]string `json:"profiles"`
+
+	// Routes mounts fixed upstreams under path prefixes
+	Routes []RouteConfig `json:"routes"`
+
+	// VirtualHosts routes requests by Host header, with per-host certificates chosen by SNI
+	VirtualHosts []VirtualHostConfig `json:"virtual_hosts"`
+
+	// Targets sets the default scheme and shorthand aliases for path-embedded targets
+	Targets *TargetsConfig `json:"targets,omitempty"`
+
+	// UnixSockets lists the sockets reachable through /unix:<socket>/path targets
+	UnixSockets []string `json:"unix_sockets"`
+
+	// FTP enables read-only ftp:// targets
+	FTP *FTPConfig `json:"ftp,omitempty"`
+
+	// Files enables read-only file:// targets beneath a root directory
+	Files *FilesConfig `json:"files,omitempty"`
+
+	// ObjectStorage holds the endpoints and credentials for s3:// and gs:// route upstreams
+	ObjectStorage *ObjectStorageConfig `json:"object_storage,omitempty"`
+
+	// Via adds the proxy to Via headers on forwarded requests and responses
+	Via *ViaConfig `json:"via,omitempty"`
+
+	// LoopDetection sets how many proxygo hops a request may pass before it is refused with 508
+	LoopDetection *LoopDetectionConfig `json:"loop_detection,omitempty"`
+
+	// Pool tunes upstream connection pooling; reloadable on SIGHUP
+	Pool *PoolConfig `json:"pool,omitempty"`
+
+	// GeoIP enables country annotation of access logs and country-based access rules
+	GeoIP *GeoIPConfig `json:"geoip,omitempty"`
+
+	// Bandwidth caps response bandwidth per client; reloadable on SIGHUP
+	Bandwidth *BandwidthConfig `json:"bandwidth,omitempty"`
+
+	// Downloads caps concurrent large or streaming responses per client; reloadable on SIGHUP
+	Downloads *DownloadsConfig `json:"downloads,omitempty"`
+
+	// Uploads tracks the progress of large request bodies and reports stalled ones
+	Uploads *UploadsConfig `json:"uploads,omitempty"`
+
+	// ContentFilter blocks responses by content type or URL extension unless a route overrides it
+	ContentFilter *ContentFilterConfig `json:"content_filter,omitempty"`
+
+	// BodyRewrite applies find/replace rules to text responses unless a route overrides it
+	BodyRewrite *BodyRewriteConfig `json:"body_rewrite,omitempty"`
+
+	// Images resizes and re-encodes proxied images on request
+	Images *ImagesConfig `json:"images,omitempty"`
+
+	// WAF blocks requests matching path traversal, SQL injection, XSS and oversized header rules
+	WAF *WAFConfig `json:"waf,omitempty"`
+
+	// SecurityHeaders adds HSTS, nosniff, frame options and CSP to responses unless a route overrides it
+	SecurityHeaders *SecurityHeadersConfig `json:"security_headers,omitempty"`
+
+	// ErrorPages renders proxy-generated errors as JSON or templated HTML unless a route overrides it
+	ErrorPages *ErrorPagesConfig `json:"error_pages,omitempty"`
+
+	// APIKeys enables API key authentication with per-key limits and quotas
+	APIKeys *APIKeysConfig `json:"api_keys,omitempty"`
+
+	// Tenants gives groups of clients, identified by API key or Host, their own routes, limits and usage
+	Tenants *TenantsConfig `json:"tenants,omitempty"`
+
+	// Auth validates JWTs from an identity provider, with optional OIDC browser login
+	Auth *AuthConfig `json:"auth,omitempty"`
+
+	// Identity forwards the client certificate and authenticated identity to upstreams
+	Identity *IdentityConfig `json:"identity,omitempty"`
+
+	// SignedURLs admits time-limited HMAC-signed links without client credentials
+	SignedURLs *SignedURLsConfig `json:"signed_urls,omitempty"`
+
+	// Integrity adds a SHA-256 header to responses and verifies upstream digests
+	Integrity *IntegrityConfig `json:"integrity,omitempty"`
+
+	// Coalesce collapses identical concurrent GETs into one upstream request
+	Coalesce *CoalesceConfig `json:"coalesce,omitempty"`
+
+	// Idempotency replays stored responses for POSTs that repeat an Idempotency-Key
+	Idempotency *IdempotencyConfig `json:"idempotency,omitempty"`
+
+	// Cache enables the in-memory response cache with optional pinned, prewarmed entries
+	Cache *CacheConfig `json:"cache,omitempty"`
+
+	// Cluster shares rate limits and cache purges with other instances through Redis
+	Cluster *ClusterConfig `json:"cluster,omitempty"`
+
+	// Usage enables persistent per-client and per-upstream usage accounting
+	Usage *UsageConfig `json:"usage,omitempty"`
+
+	// Kubernetes watches the mounted config and certificates and drains before shutdown
+	Kubernetes *KubernetesConfig `json:"kubernetes,omitempty"`
+
+	// Streams forward raw TCP and UDP traffic from their own listeners to fixed upstreams
+	Streams []StreamConfig `json:"streams,omitempty"`
+
+	// Schedules tighten rate limits or close routes during recurring windows; reloadable on SIGHUP
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+
+	// Scripts route, rewrite or refuse requests with rules written as expressions; reloadable on SIGHUP
+	Scripts []ScriptConfig `json:"scripts,omitempty"`
+
+	// PAC serves a proxy auto-config file listing the hosts to reach through proxygo
+	PAC *PACConfig `json:"pac,omitempty"`
+
+	// Maintenance is the static response served instead of the upstreams while maintenance mode is on
+	Maintenance *MaintenanceConfig `json:"maintenance,omitempty"`
+
+	// Notifications posts certificate expiry, error rate, reload failure and SLO events to webhooks
+	Notifications *NotificationsConfig `json:"notifications,omitempty"`
+
+	// Secrets resolves ${secret:name} references in upstream credentials from external stores
+	Secrets *SecretsConfig `json:"secrets,omitempty"`
+
+	// SLOs track per-route success and latency objectives, with burn rate alerts sent as notifications
+	SLOs []SLOConfig `json:"slos,omitempty"`
+
+	// Extensions holds the settings of extensions compiled into the build, by extension name
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+
+	// Admin enables the admin API and metrics on a separate listener
+	Admin *AdminConfig `json:"admin,omitempty"`
+
+	// Logging routes the access, error and audit logs to stdout, files or syslog
+	Logging *LoggingConfig `json:"logging,omitempty"`
+
+	// Audit records denials, auth failures, reloads and admin actions to a separate log
+	Audit *AuditConfig `json:"audit,omitempty"`
+}
+
+// ListenerConfig describes a single listening socket
+type ListenerConfig struct {
+	Name    string     `json:"name"`    // default "listener-N"; "admin" is taken by the admin API
+	Network string     `json:"network"` // "tcp" (default) or "unix"
+	Address string     `json:"address"` // e.g. ":8080" or "/run/proxygo.sock"
+	TLS     *TLSConfig `json:"tls,omitempty"`
+	Profile string     `json:"profile"` // middleware profile applied to this listener
+	H2C     bool       `json:"h2c"`     // accept cleartext HTTP/2, e.g. for plaintext gRPC clients
+
+	// HTTP3 also serves the listener over QUIC on the UDP port of the same address, and
+	// advertises it with Alt-Svc. Experimental; needs tls.
+	HTTP3 bool `json:"http3"`
+}
+
+// TLSConfig holds the certificate used to terminate TLS on a listener
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// Listeners only: verify client certificates against these CAs, for mTLS
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+	ClientAuth   string `json:"client_auth,omitempty"` // "require" (default) or "optional" to also accept clients without one
+}
+
+// DefaultConfig returns the configuration used when no config file is given
+func DefaultConfig() *Config {
+	return &Config{
+		Listeners: []ListenerConfig{
+			{Name: "default", Network: "tcp", Address: serverPort},
+		},
+		Profiles: map[string][]string{},
+	}
+}
+
+// LoadConfig reads and validates the config file at path.
+// An empty path yields the default configuration.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// normalize fills in defaults and validates the configuration
+func (c *Config) normalize() error {
+	if len(c.Listeners) == 0 {
+		c.Listeners = DefaultConfig().Listeners
+	}
+	if c.Profiles == nil {
+		c.Profiles = map[string][]string{}
+	}
+
+	for name, chain := range c.Profiles {
+		for _, mw := range chain {
+			if _, ok := middlewareRegistry[mw]; !ok {
+				return fmt.Errorf("profile %q: unknown middleware %q", name, mw)
+			}
+		}
+	}
+
+	if c.Pool != nil && c.Pool.CopyBuffer != 0 && (c.Pool.CopyBuffer < minCopyBuffer || c.Pool.CopyBuffer > maxCopyBuffer) {
+		return fmt.Errorf("pool: copy_buffer must be between 4KB and 1MB")
+	}
+	if c.Pool != nil && c.Pool.TLSSessionCache < -1 {
+		return fmt.Errorf("pool: tls_session_cache must be -1 or more")
+	}
+
+	if len(c.Schedules) > 0 {
+		applied := false
+		for _, chain := range c.Profiles {
+			applied = applied || slices.Contains(chain, "schedule")
+		}
+		if !applied {
+			return fmt.Errorf("schedules: no profile includes the schedule middleware")
+		}
+	}
+
+	if c.Admin != nil && c.Admin.Address == "" {
+		return fmt.Errorf("admin: missing address")
+	}
+	if c.Admin != nil && c.Admin.DryRun && c.Admin.Token == "" {
+		return fmt.Errorf("admin: dry_run needs a token")
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("listener-%d", i)
+		}
+		if seen[l.Name] {
+			return fmt.Errorf("duplicate listener name %q", l.Name)
+		}
+		if l.Name == adminListenerName {
+			return fmt.Errorf("listener name %q is reserved for the admin API listener", l.Name)
+		}
+		seen[l.Name] = true
+
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Network != "tcp" && l.Network != "unix" {
+			return fmt.Errorf("listener %q: unsupported network %q", l.Name, l.Network)
+		}
+		if l.Address == "" {
+			return fmt.Errorf("listener %q: missing address", l.Name)
+		}
+		if l.TLS != nil && (l.TLS.CertFile == "" || l.TLS.KeyFile == "") {
+			return fmt.Errorf("listener %q: tls requires cert_file and key_file", l.Name)
+		}
+		if l.HTTP3 && (l.TLS == nil || l.Network != "tcp") {
+			return fmt.Errorf("listener %q: http3 needs a tcp listener with tls", l.Name)
+		}
+		if l.TLS != nil && l.TLS.ClientAuth != "" {
+			if l.TLS.ClientCAFile == "" {
+				return fmt.Errorf("listener %q: tls client_auth requires client_ca_file", l.Name)
+			}
+			if l.TLS.ClientAuth != "require" && l.TLS.ClientAuth != "optional" {
+				return fmt.Errorf("listener %q: unknown tls client_auth %q: expected require or optional", l.Name, l.TLS.ClientAuth)
+			}
+		}
+		if l.Profile != "" {
+			if _, ok := c.Profiles[l.Profile]; !ok {
+				return fmt.Errorf("listener %q: unknown profile %q", l.Name, l.Profile)
+			}
+		}
+	}
+
+	for i, vc := range c.VirtualHosts {
+		if vc.TLS != nil && (vc.TLS.ClientCAFile != "" || vc.TLS.ClientAuth != "") {
+			return fmt.Errorf("virtual host #%d: client certificates are configured on the listener", i)
+		}
+	}
+
+	streams := make(map[string]bool)
+	for i := range c.Streams {
+		sc := &c.Streams[i]
+		if sc.Name == "" {
+			sc.Name = fmt.Sprintf("stream-%d", i)
+		}
+		if streams[sc.Name] {
+			return fmt.Errorf("duplicate stream name %q", sc.Name)
+		}
+		streams[sc.Name] = true
+		if err := sc.validate(); err != nil {
+			return fmt.Errorf("stream %q: %w", sc.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package proxygo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListenerNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []ListenerConfig
+		want      []string // names after normalize
+		err       string
+	}{
+		{name: "default", want: []string{"default"}},
+		{
+			name:      "defaulted names",
+			listeners: []ListenerConfig{{Address: ":8080"}, {Name: "internal", Address: ":8081"}, {Address: ":8082"}},
+			want:      []string{"listener-0", "internal", "listener-2"},
+		},
+		{
+			name:      "duplicate",
+			listeners: []ListenerConfig{{Name: "web", Address: ":8080"}, {Name: "web", Address: ":8081"}},
+			err:       `duplicate listener name "web"`,
+		},
+		{
+			name:      "duplicate of a default",
+			listeners: []ListenerConfig{{Address: ":8080"}, {Name: "listener-0", Address: ":8081"}},
+			err:       `duplicate listener name "listener-0"`,
+		},
+		{
+			name:      "admin",
+			listeners: []ListenerConfig{{Name: "admin", Address: ":8080"}},
+			err:       `listener name "admin" is reserved for the admin API listener`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Listeners: tt.listeners}
+			err := cfg.normalize()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("normalize: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, l := range cfg.Listeners {
+				names = append(names, l.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("names %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package proxygo
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ContentFilterConfig blocks or allows proxied content by media type and URL extension.
+// Deny lists win over allow lists; an empty allow list allows everything not denied.
+type ContentFilterConfig struct {
+	AllowTypes      []string `json:"allow_types"`      // e.g. "application/json", "image/*"
+	DenyTypes       []string `json:"deny_types"`       // e.g. "video/*", "application/x-msdownload"
+	AllowExtensions []string `json:"allow_extensions"` // only consulted for paths that have an extension
+	DenyExtensions  []string `json:"deny_extensions"`  // e.g. ".exe", ".msi"
+}
+
+// contentBlockedError explains why a request or response was filtered out
+type contentBlockedError struct {
+	reason string
+}
+
+// Error implements error
+func (e *contentBlockedError) Error() string {
+	return "content blocked: " + e.reason
+}
+
+// contentFilter is a compiled ContentFilterConfig
+type contentFilter struct {
+	allowTypes, denyTypes []string
+	allowExts, denyExts   map[string]bool
+}
+
+// newContentFilter compiles cfg, returning nil when there is nothing to filter
+func newContentFilter(cfg *ContentFilterConfig) *contentFilter {
+	if cfg == nil {
+		return nil
+	}
+
+	lowerAll := func(values []string) []string {
+		out := make([]string, 0, len(values))
+		for _, v := range values {
+			out = append(out, strings.ToLower(strings.TrimSpace(v)))
+		}
+		return out
+	}
+	extSet := func(exts []string) map[string]bool {
+		set := make(map[string]bool, len(exts))
+		for _, ext := range lowerAll(exts) {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			set[ext] = true
+		}
+		return set
+	}
+
+	return &contentFilter{
+		allowTypes: lowerAll(cfg.AllowTypes),
+		denyTypes:  lowerAll(cfg.DenyTypes),
+		allowExts:  extSet(cfg.AllowExtensions),
+		denyExts:   extSet(cfg.DenyExtensions),
+	}
+}
+
+// checkPath rejects request paths by extension, before the upstream is contacted
+func (f *contentFilter) checkPath(p string) error {
+	ext := strings.ToLower(path.Ext(p))
+	if ext == "" {
+		return nil
+	}
+	if f.denyExts[ext] {
+		return &contentBlockedError{reason: fmt.Sprintf("extension %s is not allowed", ext)}
+	}
+	if len(f.allowExts) > 0 && !f.allowExts[ext] {
+		return &contentBlockedError{reason: fmt.Sprintf("extension %s is not allowed", ext)}
+	}
+	return nil
+}
+
+// checkResponse rejects upstream responses by Content-Type
+func (f *contentFilter) checkResponse(resp *http.Response) error {
+	// A 304 describes content the client already holds
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	mediaType := "application/octet-stream"
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		if parsed, _, err := mime.ParseMediaType(ct); err == nil {
+			mediaType = parsed
+		}
+	}
+
+	if matchesMediaType(f.denyTypes, mediaType) {
+		return &contentBlockedError{reason: fmt.Sprintf("content type %s is not allowed", mediaType)}
+	}
+	if len(f.allowTypes) > 0 && !matchesMediaType(f.allowTypes, mediaType) {
+		return &contentBlockedError{reason: fmt.Sprintf("content type %s is not allowed", mediaType)}
+	}
+	return nil
+}
+
+// matchesMediaType reports whether mediaType matches any pattern, supporting "type/*" wildcards
+func matchesMediaType(patterns []string, mediaType string) bool {
+	for _, p := range patterns {
+		if p == mediaType || p == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package proxygo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestContentFilter(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if ct := r.URL.Query().Get("type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		} else {
+			w.Header()["Content-Type"] = nil
+		}
+		if r.URL.Query().Get("status") == "304" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{
+		"content_filter": {"deny_types": ["video/*"], "deny_extensions": ["exe"]},
+		"routes": [
+			{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`",
+			 "content_filter": {"allow_types": ["application/json", "image/*"], "deny_types": ["image/svg+xml"],
+				"allow_extensions": [".json", ".PNG"], "deny_extensions": [".png.exe"]}},
+			{"name": "files", "prefix": "/files/", "upstream": "`+upstream.URL+`"}]}`)
+
+	tests := []struct {
+		name    string
+		target  string
+		status  int
+		reached bool // whether the upstream was asked
+	}{
+		{name: "allowed type", target: "/api/items?type=application/json", status: http.StatusOK, reached: true},
+		{name: "allowed type with parameters", target: "/api/items?type=application/json%3B+charset=utf-8", status: http.StatusOK, reached: true},
+		{name: "allowed wildcard", target: "/api/logo?type=image/png", status: http.StatusOK, reached: true},
+		{name: "deny wins over allow", target: "/api/logo?type=image/svg%2Bxml", status: http.StatusForbidden, reached: true},
+		{name: "type not allowed", target: "/api/page?type=text/html", status: http.StatusForbidden, reached: true},
+		{name: "missing type", target: "/api/blob", status: http.StatusForbidden, reached: true},
+		{name: "not modified", target: "/api/page?type=text/html&status=304", status: http.StatusNotModified, reached: true},
+		{name: "allowed extension", target: "/api/logo.png?type=image/png", status: http.StatusOK, reached: true},
+		{name: "extension not allowed", target: "/api/report.pdf?type=application/json", status: http.StatusForbidden},
+		{name: "denied extension", target: "/api/logo.png.exe", status: http.StatusForbidden},
+
+		// The route's filter replaces the global one rather than adding to it
+		{name: "global type", target: "/files/movie?type=video/mp4", status: http.StatusForbidden, reached: true},
+		{name: "global extension", target: "/files/setup.EXE", status: http.StatusForbidden},
+		{name: "global other", target: "/files/page.html?type=text/html", status: http.StatusOK, reached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := hits.Load()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w.Code == http.StatusForbidden && !strings.Contains(w.Body.String(), "content blocked") {
+				t.Errorf("body %q does not say the content was blocked", w.Body.String())
+			}
+			if reached := hits.Load() > before; reached != tt.reached {
+				t.Errorf("upstream asked %v, want %v", reached, tt.reached)
+			}
+		})
+	}
+}
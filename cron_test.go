@@ -0,0 +1,99 @@
+package proxygo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronMatches(t *testing.T) {
+	// 2024-06-03 is a Monday, 2024-06-09 a Sunday
+	monday := time.Date(2024, 6, 3, 10, 30, 0, 0, time.UTC)
+	saturday := time.Date(2024, 6, 8, 10, 30, 0, 0, time.UTC)
+	sunday := time.Date(2024, 6, 9, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"* * * * *", monday, true},
+		{"30 10 * * *", monday, true},
+		{"31 10 * * *", monday, false},
+		{"*/15 9-17 * * 1-5", monday, true},
+		{"*/15 9-17 * * 1-5", sunday, false},
+
+		// Sunday is 0 or 7, and 7 means Sunday alone
+		{"* * * * 7", sunday, true},
+		{"* * * * 7", monday, false},
+		{"* * * * 7", saturday, false},
+		{"* * * * 0", sunday, true},
+		{"* * * * 5-7", saturday, true},
+		{"* * * * 5-7", sunday, true},
+		{"* * * * 5-7", monday, false},
+		{"* * * * 0,7", sunday, true},
+		{"* * * * 0,7", monday, false},
+		{"* * * * 6,7", saturday, true},
+
+		// With both day fields restricted, either may match
+		{"* * 3 * 0", monday, true},
+		{"* * 4 * 0", sunday, true},
+		{"* * 4 * 0", monday, false},
+		{"* * * 7 *", monday, false},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.matches(tt.at); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.spec, tt.at.Format("Mon 2006-01-02 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@hourly", time.Date(2023, 3, 1, 1, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+		{"0 12 * * 7", time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q next after %s = %s, want %s", tt.spec, from, got, tt.want)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"@every -1m",
+		// No month has these days, so the schedule would never fire
+		"0 0 31 2 *",
+		"0 0 30,31 2 *",
+		"0 0 31 4,6,9,11 *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package proxygo
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardHeartbeat keeps idle event streams from being closed by intermediaries
+const dashboardHeartbeat = 15 * time.Second
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// trafficEvent is one completed request as shown on the dashboard
+type trafficEvent struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+	Cache    string    `json:"cache,omitempty"`
+}
+
+// hostStats aggregates the traffic to one upstream since startup
+type hostStats struct {
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"` // 5xx responses
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	totalMs      float64
+}
+
+// feedEvent is one server-sent event of the dashboard stream
+type feedEvent struct {
+	name string // "request" or "upload"
+	data any
+}
+
+// trafficFeed fans completed requests and upload progress out to dashboard subscribers
+// and keeps per-host totals
+type trafficFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan feedEvent]struct{}
+	hosts       map[string]*hostStats
+}
+
+// newTrafficFeed creates an empty feed
+func newTrafficFeed() *trafficFeed {
+	return &trafficFeed{subscribers: make(map[chan feedEvent]struct{}), hosts: make(map[string]*hostStats)}
+}
+
+// publish records ev and hands it to every subscriber that keeps up
+func (f *trafficFeed) publish(ev trafficEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hs, ok := f.hosts[ev.Host]
+	if !ok {
+		hs = &hostStats{}
+		f.hosts[ev.Host] = hs
+	}
+	hs.Requests++
+	if ev.Status >= 500 {
+		hs.Errors++
+	}
+	hs.totalMs += ev.Duration
+	f.send(feedEvent{name: "request", data: ev})
+}
+
+// publishUpload hands the progress of an upload to every subscriber that keeps up
+func (f *trafficFeed) publishUpload(ev uploadEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.send(feedEvent{name: "upload", data: ev})
+}
+
+// send hands ev to every subscriber that keeps up; the caller holds f.mu
+func (f *trafficFeed) send(ev feedEvent) {
+	for ch := range f.subscribers {
+		// A slow browser loses events rather than slowing down the proxy
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// subscribe registers a new event channel; call the returned func to release it
+func (f *trafficFeed) subscribe() (<-chan feedEvent, func()) {
+	ch := make(chan feedEvent, 64)
+	f.mu.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subscribers, ch)
+		f.mu.Unlock()
+	}
+}
+
+// hostSnapshot copies the per-host totals
+func (f *trafficFeed) hostSnapshot() map[string]hostStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]hostStats, len(f.hosts))
+	for host, hs := range f.hosts {
+		s := *hs
+		s.AvgLatencyMs = hs.totalMs / float64(hs.Requests)
+		out[host] = s
+	}
+	return out
+}
+
+// dashboardEnabled answers 404 when the dashboard is switched off
+func (a *adminAPI) dashboardEnabled(w http.ResponseWriter) bool {
+	if a.proxy.traffic == nil {
+		writeJSONError(w, http.StatusNotFound, "dashboard_disabled", "set admin.dashboard to use the dashboard")
+		return false
+	}
+	return true
+}
+
+// serveDashboard handles GET /dashboard
+func (a *adminAPI) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if !a.dashboardEnabled(w) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardHTML)
+}
+
+// dashboardEvents handles GET /dashboard/events, streaming completed requests and upload
+// progress as server-sent events
+func (a *adminAPI) dashboardEvents(w http.ResponseWriter, r *http.Request) {
+	if !a.dashboardEnabled(w) {
+		return
+	}
+
+	events, release := a.proxy.traffic.subscribe()
+	defer release()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(dashboardHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-events:
+			data, _ := json.Marshal(ev.data)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// dashboardStats handles GET /dashboard/stats
+func (a *adminAPI) dashboardStats(w http.ResponseWriter, r *http.Request) {
+	if !a.dashboardEnabled(w) {
+		return
+	}
+
+	stats := struct {
+		Hosts map[string]hostStats `json:"hosts"`
+		Cache *cacheStats          `json:"cache,omitempty"`
+	}{Hosts: a.proxy.traffic.hostSnapshot()}
+	if a.proxy.cache != nil {
+		s := a.proxy.cache.stats()
+		stats.Cache = &s
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// Config keys whose string values the dashboard shows. Every other string is shown as
+// [redacted], so fields added later stay hidden until they are listed here.
+var dashboardVisibleKeys = map[string]bool{
+	"address": true, "aliases_file": true, "allow": true, "allow_extensions": true, "allow_types": true,
+	"allowed_clients": true, "allowed_hosts": true, "api_keys": true, "audience": true, "body_file": true,
+	"by": true, "cert_file": true, "claim_headers": true, "client_auth": true, "client_ca_file": true,
+	"client_id": true, "content_security_policy": true, "content_type": true, "cookie": true, "database": true,
+	"default_scheme": true, "deny": true, "deny_extensions": true, "deny_types": true, "dir": true,
+	"disabled_rules": true, "events": true, "field": true, "file": true, "find": true, "format": true,
+	"frame_options": true, "header": true, "hosts": true, "id": true, "ignore_fields": true,
+	"ignore_headers": true, "issuer": true, "key_file": true, "key_prefix": true, "listen": true,
+	"message": true, "methods": true, "mode": true, "name": true, "namespace": true, "network": true,
+	"on_error": true, "openapi": true, "pages": true, "path": true, "pattern": true, "prefix": true,
+	"primary": true, "profile": true, "profiles": true, "proxy": true, "pseudonym": true,
+	"redact_fields": true, "redact_headers": true, "region": true, "replace": true, "root": true,
+	"routes": true, "rule_sets": true, "schedule": true, "schema": true, "scopes": true, "service": true,
+	"signed_header": true, "socket": true, "source": true, "strip": true, "strip_headers": true,
+	"syslog": true, "timezone": true, "token_file": true, "type": true, "types": true,
+	"unix_sockets": true, "when": true, "window": true,
+}
+
+// Config keys holding URLs, shown without their userinfo
+var dashboardURLKeys = map[string]bool{
+	"upstream": true, "aliases": true, "endpoint": true, "jwks_url": true, "redirect_url": true, "redis": true,
+}
+
+// dashboardConfig handles GET /dashboard/config, showing the active config without secrets
+func (a *adminAPI) dashboardConfig(w http.ResponseWriter, r *http.Request) {
+	if !a.dashboardEnabled(w) {
+		return
+	}
+	cfg := redactConfig(reflect.ValueOf(a.proxy.config.Load()), "")
+	writeJSON(w, http.StatusOK, cfg.Interface())
+}
+
+// redactConfig returns a deep copy of v whose strings are redacted unless the JSON key
+// they are found under is in dashboardVisibleKeys. Map values and slice elements take
+// the key of the field holding them, so header maps are redacted by their field's key
+// and not by each header name.
+func redactConfig(v reflect.Value, key string) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			out.Set(redactConfig(v.Elem(), key).Addr())
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			out.Set(redactConfig(v.Elem(), key))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			switch {
+			case name != "":
+			case f.Anonymous:
+				name = key
+			default:
+				name = f.Name
+			}
+			out.Field(i).Set(redactConfig(v.Field(i), name))
+		}
+	case reflect.Slice:
+		switch {
+		case v.IsNil():
+		case v.Type() == reflect.TypeFor[json.RawMessage]():
+			// Extension settings are opaque
+			out.Set(reflect.ValueOf(json.RawMessage(strconv.Quote(redactedValue))))
+		default:
+			out.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				out.Index(i).Set(redactConfig(v.Index(i), key))
+			}
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			out.Set(reflect.MakeMapWithSize(v.Type(), v.Len()))
+			for iter := v.MapRange(); iter.Next(); {
+				out.SetMapIndex(iter.Key(), redactConfig(iter.Value(), key))
+			}
+		}
+	case reflect.String:
+		switch s := v.String(); {
+		case s == "" || dashboardVisibleKeys[key]:
+			out.Set(v)
+		case dashboardURLKeys[key]:
+			out.SetString(withoutUserinfo(s))
+		default:
+			out.SetString(redactedValue)
+		}
+	default:
+		out.Set(v)
+	}
+	return out
+}
+
+// withoutUserinfo removes the credentials from a URL, redacting values that do not parse
+func withoutUserinfo(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactedValue
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,33 @@
+package proxygo
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// publishDebugVars adds proxygo's own variables to /debug/vars, next to cmdline and memstats
+var publishDebugVars = sync.OnceFunc(func() {
+	started := time.Now()
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() any { return int64(time.Since(started).Seconds()) }))
+})
+
+// registerDebug mounts the pprof and expvar endpoints the config enables. Both reveal
+// process internals, so they sit behind the admin token like the other admin endpoints.
+func (a *adminAPI) registerDebug(cfg *AdminConfig) {
+	if cfg.Pprof {
+		a.mux.HandleFunc("GET /debug/pprof/", a.authorized(pprof.Index))
+		a.mux.HandleFunc("GET /debug/pprof/cmdline", a.authorized(pprof.Cmdline))
+		a.mux.HandleFunc("GET /debug/pprof/profile", a.authorized(pprof.Profile))
+		a.mux.HandleFunc("GET /debug/pprof/symbol", a.authorized(pprof.Symbol))
+		a.mux.HandleFunc("POST /debug/pprof/symbol", a.authorized(pprof.Symbol))
+		a.mux.HandleFunc("GET /debug/pprof/trace", a.authorized(pprof.Trace))
+	}
+	if cfg.Expvar {
+		publishDebugVars()
+		a.mux.HandleFunc("GET /debug/vars", a.authorized(expvar.Handler().ServeHTTP))
+	}
+}
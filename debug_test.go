@@ -0,0 +1,67 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		admin  string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "pprof index", admin: `"pprof": true`, path: "/debug/pprof/", token: "secret", status: http.StatusOK},
+		{name: "pprof profile", admin: `"pprof": true`, path: "/debug/pprof/goroutine?debug=1", token: "secret", status: http.StatusOK},
+		{name: "pprof cmdline", admin: `"pprof": true`, path: "/debug/pprof/cmdline", token: "secret", status: http.StatusOK},
+		{name: "pprof without token", admin: `"pprof": true`, path: "/debug/pprof/heap", status: http.StatusUnauthorized},
+		{name: "pprof wrong token", admin: `"pprof": true`, path: "/debug/pprof/heap", token: "guess", status: http.StatusUnauthorized},
+		{name: "pprof off", admin: `"expvar": true`, path: "/debug/pprof/", token: "secret", status: http.StatusNotFound},
+		{name: "expvar", admin: `"expvar": true`, path: "/debug/vars", token: "secret", status: http.StatusOK},
+		{name: "expvar without token", admin: `"expvar": true`, path: "/debug/vars", status: http.StatusUnauthorized},
+		{name: "expvar off", admin: `"pprof": true`, path: "/debug/vars", token: "secret", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0", "token": "secret", `+tt.admin+`}}`)
+			admin := newAdminAPI(h, h.config.Load().Admin)
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.path == "/debug/vars" && w.Code == http.StatusOK {
+				var vars map[string]json.RawMessage
+				if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range []string{"cmdline", "memstats", "goroutines", "uptime_seconds"} {
+					if vars[name] == nil {
+						t.Errorf("/debug/vars lacks %s", name)
+					}
+				}
+			}
+		})
+	}
+
+	// The proxy listeners never serve them
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0", "token": "secret", "pprof": true, "expvar": true}}`)
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "goroutine") {
+			t.Errorf("proxy served %s: %d", path, w.Code)
+		}
+	}
+}
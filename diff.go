@@ -0,0 +1,503 @@
+package proxygo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response diffing defaults
+const (
+	defaultDiffMaxBody     = 1 << 20
+	defaultDiffTimeout     = 10 * time.Second
+	maxRecordedDifferences = 50
+)
+
+// defaultDiffIgnoredHeaders vary between any two responses, or describe framing rather than
+// content; bodies are compared decoded, so Content-Encoding is framing too
+var defaultDiffIgnoredHeaders = []string{"Date", "Age", "Expires", "Server", "Via", "X-Request-Id", "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection", "Keep-Alive"}
+
+// DiffConfig sends a route's requests to a candidate upstream as well, for example a new
+// API version, and records how its responses differ. Only the primary response reaches the client.
+type DiffConfig struct {
+	Upstream      string   `json:"upstream"`       // candidate base URL, e.g. "http://api-v2.internal"
+	Methods       []string `json:"methods"`        // default GET and HEAD; other methods would run side effects twice
+	SampleRate    float64  `json:"sample_rate"`    // fraction of requests compared; default 1
+	IgnoreHeaders []string `json:"ignore_headers"` // beyond Date, Age, Expires, Server, Via, X-Request-Id and framing headers
+	IgnoreFields  []string `json:"ignore_fields"`  // JSON paths left out of body comparison, e.g. "$.meta.generated_at" or "$.items[*].id"
+	MaxBody       ByteSize `json:"max_body"`       // larger bodies are not compared; default 1MB
+	Timeout       Duration `json:"timeout"`        // for the candidate's response; default 10s
+}
+
+// responseDiffer is a compiled DiffConfig
+type responseDiffer struct {
+	candidate     *url.URL
+	methods       []string
+	sampleRate    float64
+	ignoreHeaders map[string]bool
+	ignoreFields  []*regexp.Regexp
+	maxBody       int64
+	timeout       time.Duration
+}
+
+// newResponseDiffer returns nil when the route is not compared against a candidate
+func newResponseDiffer(cfg *DiffConfig) (*responseDiffer, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.Upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("diff: upstream must be an absolute http(s) URL")
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("diff: sample_rate must be between 0 and 1")
+	}
+
+	d := &responseDiffer{
+		candidate:     u,
+		methods:       []string{http.MethodGet, http.MethodHead},
+		sampleRate:    cfg.SampleRate,
+		ignoreHeaders: make(map[string]bool),
+		maxBody:       int64(cfg.MaxBody),
+		timeout:       time.Duration(cfg.Timeout),
+	}
+	if len(cfg.Methods) > 0 {
+		d.methods = nil
+		for _, m := range cfg.Methods {
+			d.methods = append(d.methods, strings.ToUpper(m))
+		}
+	}
+	if d.sampleRate == 0 {
+		d.sampleRate = 1
+	}
+	if d.maxBody <= 0 {
+		d.maxBody = defaultDiffMaxBody
+	}
+	if d.timeout <= 0 {
+		d.timeout = defaultDiffTimeout
+	}
+	for _, name := range append(slices.Clone(defaultDiffIgnoredHeaders), cfg.IgnoreHeaders...) {
+		d.ignoreHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, field := range cfg.IgnoreFields {
+		re, err := compileJSONPathPattern(field)
+		if err != nil {
+			return nil, err
+		}
+		d.ignoreFields = append(d.ignoreFields, re)
+	}
+	return d, nil
+}
+
+// compileJSONPathPattern turns "$.items[*].id" into a pattern over the paths diffs report;
+// [*] matches any index and a * segment any key
+func compileJSONPathPattern(field string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(field, "$") {
+		return nil, fmt.Errorf("diff: ignore_fields entry %q must start with $", field)
+	}
+	pattern := regexp.QuoteMeta(field)
+	pattern = strings.ReplaceAll(pattern, `\[\*\]`, `\[\d+\]`)
+	pattern = strings.ReplaceAll(pattern, `\.\*`, `\.[^.\[]+`)
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// diffSide is one upstream's response, with its body read up to the limit
+type diffSide struct {
+	status    int
+	header    http.Header
+	body      []byte
+	truncated bool
+	err       error
+}
+
+// responseDifference is one recorded mismatch
+type responseDifference struct {
+	Kind      string `json:"kind"` // "status", "header" or "body"
+	Path      string `json:"path,omitempty"`
+	Primary   any    `json:"primary,omitempty"`
+	Candidate any    `json:"candidate,omitempty"`
+}
+
+// diffRecord is written for every compared request whose responses differ
+type diffRecord struct {
+	Time        time.Time            `json:"time"`
+	Route       string               `json:"route"`
+	Method      string               `json:"method"`
+	Path        string               `json:"path"`
+	RequestID   string               `json:"request_id,omitempty"`
+	Differences []responseDifference `json:"differences"`
+	Truncated   bool                 `json:"truncated,omitempty"` // more differences were found than recorded
+}
+
+// diffRecorder writes diff records as JSON lines, or to the error log when no sink is configured
+type diffRecorder struct {
+	mu      sync.Mutex
+	sinks   []io.WriteCloser
+	results *metricVec
+}
+
+// newDiffRecorder writes to the logging.diff sinks
+func newDiffRecorder(sinks []io.WriteCloser, metrics *metricsRegistry) *diffRecorder {
+	return &diffRecorder{
+		sinks:   sinks,
+		results: metrics.counter("proxygo_diff_comparisons_total", "Requests compared against a candidate upstream, by route and result.", "route", "result"),
+	}
+}
+
+// diffTransport sends requests to the candidate alongside the primary and compares the two
+// responses once the primary's body has been passed on to the client
+type diffTransport struct {
+	http.RoundTripper
+	differ   *responseDiffer
+	route    *Route
+	recorder *diffRecorder
+	h        *ProxyHandler
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *diffTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d := t.differ
+	if !slices.Contains(d.methods, req.Method) || (d.sampleRate < 1 && rand.Float64() >= d.sampleRate) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// Both upstreams need the body, so it is read up front
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, d.maxBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > d.maxBody {
+			rest := req.Body
+			req = req.Clone(req.Context())
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), rest), rest}
+			t.recorder.results.inc(t.route.Name, "skipped")
+			return t.RoundTripper.RoundTrip(req)
+		}
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+
+	candidate := make(chan diffSide, 1)
+	go func() { candidate <- t.fetchCandidate(req, body) }()
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		t.recorder.results.inc(t.route.Name, "error")
+		return nil, err
+	}
+	primary := diffSide{status: resp.StatusCode, header: resp.Header.Clone()}
+	resp.Body = &diffCapture{ReadCloser: resp.Body, limit: d.maxBody, done: func(captured []byte, complete, truncated bool) {
+		if !complete {
+			t.recorder.results.inc(t.route.Name, "skipped")
+			return
+		}
+		primary.body, primary.truncated = captured, truncated
+		go func() { t.compare(req, primary, <-candidate) }()
+	}}
+	return resp, nil
+}
+
+// fetchCandidate sends req to the candidate; the client going away does not cut it short
+func (t *diffTransport) fetchCandidate(req *http.Request, body []byte) diffSide {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), t.differ.timeout)
+	defer cancel()
+
+	out := req.Clone(ctx)
+	rest := strings.TrimPrefix(req.URL.Path, t.route.Upstream.Path)
+	out.URL = &url.URL{Scheme: t.differ.candidate.Scheme, Host: t.differ.candidate.Host, Path: singleJoiningSlash(t.differ.candidate.Path, rest), RawQuery: req.URL.RawQuery}
+	out.Host = hostHeader(t.differ.candidate)
+	out.Body = http.NoBody
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+
+	resp, err := t.h.transports.forTarget(&proxyTarget{URL: t.differ.candidate}, false).RoundTrip(out)
+	if err != nil {
+		return diffSide{err: err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, t.differ.maxBody+1))
+	if err != nil {
+		return diffSide{err: err}
+	}
+	side := diffSide{status: resp.StatusCode, header: resp.Header}
+	if int64(len(data)) > t.differ.maxBody {
+		side.truncated = true
+	} else {
+		side.body = data
+	}
+	return side
+}
+
+// compare records how the candidate's response differs from the primary's
+func (t *diffTransport) compare(req *http.Request, primary, candidate diffSide) {
+	if candidate.err != nil {
+		t.recorder.results.inc(t.route.Name, "error")
+		t.h.logger.Printf("Diff candidate for %s failed: %v", req.URL.Path, candidate.err)
+		return
+	}
+
+	var diffs []responseDifference
+	if primary.status != candidate.status {
+		diffs = append(diffs, responseDifference{Kind: "status", Primary: primary.status, Candidate: candidate.status})
+	}
+	diffs = append(diffs, t.differ.compareHeaders(primary.header, candidate.header)...)
+	diffs = append(diffs, t.differ.compareBodies(primary, candidate)...)
+
+	if len(diffs) == 0 {
+		t.recorder.results.inc(t.route.Name, "match")
+		return
+	}
+	t.recorder.results.inc(t.route.Name, "mismatch")
+	_, info := withRequestInfo(req)
+	rec := diffRecord{Time: time.Now().UTC(), Route: t.route.Name, Method: req.Method, Path: req.URL.Path, RequestID: info.RequestID}
+	if len(diffs) > maxRecordedDifferences {
+		diffs, rec.Truncated = diffs[:maxRecordedDifferences], true
+	}
+	rec.Differences = diffs
+	if err := t.recorder.record(t.h, rec); err != nil {
+		t.h.logger.Printf("Diff log write failed: %v", err)
+	}
+}
+
+// compareHeaders reports headers that differ, ignoring the configured ones
+func (d *responseDiffer) compareHeaders(primary, candidate http.Header) []responseDifference {
+	names := make(map[string]bool)
+	for name := range primary {
+		names[name] = true
+	}
+	for name := range candidate {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		if !d.ignoreHeaders[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	slices.Sort(sorted)
+
+	var diffs []responseDifference
+	for _, name := range sorted {
+		p, c := strings.Join(primary.Values(name), ", "), strings.Join(candidate.Values(name), ", ")
+		if p != c {
+			diffs = append(diffs, responseDifference{Kind: "header", Path: name, Primary: p, Candidate: c})
+		}
+	}
+	return diffs
+}
+
+// compareBodies compares JSON bodies structurally and anything else byte for byte
+func (d *responseDiffer) compareBodies(primary, candidate diffSide) []responseDifference {
+	if primary.truncated || candidate.truncated {
+		return nil
+	}
+	p, c := decodedBody(primary), decodedBody(candidate)
+	if bytes.Equal(p, c) {
+		return nil
+	}
+
+	if isJSONResponse(primary.header) && isJSONResponse(candidate.header) {
+		pv, perr := decodeJSON(p)
+		cv, cerr := decodeJSON(c)
+		if perr == nil && cerr == nil {
+			var diffs []responseDifference
+			d.diffJSON("$", pv, cv, &diffs)
+			return diffs
+		}
+	}
+	summary := func(b []byte) string {
+		return fmt.Sprintf("%d bytes, sha256 %x", len(b), sha256.Sum256(b))
+	}
+	return []responseDifference{{Kind: "body", Primary: summary(p), Candidate: summary(c)}}
+}
+
+// diffJSON appends the differences between two decoded JSON values at path
+func (d *responseDiffer) diffJSON(path string, p, c any, diffs *[]responseDifference) {
+	for _, re := range d.ignoreFields {
+		if re.MatchString(path) {
+			return
+		}
+	}
+	if len(*diffs) > maxRecordedDifferences {
+		return
+	}
+
+	switch pv := p.(type) {
+	case map[string]any:
+		if cv, ok := c.(map[string]any); ok {
+			keys := make(map[string]bool)
+			for k := range pv {
+				keys[k] = true
+			}
+			for k := range cv {
+				keys[k] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			slices.Sort(sorted)
+			for _, k := range sorted {
+				d.diffJSON(path+"."+k, pv[k], cv[k], diffs)
+			}
+			return
+		}
+	case []any:
+		if cv, ok := c.([]any); ok {
+			for i := range max(len(pv), len(cv)) {
+				var pe, ce any
+				if i < len(pv) {
+					pe = pv[i]
+				}
+				if i < len(cv) {
+					ce = cv[i]
+				}
+				d.diffJSON(path+"["+strconv.Itoa(i)+"]", pe, ce, diffs)
+			}
+			return
+		}
+	}
+	if !jsonEqual(p, c) {
+		*diffs = append(*diffs, responseDifference{Kind: "body", Path: path, Primary: p, Candidate: c})
+	}
+}
+
+// jsonEqual compares scalars, treating numbers by value so 1 and 1.0 match
+func jsonEqual(p, c any) bool {
+	if pn, ok := p.(json.Number); ok {
+		cn, ok := c.(json.Number)
+		if !ok {
+			return false
+		}
+		pf, perr := pn.Float64()
+		cf, cerr := cn.Float64()
+		if perr == nil && cerr == nil {
+			return pf == cf
+		}
+		return pn == cn
+	}
+	switch p.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	switch c.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return p == c
+}
+
+// decodeJSON decodes one JSON document, keeping numbers exact
+func decodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// isJSONResponse reports whether header declares a JSON body
+func isJSONResponse(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodedBody undoes gzip, so upstreams that compress differently still compare equal
+func decodedBody(side diffSide) []byte {
+	if !strings.EqualFold(side.header.Get("Content-Encoding"), "gzip") {
+		return side.body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(side.body))
+	if err != nil {
+		return side.body
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return side.body
+	}
+	return data
+}
+
+// record writes rec to each sink, or to the error log without sinks
+func (r *diffRecorder) record(h *ProxyHandler, rec diffRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if len(r.sinks) == 0 {
+		h.logger.Printf("Response diff: %s", line)
+		return nil
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sink := range r.sinks {
+		if _, err := sink.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffCapture keeps a copy of the primary body as the client reads it. done runs once, on
+// Close: complete is false when the client stopped reading before the end.
+type diffCapture struct {
+	io.ReadCloser
+	limit     int64
+	buf       bytes.Buffer
+	truncated bool
+	eof       bool
+	once      sync.Once
+	done      func(body []byte, complete, truncated bool)
+}
+
+// Read implements io.Reader
+func (c *diffCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.truncated {
+		if int64(c.buf.Len()+n) > c.limit {
+			c.truncated = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (c *diffCapture) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { c.done(c.buf.Bytes(), c.eof, c.truncated) })
+	return err
+}
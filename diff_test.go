@@ -0,0 +1,181 @@
+package proxygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJSONPathPattern(t *testing.T) {
+	tests := []struct {
+		field string
+		match []string
+		miss  []string
+	}{
+		{field: "$.meta.generated_at", match: []string{"$.meta.generated_at"}, miss: []string{"$.meta", "$.meta.generated_at_ms", "$.xmeta.generated_at"}},
+		{field: "$.items[*].id", match: []string{"$.items[0].id", "$.items[12].id"}, miss: []string{"$.items[0].name", "$.items.id"}},
+		{field: "$.*.etag", match: []string{"$.user.etag", "$.order.etag"}, miss: []string{"$.user.profile.etag", "$.items[0].etag"}},
+	}
+	for _, tt := range tests {
+		re, err := compileJSONPathPattern(tt.field)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.field, err)
+		}
+		for _, path := range tt.match {
+			if !re.MatchString(path) {
+				t.Errorf("%s does not match %s", tt.field, path)
+			}
+		}
+		for _, path := range tt.miss {
+			if re.MatchString(path) {
+				t.Errorf("%s matches %s", tt.field, path)
+			}
+		}
+	}
+	if _, err := compileJSONPathPattern("items[*].id"); err == nil {
+		t.Error("a field without $ compiled")
+	}
+}
+
+func TestCompareBodies(t *testing.T) {
+	d, err := newResponseDiffer(&DiffConfig{Upstream: "http://candidate.internal", IgnoreFields: []string{"$.meta.*", "$.items[*].etag"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	textHeader := http.Header{"Content-Type": {"text/plain"}}
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		primary   string
+		candidate string
+		want      []string // kind and path of each difference
+	}{
+		{name: "equal", header: jsonHeader, primary: `{"a": 1}`, candidate: `{"a": 1}`},
+		{name: "numbers by value", header: jsonHeader, primary: `{"a": 1, "b": [1.50]}`, candidate: `{"b": [1.5], "a": 1.0}`},
+		{
+			name: "changed fields", header: jsonHeader,
+			primary:   `{"name": "a", "items": [{"id": 1}, {"id": 2}], "gone": true}`,
+			candidate: `{"name": "b", "items": [{"id": 1}, {"id": 3}, {"id": 4}], "added": null}`,
+			want:      []string{"body $.gone", "body $.items[1].id", "body $.items[2]", "body $.name"},
+		},
+		{
+			name: "ignored fields", header: jsonHeader,
+			primary:   `{"meta": {"at": "1"}, "items": [{"etag": "x", "id": 1}]}`,
+			candidate: `{"meta": {"at": "2"}, "items": [{"etag": "y", "id": 1}]}`,
+		},
+		{name: "type change", header: jsonHeader, primary: `{"a": [1]}`, candidate: `{"a": {"0": 1}}`, want: []string{"body $.a"}},
+		{name: "text", header: textHeader, primary: "v1", candidate: "v2", want: []string{"body "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := d.compareBodies(
+				diffSide{status: 200, header: tt.header, body: []byte(tt.primary)},
+				diffSide{status: 200, header: tt.header, body: []byte(tt.candidate)})
+			var got []string
+			for _, diff := range diffs {
+				got = append(got, diff.Kind+" "+diff.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("differences %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseDiff(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Version", "1")
+		io.WriteString(w, `{"path": "`+r.URL.Path+`", "total": 3}`)
+	}))
+	defer primary.Close()
+	var candidateHits atomic.Int64
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		candidateHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v2/same" {
+			w.Header().Set("X-Version", "1")
+			io.WriteString(w, `{"path": "/v1/same", "total": 3.0}`)
+			return
+		}
+		w.Header().Set("X-Version", "2")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"path": "`+r.URL.Path+`", "total": 4}`)
+	}))
+	defer candidate.Close()
+	file := filepath.Join(t.TempDir(), "diff.log")
+	h := newTestHandler(t, `{"logging": {"diff": [{"type": "file", "path": "`+file+`"}]},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+primary.URL+`/v1", "diff": {"upstream": "`+candidate.URL+`/v2"}}]}`)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		result string // counted comparison result; "" when not compared
+	}{
+		{name: "match", method: http.MethodGet, path: "/api/same", result: "match"},
+		{name: "mismatch", method: http.MethodGet, path: "/api/orders", result: "mismatch"},
+		{name: "not compared", method: http.MethodPost, path: "/api/orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := candidateHits.Load()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}")))
+			// The client always gets the primary's answer
+			if w.Code != http.StatusOK || w.Header().Get("X-Version") != "1" {
+				t.Fatalf("%d %v %s, want the primary response", w.Code, w.Header(), w.Body)
+			}
+			if tt.result == "" {
+				if candidateHits.Load() != hits {
+					t.Errorf("candidate asked for a %s", tt.method)
+				}
+				return
+			}
+			waitUntil(t, tt.result+" counted", func() bool { return h.diffs.results.value("api", tt.result) == 1 })
+		})
+	}
+
+	// The mismatch is counted before its record is written
+	waitUntil(t, "the diff record", func() bool {
+		data, _ := os.ReadFile(file)
+		return strings.HasSuffix(string(data), "\n")
+	})
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []diffRecord
+	for lines := bufio.NewScanner(f); lines.Scan(); {
+		var rec diffRecord
+		if err := json.Unmarshal(lines.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 1 {
+		t.Fatalf("%d diff records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Route != "api" || rec.Method != "GET" || rec.Path != "/v1/orders" {
+		t.Errorf("record %+v", rec)
+	}
+	var got []string
+	for _, diff := range rec.Differences {
+		got = append(got, diff.Kind+" "+diff.Path)
+	}
+	if want := []string{"status ", "header X-Version", "body $.path", "body $.total"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("differences %v, want %v", got, want)
+	}
+}
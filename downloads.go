@@ -0,0 +1,120 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// defaultDownloadMinSize is the smallest response counted as a download session
+const defaultDownloadMinSize = 1 << 20
+
+// errTooManyDownloads is returned when a client already has its maximum of downloads running
+var errTooManyDownloads = errors.New("too many concurrent downloads")
+
+// DownloadsConfig caps how many large or streaming responses each client receives at once,
+// so one client cannot monopolize the bandwidth of a large-file origin; reloadable on SIGHUP
+type DownloadsConfig struct {
+	MaxSessions int            `json:"max_sessions"` // concurrent download sessions per client, 0 for unlimited
+	MinSize     ByteSize       `json:"min_size"`     // responses at least this large, or of unknown length, are downloads; default 1MB
+	Clients     map[string]int `json:"clients"`      // per-client overrides keyed by client ID; 0 for unlimited
+}
+
+// limitFor returns the session limit that applies to client
+func (c *DownloadsConfig) limitFor(client string) int {
+	if n, ok := c.Clients[client]; ok {
+		return n
+	}
+	return c.MaxSessions
+}
+
+// downloadLimiter counts the download sessions in flight per client
+type downloadLimiter struct {
+	mu      sync.Mutex
+	cfg     DownloadsConfig
+	active  map[string]int
+	rejects *metricVec
+}
+
+// newDownloadLimiter creates a limiter for cfg, which may be nil
+func newDownloadLimiter(cfg *DownloadsConfig, metrics *metricsRegistry) *downloadLimiter {
+	l := &downloadLimiter{
+		active:  make(map[string]int),
+		rejects: metrics.counter("proxygo_download_rejections_total", "Downloads refused because the client had too many in flight."),
+	}
+	l.update(cfg)
+	metrics.gaugeFunc("proxygo_download_sessions", "Download sessions in flight across all clients.", nil, func() []sample {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		total := 0
+		for _, n := range l.active {
+			total += n
+		}
+		return []sample{{value: float64(total)}}
+	})
+	return l
+}
+
+// update applies new limits; sessions already running are never cut off
+func (l *downloadLimiter) update(cfg *DownloadsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg == nil {
+		cfg = &DownloadsConfig{}
+	}
+	l.cfg = *cfg
+	if l.cfg.MinSize <= 0 {
+		l.cfg.MinSize = defaultDownloadMinSize
+	}
+}
+
+// modifyResponse opens a session for download-sized responses, refusing clients that are
+// at their limit. The session ends when the body is closed, however the transfer ends.
+func (l *downloadLimiter) modifyResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent || !responseHasBody(resp) {
+		return nil
+	}
+	_, info := withRequestInfo(resp.Request)
+	client := info.ClientID
+
+	l.mu.Lock()
+	limit := l.cfg.limitFor(client)
+	if limit <= 0 || (resp.ContentLength >= 0 && resp.ContentLength < int64(l.cfg.MinSize)) {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.active[client] >= limit {
+		l.mu.Unlock()
+		l.rejects.inc()
+		return fmt.Errorf("%w: %d allowed", errTooManyDownloads, limit)
+	}
+	l.active[client]++
+	l.mu.Unlock()
+
+	resp.Body = &sessionBody{ReadCloser: resp.Body, release: func() { l.release(client) }}
+	return nil
+}
+
+// release ends one of client's sessions
+func (l *downloadLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[client]--; l.active[client] <= 0 {
+		delete(l.active, client)
+	}
+}
+
+// sessionBody ends its download session once, when closed
+type sessionBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Close implements io.Closer
+func (b *sessionBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
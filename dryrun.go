@@ -0,0 +1,147 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Where a request asks for a dry run, carrying the admin token
+const (
+	dryRunHeader = "X-Proxygo-Dry-Run"
+	dryRunParam  = "proxygo_dry_run"
+)
+
+// dryRunResult is the body of a dry run: the request as it would leave for the upstream
+type dryRunResult struct {
+	DryRun    bool        `json:"dry_run"`
+	RequestID string      `json:"request_id"`
+	Route     string      `json:"route,omitempty"` // empty for unix, alias and path-embedded targets
+	Upstream  string      `json:"upstream"`        // the target, with credentials redacted
+	Socket    string      `json:"socket,omitempty"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"` // final URL, with credentials redacted
+	Host      string      `json:"host"`
+	Headers   http.Header `json:"headers"`              // after every transformation; credentials show their scheme only, and headers holding secrets nothing
+	BodyBytes int64       `json:"body_bytes,omitempty"` // declared length of the body, which is not read; -1 when unknown
+	GRPC      bool        `json:"grpc,omitempty"`
+	Transport []string    `json:"transport,omitempty"` // route features applied while sending: aws_signing, hedging, diff, write_queue
+}
+
+// dryRunRequested reports whether r asks for a dry run and removes the request for it,
+// so neither the token nor the marker reaches the upstream. ok is false when r asks with
+// a wrong token; it is then answered with 401.
+func (h *ProxyHandler) dryRunRequested(w http.ResponseWriter, r *http.Request) (dryRun, ok bool) {
+	if h.dryRunToken == "" {
+		return false, true
+	}
+	token := r.Header.Get(dryRunHeader)
+	if token == "" && strings.Contains(r.URL.RawQuery, dryRunParam) {
+		token = r.URL.Query().Get(dryRunParam)
+	}
+	if token == "" {
+		return false, true
+	}
+	r.Header.Del(dryRunHeader)
+	r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, dryRunParam)
+	r.RequestURI = r.URL.RequestURI()
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.dryRunToken)) != 1 {
+		h.audit(r, auditEvent{Event: auditAdminAuthFailed, Status: http.StatusUnauthorized, Reason: "dry_run"})
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", "a dry run needs the admin token")
+		return false, false
+	}
+	return true, true
+}
+
+// removeQueryParam drops every occurrence of name from rawQuery, keeping the rest as is
+func removeQueryParam(rawQuery, name string) string {
+	var kept []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(part, "=")
+		if key, err := url.QueryUnescape(key); err == nil && key == name {
+			continue
+		}
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// serveDryRun answers r with the request serveProxy would send to target, built the same
+// way the reverse proxy builds it, without contacting the upstream
+func (h *ProxyHandler) serveDryRun(w http.ResponseWriter, r *http.Request, target *proxyTarget, grpc bool) {
+	st := &proxyState{
+		target:   target,
+		grpc:     grpc,
+		filter:   h.contentFilterFor(target),
+		rewrite:  h.bodyRewriterFor(target),
+		security: h.securityHeadersFor(target),
+	}
+	out := r.Clone(context.WithValue(r.Context(), proxyStateKey{}, st))
+	h.direct(out)
+
+	// What httputil.ReverseProxy does around the Director
+	stripHopByHopHeaders(out.Header)
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	if _, ok := out.Header["User-Agent"]; !ok {
+		out.Header.Set("User-Agent", "")
+	}
+
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		if v := out.Header.Get(name); v != "" {
+			scheme, _, _ := strings.Cut(v, " ")
+			out.Header.Set(name, scheme+" [redacted]")
+		}
+	}
+	if target.Route != nil {
+		for _, uh := range target.Route.UpstreamHeaders {
+			if secretRefs(uh.value) != nil && uh.name != "Authorization" && uh.name != "Proxy-Authorization" {
+				out.Header.Set(uh.name, "[redacted]")
+			}
+		}
+	}
+
+	_, info := withRequestInfo(r)
+	result := dryRunResult{
+		DryRun:    true,
+		RequestID: info.RequestID,
+		Route:     routeName(target),
+		Upstream:  target.URL.Redacted(),
+		Socket:    target.Socket,
+		Method:    out.Method,
+		URL:       out.URL.Redacted(),
+		Host:      out.Host,
+		Headers:   out.Header,
+		BodyBytes: r.ContentLength,
+		GRPC:      grpc,
+	}
+	if route := target.Route; route != nil {
+		if route.Signer != nil {
+			result.Transport = append(result.Transport, "aws_signing")
+		}
+		if route.Hedging != nil && !grpc {
+			result.Transport = append(result.Transport, "hedging")
+		}
+		if route.Differ != nil && !grpc {
+			result.Transport = append(result.Transport, "diff")
+		}
+		if route.Queue != nil && !grpc {
+			result.Transport = append(result.Transport, "write_queue")
+		}
+	}
+
+	h.logger.Printf("Dry run for %s %s: would send to %s", r.Method, r.URL.Path, result.URL)
+	h.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: "dry_run", Details: map[string]string{"upstream": result.URL}})
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, result)
+}
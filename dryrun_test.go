@@ -0,0 +1,131 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRemoveQueryParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "proxygo_dry_run=secret", want: ""},
+		{query: "a=1&proxygo_dry_run=secret&b=2", want: "a=1&b=2"},
+		{query: "proxygo_dry_run=x&proxygo_dry_run=y&a=1", want: "a=1"},
+		{query: "proxygo%5Fdry%5Frun=secret&a=%2F", want: "a=%2F"},
+		{query: "a=proxygo_dry_run&proxygo_dry_runs=1", want: "a=proxygo_dry_run&proxygo_dry_runs=1"},
+		{query: "a=1&&b=2&", want: "a=1&b=2"},
+	}
+	for _, tt := range tests {
+		if got := removeQueryParam(tt.query, dryRunParam); got != tt.want {
+			t.Errorf("removeQueryParam(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var hits atomic.Int32
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		seen = r.Header.Clone()
+	}))
+	defer upstream.Close()
+	file := filepath.Join(t.TempDir(), "audit.log")
+	h := newTestHandler(t, `{"audit": {"file": "`+file+`"},
+		"admin": {"address": "127.0.0.1:0", "token": "secret", "dry_run": true},
+		"slos": [{"name": "api", "objective": 0.99}],
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`",
+			"upstream_headers": {"Authorization": "Bearer upstream-secret"}, "hedging": {"delay": "50ms"}}]}`)
+
+	tests := []struct {
+		name   string
+		target string
+		token  string // in the header
+		status int
+		url    string // of a dry run
+		audit  string // event recorded, if any
+	}{
+		{name: "header", target: "/api/orders?x=1", token: "secret", status: http.StatusOK, url: upstream.URL + "/orders?x=1", audit: auditAdminAction},
+		{name: "query", target: "/api/orders?proxygo_dry_run=secret&x=1", status: http.StatusOK, url: upstream.URL + "/orders?x=1", audit: auditAdminAction},
+		{name: "wrong token", target: "/api/orders", token: "guess", status: http.StatusUnauthorized, audit: auditAdminAuthFailed},
+		{name: "wrong token in the query", target: "/api/orders?proxygo_dry_run=guess", status: http.StatusUnauthorized, audit: auditAdminAuthFailed},
+		{name: "proxied", target: "/api/orders", status: http.StatusOK},
+	}
+	audited := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits.Store(0)
+			seen = nil
+			slo := h.slos.requests.value("api", "good")
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.token != "" {
+				r.Header.Set(dryRunHeader, tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			proxied := tt.url == "" && tt.status == http.StatusOK
+			if got := hits.Load(); (got != 0) != proxied {
+				t.Fatalf("upstream asked %d times", got)
+			}
+			if proxied && (seen.Get(dryRunHeader) != "" || seen.Get("Authorization") != "Bearer upstream-secret") {
+				t.Errorf("upstream saw headers %v", seen)
+			}
+			if counted := h.slos.requests.value("api", "good") - slo; (counted == 1) != proxied {
+				t.Errorf("SLO counted %v requests", counted)
+			}
+
+			events := readAuditLog(t, file)
+			if tt.audit == "" {
+				if len(events) != audited {
+					t.Errorf("recorded %+v", events[audited:])
+				}
+			} else if len(events) != audited+1 || events[audited].Event != tt.audit || events[audited].Reason != "dry_run" {
+				t.Errorf("recorded %+v, want one %s", events[audited:], tt.audit)
+			}
+			audited = len(events)
+
+			if tt.url == "" {
+				return
+			}
+			if w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control %q", w.Header().Get("Cache-Control"))
+			}
+			var got dryRunResult
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.DryRun || got.Route != "api" || got.Method != http.MethodGet || got.URL != tt.url || got.Upstream != upstream.URL || got.RequestID == "" {
+				t.Errorf("dry run %+v", got)
+			}
+			if got.Headers.Get("Authorization") != "Bearer [redacted]" || got.Headers.Get(dryRunHeader) != "" || got.Headers.Get("X-Forwarded-For") == "" {
+				t.Errorf("headers %v", got.Headers)
+			}
+			if !slices.Equal(got.Transport, []string{"hedging"}) {
+				t.Errorf("transport %v, want hedging", got.Transport)
+			}
+		})
+	}
+}
+
+func TestDryRunConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"admin": {"address": "127.0.0.1:0", "dry_run": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "admin: dry_run needs a token") {
+		t.Errorf("LoadConfig: %v, want the missing token", err)
+	}
+}
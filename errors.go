@@ -0,0 +1,166 @@
+package proxygo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// defaultErrorPage is the HTML page used when no template matches the status
+var defaultErrorPage = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// jsonError is the body of JSON error responses
+type jsonError struct {
+	Error     string `json:"error"`                // machine-readable error code
+	Message   string `json:"message"`              // human-readable explanation
+	RequestID string `json:"request_id,omitempty"` // correlates the error with logs
+}
+
+// writeJSONError sends a JSON error body with the given status
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSONErrorBody(w, status, jsonError{Error: code, Message: message})
+}
+
+// writeJSONErrorBody sends body as a JSON error with the given status
+func writeJSONErrorBody(w http.ResponseWriter, status int, body jsonError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// ErrorPagesConfig selects how errors generated by the proxy itself are rendered
+type ErrorPagesConfig struct {
+	Format string            `json:"format"` // "json" (default) or "html"
+	Pages  map[string]string `json:"pages"`  // html/template files by status code, or "default" for the rest
+}
+
+// errorPageData is what error page templates are executed with
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// errorRenderer writes proxy-generated errors as JSON or templated HTML
+type errorRenderer struct {
+	html     bool
+	pages    map[int]*template.Template
+	fallback *template.Template
+}
+
+// newErrorRenderer compiles cfg; a nil cfg renders JSON
+func newErrorRenderer(cfg *ErrorPagesConfig) (*errorRenderer, error) {
+	e := &errorRenderer{pages: make(map[int]*template.Template), fallback: defaultErrorPage}
+	if cfg == nil {
+		return e, nil
+	}
+
+	switch cfg.Format {
+	case "", "json":
+		if len(cfg.Pages) > 0 {
+			return nil, fmt.Errorf("error_pages: pages require format \"html\"")
+		}
+		return e, nil
+	case "html":
+		e.html = true
+	default:
+		return nil, fmt.Errorf("error_pages: unknown format %q: expected json or html", cfg.Format)
+	}
+
+	for key, file := range cfg.Pages {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error_pages: %w", err)
+		}
+		tmpl, err := template.New(file).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("error_pages: %w", err)
+		}
+
+		if key == "default" {
+			e.fallback = tmpl
+			continue
+		}
+		status, err := strconv.Atoi(key)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("error_pages: %q is not an error status code or \"default\"", key)
+		}
+		e.pages[status] = tmpl
+	}
+	return e, nil
+}
+
+// render writes the error for r in the configured format
+func (e *errorRenderer) render(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	_, info := withRequestInfo(r)
+	if !e.html {
+		writeJSONErrorBody(w, status, jsonError{Error: code, Message: message, RequestID: info.RequestID})
+		return
+	}
+
+	tmpl, ok := e.pages[status]
+	if !ok {
+		tmpl = e.fallback
+	}
+	var buf bytes.Buffer
+	data := errorPageData{Status: status, StatusText: http.StatusText(status), Code: code, Message: message, RequestID: info.RequestID}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		// A broken custom page must not hide the original error
+		buf.Reset()
+		defaultErrorPage.Execute(&buf, data)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// WriteError answers r with an error response of the proxy's own, rendered and counted
+// like the errors the proxy produces itself. Extensions use it to refuse requests.
+func (h *ProxyHandler) WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	h.writeError(w, r, nil, status, code, message)
+}
+
+// writeError renders a proxy-generated error with the renderer of target's route, else the global one.
+// target may be nil when the request could not be resolved.
+func (h *ProxyHandler) writeError(w http.ResponseWriter, r *http.Request, target *proxyTarget, status int, code, message string) {
+	h.writeProxyError(w, r, target, &ProxyError{Kind: errorKind(status, code), Status: status, Code: code, Message: message})
+}
+
+// writeProxyError renders perr like writeError, after counting it and telling the error extensions
+func (h *ProxyHandler) writeProxyError(w http.ResponseWriter, r *http.Request, target *proxyTarget, perr *ProxyError) {
+	h.reportError(r, target, perr)
+	renderer := h.errorPages
+	if target != nil && target.Route != nil && target.Route.Errors != nil {
+		renderer = target.Route.Errors
+	}
+	renderer.render(w, r, perr.Status, perr.Code, perr.Message)
+}
+
+// reportError counts an error response by kind and passes it to the error extensions,
+// for errors answered without writeProxyError too
+func (h *ProxyHandler) reportError(r *http.Request, target *proxyTarget, perr *ProxyError) {
+	_, info := withRequestInfo(r)
+	info.proxyError = true
+	h.proxyErrors.inc(routeName(target), errorKindLabels[perr.Kind])
+	for _, ext := range h.errorExtensions {
+		ext.ProxyError(r, perr)
+	}
+}
@@ -0,0 +1,149 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestPage writes an error page template and returns its path
+func writeTestPage(t *testing.T, page string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "page.html")
+	if err := os.WriteFile(path, []byte(page), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestErrorRenderer(t *testing.T) {
+	notFound := writeTestPage(t, `<p>missing: {{.Message}} ({{.Code}}, {{.RequestID}})</p>`)
+	fallback := writeTestPage(t, `<p>{{.Status}} {{.StatusText}}</p>`)
+	broken := writeTestPage(t, `<p>{{.Nope}}</p>`)
+
+	tests := []struct {
+		name        string
+		cfg         *ErrorPagesConfig
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			name: "json by default", status: http.StatusBadGateway, contentType: "application/json",
+			body: `{"error":"upstream_error","message":"\u003cboom\u003e","request_id":"req-1"}` + "\n",
+		},
+		{
+			name: "builtin html page", cfg: &ErrorPagesConfig{Format: "html"}, status: http.StatusBadGateway, contentType: "text/html; charset=utf-8",
+			body: "<h1>502 Bad Gateway</h1>\n<p>&lt;boom&gt;</p>",
+		},
+		{
+			name: "page for status", cfg: &ErrorPagesConfig{Format: "html", Pages: map[string]string{"404": notFound}}, status: http.StatusNotFound,
+			contentType: "text/html; charset=utf-8", body: "<p>missing: &lt;boom&gt; (upstream_error, req-1)</p>",
+		},
+		{
+			name: "default page", cfg: &ErrorPagesConfig{Format: "html", Pages: map[string]string{"404": notFound, "default": fallback}}, status: http.StatusBadGateway,
+			contentType: "text/html; charset=utf-8", body: "<p>502 Bad Gateway</p>",
+		},
+		{
+			name: "broken page", cfg: &ErrorPagesConfig{Format: "html", Pages: map[string]string{"default": broken}}, status: http.StatusBadGateway,
+			contentType: "text/html; charset=utf-8", body: "<h1>502 Bad Gateway</h1>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newErrorRenderer(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Request-Id", "req-1")
+			w := httptest.NewRecorder()
+			e.render(w, r, tt.status, "upstream_error", "<boom>")
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("content type %q, want %q", ct, tt.contentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body %q, want %q", w.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestErrorPagesConfig(t *testing.T) {
+	page := writeTestPage(t, `<p>{{.Message}}</p>`)
+	tests := []struct {
+		name string
+		cfg  ErrorPagesConfig
+		err  string
+	}{
+		{name: "json", cfg: ErrorPagesConfig{Format: "json"}},
+		{name: "html pages", cfg: ErrorPagesConfig{Format: "html", Pages: map[string]string{"503": page, "default": page}}},
+		{name: "unknown format", cfg: ErrorPagesConfig{Format: "xml"}, err: `unknown format "xml"`},
+		{name: "pages without html", cfg: ErrorPagesConfig{Pages: map[string]string{"503": page}}, err: `pages require format "html"`},
+		{name: "success status", cfg: ErrorPagesConfig{Format: "html", Pages: map[string]string{"200": page}}, err: "not an error status code"},
+		{name: "not a status", cfg: ErrorPagesConfig{Format: "html", Pages: map[string]string{"oops": page}}, err: "not an error status code"},
+		{name: "missing file", cfg: ErrorPagesConfig{Format: "html", Pages: map[string]string{"503": page + ".missing"}}, err: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newErrorRenderer(&tt.cfg)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("newErrorRenderer: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("newErrorRenderer: %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRouteErrorPages(t *testing.T) {
+	// A port nothing listens on any more
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+	h := newTestHandler(t, `{"routes": [
+		{"name": "api", "prefix": "/api/", "upstream": "`+down+`"},
+		{"name": "site", "prefix": "/site/", "upstream": "`+down+`", "error_pages": {"format": "html"}}]}`)
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		code        string // JSON error code
+	}{
+		{path: "/api/x", status: http.StatusBadGateway, contentType: "application/json", code: "upstream_unreachable"},
+		{path: "/site/x", status: http.StatusBadGateway, contentType: "text/html; charset=utf-8"},
+		{path: "/nowhere", status: http.StatusBadRequest, contentType: "application/json", code: "invalid_target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status || w.Header().Get("Content-Type") != tt.contentType {
+				t.Fatalf("%d %s, want %d %s: %s", w.Code, w.Header().Get("Content-Type"), tt.status, tt.contentType, w.Body)
+			}
+			if tt.code == "" {
+				return
+			}
+			var body jsonError
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != tt.code || body.RequestID != w.Header().Get("X-Request-Id") {
+				t.Errorf("error %+v, want %q with request ID %q", body, tt.code, w.Header().Get("X-Request-Id"))
+			}
+		})
+	}
+}
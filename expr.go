@@ -0,0 +1,240 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/file"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Expression limits that hold whatever the script config says
+const (
+	maxExprLength    = 4 << 10  // source characters per expression
+	maxExprString    = 64 << 10 // bytes in any string an expression builds or looks up
+	exprMemoryBudget = 10000    // list elements and range items one evaluation may create
+)
+
+// errExprDeadline is returned by evaluations still running at the script's deadline
+var errExprDeadline = errors.New("time limit exceeded")
+
+// exprBuiltins are the expr-lang builtins scripts may call. None of them loops over a
+// list or builds a string much longer than its arguments.
+var exprBuiltins = []string{"len", "lower", "upper", "trim", "trimPrefix", "trimSuffix", "split",
+	"indexOf", "lastIndexOf", "hasPrefix", "hasSuffix", "string", "int", "float", "abs"}
+
+// exprFunctions are the pure functions the proxy adds to the builtins
+var exprFunctions = []expr.Option{
+	expr.Function("in_cidr", func(args ...any) (any, error) {
+		_, network, err := net.ParseCIDR(args[1].(string))
+		if err != nil {
+			return nil, fmt.Errorf("in_cidr: %w", err)
+		}
+		ip := net.ParseIP(args[0].(string))
+		return ip != nil && network.Contains(ip), nil
+	}, new(func(ip, cidr string) bool)),
+	expr.Function("hash", func(args ...any) (any, error) {
+		h := fnv.New32a()
+		h.Write([]byte(args[0].(string)))
+		return int(h.Sum32()), nil
+	}, new(func(s string) int)),
+}
+
+// exprEnv is what an expression sees: the request attributes, the lookups and the
+// functions that build strings, which hold them to maxExprString and stop at the deadline.
+// An expression that breaks a limit panics, which vm.Run turns into its error.
+type exprEnv struct {
+	Method   string `expr:"method"`
+	Host     string `expr:"host"`
+	Path     string `expr:"path"`
+	Query    string `expr:"query"`
+	Scheme   string `expr:"scheme"`
+	Client   string `expr:"client"`
+	ClientIP string `expr:"client_ip"`
+	Country  string `expr:"country"`
+	Tenant   string `expr:"tenant"`
+	Route    string `expr:"route"`
+	Upstream string `expr:"upstream"`
+
+	Header func(name string) string `expr:"header"`
+	Param  func(name string) string `expr:"param"`
+	Cookie func(name string) string `expr:"cookie"`
+	Claim  func(name string) string `expr:"claim"`
+
+	Concat  func(a, b string) string          `expr:"concat"` // + on two strings
+	Replace func(s, old, repl string) string  `expr:"replace"`
+	Join    func(list any, sep string) string `expr:"join"`
+
+	deadline time.Time
+}
+
+// newExprEnv returns an environment whose lookups go through get; the attributes are left
+// for the caller to fill
+func newExprEnv(get map[string]func(name string) string) *exprEnv {
+	env := &exprEnv{}
+	lookup := func(kind string) func(name string) string {
+		fn := get[kind]
+		return func(name string) string {
+			value := fn(name)
+			if len(value) > maxExprString {
+				panic(fmt.Errorf("%s %s: value longer than %d bytes", kind, name, maxExprString))
+			}
+			return value
+		}
+	}
+	env.Header, env.Param, env.Cookie, env.Claim = lookup("header"), lookup("param"), lookup("cookie"), lookup("claim")
+
+	env.Concat = func(a, b string) string {
+		env.build(len(a) + len(b))
+		return a + b
+	}
+	env.Replace = func(s, old, repl string) string {
+		if n := strings.Count(s, old); n > 0 && len(repl) > len(old) {
+			env.build(len(s) + n*(len(repl)-len(old)))
+		}
+		return strings.ReplaceAll(s, old, repl)
+	}
+	env.Join = func(list any, sep string) string {
+		var parts []string
+		switch list := list.(type) {
+		case []string:
+			parts = list
+		case []any:
+			for _, v := range list {
+				parts = append(parts, exprString(v))
+			}
+		default:
+			panic(fmt.Errorf("join: expected a list, got %T", list))
+		}
+		size := len(sep) * max(len(parts)-1, 0)
+		for _, part := range parts {
+			size += len(part)
+		}
+		env.build(size)
+		return strings.Join(parts, sep)
+	}
+	return env
+}
+
+// build checks that a string of size bytes may be built now
+func (env *exprEnv) build(size int) {
+	if size > maxExprString {
+		panic(fmt.Errorf("string longer than %d bytes", maxExprString))
+	}
+	if time.Now().After(env.deadline) {
+		panic(errExprDeadline)
+	}
+}
+
+// compileExpr compiles source against exprEnv with at most maxNodes syntax tree nodes;
+// asBool requires a boolean result
+func compileExpr(source string, maxNodes int, asBool bool) (*vm.Program, error) {
+	if len(source) > maxExprLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxExprLength)
+	}
+	options := append([]expr.Option{
+		expr.Env(exprEnv{}),
+		expr.MaxNodes(uint(maxNodes)),
+		expr.DisableAllBuiltins(),
+		expr.Operator("+", "concat"),
+	}, exprFunctions...)
+	for _, name := range exprBuiltins {
+		options = append(options, expr.EnableBuiltin(name))
+	}
+	if asBool {
+		options = append(options, expr.AsBool())
+	}
+	program, err := expr.Compile(source, options...)
+	if err != nil {
+		return nil, exprError(err)
+	}
+
+	// Without variables or loops every node runs at most once, so the node budget and
+	// the checks on built strings bound the work of an evaluation
+	v := &exprValidator{}
+	node := program.Node()
+	ast.Walk(&node, v)
+	if v.err != nil {
+		return nil, v.err
+	}
+	return program, nil
+}
+
+// exprValidator finds the constructs compileExpr does not allow
+type exprValidator struct {
+	err error
+}
+
+// Visit implements ast.Visitor
+func (v *exprValidator) Visit(node *ast.Node) {
+	if v.err != nil {
+		return
+	}
+	switch n := (*node).(type) {
+	case *ast.VariableDeclaratorNode:
+		v.err = fmt.Errorf("column %d: let is not allowed", n.Location().From+1)
+	case *ast.PredicateNode:
+		// The parser accepts map, filter and the other list loops even with the builtins off
+		v.err = fmt.Errorf("column %d: loops over lists are not allowed", n.Location().From+1)
+	case *ast.BinaryNode:
+		// Strings go through concat; + left over means the checker could not tell the types
+		if n.Operator == "+" && (!exprNumber(n.Left.Type()) || !exprNumber(n.Right.Type())) {
+			v.err = fmt.Errorf("column %d: + needs two strings or two numbers; use string() on values of unknown type", n.Location().From+1)
+		}
+	}
+}
+
+// exprNumber reports whether t is a numeric type
+func exprNumber(t reflect.Type) bool {
+	if t == nil {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// evalExpr runs program in env
+func evalExpr(program *vm.Program, env *exprEnv) (any, error) {
+	machine := vm.VM{MemoryBudget: exprMemoryBudget}
+	out, err := machine.Run(program, env)
+	if err != nil {
+		return nil, exprError(err)
+	}
+	return out, nil
+}
+
+// exprError turns an expr-lang error into one line that names the column, keeping any
+// error an env function panicked with
+func exprError(err error) error {
+	var ferr *file.Error
+	if !errors.As(err, &ferr) {
+		return err
+	}
+	if ferr.Prev != nil {
+		return fmt.Errorf("column %d: %w", ferr.From+1, ferr.Prev)
+	}
+	return fmt.Errorf("column %d: %s", ferr.From+1, ferr.Message)
+}
+
+// exprString renders a result as a header value or URL; nil becomes ""
+func exprString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
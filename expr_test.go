@@ -0,0 +1,122 @@
+package proxygo
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// evalTestExpr compiles and runs source with path set and header(name) returning "h:" and
+// the name, or 6400 bytes for header("long") and more than maxExprString for header("huge")
+func evalTestExpr(source string, deadline time.Time) (any, error) {
+	x, err := compileExpr(source, defaultScriptMaxNodes, false)
+	if err != nil {
+		return nil, err
+	}
+	env := newExprEnv(map[string]func(name string) string{
+		"header": func(name string) string {
+			switch name {
+			case "long":
+				return strings.Repeat("x", 6400)
+			case "huge":
+				return strings.Repeat("x", maxExprString+1)
+			}
+			return "h:" + name
+		},
+	})
+	env.Path, env.ClientIP = "/api/items", "10.1.2.3"
+	env.deadline = deadline
+	return evalExpr(x, env)
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		source string
+		want   any
+	}{
+		{"1 + 2 * 3", 7},
+		{"'a' + 'b' == 'ab'", true},
+		{"'a' + 'b' in ['ab', 'c']", true},
+		{"path + '?' + header('x-a')", "/api/items?h:x-a"},
+		{"len(path) > 3 ? 'long' : 'short'", "long"},
+		{"upper(path)[1:4]", "API"},
+		{"split(path, '/')[2]", "items"},
+		{"join(split(path, '/'), '-')", "-api-items"},
+		{"replace(path, '/', '//')", "//api//items"},
+		{"path matches '^/api/'", true},
+		{"path startsWith '/api' && path endsWith 'items'", true},
+		{"in_cidr(client_ip, '10.0.0.0/8')", true},
+		{"in_cidr('bad', '10.0.0.0/8')", false},
+		{"hash('a') == hash('a') && hash('a') != hash('b')", true},
+		{"string(1) + 'x'", "1x"},
+		{"nil", nil},
+	}
+	for _, tt := range tests {
+		got, err := evalTestExpr(tt.source, time.Now().Add(time.Second))
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, %v; want %#v", tt.source, got, err, tt.want)
+		}
+	}
+}
+
+func TestExprCompileErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"1 +", "column 3: unexpected token EOF"},
+		{"nope", "column 1: unknown name nope"},
+		{"header(1)", "column 8: cannot use int as argument"},
+		{"1 + 'a'", "column 3: invalid operation"},
+		// Builtins that loop or build long strings are not available
+		{"repeat('x', 100)", "unknown name repeat"},
+		{"map([1, 2], # * 2)", "loops over lists are not allowed"},
+		{"let a = path; a + a", "let is not allowed"},
+		// + on values of unknown type would get past the size check of concat
+		{"['a', 1][0] + path", "+ needs two strings or two numbers"},
+		{strings.Repeat("path + ", 300) + "path", "exceeds maximum allowed nodes"},
+		{strings.Repeat("1+", maxExprLength), "expression longer than"},
+	}
+	for _, tt := range tests {
+		got, err := evalTestExpr(tt.source, time.Now().Add(time.Second))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%.40s = %#v, %v; want an error containing %q", tt.source, got, err, tt.want)
+		}
+	}
+
+	// A when rule must be boolean
+	if _, err := compileExpr("path", defaultScriptMaxNodes, true); err == nil {
+		t.Error("non-boolean condition compiled")
+	}
+}
+
+func TestExprLimits(t *testing.T) {
+	// Strings cannot grow past maxExprString, however they are built
+	tooLong := []string{
+		"header('long') + header('long') + header('long') + header('long') + header('long') + " +
+			"header('long') + header('long') + header('long') + header('long') + header('long') + header('long')",
+		"replace(header('long'), 'x', 'xxxxxxxxxxx')",
+		"join([header('long'), header('long'), header('long'), header('long'), header('long'), header('long'), " +
+			"header('long'), header('long'), header('long'), header('long'), header('long')], '')",
+	}
+	for _, source := range tooLong {
+		if _, err := evalTestExpr(source, time.Now().Add(time.Second)); err == nil || !strings.Contains(err.Error(), "string longer than") {
+			t.Errorf("%.60s: err = %v, want a string longer than error", source, err)
+		}
+	}
+	if _, err := evalTestExpr("header('huge') == ''", time.Now().Add(time.Second)); err == nil || !strings.Contains(err.Error(), "header huge: value longer than") {
+		t.Errorf("oversized header: err = %v", err)
+	}
+
+	// Ranges count against the memory budget
+	if _, err := evalTestExpr("len(1..100000)", time.Now().Add(time.Second)); err == nil || !strings.Contains(err.Error(), "memory budget exceeded") {
+		t.Errorf("large range: err = %v", err)
+	}
+
+	// Building a string past the deadline stops the evaluation
+	if _, err := evalTestExpr("path + path", time.Now().Add(-time.Second)); !errors.Is(err, errExprDeadline) {
+		t.Errorf("past the deadline: err = %v, want %v", err, errExprDeadline)
+	}
+}
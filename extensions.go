@@ -0,0 +1,165 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Extension is custom logic compiled into a proxygo build. A third party builds its own
+// main package that registers the extension from init and runs the proxy:
+//
+//	func init() { proxygo.RegisterExtension(acmeExtension{}) }
+//
+//	func main() { proxygo.Main() }
+//
+// and implements any of ExtensionStarter, RequestExtension, ResponseExtension and
+// ErrorExtension for the hooks it needs; cmd/proxygo/ext_example.go shows one. An
+// extension that is also an io.Closer is closed when the handler is. The core handler
+// needs no changes, and builds without the extension behave as before.
+type Extension interface {
+	Name() string // unique; the key of its settings under "extensions" in the config
+}
+
+// ExtensionStarter is started once the handler is built, with the extension's settings
+// from the config, nil when it has none. An error stops proxygo from starting. h takes no
+// requests yet but may be given response hooks.
+type ExtensionStarter interface {
+	Start(h *ProxyHandler, config json.RawMessage) error
+}
+
+// RequestExtension sees every request once it has passed access checks and its upstream
+// is settled, right before it is proxied. It may change the request's headers, or answer
+// it itself and return true to stop it there.
+type RequestExtension interface {
+	HandleRequest(w http.ResponseWriter, r *http.Request, req ExtensionRequest) bool
+}
+
+// ResponseExtension post-processes upstream responses like a ResponseHook, in registration
+// order after the hooks added with order 0 or less. Return a *HookError to choose the
+// client-facing error.
+type ResponseExtension interface {
+	ModifyResponse(resp *http.Response) error
+}
+
+// ErrorExtension is told about every error response the proxy produces itself, from
+// rejected credentials to failed upstreams and clients that went away. err is a
+// *ProxyError; branch on its kind with errors.Is, e.g. errors.Is(err, ErrUpstreamTimeout).
+// It cannot change the error sent to the client.
+type ErrorExtension interface {
+	ProxyError(r *http.Request, err error)
+}
+
+// ExtensionRequest describes a request to extensions
+type ExtensionRequest struct {
+	RequestID string
+	ClientID  string // authenticated client name, falling back to the client IP
+	ClientIP  string
+	Country   string   // when GeoIP is enabled
+	Tenant    string   // when tenants are configured
+	Route     string   // "" for unix, alias and path-embedded targets
+	Upstream  *url.URL // a copy; changing it does not redirect the request
+	Path      string   // path on the upstream
+}
+
+// extensionRegistry holds the extensions registered from init functions
+var extensionRegistry struct {
+	mu         sync.Mutex
+	extensions []Extension
+}
+
+// RegisterExtension adds ext to every handler built afterwards, in registration order.
+// It panics when the name is empty or taken, as both are mistakes in the build.
+func RegisterExtension(ext Extension) {
+	extensionRegistry.mu.Lock()
+	defer extensionRegistry.mu.Unlock()
+	name := ext.Name()
+	if name == "" {
+		panic("proxygo: extension with an empty name")
+	}
+	if slices.ContainsFunc(extensionRegistry.extensions, func(e Extension) bool { return e.Name() == name }) {
+		panic(fmt.Sprintf("proxygo: extension %q registered twice", name))
+	}
+	extensionRegistry.extensions = append(extensionRegistry.extensions, ext)
+}
+
+// registeredExtensions returns the extensions in registration order
+func registeredExtensions() []Extension {
+	extensionRegistry.mu.Lock()
+	defer extensionRegistry.mu.Unlock()
+	return slices.Clone(extensionRegistry.extensions)
+}
+
+// extensionOrder places extension response hooks after embedder hooks of order 0 or less
+const extensionOrder = 1
+
+// startExtensions starts the registered extensions and wires their hooks. Settings for
+// an extension missing from the build are an error, so a typo is not silently ignored.
+func (h *ProxyHandler) startExtensions(settings map[string]json.RawMessage) error {
+	all := registeredExtensions()
+	var names []string
+	for name := range settings {
+		if !slices.ContainsFunc(all, func(e Extension) bool { return e.Name() == name }) {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("extensions: %q not compiled into this build", names)
+	}
+
+	for _, ext := range all {
+		if s, ok := ext.(ExtensionStarter); ok {
+			if err := s.Start(h, settings[ext.Name()]); err != nil {
+				for _, c := range h.extensionClosers {
+					c.Close()
+				}
+				return fmt.Errorf("extension %s: %w", ext.Name(), err)
+			}
+		}
+		if re, ok := ext.(RequestExtension); ok {
+			h.requestExtensions = append(h.requestExtensions, re)
+		}
+		if re, ok := ext.(ResponseExtension); ok {
+			h.AddResponseHook("extension:"+ext.Name(), extensionOrder, re.ModifyResponse)
+		}
+		if ee, ok := ext.(ErrorExtension); ok {
+			h.errorExtensions = append(h.errorExtensions, ee)
+		}
+		if c, ok := ext.(io.Closer); ok {
+			h.extensionClosers = append(h.extensionClosers, c)
+		}
+		h.logger.Printf("Extension %s loaded", ext.Name())
+	}
+	return nil
+}
+
+// runRequestExtensions offers the request to each request extension and reports whether
+// one answered it
+func (h *ProxyHandler) runRequestExtensions(w http.ResponseWriter, r *http.Request, target *proxyTarget, info *requestInfo) bool {
+	if len(h.requestExtensions) == 0 {
+		return false
+	}
+	upstream := *target.URL
+	req := ExtensionRequest{
+		RequestID: info.RequestID,
+		ClientID:  info.ClientID,
+		ClientIP:  info.ClientIP,
+		Country:   info.Country,
+		Tenant:    info.Tenant,
+		Route:     routeName(target),
+		Upstream:  &upstream,
+		Path:      target.Path,
+	}
+	for _, ext := range h.requestExtensions {
+		if ext.HandleRequest(w, r, req) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withExtensions replaces the registered extensions for the rest of the test
+func withExtensions(t *testing.T, exts ...Extension) {
+	t.Helper()
+	extensionRegistry.mu.Lock()
+	saved := extensionRegistry.extensions
+	extensionRegistry.extensions = nil
+	extensionRegistry.mu.Unlock()
+	t.Cleanup(func() {
+		extensionRegistry.mu.Lock()
+		extensionRegistry.extensions = saved
+		extensionRegistry.mu.Unlock()
+	})
+	for _, ext := range exts {
+		RegisterExtension(ext)
+	}
+}
+
+// stampExtension uses every hook: it stamps requests and responses, refuses /api/private
+// and keeps what it was told
+type stampExtension struct {
+	mu       sync.Mutex
+	header   string // from its settings
+	requests []ExtensionRequest
+	errors   []error
+	closed   bool
+	startErr error
+}
+
+func (e *stampExtension) Name() string { return "stamp" }
+
+func (e *stampExtension) Start(h *ProxyHandler, config json.RawMessage) error {
+	if e.startErr != nil {
+		return e.startErr
+	}
+	var settings struct {
+		Header string `json:"header"`
+	}
+	if err := json.Unmarshal(config, &settings); err != nil {
+		return err
+	}
+	e.header = settings.Header
+	return nil
+}
+
+func (e *stampExtension) HandleRequest(w http.ResponseWriter, r *http.Request, req ExtensionRequest) bool {
+	e.mu.Lock()
+	e.requests = append(e.requests, req)
+	e.mu.Unlock()
+	if strings.HasPrefix(req.Path, "/private") {
+		http.Error(w, "refused by stamp", http.StatusForbidden)
+		return true
+	}
+	r.Header.Set(e.header, "request")
+	return false
+}
+
+func (e *stampExtension) ModifyResponse(resp *http.Response) error {
+	if resp.Header.Get("X-Reject") != "" {
+		return &HookError{Status: http.StatusUnavailableForLegalReasons, Code: "stamped_out", Message: "rejected by stamp"}
+	}
+	resp.Header.Set(e.header, "response")
+	return nil
+}
+
+func (e *stampExtension) ProxyError(r *http.Request, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errors = append(e.errors, err)
+}
+
+func (e *stampExtension) Close() error {
+	e.closed = true
+	return nil
+}
+
+// nameExtension has a name and no hooks
+type nameExtension string
+
+func (e nameExtension) Name() string { return string(e) }
+
+func TestRegisterExtension(t *testing.T) {
+	withExtensions(t, nameExtension("a"))
+	tests := []struct {
+		name string
+		ext  Extension
+		want string
+	}{
+		{name: "empty", ext: nameExtension(""), want: "proxygo: extension with an empty name"},
+		{name: "duplicate", ext: nameExtension("a"), want: `proxygo: extension "a" registered twice`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if got := recover(); got != tt.want {
+					t.Errorf("panic %v, want %q", got, tt.want)
+				}
+			}()
+			RegisterExtension(tt.ext)
+		})
+	}
+	withExtensions(t, nameExtension("b"), nameExtension("a"))
+	got := registeredExtensions()
+	if len(got) != 2 || got[0].Name() != "b" || got[1].Name() != "a" {
+		t.Errorf("registered %v, want b then a", got)
+	}
+}
+
+func TestExtensionStartup(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		startErr error
+		err      string
+	}{
+		{name: "settings", config: `{"extensions": {"stamp": {"header": "X-Stamp"}}}`},
+		{name: "not compiled in", config: `{"extensions": {"stamp": {"header": "X-Stamp"}, "stmap": {}, "acme": {}}}`, err: `extensions: ["acme" "stmap"] not compiled into this build`},
+		{name: "start fails", config: `{"extensions": {"stamp": {}}}`, startErr: errors.New("no license"), err: "extension stamp: no license"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ext := &stampExtension{startErr: tt.startErr}
+			withExtensions(t, nameExtension("plain"), ext)
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := NewProxyHandler(cfg)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("NewProxyHandler: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ext.header != "X-Stamp" {
+				t.Errorf("started with header %q", ext.header)
+			}
+			h.Close()
+			if !ext.closed {
+				t.Error("extension not closed with the handler")
+			}
+		})
+	}
+}
+
+func TestExtensionHooks(t *testing.T) {
+	ext := &stampExtension{}
+	withExtensions(t, ext)
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		if r.URL.Path == "/reject" {
+			w.Header().Set("X-Reject", "1")
+		}
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"extensions": {"stamp": {"header": "X-Stamp"}},
+		"routes": [
+			{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"},
+			{"name": "down", "prefix": "/down/", "upstream": "http://127.0.0.1:1"}
+		]}`)
+	// Embedder hooks of order 0 run before the extension's
+	var order []string
+	h.AddResponseHook("embedder", 0, func(resp *http.Response) error {
+		order = append(order, "embedder:"+resp.Header.Get("X-Stamp"))
+		return nil
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		upstream bool   // whether the upstream was asked
+		stamp    string // X-Stamp on the response
+		kind     error  // reported to the error hook
+	}{
+		{name: "stamped", path: "/api/orders", status: http.StatusOK, upstream: true, stamp: "response"},
+		{name: "answered by the extension", path: "/api/private/x", status: http.StatusForbidden},
+		{name: "response rejected", path: "/api/reject", status: http.StatusUnavailableForLegalReasons, upstream: true, kind: ErrInvalidRequest},
+		{name: "upstream down", path: "/down/x", status: http.StatusBadGateway, kind: ErrUpstreamUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen, order = nil, nil
+			ext.errors = nil
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if (seen != nil) != tt.upstream {
+				t.Fatalf("upstream asked: %v, want %v", seen != nil, tt.upstream)
+			}
+			if tt.upstream {
+				if seen.Get("X-Stamp") != "request" {
+					t.Errorf("upstream request headers %v", seen)
+				}
+				if !slices.Equal(order, []string{"embedder:"}) {
+					t.Errorf("response hooks ran as %v", order)
+				}
+			}
+			if got := w.Header().Get("X-Stamp"); got != tt.stamp {
+				t.Errorf("X-Stamp %q, want %q", got, tt.stamp)
+			}
+			switch {
+			case tt.kind == nil && len(ext.errors) > 0:
+				t.Errorf("error hook told about %v", ext.errors)
+			case tt.kind != nil && (len(ext.errors) != 1 || !errors.Is(ext.errors[0], tt.kind)):
+				t.Errorf("error hook told about %v, want one %v", ext.errors, tt.kind)
+			}
+		})
+	}
+
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	req := ext.requests[0]
+	if req.Route != "api" || req.Path != "/orders" || req.Upstream.String() != upstream.URL || req.RequestID == "" || req.ClientIP == "" {
+		t.Errorf("extension request %+v", req)
+	}
+}
@@ -0,0 +1,259 @@
+package proxygo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFTPTimeout = 30 * time.Second
+
+// ftpTransport answers HTTP requests for ftp:// targets. Each request logs in on a control
+// connection of its own, which lasts until the response body is closed.
+type ftpTransport struct {
+	dialer  *net.Dialer
+	timeout time.Duration
+}
+
+// newFTPTransport returns nil when ftp:// targets are disabled; dialer is the upstream
+// dialer, so destination rules apply to control and data connections alike
+func newFTPTransport(cfg *FTPConfig, dialer *net.Dialer) *ftpTransport {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	t := &ftpTransport{dialer: dialer, timeout: time.Duration(cfg.Timeout)}
+	if t.timeout <= 0 {
+		t.timeout = defaultFTPTimeout
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper. Basic auth credentials, which the director sets
+// from the target URL's userinfo, log in; without them the login is anonymous.
+func (t *ftpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if resp := readOnlyResponse(req); resp != nil {
+		return resp, nil
+	}
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		user, pass = "anonymous", "proxygo@"
+	}
+	// RFC 1738: the URL path is relative to the login directory
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if strings.ContainsAny(user+pass+name, "\r\n") {
+		return nil, fmt.Errorf("ftp: line breaks are not allowed in credentials or paths")
+	}
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "21")
+	}
+	conn, err := t.dialer.DialContext(req.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &ftpSession{transport: t, conn: conn, text: textproto.NewConn(conn)}
+	// Closing the control connection unblocks whatever the session is waiting for
+	s.stop = context.AfterFunc(req.Context(), func() { conn.Close() })
+
+	resp, err := s.fetch(req, user, pass, name)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if _, streaming := resp.Body.(*ftpBody); !streaming {
+		s.close()
+	}
+	return resp, nil
+}
+
+// ftpSession is one logged-in control connection
+type ftpSession struct {
+	transport *ftpTransport
+	conn      net.Conn
+	text      *textproto.Conn
+	stop      func() bool
+}
+
+// cmd sends a command and reads its reply; expect is the reply code or class required,
+// or 0 to accept any
+func (s *ftpSession) cmd(expect int, format string, args ...any) (int, string, error) {
+	s.conn.SetDeadline(time.Now().Add(s.transport.timeout))
+	if _, err := s.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return s.text.ReadResponse(expect)
+}
+
+// fetch logs in and answers req for name; a streamed body keeps the session open until closed
+func (s *ftpSession) fetch(req *http.Request, user, pass, name string) (*http.Response, error) {
+	s.conn.SetDeadline(time.Now().Add(s.transport.timeout))
+	if _, _, err := s.text.ReadResponse(2); err != nil {
+		return nil, fmt.Errorf("ftp greeting: %w", err)
+	}
+	code, msg, err := s.cmd(0, "USER %s", user)
+	if err == nil && (code == 331 || code == 332) {
+		code, msg, err = s.cmd(0, "PASS %s", pass)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code/100 != 2 {
+		return nil, fmt.Errorf("ftp login as %s refused: %d %s", user, code, msg)
+	}
+	if _, _, err := s.cmd(2, "TYPE I"); err != nil {
+		return nil, fmt.Errorf("ftp binary mode: %w", err)
+	}
+
+	header := http.Header{}
+	if name == "" || strings.HasSuffix(name, "/") {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		if req.Method == http.MethodHead {
+			return localResponse(req, http.StatusOK, header, http.NoBody, -1), nil
+		}
+		if name == "" {
+			return s.transfer(req, header, -1, "LIST")
+		}
+		return s.transfer(req, header, -1, "LIST %s", name)
+	}
+
+	// SIZE and MDTM are extensions, so a server may not answer them
+	size := int64(-1)
+	code, msg, err = s.cmd(0, "SIZE %s", name)
+	if err != nil {
+		return nil, err
+	}
+	if code == 213 {
+		size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	} else if code == 550 && req.Method == http.MethodHead {
+		return localResponse(req, http.StatusNotFound, header, http.NoBody, -1), nil
+	}
+	if code, msg, err := s.cmd(0, "MDTM %s", name); err != nil {
+		return nil, err
+	} else if modified, err := time.Parse("20060102150405", strings.TrimSpace(msg)); code == 213 && err == nil {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	if req.Method == http.MethodHead {
+		return localResponse(req, http.StatusOK, header, http.NoBody, size), nil
+	}
+	return s.transfer(req, header, size, "RETR %s", name)
+}
+
+// transfer runs a command that sends its output over a passive data connection
+func (s *ftpSession) transfer(req *http.Request, header http.Header, size int64, format string, args ...any) (*http.Response, error) {
+	data, err := s.passive(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	code, msg, err := s.cmd(0, format, args...)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	switch code {
+	case 125, 150:
+	case 450, 550:
+		data.Close()
+		return textResponse(req, http.StatusNotFound, msg), nil
+	default:
+		data.Close()
+		return nil, fmt.Errorf("ftp %s: %d %s", strings.Fields(format)[0], code, msg)
+	}
+
+	// The control connection stays quiet for however long the transfer takes
+	s.conn.SetDeadline(time.Time{})
+	return localResponse(req, http.StatusOK, header, &ftpBody{data: data, session: s}, size), nil
+}
+
+// passive opens a data connection, preferring EPSV. The data connection always goes to the
+// control connection's address, so a server cannot point the proxy somewhere else.
+func (s *ftpSession) passive(ctx context.Context) (net.Conn, error) {
+	port := 0
+	code, msg, err := s.cmd(0, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(msg, "(|||"); code == 229 && i >= 0 {
+		fmt.Sscanf(msg[i+4:], "%d|)", &port)
+	}
+	if port == 0 {
+		_, msg, err := s.cmd(227, "PASV")
+		if err != nil {
+			return nil, fmt.Errorf("ftp passive mode: %w", err)
+		}
+		var h1, h2, h3, h4, p1, p2 int
+		i := strings.IndexAny(msg, "0123456789")
+		if i < 0 {
+			return nil, fmt.Errorf("ftp passive mode: unexpected reply %q", msg)
+		}
+		if n, _ := fmt.Sscanf(msg[i:], "%d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1, &p2); n != 6 {
+			return nil, fmt.Errorf("ftp passive mode: unexpected reply %q", msg)
+		}
+		port = p1<<8 | p2
+	}
+
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	return s.transport.dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// close ends the session without waiting for the server
+func (s *ftpSession) close() {
+	s.stop()
+	s.conn.SetDeadline(time.Now().Add(time.Second))
+	s.text.Cmd("QUIT")
+	s.text.Close()
+}
+
+// ftpBody streams a transfer. At the end of the data it reads the transfer's final reply,
+// so a transfer the server aborted is reported as an error rather than a short body.
+type ftpBody struct {
+	data    net.Conn
+	session *ftpSession
+	done    bool
+	once    sync.Once
+}
+
+// Read implements io.Reader
+func (b *ftpBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		b.done = true
+		b.data.Close()
+		s := b.session
+		s.conn.SetDeadline(time.Now().Add(s.transport.timeout))
+		if code, msg, replyErr := s.text.ReadResponse(2); replyErr != nil {
+			return n, fmt.Errorf("ftp transfer incomplete: %d %s", code, msg)
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (b *ftpBody) Close() error {
+	b.once.Do(func() {
+		b.data.Close()
+		b.session.close()
+	})
+	return nil
+}
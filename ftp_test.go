@@ -0,0 +1,267 @@
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFTP is a minimal FTP server holding files in memory
+type fakeFTP struct {
+	ln     net.Listener
+	files  map[string]string
+	noEPSV bool   // answer EPSV with 502, so clients fall back to PASV
+	abort  string // file whose transfer is aborted halfway
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// startFakeFTP starts f on a loopback port until the test ends
+func startFakeFTP(t *testing.T, f *fakeFTP) *fakeFTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// log returns the commands received so far
+func (f *fakeFTP) log() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// serve runs one control connection
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ftp")
+	var user string
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		content, exists := f.files[arg]
+		switch cmd {
+		case "USER":
+			user = arg
+			text.PrintfLine("331 password please")
+		case "PASS":
+			if user == "anonymous" || user == "alice" && arg == "secret" {
+				text.PrintfLine("230 logged in")
+			} else {
+				text.PrintfLine("530 login incorrect")
+			}
+		case "TYPE":
+			text.PrintfLine("200 type set")
+		case "SIZE":
+			if exists {
+				text.PrintfLine("213 %d", len(content))
+			} else {
+				text.PrintfLine("550 no such file")
+			}
+		case "MDTM":
+			if exists {
+				text.PrintfLine("213 20240102030405")
+			} else {
+				text.PrintfLine("550 no such file")
+			}
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && f.noEPSV {
+				text.PrintfLine("502 not implemented")
+				continue
+			}
+			data, _ = net.Listen("tcp", "127.0.0.1:0")
+			port := data.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				// An address other than the server's, which clients must not connect to
+				text.PrintfLine("227 Entering Passive Mode (192,0,2,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "RETR", "LIST":
+			if cmd == "LIST" {
+				var names []string
+				for name := range f.files {
+					if strings.HasPrefix(name, arg) {
+						names = append(names, strings.TrimPrefix(name, arg))
+					}
+				}
+				sort.Strings(names)
+				content, exists = strings.Join(names, "\r\n")+"\r\n", len(names) > 0
+			}
+			if !exists {
+				text.PrintfLine("550 no such file")
+				continue
+			}
+			text.PrintfLine("150 opening data connection")
+			dc, err := data.Accept()
+			if err != nil {
+				return
+			}
+			if arg == f.abort {
+				io.WriteString(dc, content[:len(content)/2])
+				dc.Close()
+				text.PrintfLine("426 transfer aborted")
+				continue
+			}
+			io.WriteString(dc, content)
+			dc.Close()
+			text.PrintfLine("226 transfer complete")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestFTPTransport(t *testing.T) {
+	files := map[string]string{
+		"pub/readme.txt": "hello over ftp\n",
+		"pub/data.bin":   strings.Repeat("0123456789", 1000),
+		"pub/sub/a.json": `{"a":1}`,
+	}
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		user, pass  string
+		noEPSV      bool
+		status      int
+		contentType string
+		body        string
+		length      int64
+		retr        bool // whether RETR was sent
+	}{
+		{name: "get", method: "GET", path: "/pub/readme.txt", status: 200, contentType: "text/plain; charset=utf-8",
+			body: files["pub/readme.txt"], length: int64(len(files["pub/readme.txt"])), retr: true},
+		{name: "get over pasv", method: "GET", path: "/pub/data.bin", noEPSV: true, status: 200, contentType: "application/octet-stream",
+			body: files["pub/data.bin"], length: 10000, retr: true},
+		{name: "head", method: "HEAD", path: "/pub/sub/a.json", status: 200, contentType: "application/json", length: 7},
+		{name: "login", method: "GET", path: "/pub/readme.txt", user: "alice", pass: "secret", status: 200,
+			contentType: "text/plain; charset=utf-8", body: files["pub/readme.txt"], length: int64(len(files["pub/readme.txt"])), retr: true},
+		{name: "listing", method: "GET", path: "/pub/sub/", status: 200, contentType: "text/plain; charset=utf-8", body: "a.json\r\n", length: -1},
+		{name: "missing", method: "GET", path: "/pub/nope.txt", status: 404, contentType: "text/plain; charset=utf-8", body: "no such file\n", length: 13, retr: true},
+		{name: "head missing", method: "HEAD", path: "/pub/nope.txt", status: 404, length: -1},
+		{name: "read only", method: "PUT", path: "/pub/readme.txt", status: 405, contentType: "text/plain; charset=utf-8",
+			body: "Method not allowed\n", length: 19},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startFakeFTP(t, &fakeFTP{files: files, noEPSV: tt.noEPSV})
+			transport := newFTPTransport(&FTPConfig{Enabled: true}, &net.Dialer{})
+			req, _ := http.NewRequest(tt.method, "ftp://"+srv.ln.Addr().String()+tt.path, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if resp.StatusCode != tt.status || string(body) != tt.body || resp.ContentLength != tt.length {
+				t.Errorf("got %d, %d bytes of length %d; want %d, %d bytes of length %d",
+					resp.StatusCode, len(body), resp.ContentLength, tt.status, len(tt.body), tt.length)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.status == 200 && tt.length >= 0 && resp.Header.Get("Last-Modified") != lastModified {
+				t.Errorf("Last-Modified = %q, want %q", resp.Header.Get("Last-Modified"), lastModified)
+			}
+
+			commands := strings.Join(srv.log(), "\n")
+			wantUser := "USER anonymous\nPASS proxygo@"
+			if tt.user != "" {
+				wantUser = fmt.Sprintf("USER %s\nPASS %s", tt.user, tt.pass)
+			}
+			if tt.method != "PUT" && !strings.HasPrefix(commands, wantUser+"\nTYPE I") {
+				t.Errorf("session did not log in as %s:\n%s", tt.user, commands)
+			}
+			if retr := strings.Contains(commands, "RETR "); retr != tt.retr {
+				t.Errorf("RETR sent = %v, want %v:\n%s", retr, tt.retr, commands)
+			}
+		})
+	}
+}
+
+func TestFTPTransportErrors(t *testing.T) {
+	srv := startFakeFTP(t, &fakeFTP{files: map[string]string{"big.bin": strings.Repeat("x", 4096)}, abort: "big.bin"})
+	transport := newFTPTransport(&FTPConfig{Enabled: true, Timeout: Duration(5 * time.Second)}, &net.Dialer{})
+	base := "ftp://" + srv.ln.Addr().String()
+
+	// A transfer the server aborts fails instead of ending early
+	req, _ := http.NewRequest("GET", base+"/big.bin", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || !strings.Contains(err.Error(), "426") {
+		t.Errorf("aborted transfer read error = %v, want the 426 reply", err)
+	}
+
+	// A refused login is an error
+	req, _ = http.NewRequest("GET", base+"/big.bin", nil)
+	req.SetBasicAuth("alice", "wrong")
+	if _, err := transport.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "530") {
+		t.Errorf("wrong password: err = %v, want the 530 reply", err)
+	}
+
+	// Line breaks would smuggle in commands
+	before := len(srv.log())
+	req, _ = http.NewRequest("GET", base+"/x", nil)
+	req.URL.Path = "/x\r\nDELE big.bin"
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Error("a path with a line break was accepted")
+	}
+	if len(srv.log()) != before {
+		t.Errorf("the server saw commands for a refused path: %q", srv.log()[before:])
+	}
+
+	if newFTPTransport(&FTPConfig{}, &net.Dialer{}) != nil {
+		t.Error("ftp is enabled without enabled: true")
+	}
+}
@@ -0,0 +1,113 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// unknownCountry is reported for addresses missing from the database, e.g. private ranges
+const unknownCountry = "ZZ"
+
+// errDestinationDenied is returned when GeoIP rules forbid dialing an upstream address
+var errDestinationDenied = errors.New("destination denied by geoip rules")
+
+// GeoIPConfig enables country lookups from a MaxMind/GeoLite2 database
+type GeoIPConfig struct {
+	Database  string       `json:"database"`  // path to a GeoLite2-Country.mmdb or compatible file
+	Clients   CountryRules `json:"clients"`   // rules applied to the connecting client
+	Upstreams CountryRules `json:"upstreams"` // rules applied to every dialed upstream address
+}
+
+// CountryRules allows or denies ISO country codes; deny wins over allow.
+// A non-empty allow list denies everything not on it, including "ZZ" (unknown).
+type CountryRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// permits reports whether country passes the rules
+func (c CountryRules) permits(country string) bool {
+	if slices.Contains(c.Deny, country) {
+		return false
+	}
+	return len(c.Allow) == 0 || slices.Contains(c.Allow, country)
+}
+
+// geoIP answers country lookups and enforces the configured country rules
+type geoIP struct {
+	db        *maxminddb.Reader
+	clients   CountryRules
+	upstreams CountryRules
+}
+
+// countryRecord is the subset of the MaxMind country schema we read
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// openGeoIP opens the configured database, returning nil when GeoIP is disabled
+func openGeoIP(cfg *GeoIPConfig) (*geoIP, error) {
+	if cfg == nil || cfg.Database == "" {
+		return nil, nil
+	}
+
+	db, err := maxminddb.Open(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geoip database: %w", err)
+	}
+
+	return &geoIP{
+		db:        db,
+		clients:   normalizeCountryRules(cfg.Clients),
+		upstreams: normalizeCountryRules(cfg.Upstreams),
+	}, nil
+}
+
+// normalizeCountryRules upper-cases country codes so config may use either case
+func normalizeCountryRules(c CountryRules) CountryRules {
+	upper := func(codes []string) []string {
+		out := make([]string, len(codes))
+		for i, code := range codes {
+			out[i] = strings.ToUpper(code)
+		}
+		return out
+	}
+	return CountryRules{Allow: upper(c.Allow), Deny: upper(c.Deny)}
+}
+
+// country returns the ISO code for ip, or unknownCountry
+func (g *geoIP) country(ip net.IP) string {
+	if ip == nil {
+		return unknownCountry
+	}
+
+	var rec countryRecord
+	if err := g.db.Lookup(ip, &rec); err != nil || rec.Country.ISOCode == "" {
+		return unknownCountry
+	}
+	return rec.Country.ISOCode
+}
+
+// dialControl vets the resolved upstream address right before connecting,
+// so the check cannot be sidestepped by DNS answers changing between lookups
+func (g *geoIP) dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	// Link-local IPv6 addresses carry a zone, as in fe80::1%eth0
+	ip, _, _ := strings.Cut(host, "%")
+	if country := g.country(net.ParseIP(ip)); !g.upstreams.permits(country) {
+		return fmt.Errorf("%w: %s is in %s", errDestinationDenied, host, country)
+	}
+	return nil
+}
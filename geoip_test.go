@@ -0,0 +1,184 @@
+package proxygo
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestGeoIP writes an IPv4 MaxMind database placing each CIDR in its country
+func writeTestGeoIP(t *testing.T, countries map[string]string) string {
+	t.Helper()
+
+	// The search tree is a binary trie over address bits; a record holds a child node,
+	// nodeCount for "not found", or nodeCount+16 plus the offset of a data record
+	type node [2]int
+	nodes := []node{{-1, -1}}
+	var data []byte
+	type leaf struct{ node, bit, offset int }
+	var leaves []leaf
+	for cidr, country := range countries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To4()
+		n := 0
+		for i := 0; i < ones-1; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if nodes[n][bit] < 0 {
+				nodes = append(nodes, node{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+		leaves = append(leaves, leaf{n, int(ip[(ones-1)/8]>>(7-(ones-1)%8)) & 1, len(data)})
+		data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(country)))...)
+	}
+	count := len(nodes)
+	for _, l := range leaves {
+		nodes[l.node][l.bit] = count + 16 + l.offset
+	}
+
+	var db []byte
+	for _, n := range nodes {
+		for _, record := range n {
+			if record < 0 {
+				record = count
+			}
+			db = append(db, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint64(count)),
+		mmdbString("record_size"), mmdbUint(5, 24),
+		mmdbString("ip_version"), mmdbUint(5, 4),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+		mmdbString("binary_format_major_version"), mmdbUint(5, 2),
+		mmdbString("binary_format_minor_version"), mmdbUint(5, 0),
+	)...)
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, db, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mmdbString encodes a short UTF-8 string in the MaxMind data format
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint encodes v as the unsigned type typ (5 for uint16, 6 for uint32)
+func mmdbUint(typ byte, v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return append([]byte{typ<<5 | byte(len(b))}, b...)
+}
+
+// mmdbMap encodes alternating keys and values as a map
+func mmdbMap(pairs ...[]byte) []byte {
+	out := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestCountryRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   CountryRules
+		country string
+		want    bool
+	}{
+		{name: "no rules", country: "DE", want: true},
+		{name: "no rules unknown", country: unknownCountry, want: true},
+		{name: "allowed", rules: CountryRules{Allow: []string{"de", "fr"}}, country: "DE", want: true},
+		{name: "not allowed", rules: CountryRules{Allow: []string{"de"}}, country: "US"},
+		{name: "unknown not allowed", rules: CountryRules{Allow: []string{"de"}}, country: unknownCountry},
+		{name: "denied", rules: CountryRules{Deny: []string{"us"}}, country: "US"},
+		{name: "not denied", rules: CountryRules{Deny: []string{"us"}}, country: "DE", want: true},
+		{name: "deny wins", rules: CountryRules{Allow: []string{"DE"}, Deny: []string{"de"}}, country: "DE"},
+		{name: "unknown denied", rules: CountryRules{Deny: []string{"zz"}}, country: unknownCountry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeCountryRules(tt.rules).permits(tt.country); got != tt.want {
+				t.Errorf("permits(%q) = %v, want %v", tt.country, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoIPClients(t *testing.T) {
+	database := writeTestGeoIP(t, map[string]string{"192.0.2.0/25": "DE", "192.0.2.128/25": "US", "198.51.100.0/24": "FR"})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"geoip": {"database": "`+database+`", "clients": {"allow": ["de", "fr"], "deny": ["fr"]}},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	tests := []struct {
+		client  string
+		country string
+		status  int
+	}{
+		{client: "192.0.2.1", country: "DE", status: http.StatusOK},
+		{client: "192.0.2.200", country: "US", status: http.StatusForbidden},
+		{client: "198.51.100.7", country: "FR", status: http.StatusForbidden},
+		{client: "203.0.113.9", country: unknownCountry, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.client, func(t *testing.T) {
+			if got := h.geo.country(net.ParseIP(tt.client)); got != tt.country {
+				t.Errorf("country %q, want %q", got, tt.country)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			r.RemoteAddr = net.JoinHostPort(tt.client, "1234")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestGeoIPUpstreams(t *testing.T) {
+	g, err := openGeoIP(&GeoIPConfig{
+		Database:  writeTestGeoIP(t, map[string]string{"192.0.2.0/24": "DE", "198.51.100.0/24": "RU"}),
+		Upstreams: CountryRules{Deny: []string{"ru", "zz"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.db.Close()
+
+	tests := []struct {
+		address string
+		denied  bool
+	}{
+		{address: "192.0.2.10:443"},
+		{address: "198.51.100.10:443", denied: true},
+		{address: "203.0.113.1:80", denied: true},
+		{address: "[fe80::1%eth0]:80", denied: true},
+	}
+	for _, tt := range tests {
+		err := g.dialControl("tcp", tt.address, nil)
+		if denied := errors.Is(err, errDestinationDenied); denied != tt.denied {
+			t.Errorf("dialControl(%s) = %v, want denied %v", tt.address, err, tt.denied)
+		}
+	}
+}
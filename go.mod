@@ -1,3 +1,20 @@
 module proxygo
 
 go 1.24.0
+
+require github.com/oschwald/maxminddb-golang v1.13.1
+
+require (
+	github.com/HugoSmits86/nativewebp v1.3.0
+	github.com/expr-lang/expr v1.17.8
+	github.com/quic-go/quic-go v0.59.0
+	golang.org/x/image v0.31.0
+	golang.org/x/sys v0.35.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+)
@@ -0,0 +1,110 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newGRPCUpstream serves cleartext HTTP/2 and answers every call with its body echoed
+// and an OK status in the trailers
+func newGRPCUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "not HTTP/2: "+r.Proto, http.StatusHTTPVersionNotSupported)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// grpcCall sends a gRPC request for target as an HTTP/2 client would
+func grpcCall(h *ProxyHandler, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestGRPCPassthrough(t *testing.T) {
+	upstream := newGRPCUpstream(t)
+	h := newTestHandler(t, `{"routes": [
+		{"name": "grpc", "prefix": "/pkg.Service/", "upstream": "`+upstream.URL+`/pkg.Service/"},
+		{"name": "down", "prefix": "/down.Service/", "upstream": "http://127.0.0.1:1/down.Service/"}]}`)
+
+	tests := []struct {
+		name       string
+		target     string
+		grpc       bool
+		status     int
+		body       string
+		grpcStatus string // in the trailers when the upstream answered, else in the header
+		message    string
+	}{
+		{name: "call", target: "/pkg.Service/Get", grpc: true, status: http.StatusOK, body: "\x00\x00\x00\x00\x02hi", grpcStatus: "0"},
+		{name: "upstream down", target: "/down.Service/Get", grpc: true, status: http.StatusOK, grpcStatus: "14", message: "proxy error: "},
+		{name: "plain request to down upstream", target: "/down.Service/Get", status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w *httptest.ResponseRecorder
+			if tt.grpc {
+				w = grpcCall(h, tt.target, "\x00\x00\x00\x00\x02hi")
+			} else {
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader("hi")))
+			}
+			resp := w.Result()
+			if resp.StatusCode != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Fatalf("%d %q, want %d %q", resp.StatusCode, w.Body.String(), tt.status, tt.body)
+			}
+			if !tt.grpc {
+				return
+			}
+			status := resp.Trailer.Get("Grpc-Status")
+			if status == "" {
+				status = resp.Header.Get("Grpc-Status")
+			}
+			if status != tt.grpcStatus {
+				t.Errorf("grpc-status %q, want %q", status, tt.grpcStatus)
+			}
+			if msg := resp.Header.Get("Grpc-Message"); !strings.HasPrefix(msg, tt.message) {
+				t.Errorf("grpc-message %q, want it to start with %q", msg, tt.message)
+			}
+		})
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	tests := []struct {
+		msg, want string
+	}{
+		{"upstream unavailable", "upstream unavailable"},
+		{"100% done", "100%25 done"},
+		{"line\nbreak", "line%0Abreak"},
+		{"café", "caf%C3%A9"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := encodeGRPCMessage(tt.msg); got != tt.want {
+			t.Errorf("encodeGRPCMessage(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Readiness defaults
+const (
+	defaultCertExpiryWindow = 7 * 24 * time.Hour
+	readinessDialTimeout    = 2 * time.Second
+)
+
+// healthCheck is the outcome of one readiness check
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the body of /healthz and /readyz
+type healthReport struct {
+	Status string        `json:"status"` // "ok", "unavailable" or "draining"
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// handleHealthz handles GET /healthz: the process is up and serving the admin API
+func (a *adminAPI) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// handleReadyz handles GET /readyz, answering 503 when any dependency check fails
+func (a *adminAPI) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	// A draining instance is healthy but should receive no new traffic
+	if a.proxy.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: "draining"})
+		return
+	}
+	report := healthReport{Status: "ok", Checks: a.proxy.readinessChecks(r.Context())}
+	status := http.StatusOK
+	for _, c := range report.Checks {
+		if !c.OK {
+			report.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, report)
+}
+
+// readinessChecks validates the config file, listener certificates and mandatory upstreams
+func (h *ProxyHandler) readinessChecks(ctx context.Context) []healthCheck {
+	cfg := h.config.Load()
+	checks := []healthCheck{h.checkConfig()}
+
+	window := defaultCertExpiryWindow
+	if cfg.Admin != nil && cfg.Admin.CertExpiryWindow > 0 {
+		window = time.Duration(cfg.Admin.CertExpiryWindow)
+	}
+	for _, lc := range cfg.Listeners {
+		if lc.TLS != nil {
+			checks = append(checks, checkCertificate(lc, window))
+		}
+	}
+	for _, vc := range cfg.VirtualHosts {
+		if vc.TLS != nil && len(vc.Hosts) > 0 {
+			checks = append(checks, checkCertificate(ListenerConfig{Name: "vhost:" + vc.Hosts[0], TLS: vc.TLS}, window))
+		}
+	}
+
+	// Dial the upstreams in parallel so one slow host does not stall the probe
+	var mandatory []*Route
+	for _, route := range h.allRoutes() {
+		if route.Mandatory {
+			mandatory = append(mandatory, route)
+		}
+	}
+	results := make([]healthCheck, len(mandatory))
+	var wg sync.WaitGroup
+	for i, route := range mandatory {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = checkUpstream(ctx, route)
+		}()
+	}
+	wg.Wait()
+	return append(checks, results...)
+}
+
+// checkConfig verifies that the config file still loads, so the next reload or restart would succeed
+func (h *ProxyHandler) checkConfig() healthCheck {
+	check := healthCheck{Name: "config", OK: true}
+	if h.configPath == "" {
+		check.Message = "using built-in defaults"
+		return check
+	}
+	if _, err := LoadConfig(h.configPath); err != nil {
+		check.OK, check.Message = false, err.Error()
+	}
+	return check
+}
+
+// checkCertificate fails when a listener's certificate cannot be loaded or expires within window
+func checkCertificate(lc ListenerConfig, window time.Duration) healthCheck {
+	check := healthCheck{Name: "certificate:" + lc.Name}
+	pair, err := tls.LoadX509KeyPair(lc.TLS.CertFile, lc.TLS.KeyFile)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+
+	remaining := time.Until(leaf.NotAfter)
+	check.Message = fmt.Sprintf("expires %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	switch {
+	case remaining <= 0:
+		check.Message = fmt.Sprintf("expired %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	case remaining < window:
+		check.Message += fmt.Sprintf(", within the %s expiry window", window)
+	default:
+		check.OK = true
+	}
+	return check
+}
+
+// checkUpstream opens and closes a connection to a route's upstream
+func checkUpstream(ctx context.Context, route *Route) healthCheck {
+	check := healthCheck{Name: "upstream:" + route.Name}
+
+	network, address := "tcp", route.Upstream.Host
+	if route.Socket != "" {
+		network, address = "unix", route.Socket
+	} else if route.Upstream.Port() == "" {
+		port := "80"
+		if route.Upstream.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(route.Upstream.Hostname(), port)
+	}
+
+	dialer := net.Dialer{Timeout: readinessDialTimeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	conn.Close()
+	check.OK = true
+	check.Message = fmt.Sprintf("connected to %s in %s", address, time.Since(start).Round(time.Millisecond))
+	return check
+}
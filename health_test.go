@@ -0,0 +1,154 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+	// A port nothing listens on any more
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	validCert, validKey := writeTestCertValid(t, time.Now().Add(-time.Hour), time.Now().Add(30*24*time.Hour))
+	soonCert, soonKey := writeTestCertValid(t, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	expiredCert, expiredKey := writeTestCertValid(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	listener := func(name, cert, key string) string {
+		return `{"name": "` + name + `", "address": "127.0.0.1:0", "tls": {"cert_file": "` + cert + `", "key_file": "` + key + `"}}`
+	}
+
+	tests := []struct {
+		name   string
+		config string // fields added to the admin config
+		status int
+		want   map[string]bool // check name to ok
+	}{
+		{
+			name:   "defaults",
+			status: http.StatusOK,
+			want:   map[string]bool{"config": true},
+		},
+		{
+			name:   "mandatory upstream reachable",
+			config: `"routes": [{"name": "api", "prefix": "/api/", "upstream": "` + up.URL + `", "mandatory": true}]`,
+			status: http.StatusOK,
+			want:   map[string]bool{"config": true, "upstream:api": true},
+		},
+		{
+			name: "mandatory upstream down",
+			config: `"routes": [{"name": "api", "prefix": "/api/", "upstream": "` + down + `", "mandatory": true},
+				{"name": "optional", "prefix": "/opt/", "upstream": "` + down + `"}]`,
+			status: http.StatusServiceUnavailable,
+			want:   map[string]bool{"config": true, "upstream:api": false},
+		},
+		{
+			name:   "certificate valid",
+			config: `"listeners": [` + listener("web", validCert, validKey) + `]`,
+			status: http.StatusOK,
+			want:   map[string]bool{"config": true, "certificate:web": true},
+		},
+		{
+			name:   "certificate within window",
+			config: `"listeners": [` + listener("web", soonCert, soonKey) + `]`,
+			status: http.StatusServiceUnavailable,
+			want:   map[string]bool{"config": true, "certificate:web": false},
+		},
+		{
+			name:   "certificate expired",
+			config: `"listeners": [` + listener("web", expiredCert, expiredKey) + `]`,
+			status: http.StatusServiceUnavailable,
+			want:   map[string]bool{"config": true, "certificate:web": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := `{"admin": {"address": "127.0.0.1:0"}`
+			if tt.config != "" {
+				config += ", " + tt.config
+			}
+			h := newTestHandler(t, config+"}")
+			admin := newAdminAPI(h, h.config.Load().Admin)
+
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var report healthReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]bool{}
+			for _, c := range report.Checks {
+				got[c.Name] = c.OK
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checks %+v, want %v", report.Checks, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthzWhileDraining(t *testing.T) {
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0"}}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+	h.draining.Store(true)
+
+	tests := []struct {
+		path   string
+		status int
+		report string
+	}{
+		{path: "/healthz", status: http.StatusOK, report: "ok"},
+		{path: "/readyz", status: http.StatusServiceUnavailable, report: "draining"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		var report healthReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		if w.Code != tt.status || report.Status != tt.report {
+			t.Errorf("%s: %d %s, want %d %q", tt.path, w.Code, w.Body, tt.status, tt.report)
+		}
+	}
+}
+
+func TestReadyzConfigFile(t *testing.T) {
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0"}}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+	h.configPath = filepath.Join(t.TempDir(), "config.json")
+
+	tests := []struct {
+		name   string
+		file   string
+		status int
+	}{
+		{name: "valid", file: `{"routes": []}`, status: http.StatusOK},
+		{name: "broken", file: `{"routes": [`, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(h.configPath, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package proxygo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HedgingConfig sends a duplicate of slow requests and uses whichever response arrives first
+type HedgingConfig struct {
+	Delay     Duration `json:"delay"`      // wait this long for response headers before hedging, e.g. "50ms"
+	MaxHedges int      `json:"max_hedges"` // duplicates sent one delay apart; default 1
+}
+
+// hedgePolicy is a compiled HedgingConfig
+type hedgePolicy struct {
+	delay     time.Duration
+	maxHedges int
+}
+
+// newHedgePolicy returns nil when the route does not hedge
+func newHedgePolicy(cfg *HedgingConfig) (*hedgePolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Delay <= 0 {
+		return nil, fmt.Errorf("hedging delay must be positive")
+	}
+	if cfg.MaxHedges < 0 {
+		return nil, fmt.Errorf("hedging max_hedges cannot be negative")
+	}
+	p := &hedgePolicy{delay: time.Duration(cfg.Delay), maxHedges: cfg.MaxHedges}
+	if p.maxHedges == 0 {
+		p.maxHedges = 1
+	}
+	return p, nil
+}
+
+// hedgeable reports whether req may be sent more than once: an idempotent method without
+// a body to replay, and not a protocol upgrade, which must stay on one connection
+func hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Header.Get("Upgrade") == ""
+}
+
+// hedgingTransport races duplicates of slow requests; proxygo has no load balancing yet,
+// so every attempt goes to the route's upstream, each over its own connection
+type hedgingTransport struct {
+	http.RoundTripper
+	policy *hedgePolicy
+	route  string
+	counts *metricVec
+}
+
+// hedgeAttempt is the outcome of one copy of a request
+type hedgeAttempt struct {
+	index  int
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+}
+
+// RoundTrip implements http.RoundTripper. The first response wins and the other attempts
+// are cancelled; an attempt that fails leaves the race to those still in flight.
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	results := make(chan hedgeAttempt, t.policy.maxHedges+1)
+	cancels := make([]context.CancelFunc, 0, t.policy.maxHedges+1)
+	launch := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := t.RoundTripper.RoundTrip(req.Clone(ctx))
+			results <- hedgeAttempt{index: index, resp: resp, err: err, cancel: cancel}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(t.policy.delay)
+	defer timer.Stop()
+
+	pending := 1
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			// A client that went away gets no further copies
+			if len(cancels) <= t.policy.maxHedges && req.Context().Err() == nil {
+				launch()
+				pending++
+				timer.Reset(t.policy.delay)
+			}
+			continue
+		case attempt := <-results:
+			pending--
+			if attempt.err != nil {
+				attempt.cancel()
+				lastErr = attempt.err
+				// Keep waiting while other attempts are out or another hedge is still due
+				if pending > 0 || (len(cancels) > 1 && len(cancels) <= t.policy.maxHedges && req.Context().Err() == nil) {
+					continue
+				}
+				t.record(len(cancels), -1)
+				return nil, lastErr
+			}
+
+			// Cancel the losers and release whatever they still return
+			for i, cancel := range cancels {
+				if i != attempt.index {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for range pending {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}
+			}(pending)
+
+			t.record(len(cancels), attempt.index)
+			attempt.resp.Body = &cancelOnClose{ReadCloser: attempt.resp.Body, cancel: attempt.cancel}
+			return attempt.resp, nil
+		}
+	}
+}
+
+// record counts the hedges of one request; winner is the index of the attempt that
+// answered, 0 for the original request, or -1 when every attempt failed
+func (t *hedgingTransport) record(attempts, winner int) {
+	for i := 1; i < attempts; i++ {
+		outcome := "lost"
+		switch {
+		case winner == i:
+			outcome = "won"
+		case winner < 0:
+			outcome = "failed"
+		}
+		t.counts.inc(t.route, outcome)
+	}
+}
+
+// cancelOnClose releases the winning attempt's context once the body is done with
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
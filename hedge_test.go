@@ -0,0 +1,214 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hedgeUpstream is a RoundTripper that hands each attempt, in the order they are sent,
+// to the matching function of attempts
+type hedgeUpstream struct {
+	attempts []func(ctx context.Context) (*http.Response, error)
+	sent     atomic.Int32
+}
+
+func (u *hedgeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := int(u.sent.Add(1)) - 1
+	return u.attempts[i](req.Context())
+}
+
+// hedgeBody is a response body that records being closed
+type hedgeBody struct {
+	io.Reader
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newHedgeBody(s string) *hedgeBody {
+	return &hedgeBody{Reader: strings.NewReader(s), closed: make(chan struct{})}
+}
+
+func (b *hedgeBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// answer returns an attempt that responds with body after delay
+func answer(delay time.Duration, body *hedgeBody) func(context.Context) (*http.Response, error) {
+	return func(ctx context.Context) (*http.Response, error) {
+		time.Sleep(delay)
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+}
+
+// hang returns an attempt that only ends when it is cancelled, reporting that on cancelled
+func hang(cancelled chan<- struct{}) func(context.Context) (*http.Response, error) {
+	return func(ctx context.Context) (*http.Response, error) {
+		<-ctx.Done()
+		if cancelled != nil {
+			close(cancelled)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// fail returns an attempt that fails after delay
+func fail(delay time.Duration, msg string) func(context.Context) (*http.Response, error) {
+	return func(ctx context.Context) (*http.Response, error) {
+		time.Sleep(delay)
+		return nil, errors.New(msg)
+	}
+}
+
+// newHedgingTransport hedges after delay with up to maxHedges copies
+func newHedgingTransport(u *hedgeUpstream, delay time.Duration, maxHedges int) *hedgingTransport {
+	return &hedgingTransport{
+		RoundTripper: u,
+		policy:       &hedgePolicy{delay: delay, maxHedges: maxHedges},
+		route:        "api",
+		counts:       newMetricsRegistry().counter("proxygo_hedged_requests_total", "", "route", "outcome"),
+	}
+}
+
+// readWinner reads and closes the body of a successful hedged response
+func readWinner(t *testing.T, resp *http.Response, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// waitClosed fails unless ch is closed soon
+func waitClosed(t *testing.T, what string, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Errorf("%s was never released", what)
+	}
+}
+
+func TestHedgeOriginalFast(t *testing.T) {
+	u := &hedgeUpstream{attempts: []func(context.Context) (*http.Response, error){answer(0, newHedgeBody("original"))}}
+	tr := newHedgingTransport(u, 50*time.Millisecond, 2)
+
+	resp, err := tr.RoundTrip(hedgeRequest(t, context.Background()))
+	if body := readWinner(t, resp, err); body != "original" {
+		t.Errorf("body %q, want the original's", body)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := u.sent.Load(); n != 1 {
+		t.Errorf("%d attempts sent, want no hedge", n)
+	}
+}
+
+func TestHedgeWins(t *testing.T) {
+	cancelled := make(chan struct{})
+	u := &hedgeUpstream{attempts: []func(context.Context) (*http.Response, error){
+		hang(cancelled),
+		answer(0, newHedgeBody("hedge")),
+	}}
+	tr := newHedgingTransport(u, 10*time.Millisecond, 1)
+
+	resp, err := tr.RoundTrip(hedgeRequest(t, context.Background()))
+	if body := readWinner(t, resp, err); body != "hedge" {
+		t.Errorf("body %q, want the hedge's", body)
+	}
+	waitClosed(t, "the original attempt", cancelled)
+	if n := tr.counts.value("api", "won"); n != 1 {
+		t.Errorf("won = %v, want 1", n)
+	}
+}
+
+func TestHedgeOriginalWinsLate(t *testing.T) {
+	// The original answers after the hedge went out; the hedge answers once it lost
+	// and its response must still be released
+	originalDone := make(chan struct{})
+	loserBody := newHedgeBody("hedge")
+	u := &hedgeUpstream{attempts: []func(context.Context) (*http.Response, error){
+		func(ctx context.Context) (*http.Response, error) {
+			defer close(originalDone)
+			time.Sleep(40 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: newHedgeBody("original")}, nil
+		},
+		func(ctx context.Context) (*http.Response, error) {
+			<-originalDone
+			<-ctx.Done()
+			return &http.Response{StatusCode: http.StatusOK, Body: loserBody}, nil
+		},
+	}}
+	tr := newHedgingTransport(u, 10*time.Millisecond, 1)
+
+	resp, err := tr.RoundTrip(hedgeRequest(t, context.Background()))
+	if body := readWinner(t, resp, err); body != "original" {
+		t.Errorf("body %q, want the original's", body)
+	}
+	waitClosed(t, "the losing hedge's body", loserBody.closed)
+	if n := tr.counts.value("api", "lost"); n != 1 {
+		t.Errorf("lost = %v, want 1", n)
+	}
+}
+
+func TestHedgeAllFail(t *testing.T) {
+	u := &hedgeUpstream{attempts: []func(context.Context) (*http.Response, error){
+		fail(30*time.Millisecond, "original failed"),
+		fail(40*time.Millisecond, "hedge 1 failed"),
+		fail(0, "hedge 2 failed"),
+	}}
+	tr := newHedgingTransport(u, 10*time.Millisecond, 2)
+
+	resp, err := tr.RoundTrip(hedgeRequest(t, context.Background()))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("RoundTrip succeeded, want the attempts' error")
+	}
+	if n := u.sent.Load(); n != 3 {
+		t.Errorf("%d attempts sent, want 3", n)
+	}
+	if n := tr.counts.value("api", "failed"); n != 2 {
+		t.Errorf("failed = %v, want 2", n)
+	}
+}
+
+func TestHedgeClientCancels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	u := &hedgeUpstream{attempts: []func(context.Context) (*http.Response, error){
+		hang(cancelled[0]), hang(cancelled[1]), hang(nil), hang(nil), hang(nil), hang(nil),
+	}}
+	tr := newHedgingTransport(u, 10*time.Millisecond, 5)
+
+	time.AfterFunc(30*time.Millisecond, cancel)
+	if resp, err := tr.RoundTrip(hedgeRequest(t, ctx)); err == nil {
+		resp.Body.Close()
+		t.Fatal("RoundTrip succeeded, want the cancellation")
+	}
+	waitClosed(t, "the original attempt", cancelled[0])
+	waitClosed(t, "the hedge", cancelled[1])
+	// No copies go out once the client is gone
+	sent := u.sent.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := u.sent.Load(); n != sent {
+		t.Errorf("%d attempts sent after the client left", n-sent)
+	}
+}
+
+// hedgeRequest is a body-less GET bound to ctx
+func hedgeRequest(t *testing.T, ctx context.Context) *http.Request {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://upstream.test/items", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
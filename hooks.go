@@ -0,0 +1,115 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// ResponseHook post-processes an upstream response before it is sent to the client,
+// in the manner of httputil.ReverseProxy.ModifyResponse. resp.Request is the outgoing
+// upstream request; its context carries the client's request info.
+type ResponseHook func(resp *http.Response) error
+
+// HookError lets a hook choose the client-facing error when it rejects a response.
+// Any other error from a hook is reported as 502 hook_failed.
+type HookError struct {
+	Status  int    // HTTP status sent to the client
+	Code    string // machine-readable error code
+	Message string
+}
+
+// Error implements error
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// registeredHook is one hook with its position in the chain
+type registeredHook struct {
+	name  string
+	order int
+	fn    ResponseHook
+}
+
+// responseHooks is the ordered set of embedder hooks
+type responseHooks struct {
+	mu    sync.Mutex
+	hooks []registeredHook
+}
+
+// hookFailure wraps a hook's error with the hook's name
+type hookFailure struct {
+	name string
+	err  error
+}
+
+// Error implements error
+func (e *hookFailure) Error() string {
+	return fmt.Sprintf("response hook %s: %v", e.name, e.err)
+}
+
+// Unwrap exposes the hook's own error to errors.As
+func (e *hookFailure) Unwrap() error {
+	return e.err
+}
+
+// Logger returns the logger the proxy writes its own messages to, for embedders and extensions
+func (h *ProxyHandler) Logger() *log.Logger {
+	return h.logger
+}
+
+// AddResponseHook registers hook under name. Hooks run in ascending order, ties in
+// registration order, after the content filter and before integrity hashing, so a
+// digest always covers what the hooks produced. The first error aborts the response.
+// Registering an existing name replaces that hook. Hooks apply to requests that start
+// after the call.
+func (h *ProxyHandler) AddResponseHook(name string, order int, hook ResponseHook) {
+	h.hooks.mu.Lock()
+	defer h.hooks.mu.Unlock()
+
+	// Requests in flight hold the current slice, so build a new one
+	h.hooks.remove(name)
+	hooks := append(slices.Clip(h.hooks.hooks), registeredHook{name: name, order: order, fn: hook})
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].order < hooks[j].order
+	})
+	h.hooks.hooks = hooks
+}
+
+// RemoveResponseHook unregisters the hook registered under name, if any
+func (h *ProxyHandler) RemoveResponseHook(name string) {
+	h.hooks.mu.Lock()
+	defer h.hooks.mu.Unlock()
+	h.hooks.remove(name)
+}
+
+// remove drops the hook called name; callers hold s.mu
+func (s *responseHooks) remove(name string) {
+	for i, hook := range s.hooks {
+		if hook.name == name {
+			s.hooks = append(s.hooks[:i:i], s.hooks[i+1:]...)
+			return
+		}
+	}
+}
+
+// current returns the hooks in order; the slice is never modified, so it stays valid
+// for a request however the hooks change
+func (s *responseHooks) current() []registeredHook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hooks
+}
+
+// response picks the client-facing error for a rejected response
+func (e *hookFailure) response() (status int, code, message string) {
+	var herr *HookError
+	if errors.As(e.err, &herr) {
+		return herr.Status, herr.Code, herr.Message
+	}
+	return http.StatusBadGateway, "hook_failed", e.Error()
+}
@@ -0,0 +1,111 @@
+package proxygo
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultViaPseudonym names the proxy in Via headers
+const defaultViaPseudonym = "proxygo"
+
+// hopByHopHeaders apply to a single connection and are never forwarded (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but still sent by old clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ViaConfig adds the proxy to the Via header of forwarded requests and responses
+type ViaConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Pseudonym string `json:"pseudonym"` // received-by name, default "proxygo"; use a host name to tell instances apart
+}
+
+// viaHeader appends this proxy's entry to Via headers
+type viaHeader struct {
+	pseudonym string
+}
+
+// newViaHeader returns nil when Via headers are disabled
+func newViaHeader(cfg *ViaConfig) *viaHeader {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	v := &viaHeader{pseudonym: cfg.Pseudonym}
+	if v.pseudonym == "" {
+		v.pseudonym = defaultViaPseudonym
+	}
+	return v
+}
+
+// add appends the entry for a message received over the given protocol version
+func (v *viaHeader) add(h http.Header, major, minor int) {
+	h.Add("Via", viaProtocol(major, minor)+" "+v.pseudonym)
+}
+
+// modifyResponse records the hop from the upstream on its response
+func (v *viaHeader) modifyResponse(resp *http.Response) error {
+	v.add(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	return nil
+}
+
+// viaProtocol formats a received-protocol; the "HTTP/" name is implied
+func viaProtocol(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major)
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor)
+}
+
+// stripHopByHopHeaders removes the headers that describe the client's connection,
+// along with every header it names in Connection. The reverse proxy does the same,
+// but only after the director has added its own headers, so a client could use
+// Connection to delete them; stripping on arrival closes that hole. An upgrade
+// handshake and a TE: trailers request are kept for the reverse proxy to forward.
+func stripHopByHopHeaders(h http.Header) {
+	var upgrade string
+	if headerHasToken(h, "Connection", "upgrade") {
+		upgrade = h.Get("Upgrade")
+	}
+	trailers := headerHasToken(h, "Te", "trailers")
+
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+}
+
+// headerHasToken reports whether the comma-separated header name lists token, case-insensitively
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			// Parameters such as "trailers;q=1" do not change the token
+			t, _, _ = strings.Cut(t, ";")
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHopByHopRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   map[string]string // header the upstream receives, "" for none
+	}{
+		{
+			name:   "connection listed",
+			header: http.Header{"Connection": {"X-Secret, close"}, "X-Secret": {"1"}, "X-Kept": {"1"}},
+			want:   map[string]string{"Connection": "", "X-Secret": "", "X-Kept": "1"},
+		},
+		{
+			name:   "connection lists proxy header",
+			header: http.Header{"Connection": {"X-Proxy-By"}},
+			want:   map[string]string{"X-Proxy-By": "proxygo"},
+		},
+		{
+			name:   "standard hop-by-hop",
+			header: http.Header{"Keep-Alive": {"timeout=5"}, "Proxy-Connection": {"keep-alive"}, "Trailer": {"X-Sum"}},
+			want:   map[string]string{"Keep-Alive": "", "Proxy-Connection": "", "Trailer": ""},
+		},
+		{
+			name:   "proxy authorization",
+			header: http.Header{"Proxy-Authorization": {"Basic dXNlcjpwYXNz"}, "Authorization": {"Bearer x"}},
+			want:   map[string]string{"Proxy-Authorization": "", "Authorization": "Bearer x"},
+		},
+		{
+			name:   "transfer encoding",
+			header: http.Header{"Transfer-Encoding": {"gzip"}},
+			want:   map[string]string{"Transfer-Encoding": ""},
+		},
+		{
+			name:   "te trailers",
+			header: http.Header{"Te": {"trailers"}},
+			want:   map[string]string{"Te": "trailers"},
+		},
+		{
+			name:   "te trailers among codings",
+			header: http.Header{"Te": {"gzip, trailers;q=1"}},
+			want:   map[string]string{"Te": "trailers"},
+		},
+		{
+			name:   "te codings",
+			header: http.Header{"Te": {"gzip, deflate"}},
+			want:   map[string]string{"Te": ""},
+		},
+		{
+			name:   "upgrade",
+			header: http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}},
+			want:   map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"},
+		},
+		{
+			name:   "upgrade without connection",
+			header: http.Header{"Upgrade": {"websocket"}},
+			want:   map[string]string{"Upgrade": ""},
+		},
+		{
+			name:   "via appended",
+			header: http.Header{"Via": {"1.0 edge"}},
+			want:   map[string]string{"Via": "1.0 edge, 1.1 proxygo"},
+		},
+		{
+			name: "via added",
+			want: map[string]string{"Via": "1.1 proxygo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan http.Header, 1)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got <- r.Header.Clone()
+			}))
+			defer upstream.Close()
+			h := newTestHandler(t, `{"via": {"enabled": true},
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/api/items", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			header := <-got
+			for name, want := range tt.want {
+				if v := strings.Join(header.Values(name), ", "); v != want {
+					t.Errorf("upstream got %s %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHopByHopResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   map[string]string // header the client receives, "" for none
+	}{
+		{
+			name:   "connection listed",
+			header: http.Header{"Connection": {"X-Backend"}, "X-Backend": {"10.0.0.7"}, "X-Kept": {"1"}},
+			want:   map[string]string{"Connection": "", "X-Backend": "", "X-Kept": "1"},
+		},
+		{
+			name:   "standard hop-by-hop",
+			header: http.Header{"Keep-Alive": {"timeout=5"}, "Proxy-Authenticate": {"Basic"}, "Upgrade": {"h2c"}},
+			want:   map[string]string{"Keep-Alive": "", "Proxy-Authenticate": "", "Upgrade": ""},
+		},
+		{
+			name:   "via appended",
+			header: http.Header{"Via": {"1.1 cache"}},
+			want:   map[string]string{"Via": "1.1 cache, 1.1 proxygo"},
+		},
+		{
+			name: "via added",
+			want: map[string]string{"Via": "1.1 proxygo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				io.WriteString(w, "ok")
+			}))
+			defer upstream.Close()
+			h := newTestHandler(t, `{"via": {"enabled": true},
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/api/items", nil))
+			if w.Code != http.StatusOK || w.Body.String() != "ok" {
+				t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+			}
+			for name, want := range tt.want {
+				if v := strings.Join(w.Header().Values(name), ", "); v != want {
+					t.Errorf("client got %s %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package proxygo
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Listener serves a TLS listener's handler over QUIC
+type http3Listener struct {
+	server *http3.Server
+	pc     net.PacketConn
+}
+
+// newHTTP3Listener binds the UDP side of lc and serves server's handler and TLS config on
+// it. Responses server sends over TCP from then on advertise the QUIC port in Alt-Svc.
+func newHTTP3Listener(lc ListenerConfig, server *http.Server) (*http3Listener, error) {
+	pc, err := listenPacket(ListenerConfig{Name: lc.Name, Network: "udp", Address: lc.Address})
+	if err != nil {
+		return nil, err
+	}
+	h3 := &http3.Server{
+		Handler:   server.Handler,
+		TLSConfig: server.TLSConfig,
+		// 0-RTT requests can be replayed by an attacker, and upstreams could not tell
+		QUICConfig: &quic.Config{},
+		Port:       pc.LocalAddr().(*net.UDPAddr).Port,
+		// Same limits as the TCP side
+		MaxHeaderBytes: server.MaxHeaderBytes,
+		IdleTimeout:    server.IdleTimeout,
+	}
+
+	next := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fails only until the QUIC side is serving, when there is nothing to advertise yet
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+	return &http3Listener{server: h3, pc: pc}, nil
+}
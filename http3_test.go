@@ -0,0 +1,114 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and returns its paths
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	return writeTestCertValid(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// writeTestCertValid is writeTestCert for a certificate valid from notBefore to notAfter
+func writeTestCertValid(t *testing.T, notBefore, notAfter time.Time) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestHTTP3(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	certFile, keyFile := writeTestCert(t)
+	h := newTestHandler(t, fmt.Sprintf(`{
+		"listeners": [{"name": "https", "address": "127.0.0.1:0", "http3": true,
+			"tls": {"cert_file": %q, "key_file": %q}}],
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": %q}]
+	}`, certFile, keyFile, upstream.URL))
+	servers, err := openListeners(h.config.Load(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serveAll(ctx, h, servers) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serveAll: %v", err)
+		}
+	}()
+
+	// A response over TCP advertises the QUIC port, which differs here since both are :0
+	port := servers[0].h3.pc.LocalAddr().(*net.UDPAddr).Port
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	tcp := &http.Client{Transport: &http.Transport{TLSClientConfig: insecure}}
+	resp, err := tcp.Get("https://" + servers[0].ln.Addr().String() + "/api/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("Alt-Svc"), fmt.Sprintf(`h3=":%d"; ma=2592000`, port); got != want {
+		t.Errorf("Alt-Svc = %q, want %q", got, want)
+	}
+
+	quic := &http3.Transport{TLSClientConfig: insecure}
+	defer quic.Close()
+	resp, err = (&http.Client{Transport: quic}).Get(fmt.Sprintf("https://127.0.0.1:%d/api/quic", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// The proxied request reaches the upstream over HTTP/1.1 like any other
+	if resp.Proto != "HTTP/3.0" || resp.StatusCode != http.StatusOK || string(body) != "HTTP/1.1 /quic" {
+		t.Errorf("over HTTP/3: %s %d %q", resp.Proto, resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,195 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Idempotency defaults
+const (
+	defaultIdempotencyTTL     = 24 * time.Hour
+	defaultIdempotencyMaxBody = 1 << 20
+	defaultIdempotencyHeader  = "Idempotency-Key"
+	idempotencySweepInterval  = time.Minute
+)
+
+// IdempotencyConfig replays stored responses for POST and PATCH requests that repeat an Idempotency-Key
+type IdempotencyConfig struct {
+	Enabled bool     `json:"enabled"`
+	Header  string   `json:"header"`   // request header carrying the key, default Idempotency-Key
+	TTL     Duration `json:"ttl"`      // how long responses are kept, default 24h
+	MaxBody ByteSize `json:"max_body"` // largest request and response body handled, default 1MB
+}
+
+// idempotencyRecord is the state of one key
+type idempotencyRecord struct {
+	fingerprint string            // hash of the request body the key was first used with
+	done        chan struct{}     // closed once resp is final
+	resp        *capturedResponse // nil while in flight, or if the response was not stored
+	expires     time.Time
+}
+
+// idempotencyStore keeps the responses of keyed requests in memory
+type idempotencyStore struct {
+	header  string
+	ttl     time.Duration
+	maxBody int64
+
+	mu        sync.Mutex
+	records   map[string]*idempotencyRecord
+	lastSweep time.Time
+
+	results *metricVec
+}
+
+// newIdempotencyStore returns nil when idempotency keys are not honored
+func newIdempotencyStore(cfg *IdempotencyConfig, metrics *metricsRegistry) *idempotencyStore {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	s := &idempotencyStore{
+		header:    cfg.Header,
+		ttl:       time.Duration(cfg.TTL),
+		maxBody:   int64(cfg.MaxBody),
+		records:   make(map[string]*idempotencyRecord),
+		lastSweep: time.Now(),
+		results: metrics.counter("proxygo_idempotent_requests_total",
+			"Requests carrying an idempotency key, by outcome.", "result"),
+	}
+	if s.header == "" {
+		s.header = defaultIdempotencyHeader
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultIdempotencyTTL
+	}
+	if s.maxBody <= 0 {
+		s.maxBody = defaultIdempotencyMaxBody
+	}
+	return s
+}
+
+// idempotencyKey returns the key r carries if it is a request the store applies to
+func (s *idempotencyStore) idempotencyKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		return "", false
+	}
+	key := r.Header.Get(s.header)
+	return key, key != "" && !isGRPCRequest(r)
+}
+
+// acquire returns the record for key, creating it when the key is new. The caller
+// that created it must call finish.
+func (s *idempotencyStore) acquire(key, fingerprint string) (rec *idempotencyRecord, created bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > idempotencySweepInterval {
+		s.sweep(now)
+	}
+
+	if rec, ok := s.records[key]; ok && (rec.expires.IsZero() || now.Before(rec.expires)) {
+		return rec, false
+	}
+	rec = &idempotencyRecord{fingerprint: fingerprint, done: make(chan struct{})}
+	s.records[key] = rec
+	return rec, true
+}
+
+// finish publishes the outcome of the first request; a nil resp forgets the key so it can be retried
+func (s *idempotencyStore) finish(key string, rec *idempotencyRecord, resp *capturedResponse) {
+	s.mu.Lock()
+	if resp == nil {
+		delete(s.records, key)
+	} else {
+		rec.resp = resp
+		rec.expires = time.Now().Add(s.ttl)
+	}
+	s.mu.Unlock()
+	close(rec.done)
+}
+
+// sweep drops expired records; callers hold s.mu
+func (s *idempotencyStore) sweep(now time.Time) {
+	for key, rec := range s.records {
+		if !rec.expires.IsZero() && now.After(rec.expires) {
+			delete(s.records, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// serveIdempotent forwards the first request for an idempotency key and replays its
+// response to repeats. Repeats while the first is in flight, or with a different body,
+// are rejected as the IETF idempotency-key draft describes.
+func (h *ProxyHandler) serveIdempotent(w http.ResponseWriter, r *http.Request, target *proxyTarget, key string) {
+	s := h.idempotency
+
+	// The body is needed up front to tell a retry from a reuse of the key
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.maxBody+1))
+	if err != nil {
+		h.writeError(w, r, target, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if int64(len(body)) > s.maxBody {
+		h.writeError(w, r, target, http.StatusRequestEntityTooLarge, "idempotency_body_too_large", "the request body is too large to be deduplicated")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	bodySum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(bodySum[:])
+
+	// Keys are scoped to the client and the resource, so clients cannot see each other's responses
+	_, info := withRequestInfo(r)
+	scope := sha256.Sum256([]byte(info.ClientID + "\x00" + r.Method + "\x00" + upstreamName(target) + target.Path + "?" + r.URL.RawQuery + "\x00" + key))
+	storeKey := hex.EncodeToString(scope[:])
+
+	rec, created := s.acquire(storeKey, fingerprint)
+	if !created {
+		if rec.fingerprint != fingerprint {
+			s.results.inc("mismatch")
+			h.writeError(w, r, target, http.StatusUnprocessableEntity, "idempotency_key_reused", "the idempotency key was already used with a different request body")
+			return
+		}
+		select {
+		case <-rec.done:
+		default:
+			s.results.inc("conflict")
+			h.writeError(w, r, target, http.StatusConflict, "idempotency_key_in_flight", "a request with this idempotency key is still being processed")
+			return
+		}
+		if rec.resp != nil {
+			s.results.inc("replayed")
+			w.Header().Set("Idempotent-Replayed", "true")
+			rec.resp.writeTo(w)
+			return
+		}
+		// The first attempt's response was not kept; fall through and retry as a new request
+		rec, created = s.acquire(storeKey, fingerprint)
+		if !created {
+			s.results.inc("conflict")
+			h.writeError(w, r, target, http.StatusConflict, "idempotency_key_in_flight", "a request with this idempotency key is still being processed")
+			return
+		}
+	}
+
+	capture := &captureWriter{ResponseWriter: w, limit: s.maxBody}
+	var stored *capturedResponse
+	defer func() { s.finish(storeKey, rec, stored) }()
+
+	h.serveProxy(capture, r, target, false)
+
+	// Server errors, timeouts and throttling are not final, and neither are the proxy's own
+	// errors, such as a download limit: let the client retry them with the same key
+	final := capture.status < http.StatusInternalServerError && capture.status != http.StatusRequestTimeout &&
+		capture.status != http.StatusTooManyRequests && !info.proxyError
+	if r.Context().Err() == nil && capture.shareable() && final {
+		stored = &capturedResponse{status: capture.status, header: capture.header, body: capture.buf.Bytes()}
+		s.results.inc("stored")
+	}
+}
@@ -0,0 +1,165 @@
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentPost sends a POST with an idempotency key from the client at remoteAddr
+func idempotentPost(h http.Handler, remoteAddr, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// newOrderUpstream answers every POST with a new order number, or with status while it is set
+func newOrderUpstream(t *testing.T, status *atomic.Int32, release chan struct{}) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var orders atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if release != nil && string(body) == "slow" {
+			<-release
+		}
+		n := orders.Add(1)
+		if code := status.Load(); code != 0 {
+			w.WriteHeader(int(code))
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		fmt.Fprintf(w, "order %d for %s", n, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &orders
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	var status atomic.Int32
+	upstream, orders := newOrderUpstream(t, &status, nil)
+	h := newTestHandler(t, `{"idempotency": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	first := idempotentPost(h, "192.0.2.1:1000", "k1", "a")
+	if first.Code != http.StatusCreated || first.Body.String() != "order 1 for a" {
+		t.Fatalf("first: %d %q", first.Code, first.Body)
+	}
+
+	// A retry gets the stored response without reaching the upstream
+	again := idempotentPost(h, "192.0.2.1:1001", "k1", "a")
+	if again.Code != http.StatusCreated || again.Body.String() != "order 1 for a" || again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: %d %q replayed %q, want the stored response", again.Code, again.Body, again.Header().Get("Idempotent-Replayed"))
+	}
+
+	// Reusing the key for another body is refused
+	if w := idempotentPost(h, "192.0.2.1:1002", "k1", "b"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("different body: status %d, want 422", w.Code)
+	}
+
+	// Keys belong to their client: another client's identical key is a new request
+	if w := idempotentPost(h, "198.51.100.7:1000", "k1", "a"); w.Code != http.StatusCreated || w.Body.String() != "order 2 for a" {
+		t.Errorf("other client: %d %q, want its own order", w.Code, w.Body)
+	}
+
+	// A new key is a new request
+	if w := idempotentPost(h, "192.0.2.1:1003", "k2", "a"); w.Body.String() != "order 3 for a" {
+		t.Errorf("new key: %q, want a new order", w.Body)
+	}
+	if n := orders.Load(); n != 3 {
+		t.Errorf("%d upstream requests, want 3", n)
+	}
+}
+
+func TestIdempotencyRetryableNotStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  int    // upstream status of the first attempt
+		blocks string // Content-Type of the first attempt, which the route's filter refuses
+		status int    // status the client gets for it
+	}{
+		{name: "server error", first: http.StatusBadGateway, status: http.StatusBadGateway},
+		{name: "throttled", first: http.StatusTooManyRequests, status: http.StatusTooManyRequests},
+		{name: "timeout", first: http.StatusRequestTimeout, status: http.StatusRequestTimeout},
+		{name: "proxy error", blocks: "application/x-msdownload", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var orders atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := orders.Add(1)
+				switch {
+				case n == 1 && tt.blocks != "":
+					w.Header().Set("Content-Type", tt.blocks)
+				case n == 1:
+					w.WriteHeader(tt.first)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, "order %d", n)
+			}))
+			t.Cleanup(upstream.Close)
+			h := newTestHandler(t, `{"idempotency": {"enabled": true},
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`",
+					"content_filter": {"deny_types": ["application/x-msdownload"]}}]}`)
+
+			if w := idempotentPost(h, "192.0.2.1:1000", "k1", "a"); w.Code != tt.status {
+				t.Fatalf("first: status %d, want %d", w.Code, tt.status)
+			}
+
+			// The first answer was not final, so the retry reaches the upstream and its success is kept
+			if w := idempotentPost(h, "192.0.2.1:1000", "k1", "a"); w.Code != http.StatusCreated || w.Body.String() != "order 2" || w.Header().Get("Idempotent-Replayed") != "" {
+				t.Errorf("retry: %d %q, want a fresh order", w.Code, w.Body)
+			}
+			if w := idempotentPost(h, "192.0.2.1:1000", "k1", "a"); w.Body.String() != "order 2" || w.Header().Get("Idempotent-Replayed") != "true" {
+				t.Errorf("retry after success: %q, want the stored order", w.Body)
+			}
+			if n := orders.Load(); n != 2 {
+				t.Errorf("%d upstream requests, want 2", n)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	var status atomic.Int32
+	release := make(chan struct{})
+	upstream, orders := newOrderUpstream(t, &status, release)
+	h := newTestHandler(t, `{"idempotency": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentPost(h, "192.0.2.1:1000", "k1", "slow") }()
+
+	// Wait until the first request holds the key, then repeat it
+	for {
+		h.idempotency.mu.Lock()
+		n := len(h.idempotency.records)
+		h.idempotency.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := idempotentPost(h, "192.0.2.1:1001", "k1", "slow"); w.Code != http.StatusConflict {
+		t.Errorf("repeat in flight: status %d, want 409", w.Code)
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Errorf("first: status %d", w.Code)
+	}
+	if w := idempotentPost(h, "192.0.2.1:1002", "k1", "slow"); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat after completion: %d %q, want a replay", w.Code, w.Body)
+	}
+	if n := orders.Load(); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+}
@@ -0,0 +1,256 @@
+package proxygo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// identityTokenTTL is how long a signed identity header is valid for
+const identityTokenTTL = time.Minute
+
+// IdentityConfig forwards who the client is to upstreams: the fields of its verified
+// client certificate and what auth and API keys established. Headers written here are
+// always removed from the client's request first, so they can only come from the proxy.
+type IdentityConfig struct {
+	Headers      map[string]string `json:"headers"`       // upstream header to identity field, e.g. {"X-Client-Cert-Subject": "cert.subject", "X-Auth-User": "user"}
+	SignedHeader string            `json:"signed_header"` // header carrying every identity field as an HS256 JWT, e.g. "X-Proxygo-Identity"
+	SigningKey   string            `json:"signing_key"`   // HMAC-SHA256 key upstreams verify the signed header with
+	Strip        []string          `json:"strip"`         // further client-supplied headers to remove, e.g. ["X-Forwarded-User"]
+}
+
+// Identity fields a header can carry
+const (
+	identityUser            = "user"             // sub claim of the bearer token or session
+	identityKey             = "key"              // ID of the API key
+	identityTenant          = "tenant"           // tenant the request belongs to
+	identityCertSubject     = "cert.subject"     // distinguished name, e.g. "CN=svc-a,O=Acme"
+	identityCertCommonName  = "cert.common_name" // CN of the subject
+	identityCertIssuer      = "cert.issuer"      // distinguished name of the issuing CA
+	identityCertSerial      = "cert.serial"      // serial number in hex
+	identityCertFingerprint = "cert.fingerprint" // SHA-256 of the DER certificate in hex
+	identityCertSAN         = "cert.san"         // DNS names, email addresses, URIs and IPs, comma-joined
+	identityCertPEM         = "cert.pem"         // URL-escaped PEM of the certificate
+	identityClaimPrefix     = "claim."           // claim.<name> forwards any claim of the token
+)
+
+// identityFields lists the fixed identity fields
+var identityFields = []string{identityUser, identityKey, identityTenant, identityCertSubject, identityCertCommonName,
+	identityCertIssuer, identityCertSerial, identityCertFingerprint, identityCertSAN, identityCertPEM}
+
+// identityForwarder sets the identity headers on requests to upstreams
+type identityForwarder struct {
+	headers      []identityHeader // sorted by header name
+	strip        []string         // every header name clients may not send
+	signedHeader string
+	signingKey   []byte
+}
+
+// identityHeader is one header and the field it carries
+type identityHeader struct {
+	name, field string
+}
+
+// newIdentityForwarder returns nil when identity forwarding is disabled
+func newIdentityForwarder(cfg *IdentityConfig) (*identityForwarder, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	f := &identityForwarder{}
+	for name, field := range cfg.Headers {
+		if name == "" {
+			return nil, errors.New("identity: header names must not be empty")
+		}
+		if !strings.HasPrefix(field, identityClaimPrefix) && !slices.Contains(identityFields, field) {
+			return nil, fmt.Errorf("identity: header %s: unknown field %q: expected one of %s or claim.<name>", name, field, strings.Join(identityFields, ", "))
+		}
+		if field == identityClaimPrefix {
+			return nil, fmt.Errorf("identity: header %s: claim. needs a claim name", name)
+		}
+		f.headers = append(f.headers, identityHeader{name: http.CanonicalHeaderKey(name), field: field})
+	}
+	sort.Slice(f.headers, func(i, j int) bool { return f.headers[i].name < f.headers[j].name })
+
+	if cfg.SignedHeader != "" {
+		if cfg.SigningKey == "" {
+			return nil, errors.New("identity: signed_header needs signing_key")
+		}
+		f.signedHeader = http.CanonicalHeaderKey(cfg.SignedHeader)
+		f.signingKey = []byte(cfg.SigningKey)
+	}
+	if len(f.headers) == 0 && f.signedHeader == "" {
+		return nil, errors.New("identity: set headers or signed_header")
+	}
+
+	for _, h := range f.headers {
+		f.strip = append(f.strip, h.name)
+	}
+	if f.signedHeader != "" {
+		f.strip = append(f.strip, f.signedHeader)
+	}
+	for _, name := range cfg.Strip {
+		f.strip = append(f.strip, http.CanonicalHeaderKey(name))
+	}
+	return f, nil
+}
+
+// requestIdentity is what the proxy established about a request's client
+type requestIdentity struct {
+	claims jwtClaims
+	keyID  string
+	tenant string
+	cert   *x509.Certificate // verified client certificate, nil without mTLS
+}
+
+// field returns the value of an identity field, "" when the request does not have it
+func (id *requestIdentity) field(name string) string {
+	if claim, ok := strings.CutPrefix(name, identityClaimPrefix); ok {
+		value, _ := id.claims.headerValue(claim)
+		return value
+	}
+	switch name {
+	case identityUser:
+		return id.claims.stringClaim("sub")
+	case identityKey:
+		return id.keyID
+	case identityTenant:
+		return id.tenant
+	}
+	if id.cert == nil {
+		return ""
+	}
+	switch name {
+	case identityCertSubject:
+		return id.cert.Subject.String()
+	case identityCertCommonName:
+		return id.cert.Subject.CommonName
+	case identityCertIssuer:
+		return id.cert.Issuer.String()
+	case identityCertSerial:
+		return id.cert.SerialNumber.Text(16)
+	case identityCertFingerprint:
+		sum := sha256.Sum256(id.cert.Raw)
+		return hex.EncodeToString(sum[:])
+	case identityCertSAN:
+		var names []string
+		names = append(names, id.cert.DNSNames...)
+		names = append(names, id.cert.EmailAddresses...)
+		for _, u := range id.cert.URIs {
+			names = append(names, u.String())
+		}
+		for _, ip := range id.cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		return strings.Join(names, ",")
+	case identityCertPEM:
+		return url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.cert.Raw})))
+	}
+	return ""
+}
+
+// anonymous reports whether the proxy knows nothing about the client
+func (id *requestIdentity) anonymous() bool {
+	return id.claims == nil && id.keyID == "" && id.tenant == "" && id.cert == nil
+}
+
+// verifiedClientCert returns the client certificate the TLS handshake verified, if any
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// forward removes client-supplied identity headers from r and sets the proxy's own. It
+// reports whether they tell the upstream who the client is, which makes the response
+// private to the client.
+func (f *identityForwarder) forward(r *http.Request, id *requestIdentity, requestID string) bool {
+	for _, name := range f.strip {
+		r.Header.Del(name)
+	}
+	identified := false
+	for _, h := range f.headers {
+		// Values that would break the header are dropped rather than forwarded
+		if value := id.field(h.field); value != "" && !strings.ContainsAny(value, "\r\n\x00") {
+			r.Header.Set(h.name, value)
+			identified = true
+		}
+	}
+	if f.signedHeader != "" {
+		r.Header.Set(f.signedHeader, f.sign(id, requestID, time.Now()))
+		identified = identified || !id.anonymous()
+	}
+	return identified
+}
+
+// sign returns the identity as an HS256 JWT. It is issued for every request, anonymous
+// ones included, so upstreams can tell an unauthenticated client from a missing header.
+func (f *identityForwarder) sign(id *requestIdentity, requestID string, now time.Time) string {
+	claims := map[string]any{
+		"iss": "proxygo",
+		"iat": now.Unix(),
+		"exp": now.Add(identityTokenTTL).Unix(),
+		"rid": requestID,
+	}
+	if sub := id.field(identityUser); sub != "" {
+		claims["sub"] = sub
+	}
+	for claim, field := range map[string]string{
+		"key":              identityKey,
+		"tenant":           identityTenant,
+		"cert_subject":     identityCertSubject,
+		"cert_issuer":      identityCertIssuer,
+		"cert_serial":      identityCertSerial,
+		"cert_fingerprint": identityCertFingerprint,
+	} {
+		if value := id.field(field); value != "" {
+			claims[claim] = value
+		}
+	}
+	payload, _ := json.Marshal(claims)
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	m := hmac.New(sha256.New, f.signingKey)
+	m.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// clientAuth configures a listener to ask for client certificates signed by the CAs in
+// tc.ClientCAFile; tc without one leaves client certificates off
+func clientAuth(config *tls.Config, tc *TLSConfig) error {
+	if tc.ClientCAFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(tc.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("client_ca_file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("client_ca_file: no certificates in %s", tc.ClientCAFile)
+	}
+	config.ClientCAs = pool
+	switch tc.ClientAuth {
+	case "", "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("unknown client_auth %q: expected require or optional", tc.ClientAuth)
+	}
+	return nil
+}
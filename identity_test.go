@@ -0,0 +1,102 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestIdentityNotShared checks that a response to a request carrying one client's identity
+// headers is never served to another client
+func TestIdentityNotShared(t *testing.T) {
+	keyFile := writeTestKeys(t, &APIKey{ID: "alice", Hash: hashKey("secret-a")}, &APIKey{ID: "bob", Hash: hashKey("secret-b")})
+
+	tests := []struct {
+		name       string
+		config     string // top-level settings besides the keys, identity and route
+		concurrent bool   // send the keyed requests together rather than one after the other
+	}{
+		{name: "cache", config: `"cache": {"enabled": true},`},
+		{name: "coalesce", config: `"coalesce": {"enabled": true},`, concurrent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Coalescing only joins requests in flight together, so hold the first response
+			// until both have arrived
+			var arrived sync.WaitGroup
+			arrived.Add(2)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.concurrent {
+					arrived.Done()
+					waitTimeout(&arrived, time.Second)
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				io.WriteString(w, "key="+r.Header.Get("X-Client-Key"))
+			}))
+			t.Cleanup(upstream.Close)
+
+			h := newTestHandler(t, `{`+tt.config+`
+				"api_keys": {"file": "`+keyFile+`"},
+				"identity": {"headers": {"X-Client-Key": "key"}, "signed_header": "X-Identity", "signing_key": "test"},
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+			proxy := httptest.NewServer(h)
+			t.Cleanup(proxy.Close)
+
+			get := func(secret string) (string, string) {
+				req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/api/items", nil)
+				if secret != "" {
+					req.Header.Set("X-API-Key", secret)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return "", ""
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				return string(body), resp.Header.Get("X-Cache")
+			}
+
+			var wg sync.WaitGroup
+			for _, key := range []string{"alice", "bob"} {
+				wg.Add(1)
+				fetch := func() {
+					defer wg.Done()
+					if body, _ := get("secret-" + key[:1]); body != "key="+key {
+						t.Errorf("%s got %q", key, body)
+					}
+				}
+				if tt.concurrent {
+					go fetch()
+				} else {
+					fetch()
+				}
+			}
+			wg.Wait()
+
+			// Anonymous requests carry no identity, so they are still shared
+			if tt.name == "cache" {
+				get("")
+				if body, cache := get(""); body != "key=" || cache != "HIT" {
+					t.Errorf("second anonymous request: %q, X-Cache %q; want a hit", body, cache)
+				}
+			}
+		})
+	}
+}
+
+// waitTimeout waits for wg, giving up after d
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+	}
+}
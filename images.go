@@ -0,0 +1,282 @@
+package proxygo
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder with image.Decode
+)
+
+// Image pipeline defaults
+const (
+	defaultImageMaxDimension    = 4096
+	defaultImageMaxSourceSize   = 20 << 20
+	defaultImageMaxSourcePixels = 50_000_000
+	defaultImageQuality         = 82
+)
+
+// Query parameters that ask for a derived image; they are never forwarded upstream
+const (
+	imageWidthParam   = "pgw"
+	imageHeightParam  = "pgh"
+	imageQualityParam = "pgq"
+	imageFormatParam  = "pgf"
+)
+
+// ImagesConfig lets clients resize and re-encode proxied images with pgw, pgh, pgq and pgf
+// query parameters. Derived variants are cached like any other response when the cache is enabled.
+type ImagesConfig struct {
+	Enabled         bool     `json:"enabled"`
+	MaxDimension    int      `json:"max_dimension"`     // largest pgw or pgh accepted; default 4096
+	MaxSourceSize   ByteSize `json:"max_source_size"`   // larger upstream images pass through unchanged; default 20MB
+	MaxSourcePixels int      `json:"max_source_pixels"` // images with more pixels pass through unchanged; default 50 million
+	DefaultQuality  int      `json:"default_quality"`   // JPEG quality when pgq is absent; default 82
+}
+
+// imagePipeline is a compiled ImagesConfig
+type imagePipeline struct {
+	maxDimension    int
+	maxSourceSize   int64
+	maxSourcePixels int
+	defaultQuality  int
+	results         *metricVec
+}
+
+// imageOptions is a parsed set of image query parameters
+type imageOptions struct {
+	width, height int    // bounding box; 0 leaves that side unconstrained
+	quality       int    // 0 for the default
+	format        string // "jpeg", "png" or "webp"; "" keeps the source format
+}
+
+// newImagePipeline returns nil when image optimization is disabled
+func newImagePipeline(cfg *ImagesConfig, metrics *metricsRegistry) *imagePipeline {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	p := &imagePipeline{
+		maxDimension:    cfg.MaxDimension,
+		maxSourceSize:   int64(cfg.MaxSourceSize),
+		maxSourcePixels: cfg.MaxSourcePixels,
+		defaultQuality:  cfg.DefaultQuality,
+		results:         metrics.counter("proxygo_image_transforms_total", "Image optimization requests, by result.", "result"),
+	}
+	if p.maxDimension <= 0 {
+		p.maxDimension = defaultImageMaxDimension
+	}
+	if p.maxSourceSize <= 0 {
+		p.maxSourceSize = defaultImageMaxSourceSize
+	}
+	if p.maxSourcePixels <= 0 {
+		p.maxSourcePixels = defaultImageMaxSourcePixels
+	}
+	if p.defaultQuality <= 0 || p.defaultQuality > 100 {
+		p.defaultQuality = defaultImageQuality
+	}
+	return p
+}
+
+// parse reads the image parameters from query; nil means the client asked for none
+func (p *imagePipeline) parse(query url.Values) (*imageOptions, error) {
+	opts := &imageOptions{}
+	found := false
+	dimension := func(name string) (int, error) {
+		v := query.Get(name)
+		if v == "" {
+			return 0, nil
+		}
+		found = true
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > p.maxDimension {
+			return 0, fmt.Errorf("%s must be between 1 and %d", name, p.maxDimension)
+		}
+		return n, nil
+	}
+
+	var err error
+	if opts.width, err = dimension(imageWidthParam); err != nil {
+		return nil, err
+	}
+	if opts.height, err = dimension(imageHeightParam); err != nil {
+		return nil, err
+	}
+	if v := query.Get(imageQualityParam); v != "" {
+		found = true
+		if opts.quality, err = strconv.Atoi(v); err != nil || opts.quality < 1 || opts.quality > 100 {
+			return nil, fmt.Errorf("%s must be between 1 and 100", imageQualityParam)
+		}
+	}
+	if v := strings.ToLower(query.Get(imageFormatParam)); v != "" {
+		found = true
+		switch v {
+		case "jpg", "jpeg":
+			opts.format = "jpeg"
+		case "png", "webp":
+			opts.format = v
+		default:
+			return nil, fmt.Errorf("%s must be jpeg, png or webp", imageFormatParam)
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// stripImageParams removes the image parameters from a raw query, leaving the rest as sent
+func stripImageParams(rawQuery string) string {
+	var kept []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(part, "=")
+		if name, err := url.QueryUnescape(name); err == nil {
+			switch name {
+			case imageWidthParam, imageHeightParam, imageQualityParam, imageFormatParam:
+				continue
+			}
+		}
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// modifyResponse derives the requested variant. Images the pipeline cannot or should
+// not handle are passed through unchanged.
+func (p *imagePipeline) modifyResponse(resp *http.Response, opts *imageOptions) error {
+	if resp.StatusCode != http.StatusOK || !responseHasBody(resp) || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return nil
+	}
+
+	src, err := io.ReadAll(io.LimitReader(resp.Body, p.maxSourceSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(src)) > p.maxSourceSize {
+		p.results.inc("too_large")
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(src), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(src))
+
+	out, contentType, result := p.transform(src, opts)
+	p.results.inc(result)
+	if out == nil {
+		return nil
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	resp.Header.Set("Content-Type", contentType)
+	// Each variant needs its own validator; Last-Modified still describes the source
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		tag := strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+		resp.Header.Set("ETag", fmt.Sprintf(`W/"%s-%s"`, tag, opts.key()))
+	}
+	resp.Header.Del("Accept-Ranges")
+	return nil
+}
+
+// transform decodes, resizes and re-encodes src; out is nil when the source is left as is
+func (p *imagePipeline) transform(src []byte, opts *imageOptions) (out []byte, contentType, result string) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", "failed"
+	}
+	if cfg.Width*cfg.Height > p.maxSourcePixels {
+		return nil, "", "too_large"
+	}
+
+	var img image.Image
+	if format == "gif" {
+		// Re-encoding would keep only the first frame of an animation
+		anim, err := gif.DecodeAll(bytes.NewReader(src))
+		if err != nil {
+			return nil, "", "failed"
+		}
+		if len(anim.Image) > 1 {
+			return nil, "", "animated"
+		}
+		img = anim.Image[0]
+	} else if img, _, err = image.Decode(bytes.NewReader(src)); err != nil {
+		return nil, "", "failed"
+	}
+
+	if w, h := fitWithin(img.Bounds().Dx(), img.Bounds().Dy(), opts.width, opts.height); w != img.Bounds().Dx() || h != img.Bounds().Dy() {
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+		img = dst
+	}
+
+	target := opts.format
+	if target == "" {
+		target = format
+		if target == "gif" {
+			// GIF's 256-colour palette would band a resized image
+			target = "png"
+		}
+	}
+
+	var buf bytes.Buffer
+	switch target {
+	case "jpeg":
+		quality := opts.quality
+		if quality == 0 {
+			quality = p.defaultQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "webp":
+		// The encoder is lossless, so pgq does not apply
+		err = nativewebp.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		return nil, "", "failed"
+	}
+	return buf.Bytes(), "image/" + target, "transformed"
+}
+
+// fitWithin scales w x h down to fit the bounding box, keeping the aspect ratio; images
+// are never enlarged and a zero box side leaves that side unconstrained
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && h > maxH {
+		scale = min(scale, float64(maxH)/float64(h))
+	}
+	if scale == 1 {
+		return w, h
+	}
+	return max(int(float64(w)*scale+0.5), 1), max(int(float64(h)*scale+0.5), 1)
+}
+
+// key names the variant in derived validators
+func (o *imageOptions) key() string {
+	return fmt.Sprintf("w%dh%dq%d%s", o.width, o.height, o.quality, o.format)
+}
@@ -0,0 +1,178 @@
+package proxygo
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFitWithin(t *testing.T) {
+	tests := []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+	}{
+		{w: 400, h: 200, maxW: 100, wantW: 100, wantH: 50},
+		{w: 400, h: 200, maxH: 50, wantW: 100, wantH: 50},
+		{w: 400, h: 200, maxW: 100, maxH: 10, wantW: 20, wantH: 10},
+		{w: 400, h: 200, maxW: 800, maxH: 800, wantW: 400, wantH: 200},
+		{w: 400, h: 200, wantW: 400, wantH: 200},
+		{w: 1000, h: 1, maxW: 10, wantW: 10, wantH: 1},
+	}
+	for _, tt := range tests {
+		if w, h := fitWithin(tt.w, tt.h, tt.maxW, tt.maxH); w != tt.wantW || h != tt.wantH {
+			t.Errorf("fitWithin(%d, %d, %d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.maxW, tt.maxH, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestImageParams(t *testing.T) {
+	p := newImagePipeline(&ImagesConfig{Enabled: true, MaxDimension: 1000}, newMetricsRegistry())
+	tests := []struct {
+		query string
+		want  *imageOptions
+		err   string
+	}{
+		{query: "page=2"},
+		{query: "pgw=800&pgq=75&pgf=webp", want: &imageOptions{width: 800, quality: 75, format: "webp"}},
+		{query: "pgh=10&pgf=JPG", want: &imageOptions{height: 10, format: "jpeg"}},
+		{query: "pgw=1001", err: "pgw must be between 1 and 1000"},
+		{query: "pgh=0", err: "pgh must be between 1 and 1000"},
+		{query: "pgq=101", err: "pgq must be between 1 and 100"},
+		{query: "pgf=bmp", err: "pgf must be jpeg, png or webp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			got, err := p.parse(query)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("parse: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripImageParams(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "pgw=100&page=2&pgf=webp", want: "page=2"},
+		{query: "pg%77=100&q=a%20b", want: "q=a%20b"},
+		{query: "pgw=100&pgh=100&pgq=5&pgf=png", want: ""},
+		{query: "a=1&&b=2", want: "a=1&b=2"},
+	}
+	for _, tt := range tests {
+		if got := stripImageParams(tt.query); got != tt.want {
+			t.Errorf("stripImageParams(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestImagePipeline(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := range 400 {
+		for y := range 200 {
+			source.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, source)
+	frame := image.NewPaletted(image.Rect(0, 0, 40, 20), color.Palette{color.Black, color.White})
+	var animated bytes.Buffer
+	gif.EncodeAll(&animated, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+
+	var seenQuery string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenQuery = r.URL.RawQuery
+		switch r.URL.Path {
+		case "/photo.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(pngData.Bytes())
+		case "/anim.gif":
+			w.Header().Set("Content-Type", "image/gif")
+			w.Write(animated.Bytes())
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("not an image"))
+		}
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"images": {"enabled": true},
+		"routes": [{"name": "img", "prefix": "/img/", "upstream": "`+upstream.URL+`"}]}`)
+
+	tests := []struct {
+		name        string
+		target      string
+		status      int
+		contentType string
+		size        image.Point // of the decoded image; zero when not an image
+		etag        string
+		upstreamQ   string
+		result      string // counted transform result
+	}{
+		{name: "untouched", target: "/img/photo.png?v=1", status: 200, contentType: "image/png", size: image.Pt(400, 200), etag: `"v1"`, upstreamQ: "v=1"},
+		{
+			name: "resized", target: "/img/photo.png?pgw=100&v=1", status: 200, contentType: "image/png", size: image.Pt(100, 50),
+			etag: `W/"v1-w100h0q0"`, upstreamQ: "v=1", result: "transformed",
+		},
+		{
+			name: "jpeg", target: "/img/photo.png?pgh=20&pgf=jpeg&pgq=50", status: 200, contentType: "image/jpeg", size: image.Pt(40, 20),
+			etag: `W/"v1-w0h20q50jpeg"`, result: "transformed",
+		},
+		{name: "webp", target: "/img/photo.png?pgf=webp", status: 200, contentType: "image/webp", size: image.Pt(400, 200), etag: `W/"v1-w0h0q0webp"`, result: "transformed"},
+		{name: "animated gif", target: "/img/anim.gif?pgw=10", status: 200, contentType: "image/gif", size: image.Pt(40, 20), result: "animated"},
+		{name: "not an image", target: "/img/readme.txt?pgw=10", status: 200, contentType: "text/plain"},
+		{name: "invalid", target: "/img/photo.png?pgw=huge", status: http.StatusBadRequest, contentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seenQuery = "unset"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.status || w.Header().Get("Content-Type") != tt.contentType {
+				t.Fatalf("%d %s, want %d %s: %s", w.Code, w.Header().Get("Content-Type"), tt.status, tt.contentType, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if seenQuery != "unset" {
+					t.Errorf("the upstream was asked")
+				}
+				return
+			}
+			if seenQuery != tt.upstreamQ {
+				t.Errorf("upstream query %q, want %q", seenQuery, tt.upstreamQ)
+			}
+			if got := w.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("ETag %q, want %q", got, tt.etag)
+			}
+			if strings.HasPrefix(tt.contentType, "image/") {
+				cfg, _, err := image.DecodeConfig(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := image.Pt(cfg.Width, cfg.Height); got != tt.size {
+					t.Errorf("image %v, want %v", got, tt.size)
+				}
+			}
+			if tt.result != "" && h.images.results.value(tt.result) == 0 {
+				t.Errorf("result %q not counted", tt.result)
+			}
+		})
+	}
+}
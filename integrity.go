@@ -0,0 +1,238 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// contentSHA256Header carries the hex SHA-256 of the response body as sent to the client
+const contentSHA256Header = "X-Proxy-Content-Sha256"
+
+// defaultIntegrityMaxBuffer is the largest body hashed up front; bigger ones get a trailer
+const defaultIntegrityMaxBuffer = 10 << 20
+
+// errIntegrityMismatch is returned when an upstream body does not match its declared digest
+var errIntegrityMismatch = errors.New("upstream body does not match its digest")
+
+// IntegrityConfig enables response hashing and upstream digest verification
+type IntegrityConfig struct {
+	Enabled   bool     `json:"enabled"`
+	MaxBuffer ByteSize `json:"max_buffer"` // bodies up to this size get a header, larger ones a trailer; default 10MB
+	Verify    bool     `json:"verify"`     // check upstream Content-MD5, Digest and Content-Digest headers
+}
+
+// integrityChecker hashes response bodies and verifies upstream digests
+type integrityChecker struct {
+	maxBuffer int64
+	verify    bool
+}
+
+// newIntegrityChecker returns nil when integrity headers are disabled
+func newIntegrityChecker(cfg *IntegrityConfig) *integrityChecker {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	maxBuffer := int64(cfg.MaxBuffer)
+	if maxBuffer <= 0 {
+		maxBuffer = defaultIntegrityMaxBuffer
+	}
+	return &integrityChecker{maxBuffer: maxBuffer, verify: cfg.Verify}
+}
+
+// modifyResponse hashes the body, buffering it when small enough to send the hash as a header
+func (c *integrityChecker) modifyResponse(resp *http.Response) error {
+	if !responseHasBody(resp) {
+		return nil
+	}
+
+	// Digests describe the encoded body; skip verification if the transport decoded it for us
+	var expected map[string][]byte
+	if c.verify && !resp.Uncompressed {
+		var err error
+		if expected, err = expectedDigests(resp.Header, resp.StatusCode == http.StatusPartialContent); err != nil {
+			return err
+		}
+	}
+	d := newBodyDigester(expected)
+
+	// Read one byte past the limit to find out whether the body fits
+	buf, err := io.ReadAll(io.LimitReader(io.TeeReader(resp.Body, d), c.maxBuffer+1))
+	if err != nil {
+		return err
+	}
+
+	if int64(len(buf)) <= c.maxBuffer {
+		resp.Body.Close()
+		if err := d.check(); err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(buf))
+		resp.Header.Set(contentSHA256Header, d.sha256Hex())
+		// Trailers, now read along with the body, can only follow a chunked body
+		if len(resp.Trailer) > 0 {
+			return nil
+		}
+		resp.ContentLength = int64(len(buf))
+		resp.Header.Set("Content-Length", fmt.Sprint(len(buf)))
+		return nil
+	}
+
+	// Too large to hold: stream the rest and attach the hash as a trailer,
+	// which requires a chunked response
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if resp.Trailer == nil {
+		resp.Trailer = http.Header{}
+	}
+	resp.Trailer[contentSHA256Header] = nil
+	resp.Body = &digestingBody{
+		Reader: io.MultiReader(bytes.NewReader(buf), io.TeeReader(resp.Body, d)),
+		body:   resp.Body,
+		d:      d,
+		resp:   resp,
+	}
+	return nil
+}
+
+// responseHasBody reports whether a response can carry a body worth hashing
+func responseHasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	return resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified && resp.Body != nil
+}
+
+// digestingBody finishes hashing a streamed body and publishes the trailer at EOF
+type digestingBody struct {
+	io.Reader
+	body io.Closer
+	d    *bodyDigester
+	resp *http.Response
+	done bool
+}
+
+// Read implements io.Reader; a digest mismatch surfaces as a read error so the client sees a broken response
+func (b *digestingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		if cerr := b.d.check(); cerr != nil {
+			return n, cerr
+		}
+		b.resp.Trailer.Set(contentSHA256Header, b.d.sha256Hex())
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (b *digestingBody) Close() error {
+	return b.body.Close()
+}
+
+// bodyDigester feeds the body into SHA-256 plus whatever the upstream declared
+type bodyDigester struct {
+	sha256   hash.Hash
+	hashes   map[string]hash.Hash
+	expected map[string][]byte
+}
+
+// newBodyDigester prepares hashers for the expected digests
+func newBodyDigester(expected map[string][]byte) *bodyDigester {
+	d := &bodyDigester{sha256: sha256.New(), hashes: map[string]hash.Hash{}, expected: expected}
+	for alg := range expected {
+		if alg == "sha-256" {
+			d.hashes[alg] = d.sha256
+			continue
+		}
+		d.hashes[alg] = newDigestHash(alg)
+	}
+	return d
+}
+
+// Write implements io.Writer
+func (d *bodyDigester) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	for alg, h := range d.hashes {
+		if alg != "sha-256" {
+			h.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// check compares every computed digest against the upstream's declaration
+func (d *bodyDigester) check() error {
+	for alg, want := range d.expected {
+		if !bytes.Equal(d.hashes[alg].Sum(nil), want) {
+			return fmt.Errorf("%w (%s)", errIntegrityMismatch, alg)
+		}
+	}
+	return nil
+}
+
+// sha256Hex returns the body hash for the response header
+func (d *bodyDigester) sha256Hex() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+// newDigestHash returns the hasher for a supported digest algorithm
+func newDigestHash(alg string) hash.Hash {
+	switch alg {
+	case "md5":
+		return md5.New()
+	case "sha-512":
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// expectedDigests collects the digests declared by Content-MD5, Digest (RFC 3230)
+// and Content-Digest (RFC 9530); unknown algorithms are ignored. Digest covers the whole
+// representation, so it cannot be checked against the body of a partial response.
+func expectedDigests(h http.Header, partial bool) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	add := func(alg, b64 string) error {
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		if alg != "md5" && alg != "sha-256" && alg != "sha-512" {
+			return nil
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return fmt.Errorf("%w: malformed %s digest", errIntegrityMismatch, alg)
+		}
+		out[alg] = sum
+		return nil
+	}
+
+	if v := h.Get("Content-MD5"); v != "" {
+		if err := add("md5", v); err != nil {
+			return nil, err
+		}
+	}
+	for _, part := range strings.Split(h.Get("Digest"), ",") {
+		if alg, value, ok := strings.Cut(part, "="); ok && !partial {
+			if err := add(alg, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, part := range strings.Split(h.Get("Content-Digest"), ",") {
+		// Structured field byte sequences are wrapped in colons: sha-256=:base64:
+		if alg, value, ok := strings.Cut(part, "="); ok {
+			if err := add(alg, strings.Trim(strings.TrimSpace(value), ":")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
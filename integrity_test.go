@@ -0,0 +1,118 @@
+package proxygo
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIntegrity(t *testing.T) {
+	const body = "the quick brown fox"
+	sha := sha256.Sum256([]byte(body))
+	sha512sum := sha512.Sum512([]byte(body))
+	md5sum := md5.Sum([]byte(body))
+	b64 := base64.StdEncoding.EncodeToString
+	wrong := b64(make([]byte, 32))
+
+	tests := []struct {
+		name      string
+		maxBuffer ByteSize
+		status    int
+		header    http.Header
+		trailer   bool // the hash follows the body rather than preceding it
+		err       bool // from modifyResponse, for buffered bodies, or reading, for streamed ones
+	}{
+		{name: "buffered", maxBuffer: 1 << 10},
+		{name: "streamed", maxBuffer: 8, trailer: true},
+		{name: "exact fit", maxBuffer: ByteSize(len(body))},
+		{name: "content-md5", maxBuffer: 1 << 10, header: http.Header{"Content-Md5": {b64(md5sum[:])}}},
+		{name: "digest", maxBuffer: 1 << 10, header: http.Header{"Digest": {"SHA-256=" + b64(sha[:]) + ", unixsum=30637"}}},
+		{name: "content-digest", maxBuffer: 1 << 10, header: http.Header{"Content-Digest": {"sha-512=:" + b64(sha512sum[:]) + ":"}}},
+		{name: "buffered mismatch", maxBuffer: 1 << 10, header: http.Header{"Content-Digest": {"sha-256=:" + wrong + ":"}}, err: true},
+		{name: "streamed mismatch", maxBuffer: 8, header: http.Header{"Content-Md5": {b64(make([]byte, 16))}}, trailer: true, err: true},
+		{name: "malformed", maxBuffer: 1 << 10, header: http.Header{"Digest": {"sha-256=%%%"}}, err: true},
+		{name: "partial ignores digest", maxBuffer: 1 << 10, status: http.StatusPartialContent, header: http.Header{"Digest": {"sha-256=" + wrong}}},
+		{name: "partial checks content-digest", maxBuffer: 1 << 10, status: http.StatusPartialContent, header: http.Header{"Content-Digest": {"sha-256=:" + wrong + ":"}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newIntegrityChecker(&IntegrityConfig{Enabled: true, MaxBuffer: tt.maxBuffer, Verify: true})
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			header := tt.header.Clone()
+			if header == nil {
+				header = http.Header{}
+			}
+			resp := &http.Response{
+				StatusCode:    status,
+				Header:        header,
+				Body:          io.NopCloser(strings.NewReader(body)),
+				ContentLength: -1,
+				Request:       &http.Request{Method: http.MethodGet},
+			}
+			err := c.modifyResponse(resp)
+			if !tt.trailer {
+				if (err != nil) != tt.err || (err != nil && !errors.Is(err, errIntegrityMismatch)) {
+					t.Fatalf("modifyResponse: %v, want error %v", err, tt.err)
+				}
+				if err != nil {
+					return
+				}
+				if got := resp.Header.Get(contentSHA256Header); got != hex.EncodeToString(sha[:]) {
+					t.Errorf("header %q, want the body's hash", got)
+				}
+				if resp.ContentLength != int64(len(body)) {
+					t.Errorf("length %d, want %d", resp.ContentLength, len(body))
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := io.ReadAll(resp.Body)
+			if tt.trailer && tt.err {
+				if !errors.Is(err, errIntegrityMismatch) {
+					t.Fatalf("reading a mismatched body: %v", err)
+				}
+				return
+			}
+			if err != nil || string(got) != body {
+				t.Fatalf("body %q, %v", got, err)
+			}
+			if tt.trailer {
+				if _, announced := resp.Trailer[contentSHA256Header]; !announced || resp.ContentLength != -1 {
+					t.Errorf("trailer not announced on a chunked response")
+				}
+				if got := resp.Trailer.Get(contentSHA256Header); got != hex.EncodeToString(sha[:]) {
+					t.Errorf("trailer %q, want the body's hash", got)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegrityNoBody(t *testing.T) {
+	c := newIntegrityChecker(&IntegrityConfig{Enabled: true})
+	tests := []struct {
+		method string
+		status int
+	}{
+		{http.MethodHead, http.StatusOK},
+		{http.MethodGet, http.StatusNoContent},
+		{http.MethodGet, http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}, Body: http.NoBody, Request: &http.Request{Method: tt.method}}
+		if err := c.modifyResponse(resp); err != nil || resp.Header.Get(contentSHA256Header) != "" {
+			t.Errorf("%s %d: hashed, %v", tt.method, tt.status, err)
+		}
+	}
+}
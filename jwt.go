@@ -0,0 +1,430 @@
+package proxygo
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched signing keys are trusted before refetching
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefetch rate-limits refetches triggered by tokens with unknown key IDs
+	jwksMinRefetch = time.Minute
+	// maxJWKSSize bounds a JWKS or discovery document
+	maxJWKSSize = 1 << 20
+)
+
+var (
+	// errUnknownKey means no fetched key matches the token's key ID
+	errUnknownKey = errors.New("no signing key matches the token")
+	// errKeysUnavailable means the key set could not be fetched, so no token can be checked
+	errKeysUnavailable = errors.New("signing keys unavailable")
+)
+
+// jwtClaims is a decoded token payload
+type jwtClaims map[string]any
+
+// jwtHeader is the part of the JOSE header used to pick the verification key
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwkSet caches the signing keys published at a JWKS URL
+type jwkSet struct {
+	client *http.Client
+	// locate returns the JWKS URL, which OIDC learns from discovery
+	locate func(ctx context.Context) (string, error)
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // by kid
+	fetchedAt time.Time                   // start of the last fetch, successful or not
+	fetchErr  error                       // outcome of the last fetch
+	fetching  *fetchCall                  // the fetch in flight, if any
+}
+
+// fetchCall is a download in flight that concurrent callers wait for instead of
+// starting their own
+type fetchCall struct {
+	done chan struct{} // closed once err is set
+	err  error
+}
+
+// wait blocks until c finishes or ctx is done
+func (c *fetchCall) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jwk is one JSON Web Key; only the public members are read
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the public key for kid, fetching the set when it is stale or lacks kid.
+// Keys already fetched are served without waiting on a fetch in flight.
+func (s *jwkSet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	k := s.lookupLocked(kid)
+	fresh := time.Since(s.fetchedAt) <= jwksRefreshInterval
+	s.mu.Unlock()
+	if k != nil && fresh {
+		return k, nil
+	}
+
+	age := jwksRefreshInterval
+	if k == nil {
+		// The issuer may have rotated keys since the last fetch
+		age = jwksMinRefetch
+	}
+	err := s.fetch(ctx, age)
+	// A failed refresh keeps the previous keys in use
+	if k := s.lookup(kid); k != nil {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errKeysUnavailable, err)
+	}
+	return nil, errUnknownKey
+}
+
+// lookup finds kid in the keys fetched so far
+func (s *jwkSet) lookup(kid string) crypto.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookupLocked(kid)
+}
+
+// fetch refreshes the set unless the last fetch started within age, in which case it
+// returns that fetch's error. Concurrent callers share one download, which runs without
+// s.mu held.
+func (s *jwkSet) fetch(ctx context.Context, age time.Duration) error {
+	s.mu.Lock()
+	if call := s.fetching; call != nil {
+		s.mu.Unlock()
+		return call.wait(ctx)
+	}
+	if time.Since(s.fetchedAt) <= age {
+		defer s.mu.Unlock()
+		return s.fetchErr
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	s.fetching = call
+	// Failed attempts also count, so an unreachable issuer is not hammered
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+
+	// The download is shared, so the caller that started it going away must not fail
+	// it for the others; the client's timeout still bounds it
+	keys, err := s.download(context.WithoutCancel(ctx))
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys = keys
+	}
+	s.fetchErr = err
+	s.fetching = nil
+	s.mu.Unlock()
+	call.err = err
+	close(call.done)
+	return call.wait(ctx)
+}
+
+// lookupLocked finds kid, accepting a token without kid when the set has one key
+func (s *jwkSet) lookupLocked(kid string) crypto.PublicKey {
+	if k, ok := s.keys[kid]; ok {
+		return k
+	}
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k
+		}
+	}
+	return nil
+}
+
+// download fetches and parses the key set
+func (s *jwkSet) download(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL, err := s.locate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := fetchJSON(ctx, s.client, jwksURL, &doc); err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Key types this proxy cannot verify with are skipped rather than fatal
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks at %s has no usable signing keys", jwksURL)
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key material
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+		}
+		return pub, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifyJWT checks the signature of a compact JWS and returns its claims.
+// Registered claims such as exp and aud are left to the caller.
+func verifyJWT(ctx context.Context, token string, keys *jwkSet) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	key, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	return claims, nil
+}
+
+// verifySignature checks sig over signed with key for alg; "none" and any algorithm
+// that does not fit the key type are rejected
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	mismatch := fmt.Errorf("token algorithm %q does not match the signing key", alg)
+	// Every supported algorithm name has five characters, e.g. RS256 or EdDSA
+	if len(alg) != 5 {
+		return mismatch
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+
+	invalid := errors.New("invalid token signature")
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if hash == 0 {
+			break
+		}
+		h := hash.New()
+		h.Write(signed)
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig) != nil {
+				return invalid
+			}
+			return nil
+		case "PS":
+			if rsa.VerifyPSS(pub, hash, h.Sum(nil), sig, nil) != nil {
+				return invalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// ES512 uses P-521; the curve must match the algorithm
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		want := map[string]int{"ES256": 32, "ES384": 48, "ES512": 66}[alg]
+		if want == 0 || want != size {
+			break
+		}
+		if len(sig) != 2*size {
+			return invalid
+		}
+		h := hash.New()
+		h.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return invalid
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(pub, signed, sig) {
+			return invalid
+		}
+		return nil
+	}
+	return mismatch
+}
+
+// fetchJSON GETs url and decodes the JSON body into v
+func fetchJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(v)
+}
+
+// timeClaim reads a NumericDate claim
+func (c jwtClaims) timeClaim(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// stringClaim reads a string claim
+func (c jwtClaims) stringClaim(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// audiences reads aud, which may be a single string or an array
+func (c jwtClaims) audiences() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		out := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// headerValue renders a claim for an upstream request header; values that would
+// break the header, such as ones containing newlines, are refused
+func (c jwtClaims) headerValue(name string) (string, bool) {
+	value, ok := c.renderClaim(name)
+	if !ok || strings.ContainsAny(value, "\r\n\x00") {
+		return "", false
+	}
+	return value, true
+}
+
+// renderClaim formats a claim as text: strings as is, arrays comma-joined, the rest as JSON
+func (c jwtClaims) renderClaim(name string) (string, bool) {
+	switch v := c[name].(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				parts = append(parts, s)
+			} else {
+				b, _ := json.Marshal(item)
+				parts = append(parts, string(b))
+			}
+		}
+		return strings.Join(parts, ","), true
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err == nil
+	}
+}
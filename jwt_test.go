@@ -0,0 +1,387 @@
+package proxygo
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is an identity provider publishing an RSA, a P-256 and an Ed25519 key under
+// the kids "rsa", "ec" and "ed", with OIDC discovery and a token endpoint
+type testIssuer struct {
+	*httptest.Server
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+
+	mu        sync.Mutex
+	extra     []jwk         // published after the three keys
+	hold      chan struct{} // when set, JWKS responses wait for it to close
+	idToken   string        // what the token endpoint returns
+	jwksHits  atomic.Int32
+	tokenHits atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{}
+	var err error
+	if iss.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if iss.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, iss.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			AuthorizationEndpoint: iss.URL + "/authorize",
+			TokenEndpoint:         iss.URL + "/token",
+			JWKSURI:               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.jwksHits.Add(1)
+		iss.mu.Lock()
+		hold, keys := iss.hold, append(iss.jwks(), iss.extra...)
+		iss.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		iss.tokenHits.Add(1)
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": iss.idToken})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// jwks returns the public halves of the three keys
+func (iss *testIssuer) jwks() []jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	return []jwk{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(iss.rsa.N.Bytes()), E: b64(big.NewInt(int64(iss.rsa.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(iss.ec.X.FillBytes(make([]byte, 32))), Y: b64(iss.ec.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64(iss.ed.Public().(ed25519.PublicKey))},
+	}
+}
+
+// sign builds a token with alg and kid in its header, signed with the key named by key;
+// "hmac" signs HS256 with the RSA public modulus as the secret and "" leaves the signature empty
+func (iss *testIssuer) sign(t *testing.T, alg, kid, key string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch key {
+	case "rsa":
+		sig, err = rsa.SignPKCS1v15(nil, iss.rsa, crypto.SHA256, digest[:])
+	case "pss":
+		sig, err = rsa.SignPSS(rand.Reader, iss.rsa, crypto.SHA256, digest[:], nil)
+	case "ec":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, iss.ec, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "ed":
+		sig = ed25519.Sign(iss.ed, []byte(signed))
+	case "hmac":
+		mac := hmac.New(sha256.New, iss.rsa.N.Bytes())
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claims returns valid claims for iss, audience "api", with changes applied
+func (iss *testIssuer) claims(changes map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss": iss.URL,
+		"sub": "user-1",
+		"aud": "api",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+// newTestAuthenticator accepts tokens from iss for the audience "api"
+func newTestAuthenticator(t *testing.T, iss *testIssuer) *authenticator {
+	t.Helper()
+	a, err := newAuthenticator(&AuthConfig{
+		JWKSURL:  iss.URL + "/jwks",
+		Issuer:   iss.URL,
+		Audience: []string{"api"},
+		Leeway:   Duration(30 * time.Second),
+	}, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestJWTValidate(t *testing.T) {
+	iss := newTestIssuer(t)
+	a := newTestAuthenticator(t, iss)
+	now := time.Now()
+
+	tests := []struct {
+		name           string
+		alg, kid, key  string
+		claims         map[string]any // changes to the valid claims
+		want           string         // error substring, "" when the token is accepted
+		wantUnknownKey bool
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa", key: "rsa"},
+		{name: "PS256", alg: "PS256", kid: "rsa", key: "pss"},
+		{name: "ES256", alg: "ES256", kid: "ec", key: "ec"},
+		{name: "EdDSA", alg: "EdDSA", kid: "ed", key: "ed"},
+
+		// The key decides which algorithms are possible, not the token
+		{name: "none", alg: "none", kid: "rsa", want: `algorithm "none" does not match`},
+		{name: "none without kid", alg: "none", want: "no signing key"},
+		{name: "HS256 with the RSA key as secret", alg: "HS256", kid: "rsa", key: "hmac", want: `algorithm "HS256" does not match`},
+		{name: "ES256 on the RSA key", alg: "ES256", kid: "rsa", key: "ec", want: `algorithm "ES256" does not match`},
+		{name: "RS256 on the EC key", alg: "RS256", kid: "ec", key: "rsa", want: `algorithm "RS256" does not match`},
+		{name: "EdDSA on the EC key", alg: "EdDSA", kid: "ec", key: "ed", want: `algorithm "EdDSA" does not match`},
+		{name: "ES384 on a P-256 key", alg: "ES384", kid: "ec", key: "ec", want: `algorithm "ES384" does not match`},
+		{name: "PSS signature under RS256", alg: "RS256", kid: "rsa", key: "pss", want: "invalid token signature"},
+		{name: "bad signature", alg: "ES256", kid: "ec", key: "ed", want: "invalid token signature"},
+		{name: "unknown kid", alg: "RS256", kid: "other", key: "rsa", wantUnknownKey: true},
+
+		{name: "no expiry", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"exp": nil}, want: "no expiry"},
+		{name: "expired", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"exp": now.Add(-time.Minute).Unix()}, want: "token expired"},
+		{name: "expired within leeway", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"exp": now.Add(-10 * time.Second).Unix()}},
+		{name: "not yet valid", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"nbf": now.Add(time.Minute).Unix()}, want: "not yet valid"},
+		{name: "not yet valid within leeway", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"nbf": now.Add(10 * time.Second).Unix()}},
+
+		{name: "other issuer", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"iss": "https://evil.test"}, want: "issuer not accepted"},
+		{name: "no issuer", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"iss": nil}, want: "issuer not accepted"},
+		{name: "issuer with trailing slash", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"iss": iss.URL + "/"}},
+		{name: "other audience", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"aud": "billing"}, want: "audience not accepted"},
+		{name: "no audience", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"aud": nil}, want: "audience not accepted"},
+		{name: "audience list", alg: "RS256", kid: "rsa", key: "rsa", claims: map[string]any{"aud": []string{"billing", "api"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := iss.sign(t, tt.alg, tt.kid, tt.key, iss.claims(tt.claims))
+			claims, err := a.validate(context.Background(), token, a.audience)
+			switch {
+			case tt.wantUnknownKey:
+				if !errors.Is(err, errUnknownKey) {
+					t.Errorf("err = %v, want %v", err, errUnknownKey)
+				}
+			case tt.want == "":
+				if err != nil || claims.stringClaim("sub") != "user-1" {
+					t.Errorf("claims %v, err %v; want the token accepted", claims, err)
+				}
+			case err == nil || !strings.Contains(err.Error(), tt.want):
+				t.Errorf("err = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWKSRefetch(t *testing.T) {
+	iss := newTestIssuer(t)
+	a := newTestAuthenticator(t, iss)
+	validate := func(kid string) error {
+		_, err := a.validate(context.Background(), iss.sign(t, "RS256", kid, "rsa", iss.claims(nil)), a.audience)
+		return err
+	}
+	if err := validate("rsa"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown kids refetch the set at most once per jwksMinRefetch
+	for range 5 {
+		if err := validate("rotated"); !errors.Is(err, errUnknownKey) {
+			t.Fatalf("err = %v, want %v", err, errUnknownKey)
+		}
+	}
+	if n := iss.jwksHits.Load(); n != 1 {
+		t.Errorf("%d JWKS fetches, want 1 within jwksMinRefetch", n)
+	}
+
+	// Once the window has passed, a rotated key is picked up
+	iss.mu.Lock()
+	rotated := iss.jwks()[0]
+	rotated.Kid = "rotated"
+	iss.extra = []jwk{rotated}
+	iss.mu.Unlock()
+	a.keys.mu.Lock()
+	a.keys.fetchedAt = time.Now().Add(-jwksMinRefetch - time.Second)
+	a.keys.mu.Unlock()
+	if err := validate("rotated"); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if n := iss.jwksHits.Load(); n != 2 {
+		t.Errorf("%d JWKS fetches, want 2", n)
+	}
+}
+
+func TestJWKSFetchShared(t *testing.T) {
+	iss := newTestIssuer(t)
+	a := newTestAuthenticator(t, iss)
+	hold := make(chan struct{})
+	iss.mu.Lock()
+	iss.hold = hold
+	iss.mu.Unlock()
+
+	// Callers arriving while the first fetch is in flight wait for it instead of fetching
+	token := iss.sign(t, "RS256", "rsa", "rsa", iss.claims(nil))
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.validate(context.Background(), token, a.audience)
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(hold)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := iss.jwksHits.Load(); n != 1 {
+		t.Errorf("%d JWKS fetches for concurrent callers, want 1", n)
+	}
+
+	// A fetch for an unknown kid must not hold up tokens signed with a known key
+	hold = make(chan struct{})
+	defer close(hold)
+	iss.mu.Lock()
+	iss.hold = hold
+	iss.mu.Unlock()
+	a.keys.mu.Lock()
+	a.keys.fetchedAt = time.Now().Add(-jwksMinRefetch - time.Second)
+	a.keys.mu.Unlock()
+	go a.validate(context.Background(), iss.sign(t, "RS256", "rotated", "rsa", iss.claims(nil)), a.audience)
+	for iss.jwksHits.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.validate(context.Background(), token, a.audience)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("known key waited on the JWKS fetch in flight")
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	iss := newTestIssuer(t)
+	h := newTestHandler(t, `{"auth": {"issuer": "`+iss.URL+`",
+		"oidc": {"client_id": "proxy", "redirect_url": "http://proxy.test/_auth/callback"}},
+		"routes": [{"name": "app", "prefix": "/", "upstream": "http://127.0.0.1:1"}]}`)
+	returnTo := base64.RawURLEncoding.EncodeToString([]byte("/app?tab=1"))
+
+	tests := []struct {
+		name   string
+		cookie string // state cookie value, none when empty
+		query  string
+		nonce  string // nonce claim of the ID token the issuer hands out
+		status int
+	}{
+		{name: "no state cookie", query: "state=abc&code=c", nonce: "abc", status: http.StatusBadRequest},
+		{name: "no state parameter", cookie: "abc." + returnTo, query: "code=c", nonce: "abc", status: http.StatusBadRequest},
+		{name: "state mismatch", cookie: "abc." + returnTo, query: "state=abd&code=c", nonce: "abc", status: http.StatusBadRequest},
+		{name: "state from another login", cookie: "abc." + returnTo, query: "state=xyz&code=c", nonce: "xyz", status: http.StatusBadRequest},
+		{name: "nonce mismatch", cookie: "abc." + returnTo, query: "state=abc&code=c", nonce: "xyz", status: http.StatusUnauthorized},
+		{name: "matching state", cookie: "abc." + returnTo, query: "state=abc&code=c", nonce: "abc", status: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss.mu.Lock()
+			iss.idToken = iss.sign(t, "RS256", "rsa", "rsa", iss.claims(map[string]any{"aud": "proxy", "nonce": tt.nonce}))
+			iss.mu.Unlock()
+			exchanges := iss.tokenHits.Load()
+
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.test/_auth/callback?"+tt.query, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			session := ""
+			for _, c := range w.Result().Cookies() {
+				if c.Name == defaultSessionCookie {
+					session = c.Value
+				}
+			}
+			if tt.status != http.StatusFound {
+				if session != "" {
+					t.Error("failed login set a session cookie")
+				}
+				// A bad state is refused before the code is spent at the issuer
+				if tt.status == http.StatusBadRequest && iss.tokenHits.Load() != exchanges {
+					t.Error("code exchanged despite the state mismatch")
+				}
+				return
+			}
+			if session == "" {
+				t.Error("no session cookie")
+			}
+			if loc, _ := url.Parse(w.Header().Get("Location")); loc == nil || loc.String() != "/app?tab=1" {
+				t.Errorf("Location = %q, want /app?tab=1", w.Header().Get("Location"))
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Kubernetes defaults
+const (
+	defaultWatchInterval = 5 * time.Second
+	defaultDrainDelay    = 5 * time.Second
+)
+
+// KubernetesConfig tunes proxygo for running in a pod. The config file and certificates
+// are usually ConfigMap and Secret volumes, which the kubelet updates by swapping a
+// symlink; they are polled by content, so the swap is picked up like any other change.
+type KubernetesConfig struct {
+	WatchInterval   Duration `json:"watch_interval"`    // how often the config file and certificates are checked; default 5s
+	DrainDelay      Duration `json:"drain_delay"`       // on SIGTERM /readyz fails this long before listeners stop, so the pod leaves its Services first; default 5s
+	RestartOnChange bool     `json:"restart_on_change"` // drain and exit on config changes a reload cannot apply, so the kubelet restarts the container with them
+}
+
+// watchInterval returns how often mounted files are checked
+func (c *KubernetesConfig) watchInterval() time.Duration {
+	if c.WatchInterval > 0 {
+		return time.Duration(c.WatchInterval)
+	}
+	return defaultWatchInterval
+}
+
+// drainDelay returns how long readiness fails before shutdown
+func (c *KubernetesConfig) drainDelay() time.Duration {
+	if c.DrainDelay > 0 {
+		return time.Duration(c.DrainDelay)
+	}
+	return defaultDrainDelay
+}
+
+// fileDigest returns the SHA-256 of the file at path, following symlinks, or nil when
+// it cannot be read, as happens briefly while a volume is updated
+func fileDigest(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// watchMounted applies changes to the config file and certificates until ctx is done.
+// restart is called for config changes only a restart can apply, when the config asks for it.
+func watchMounted(ctx context.Context, handler *ProxyHandler, configPath string, interval time.Duration, restart func()) {
+	digests := make(map[string][]byte)
+	snapshot := func() (configChanged, certsChanged bool) {
+		if configPath != "" {
+			if d := fileDigest(configPath); d != nil && !bytes.Equal(d, digests[configPath]) {
+				configChanged = digests[configPath] != nil
+				digests[configPath] = d
+			}
+		}
+		for _, p := range handler.keyPairs() {
+			for _, path := range []string{p.certFile, p.keyFile} {
+				if d := fileDigest(path); d != nil && !bytes.Equal(d, digests[path]) {
+					certsChanged = certsChanged || digests[path] != nil
+					digests[path] = d
+				}
+			}
+		}
+		return configChanged, certsChanged
+	}
+	snapshot()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		configChanged, certsChanged := snapshot()
+		if configChanged {
+			previous := handler.config.Load()
+			cfg, err := LoadConfig(configPath)
+			if err == nil && cfg.Kubernetes != nil && cfg.Kubernetes.RestartOnChange && !reloadable(previous, cfg) {
+				handler.logger.Printf("Config change in %s needs a restart; draining", configPath)
+				handler.audit(nil, auditEvent{Event: auditConfigReload, Reason: "restarting", Details: map[string]string{"file": configPath, "trigger": "watch"}})
+				restart()
+				return
+			}
+			reloadConfig(handler, configPath, "watch")
+		} else if certsChanged {
+			handler.reloadCertificates()
+			handler.logger.Printf("Certificates reloaded")
+		}
+	}
+}
+
+// reloadable reports whether a reload applies every difference between old and new:
+// outside the sections Reload updates, the two configs must be identical
+func reloadable(old, new *Config) bool {
+	strip := func(c *Config) []byte {
+		c2 := *c
+		c2.Bandwidth, c2.Downloads, c2.Pool, c2.Targets, c2.Tenants, c2.Schedules = nil, nil, nil, nil, nil, nil
+		data, _ := json.Marshal(&c2)
+		return data
+	}
+	return bytes.Equal(strip(old), strip(new))
+}
+
+// delayShutdown returns a context cancelled delay after parent is, failing readiness and
+// turning off keep-alives in between so load balancers move clients elsewhere first
+func delayShutdown(parent context.Context, handler *ProxyHandler, servers []*listenerServer, delay time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		<-parent.Done()
+		handler.draining.Store(true)
+		for _, s := range servers {
+			s.server.SetKeepAlivesEnabled(false)
+		}
+		handler.logger.Printf("Draining: failing readiness for %s before shutting down", delay)
+		time.Sleep(delay)
+	}()
+	return ctx
+}
@@ -0,0 +1,165 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadable(t *testing.T) {
+	base := func() *Config {
+		return &Config{Routes: []RouteConfig{{Name: "api", Prefix: "/api/", Upstream: "http://api.internal"}}}
+	}
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   bool
+	}{
+		{name: "unchanged", change: func(*Config) {}, want: true},
+		{name: "targets", change: func(c *Config) { c.Targets = &TargetsConfig{DefaultScheme: "http"} }, want: true},
+		{name: "pool", change: func(c *Config) { c.Pool = &PoolConfig{MaxIdleConnsPerHost: 8} }, want: true},
+		{name: "schedules", change: func(c *Config) { c.Schedules = []ScheduleConfig{{Name: "nightly"}} }, want: true},
+		{name: "routes", change: func(c *Config) { c.Routes[0].Upstream = "http://api-v2.internal" }},
+		{name: "kubernetes", change: func(c *Config) { c.Kubernetes = &KubernetesConfig{RestartOnChange: true} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := base()
+			tt.change(changed)
+			if got := reloadable(base(), changed); got != tt.want {
+				t.Errorf("reloadable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// replaceFile swaps the file at path for a copy of from, as a volume update does
+func replaceFile(t *testing.T, path, from string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchMounted(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	const routes = `"routes": [{"name": "api", "prefix": "/api/", "upstream": "http://api.internal"}]`
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"kubernetes": {"restart_on_change": true}, ` + routes + `}`)
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, `{`+routes+`}`)
+	h.config.Store(cfg)
+	certFile, keyFile := writeTestCert(t)
+	pair, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.listenerCerts = []*keyPair{pair}
+
+	var restarts atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchMounted(ctx, h, configPath, 10*time.Millisecond, func() { restarts.Add(1) })
+	}()
+	// Let the watch take its first snapshot before anything changes
+	time.Sleep(50 * time.Millisecond)
+
+	// A renewed certificate is presented without touching the config
+	before := pair.get()
+	renewedCert, renewedKey := writeTestCertValid(t, time.Now().Add(-time.Minute), time.Now().Add(2*time.Hour))
+	replaceFile(t, keyFile, renewedKey)
+	replaceFile(t, certFile, renewedCert)
+	waitUntil(t, "the renewed certificate", func() bool {
+		return !bytes.Equal(pair.get().Certificate[0], before.Certificate[0])
+	})
+
+	// A change a reload applies is reloaded
+	writeConfig(`{"kubernetes": {"restart_on_change": true}, "targets": {"aliases": {"gh": "https://api.github.com"}}, ` + routes + `}`)
+	waitUntil(t, "the reloaded config", func() bool { return h.config.Load().Targets != nil })
+	if restarts.Load() != 0 {
+		t.Fatal("restarted for a reloadable change")
+	}
+
+	// Anything else restarts the container and stops watching
+	writeConfig(`{"kubernetes": {"restart_on_change": true}, "targets": {"aliases": {"gh": "https://api.github.com"}},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "http://api-v2.internal"}]}`)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop for a restart")
+	}
+	if restarts.Load() != 1 {
+		t.Errorf("%d restarts, want 1", restarts.Load())
+	}
+	if got := h.config.Load().Routes[0].Upstream; got != "http://api.internal" {
+		t.Errorf("route upstream reloaded to %s", got)
+	}
+}
+
+func TestDelayShutdown(t *testing.T) {
+	h := newTestHandler(t, `{}`)
+	servers := []*listenerServer{{server: &http.Server{}}}
+	parent, stop := context.WithCancel(context.Background())
+	ctx := delayShutdown(parent, h, servers, 50*time.Millisecond)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("shutdown started before the signal")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if h.draining.Load() {
+		t.Fatal("draining before the signal")
+	}
+
+	stop()
+	start := time.Now()
+	waitUntil(t, "draining", h.draining.Load)
+	<-ctx.Done()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("shutdown started %s after the signal, want the 50ms drain delay", elapsed)
+	}
+}
+
+func TestKubernetesDefaults(t *testing.T) {
+	tests := []struct {
+		cfg   KubernetesConfig
+		watch time.Duration
+		drain time.Duration
+	}{
+		{watch: defaultWatchInterval, drain: defaultDrainDelay},
+		{cfg: KubernetesConfig{WatchInterval: Duration(time.Second), DrainDelay: Duration(30 * time.Second)}, watch: time.Second, drain: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.watchInterval(); got != tt.watch {
+			t.Errorf("watchInterval = %s, want %s", got, tt.watch)
+		}
+		if got := tt.cfg.drainDelay(); got != tt.drain {
+			t.Errorf("drainDelay = %s, want %s", got, tt.drain)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultLogMaxSize is the rotation size of log files that do not set one
+const defaultLogMaxSize = 100 << 20
+
+// LoggingConfig routes each log category to one or more sinks
+type LoggingConfig struct {
+	Access []LogSinkConfig `json:"access"` // access-log middleware lines; default: the error sinks
+	Error  []LogSinkConfig `json:"error"`  // operational messages; default: stderr
+	Audit  []LogSinkConfig `json:"audit"`  // audit records, in addition to the audit section's file and syslog
+	Diff   []LogSinkConfig `json:"diff"`   // response diff records as JSON lines; default: the error log
+
+	// BodySample adds the start of request and response bodies to access log lines
+	BodySample *BodySampleConfig `json:"body_sample,omitempty"`
+}
+
+// LogSinkConfig is one log destination
+type LogSinkConfig struct {
+	Type       string   `json:"type"`        // "stdout", "stderr", "file" or "syslog"
+	Path       string   `json:"path"`        // log file, for "file"
+	Address    string   `json:"address"`     // for "syslog": "local" (default), or udp://host:514 / tcp://host:514
+	MaxSize    ByteSize `json:"max_size"`    // rotate the file past this size, default 100MB
+	MaxAge     Duration `json:"max_age"`     // remove rotated files older than this; 0 keeps them
+	MaxBackups int      `json:"max_backups"` // rotated files kept; 0 keeps all
+	Compress   bool     `json:"compress"`    // gzip rotated files
+}
+
+// openLogSink opens one destination; security selects the syslog auth facility
+func openLogSink(cfg LogSinkConfig, security bool) (io.WriteCloser, error) {
+	switch cfg.Type {
+	case "stdout":
+		return nopWriteCloser{os.Stdout}, nil
+	case "stderr":
+		return nopWriteCloser{os.Stderr}, nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file log sink: missing path")
+		}
+		maxSize := int64(cfg.MaxSize)
+		if maxSize <= 0 {
+			maxSize = defaultLogMaxSize
+		}
+		return openRotatingFile(cfg.Path, maxSize, cfg.MaxBackups, time.Duration(cfg.MaxAge), cfg.Compress)
+	case "syslog":
+		address := cfg.Address
+		if address == "" {
+			address = "local"
+		}
+		return dialSyslog(address, security)
+	}
+	return nil, fmt.Errorf("unknown log sink type %q: expected stdout, stderr, file or syslog", cfg.Type)
+}
+
+// openLogSinks opens every sink of a category, closing the opened ones on failure
+func openLogSinks(category string, configs []LogSinkConfig, security bool) ([]io.WriteCloser, error) {
+	var sinks []io.WriteCloser
+	for _, sc := range configs {
+		sink, err := openLogSink(sc, security)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return nil, fmt.Errorf("logging.%s: %w", category, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// newProxyLogger creates a logger in the proxy's format writing to every sink
+func newProxyLogger(sinks []io.WriteCloser) *log.Logger {
+	writers := make([]io.Writer, len(sinks))
+	for i, s := range sinks {
+		writers[i] = s
+	}
+	return log.New(io.MultiWriter(writers...), "[PROXY] ", log.LstdFlags)
+}
+
+// nopWriteCloser keeps the standard streams open when the sinks are closed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,127 @@
+package proxygo
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenLogSink(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		cfg  LogSinkConfig
+		err  string
+	}{
+		{name: "stdout", cfg: LogSinkConfig{Type: "stdout"}},
+		{name: "stderr", cfg: LogSinkConfig{Type: "stderr"}},
+		{name: "file", cfg: LogSinkConfig{Type: "file", Path: filepath.Join(dir, "logs", "access.log")}},
+		{name: "file without path", cfg: LogSinkConfig{Type: "file"}, err: "file log sink: missing path"},
+		{name: "unknown", cfg: LogSinkConfig{Type: "kafka"}, err: `unknown log sink type "kafka"`},
+		{name: "bad syslog address", cfg: LogSinkConfig{Type: "syslog", Address: "syslog.example.com:514"}, err: "syslog"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := openLogSink(tt.cfg, false)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// A failing sink closes the ones opened before it, and names the category
+	_, err := openLogSinks("access", []LogSinkConfig{{Type: "stdout"}, {Type: "kafka"}}, false)
+	if err == nil || !strings.HasPrefix(err.Error(), "logging.access: ") {
+		t.Errorf("error %v, want it to name logging.access", err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		compress   bool
+		backups    []string // contents of the rotated files, oldest first
+	}{
+		{name: "keep all", backups: []string{"line 1\n", "line 2\n", "line 3\n"}},
+		{name: "keep one", maxBackups: 1, backups: []string{"line 3\n"}},
+		{name: "compressed", maxBackups: 2, compress: true, backups: []string{"line 2\n", "line 3\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.log")
+			f, err := openRotatingFile(path, 10, tt.maxBackups, 0, tt.compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for i := 1; i <= 4; i++ {
+				if _, err := f.Write([]byte("line " + string(rune('0'+i)) + "\n")); err != nil {
+					t.Fatal(err)
+				}
+				// Backups are named by the millisecond
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			if data, _ := os.ReadFile(path); string(data) != "line 4\n" {
+				t.Errorf("current file %q, want the last line", data)
+			}
+			var got []string
+			waitUntil(t, "backups to be milled", func() bool {
+				f.mill.Lock()
+				defer f.mill.Unlock()
+				got = readBackups(t, path, tt.compress)
+				return len(got) == len(tt.backups)
+			})
+			if strings.Join(got, "") != strings.Join(tt.backups, "") {
+				t.Errorf("backups %q, want %q", got, tt.backups)
+			}
+		})
+	}
+}
+
+// readBackups returns the contents of path's rotated files, oldest first
+func readBackups(t *testing.T, path string, compressed bool) []string {
+	t.Helper()
+	pattern := path + ".*"
+	if compressed {
+		pattern += ".gz"
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, name := range matches {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if compressed {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := io.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, string(data))
+	}
+	return out
+}
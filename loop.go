@@ -0,0 +1,166 @@
+package proxygo
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// defaultMaxProxyHops is how many proxygo hops a request may already have passed
+const defaultMaxProxyHops = 5
+
+// LoopDetectionConfig tunes the 508 Loop Detected check, which is always on
+type LoopDetectionConfig struct {
+	MaxHops int `json:"max_hops"` // proxygo hops recorded in X-Proxy-By or Via before a request is refused; default 5
+}
+
+// loopDetector recognizes requests that would come back to this proxy
+type loopDetector struct {
+	maxHops   int
+	pseudonym string // Via received-by name of proxygo instances
+
+	listeners []loopListener
+	sockets   []string // unix listener paths
+	localIPs  []net.IP // addresses of this host, matched against wildcard listeners
+	hostname  string
+}
+
+// loopListener is a TCP address this process accepts connections on
+type loopListener struct {
+	host string // IP literal or name; "" for the wildcard address
+	port string
+}
+
+// newLoopDetector records the proxy's own listeners so targets pointing at them can be refused
+func newLoopDetector(cfg *Config) *loopDetector {
+	d := &loopDetector{maxHops: defaultMaxProxyHops, pseudonym: defaultViaPseudonym}
+	if cfg.LoopDetection != nil && cfg.LoopDetection.MaxHops > 0 {
+		d.maxHops = cfg.LoopDetection.MaxHops
+	}
+	if cfg.Via != nil && cfg.Via.Pseudonym != "" {
+		d.pseudonym = cfg.Via.Pseudonym
+	}
+
+	listeners := cfg.Listeners
+	if cfg.Admin != nil {
+		listeners = append(slices.Clip(listeners), ListenerConfig{Network: "tcp", Address: cfg.Admin.Address})
+	}
+	for _, lc := range listeners {
+		if lc.Network == "unix" {
+			d.sockets = append(d.sockets, lc.Address)
+			continue
+		}
+		host, port, err := net.SplitHostPort(lc.Address)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			host = ""
+		}
+		d.listeners = append(d.listeners, loopListener{host: strings.ToLower(host), port: port})
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				d.localIPs = append(d.localIPs, ipNet.IP)
+			}
+		}
+	}
+	d.hostname, _ = os.Hostname()
+	d.hostname = strings.ToLower(d.hostname)
+	return d
+}
+
+// targetsSelf reports whether target is one of this proxy's own listeners
+func (d *loopDetector) targetsSelf(target *proxyTarget) bool {
+	if target.Socket != "" {
+		return slices.Contains(d.sockets, target.Socket)
+	}
+
+	host := strings.ToLower(target.URL.Hostname())
+	host, _, _ = strings.Cut(host, "%") // zone identifiers do not change the address
+	port := target.URL.Port()
+	if port == "" {
+		port = "80"
+		if target.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	for _, l := range d.listeners {
+		if l.port != port {
+			continue
+		}
+		switch {
+		case l.host == "":
+			if d.isLocal(host) {
+				return true
+			}
+		case l.host == host:
+			return true
+		case isLoopbackHost(l.host) && isLoopbackHost(host):
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal reports whether host names this machine
+func (d *loopDetector) isLocal(host string) bool {
+	if isLoopbackHost(host) || (d.hostname != "" && host == d.hostname) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsUnspecified() || slices.ContainsFunc(d.localIPs, ip.Equal)
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback address
+func isLoopbackHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hops counts the proxygo instances a request has already passed. Each hop adds an
+// X-Proxy-By entry and, with Via enabled, a Via entry; the larger count wins.
+func (d *loopDetector) hops(h http.Header) int {
+	proxyBy := 0
+	for _, value := range h.Values("X-Proxy-By") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.TrimSpace(name) == "proxygo" {
+				proxyBy++
+			}
+		}
+	}
+
+	via := 0
+	for _, value := range h.Values("Via") {
+		for _, entry := range strings.Split(value, ",") {
+			// received-protocol received-by [comment]
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && fields[1] == d.pseudonym {
+				via++
+			}
+		}
+	}
+	return max(proxyBy, via)
+}
+
+// check returns why r must be refused as a loop, or "" when it may proceed
+func (d *loopDetector) check(r *http.Request, target *proxyTarget) string {
+	if d.targetsSelf(target) {
+		return "Target is this proxy"
+	}
+	if d.hops(r.Header) >= d.maxHops {
+		return "Request has passed through too many proxies"
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+package proxygo
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLoopTargetsSelf(t *testing.T) {
+	d := newLoopDetector(&Config{
+		Listeners: []ListenerConfig{
+			{Address: ":8080"},
+			{Address: "0.0.0.0:443"},
+			{Address: "127.0.0.1:8081"},
+			{Address: "[::1]:8082"},
+			{Address: "Proxy.Internal:8083"},
+			{Network: "unix", Address: "/run/proxygo.sock"},
+		},
+		Admin: &AdminConfig{Address: "127.0.0.1:9901"},
+	})
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		target string // URL, or unix: and a socket path
+		self   bool
+	}{
+		// A wildcard listener is reached through any address of this host
+		{"http://localhost:8080", true},
+		{"http://127.0.0.1:8080", true},
+		{"http://[::1]:8080", true},
+		{"http://0.0.0.0:8080", true},
+		{"http://[fe80::1%25lo]:8080", false},
+		{"http://api.localhost:8080", true},
+		{"http://" + strings.ToUpper(hostname) + ":8080", hostname != ""},
+		{"http://192.0.2.1:8080", false},
+		{"http://example.com:8080", false},
+		{"https://localhost", true},
+		{"http://localhost", false},
+		{"http://localhost:443", true},
+
+		// Loopback names and addresses all reach a loopback listener
+		{"http://localhost:8081", true},
+		{"http://127.0.0.2:8081", true},
+		{"http://[::1]:8081", true},
+		{"http://example.com:8081", false},
+		{"http://localhost:8082", true},
+		{"http://proxy.internal:8083", true},
+		{"http://127.0.0.1:8083", false},
+		{"http://127.0.0.1:8084", false},
+
+		// The admin listener counts as the proxy too
+		{"http://localhost:9901", true},
+
+		{"unix:/run/proxygo.sock", true},
+		{"unix:/run/other.sock", false},
+	}
+	for _, tt := range tests {
+		target := &proxyTarget{}
+		if socket, ok := strings.CutPrefix(tt.target, "unix:"); ok {
+			target.URL, target.Socket = &url.URL{Scheme: "http", Host: "localhost"}, socket
+		} else {
+			u, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target.URL = u
+		}
+		if got := d.targetsSelf(target); got != tt.self {
+			t.Errorf("%s: targetsSelf = %v, want %v", tt.target, got, tt.self)
+		}
+	}
+}
+
+func TestLoopHops(t *testing.T) {
+	d := newLoopDetector(&Config{Via: &ViaConfig{Pseudonym: "edge"}})
+	tests := []struct {
+		header http.Header
+		hops   int
+	}{
+		{http.Header{}, 0},
+		{http.Header{"X-Proxy-By": {"proxygo"}}, 1},
+		{http.Header{"X-Proxy-By": {"proxygo, other", "proxygo"}}, 2},
+		{http.Header{"X-Proxy-By": {"proxygo-fork, Proxygo"}}, 0},
+		{http.Header{"Via": {"1.1 edge, 1.1 cdn (Varnish), HTTP/2 edge"}}, 2},
+		{http.Header{"Via": {"1.1 proxygo"}}, 0},
+		// Each hop adds to both headers, so the larger count wins rather than the sum
+		{http.Header{"X-Proxy-By": {"proxygo"}, "Via": {"1.1 edge, 1.1 edge"}}, 2},
+		{http.Header{"X-Proxy-By": {"proxygo, proxygo, proxygo"}, "Via": {"1.1 edge"}}, 3},
+	}
+	for _, tt := range tests {
+		if got := d.hops(tt.header); got != tt.hops {
+			t.Errorf("%v: hops = %d, want %d", tt.header, got, tt.hops)
+		}
+	}
+}
+
+// TestLoopDetected checks that a route back to the proxy's own port is cut off once it
+// has passed max_hops times
+func TestLoopDetected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The detector does not know this listener, so only the hop count can stop the loop
+	h := newTestHandler(t, `{"loop_detection": {"max_hops": 3},
+		"routes": [{"name": "again", "prefix": "/", "upstream": "http://`+ln.Addr().String()+`"}]}`)
+	var passes atomic.Int32
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passes.Add(1)
+		h.ServeHTTP(w, r)
+	}))
+	proxy.Listener.Close()
+	proxy.Listener = ln
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	resp, err := http.Get(proxy.URL + "/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusLoopDetected)
+	}
+	// The client's request and two forwarded ones; the fourth pass sees three hops
+	if n := passes.Load(); n != 4 {
+		t.Errorf("%d passes through the proxy, want 4", n)
+	}
+}
+
+// TestLoopSelfTarget checks that requests aimed at a listener are refused before they
+// reach any upstream, whether the target comes from the path, a route or a script
+func TestLoopSelfTarget(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := newTestHandler(t, `{
+		"listeners": [{"name": "http", "address": ":18080"}, {"name": "local", "network": "unix", "address": "/tmp/proxygo-loop-test.sock"}],
+		"admin": {"address": "127.0.0.1:19901"},
+		"routes": [
+			{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"},
+			{"name": "self", "prefix": "/self/", "upstream": "http://localhost:18080"},
+			{"name": "socket", "prefix": "/socket/", "socket": "/tmp/proxygo-loop-test.sock"}
+		],
+		"unix_sockets": ["/tmp/proxygo-loop-test.sock"],
+		"scripts": [{"rules": [
+			{"when": "header('X-To') == 'listener'", "upstream": "'http://127.0.0.2:18080'"},
+			{"when": "header('X-To') == 'admin'", "upstream": "'http://localhost:19901'"}
+		]}]
+	}`)
+
+	tests := []struct {
+		name   string
+		path   string
+		to     string // X-To header picking a script override
+		status int
+	}{
+		{name: "route", path: "/api/items", status: http.StatusOK},
+		{name: "route to own listener", path: "/self/items", status: http.StatusLoopDetected},
+		{name: "route to own socket", path: "/socket/items", status: http.StatusLoopDetected},
+		{name: "unix target", path: "/unix:/tmp/proxygo-loop-test.sock/items", status: http.StatusLoopDetected},
+		{name: "embedded target", path: "/http://127.0.0.1:18080/items", status: http.StatusLoopDetected},
+		{name: "embedded admin target", path: "/http://127.0.0.1:19901/metrics", status: http.StatusLoopDetected},
+		{name: "script to own listener", path: "/api/items", to: "listener", status: http.StatusLoopDetected},
+		{name: "script to admin listener", path: "/api/items", to: "admin", status: http.StatusLoopDetected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits.Store(0)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.to != "" {
+				req.Header.Set("X-To", tt.to)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			want := int32(0)
+			if tt.status == http.StatusOK {
+				want = 1
+			}
+			if rec.Code != tt.status || hits.Load() != want {
+				t.Errorf("status %d with %d upstream requests, want %d with %d", rec.Code, hits.Load(), tt.status, want)
+			}
+		})
+	}
+}
@@ -1,141 +1,1201 @@
-package main
+package proxygo
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-const (
-	serverPort = ":8080"
-	serverAddr = "localhost" + serverPort
-)
+const serverPort = ":8080"
 
 // ProxyHandler handles HTTP proxy requests
 type ProxyHandler struct {
-	logger *log.Logger
+	logger      *log.Logger
+	accessLog   *log.Logger
+	bodySample  *bodySampler // nil unless access log lines carry body samples
+	logSinks    []io.WriteCloser
+	router      *router
+	vhosts      *vhostTable                   // nil without virtual hosts
+	pac         *pacFile                      // nil unless the auto-config file is served
+	schedules   atomic.Pointer[scheduleTable] // nil without schedules; replaced on reload
+	scripts     atomic.Pointer[scriptSet]     // nil without scripts; replaced on reload
+	targets     *targetTable
+	unixSockets []string
+	transports  *transportPool
+	geo         *geoIP
+	bandwidth   *bandwidthLimiter
+	downloads   *downloadLimiter
+	diffs       *diffRecorder
+	cluster     *clusterState // nil when the instance runs alone
+	dryRunToken string        // admin token that turns a request into a dry run; empty when dry runs are off
+	filter      *contentFilter
+	waf         *waf
+	rewrite     *bodyRewriter
+	images      *imagePipeline
+	security    *securityHeaders
+	via         *viaHeader
+	loops       *loopDetector
+	errorPages  *errorRenderer
+	keys        *keyStore
+	tenants     *tenantTable
+	auth        *authenticator
+	identity    *identityForwarder
+	signer      *urlSigner
+	usage       *usageTracker
+	integrity   *integrityChecker
+	coalescer   *coalescer
+	idempotency *idempotencyStore
+	cache       *responseCache
+	prewarmJobs []prewarmJob
+	auditLog    *auditLog
+	notifier    *notifier              // nil unless webhooks are configured
+	slos        *sloTracker            // nil unless SLOs are configured
+	uploads     *uploadTracker         // nil unless uploads are tracked
+	secrets     *secretStore           // nil without secrets
+	maintenance *maintenanceMode       // switched through the admin API
+	traffic     *trafficFeed           // nil unless the dashboard is enabled
+	config      atomic.Pointer[Config] // active config, shown on the dashboard
+	configPath  string                 // file the config was loaded from, "" for defaults
+	hooks       responseHooks          // embedder response hooks
+
+	requestExtensions []RequestExtension // compiled-in extensions, in registration order
+	errorExtensions   []ErrorExtension
+	extensionClosers  []io.Closer
+
+	proxy     *httputil.ReverseProxy // shared by every request; see serveProxy
+	grpcProxy *httputil.ReverseProxy // the same, flushing each gRPC message
+	buffers   *proxyBufferPool
+
+	listenerCerts []*keyPair  // certificates of the TLS listeners, reloaded with the config
+	draining      atomic.Bool // set on shutdown so readiness fails while traffic drains
+
+	metrics       *metricsRegistry
+	keyRejects    *metricVec
+	tenantRejects *metricVec
+	validations   *metricVec
+	schemaReloads *metricVec
+	connReuse     *metricVec
+	warmupDials   *metricVec
+	hedges        *metricVec
+	queueEvents   *metricVec
+
+	streams     []*streamProxy // raw TCP and UDP forwarders, set by openStreams
+	streamConns *metricVec
+
+	scheduleRejects *metricVec
+	streamBytes     *metricVec
+
+	maintenanceResponses *metricVec
+	scriptActions        *metricVec
+	proxyErrors          *metricVec
+	splitResponses       *metricVec
+	clientAborts         *metricVec
+	upstreamErrors       *metricVec
+
+	queuesMu sync.Mutex
+	queues   map[string]*writeQueue // write queues by directory, opened on first use
+}
+
+// proxyTarget describes where a single request is forwarded to
+type proxyTarget struct {
+	URL    *url.URL // scheme and host of the upstream
+	Path   string   // path to request on the upstream
+	Socket string   // unix socket to dial instead of URL.Host
+	Route  *Route   // matched route, nil for path-embedded targets
 }
 
 // NewProxyHandler creates a new proxy handler
-func NewProxyHandler() *ProxyHandler {
-	return &ProxyHandler{
-		logger: log.New(log.Writer(), "[PROXY] ", log.LstdFlags),
+func NewProxyHandler(cfg *Config) (*ProxyHandler, error) {
+	rt, err := newRouter(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	vhosts, err := newVhostTable(cfg.VirtualHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	pac, err := newPACFile(cfg.PAC, cfg.VirtualHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := newScheduleTable(cfg.Schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	errorPages, err := newErrorRenderer(cfg.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance, err := newMaintenanceMode(cfg.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := newTargetTable(cfg.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrite, err := newBodyRewriter(cfg.BodyRewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	security, err := newSecurityHeaders(cfg.SecurityHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	geo, err := openGeoIP(cfg.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialControl func(network, address string, c syscall.RawConn) error
+	if geo != nil {
+		dialControl = geo.dialControl
+	}
+
+	keys, err := openKeyStore(cfg.APIKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := openTenantTable(cfg.Tenants)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := newURLSigner(cfg.SignedURLs)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := openUsageTracker(cfg.Usage)
+	if err != nil {
+		return nil, err
+	}
+
+	logging := cfg.Logging
+	if logging == nil {
+		logging = &LoggingConfig{}
+	}
+	auditLog, err := openAuditLog(cfg.Audit, logging.Audit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without explicit sinks the error log keeps going to stderr and access lines follow it
+	errorSinks, err := openLogSinks("error", logging.Error, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(errorSinks) == 0 {
+		errorSinks = []io.WriteCloser{nopWriteCloser{log.Writer()}}
+	}
+	logger := newProxyLogger(errorSinks)
+	accessLog := logger
+	accessSinks, err := openLogSinks("access", logging.Access, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(accessSinks) > 0 {
+		accessLog = newProxyLogger(accessSinks)
+	}
+	bodySample, err := newBodySampler(logging.BodySample)
+	if err != nil {
+		return nil, err
+	}
+	diffSinks, err := openLogSinks("diff", logging.Diff, false)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHandler{
+		logger:      logger,
+		accessLog:   accessLog,
+		bodySample:  bodySample,
+		logSinks:    slices.Concat(errorSinks, accessSinks, diffSinks),
+		router:      rt,
+		vhosts:      vhosts,
+		pac:         pac,
+		targets:     targets,
+		unixSockets: cfg.UnixSockets,
+		transports:  newTransportPool(dialControl, cfg.Pool),
+		geo:         geo,
+		bandwidth:   newBandwidthLimiter(cfg.Bandwidth),
+		filter:      newContentFilter(cfg.ContentFilter),
+		rewrite:     rewrite,
+		security:    security,
+		via:         newViaHeader(cfg.Via),
+		loops:       newLoopDetector(cfg),
+		errorPages:  errorPages,
+		maintenance: maintenance,
+		keys:        keys,
+		tenants:     tenants,
+		signer:      signer,
+		usage:       usage,
+		integrity:   newIntegrityChecker(cfg.Integrity),
+		auditLog:    auditLog,
+		metrics:     newMetricsRegistry(),
+	}
+	h.config.Store(cfg)
+	if cfg.Admin != nil && cfg.Admin.Dashboard {
+		h.traffic = newTrafficFeed()
+	}
+	if cfg.Admin != nil && cfg.Admin.DryRun {
+		h.dryRunToken = cfg.Admin.Token
+	}
+	h.registerMetrics()
+	h.transports.ftp = newFTPTransport(cfg.FTP, h.transports.dialer)
+	if h.transports.files, err = newFileTransport(cfg.Files); err != nil {
+		return nil, err
+	}
+	if h.transports.stores, err = newObjectStores(cfg.ObjectStorage); err != nil {
+		return nil, err
+	}
+	if h.waf, err = newWAF(cfg.WAF, h.metrics); err != nil {
+		return nil, err
+	}
+	if h.auth, err = newAuthenticator(cfg.Auth, h.metrics); err != nil {
+		return nil, err
+	}
+	if h.identity, err = newIdentityForwarder(cfg.Identity); err != nil {
+		return nil, err
+	}
+	h.downloads = newDownloadLimiter(cfg.Downloads, h.metrics)
+	h.diffs = newDiffRecorder(diffSinks, h.metrics)
+	h.coalescer = newCoalescer(cfg.Coalesce, h.metrics)
+	h.idempotency = newIdempotencyStore(cfg.Idempotency, h.metrics)
+	h.images = newImagePipeline(cfg.Images, h.metrics)
+	if h.cache, err = newResponseCache(cfg.Cache, h.metrics); err != nil {
+		return nil, err
+	}
+	if h.cluster, err = newClusterState(cfg.Cluster, h.logger, h.metrics); err != nil {
+		return nil, err
+	}
+	if h.notifier, err = newNotifier(cfg.Notifications, cfg.Admin, h.logger, h.metrics); err != nil {
+		return nil, err
+	}
+	if h.cluster != nil {
+		if h.keys != nil {
+			h.keys.cluster = h.cluster
+		}
+		if h.tenants != nil {
+			h.tenants.cluster = h.cluster
+		}
+		if h.cache != nil {
+			h.cluster.on(clusterCachePurge, func(data json.RawMessage) {
+				var p cachePurge
+				if len(data) > 0 && json.Unmarshal(data, &p) != nil {
+					return
+				}
+				h.logger.Printf("Cluster: purged %d cache entries", h.cache.purge(p))
+			})
+		}
+	}
+	if h.cache != nil {
+		if h.prewarmJobs, err = compilePrewarm(cfg.Cache.Prewarm); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Maintenance != nil {
+		for _, name := range cfg.Maintenance.Routes {
+			if !slices.ContainsFunc(h.allRoutes(), func(route *Route) bool { return route.Name == name }) {
+				return nil, fmt.Errorf("maintenance: unknown route %q", name)
+			}
+		}
+	}
+	h.schedules.Store(schedules)
+	scripts, err := newScriptSet(cfg.Scripts, h.allRoutes())
+	if err != nil {
+		return nil, err
+	}
+	h.scripts.Store(scripts)
+	h.updateSampleRedaction()
+	if h.slos, err = newSLOTracker(cfg.SLOs, h.allRoutes(), h.metrics); err != nil {
+		return nil, err
+	}
+	if h.uploads, err = newUploadTracker(cfg.Uploads, h.logger, h.traffic, h.metrics); err != nil {
+		return nil, err
+	}
+	if h.secrets, err = newSecretStore(cfg.Secrets, h.logger, h.metrics); err != nil {
+		return nil, err
+	}
+	if err := h.secrets.checkRefs(h.allRoutes()); err != nil {
+		return nil, err
 	}
+	if h.secrets != nil {
+		if err := h.secrets.load(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	h.buffers = newProxyBufferPool(cfg.Pool)
+	h.proxy = h.newSharedProxy(false)
+	h.grpcProxy = h.newSharedProxy(true)
+	if err := h.startExtensions(cfg.Extensions); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
-// parseTargetURL extracts the target URL and remaining path from the request
-func (h *ProxyHandler) parseTargetURL(requestPath string) (targetURL *url.URL, remainingPath string, err error) {
-	// Remove leading slash: /https://example.com/api/foo -> https://example.com/api/foo
-	cleanPath := strings.TrimPrefix(requestPath, "/")
+// registerMetrics declares the metric families exported on the admin listener
+func (h *ProxyHandler) registerMetrics() {
+	h.keyRejects = h.metrics.counter("proxygo_apikey_rejections_total", "Requests rejected by API key checks.", "reason")
+	h.tenantRejects = h.metrics.counter("proxygo_tenant_rejections_total", "Requests rejected by tenant checks.", "tenant", "reason")
+	h.validations = h.metrics.counter("proxygo_request_validations_total", "Request bodies checked against route schemas, by result.", "route", "result")
+	h.schemaReloads = h.metrics.counter("proxygo_schema_reloads_total", "Route schema file reloads, by outcome.", "route", "result")
+	h.connReuse = h.metrics.counter("proxygo_upstream_requests_total", "Routed upstream requests by whether they reused a warm connection or dialed a cold one.", "route", "connection")
+	h.hedges = h.metrics.counter("proxygo_hedged_requests_total", "Duplicate requests sent to slow upstreams, by outcome.", "route", "outcome")
+	h.warmupDials = h.metrics.counter("proxygo_warmup_dials_total", "Upstream connections opened ahead of traffic by route warmup.", "route")
+	h.queueEvents = h.metrics.counter("proxygo_queue_requests_total", "Write requests queued during upstream outages, by route and event.", "route", "event")
+	h.clientAborts = h.metrics.counter("proxygo_client_aborts_total", "Requests the client abandoned, waiting for the upstream or while the body streamed, by route.", "route", "stage")
+	h.upstreamErrors = h.metrics.counter("proxygo_upstream_errors_total", "Upstream requests that failed before answering or broke off mid-body, by route.", "route", "stage")
+	h.proxyErrors = h.metrics.counter("proxygo_proxy_errors_total", "Error responses produced by the proxy itself, by route and error kind.", "route", "kind")
+	h.scriptActions = h.metrics.counter("proxygo_script_actions_total", "Script actions taken on requests by script and action (upstream, headers, reject or error).", "script", "action")
+	h.maintenanceResponses = h.metrics.counter("proxygo_maintenance_responses_total", "Requests answered with the maintenance response instead of an upstream, by route.", "route")
+	h.splitResponses = h.metrics.counter("proxygo_split_responses_total", "Responses of split routes, by variant and status class.", "route", "variant", "class")
+	h.scheduleRejects = h.metrics.counter("proxygo_schedule_rejections_total", "Requests refused by scheduled windows, by schedule and reason.", "schedule", "reason")
+	h.streamConns = h.metrics.counter("proxygo_stream_connections_total", "Connections and UDP clients of raw stream listeners, by outcome.", "stream", "result")
+	h.streamBytes = h.metrics.counter("proxygo_stream_bytes_total", "Bytes forwarded by raw stream listeners, in from clients and out to them.", "stream", "direction")
+	h.metrics.gaugeFunc("proxygo_stream_active_connections", "Open connections and UDP clients of each raw stream listener.", []string{"stream"}, h.streamSamples)
+	h.metrics.gaugeFunc("proxygo_queue_depth", "Write requests waiting to be replayed, by queue directory.", []string{"dir"}, h.queueSamples)
+	h.metrics.gaugeFunc("proxygo_upstream_connections", "Upstream connections by host and state.", []string{"host", "state"},
+		h.transports.stats.samples)
+	h.metrics.counterFunc("proxygo_upstream_tls_handshakes_total", "Upstream TLS handshakes by host and result (full, resumed or failed).", []string{"host", "result"},
+		h.transports.tls.handshakeSamples)
+	h.metrics.counterFunc("proxygo_upstream_tls_handshake_seconds_total", "Time spent in successful upstream TLS handshakes by host.", []string{"host"},
+		h.transports.tls.secondsSamples)
+	h.metrics.gaugeFunc("proxygo_upstream_tls_resumption_ratio", "Share of successful upstream TLS handshakes that resumed a session, by host.", []string{"host"},
+		h.transports.tls.ratioSamples)
+
+	if h.keys != nil {
+		h.metrics.gaugeFunc("proxygo_apikey_month_requests", "Requests made with each API key this month.", []string{"key"},
+			h.keys.samples(func(u KeyUsage) int64 { return u.Requests }))
+		h.metrics.gaugeFunc("proxygo_apikey_month_bytes", "Response bytes served to each API key this month.", []string{"key"},
+			h.keys.samples(func(u KeyUsage) int64 { return u.Bytes }))
+	}
+}
 
-	// Find the protocol separator (://)
-	protocolIndex := strings.Index(cleanPath, "://")
-	if protocolIndex == -1 {
-		return nil, "", fmt.Errorf("invalid format: expected /http(s)://host/path")
+// runBackground starts the handler's periodic maintenance tasks until ctx is done
+func (h *ProxyHandler) runBackground(ctx context.Context) {
+	if h.keys != nil {
+		go h.keys.run(ctx, h.logger)
 	}
+	if h.usage != nil {
+		go h.usage.run(ctx, h.logger)
+	}
+	if len(h.prewarmJobs) > 0 {
+		h.runPrewarm(ctx, h.prewarmJobs)
+	}
+	go h.watchSchemas(ctx)
+	go h.runWarmup(ctx)
+	go h.runQueues(ctx)
+	if h.cluster != nil {
+		go h.cluster.run(ctx)
+	}
+	if h.notifier != nil {
+		go h.notifier.run(ctx, h.keyPairs)
+	}
+	if h.slos != nil {
+		go h.slos.run(ctx, h.notifier)
+	}
+	if h.uploads != nil {
+		go h.uploads.run(ctx)
+	}
+	if h.secrets != nil {
+		h.secrets.run(ctx)
+	}
+}
 
-	// Find the first slash after the host part
-	// Start searching after the protocol://host part
-	hostStart := protocolIndex + 3 // Skip "://"
-	pathIndex := strings.Index(cleanPath[hostStart:], "/")
+// Close flushes persistent state; call it after the listeners have drained
+func (h *ProxyHandler) Close() {
+	for _, c := range h.extensionClosers {
+		if err := c.Close(); err != nil {
+			h.logger.Printf("Closing extension failed: %v", err)
+		}
+	}
+	h.flushState()
+	if h.auditLog != nil {
+		h.auditLog.Close()
+	}
+	for _, sink := range h.logSinks {
+		sink.Close()
+	}
+}
 
-	if pathIndex == -1 {
-		// No path component, the entire string is the target URL
-		targetURL, err = url.Parse(cleanPath)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to parse target URL: %w", err)
+// flushState writes API key and usage counters to their files
+func (h *ProxyHandler) flushState() {
+	if h.keys != nil {
+		if err := h.keys.flush(); err != nil {
+			h.logger.Printf("API key usage flush failed: %v", err)
 		}
-		remainingPath = "/"
+	}
+	if h.usage != nil {
+		if err := h.usage.flush(); err != nil {
+			h.logger.Printf("Usage flush failed: %v", err)
+		}
+	}
+}
+
+// Reload applies the runtime-tunable parts of a freshly loaded config
+func (h *ProxyHandler) Reload(cfg *Config) {
+	h.bandwidth.update(cfg.Bandwidth)
+	h.downloads.update(cfg.Downloads)
+	if pool := cfg.Pool; pool != nil {
+		h.buffers.resize(pool.CopyBuffer)
+		// The copy buffer is not a transport setting; changing it alone keeps the connections
+		current := h.transports.currentSettings()
+		current.CopyBuffer = pool.CopyBuffer
+		if *pool != current {
+			h.transports.tune(*pool)
+		}
+	}
+	if err := h.targets.update(cfg.Targets); err != nil {
+		h.logger.Printf("Keeping previous targets config: %v", err)
+	}
+	if schedules, err := newScheduleTable(cfg.Schedules); err != nil {
+		h.logger.Printf("Keeping previous schedules: %v", err)
+	} else {
+		h.schedules.Store(schedules)
+	}
+	if scripts, err := newScriptSet(cfg.Scripts, h.allRoutes()); err != nil {
+		h.logger.Printf("Keeping previous scripts: %v", err)
 	} else {
-		// Split at the path boundary
-		rawTargetURL := cleanPath[:hostStart+pathIndex]       // e.g., "https://example.com"
-		remainingPath = "/" + cleanPath[hostStart+pathIndex:] // e.g., "/api/foo"
+		h.scripts.Store(scripts)
+	}
+	if h.tenants != nil {
+		if err := h.tenants.update(cfg.Tenants); err != nil {
+			h.logger.Printf("Keeping previous tenants config: %v", err)
+		}
+	}
+	h.updateSampleRedaction()
+	h.config.Store(cfg)
+}
+
+// upstreamName labels target in usage accounting and on the dashboard
+func upstreamName(target *proxyTarget) string {
+	if target.Socket != "" {
+		return "unix:" + target.Socket
+	}
+	if target.URL.Scheme == "file" {
+		return "file"
+	}
+	return target.URL.Host
+}
+
+// contentFilterFor returns the content filter for target: the route's own, else the global one
+func (h *ProxyHandler) contentFilterFor(target *proxyTarget) *contentFilter {
+	if target.Route != nil && target.Route.Filter != nil {
+		return target.Route.Filter
+	}
+	return h.filter
+}
+
+// allRoutes returns the global routes followed by every virtual host's and tenant's routes
+func (h *ProxyHandler) allRoutes() []*Route {
+	routes := h.router.routes
+	if h.vhosts != nil {
+		routes = append(slices.Clip(routes), h.vhosts.routes()...)
+	}
+	if h.tenants != nil {
+		routes = append(slices.Clip(routes), h.tenants.routes()...)
+	}
+	return routes
+}
+
+// resolveTarget works out the upstream for a request: virtual hosts by Host header, the tenant's
+// routes, then configured routes, then /unix:<socket>/path targets, then aliases, then path-embedded URLs
+func (h *ProxyHandler) resolveTarget(r *http.Request, tn *tenant) (*proxyTarget, error) {
+	return h.traceTarget(r, tn, nil)
+}
 
-		// Parse the target URL
-		targetURL, err = url.Parse(rawTargetURL)
+// traceTarget is resolveTarget, recording the routes it tries in tr when set
+func (h *ProxyHandler) traceTarget(r *http.Request, tn *tenant, tr *routeTrace) (*proxyTarget, error) {
+	if h.vhosts != nil {
+		if rt := h.vhosts.routerFor(r.Host); rt != nil {
+			if route, upstreamPath := rt.match(r, tr, "vhost"); route != nil {
+				return &proxyTarget{URL: route.Upstream, Path: upstreamPath, Socket: route.Socket, Route: route}, nil
+			}
+		}
+	}
+	if tn != nil {
+		if route, upstreamPath := tn.router.match(r, tr, "tenant"); route != nil {
+			return &proxyTarget{URL: route.Upstream, Path: upstreamPath, Socket: route.Socket, Route: route}, nil
+		}
+	}
+	if route, upstreamPath := h.router.match(r, tr, "routes"); route != nil {
+		return &proxyTarget{URL: route.Upstream, Path: upstreamPath, Socket: route.Socket, Route: route}, nil
+	}
+
+	requestPath := r.URL.Path
+	if strings.HasPrefix(requestPath, "/unix:") {
+		target, err := h.parseUnixTarget(strings.TrimPrefix(requestPath, "/unix:"))
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to parse target URL: %w", err)
+			return nil, invalidTarget(err)
 		}
+		return target, nil
 	}
 
-	// Validate the parsed URL
-	if targetURL.Scheme == "" {
-		return nil, "", fmt.Errorf("missing scheme in target URL")
+	if target, ok := h.targets.resolve(requestPath); ok {
+		return target, nil
 	}
-	if targetURL.Host == "" {
-		return nil, "", fmt.Errorf("missing host in target URL")
+
+	targetURL, remainingPath, err := h.parseTargetURL(requestPath)
+	if err != nil {
+		return nil, invalidTarget(err)
 	}
+	return &proxyTarget{URL: targetURL, Path: remainingPath}, nil
+}
 
-	return targetURL, remainingPath, nil
+// parseUnixTarget splits /var/run/app.sock/api/foo into an allowed socket and the remaining path
+func (h *ProxyHandler) parseUnixTarget(rest string) (*proxyTarget, error) {
+	for _, socket := range h.unixSockets {
+		if rest != socket && !strings.HasPrefix(rest, socket+"/") {
+			continue
+		}
+
+		remainingPath := strings.TrimPrefix(rest, socket)
+		if remainingPath == "" {
+			remainingPath = "/"
+		}
+		return &proxyTarget{
+			URL:    &url.URL{Scheme: "http", Host: "localhost"},
+			Path:   remainingPath,
+			Socket: socket,
+		}, nil
+	}
+	return nil, fmt.Errorf("unix socket not allowed: expected one of the configured unix_sockets")
 }
 
-// createReverseProxy creates a reverse proxy for the given target URL
-func (h *ProxyHandler) createReverseProxy(targetURL *url.URL, remainingPath string) *httputil.ReverseProxy {
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+// targetPathEscaper undoes the decoding of characters that are significant to url.Parse
+var targetPathEscaper = strings.NewReplacer("%", "%25", "?", "%3F", "#", "%23")
+
+// parseTargetURL extracts the target URL and remaining path from the request
+func (h *ProxyHandler) parseTargetURL(requestPath string) (targetURL *url.URL, remainingPath string, err error) {
+	// Remove leading slash: /https://example.com/api/foo -> https://example.com/api/foo
+	cleanPath := strings.TrimPrefix(requestPath, "/")
+	if !strings.Contains(cleanPath, "://") {
+		// /example.com/api/foo is accepted when a default scheme is configured
+		scheme := h.targets.scheme()
+		if scheme == "" {
+			return nil, "", fmt.Errorf("invalid format: expected /http(s)://host/path")
+		}
+		cleanPath = scheme + "://" + cleanPath
+	}
+
+	// Let url.Parse split the authority so ports, userinfo and IPv6 literals survive.
+	// The request path is already decoded, so re-escape what url.Parse would
+	// otherwise treat as escapes, a query or a fragment.
+	parsed, err := url.Parse(targetPathEscaper.Replace(cleanPath))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse target URL: %w", err)
+	}
 
-	// Customize the request director
-	proxy.Director = func(req *http.Request) {
-		// Set the target URL components
-		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-		req.URL.Path = remainingPath
-		req.URL.RawQuery = req.URL.RawQuery
+	// Validate the parsed URL
+	if parsed.Scheme == "" {
+		return nil, "", fmt.Errorf("missing scheme in target URL")
+	}
+	if parsed.Host == "" && parsed.Scheme != "file" {
+		return nil, "", fmt.Errorf("missing host in target URL")
+	}
+	// url.Parse reads an unbracketed IPv6 address as a host with a strange port
+	if !strings.HasPrefix(parsed.Host, "[") && strings.Count(parsed.Host, ":") > 1 {
+		return nil, "", fmt.Errorf("IPv6 hosts must be bracketed, as in http://[2001:db8::1]:8080/")
+	}
 
-		// Set the Host header to the target host
-		req.Host = targetURL.Host
+	remainingPath = parsed.Path
+	if remainingPath == "" {
+		remainingPath = "/"
+	}
+	return &url.URL{Scheme: parsed.Scheme, Host: parsed.Host, User: parsed.User}, remainingPath, nil
+}
 
-		// Add proxy headers for debugging and tracking
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Origin-Host", targetURL.Host)
-		req.Header.Set("X-Proxy-By", "proxygo")
+// hostHeader returns the Host header for target. IPv6 zone identifiers only mean
+// something to the local host, so they are dropped (RFC 9110 section 4.2.4).
+func hostHeader(target *url.URL) string {
+	host, _, hasZone := strings.Cut(target.Hostname(), "%")
+	if !hasZone {
+		return target.Host
+	}
+	host = "[" + host + "]"
+	if port := target.Port(); port != "" {
+		host += ":" + port
 	}
+	return host
+}
 
-	// Handle proxy errors
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		h.logger.Printf("Proxy error for %s: %v", r.URL.Path, err)
-		http.Error(w, fmt.Sprintf("Proxy error: %v", err), http.StatusBadGateway)
+// bodyRewriterFor returns the body rewrite rules for target: the route's own, else the global ones
+func (h *ProxyHandler) bodyRewriterFor(target *proxyTarget) *bodyRewriter {
+	if target.Route != nil && target.Route.Rewrite != nil {
+		return target.Route.Rewrite
 	}
+	return h.rewrite
+}
 
-	return proxy
+// securityHeadersFor returns the response hardening for target: the route's own, else the global one
+func (h *ProxyHandler) securityHeadersFor(target *proxyTarget) *securityHeaders {
+	if target.Route != nil && target.Route.Security != nil {
+		return target.Route.Security
+	}
+	return h.security
 }
 
 // ServeHTTP handles incoming HTTP requests
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.logger.Printf("Received request: %s %s", r.Method, r.URL.Path)
 
-	// Parse the target URL from the request path
-	targetURL, remainingPath, err := h.parseTargetURL(r.URL.Path)
+	r, info := withRequestInfo(r)
+	w.Header().Set("X-Request-Id", info.RequestID)
+
+	// Connection-level headers are not part of the request and must not be forwarded
+	stripHopByHopHeaders(r.Header)
+
+	// Count response bytes for key quotas and usage accounting
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+
+	// A dry run is asked for with the admin token, which never reaches the upstream
+	dryRun, ok := h.dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+
+	if h.notifier != nil {
+		defer func() { h.notifier.observe(rec.status) }()
+	}
+
+	// Enforce client country rules before doing any work for the request
+	if h.geo != nil {
+		info.Country = h.geo.country(net.ParseIP(info.ClientIP))
+		if !h.geo.clients.permits(info.Country) {
+			h.logger.Printf("Denied client %s from %s", info.ClientIP, info.Country)
+			h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "client_country", Details: map[string]string{"country": info.Country}})
+			h.writeError(w, r, nil, http.StatusForbidden, "access_denied", "Access denied")
+			return
+		}
+	}
+
+	// Refuse requests that look like attacks before they reach auth or the upstream
+	if h.waf != nil {
+		block, reported := h.waf.inspect(r)
+		for _, m := range reported {
+			h.logger.Printf("WAF rule %s matched %s %s (report only): %s", m.rule, r.Method, r.URL.Path, m.detail)
+		}
+		if block != nil {
+			h.logger.Printf("WAF rule %s blocked %s %s: %s", block.rule, r.Method, r.URL.Path, block.detail)
+			h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "waf", Details: map[string]string{"rule": block.rule, "detail": block.detail}})
+			h.writeError(w, r, nil, http.StatusForbidden, "request_blocked", "Request blocked by rule "+block.rule)
+			return
+		}
+	}
+
+	// Browsers fetch the auto-config file before they have any credentials
+	if h.pac != nil && r.URL.Path == h.pac.path {
+		h.servePAC(w, r)
+		return
+	}
+
+	// The OIDC callback is answered by the proxy itself
+	if h.auth != nil && h.auth.oidc != nil && r.URL.Path == h.auth.oidc.callbackPath {
+		h.oidcCallback(w, r)
+		return
+	}
+
+	// Find the tenant whose routes and limits apply
+	var tn *tenant
+	if h.tenants != nil {
+		var keyID string
+		if h.keys != nil {
+			keyID = h.keys.keyID(r)
+		}
+		var err error
+		if tn, err = h.tenants.identify(r, keyID); err != nil {
+			var kerr *keyError
+			errors.As(err, &kerr)
+			h.tenantRejects.inc("", kerr.code)
+			h.audit(r, auditEvent{Event: auditRequestDenied, Status: kerr.status, Reason: kerr.code, Details: map[string]string{"host": r.Host}})
+			h.writeError(w, r, nil, kerr.status, kerr.code, kerr.message)
+			return
+		}
+		if tn != nil {
+			info.Tenant = tn.ID
+		}
+	}
+
+	// Work out the upstream from the request path
+	target, err := h.resolveTarget(r, tn)
 	if err != nil {
 		h.logger.Printf("Failed to parse target URL: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		var perr *ProxyError
+		errors.As(err, &perr)
+		h.writeProxyError(w, r, nil, perr)
+		return
+	}
+
+	// A target that leads back here would recurse until something runs out
+	if reason := h.loops.check(r, target); reason != "" {
+		h.logger.Printf("Loop detected for %s: %s", r.URL.Path, reason)
+		h.writeError(w, r, target, http.StatusLoopDetected, "loop_detected", reason)
+		return
+	}
+
+	// Feed the admin dashboard once the request completes
+	if h.traffic != nil {
+		start := time.Now()
+		defer func() {
+			h.traffic.publish(trafficEvent{
+				Time:     start,
+				Client:   info.ClientID,
+				Method:   r.Method,
+				Host:     upstreamName(target),
+				Path:     target.Path,
+				Status:   rec.status,
+				Bytes:    rec.bytes,
+				Duration: float64(time.Since(start).Microseconds()) / 1000,
+				Cache:    rec.Header().Get("X-Cache"),
+			})
+		}()
+	}
+
+	// Judge the request against the SLOs of its route once it completes
+	if h.slos != nil && !dryRun {
+		start := time.Now()
+		defer func() { h.slos.observe(target, rec.status, time.Since(start)) }()
+	}
+
+	// Account the request to the client and upstream once it completes
+	if h.usage != nil {
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		upstream := upstreamName(target)
+		defer func() { h.usage.record(info.ClientID, upstream, info.Tenant, body.n, rec.bytes) }()
+	}
+
+	// In maintenance the upstream is not contacted at all
+	if h.maintenance.active(target.Route) {
+		h.serveMaintenance(w, r, target)
+		return
+	}
+
+	// A valid signed link stands in for client credentials
+	signed := false
+	if h.signer != nil {
+		if signed, err = h.signer.verify(r); err != nil {
+			h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "invalid_signature", Details: map[string]string{"detail": err.Error()}})
+			h.writeError(w, r, target, http.StatusForbidden, "invalid_signature", err.Error())
+			return
+		}
+	}
+
+	// Validate the bearer token or login session and forward its claims
+	var claims jwtClaims
+	if h.auth != nil && !signed {
+		claims, err = h.auth.admit(r)
+		if err != nil {
+			var kerr *keyError
+			errors.As(err, &kerr)
+			// Browsers without a valid session are sent to log in instead
+			if kerr.status == http.StatusUnauthorized && h.auth.oidc != nil && h.auth.oidc.wantsLogin(r) {
+				if err := h.auth.oidc.login(w, r); err != nil {
+					h.logger.Printf("OIDC login redirect failed: %v", err)
+					h.writeError(w, r, target, http.StatusServiceUnavailable, "auth_unavailable", "Login is unavailable")
+				}
+				return
+			}
+			if kerr.status == http.StatusUnauthorized {
+				h.audit(r, auditEvent{Event: auditAuthFailed, Status: kerr.status, Reason: kerr.code})
+				challenge := "Bearer"
+				if kerr.code != "missing_token" {
+					challenge += ` error="invalid_token"`
+				}
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			h.writeError(w, r, target, kerr.status, kerr.code, kerr.message)
+			return
+		}
+		// An API key, checked next, names the client more specifically
+		if sub := claims.stringClaim("sub"); sub != "" {
+			info.ClientID = sub
+		}
+	}
+
+	// Authenticate the API key and enforce its host, quota and rate limits
+	var keyID string
+	if h.keys != nil && !signed {
+		key, err := h.keys.admit(r, target.URL.Hostname())
+		if err != nil {
+			var kerr *keyError
+			errors.As(err, &kerr)
+			h.keyRejects.inc(kerr.code)
+			// Throttling is routine; only authentication and authorization failures are audited
+			switch kerr.status {
+			case http.StatusUnauthorized:
+				h.audit(r, auditEvent{Event: auditAuthFailed, Status: kerr.status, Reason: kerr.code})
+			case http.StatusForbidden:
+				h.audit(r, auditEvent{Event: auditRequestDenied, Status: kerr.status, Reason: kerr.code, Details: map[string]string{"upstream": target.URL.Host}})
+			}
+			if kerr.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(kerr.retryAfter.Seconds()))))
+			}
+			h.writeError(w, r, target, kerr.status, kerr.code, kerr.message)
+			return
+		}
+		if key != nil {
+			info.ClientID = key.ID
+			keyID = key.ID
+			defer func() { h.keys.record(key.ID, rec.bytes) }()
+		}
+	}
+
+	// Send the client to its variant of a split route, so every check below sees that upstream
+	if target.Route != nil && target.Route.Split != nil {
+		variant := h.applySplit(w, r, target, info.ClientID)
+		defer func() { h.splitResponses.inc(target.Route.Name, variant, statusClass(rec.status)) }()
+	}
+
+	// Tell the upstream who the client is, replacing whatever the client claimed itself
+	identified := false
+	if h.identity != nil {
+		identified = h.identity.forward(r, &requestIdentity{claims: claims, keyID: keyID, tenant: info.Tenant, cert: verifiedClientCert(r)}, info.RequestID)
+	}
+
+	// Let the route's scripts pick the upstream, adjust headers or refuse the request
+	routed := target.URL
+	if h.runScripts(w, r, target, info, claims) {
+		return
+	}
+	// An upstream a script picked has to pass the checks the route's own passed above
+	if target.URL != routed {
+		if reason := h.loops.check(r, target); reason != "" {
+			h.logger.Printf("Loop detected for %s: %s", r.URL.Path, reason)
+			h.writeError(w, r, target, http.StatusLoopDetected, "loop_detected", reason)
+			return
+		}
+		if keyID != "" {
+			if kerr := h.keys.reaches(keyID, target.URL.Hostname()); kerr != nil {
+				h.keyRejects.inc(kerr.code)
+				h.audit(r, auditEvent{Event: auditRequestDenied, Status: kerr.status, Reason: kerr.code, Details: map[string]string{"upstream": target.URL.Host}})
+				h.writeError(w, r, target, kerr.status, kerr.code, kerr.message)
+				return
+			}
+		}
+	}
+
+	// Hold the tenant to its client and upstream allowlists and its shared rate limit
+	if tn != nil {
+		if kerr := h.tenants.admit(r.Context(), tn, info.ClientIP, target.URL.Hostname()); kerr != nil {
+			h.tenantRejects.inc(tn.ID, kerr.code)
+			if kerr.status == http.StatusForbidden {
+				h.audit(r, auditEvent{Event: auditRequestDenied, Status: kerr.status, Reason: kerr.code, Details: map[string]string{"tenant": tn.ID, "upstream": target.URL.Host}})
+			}
+			if kerr.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(kerr.retryAfter.Seconds()))))
+			}
+			h.writeError(w, r, target, kerr.status, kerr.code, kerr.message)
+			return
+		}
+	}
+
+	// Compiled-in extensions see the request once it is admitted and its upstream is final
+	if h.runRequestExtensions(w, r, target, info) {
+		return
+	}
+
+	// Pace the response body when the client has a bandwidth cap
+	if bucket := h.bandwidth.bucketFor(info.ClientID); bucket != nil {
+		w = &limitedWriter{ResponseWriter: w, ctx: r.Context(), bucket: bucket}
+	}
+
+	if target.Socket != "" {
+		h.logger.Printf("Proxying to: unix:%s%s", target.Socket, target.Path)
+	} else {
+		h.logger.Printf("Proxying to: %s%s", target.URL.Redacted(), target.Path)
+	}
+
+	// Reject filtered extensions without contacting the upstream
+	if filter := h.contentFilterFor(target); filter != nil {
+		if err := filter.checkPath(target.Path); err != nil {
+			h.logger.Printf("Blocked %s: %v", r.URL.Path, err)
+			h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "content_blocked", Details: map[string]string{"detail": err.Error()}})
+			h.writeError(w, r, target, http.StatusForbidden, "content_blocked", err.Error())
+			return
+		}
+	}
+
+	// Refuse malformed image parameters without contacting the upstream
+	if h.images != nil {
+		if _, err := h.images.parse(r.URL.Query()); err != nil {
+			h.writeError(w, r, target, http.StatusBadRequest, "invalid_image_options", err.Error())
+			return
+		}
+	}
+
+	// Reject request bodies that do not match the route's schema
+	if target.Route != nil && target.Route.Validator != nil {
+		result, rejection := target.Route.Validator.checkBody(r, target.Path)
+		h.validations.inc(target.Route.Name, result)
+		if rejection != nil {
+			h.writeError(w, r, target, rejection.status, rejection.code, rejection.message)
+			return
+		}
+	}
+
+	// Describe the upstream request instead of sending it
+	if dryRun {
+		h.serveDryRun(w, r, target, isGRPCRequest(r))
 		return
 	}
 
-	h.logger.Printf("Proxying to: %s%s", targetURL.String(), remainingPath)
+	// A successful write leaves the stored copies of what it changed stale, whichever path answers it
+	if h.cache != nil && unsafeMethod(r.Method) {
+		defer func() {
+			if rec.status < http.StatusBadRequest {
+				h.cache.invalidateAfterWrite(r, target, w.Header())
+			}
+		}()
+	}
+
+	// Deduplicate retried POSTs that carry an idempotency key
+	if h.idempotency != nil {
+		if key, ok := h.idempotency.idempotencyKey(r); ok {
+			h.serveIdempotent(w, r, target, key)
+			return
+		}
+	}
+
+	// Answer from the cache when possible, otherwise record the response for it
+	var capture *captureWriter
+	var cacheBase string
+	// Credentials embedded in the target make the response as private as an Authorization header
+	// would, and so do the claims of an authenticated user and the identity headers
+	if h.cache != nil && cacheableRequest(r) && target.URL.User == nil && claims == nil && !identified {
+		cacheBase = cacheBaseKey(r, target)
+		entry, fresh := h.cache.lookup(r, cacheBase)
+		if entry != nil && fresh {
+			h.cache.serve(w, r, entry, "HIT")
+			return
+		}
+		if entry != nil {
+			h.revalidate(w, r, target, cacheBase, entry)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			h.fillForRange(w, r, target, cacheBase)
+			return
+		}
+		if r.Method == http.MethodGet {
+			capture = &captureWriter{ResponseWriter: w, limit: h.cache.maxEntry}
+			w = capture
+		}
+	}
+
+	// Count responses cut off mid-body against whoever went away
+	defer h.recordAbort(r, rec, target)
 
-	// Create and serve the reverse proxy
-	proxy := h.createReverseProxy(targetURL, remainingPath)
-	proxy.ServeHTTP(w, r)
+	// Let identical concurrent GETs share one upstream response
+	grpc := isGRPCRequest(r)
+	served := false
+	if h.coalescer != nil && coalescable(r) && claims == nil && !identified {
+		served = h.coalescer.serve(w, r, coalesceKey(r, target), func(w http.ResponseWriter) { h.serveProxy(w, r, target, grpc) })
+	}
+	if !served {
+		h.serveProxy(w, r, target, grpc)
+	}
+
+	// Only reached when the proxy returned normally, so the capture is complete
+	if capture != nil && r.Context().Err() == nil && capture.shareable() {
+		if capture.status < http.StatusBadRequest {
+			h.cache.storeResponse(cacheBase, capture.status, capture.header, capture.buf.Bytes())
+		} else if !info.proxyError {
+			// The proxy's own error pages carry the request ID and must not be replayed
+			h.cache.storeNegative(cacheBase, h.cache.negativeFor(target), capture.status, capture.header, capture.buf.Bytes())
+		}
+	}
 }
 
-func main() {
-	// Create the proxy handler
-	handler := NewProxyHandler()
+// Main runs the proxygo command with the arguments in os.Args: the proxy server, or one
+// of the report, sign and check subcommands. Builds with extensions call it from their
+// own main package; see Extension.
+func Main() {
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(runReport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
 
-	// Set up the HTTP server
-	server := &http.Server{
-		Addr:    serverPort,
-		Handler: handler,
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Start the server
-	handler.logger.Printf("Proxy server starting on %s", serverAddr)
-	handler.logger.Printf("Usage: http://%s/https://example.com/api/endpoint", serverAddr)
+	// Create the proxy handler
+	handler, err := NewProxyHandler(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	handler.configPath = *configPath
 
-	if err := server.ListenAndServe(); err != nil {
+	// Bind all listeners up front so a bad address fails fast
+	if err := adoptInheritedListeners(); err != nil {
+		handler.logger.Fatalf("Server failed to start: %v", err)
+	}
+	if err := adoptSystemdListeners(); err != nil {
 		handler.logger.Fatalf("Server failed to start: %v", err)
 	}
+	servers, err := openListeners(cfg, handler)
+	if err != nil {
+		handler.logger.Fatalf("Server failed to start: %v", err)
+	}
+	streams, err := openStreams(cfg, handler)
+	if err != nil {
+		for _, s := range servers {
+			s.close()
+		}
+		handler.logger.Fatalf("Server failed to start: %v", err)
+	}
+	closeUnusedInherited()
+	closeUnusedSystemd(handler.logger)
+
+	// An upgraded binary becomes the service's main process before the old one drains
+	ready := "READY=1"
+	if os.Getenv(envUpgradeReadyFD) != "" {
+		ready = fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), ready)
+	}
+	if err := sdNotify(ready); err != nil {
+		handler.logger.Printf("systemd notification failed: %v", err)
+	}
+	if err := notifyUpgradeParent(); err != nil {
+		handler.logger.Printf("Upgrade readiness notification failed: %v", err)
+	}
+
+	handler.logger.Printf("Proxy server starting with %d listener(s)", len(servers))
+	if base := exampleURL(servers); base != "" {
+		handler.logger.Printf("Usage: %s/https://example.com/api/endpoint", base)
+	}
+
+	// Stop every listener together on SIGINT/SIGTERM
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// In Kubernetes, fail readiness for a while first; a config change that needs a
+	// restart takes the same path
+	shutdownCtx, restart := context.WithCancel(sigCtx)
+	defer restart()
+	if cfg.Kubernetes != nil {
+		shutdownCtx = delayShutdown(shutdownCtx, handler, servers, cfg.Kubernetes.drainDelay())
+	}
+	// A successful binary upgrade drains this process the same way
+	ctx, cancel := context.WithCancel(shutdownCtx)
+	defer cancel()
+	var handedOff atomic.Bool
+	handoff := func() {
+		handedOff.Store(true)
+		cancel()
+	}
+	stopping := make(chan struct{})
+	go func() {
+		defer close(stopping)
+		<-ctx.Done()
+		// After a handoff the service is not stopping; the new process carries on
+		if !handedOff.Load() {
+			sdNotify("STOPPING=1")
+		}
+	}()
+
+	// Re-read the config file on SIGHUP, and when it or a certificate changes in Kubernetes
+	go watchReload(ctx, handler, *configPath)
+	if cfg.Kubernetes != nil {
+		go watchMounted(ctx, handler, *configPath, cfg.Kubernetes.watchInterval(), restart)
+	}
+	// Hand the listeners and stream sockets to a new binary on SIGUSR2
+	go watchUpgrade(ctx, handler, servers, streams, handoff)
+	go runWatchdog(ctx, handler.logger)
+	handler.runBackground(ctx)
+
+	streamsDone := serveStreams(ctx, handler, streams)
+	err = serveAll(ctx, handler, servers)
+	cancel()
+	<-streamsDone
+	<-stopping
+	handler.Close()
+	if err != nil {
+		handler.logger.Fatalf("Server failed: %v", err)
+	}
+}
+
+// watchReload re-reads the config on every SIGHUP and applies it to the handler
+func watchReload(ctx context.Context, handler *ProxyHandler, configPath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		if configPath == "" {
+			handler.logger.Printf("Ignoring SIGHUP: no config file to reload")
+			continue
+		}
+		reloadConfig(handler, configPath, "sighup")
+	}
+}
+
+// reloadConfig re-reads the config file and applies it, along with any renewed
+// certificates; trigger names what asked for the reload in the audit log
+func reloadConfig(handler *ProxyHandler, configPath, trigger string) {
+	if err := sdReloading(); err != nil {
+		handler.logger.Printf("systemd notification failed: %v", err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		sdNotify("READY=1")
+		// Keep serving with the previous config
+		handler.logger.Printf("Config reload failed: %v", err)
+		handler.audit(nil, auditEvent{Event: auditConfigReload, Reason: "failed", Details: map[string]string{"file": configPath, "trigger": trigger, "error": err.Error()}})
+		handler.notify(notification{Event: eventReloadFailed, Subject: configPath, Message: fmt.Sprintf("reload of %s failed, keeping the previous config: %v", configPath, err), Details: map[string]string{"trigger": trigger}})
+		return
+	}
+	handler.Reload(cfg)
+	handler.reloadCertificates()
+	sdNotify("READY=1")
+	handler.logger.Printf("Config reloaded from %s", configPath)
+	handler.audit(nil, auditEvent{Event: auditConfigReload, Reason: "applied", Details: map[string]string{"file": configPath, "trigger": trigger}})
 }
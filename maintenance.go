@@ -0,0 +1,190 @@
+package proxygo
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenanceMessage is sent through the error pages when no body file is configured
+const defaultMaintenanceMessage = "Down for maintenance"
+
+// MaintenanceConfig is the static response served instead of contacting upstreams while
+// maintenance mode is on. The mode is switched at runtime through the admin API, for
+// every request or per route; enabled and routes only set the state at startup.
+type MaintenanceConfig struct {
+	Enabled     bool              `json:"enabled"`      // start with maintenance on for every request
+	Routes      []string          `json:"routes"`       // routes that start in maintenance
+	Status      int               `json:"status"`       // default 503
+	Headers     map[string]string `json:"headers"`      // added to the response, e.g. Cache-Control
+	BodyFile    string            `json:"body_file"`    // served as is; default an error page with "Down for maintenance"
+	ContentType string            `json:"content_type"` // default guessed from the body file's extension
+	RetryAfter  Duration          `json:"retry_after"`  // sent as Retry-After when set
+}
+
+// maintenanceMode holds the maintenance response and which requests get it
+type maintenanceMode struct {
+	status     int
+	header     http.Header
+	body       []byte // nil to render an error page
+	retryAfter time.Duration
+
+	global atomic.Bool
+	mu     sync.RWMutex
+	routes map[string]bool
+}
+
+// maintenanceState is the body of GET /maintenance
+type maintenanceState struct {
+	Enabled bool     `json:"enabled"` // every request gets the maintenance response
+	Routes  []string `json:"routes"`  // routes in maintenance on their own
+}
+
+// newMaintenanceMode loads the response; without a config maintenance answers 503 with
+// an error page, and starts off
+func newMaintenanceMode(cfg *MaintenanceConfig) (*maintenanceMode, error) {
+	m := &maintenanceMode{status: http.StatusServiceUnavailable, header: make(http.Header), routes: make(map[string]bool)}
+	if cfg == nil {
+		return m, nil
+	}
+	if cfg.Status != 0 {
+		if cfg.Status < 200 || cfg.Status > 599 {
+			return nil, fmt.Errorf("maintenance: invalid status %d", cfg.Status)
+		}
+		m.status = cfg.Status
+	}
+	for name, value := range cfg.Headers {
+		m.header.Set(name, value)
+	}
+	if cfg.BodyFile != "" {
+		data, err := os.ReadFile(cfg.BodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance: %w", err)
+		}
+		m.body = data
+		contentType := cfg.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(cfg.BodyFile))
+		}
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		m.header.Set("Content-Type", contentType)
+	}
+	m.retryAfter = time.Duration(cfg.RetryAfter)
+	m.global.Store(cfg.Enabled)
+	for _, name := range cfg.Routes {
+		m.routes[name] = true
+	}
+	return m, nil
+}
+
+// active reports whether a request to route gets the maintenance response
+func (m *maintenanceMode) active(route *Route) bool {
+	if m.global.Load() {
+		return true
+	}
+	if route == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.routes[route.Name]
+}
+
+// setRoute switches maintenance for one route
+func (m *maintenanceMode) setRoute(name string, on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if on {
+		m.routes[name] = true
+	} else {
+		delete(m.routes, name)
+	}
+}
+
+// state returns what is in maintenance
+func (m *maintenanceMode) state() maintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := maintenanceState{Enabled: m.global.Load(), Routes: []string{}}
+	for name := range m.routes {
+		s.Routes = append(s.Routes, name)
+	}
+	slices.Sort(s.Routes)
+	return s
+}
+
+// serveMaintenance answers a request with the maintenance response
+func (h *ProxyHandler) serveMaintenance(w http.ResponseWriter, r *http.Request, target *proxyTarget) {
+	m := h.maintenance
+	h.maintenanceResponses.inc(routeName(target))
+
+	for name, values := range m.header {
+		w.Header()[name] = values
+	}
+	if m.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(m.retryAfter.Seconds()))))
+	}
+	if m.body == nil {
+		h.writeError(w, r, target, m.status, "maintenance", defaultMaintenanceMessage)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.body)))
+	w.WriteHeader(m.status)
+	if r.Method != http.MethodHead {
+		w.Write(m.body)
+	}
+}
+
+// handleMaintenance handles GET /maintenance
+func (a *adminAPI) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.proxy.maintenance.state())
+}
+
+// setMaintenance handles PUT and DELETE /maintenance, switching it for every request
+func (a *adminAPI) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	on := r.Method == http.MethodPut
+	a.proxy.maintenance.global.Store(on)
+	reason := "maintenance_ended"
+	if on {
+		reason = "maintenance_started"
+	}
+	a.proxy.logger.Printf("Admin: maintenance mode %s", onOff(on))
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: reason})
+	writeJSON(w, http.StatusOK, a.proxy.maintenance.state())
+}
+
+// setRouteMaintenance handles PUT and DELETE /maintenance/{route}
+func (a *adminAPI) setRouteMaintenance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("route")
+	on := r.Method == http.MethodPut
+	if on && !slices.ContainsFunc(a.proxy.allRoutes(), func(route *Route) bool { return route.Name == name }) {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no route named %q", name))
+		return
+	}
+	a.proxy.maintenance.setRoute(name, on)
+	reason := "maintenance_ended"
+	if on {
+		reason = "maintenance_started"
+	}
+	a.proxy.logger.Printf("Admin: maintenance mode %s for route %q", onOff(on), name)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: reason, Details: map[string]string{"route": name}})
+	writeJSON(w, http.StatusOK, a.proxy.maintenance.state())
+}
+
+// onOff spells a switch for the log
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,165 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceConfig(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Back soon</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	noExt := filepath.Join(dir, "maintenance")
+	if err := os.WriteFile(noExt, []byte(`{"status": "maintenance"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		cfg         *MaintenanceConfig
+		status      int
+		contentType string
+		err         string
+	}{
+		{name: "defaults", status: http.StatusServiceUnavailable},
+		{name: "html", cfg: &MaintenanceConfig{Status: 200, BodyFile: page}, status: 200, contentType: "text/html; charset=utf-8"},
+		{name: "sniffed", cfg: &MaintenanceConfig{BodyFile: noExt}, status: 503, contentType: "text/plain; charset=utf-8"},
+		{name: "set", cfg: &MaintenanceConfig{BodyFile: noExt, ContentType: "application/json"}, status: 503, contentType: "application/json"},
+		{name: "bad status", cfg: &MaintenanceConfig{Status: 99}, err: "maintenance: invalid status 99"},
+		{name: "missing file", cfg: &MaintenanceConfig{BodyFile: filepath.Join(dir, "gone.html")}, err: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMaintenanceMode(tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("newMaintenanceMode: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.status != tt.status || m.header.Get("Content-Type") != tt.contentType {
+				t.Errorf("status %d and Content-Type %q, want %d and %q", m.status, m.header.Get("Content-Type"), tt.status, tt.contentType)
+			}
+		})
+	}
+
+	cfg := &Config{Maintenance: &MaintenanceConfig{Routes: []string{"nope"}}}
+	if _, err := NewProxyHandler(cfg); err == nil || !strings.Contains(err.Error(), `maintenance: unknown route "nope"`) {
+		t.Errorf("NewProxyHandler: %v, want the unknown route refused", err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Back soon</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0", "token": "secret"},
+		"maintenance": {"routes": ["a"], "body_file": "`+page+`", "headers": {"Cache-Control": "no-store"}, "retry_after": "90s"},
+		"routes": [
+			{"name": "a", "prefix": "/a/", "upstream": "`+upstream.URL+`"},
+			{"name": "b", "prefix": "/b/", "upstream": "`+upstream.URL+`"}
+		]}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+
+	tests := []struct {
+		name   string
+		method string // admin request switching maintenance; "" for none
+		path   string
+		status int
+		state  maintenanceState
+		down   []string // routes answering with the maintenance page
+	}{
+		{name: "at startup", state: maintenanceState{Routes: []string{"a"}}, down: []string{"a"}},
+		{name: "route on", method: http.MethodPut, path: "/maintenance/b", status: 200, state: maintenanceState{Routes: []string{"a", "b"}}, down: []string{"a", "b"}},
+		{name: "route off", method: http.MethodDelete, path: "/maintenance/a", status: 200, state: maintenanceState{Routes: []string{"b"}}, down: []string{"b"}},
+		{name: "unknown route", method: http.MethodPut, path: "/maintenance/c", status: 404, state: maintenanceState{Routes: []string{"b"}}, down: []string{"b"}},
+		{name: "global on", method: http.MethodPut, path: "/maintenance", status: 200, state: maintenanceState{Enabled: true, Routes: []string{"b"}}, down: []string{"a", "b"}},
+		{name: "global off", method: http.MethodDelete, path: "/maintenance", status: 200, state: maintenanceState{Routes: []string{"b"}}, down: []string{"b"}},
+		{name: "last route off", method: http.MethodDelete, path: "/maintenance/b", status: 200, state: maintenanceState{Routes: []string{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.method != "" {
+				r := httptest.NewRequest(tt.method, tt.path, nil)
+				r.Header.Set("Authorization", "Bearer secret")
+				w := httptest.NewRecorder()
+				admin.ServeHTTP(w, r)
+				if w.Code != tt.status {
+					t.Fatalf("%s %s: status %d, want %d: %s", tt.method, tt.path, w.Code, tt.status, w.Body)
+				}
+			}
+			r := httptest.NewRequest(http.MethodGet, "/maintenance", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			var state maintenanceState
+			if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(state, tt.state) {
+				t.Errorf("state %+v, want %+v", state, tt.state)
+			}
+
+			for _, route := range []string{"a", "b"} {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+route+"/x", nil))
+				down := strings.Contains(strings.Join(tt.down, ","), route)
+				switch {
+				case down && (w.Code != 503 || w.Body.String() != "<h1>Back soon</h1>"):
+					t.Errorf("route %s: %d %q, want the maintenance page", route, w.Code, w.Body)
+				case down && (w.Header().Get("Retry-After") != "90" || w.Header().Get("Cache-Control") != "no-store" ||
+					w.Header().Get("Content-Type") != "text/html; charset=utf-8"):
+					t.Errorf("route %s: headers %v", route, w.Header())
+				case !down && w.Body.String() != "upstream":
+					t.Errorf("route %s: %d %q, want the upstream", route, w.Code, w.Body)
+				}
+			}
+		})
+	}
+	if got := h.maintenanceResponses.value("a"); got != 3 {
+		t.Errorf("route a answered %v times in maintenance, want 3", got)
+	}
+
+	// Runtime switches survive a reload
+	admin.ServeHTTP(httptest.NewRecorder(), func() *http.Request {
+		r := httptest.NewRequest(http.MethodPut, "/maintenance/b", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		return r
+	}())
+	h.Reload(h.config.Load())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/b/x", nil))
+	if w.Code != 503 || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "18" {
+		t.Errorf("after a reload, HEAD got %d %q with Content-Length %s", w.Code, w.Body, w.Header().Get("Content-Length"))
+	}
+}
+
+func TestMaintenanceErrorPage(t *testing.T) {
+	h := newTestHandler(t, `{"maintenance": {"enabled": true, "status": 502},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "http://127.0.0.1:1"}]}`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/x", nil))
+	if w.Code != 502 || !strings.Contains(w.Body.String(), `"error":"maintenance","message":"Down for maintenance"`) {
+		t.Errorf("%d %s, want the maintenance error page", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Errorf("Retry-After %q without retry_after", w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,184 @@
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry is a minimal Prometheus text-format registry
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// collector writes one metric family in the Prometheus exposition format
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// newMetricsRegistry creates an empty registry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+// register adds c to the registry output
+func (m *metricsRegistry) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// counter registers a counter family with the given label names
+func (m *metricsRegistry) counter(name, help string, labels ...string) *metricVec {
+	v := newMetricVec(name, help, "counter", labels)
+	m.register(v)
+	return v
+}
+
+// gauge registers a gauge family with the given label names
+func (m *metricsRegistry) gauge(name, help string, labels ...string) *metricVec {
+	v := newMetricVec(name, help, "gauge", labels)
+	m.register(v)
+	return v
+}
+
+// gaugeFunc registers a gauge family whose samples are computed at scrape time
+func (m *metricsRegistry) gaugeFunc(name, help string, labels []string, fn func() []sample) {
+	m.register(&funcCollector{name: name, help: help, kind: "gauge", labels: labels, fn: fn})
+}
+
+// counterFunc registers a counter family whose samples are read at scrape time from
+// counts kept elsewhere
+func (m *metricsRegistry) counterFunc(name, help string, labels []string, fn func() []sample) {
+	m.register(&funcCollector{name: name, help: help, kind: "counter", labels: labels, fn: fn})
+}
+
+// ServeHTTP writes every registered metric family
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	collectors := append([]collector(nil), m.collectors...)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+// sample is one labelled value of a metric family
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// metricVec is a counter or gauge family partitioned by label values
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+// newMetricVec creates an empty family
+func newMetricVec(name, help, kind string, labels []string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*sample)}
+}
+
+// add increases the sample for labelValues by v
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sampleFor(labelValues).value += delta
+}
+
+// inc increases the sample for labelValues by one
+func (v *metricVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+// set replaces the sample for labelValues, for gauges
+func (v *metricVec) set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sampleFor(labelValues).value = value
+}
+
+// value reads the sample for labelValues, zero if it was never set
+func (v *metricVec) value(labelValues ...string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.values[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// sampleFor returns the sample for labelValues, creating it; callers hold v.mu
+func (v *metricVec) sampleFor(labelValues []string) *sample {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+// writeTo implements collector
+func (v *metricVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	samples := make([]sample, 0, len(v.values))
+	for _, s := range v.values {
+		samples = append(samples, *s)
+	}
+	v.mu.Unlock()
+
+	writeFamily(w, v.name, v.help, v.kind, v.labels, samples)
+}
+
+// funcCollector computes its samples on every scrape
+type funcCollector struct {
+	name, help, kind string
+	labels           []string
+	fn               func() []sample
+}
+
+// writeTo implements collector
+func (f *funcCollector) writeTo(w io.Writer) {
+	writeFamily(w, f.name, f.help, f.kind, f.labels, f.fn())
+}
+
+// writeFamily renders a metric family in a stable order
+func writeFamily(w io.Writer, name, help, kind string, labels []string, samples []sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(labels, s.labels), s.value)
+	}
+}
+
+// formatLabels renders {name="value",...}, escaping values as the format requires
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, escaper.Replace(value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
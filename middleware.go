@@ -0,0 +1,142 @@
+package proxygo
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps an http.Handler with additional behavior
+type Middleware func(http.Handler) http.Handler
+
+// middlewareRegistry maps the names usable in config profiles to middleware constructors
+var middlewareRegistry = map[string]func(h *ProxyHandler) Middleware{
+	"recover":    recoverMiddleware,
+	"access-log": accessLogMiddleware,
+	"schedule":   scheduleMiddleware,
+}
+
+// buildChain wraps next with the named middlewares, the first name being the outermost
+func buildChain(h *ProxyHandler, names []string, next http.Handler) http.Handler {
+	for i := len(names) - 1; i >= 0; i-- {
+		next = middlewareRegistry[names[i]](h)(next)
+	}
+	return next
+}
+
+// statusRecorder captures the status code and body size written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	writeErr error // first failed write, usually a client that went away
+
+	sample      []byte // first bytes of the body, for access log body sampling
+	sampleLimit int    // how many bytes sample keeps; 0 keeps none
+}
+
+// WriteHeader records the status code before delegating
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the number of bytes written before delegating
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	if keep := min(n, r.sampleLimit-len(r.sample)); keep > 0 {
+		r.sample = append(r.sample, b[:keep]...)
+	}
+	if err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recoverMiddleware turns handler panics into 500 responses instead of dropped connections
+func recoverMiddleware(h *ProxyHandler) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					// Let the server abort the connection as it normally would
+					if rec == http.ErrAbortHandler {
+						panic(rec)
+					}
+					h.logger.Printf("Panic serving %s: %v\n%s", r.URL.Path, rec, debug.Stack())
+					h.writeError(w, r, nil, http.StatusInternalServerError, "internal_error", "Internal proxy error")
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// accessLogMiddleware logs one line per request with status, size and duration
+func accessLogMiddleware(h *ProxyHandler) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			r, info := withRequestInfo(r)
+
+			// The client's headers and body as sent, before the proxy adds to them
+			var sampled bool
+			var reqHeader http.Header
+			var reqBody *sampleReader
+			if h.bodySample != nil {
+				var capture bool
+				if sampled, capture = h.bodySample.sample(); capture {
+					reqHeader = r.Header.Clone()
+					rec.sampleLimit = h.bodySample.limit
+					if r.Body != nil && r.Body != http.NoBody {
+						reqBody = &sampleReader{ReadCloser: r.Body, limit: h.bodySample.limit}
+						r.Body = reqBody
+					}
+				}
+			}
+			defer func() {
+				// Responses cut off mid-body are logged too; other panics are the recover middleware's
+				aborted := recover()
+				if aborted != nil && aborted != http.ErrAbortHandler {
+					panic(aborted)
+				}
+
+				line := fmt.Sprintf("%s %s %s %d %dB %s", r.RemoteAddr, r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start))
+				if info.Country != "" {
+					line += " country=" + info.Country
+				}
+				if info.Tenant != "" {
+					line += " tenant=" + info.Tenant
+				}
+				if aborted != nil {
+					line += " aborted"
+				}
+				if reqHeader != nil && (sampled || rec.status >= http.StatusBadRequest) {
+					var body []byte
+					if reqBody != nil {
+						body = reqBody.sample
+					}
+					line += h.bodySample.format(reqHeader, body, rec.Header(), rec.sample)
+				}
+				h.accessLog.Print(line)
+				if aborted != nil {
+					panic(aborted)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
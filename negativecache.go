@@ -0,0 +1,125 @@
+package proxygo
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NegativeCacheConfig keeps upstream error responses for a short while, so a burst of
+// requests for a missing or rate-limited resource reaches the upstream once. Each status
+// class has its own TTL; 0 leaves it uncached. Needs the response cache to be enabled.
+type NegativeCacheConfig struct {
+	NotFound    Duration `json:"not_found"`    // 404 and 410
+	RateLimited Duration `json:"rate_limited"` // 429, at most until its Retry-After
+	ServerError Duration `json:"server_error"` // 500, 502, 503 and 504, at most until a Retry-After
+}
+
+// negativePolicy is a compiled NegativeCacheConfig
+type negativePolicy struct {
+	notFound    time.Duration
+	rateLimited time.Duration
+	serverError time.Duration
+}
+
+// newNegativePolicy returns nil when cfg is nil. A config with every TTL at 0 disables
+// negative caching, which lets a route opt out of the global policy.
+func newNegativePolicy(cfg *NegativeCacheConfig) (*negativePolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	p := &negativePolicy{
+		notFound:    time.Duration(cfg.NotFound),
+		rateLimited: time.Duration(cfg.RateLimited),
+		serverError: time.Duration(cfg.ServerError),
+	}
+	if p.notFound < 0 || p.rateLimited < 0 || p.serverError < 0 {
+		return nil, fmt.Errorf("negative cache: TTLs must not be negative")
+	}
+	return p, nil
+}
+
+// negativeClass names the status class of a cacheable error response, "" for others
+func negativeClass(status int) string {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return "not_found"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return "server_error"
+	}
+	return ""
+}
+
+// ttl returns how long a response with status may be served from the cache; 0 when it
+// is not kept. The upstream can shorten it with caching headers or Retry-After.
+func (p *negativePolicy) ttl(status int, header http.Header, now time.Time) time.Duration {
+	if p == nil {
+		return 0
+	}
+	var ttl time.Duration
+	switch negativeClass(status) {
+	case "not_found":
+		ttl = p.notFound
+	case "rate_limited":
+		ttl = p.rateLimited
+	case "server_error":
+		ttl = p.serverError
+	}
+	if ttl <= 0 || !cacheStorable(header) {
+		return 0
+	}
+	if _, ok := parseCacheControl(header.Get("Cache-Control"))["no-cache"]; ok {
+		return 0
+	}
+	// Explicit freshness from the origin is honoured when shorter than the configured TTL
+	if lifetime := freshnessLifetime(header, now, ttl); lifetime < ttl {
+		ttl = lifetime
+	}
+	// Retry-After: 0 asks to retry now, so the response is not kept at all
+	if retry, ok := retryAfter(header.Get("Retry-After"), now); ok && retry < ttl {
+		ttl = retry
+	}
+	return ttl
+}
+
+// retryAfter parses a Retry-After value in seconds or as a date; ok is false when it
+// is absent or invalid
+func retryAfter(v string, now time.Time) (d time.Duration, ok bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// negativeFor returns the negative caching policy for requests to target
+func (c *responseCache) negativeFor(target *proxyTarget) *negativePolicy {
+	if target.Route != nil && target.Route.Negative != nil {
+		return target.Route.Negative
+	}
+	return c.negative
+}
+
+// storeNegative caches an upstream error response if the policy covers its status
+func (c *responseCache) storeNegative(base string, policy *negativePolicy, status int, header http.Header, body []byte) {
+	if int64(len(body)) > c.maxEntry {
+		return
+	}
+	now := time.Now()
+	ttl := policy.ttl(status, header, now)
+	if ttl <= 0 {
+		return
+	}
+	// Other variants describe the resource as it was before it went missing or failing
+	c.invalidate(base)
+	c.put(base, status, header, body, now.Add(ttl), false)
+	c.negativeStored.inc(negativeClass(status))
+}
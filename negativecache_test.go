@@ -0,0 +1,95 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheNegative(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		route  string // extra route settings
+		cached bool
+	}{
+		{name: "not found", status: http.StatusNotFound, cached: true},
+		{name: "gone", status: http.StatusGone, cached: true},
+		{name: "server error", status: http.StatusServiceUnavailable, cached: true},
+		{name: "gateway error", status: http.StatusBadGateway, cached: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, cached: true},
+		{name: "rate limited until now", status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"0"}}},
+		{name: "no-store", status: http.StatusNotFound, header: http.Header{"Cache-Control": {"no-store"}}},
+		{name: "origin max-age=0", status: http.StatusNotFound, header: http.Header{"Cache-Control": {"max-age=0"}}},
+		{name: "bad request", status: http.StatusBadRequest},
+		{name: "forbidden", status: http.StatusForbidden},
+		{name: "route opts out", status: http.StatusNotFound, route: `, "negative_cache": {}`},
+		{name: "route policy", status: http.StatusServiceUnavailable, route: `, "negative_cache": {"not_found": "1m"}`},
+		{name: "route policy match", status: http.StatusNotFound, route: `, "negative_cache": {"not_found": "1m"}`, cached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				for k, vv := range tt.header {
+					w.Header()[k] = vv
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, "error")
+			})
+			h := newTestHandler(t, `{"cache": {"enabled": true, "negative": {"not_found": "1m", "rate_limited": "1m", "server_error": "1m"}},
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"`+tt.route+`}]}`)
+
+			checkCached(t, "first", cacheGet(h, "/api/items"), tt.status, "error", "MISS")
+			w := cacheGet(h, "/api/items")
+			hits := int32(2)
+			if tt.cached {
+				hits = 1
+				checkCached(t, "second", w, tt.status, "error", "HIT")
+			}
+			if n := upstream.hits.Load(); n != hits {
+				t.Errorf("%d upstream requests, want %d", n, hits)
+			}
+		})
+	}
+}
+
+func TestCacheNegativeRecovery(t *testing.T) {
+	// The proxy's own error pages are never stored, however the policy reads
+	upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	})
+	h := newTestHandler(t, `{"cache": {"enabled": true, "negative": {"server_error": "1m"}},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	if w := cacheGet(h, "/api/items"); w.Code != http.StatusBadGateway {
+		t.Fatalf("unreachable upstream: status %d, want 502", w.Code)
+	}
+
+	upstream.set(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "back")
+	})
+	checkCached(t, "recovered", cacheGet(h, "/api/items"), http.StatusOK, "back", "MISS")
+
+	// A stored 404 gives way to the resource once a write creates it
+	h = newTestHandler(t, `{"cache": {"enabled": true, "negative": {"not_found": "1m"}},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	upstream.set(func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	cacheGet(h, "/api/new")
+	if w := cacheGet(h, "/api/new"); w.Code != http.StatusNotFound || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("404: status %d with X-Cache %q, want a cached 404", w.Code, w.Header().Get("X-Cache"))
+	}
+	upstream.set(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "created")
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/new", strings.NewReader("x")))
+	checkCached(t, "created", cacheGet(h, "/api/new"), http.StatusOK, "created", "MISS")
+}
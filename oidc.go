@@ -0,0 +1,328 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSessionCookie holds the ID token of a logged-in browser
+	defaultSessionCookie = "proxygo_session"
+	// oidcStateCookie carries the login state and the page to return to
+	oidcStateCookie = "proxygo_oidc_state"
+	// oidcLoginTimeout is how long a browser may take at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// OIDCConfig enables an authorization code login for browser requests without a token
+type OIDCConfig struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	RedirectURL  string   `json:"redirect_url"` // absolute callback URL served by the proxy, e.g. "https://proxy.example.com/_auth/callback"
+	Scopes       []string `json:"scopes"`       // default openid, profile, email
+	Cookie       string   `json:"cookie"`       // session cookie name, default proxygo_session
+}
+
+// oidcFlow runs the browser login against the issuer's discovered endpoints
+type oidcFlow struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	callbackPath string
+	secure       bool // set cookies with Secure when the callback is served over https
+	scopes       string
+	cookie       string
+	client       *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	discovering *fetchCall // the discovery fetch in flight, if any
+}
+
+// oidcDiscovery is the part of the provider metadata the flow uses
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// newOIDCFlow validates the OIDC settings; the provider is contacted lazily
+func newOIDCFlow(cfg *OIDCConfig, issuer string, client *http.Client) (*oidcFlow, error) {
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc requires client_id and redirect_url")
+	}
+	redirect, err := url.Parse(cfg.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return nil, fmt.Errorf("oidc redirect_url %q must be an absolute URL", cfg.RedirectURL)
+	}
+
+	f := &oidcFlow{
+		issuer:       issuer,
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		redirectURL:  cfg.RedirectURL,
+		callbackPath: redirect.Path,
+		secure:       redirect.Scheme == "https",
+		scopes:       strings.Join(cfg.Scopes, " "),
+		cookie:       cfg.Cookie,
+		client:       client,
+	}
+	if f.scopes == "" {
+		f.scopes = "openid profile email"
+	}
+	if f.cookie == "" {
+		f.cookie = defaultSessionCookie
+	}
+	return f, nil
+}
+
+// endpoints fetches the provider metadata once and caches it. Concurrent callers share
+// one fetch, made without f.mu held; a failed one is retried by the next caller.
+func (f *oidcFlow) endpoints(ctx context.Context) (*oidcDiscovery, error) {
+	f.mu.Lock()
+	if f.discovery != nil {
+		defer f.mu.Unlock()
+		return f.discovery, nil
+	}
+	if call := f.discovering; call != nil {
+		f.mu.Unlock()
+		if err := call.wait(ctx); err != nil {
+			return nil, err
+		}
+		return f.endpoints(ctx)
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	f.discovering = call
+	f.mu.Unlock()
+
+	d, err := f.discover(context.WithoutCancel(ctx))
+
+	f.mu.Lock()
+	f.discovery = d
+	f.discovering = nil
+	f.mu.Unlock()
+	call.err = err
+	close(call.done)
+	if err := call.wait(ctx); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// discover downloads the provider metadata
+func (f *oidcFlow) discover(ctx context.Context) (*oidcDiscovery, error) {
+	var d oidcDiscovery
+	if err := fetchJSON(ctx, f.client, f.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery document is missing endpoints")
+	}
+	return &d, nil
+}
+
+// jwksURL returns the discovered key set location
+func (f *oidcFlow) jwksURL(ctx context.Context) (string, error) {
+	d, err := f.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	return d.JWKSURI, nil
+}
+
+// wantsLogin reports whether r comes from a browser that can be sent to the provider
+func (f *oidcFlow) wantsLogin(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// takeSession returns the session token and strips the cookie so it never reaches upstreams
+func (f *oidcFlow) takeSession(r *http.Request) string {
+	var token string
+	var kept []string
+	for _, c := range r.Cookies() {
+		if c.Name == f.cookie {
+			token = c.Value
+			continue
+		}
+		kept = append(kept, c.String())
+	}
+	if token == "" {
+		return ""
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+	return token
+}
+
+// login sends the browser to the provider, remembering where it was headed
+func (f *oidcFlow) login(w http.ResponseWriter, r *http.Request) error {
+	d, err := f.endpoints(r.Context())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	state := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + base64.RawURLEncoding.EncodeToString([]byte(r.URL.RequestURI())),
+		Path:     f.callbackPath,
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   f.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {f.clientID},
+		"redirect_uri":  {f.redirectURL},
+		"scope":         {f.scopes},
+		"state":         {state},
+		// The state doubles as the nonce binding the ID token to this login
+		"nonce": {state},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	return nil
+}
+
+// oidcCallback completes a login: it exchanges the code, verifies the ID token and
+// stores it in the session cookie before returning the browser to its page
+func (h *ProxyHandler) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	a := h.auth
+	f := a.oidc
+
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		h.writeError(w, r, nil, http.StatusBadRequest, "login_failed", "Login expired, please retry")
+		return
+	}
+	state, encodedReturn, _ := strings.Cut(stateCookie.Value, ".")
+	if q := r.URL.Query().Get("state"); q == "" || subtle.ConstantTimeCompare([]byte(q), []byte(state)) != 1 {
+		a.rejects.inc("login_state_mismatch")
+		h.audit(r, auditEvent{Event: auditAuthFailed, Status: http.StatusBadRequest, Reason: "login_state_mismatch"})
+		h.writeError(w, r, nil, http.StatusBadRequest, "login_failed", "Login state mismatch")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		a.rejects.inc("login_denied")
+		h.audit(r, auditEvent{Event: auditAuthFailed, Status: http.StatusUnauthorized, Reason: "login_denied", Details: map[string]string{"error": e}})
+		h.writeError(w, r, nil, http.StatusUnauthorized, "login_failed", "Login failed: "+e)
+		return
+	}
+
+	idToken, err := f.exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		h.logger.Printf("OIDC code exchange failed: %v", err)
+		h.writeError(w, r, nil, http.StatusBadGateway, "login_failed", "Login could not be completed")
+		return
+	}
+	claims, err := a.validate(r.Context(), idToken, []string{f.clientID})
+	if err == nil && claims.stringClaim("nonce") != state {
+		err = errors.New("token nonce mismatch")
+	}
+	if err != nil {
+		a.rejects.inc("invalid_id_token")
+		h.audit(r, auditEvent{Event: auditAuthFailed, Status: http.StatusUnauthorized, Reason: "invalid_id_token", Details: map[string]string{"error": err.Error()}})
+		h.writeError(w, r, nil, http.StatusUnauthorized, "login_failed", "Login could not be verified")
+		return
+	}
+
+	// The session lasts as long as the ID token does
+	exp, _ := claims.timeClaim("exp")
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.cookie,
+		Value:    idToken,
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   f.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: f.callbackPath, MaxAge: -1})
+
+	// Set Location directly: http.Redirect would clean "/https://host" into "/https:/host"
+	w.Header().Set("Location", localRedirect(encodedReturn))
+	w.WriteHeader(http.StatusFound)
+}
+
+// exchange trades an authorization code for the ID token at the token endpoint
+func (f *oidcFlow) exchange(ctx context.Context, code string) (string, error) {
+	if code == "" {
+		return "", errors.New("callback has no code")
+	}
+	d, err := f.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {f.redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, the default token endpoint authentication method
+	req.SetBasicAuth(url.QueryEscape(f.clientID), url.QueryEscape(f.clientSecret))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// localRedirect decodes the saved return path, refusing anything that would leave this host
+func localRedirect(encoded string) string {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	target := string(raw)
+	if err != nil || !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
@@ -0,0 +1,140 @@
+package proxygo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PAC defaults
+const (
+	defaultPACPath   = "/proxy.pac"
+	defaultPACMaxAge = 5 * time.Minute
+)
+
+// PACConfig serves a proxy auto-config file telling browsers and operating systems which
+// destinations to reach through proxygo: the virtual hosts, plus any other hosts listed.
+// proxygo forwards plain HTTP requests for them by Host header; it does not tunnel
+// CONNECT, so https URLs are always sent DIRECT.
+type PACConfig struct {
+	Path   string   `json:"path"`    // where the file is served on every listener; default "/proxy.pac"
+	Proxy  string   `json:"proxy"`   // host:port clients should use; default the host the file was fetched from
+	Hosts  []string `json:"hosts"`   // more host patterns to proxy, e.g. "*.corp.example"
+	MaxAge Duration `json:"max_age"` // how long clients may cache the file; default 5m
+}
+
+// pacFile is the compiled auto-config
+type pacFile struct {
+	path     string
+	proxy    string
+	exact    []string
+	patterns []string
+	maxAge   time.Duration
+}
+
+// newPACFile compiles the auto-config from the virtual hosts, returning nil when disabled
+func newPACFile(cfg *PACConfig, vhosts []VirtualHostConfig) (*pacFile, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	p := &pacFile{path: cfg.Path, proxy: cfg.Proxy, maxAge: time.Duration(cfg.MaxAge)}
+	if p.path == "" {
+		p.path = defaultPACPath
+	}
+	if !strings.HasPrefix(p.path, "/") {
+		return nil, fmt.Errorf("pac: path must start with /")
+	}
+	if p.maxAge <= 0 {
+		p.maxAge = defaultPACMaxAge
+	}
+
+	seen := make(map[string]bool)
+	add := func(hosts []string) {
+		for _, host := range normalizeHosts(hosts) {
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+			// shExpMatch knows * and ? only; bracket patterns stay out of the file
+			if strings.Contains(host, "[") {
+				continue
+			}
+			if strings.ContainsAny(host, "*?") {
+				p.patterns = append(p.patterns, host)
+			} else {
+				p.exact = append(p.exact, host)
+			}
+		}
+	}
+	for _, vc := range vhosts {
+		add(vc.Hosts)
+	}
+	for _, host := range cfg.Hosts {
+		if _, err := path.Match(host, ""); err != nil || strings.Contains(host, "[") {
+			return nil, fmt.Errorf("pac: invalid host pattern %q", host)
+		}
+	}
+	add(cfg.Hosts)
+	return p, nil
+}
+
+// render writes the auto-config pointing clients at proxy. Names are JSON-encoded, which
+// is valid JavaScript, so no host can break out of its string.
+func (p *pacFile) render(proxy string) []byte {
+	quote := func(v any) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	exact := make(map[string]bool, len(p.exact))
+	for _, host := range p.exact {
+		exact[host] = true
+	}
+	patterns := p.patterns
+	if patterns == nil {
+		patterns = []string{}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("// Generated by proxygo from its virtual hosts\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  // proxygo forwards plain HTTP only; it does not tunnel CONNECT\n")
+	b.WriteString("  if (url.substring(0, 5).toLowerCase() !== \"http:\") return \"DIRECT\";\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	fmt.Fprintf(&b, "  var proxy = %s;\n", quote("PROXY "+proxy))
+	fmt.Fprintf(&b, "  var exact = %s;\n", quote(exact))
+	b.WriteString("  if (exact.hasOwnProperty(host)) return proxy;\n")
+	fmt.Fprintf(&b, "  var patterns = %s;\n", quote(patterns))
+	b.WriteString("  for (var i = 0; i < patterns.length; i++) {\n")
+	b.WriteString("    if (shExpMatch(host, patterns[i])) return proxy;\n")
+	b.WriteString("  }\n")
+	b.WriteString("  return \"DIRECT\";\n")
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// servePAC answers a request for the auto-config file
+func (h *ProxyHandler) servePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		h.writeError(w, r, nil, http.StatusMethodNotAllowed, "method_not_allowed", "The auto-config file is read with GET")
+		return
+	}
+	proxy := h.pac.proxy
+	if proxy == "" {
+		// The address the client reached us at is one it can use as a proxy
+		proxy = r.Host
+	}
+	body := h.pac.render(proxy)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(h.pac.maxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
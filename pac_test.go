@@ -0,0 +1,141 @@
+package proxygo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPACFile(t *testing.T) {
+	vhosts := []VirtualHostConfig{
+		{Hosts: []string{"App.example.com", "*.apps.example.com"}},
+		{Hosts: []string{"app.example.com", "[ab].example.com"}},
+	}
+	tests := []struct {
+		name     string
+		cfg      *PACConfig
+		path     string
+		exact    []string
+		patterns []string
+		maxAge   time.Duration
+		err      string
+	}{
+		{name: "off"},
+		{
+			name: "defaults", cfg: &PACConfig{}, path: "/proxy.pac", maxAge: defaultPACMaxAge,
+			exact: []string{"app.example.com"}, patterns: []string{"*.apps.example.com"},
+		},
+		{
+			name: "extra hosts", cfg: &PACConfig{Path: "/wpad.dat", Hosts: []string{"intranet", "*.corp.example", "APP.example.com"}, MaxAge: Duration(time.Hour)},
+			path: "/wpad.dat", maxAge: time.Hour,
+			exact: []string{"app.example.com", "intranet"}, patterns: []string{"*.apps.example.com", "*.corp.example"},
+		},
+		{name: "relative path", cfg: &PACConfig{Path: "proxy.pac"}, err: "pac: path must start with /"},
+		{name: "bracket host", cfg: &PACConfig{Hosts: []string{"[ab].corp.example"}}, err: `pac: invalid host pattern "[ab].corp.example"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPACFile(tt.cfg, vhosts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("newPACFile: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.cfg == nil {
+				if p != nil {
+					t.Errorf("newPACFile = %+v, want nil", p)
+				}
+				return
+			}
+			if p.path != tt.path || p.maxAge != tt.maxAge || !reflect.DeepEqual(p.exact, tt.exact) || !reflect.DeepEqual(p.patterns, tt.patterns) {
+				t.Errorf("newPACFile = %+v, want %s, %s, %q and %q", p, tt.path, tt.maxAge, tt.exact, tt.patterns)
+			}
+		})
+	}
+}
+
+func TestPACRender(t *testing.T) {
+	p, err := newPACFile(&PACConfig{Hosts: []string{`evil");alert(1);//`}}, []VirtualHostConfig{{Hosts: []string{"app.example.com"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(p.render("proxy.internal:8080"))
+	for _, want := range []string{
+		`var proxy = "PROXY proxy.internal:8080";`,
+		`var exact = {"app.example.com":true,"evil\");alert(1);//":true};`,
+		`var patterns = [];`,
+		`return "DIRECT";`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("auto-config lacks %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestServePAC(t *testing.T) {
+	keyFile := writeTestKeys(t, &APIKey{ID: "open", Hash: hashKey("open-secret")})
+	h := newTestHandler(t, `{"api_keys": {"file": "`+keyFile+`", "required": true},
+		"pac": {"hosts": ["*.corp.example"], "max_age": "1m"},
+		"virtual_hosts": [{"hosts": ["app.example.com"], "upstream": "http://app.internal"}]}`)
+	fixed := newTestHandler(t, `{"pac": {"path": "/wpad.dat", "proxy": "proxy.internal:3128"}}`)
+
+	tests := []struct {
+		name   string
+		h      *ProxyHandler
+		method string
+		target string
+		status int
+		proxy  string // the PROXY directive served; "" when no file is
+	}{
+		{name: "without credentials", h: h, method: http.MethodGet, target: "http://gw.example.net:8080/proxy.pac", status: http.StatusOK, proxy: "gw.example.net:8080"},
+		{name: "head", h: h, method: http.MethodHead, target: "/proxy.pac", status: http.StatusOK},
+		{name: "post", h: h, method: http.MethodPost, target: "/proxy.pac", status: http.StatusMethodNotAllowed},
+		{name: "configured", h: fixed, method: http.MethodGet, target: "http://gw.example.net/wpad.dat", status: http.StatusOK, proxy: "proxy.internal:3128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+					t.Errorf("Allow %q", allow)
+				}
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			if tt.proxy == "" {
+				if w.Body.Len() != 0 || w.Header().Get("Content-Length") == "0" {
+					t.Errorf("HEAD: body %q, Content-Length %s", w.Body, w.Header().Get("Content-Length"))
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), `"PROXY `+tt.proxy+`"`) {
+				t.Errorf("auto-config does not point at %s:\n%s", tt.proxy, w.Body)
+			}
+		})
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy.pac", nil))
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("Cache-Control %q, want max-age=60", cc)
+	}
+
+	// Without a pac section the path is not special
+	w = httptest.NewRecorder()
+	newTestHandler(t, `{}`).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy.pac", nil))
+	if w.Header().Get("Content-Type") == "application/x-ns-proxy-autoconfig" {
+		t.Error("auto-config served while disabled")
+	}
+}
@@ -0,0 +1,201 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// PoolConfig tunes upstream connection pooling; reloadable on SIGHUP and through the admin API
+type PoolConfig struct {
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"` // idle connections kept per upstream; 0 uses Go's default of 2
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`      // dialing, active and idle connections per upstream; 0 for unlimited
+	CopyBuffer          ByteSize `json:"copy_buffer"`             // buffer responses are copied through, 4KB to 1MB; default 32KB
+	TLSSessionCache     int      `json:"tls_session_cache"`       // TLS sessions kept to resume upstream handshakes; 0 uses 256, -1 disables resumption
+}
+
+// apply copies the settings onto tr
+func (c PoolConfig) apply(tr *http.Transport) {
+	tr.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	tr.MaxConnsPerHost = c.MaxConnsPerHost
+}
+
+// hostPoolStats counts the connections and in-flight requests of one upstream address
+type hostPoolStats struct {
+	open   int64 // dialed and not yet closed
+	active int64 // requests waiting for or reading a response
+}
+
+// poolStats tracks connection use per upstream address ("host:port" or "unix:/path")
+type poolStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostPoolStats
+}
+
+// newPoolStats creates empty stats
+func newPoolStats() *poolStats {
+	return &poolStats{hosts: make(map[string]*hostPoolStats)}
+}
+
+// adjust changes one host's counters and forgets hosts with nothing left open
+func (s *poolStats) adjust(host string, open, active int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs, ok := s.hosts[host]
+	if !ok {
+		hs = &hostPoolStats{}
+		s.hosts[host] = hs
+	}
+	hs.open += open
+	hs.active += active
+	if hs.open <= 0 && hs.active <= 0 {
+		delete(s.hosts, host)
+	}
+}
+
+// track returns a function that registers a freshly dialed connection to host
+func (s *poolStats) track(host string) func(net.Conn, error) (net.Conn, error) {
+	return func(conn net.Conn, err error) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		s.adjust(host, 1, 0)
+		return &trackedConn{Conn: conn, release: func() { s.adjust(host, -1, 0) }}, nil
+	}
+}
+
+// upstreamPoolStats is the per-host view served by the admin API
+type upstreamPoolStats struct {
+	Host   string `json:"host"`
+	Open   int64  `json:"open"`
+	Active int64  `json:"active"`
+	Idle   int64  `json:"idle"`
+}
+
+// snapshot reports every host. Idle is derived as open minus active, which is exact
+// for HTTP/1.1; HTTP/2 multiplexes several requests onto one connection.
+func (s *poolStats) snapshot() []upstreamPoolStats {
+	s.mu.Lock()
+	out := make([]upstreamPoolStats, 0, len(s.hosts))
+	for host, hs := range s.hosts {
+		out = append(out, upstreamPoolStats{Host: host, Open: hs.open, Active: hs.active, Idle: max(hs.open-hs.active, 0)})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// samples exposes the snapshot as gauge samples by host and state
+func (s *poolStats) samples() []sample {
+	var out []sample
+	for _, hs := range s.snapshot() {
+		out = append(out,
+			sample{labels: []string{hs.Host, "active"}, value: float64(hs.Active)},
+			sample{labels: []string{hs.Host, "idle"}, value: float64(hs.Idle)})
+	}
+	return out
+}
+
+// trackedConn reports its closing to the pool stats exactly once
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close implements net.Conn
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// trackedTransport counts in-flight requests per upstream address
+type trackedTransport struct {
+	http.RoundTripper
+	stats *poolStats
+	host  string // fixed address for unix transports; derived from the URL otherwise
+}
+
+// RoundTrip implements http.RoundTripper; a request stays active until its body is closed
+func (t *trackedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := t.host
+	if host == "" {
+		host = canonicalAddr(req.URL.Scheme, req.URL.Host)
+	}
+
+	t.stats.adjust(host, 0, 1)
+	resp, err := t.RoundTripper.RoundTrip(req)
+	// Upgraded connections leave the pool; their body must stay an io.ReadWriteCloser
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		t.stats.adjust(host, 0, -1)
+		return resp, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, release: func() { t.stats.adjust(host, 0, -1) }}
+	return resp, nil
+}
+
+// canonicalAddr adds the scheme's default port to host, as the transport does when dialing
+func canonicalAddr(scheme, host string) string {
+	if _, port, err := net.SplitHostPort(host); err == nil && port != "" {
+		return host
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// trackedBody releases its request's active slot once
+type trackedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Close implements io.Closer
+func (b *trackedBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// handlePool handles GET /pool
+func (a *adminAPI) handlePool(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Settings  PoolConfig          `json:"settings"`
+		Upstreams []upstreamPoolStats `json:"upstreams"`
+		TLS       []upstreamTLSStats  `json:"tls"`
+	}{a.proxy.transports.currentSettings(), a.proxy.transports.stats.snapshot(), a.proxy.transports.tls.snapshot()})
+}
+
+// tunePool handles PUT /pool, replacing the pool settings until the next reload
+func (a *adminAPI) tunePool(w http.ResponseWriter, r *http.Request) {
+	settings := a.proxy.transports.currentSettings()
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&settings); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if settings.MaxIdleConnsPerHost < 0 || settings.MaxConnsPerHost < 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_settings", "pool limits cannot be negative")
+		return
+	}
+	if settings.TLSSessionCache < -1 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_settings", "tls_session_cache must be -1 or more")
+		return
+	}
+
+	a.proxy.transports.tune(settings)
+	a.proxy.logger.Printf("Admin: pool settings now max_idle_conns_per_host=%d max_conns_per_host=%d tls_session_cache=%d",
+		settings.MaxIdleConnsPerHost, settings.MaxConnsPerHost, settings.TLSSessionCache)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: "pool_tuned", Details: map[string]string{
+		"max_idle_conns_per_host": strconv.Itoa(settings.MaxIdleConnsPerHost),
+		"max_conns_per_host":      strconv.Itoa(settings.MaxConnsPerHost),
+		"tls_session_cache":       strconv.Itoa(settings.TLSSessionCache),
+	}})
+	writeJSON(w, http.StatusOK, settings)
+}
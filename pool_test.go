@@ -0,0 +1,133 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// poolRequest calls the pool admin API and decodes the answer into v
+func poolRequest(t *testing.T, admin http.Handler, method, body string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, "/pool", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w
+}
+
+func TestPoolStats(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0", "token": "secret"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+	u, _ := url.Parse(upstream.URL)
+
+	var pool struct {
+		Upstreams []upstreamPoolStats `json:"upstreams"`
+	}
+	stats := func() []upstreamPoolStats {
+		poolRequest(t, admin, http.MethodGet, "", &pool)
+		return pool.Upstreams
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/x", nil))
+	}()
+	waitUntil(t, "an active upstream request", func() bool {
+		s := stats()
+		return len(s) == 1 && s[0].Active == 1
+	})
+	if want := (upstreamPoolStats{Host: u.Host, Open: 1, Active: 1}); stats()[0] != want {
+		t.Errorf("in flight: %+v, want %+v", stats()[0], want)
+	}
+
+	close(release)
+	<-done
+	if want := (upstreamPoolStats{Host: u.Host, Open: 1, Idle: 1}); len(stats()) != 1 || stats()[0] != want {
+		t.Errorf("after the response: %+v, want %+v", stats(), want)
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `proxygo_upstream_connections{host="` + u.Host + `",state="idle"} 1`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics do not contain %s", want)
+	}
+}
+
+func TestPoolTuning(t *testing.T) {
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0", "token": "secret"},
+		"pool": {"max_idle_conns_per_host": 4, "max_conns_per_host": 8}}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+		want   PoolConfig // settings afterwards
+	}{
+		{
+			name: "partial update", body: `{"max_idle_conns_per_host": 16}`, status: http.StatusOK,
+			want: PoolConfig{MaxIdleConnsPerHost: 16, MaxConnsPerHost: 8},
+		},
+		{
+			name: "unlimited", body: `{"max_conns_per_host": 0, "tls_session_cache": -1}`, status: http.StatusOK,
+			want: PoolConfig{MaxIdleConnsPerHost: 16, TLSSessionCache: -1},
+		},
+		{
+			name: "negative limit", body: `{"max_conns_per_host": -1}`, status: http.StatusBadRequest, code: "invalid_settings",
+			want: PoolConfig{MaxIdleConnsPerHost: 16, TLSSessionCache: -1},
+		},
+		{
+			name: "session cache below -1", body: `{"tls_session_cache": -2}`, status: http.StatusBadRequest, code: "invalid_settings",
+			want: PoolConfig{MaxIdleConnsPerHost: 16, TLSSessionCache: -1},
+		},
+		{
+			name: "not json", body: `max=4`, status: http.StatusBadRequest, code: "invalid_body",
+			want: PoolConfig{MaxIdleConnsPerHost: 16, TLSSessionCache: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := poolRequest(t, admin, http.MethodPut, tt.body, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), `"error":"`+tt.code+`"`) {
+				t.Errorf("body %s, want error %q", w.Body, tt.code)
+			}
+
+			var pool struct {
+				Settings PoolConfig `json:"settings"`
+			}
+			poolRequest(t, admin, http.MethodGet, "", &pool)
+			if pool.Settings != tt.want {
+				t.Errorf("settings %+v, want %+v", pool.Settings, tt.want)
+			}
+			// New requests use transports built with the settings
+			h.transports.mu.Lock()
+			tcp := h.transports.tcp
+			h.transports.mu.Unlock()
+			if tcp.MaxIdleConnsPerHost != tt.want.MaxIdleConnsPerHost || tcp.MaxConnsPerHost != tt.want.MaxConnsPerHost {
+				t.Errorf("transport limits %d/%d, want %d/%d", tcp.MaxIdleConnsPerHost, tcp.MaxConnsPerHost,
+					tt.want.MaxIdleConnsPerHost, tt.want.MaxConnsPerHost)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// defaultPrewarmSchedule refreshes pinned entries hourly unless configured otherwise
+const defaultPrewarmSchedule = "@every 1h"
+
+// PrewarmConfig is a URL fetched into the cache at startup and refreshed on a schedule
+type PrewarmConfig struct {
+	URL      string `json:"url"`      // upstream URL, e.g. "https://cdn.example.com/app.js"
+	Schedule string `json:"schedule"` // cron expression or "@every 10m"; default hourly
+}
+
+// prewarmJob is a compiled PrewarmConfig
+type prewarmJob struct {
+	url      string
+	schedule *cronSchedule
+}
+
+// compilePrewarm validates the prewarm entries
+func compilePrewarm(configs []PrewarmConfig) ([]prewarmJob, error) {
+	jobs := make([]prewarmJob, 0, len(configs))
+	for _, pc := range configs {
+		spec := pc.Schedule
+		if spec == "" {
+			spec = defaultPrewarmSchedule
+		}
+		schedule, err := parseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("prewarm %s: %w", pc.URL, err)
+		}
+		if u, err := url.Parse(pc.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("prewarm %s: expected an absolute URL", pc.URL)
+		}
+		jobs = append(jobs, prewarmJob{url: pc.URL, schedule: schedule})
+	}
+	return jobs, nil
+}
+
+// runPrewarm fetches every job now and again on its schedule until ctx is done
+func (h *ProxyHandler) runPrewarm(ctx context.Context, jobs []prewarmJob) {
+	for _, job := range jobs {
+		go func(job prewarmJob) {
+			for {
+				if err := h.prewarm(ctx, job.url); err != nil {
+					// The previously pinned copy, if any, keeps being served
+					h.logger.Printf("Prewarm %s failed: %v", job.url, err)
+				} else {
+					h.logger.Printf("Prewarmed %s", job.url)
+				}
+
+				next := job.schedule.next(time.Now())
+				if next.IsZero() {
+					h.logger.Printf("Prewarm %s: schedule never fires again; no longer refreshing", job.url)
+					return
+				}
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+		}(job)
+	}
+}
+
+// prewarm fetches rawURL through every route that reaches it, or as a path-embedded target
+// when none does, and pins the responses in the cache. Each route keeps its own entries,
+// fetched with its own upstream headers and filters.
+func (h *ProxyHandler) prewarm(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://prewarm.invalid/", nil)
+	if err != nil {
+		return err
+	}
+	// Address the upstream the same way a client would, as a path-embedded target
+	req.Host = ""
+	req.URL.Path = "/" + u.Scheme + "://" + u.Host + u.Path
+	req.URL.RawQuery = u.RawQuery
+
+	targets := h.prewarmTargets(u)
+	if len(targets) == 0 {
+		target, err := h.resolveTarget(req, nil)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	}
+
+	var errs []error
+	for _, target := range targets {
+		if err := h.prewarmTarget(req, target); err != nil {
+			if target.Route != nil {
+				err = fmt.Errorf("route %s: %w", target.Route.Name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prewarmTargets returns a target for u on every route whose upstream serves it
+func (h *ProxyHandler) prewarmTargets(u *url.URL) []*proxyTarget {
+	var targets []*proxyTarget
+	for _, route := range h.allRoutes() {
+		up := route.Upstream
+		if route.Socket != "" || up.Scheme != u.Scheme || up.Host != u.Host {
+			continue
+		}
+		if len(route.Methods) > 0 && !slices.Contains(route.Methods, http.MethodGet) {
+			continue
+		}
+		if _, ok := matchPrefix(u.Path, up.Path); up.Path != "" && !ok {
+			continue
+		}
+		targets = append(targets, &proxyTarget{URL: up, Path: u.Path, Route: route})
+	}
+	return targets
+}
+
+// prewarmTarget fetches req from target and pins the response
+func (h *ProxyHandler) prewarmTarget(req *http.Request, target *proxyTarget) error {
+	capture := &captureWriter{ResponseWriter: newDiscardWriter(), limit: h.cache.maxEntry}
+	h.serveProxy(capture, req, target, false)
+
+	if capture.status != http.StatusOK {
+		return fmt.Errorf("upstream answered %d", capture.status)
+	}
+	if capture.overflow {
+		return fmt.Errorf("response exceeds cache max_entry_size")
+	}
+
+	// Pinned entries stay servable until the next refresh replaces them
+	h.cache.put(cacheBaseKey(req, target), capture.status, capture.header, capture.buf.Bytes(), time.Time{}, true)
+	return nil
+}
+
+// discardWriter is a ResponseWriter that keeps headers and drops the body
+type discardWriter struct {
+	header http.Header
+}
+
+// newDiscardWriter creates an empty discardWriter
+func newDiscardWriter() *discardWriter {
+	return &discardWriter{header: http.Header{}}
+}
+
+// Header implements http.ResponseWriter
+func (d *discardWriter) Header() http.Header { return d.header }
+
+// Write implements http.ResponseWriter
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// WriteHeader implements http.ResponseWriter
+func (d *discardWriter) WriteHeader(int) {}
@@ -0,0 +1,397 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Copy buffer sizes: larger buffers mean fewer reads and writes per large transfer,
+// at the cost of memory per response in flight
+const (
+	defaultCopyBuffer = 32 << 10
+	minCopyBuffer     = 4 << 10
+	maxCopyBuffer     = 1 << 20
+)
+
+// proxyBufferPool recycles the copy buffers of the shared reverse proxies
+type proxyBufferPool struct {
+	size atomic.Int64
+	pool sync.Pool
+}
+
+// newProxyBufferPool returns a pool of buffers of the configured size
+func newProxyBufferPool(cfg *PoolConfig) *proxyBufferPool {
+	p := &proxyBufferPool{}
+	var size ByteSize
+	if cfg != nil {
+		size = cfg.CopyBuffer
+	}
+	p.resize(size)
+	return p
+}
+
+// resize makes new buffers size bytes long, or the default for 0. Buffers of the old
+// size are dropped as they come back.
+func (p *proxyBufferPool) resize(size ByteSize) {
+	if size == 0 {
+		size = defaultCopyBuffer
+	}
+	p.size.Store(int64(size))
+}
+
+// Get implements httputil.BufferPool
+func (p *proxyBufferPool) Get() []byte {
+	size := int(p.size.Load())
+	if buf, ok := p.pool.Get().(*[]byte); ok && len(*buf) == size {
+		return *buf
+	}
+	return make([]byte, size)
+}
+
+// Put implements httputil.BufferPool
+func (p *proxyBufferPool) Put(buf []byte) {
+	if len(buf) == int(p.size.Load()) {
+		p.pool.Put(&buf)
+	}
+}
+
+// proxyState is what the shared reverse proxies need to know about one request.
+// It travels in the request context, from the director to the transport, the
+// response modifiers and the error handler.
+type proxyState struct {
+	target   *proxyTarget
+	grpc     bool
+	filter   *contentFilter
+	rewrite  *bodyRewriter
+	security *securityHeaders
+	hooks    []registeredHook // the embedder hooks when the request started
+
+	imageOpts *imageOptions // parsed by the director, which sees the request first
+}
+
+// statusClientClosedRequest is recorded, as nginx does, for requests the client gave up on
+// before the upstream answered; nothing reaches the client
+const statusClientClosedRequest = 499
+
+// proxyStateKey is the context key of a request's proxyState
+type proxyStateKey struct{}
+
+// proxyStateFrom returns the state serveProxy attached to ctx
+func proxyStateFrom(ctx context.Context) *proxyState {
+	st, _ := ctx.Value(proxyStateKey{}).(*proxyState)
+	return st
+}
+
+// newSharedProxy builds the reverse proxy every request to an upstream goes through;
+// everything specific to a request is read from its proxyState
+func (h *ProxyHandler) newSharedProxy(grpc bool) *httputil.ReverseProxy {
+	proxy := &httputil.ReverseProxy{
+		Director:       h.direct,
+		Transport:      proxyTransport{h: h},
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.proxyError,
+		BufferPool:     h.buffers,
+	}
+	// gRPC streams must be flushed message by message
+	if grpc {
+		proxy.FlushInterval = -1
+	}
+	return proxy
+}
+
+// serveProxy forwards r to target through the shared reverse proxy
+func (h *ProxyHandler) serveProxy(w http.ResponseWriter, r *http.Request, target *proxyTarget, grpc bool) {
+	st := &proxyState{
+		target:   target,
+		grpc:     grpc,
+		filter:   h.contentFilterFor(target),
+		rewrite:  h.bodyRewriterFor(target),
+		security: h.securityHeadersFor(target),
+		hooks:    h.hooks.current(),
+	}
+	r = r.WithContext(context.WithValue(r.Context(), proxyStateKey{}, st))
+	if h.uploads != nil {
+		defer h.uploads.track(r, target)()
+	}
+	if grpc {
+		h.grpcProxy.ServeHTTP(w, r)
+		return
+	}
+	h.proxy.ServeHTTP(w, r)
+}
+
+// proxyTransport sends each request through the transport chain of its target
+type proxyTransport struct {
+	h *ProxyHandler
+}
+
+// RoundTrip implements http.RoundTripper
+func (t proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st := proxyStateFrom(req.Context())
+	return t.h.transportFor(st.target, st.grpc).RoundTrip(req)
+}
+
+// transportFor returns the transport for target, wrapped for the route's features
+func (h *ProxyHandler) transportFor(target *proxyTarget, grpc bool) http.RoundTripper {
+	transport := h.transports.forTarget(target, grpc)
+	route := target.Route
+	if route == nil {
+		return transport
+	}
+	// Signing comes first so every hedged attempt carries a fresh signature
+	if route.Signer != nil {
+		transport = &signingTransport{RoundTripper: transport, signer: route.Signer, secrets: h.secrets}
+	}
+	// gRPC streams are never hedged: replaying a stream is not the same as replaying a request
+	if route.Hedging != nil && !grpc {
+		transport = &hedgingTransport{RoundTripper: transport, policy: route.Hedging, route: route.Name, counts: h.hedges}
+	}
+	// The candidate is sent the request once, however many attempts the primary takes
+	if route.Differ != nil && !grpc {
+		transport = &diffTransport{RoundTripper: transport, differ: route.Differ, route: route, recorder: h.diffs, h: h}
+	}
+	// Writes are queued last, after every attempt above has failed
+	if route.Queue != nil && !grpc {
+		if queue, err := h.queueFor(route.Queue); err != nil {
+			h.logger.Printf("Write queue for route %s: %v", route.Name, err)
+		} else {
+			transport = &queueTransport{RoundTripper: transport, policy: route.Queue, queue: queue, target: target, h: h}
+		}
+	}
+	return &connReuseTransport{RoundTripper: transport, route: route.Name, counts: h.connReuse}
+}
+
+// direct points the outgoing request at its target
+func (h *ProxyHandler) direct(req *http.Request) {
+	st := proxyStateFrom(req.Context())
+	targetURL := st.target.URL
+
+	// Set the target URL components
+	req.URL.Scheme = targetURL.Scheme
+	req.URL.Host = targetURL.Host
+	req.URL.Path = st.target.Path
+
+	// Set the Host header to the target host
+	req.Host = hostHeader(targetURL)
+
+	// Derived images are made from the whole source; the upstream never sees the parameters
+	if h.images != nil {
+		if st.imageOpts, _ = h.images.parse(req.URL.Query()); st.imageOpts != nil {
+			req.URL.RawQuery = stripImageParams(req.URL.RawQuery)
+			req.Header.Del("Range")
+			req.Header.Del("If-Range")
+		}
+	}
+
+	// Compressed bodies cannot be rewritten, so ask for them uncompressed
+	if st.rewrite != nil {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	// Credentials embedded in the target become Basic auth, as a browser would send them
+	if targetURL.User != nil {
+		password, _ := targetURL.User.Password()
+		req.SetBasicAuth(targetURL.User.Username(), password)
+	}
+
+	// Credentials from the route, with secrets at their current value
+	if route := st.target.Route; route != nil {
+		for _, uh := range route.UpstreamHeaders {
+			value, err := h.secrets.expand(uh.value)
+			if err != nil {
+				h.logger.Printf("Upstream header %s of route %s not sent: %v", uh.name, route.Name, err)
+				continue
+			}
+			req.Header.Set(uh.name, value)
+		}
+	}
+
+	// Add proxy headers for debugging and tracking
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Origin-Host", req.Host)
+	// Appended rather than set, so chained proxygo hops can be counted for loop detection
+	req.Header.Add("X-Proxy-By", "proxygo")
+	if h.via != nil {
+		h.via.add(req.Header, req.ProtoMajor, req.ProtoMinor)
+	}
+
+	// Let the upstream log the same request ID the client sees
+	if _, info := withRequestInfo(req); info.RequestID != "" {
+		req.Header.Set("X-Request-Id", info.RequestID)
+	}
+}
+
+// modifyResponse runs the response hooks in order; the first error aborts the response
+func (h *ProxyHandler) modifyResponse(resp *http.Response) error {
+	st := proxyStateFrom(resp.Request.Context())
+
+	// The client already has our X-Request-Id; don't repeat it if the upstream echoes it
+	resp.Header.Del("X-Request-Id")
+
+	if h.via != nil {
+		if err := h.via.modifyResponse(resp); err != nil {
+			return err
+		}
+	}
+
+	// Refuse responses whose content type is filtered out
+	if st.filter != nil {
+		if err := st.filter.checkResponse(resp); err != nil {
+			return err
+		}
+	}
+
+	// Count downloads by what the upstream sent, before any transform changes the length.
+	// A range fill is served from the cache like a hit, or abandoned for the client's own
+	// request, which is counted; counting the fill as well would count the request twice.
+	if resp.Request.Context().Value(rangeFillKey{}) == nil {
+		if err := h.downloads.modifyResponse(resp); err != nil {
+			return err
+		}
+	}
+
+	if h.images != nil && st.imageOpts != nil {
+		if err := h.images.modifyResponse(resp, st.imageOpts); err != nil {
+			return err
+		}
+	}
+
+	// Rewrite text bodies before embedder hooks and integrity hashing see them
+	if st.rewrite != nil {
+		if err := st.rewrite.modifyResponse(resp); err != nil {
+			return err
+		}
+	}
+
+	// Embedder hooks see only responses the filter let through
+	for _, hook := range st.hooks {
+		if err := hook.fn(resp); err != nil {
+			return &hookFailure{name: hook.name, err: err}
+		}
+	}
+
+	// Harden headers after the hooks so an embedder cannot reintroduce Server and friends
+	if st.security != nil {
+		if err := st.security.modifyResponse(resp); err != nil {
+			return err
+		}
+	}
+
+	// Hash the body last so the digest covers exactly what the client receives
+	if h.integrity != nil {
+		return h.integrity.modifyResponse(resp)
+	}
+	return nil
+}
+
+// proxyError answers a request the upstream could not serve
+func (h *ProxyHandler) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	st := proxyStateFrom(r.Context())
+	target := st.target
+
+	// A client that hung up cancels the upstream request; that is not the upstream failing
+	if clientGone(r) {
+		h.logger.Printf("Client closed %s before the upstream answered", r.URL.Path)
+		h.clientAborts.inc(routeName(target), "waiting")
+		h.reportError(r, target, &ProxyError{Kind: ErrClientClosed, Status: statusClientClosedRequest, Code: "client_closed", Message: "client closed the request", Err: err})
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	h.logger.Printf("Proxy error for %s: %v", r.URL.Path, err)
+
+	perr := h.classifyProxyError(r, err)
+	if errors.Is(perr, ErrUpstreamFailed) || errors.Is(perr, ErrUpstreamUnreachable) || errors.Is(perr, ErrUpstreamTimeout) {
+		h.upstreamErrors.inc(routeName(target), "waiting")
+	}
+	if st.grpc {
+		h.reportError(r, target, perr)
+		writeGRPCError(w, grpcStatusUnavailable, fmt.Sprintf("proxy error: %v", err))
+		return
+	}
+	h.writeProxyError(w, r, target, perr)
+}
+
+// classifyProxyError turns a failed round trip into the error response for it
+func (h *ProxyHandler) classifyProxyError(r *http.Request, err error) *ProxyError {
+	perr := &ProxyError{Err: err, Message: err.Error()}
+	var blocked *contentBlockedError
+	var hookErr *hookFailure
+	switch {
+	case errors.As(err, &blocked):
+		h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "content_blocked", Details: map[string]string{"detail": blocked.Error()}})
+		perr.Status, perr.Code, perr.Message = http.StatusForbidden, "content_blocked", blocked.Error()
+	case errors.As(err, &hookErr):
+		perr.Status, perr.Code, perr.Message = hookErr.response()
+	case errors.Is(err, errTooManyDownloads):
+		perr.Status, perr.Code = http.StatusTooManyRequests, "too_many_downloads"
+	case errors.Is(err, errSigningBodyTooLarge):
+		perr.Status, perr.Code = http.StatusRequestEntityTooLarge, "body_too_large"
+	case errors.Is(err, errIntegrityMismatch):
+		perr.Status, perr.Code = http.StatusBadGateway, "integrity_mismatch"
+	case errors.Is(err, errDestinationDenied):
+		h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "destination_denied", Details: map[string]string{"upstream": r.URL.Host}})
+		perr.Status, perr.Code, perr.Message = http.StatusForbidden, "destination_denied", "Proxy error: "+err.Error()
+	case errors.Is(err, errOutsideFilesRoot):
+		h.audit(r, auditEvent{Event: auditRequestDenied, Status: http.StatusForbidden, Reason: "destination_denied", Details: map[string]string{"upstream": r.URL.Path}})
+		perr.Status, perr.Code, perr.Message = http.StatusForbidden, "destination_denied", "Proxy error: "+err.Error()
+	default:
+		perr.Kind = upstreamErrorKind(err)
+		perr.Message = "Proxy error: " + err.Error()
+		switch perr.Kind {
+		case ErrUpstreamTimeout:
+			perr.Status, perr.Code = http.StatusGatewayTimeout, "upstream_timeout"
+		case ErrUpstreamUnreachable:
+			perr.Status, perr.Code = http.StatusBadGateway, "upstream_unreachable"
+		default:
+			perr.Status, perr.Code = http.StatusBadGateway, "upstream_error"
+		}
+		return perr
+	}
+	perr.Kind = errorKind(perr.Status, perr.Code)
+	return perr
+}
+
+// recordAbort, deferred around serveProxy, counts a response that broke off mid-body
+// against the client or the upstream, whichever went away, and lets the abort continue
+func (h *ProxyHandler) recordAbort(r *http.Request, rec *statusRecorder, target *proxyTarget) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		if rec.writeErr != nil || clientGone(r) {
+			h.clientAborts.inc(routeName(target), "streaming")
+		} else {
+			h.upstreamErrors.inc(routeName(target), "streaming")
+		}
+	}
+	panic(v)
+}
+
+// clientGone reports whether the client cancelled r, by disconnecting or resetting its stream
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// routeName labels metrics by route, "" for targets outside any route
+func routeName(target *proxyTarget) string {
+	if target == nil || target.Route == nil {
+		return ""
+	}
+	return target.Route.Name
+}
+
+// routeIdentity tells target's route apart from every other route, including ones that
+// share its name; "" for path-embedded targets
+func routeIdentity(target *proxyTarget) string {
+	if target == nil || target.Route == nil {
+		return ""
+	}
+	return strconv.FormatUint(target.Route.id, 10)
+}
@@ -0,0 +1,423 @@
+package proxygo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// discardResponseWriter throws the response away, so benchmarks measure the proxy and
+// not a recorder growing its buffer
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) Flush() {}
+
+// newBenchUpstream serves size bytes on every request, after reading the request body
+func newBenchUpstream(b *testing.B, size int) *httptest.Server {
+	b.Helper()
+	body := bytes.Repeat([]byte("x"), size)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(body)
+	}))
+	b.Cleanup(upstream.Close)
+	return upstream
+}
+
+// benchServe proxies newRequest() through h b.N times, failing on any status but 200
+func benchServe(b *testing.B, h *ProxyHandler, newRequest func() *http.Request) {
+	b.Helper()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &discardResponseWriter{}
+		h.ServeHTTP(w, newRequest())
+		if w.status != http.StatusOK {
+			b.Fatalf("status %d", w.status)
+		}
+	}
+}
+
+func BenchmarkServeHTTPEmbeddedTarget(b *testing.B) {
+	upstream := newBenchUpstream(b, 512)
+	h := newTestHandler(b, `{}`)
+	benchServe(b, h, func() *http.Request {
+		return httptest.NewRequest("GET", "/"+upstream.URL+"/api/items?page=2", nil)
+	})
+}
+
+func BenchmarkServeHTTPRoute(b *testing.B) {
+	upstream := newBenchUpstream(b, 512)
+	h := newTestHandler(b, `{"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	benchServe(b, h, func() *http.Request {
+		return httptest.NewRequest("GET", "/api/items?page=2", nil)
+	})
+}
+
+func BenchmarkServeHTTPRouteBody(b *testing.B) {
+	upstream := newBenchUpstream(b, 256<<10)
+	h := newTestHandler(b, `{"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	body := strings.Repeat("y", 256<<10)
+	b.SetBytes(int64(2 * len(body)))
+	benchServe(b, h, func() *http.Request {
+		return httptest.NewRequest("POST", "/api/upload", strings.NewReader(body))
+	})
+}
+
+func BenchmarkCopy(b *testing.B) {
+	for _, size := range []int{1 << 20, 8 << 20} {
+		upstream := newBenchUpstream(b, size)
+		for _, buffer := range []string{"32KB", "256KB", "1MB"} {
+			b.Run(fmt.Sprintf("body=%dMB/buffer=%s", size>>20, buffer), func(b *testing.B) {
+				h := newTestHandler(b, `{"pool": {"copy_buffer": "`+buffer+`"},
+					"routes": [{"name": "files", "prefix": "/files/", "upstream": "`+upstream.URL+`"}]}`)
+				b.SetBytes(int64(size))
+				benchServe(b, h, func() *http.Request {
+					return httptest.NewRequest("GET", "/files/blob", nil)
+				})
+			})
+		}
+	}
+}
+
+// newTrailerUpstream streams a chunked body ending in an unannounced X-Late trailer and,
+// with announce, an announced Grpc-Status one; release, when set, holds every response
+// until it is closed
+func newTrailerUpstream(t *testing.T, announce bool, release chan struct{}) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if release != nil {
+			<-release
+		}
+		if announce {
+			w.Header().Set("Trailer", "Grpc-Status")
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		for _, chunk := range []string{"one ", "two ", "three"} {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+		if announce {
+			w.Header().Set("Grpc-Status", "0")
+		}
+		w.Header().Set(http.TrailerPrefix+"X-Late", "done")
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &hits
+}
+
+// checkTrailers fetches url and fails unless the body arrives chunked with the trailers
+// newTrailerUpstream sends
+func checkTrailers(t *testing.T, url string, announce bool) *http.Response {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("reading body: %v", err)
+		return resp
+	}
+	if string(body) != "one two three" {
+		t.Errorf("body = %q", body)
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("length %d, transfer encoding %q; want a chunked body", resp.ContentLength, resp.TransferEncoding)
+	}
+	want := http.Header{"X-Late": {"done"}}
+	if announce {
+		want.Set("Grpc-Status", "0")
+	}
+	if got := resp.Trailer; !reflect.DeepEqual(got, want) {
+		t.Errorf("trailers = %v, want %v", got, want)
+	}
+	return resp
+}
+
+func TestTrailers(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string // top-level settings besides the route
+	}{
+		{name: "plain"},
+		{name: "integrity", config: `"integrity": {"enabled": true},`},
+		{name: "cache", config: `"cache": {"enabled": true},`},
+		{name: "coalesce", config: `"coalesce": {"enabled": true},`},
+	}
+	for _, tt := range tests {
+		for _, announce := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/announced=%v", tt.name, announce), func(t *testing.T) {
+				upstream, hits := newTrailerUpstream(t, announce, nil)
+				h := newTestHandler(t, `{`+tt.config+`"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+				proxy := httptest.NewServer(h)
+				t.Cleanup(proxy.Close)
+
+				resp := checkTrailers(t, proxy.URL+"/api/stream", announce)
+				if tt.name == "integrity" && resp != nil && resp.Header.Get(contentSHA256Header) == "" {
+					t.Errorf("no %s header on a buffered body", contentSHA256Header)
+				}
+				// A second fetch must not be answered from a stored copy without the trailers
+				checkTrailers(t, proxy.URL+"/api/stream", announce)
+				if n := hits.Load(); n != 2 {
+					t.Errorf("%d upstream requests for two fetches, want 2", n)
+				}
+			})
+		}
+	}
+}
+
+func TestTrailersCoalesced(t *testing.T) {
+	release := make(chan struct{})
+	upstream, _ := newTrailerUpstream(t, false, release)
+	h := newTestHandler(t, `{"coalesce": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	proxy := httptest.NewServer(h)
+	t.Cleanup(proxy.Close)
+
+	// Requests waiting on the same upstream response each get its trailers
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkTrailers(t, proxy.URL+"/api/stream", false)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+}
+
+func TestProxyBufferPool(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *PoolConfig
+		want int
+	}{
+		{name: "no pool config", want: defaultCopyBuffer},
+		{name: "default", cfg: &PoolConfig{}, want: defaultCopyBuffer},
+		{name: "configured", cfg: &PoolConfig{CopyBuffer: 256 << 10}, want: 256 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(newProxyBufferPool(tt.cfg).Get()); got != tt.want {
+				t.Errorf("buffer of %d bytes, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Buffers of the old size never come back out after a resize
+	p := newProxyBufferPool(nil)
+	old := p.Get()
+	p.resize(minCopyBuffer)
+	p.Put(old)
+	for range 10 {
+		if got := len(p.Get()); got != minCopyBuffer {
+			t.Fatalf("buffer of %d bytes after resizing to %d", got, minCopyBuffer)
+		}
+	}
+}
+
+func TestCopyBufferConfig(t *testing.T) {
+	tests := []struct {
+		size ByteSize
+		err  bool
+	}{
+		{size: 0},
+		{size: minCopyBuffer},
+		{size: maxCopyBuffer},
+		{size: minCopyBuffer - 1, err: true},
+		{size: 2 << 20, err: true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Pool: &PoolConfig{CopyBuffer: tt.size}}
+		err := cfg.normalize()
+		if (err != nil) != tt.err {
+			t.Errorf("copy_buffer %d: %v, want error %v", tt.size, err, tt.err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "copy_buffer must be between 4KB and 1MB") {
+			t.Errorf("copy_buffer %d: %v", tt.size, err)
+		}
+	}
+}
+
+func TestCopyBufferReload(t *testing.T) {
+	h := newTestHandler(t, `{"pool": {"max_idle_conns_per_host": 4}}`)
+	tests := []struct {
+		name    string
+		pool    PoolConfig
+		buffer  int
+		rebuilt bool // whether the upstream transports were replaced
+	}{
+		{name: "copy buffer only", pool: PoolConfig{MaxIdleConnsPerHost: 4, CopyBuffer: 512 << 10}, buffer: 512 << 10},
+		{name: "back to the default", pool: PoolConfig{MaxIdleConnsPerHost: 4}, buffer: defaultCopyBuffer},
+		{name: "transport setting", pool: PoolConfig{MaxIdleConnsPerHost: 8, CopyBuffer: 64 << 10}, buffer: 64 << 10, rebuilt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := h.transports.tcp
+			cfg := *h.config.Load()
+			cfg.Pool = &tt.pool
+			h.Reload(&cfg)
+			if got := len(h.buffers.Get()); got != tt.buffer {
+				t.Errorf("buffer of %d bytes, want %d", got, tt.buffer)
+			}
+			if rebuilt := h.transports.tcp != before; rebuilt != tt.rebuilt {
+				t.Errorf("transports rebuilt: %v, want %v", rebuilt, tt.rebuilt)
+			}
+		})
+	}
+}
+
+func TestAborts(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream http.HandlerFunc
+		client   func(t *testing.T, url string)
+		aborts   string // stage counted as a client abort
+		errors   string // stage counted as an upstream error
+	}{
+		{
+			name: "client leaves while waiting",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			client: func(t *testing.T, url string) {
+				client := &http.Client{Timeout: 50 * time.Millisecond}
+				if resp, err := client.Get(url); err == nil {
+					resp.Body.Close()
+					t.Error("the request was answered")
+				}
+			},
+			aborts: "waiting",
+		},
+		{
+			name: "client leaves mid-body",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				for {
+					if _, err := io.WriteString(w, strings.Repeat("x", 1024)); err != nil {
+						return
+					}
+					w.(http.Flusher).Flush()
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(5 * time.Millisecond):
+					}
+				}
+			},
+			client: func(t *testing.T, url string) {
+				resp, err := http.Get(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.ReadFull(resp.Body, make([]byte, 1024))
+				resp.Body.Close()
+			},
+			aborts: "streaming",
+		},
+		{
+			name: "upstream breaks off mid-body",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "100")
+				io.WriteString(w, "short")
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			},
+			client: func(t *testing.T, url string) {
+				// The headers may not have reached the client before the abort
+				resp, err := http.Get(url)
+				if err != nil {
+					return
+				}
+				defer resp.Body.Close()
+				if _, err := io.ReadAll(resp.Body); err == nil {
+					t.Error("the truncated body read cleanly")
+				}
+			},
+			errors: "streaming",
+		},
+		{
+			name: "upstream unreachable",
+			client: func(t *testing.T, url string) {
+				resp, err := http.Get(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusBadGateway {
+					t.Errorf("status %d, want 502", resp.StatusCode)
+				}
+			},
+			errors: "waiting",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamURL := "http://127.0.0.1:1"
+			if tt.upstream != nil {
+				upstream := httptest.NewServer(tt.upstream)
+				defer upstream.Close()
+				upstreamURL = upstream.URL
+			}
+			h := newTestHandler(t, `{"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstreamURL+`"}]}`)
+			proxy := httptest.NewServer(h)
+			defer proxy.Close()
+
+			tt.client(t, proxy.URL+"/api/x")
+			for _, stage := range []string{"waiting", "streaming"} {
+				wantAborts, wantErrors := 0.0, 0.0
+				if stage == tt.aborts {
+					wantAborts = 1
+				}
+				if stage == tt.errors {
+					wantErrors = 1
+				}
+				waitUntil(t, "the "+stage+" counters", func() bool {
+					return h.clientAborts.value("api", stage) == wantAborts && h.upstreamErrors.value("api", stage) == wantErrors
+				})
+			}
+			if tt.aborts == "waiting" {
+				waitUntil(t, "the client_closed error", func() bool { return h.proxyErrors.value("api", "client_closed") == 1 })
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// Kinds of errors the proxy answers requests with. Every *ProxyError and every error
+// passed to an ErrorExtension matches exactly one of them under errors.Is.
+var (
+	ErrInvalidRequest      = errors.New("invalid request")      // 4xx the client can fix: malformed, too large, conflicting
+	ErrInvalidTarget       = errors.New("invalid target")       // no route, alias or URL in the path to send the request to
+	ErrUnauthorized        = errors.New("unauthorized")         // missing or invalid credentials
+	ErrDenied              = errors.New("denied")               // credentials or client not allowed, or blocked by a rule
+	ErrRateLimited         = errors.New("rate limited")         // a rate, quota or concurrency limit
+	ErrUnavailable         = errors.New("unavailable")          // maintenance, scheduled closure or a dependency of the proxy down
+	ErrLoopDetected        = errors.New("loop detected")        // the target leads back to the proxy
+	ErrUpstreamUnreachable = errors.New("upstream unreachable") // name lookup, connect or TLS handshake failed
+	ErrUpstreamTimeout     = errors.New("upstream timeout")     // the upstream did not answer in time
+	ErrUpstreamFailed      = errors.New("upstream failed")      // any other failure of or refusal by the upstream
+	ErrClientClosed        = errors.New("client closed")        // the client went away before the upstream answered
+	ErrInternal            = errors.New("internal error")       // a fault in the proxy or its configuration
+)
+
+// errorKindLabels names the kinds in metrics
+var errorKindLabels = map[error]string{
+	ErrInvalidRequest:      "invalid_request",
+	ErrInvalidTarget:       "invalid_target",
+	ErrUnauthorized:        "unauthorized",
+	ErrDenied:              "denied",
+	ErrRateLimited:         "rate_limited",
+	ErrUnavailable:         "unavailable",
+	ErrLoopDetected:        "loop_detected",
+	ErrUpstreamUnreachable: "upstream_unreachable",
+	ErrUpstreamTimeout:     "upstream_timeout",
+	ErrUpstreamFailed:      "upstream_failed",
+	ErrClientClosed:        "client_closed",
+	ErrInternal:            "internal",
+}
+
+// ProxyError is an error response produced by the proxy itself rather than the upstream
+type ProxyError struct {
+	Kind    error  // one of the Err kinds above
+	Status  int    // HTTP status sent to the client
+	Code    string // machine-readable code of the error body, e.g. "rate_limited"
+	Message string
+	Err     error // underlying cause, nil when the proxy decided on its own
+}
+
+// Error implements error
+func (e *ProxyError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Kind.Error()
+}
+
+// Unwrap exposes the kind and the cause to errors.Is and errors.As
+func (e *ProxyError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// errorKind returns the kind of a response with status and code. The status decides,
+// except for the few codes that single out a kind within it.
+func errorKind(status int, code string) error {
+	switch code {
+	case "invalid_target":
+		return ErrInvalidTarget
+	case "upstream_unreachable":
+		return ErrUpstreamUnreachable
+	case "too_many_downloads":
+		return ErrRateLimited
+	}
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case status == http.StatusForbidden:
+		return ErrDenied
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case status == statusClientClosedRequest:
+		return ErrClientClosed
+	case status == http.StatusLoopDetected:
+		return ErrLoopDetected
+	case status == http.StatusServiceUnavailable:
+		return ErrUnavailable
+	case status == http.StatusGatewayTimeout:
+		return ErrUpstreamTimeout
+	case status == http.StatusBadGateway:
+		return ErrUpstreamFailed
+	case status >= 400 && status < 500:
+		return ErrInvalidRequest
+	}
+	return ErrInternal
+}
+
+// Is lets errors.Is match API key, auth and tenant rejections against the kinds
+func (e *keyError) Is(target error) bool {
+	return errorKind(e.status, e.code) == target
+}
+
+// invalidTarget wraps an error resolving the request's target
+func invalidTarget(err error) *ProxyError {
+	return &ProxyError{Kind: ErrInvalidTarget, Status: http.StatusBadRequest, Code: "invalid_target", Message: err.Error(), Err: err}
+}
+
+// upstreamErrorKind classifies a failed round trip to the upstream
+func upstreamErrorKind(err error) error {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var certErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrUpstreamTimeout
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH), errors.As(err, &certErr), errors.As(err, &hostErr),
+		errors.As(err, &authErr), errors.As(err, &recordErr):
+		return ErrUpstreamUnreachable
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return ErrUpstreamTimeout
+		}
+		return ErrUpstreamUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrUpstreamTimeout
+	}
+	return ErrUpstreamFailed
+}
@@ -0,0 +1,154 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		want   error
+	}{
+		{status: 400, code: "invalid_target", want: ErrInvalidTarget},
+		{status: 400, code: "bad_request", want: ErrInvalidRequest},
+		{status: 413, code: "body_too_large", want: ErrInvalidRequest},
+		{status: 401, code: "missing_api_key", want: ErrUnauthorized},
+		{status: 403, code: "destination_denied", want: ErrDenied},
+		{status: 429, code: "quota_exceeded", want: ErrRateLimited},
+		{status: 429, code: "too_many_downloads", want: ErrRateLimited},
+		{status: 499, code: "client_closed", want: ErrClientClosed},
+		{status: 508, code: "loop_detected", want: ErrLoopDetected},
+		{status: 503, code: "maintenance", want: ErrUnavailable},
+		{status: 504, code: "upstream_timeout", want: ErrUpstreamTimeout},
+		{status: 502, code: "upstream_unreachable", want: ErrUpstreamUnreachable},
+		{status: 502, code: "integrity_mismatch", want: ErrUpstreamFailed},
+		{status: 500, code: "internal", want: ErrInternal},
+	}
+	for _, tt := range tests {
+		if got := errorKind(tt.status, tt.code); got != tt.want {
+			t.Errorf("errorKind(%d, %q) = %v, want %v", tt.status, tt.code, got, tt.want)
+		}
+	}
+
+	// Key rejections match their kind without being a *ProxyError
+	err := error(&keyError{status: http.StatusTooManyRequests, code: "rate_limited"})
+	if !errors.Is(err, ErrRateLimited) || errors.Is(err, ErrDenied) {
+		t.Errorf("keyError %v does not match only ErrRateLimited", err)
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "deadline", err: fmt.Errorf("round trip: %w", context.DeadlineExceeded), want: ErrUpstreamTimeout},
+		{name: "read deadline", err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, want: ErrUpstreamTimeout},
+		{name: "dial timeout", err: &net.OpError{Op: "dial", Err: timeoutError{}}, want: ErrUpstreamTimeout},
+		{name: "other timeout", err: timeoutError{}, want: ErrUpstreamTimeout},
+		{name: "dns", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "api.internal"}}, want: ErrUpstreamUnreachable},
+		{name: "refused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: ErrUpstreamUnreachable},
+		{name: "dial", err: &net.OpError{Op: "dial", Err: errors.New("network is down")}, want: ErrUpstreamUnreachable},
+		{name: "untrusted", err: x509.UnknownAuthorityError{}, want: ErrUpstreamUnreachable},
+		{name: "reset", err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: ErrUpstreamFailed},
+		{name: "eof", err: io.ErrUnexpectedEOF, want: ErrUpstreamFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamErrorKind(tt.err); got != tt.want {
+				t.Errorf("upstreamErrorKind = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyError(t *testing.T) {
+	cause := &net.DNSError{Err: "no such host", Name: "api.internal"}
+	err := error(&ProxyError{Kind: ErrUpstreamUnreachable, Status: 502, Code: "upstream_unreachable", Err: cause})
+	if !errors.Is(err, ErrUpstreamUnreachable) || errors.Is(err, ErrUpstreamFailed) {
+		t.Error("kind does not match under errors.Is")
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr != cause {
+		t.Error("cause not reachable with errors.As")
+	}
+	if err.Error() != "upstream unreachable" {
+		t.Errorf("Error() = %q, want the kind without a message", err.Error())
+	}
+	if err := invalidTarget(errors.New("no scheme")); !errors.Is(err, ErrInvalidTarget) || err.Error() != "no scheme" || err.Status != 400 {
+		t.Errorf("invalidTarget = %+v", err)
+	}
+}
+
+func TestProxyErrorResponses(t *testing.T) {
+	keyFile := writeTestKeys(t, &APIKey{ID: "open", Hash: hashKey("open-secret")})
+	h := newTestHandler(t, `{"api_keys": {"file": "`+keyFile+`"},
+		"maintenance": {"routes": ["closed"]},
+		"routes": [
+			{"name": "down", "prefix": "/down/", "upstream": "http://127.0.0.1:1"},
+			{"name": "dns", "prefix": "/dns/", "upstream": "http://upstream.invalid"},
+			{"name": "closed", "prefix": "/closed/", "upstream": "http://127.0.0.1:1"}
+		]}`)
+	ext := &stampExtension{}
+	h.errorExtensions = append(h.errorExtensions, ext)
+
+	tests := []struct {
+		path   string
+		key    string
+		status int
+		code   string
+		route  string
+		kind   error
+	}{
+		{path: "/down/x", status: 502, code: "upstream_unreachable", route: "down", kind: ErrUpstreamUnreachable},
+		{path: "/dns/x", status: 502, code: "upstream_unreachable", route: "dns", kind: ErrUpstreamUnreachable},
+		{path: "/closed/x", status: 503, code: "maintenance", route: "closed", kind: ErrUnavailable},
+		{path: "/nowhere", status: 400, code: "invalid_target", kind: ErrInvalidTarget},
+		{path: "/down/x", key: "guess", status: 401, code: "invalid_api_key", route: "down", kind: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code+tt.path, func(t *testing.T) {
+			ext.errors = nil
+			before := h.proxyErrors.value(tt.route, errorKindLabels[tt.kind])
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.key != "" {
+				r.Header.Set("X-API-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), `"error":"`+tt.code+`"`) {
+				t.Fatalf("%d %s, want %d %s", w.Code, w.Body, tt.status, tt.code)
+			}
+			if got := h.proxyErrors.value(tt.route, errorKindLabels[tt.kind]); got != before+1 {
+				t.Errorf("%s errors on route %q counted %v times", errorKindLabels[tt.kind], tt.route, got-before)
+			}
+			if len(ext.errors) != 1 {
+				t.Fatalf("error extension told about %v", ext.errors)
+			}
+			var perr *ProxyError
+			if !errors.As(ext.errors[0], &perr) || perr.Kind != tt.kind || perr.Status != tt.status || perr.Code != tt.code {
+				t.Errorf("error extension told about %+v", ext.errors[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write queue defaults
+const (
+	defaultQueueMaxBody       = 1 << 20
+	defaultQueueMaxSize       = 100 << 20
+	defaultQueueTTL           = 24 * time.Hour
+	defaultQueueRetryInterval = 5 * time.Second
+	queueReplayTimeout        = 30 * time.Second
+	queueTick                 = time.Second
+)
+
+// WriteQueueConfig stores write requests that find the upstream down and replays them, oldest
+// first, once it is back; the client is told 202 Accepted. A request the upstream received
+// just before failing may be replayed, so delivery is at least once.
+type WriteQueueConfig struct {
+	Dir           string   `json:"dir"`            // where queued requests are kept across restarts; required
+	Methods       []string `json:"methods"`        // default POST and PUT
+	OnStatus      []int    `json:"on_status"`      // upstream statuses that also mean down; default 502, 503 and 504
+	MaxBody       ByteSize `json:"max_body"`       // larger requests are never queued; default 1MB
+	MaxSize       ByteSize `json:"max_size"`       // total queued body bytes; default 100MB
+	TTL           Duration `json:"ttl"`            // requests not delivered by then are dropped; default 24h
+	RetryInterval Duration `json:"retry_interval"` // time between replay attempts while the upstream is down; default 5s
+}
+
+// queuePolicy is a compiled WriteQueueConfig
+type queuePolicy struct {
+	dir           string
+	methods       []string
+	onStatus      []int
+	maxBody       int64
+	maxSize       int64
+	ttl           time.Duration
+	retryInterval time.Duration
+}
+
+// newQueuePolicy returns nil when the route does not queue writes
+func newQueuePolicy(cfg *WriteQueueConfig) (*queuePolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("write queue: dir is required")
+	}
+	p := &queuePolicy{
+		dir:           filepath.Clean(cfg.Dir),
+		methods:       []string{http.MethodPost, http.MethodPut},
+		onStatus:      cfg.OnStatus,
+		maxBody:       int64(cfg.MaxBody),
+		maxSize:       int64(cfg.MaxSize),
+		ttl:           time.Duration(cfg.TTL),
+		retryInterval: time.Duration(cfg.RetryInterval),
+	}
+	if len(cfg.Methods) > 0 {
+		p.methods = nil
+		for _, m := range cfg.Methods {
+			p.methods = append(p.methods, strings.ToUpper(m))
+		}
+	}
+	if len(p.onStatus) == 0 {
+		p.onStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if p.maxBody <= 0 {
+		p.maxBody = defaultQueueMaxBody
+	}
+	if p.maxSize <= 0 {
+		p.maxSize = defaultQueueMaxSize
+	}
+	if p.ttl <= 0 {
+		p.ttl = defaultQueueTTL
+	}
+	if p.retryInterval <= 0 {
+		p.retryInterval = defaultQueueRetryInterval
+	}
+	return p, nil
+}
+
+// queuedRequest is one stored request, as it was to be sent upstream
+type queuedRequest struct {
+	ID        string      `json:"id"`
+	Route     string      `json:"route"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Host      string      `json:"host"`
+	Socket    string      `json:"socket,omitempty"`
+	Header    http.Header `json:"header"`              // upstream_headers with their secrets unexpanded
+	Templates []string    `json:"templates,omitempty"` // headers whose secrets replay expands
+	Body      []byte      `json:"body"`
+	QueuedAt  time.Time   `json:"queued_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// queueEntry is the in-memory index of a stored request
+type queueEntry struct {
+	id      string
+	size    int64
+	expires time.Time
+}
+
+// writeQueue is the on-disk queue of one directory, shared by every route that names it
+type writeQueue struct {
+	dir string
+
+	mu      sync.Mutex
+	entries []queueEntry // oldest first
+	size    int64
+	lastID  int64
+	next    time.Time // earliest time of the next replay attempt
+	busy    bool
+}
+
+// openWriteQueue creates dir if needed and indexes the requests already stored in it
+func openWriteQueue(dir string) (*writeQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("write queue: %w", err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+
+	q := &writeQueue{dir: dir}
+	for _, name := range names {
+		qr, err := q.load(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("write queue: %s: %w", name, err)
+		}
+		q.entries = append(q.entries, queueEntry{id: qr.ID, size: int64(len(qr.Body)), expires: qr.ExpiresAt})
+		q.size += int64(len(qr.Body))
+		if n, err := strconv.ParseInt(qr.ID, 10, 64); err == nil && n > q.lastID {
+			q.lastID = n
+		}
+	}
+	return q, nil
+}
+
+// pending reports whether requests are waiting, in which case new ones queue behind them
+func (q *writeQueue) pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries) > 0
+}
+
+// depth returns how many requests are waiting
+func (q *writeQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// push stores qr, refusing it when the queue is full
+func (q *writeQueue) push(qr *queuedRequest, p *queuePolicy) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size+int64(len(qr.Body)) > p.maxSize {
+		return fmt.Errorf("write queue %s is full", q.dir)
+	}
+
+	// IDs are increasing timestamps, so file names sort in queue order
+	id := max(time.Now().UnixNano(), q.lastID+1)
+	q.lastID = id
+	qr.ID = fmt.Sprintf("%020d", id)
+
+	data, err := json.Marshal(qr)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.dir, qr.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	q.entries = append(q.entries, queueEntry{id: qr.ID, size: int64(len(qr.Body)), expires: qr.ExpiresAt})
+	q.size += int64(len(qr.Body))
+	if len(q.entries) == 1 {
+		// The upstream just failed; give it a moment before the first replay
+		q.next = time.Now().Add(p.retryInterval)
+	}
+	return nil
+}
+
+// load reads a stored request
+func (q *writeQueue) load(id string) (*queuedRequest, error) {
+	data, err := os.ReadFile(filepath.Join(q.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	qr := &queuedRequest{}
+	if err := json.Unmarshal(data, qr); err != nil {
+		return nil, err
+	}
+	return qr, nil
+}
+
+// remove drops the oldest request, which replay has delivered or given up on
+func (q *writeQueue) remove(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 || q.entries[0].id != id {
+		return
+	}
+	q.size -= q.entries[0].size
+	q.entries = q.entries[1:]
+	os.Remove(filepath.Join(q.dir, id+".json"))
+}
+
+// oldest returns the request at the head of the queue
+func (q *writeQueue) oldest() (queueEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return queueEntry{}, false
+	}
+	return q.entries[0], true
+}
+
+// upstreamDown reports whether err means the upstream could not be reached, rather than
+// that the client went away or a local rule refused the request
+func upstreamDown(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !errors.Is(err, errDestinationDenied)
+}
+
+// queueTransport stores writes that the upstream cannot take and answers them with 202
+type queueTransport struct {
+	http.RoundTripper
+	policy *queuePolicy
+	queue  *writeQueue
+	target *proxyTarget
+	h      *ProxyHandler
+}
+
+// RoundTrip implements http.RoundTripper. Once anything is queued, later writes queue behind
+// it so the upstream sees them in order.
+func (t *queueTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !slices.Contains(t.policy.methods, req.Method) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, t.policy.maxBody+1))
+		if err != nil {
+			return nil, err
+		}
+		rest := req.Body
+		req = req.Clone(req.Context())
+		if int64(len(body)) > t.policy.maxBody {
+			// Too large to keep: forward as is and let failures be failures
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), rest), rest}
+			return t.RoundTripper.RoundTrip(req)
+		}
+		rest.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+
+	if t.queue.pending() {
+		return t.enqueue(req, body, nil)
+	}
+	resp, err := t.RoundTripper.RoundTrip(req)
+	switch {
+	case err != nil && upstreamDown(req.Context(), err):
+		return t.enqueue(req, body, err)
+	case err == nil && slices.Contains(t.policy.onStatus, resp.StatusCode):
+		queued, qerr := t.enqueue(req, body, nil)
+		if qerr != nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		return queued, nil
+	}
+	return resp, err
+}
+
+// enqueue stores req and answers 202; when the queue is full the client gets cause, the
+// upstream's own error, or a 503 without one
+func (t *queueTransport) enqueue(req *http.Request, body []byte, cause error) (*http.Response, error) {
+	_, info := withRequestInfo(req)
+	now := time.Now().UTC()
+	qr := &queuedRequest{
+		Route:     t.target.Route.Name,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Host:      req.Host,
+		Socket:    t.target.Socket,
+		Header:    req.Header.Clone(),
+		Body:      body,
+		QueuedAt:  now,
+		ExpiresAt: now.Add(t.policy.ttl),
+	}
+	// Secrets are not written to the queue, and may have rotated by the time it drains
+	for _, uh := range t.target.Route.UpstreamHeaders {
+		if qr.Header.Get(uh.name) != "" {
+			qr.Header.Set(uh.name, uh.value)
+			qr.Templates = append(qr.Templates, uh.name)
+		}
+	}
+	if err := t.queue.push(qr, t.policy); err != nil {
+		t.h.queueEvents.inc(t.target.Route.Name, "rejected")
+		t.h.logger.Printf("Not queueing %s %s: %v", req.Method, req.URL.Path, err)
+		if cause != nil {
+			return nil, cause
+		}
+		return textResponse(req, http.StatusServiceUnavailable, "Upstream unavailable and the write queue is full"), nil
+	}
+	t.h.queueEvents.inc(t.target.Route.Name, "queued")
+
+	doc, _ := json.Marshal(map[string]any{"queued": true, "request_id": info.RequestID, "expires_at": qr.ExpiresAt})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return localResponse(req, http.StatusAccepted, header, io.NopCloser(bytes.NewReader(doc)), int64(len(doc))), nil
+}
+
+// queueFor returns the queue behind policy, opening it on first use
+func (h *ProxyHandler) queueFor(policy *queuePolicy) (*writeQueue, error) {
+	h.queuesMu.Lock()
+	defer h.queuesMu.Unlock()
+	if q, ok := h.queues[policy.dir]; ok {
+		return q, nil
+	}
+	q, err := openWriteQueue(policy.dir)
+	if err != nil {
+		return nil, err
+	}
+	if h.queues == nil {
+		h.queues = make(map[string]*writeQueue)
+	}
+	h.queues[policy.dir] = q
+	return q, nil
+}
+
+// queueSamples reports the depth of every open queue
+func (h *ProxyHandler) queueSamples() []sample {
+	h.queuesMu.Lock()
+	defer h.queuesMu.Unlock()
+	var samples []sample
+	for dir, q := range h.queues {
+		samples = append(samples, sample{labels: []string{dir}, value: float64(q.depth())})
+	}
+	return samples
+}
+
+// runQueues replays stored writes until ctx is done. Queues left by a previous run are
+// opened at once, so their requests go out without waiting for new traffic.
+func (h *ProxyHandler) runQueues(ctx context.Context) {
+	ticker := time.NewTicker(queueTick)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, route := range h.allRoutes() {
+			if route.Queue == nil {
+				continue
+			}
+			q, err := h.queueFor(route.Queue)
+			if err != nil {
+				h.logger.Printf("Write queue for route %s: %v", route.Name, err)
+				continue
+			}
+			q.mu.Lock()
+			due := len(q.entries) > 0 && !q.busy && !now.Before(q.next)
+			if due {
+				q.busy = true
+			}
+			q.mu.Unlock()
+			if due {
+				go h.replayQueue(ctx, q, route.Queue)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replayQueue sends queued requests oldest first, stopping at the first one the upstream
+// still cannot take
+func (h *ProxyHandler) replayQueue(ctx context.Context, q *writeQueue, policy *queuePolicy) {
+	defer func() {
+		q.mu.Lock()
+		q.busy = false
+		q.mu.Unlock()
+	}()
+
+	for ctx.Err() == nil {
+		entry, ok := q.oldest()
+		if !ok {
+			return
+		}
+		qr, err := q.load(entry.id)
+		if err != nil {
+			h.logger.Printf("Dropping unreadable queued request %s: %v", entry.id, err)
+			q.remove(entry.id)
+			continue
+		}
+		if time.Now().After(qr.ExpiresAt) {
+			h.queueEvents.inc(qr.Route, "expired")
+			h.logger.Printf("Queued %s %s expired undelivered", qr.Method, qr.URL)
+			q.remove(entry.id)
+			continue
+		}
+
+		status, err := h.replay(ctx, qr)
+		if (err != nil && upstreamDown(ctx, err)) || (err == nil && slices.Contains(policy.onStatus, status)) {
+			q.mu.Lock()
+			q.next = time.Now().Add(policy.retryInterval)
+			q.mu.Unlock()
+			return
+		}
+		if err != nil {
+			h.logger.Printf("Dropping queued %s %s: %v", qr.Method, qr.URL, err)
+		} else {
+			h.logger.Printf("Replayed queued %s %s: %d", qr.Method, qr.URL, status)
+		}
+		h.queueEvents.inc(qr.Route, "replayed")
+		q.remove(entry.id)
+	}
+}
+
+// replay sends a stored request to its upstream, signed afresh when its route signs
+func (h *ProxyHandler) replay(ctx context.Context, qr *queuedRequest) (int, error) {
+	u, err := url.Parse(qr.URL)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, queueReplayTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, qr.Method, qr.URL, bytes.NewReader(qr.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = qr.Header.Clone()
+	req.Host = qr.Host
+	for _, name := range qr.Templates {
+		value, err := h.secrets.expand(qr.Header.Get(name))
+		if err != nil {
+			return 0, fmt.Errorf("upstream header %s: %w", name, err)
+		}
+		req.Header.Set(name, value)
+	}
+
+	target := &proxyTarget{URL: u, Socket: qr.Socket}
+	var transport http.RoundTripper = h.transports.forTarget(target, false)
+	for _, route := range h.allRoutes() {
+		if route.Name == qr.Route && route.Signer != nil {
+			transport = &signingTransport{RoundTripper: transport, signer: route.Signer, secrets: h.secrets}
+			break
+		}
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
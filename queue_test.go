@@ -0,0 +1,236 @@
+package proxygo
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueReplaySecrets(t *testing.T) {
+	t.Setenv("PROXYGO_TEST_TOKEN", "old-token")
+	t.Setenv("PROXYGO_TEST_KEY_ID", "AKIDOLD")
+	t.Setenv("PROXYGO_TEST_SECRET_KEY", "old-secret-key")
+
+	var up atomic.Bool
+	var mu sync.Mutex
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		seen = r.Header.Clone()
+		mu.Unlock()
+	}))
+	t.Cleanup(upstream.Close)
+
+	dir := t.TempDir()
+	h := newTestHandler(t, `{
+		"secrets": {"list": {
+			"token": {"source": "env", "name": "PROXYGO_TEST_TOKEN"},
+			"key_id": {"source": "env", "name": "PROXYGO_TEST_KEY_ID"},
+			"secret_key": {"source": "env", "name": "PROXYGO_TEST_SECRET_KEY"}
+		}},
+		"routes": [{"name": "orders", "prefix": "/orders/", "upstream": "`+upstream.URL+`",
+			"upstream_headers": {"X-Upstream-Token": "Bearer ${secret:token}"},
+			"aws_signing": {"service": "execute-api", "region": "us-east-1",
+				"access_key_id": "${secret:key_id}", "secret_access_key": "${secret:secret_key}"},
+			"write_queue": {"dir": "`+dir+`"}}]
+	}`)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/orders/new", strings.NewReader(`{"item": 1}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d while the upstream is down, want 202", w.Code)
+	}
+
+	// Only the references are written to disk
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	var stored strings.Builder
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		stored.Write(data)
+	}
+	if strings.Contains(stored.String(), "old-token") {
+		t.Errorf("the queue stored the secret value: %s", stored.String())
+	}
+	if !strings.Contains(stored.String(), "${secret:token}") {
+		t.Errorf("the queue did not store the header template: %s", stored.String())
+	}
+
+	// Rotated secrets are used when the queue drains
+	t.Setenv("PROXYGO_TEST_TOKEN", "new-token")
+	t.Setenv("PROXYGO_TEST_KEY_ID", "AKIDNEW")
+	if err := h.secrets.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	up.Store(true)
+	route := h.allRoutes()[0]
+	q, err := h.queueFor(route.Queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.busy = true
+	h.replayQueue(context.Background(), q, route.Queue)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if seen == nil {
+		t.Fatal("the queued request was not replayed")
+	}
+	if got := seen.Get("X-Upstream-Token"); got != "Bearer new-token" {
+		t.Errorf("replayed X-Upstream-Token = %q, want the rotated secret", got)
+	}
+	if got := seen.Get("Authorization"); !strings.Contains(got, "Credential=AKIDNEW/") {
+		t.Errorf("replayed Authorization = %q, want it signed with the rotated key", got)
+	}
+	if q.depth() != 0 {
+		t.Errorf("%d requests still queued after the replay", q.depth())
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	var up atomic.Bool
+	var mu sync.Mutex
+	var received []string // method and body of each request the upstream accepted
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r.Method+" "+string(body))
+		mu.Unlock()
+	}))
+	t.Cleanup(upstream.Close)
+
+	dir := t.TempDir()
+	h := newTestHandler(t, `{"routes": [{"name": "orders", "prefix": "/orders/", "upstream": "`+upstream.URL+`",
+		"write_queue": {"dir": "`+dir+`", "max_body": 16}}]}`)
+
+	tests := []struct {
+		name   string
+		up     bool
+		method string
+		body   string
+		status int
+	}{
+		{name: "delivered while up", up: true, method: http.MethodPost, body: "first", status: http.StatusOK},
+		{name: "queued while down", method: http.MethodPost, body: "second", status: http.StatusAccepted},
+		{name: "queued behind pending writes", up: true, method: http.MethodPut, body: "third", status: http.StatusAccepted},
+		{name: "reads pass", up: true, method: http.MethodGet, status: http.StatusOK},
+		{name: "too large to queue", method: http.MethodPost, body: "a body over sixteen bytes", status: http.StatusServiceUnavailable},
+		{name: "other methods fail", method: http.MethodDelete, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up.Store(tt.up)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, "/orders/1", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusAccepted && !strings.Contains(w.Body.String(), `"queued":true`) {
+				t.Errorf("body %s, want a queued receipt", w.Body)
+			}
+		})
+	}
+
+	route := h.allRoutes()[0]
+	q, err := h.queueFor(route.Queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.depth() != 2 {
+		t.Fatalf("%d queued, want 2", q.depth())
+	}
+	// The queue survives a restart
+	if reopened, err := openWriteQueue(dir); err != nil || reopened.depth() != 2 {
+		t.Fatalf("reopened queue holds %v (%v), want 2", reopened, err)
+	}
+
+	// Still down: nothing is delivered and the queue waits for the next attempt
+	up.Store(false)
+	q.busy = true
+	h.replayQueue(context.Background(), q, route.Queue)
+	if q.depth() != 2 {
+		t.Errorf("%d queued after a failed replay, want 2", q.depth())
+	}
+
+	up.Store(true)
+	q.busy = true
+	h.replayQueue(context.Background(), q, route.Queue)
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"POST first", "GET ", "POST second", "PUT third"}
+	if strings.Join(received, "|") != strings.Join(want, "|") {
+		t.Errorf("upstream received %q, want %q", received, want)
+	}
+	if q.depth() != 0 {
+		t.Errorf("%d still queued", q.depth())
+	}
+	if queued, replayed := h.queueEvents.value("orders", "queued"), h.queueEvents.value("orders", "replayed"); queued != 2 || replayed != 2 {
+		t.Errorf("queued %v and replayed %v, want 2 each", queued, replayed)
+	}
+}
+
+func TestWriteQueueLimits(t *testing.T) {
+	// A port nothing listens on any more
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	dir := t.TempDir()
+	h := newTestHandler(t, `{"routes": [{"name": "orders", "prefix": "/orders/", "upstream": "`+down+`",
+		"write_queue": {"dir": "`+dir+`", "max_size": 10, "ttl": "50ms"}}]}`)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{body: "123456", status: http.StatusAccepted},
+		{body: "7890", status: http.StatusAccepted},
+		// The queue is full
+		{body: "x", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("POST %s: status %d, want %d: %s", tt.body, w.Code, tt.status, w.Body)
+		}
+	}
+	if got := h.queueEvents.value("orders", "rejected"); got != 1 {
+		t.Errorf("rejected %v, want 1", got)
+	}
+
+	// Requests not delivered within the TTL are dropped
+	time.Sleep(60 * time.Millisecond)
+	route := h.allRoutes()[0]
+	q, err := h.queueFor(route.Queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.busy = true
+	h.replayQueue(context.Background(), q, route.Queue)
+	if q.depth() != 0 || h.queueEvents.value("orders", "expired") != 2 {
+		t.Errorf("%d queued and %v expired, want both requests expired", q.depth(), h.queueEvents.value("orders", "expired"))
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("files left behind: %v", files)
+	}
+}
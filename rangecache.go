@@ -0,0 +1,109 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// fillForRange answers a Range request that missed the cache by fetching the whole object,
+// storing it, and cutting the range from it, so later ranges of the same object are hits.
+// Objects too large to cache are abandoned once their size is known, and the range is
+// requested from the upstream as sent.
+func (h *ProxyHandler) fillForRange(w http.ResponseWriter, r *http.Request, target *proxyTarget, base string) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Ask for the full representation; the client's conditions are evaluated against it below
+	out := r.Clone(context.WithValue(ctx, rangeFillKey{}, true))
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		out.Header.Del(name)
+	}
+
+	fill := &rangeFillWriter{header: http.Header{}, limit: h.cache.maxEntry, cancel: cancel}
+	func() {
+		// Cutting the copy short makes the reverse proxy abort; that is expected here
+		defer func() {
+			if v := recover(); v != nil && v != http.ErrAbortHandler {
+				panic(v)
+			}
+		}()
+		h.serveProxy(fill, out, target, false)
+	}()
+	if r.Context().Err() != nil {
+		return
+	}
+
+	if fill.overflow {
+		h.serveProxy(w, r, target, false)
+		return
+	}
+
+	header := stripCacheHopHeaders(fill.header)
+	if fill.status != http.StatusOK {
+		// Errors and redirects reach the client as the upstream sent them
+		for k, vv := range header {
+			w.Header()[k] = vv
+		}
+		w.WriteHeader(fill.status)
+		w.Write(fill.buf.Bytes())
+		return
+	}
+
+	body := fill.buf.Bytes()
+	h.cache.storeResponse(base, fill.status, fill.header, body)
+	h.cache.serve(w, r, &cacheEntry{status: fill.status, header: header, body: body, storedAt: time.Now()}, "MISS")
+}
+
+// rangeFillKey marks the whole-object request of fillForRange in its context
+type rangeFillKey struct{}
+
+// rangeFillWriter buffers a whole upstream response, giving up as soon as it is known
+// to exceed the cache's entry limit
+type rangeFillWriter struct {
+	header   http.Header
+	status   int
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	cancel   context.CancelFunc // stops the upstream transfer on overflow
+}
+
+// Header implements http.ResponseWriter
+func (f *rangeFillWriter) Header() http.Header {
+	return f.header
+}
+
+// WriteHeader implements http.ResponseWriter; a declared length over the limit overflows at once
+func (f *rangeFillWriter) WriteHeader(code int) {
+	if f.status != 0 {
+		return
+	}
+	f.status = code
+	if n, err := strconv.ParseInt(f.header.Get("Content-Length"), 10, 64); err == nil && n > f.limit {
+		f.giveUp()
+	}
+}
+
+// Write implements http.ResponseWriter
+func (f *rangeFillWriter) Write(p []byte) (int, error) {
+	if f.status == 0 {
+		f.WriteHeader(http.StatusOK)
+	}
+	if !f.overflow && int64(f.buf.Len()+len(p)) > f.limit {
+		f.giveUp()
+	}
+	if f.overflow {
+		return len(p), nil
+	}
+	return f.buf.Write(p)
+}
+
+// giveUp drops the buffered body and cancels the transfer
+func (f *rangeFillWriter) giveUp() {
+	f.overflow = true
+	f.buf = bytes.Buffer{}
+	f.cancel()
+}
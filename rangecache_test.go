@@ -0,0 +1,116 @@
+package proxygo
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheRange(t *testing.T) {
+	var ranged atomic.Int32 // upstream requests that carried a Range header
+	upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"abc"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	})
+	h := newTestHandler(t, `{"cache": {"enabled": true},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	// The first range fetches the whole body for the cache
+	checkCached(t, "first range", cacheGet(h, "/api/file", "Range", "bytes=2-4"), http.StatusPartialContent, "234", "MISS")
+	if n := ranged.Load(); n != 0 {
+		t.Errorf("%d ranged upstream requests, want the full body fetched", n)
+	}
+
+	tests := []struct {
+		name   string
+		header []string
+		status int
+		body   string
+	}{
+		{name: "suffix range", header: []string{"Range", "bytes=-3"}, status: http.StatusPartialContent, body: "789"},
+		{name: "open range", header: []string{"Range", "bytes=5-"}, status: http.StatusPartialContent, body: "56789"},
+		{name: "whole body", status: http.StatusOK, body: "0123456789"},
+		{name: "matching If-Range", header: []string{"Range", "bytes=0-0", "If-Range", `"abc"`}, status: http.StatusPartialContent, body: "0"},
+		{name: "stale If-Range", header: []string{"Range", "bytes=0-0", "If-Range", `"old"`}, status: http.StatusOK, body: "0123456789"},
+		{name: "unsatisfiable", header: []string{"Range", "bytes=20-"}, status: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		w := cacheGet(h, "/api/file", tt.header...)
+		if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) || w.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("%s: %d %q with X-Cache %q, want %d %q from the cache", tt.name, w.Code, w.Body, w.Header().Get("X-Cache"), tt.status, tt.body)
+		}
+	}
+	if n := upstream.hits.Load(); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+
+	// Bodies too large to cache are fetched as ranges from the origin
+	h = newTestHandler(t, `{"cache": {"enabled": true, "max_entry_size": "4B"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+	for range 2 {
+		if w := cacheGet(h, "/api/file", "Range", "bytes=2-4"); w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+			t.Errorf("large body: %d %q, want 206 %q", w.Code, w.Body, "234")
+		}
+	}
+	if n := ranged.Load(); n != 2 {
+		t.Errorf("%d ranged upstream requests for an uncacheable body, want 2", n)
+	}
+}
+
+func TestCacheRangeFillDownloads(t *testing.T) {
+	var h *ProxyHandler
+	sessions := func() int {
+		h.downloads.mu.Lock()
+		defer h.downloads.mu.Unlock()
+		return h.downloads.active["192.0.2.1"]
+	}
+	// during holds the sessions open while the upstream sends the full body, then the range
+	var during [2]atomic.Int32
+	upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		ranged := r.Header.Get("Range") != ""
+		if ranged {
+			w.Header().Set("Content-Range", "bytes 2-4/100")
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		// The proxy has the headers, and any session is open, once they are flushed
+		w.Write([]byte("234"))
+		w.(http.Flusher).Flush()
+		if ranged {
+			deadline := time.Now().Add(5 * time.Second)
+			for sessions() == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			during[1].Store(int32(sessions()))
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		during[0].Store(int32(sessions()))
+		w.Write([]byte(strings.Repeat("x", 97)))
+	})
+	h = newTestHandler(t, `{"cache": {"enabled": true, "max_entry_size": "16B"},
+		"downloads": {"max_sessions": 1, "min_size": "1B"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	w := cacheGet(h, "/api/file", "Range", "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("%d %q, want 206 %q", w.Code, w.Body, "234")
+	}
+	// Only the request the client receives is a download session
+	if fill, ranged := during[0].Load(), during[1].Load(); fill != 0 || ranged != 1 {
+		t.Errorf("%d session(s) during the fill and %d during the range request, want 0 and 1", fill, ranged)
+	}
+	if n := sessions(); n != 0 {
+		t.Errorf("%d session(s) left open", n)
+	}
+	if got := h.downloads.rejects.value(); got != 0 {
+		t.Errorf("%v downloads rejected, want 0", got)
+	}
+}
@@ -0,0 +1,257 @@
+package proxygo
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisIdleConns caps the connections kept open between commands
+const redisIdleConns = 8
+
+// redisError is an error reply from the server, as opposed to a failed connection
+type redisError string
+
+// Error implements error
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient speaks just enough RESP2 to run commands and follow a pub/sub channel
+type redisClient struct {
+	addr     string
+	tls      *tls.Config // nil for plain TCP
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+
+	idle chan *redisConn
+}
+
+// redisConn is one connection with its reply reader
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisClient parses redis://[user:password@]host:port[/db], rediss:// for TLS, or a bare host:port
+func newRedisClient(rawURL, password string, timeout time.Duration) (*redisClient, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "redis://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	c := &redisClient{addr: u.Host, timeout: timeout, idle: make(chan *redisConn, redisIdleConns)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("redis url: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			// redis://secret@host is the password alone
+			c.username, c.password = "", c.username
+		}
+	}
+	if password != "" {
+		c.password = password
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis url: database must be a number, got %q", db)
+		}
+	}
+	return c, nil
+}
+
+// dial opens an authenticated connection to the selected database
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	d := &net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		conn = tls.Client(conn, c.tls)
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var setup [][]string
+	switch {
+	case c.username != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.roundTrip(args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs one command and returns its reply: a string, an int64, a []any, or nil
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	select {
+	case rc := <-c.idle:
+		reply, broken, err := c.doOn(ctx, rc, args)
+		// Idle connections go stale when the server restarts or times clients out
+		if !broken {
+			return reply, err
+		}
+	default:
+	}
+	rc, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, _, err := c.doOn(ctx, rc, args)
+	return reply, err
+}
+
+// doOn runs one command on rc, keeping the connection for reuse unless it broke
+func (c *redisClient) doOn(ctx context.Context, rc *redisConn, args []string) (any, bool, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	rc.SetDeadline(deadline)
+	reply, err := rc.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The stream may be mid-reply; the connection cannot be reused
+		rc.Close()
+		return nil, true, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.Close()
+	}
+	return reply, false, err
+}
+
+// subscribe delivers each message published on channel to handle until ctx is done or
+// the connection fails
+func (c *redisClient) subscribe(ctx context.Context, channel string, handle func(payload string)) error {
+	rc, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	stop := context.AfterFunc(ctx, func() { rc.Close() })
+	defer stop()
+
+	if err := rc.write([]string{"SUBSCRIBE", channel}); err != nil {
+		return err
+	}
+	// Messages arrive whenever they are published
+	rc.SetDeadline(time.Time{})
+	for {
+		reply, err := rc.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue // the subscribe confirmation
+		}
+		if payload, ok := msg[2].(string); ok {
+			handle(payload)
+		}
+	}
+}
+
+// roundTrip writes a command and reads its reply
+func (rc *redisConn) roundTrip(args []string) (any, error) {
+	if err := rc.write(args); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+// write sends args as a RESP array of bulk strings
+func (rc *redisConn) write(args []string) error {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	_, err := io.WriteString(rc.Conn, b.String())
+	return err
+}
+
+// read parses one reply. Error replies are returned as redisError.
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply line")
+	}
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = rc.read(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
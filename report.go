@@ -0,0 +1,90 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runReport implements `proxygo report`, printing usage totals from the usage file
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the proxy config file")
+	fromValue := fs.String("from", "", "start of the range (RFC 3339 or YYYY-MM-DD), default 24h ago")
+	toValue := fs.String("to", "", "end of the range (RFC 3339 or YYYY-MM-DD), default now")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	if cfg.Usage == nil || cfg.Usage.File == "" {
+		fmt.Fprintln(os.Stderr, "usage.file is not configured")
+		return 1
+	}
+
+	from, to, err := parseReportRange(*fromValue, *toValue)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	buckets, err := readUsageFile(cfg.Usage.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := buildUsageReport(buckets, from, to)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return 0
+	}
+	printUsageReport(os.Stdout, report)
+	return 0
+}
+
+// printUsageReport renders the report as aligned tables
+func printUsageReport(out io.Writer, report *usageReport) {
+	fmt.Fprintf(out, "Usage from %s to %s\n", report.From.Format(time.RFC3339), report.To.Format(time.RFC3339))
+
+	section := func(title string, rows []usageRow) {
+		fmt.Fprintf(out, "\n%s\n", title)
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "NAME\tREQUESTS\tBYTES IN\tBYTES OUT\t")
+		for _, row := range rows {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t\n", row.Name, row.Requests, formatBytes(row.BytesIn), formatBytes(row.BytesOut))
+		}
+		tw.Flush()
+	}
+
+	section("Clients", append(report.Clients, report.Total))
+	section("Upstreams", report.Upstreams)
+	if len(report.Tenants) > 0 {
+		section("Tenants", report.Tenants)
+	}
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
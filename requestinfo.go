@@ -0,0 +1,69 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 128
+
+// requestInfo carries per-request facts discovered by the handler back out to middlewares
+type requestInfo struct {
+	RequestID string // client-supplied X-Request-Id, or a random one
+	ClientIP  string
+	ClientID  string // authenticated client name, falling back to the client IP
+	Country   string // ISO country code of the client, when GeoIP is enabled
+	Tenant    string // tenant the request belongs to, when tenants are configured
+
+	proxyError bool   // the response is an error the proxy produced itself
+	path       string // as the client sent it, before routing rewrote it for the upstream
+}
+
+// requestInfoKey is the context key for *requestInfo
+type requestInfoKey struct{}
+
+// withRequestInfo returns the request's info, attaching a fresh one if none exists yet
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return r, info
+	}
+	info := &requestInfo{RequestID: requestID(r), ClientIP: clientIP(r), path: r.URL.Path}
+	info.ClientID = info.ClientIP
+	if info.ClientID == "" {
+		info.ClientID = "local"
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// clientIP returns the IP of the direct peer, or "" for unix socket clients
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// requestID reuses a well-formed incoming X-Request-Id so traces join up, else makes one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// isPrintableASCII reports whether s is safe to echo into headers and logs
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
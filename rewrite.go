@@ -0,0 +1,215 @@
+package proxygo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultRewriteMaxMatch = 1 << 10
+	rewriteReadSize        = 32 << 10
+)
+
+// defaultRewriteTypes are the text responses rewritten when no types are configured
+var defaultRewriteTypes = []string{"text/*", "application/javascript", "application/json", "application/xml", "application/xhtml+xml"}
+
+// BodyRewriteConfig applies find/replace rules to text response bodies as they stream through
+type BodyRewriteConfig struct {
+	Types    []string            `json:"types"`     // media types to rewrite, e.g. "text/html"; default text/* plus JSON, JavaScript and XML
+	MaxMatch ByteSize            `json:"max_match"` // longest text a regex rule may match; default 1KB
+	Rules    []RewriteRuleConfig `json:"rules"`     // applied in order, each to the output of the one before
+}
+
+// RewriteRuleConfig replaces every occurrence of Find with Replace
+type RewriteRuleConfig struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"` // with regex, $1 or ${name} expand to submatches
+	Regex   bool   `json:"regex"`   // treat Find as a regular expression; ^ and $ are not reliable, as bodies are matched in pieces
+}
+
+// bodyRewriter is a compiled BodyRewriteConfig
+type bodyRewriter struct {
+	types []string
+	rules []rewriteRule
+}
+
+// rewriteRule is one compiled rule; window is the longest text it can match
+type rewriteRule struct {
+	literal []byte
+	re      *regexp.Regexp
+	replace []byte
+	window  int
+}
+
+// newBodyRewriter returns nil when there are no rules
+func newBodyRewriter(cfg *BodyRewriteConfig) (*bodyRewriter, error) {
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+
+	maxMatch := int(cfg.MaxMatch)
+	if maxMatch <= 0 {
+		maxMatch = defaultRewriteMaxMatch
+	}
+	types := cfg.Types
+	if len(types) == 0 {
+		types = defaultRewriteTypes
+	}
+	b := &bodyRewriter{}
+	for _, t := range types {
+		b.types = append(b.types, strings.ToLower(strings.TrimSpace(t)))
+	}
+
+	for i, rc := range cfg.Rules {
+		if rc.Find == "" {
+			return nil, fmt.Errorf("body rewrite rule #%d: find is required", i)
+		}
+		rule := rewriteRule{replace: []byte(rc.Replace)}
+		if rc.Regex {
+			re, err := regexp.Compile(rc.Find)
+			if err != nil {
+				return nil, fmt.Errorf("body rewrite rule #%d: %w", i, err)
+			}
+			if re.MatchString("") {
+				return nil, fmt.Errorf("body rewrite rule #%d: pattern %q matches empty text", i, rc.Find)
+			}
+			rule.re, rule.window = re, maxMatch
+		} else {
+			rule.literal, rule.window = []byte(rc.Find), len(rc.Find)
+		}
+		b.rules = append(b.rules, rule)
+	}
+	return b, nil
+}
+
+// modifyResponse chains the rules onto text bodies. Encoded bodies cannot be matched and
+// partial content would be rewritten out of context, so both pass through untouched.
+func (b *bodyRewriter) modifyResponse(resp *http.Response) error {
+	if !responseHasBody(resp) || resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !matchesMediaType(b.types, strings.ToLower(mediaType)) {
+		return nil
+	}
+
+	var body io.Reader = resp.Body
+	for i := range b.rules {
+		body = &rewriteReader{src: body, rule: &b.rules[i]}
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+
+	// The length changes, and the upstream's validator no longer names these exact bytes
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// rewriteReader applies one rule to a stream. It holds back the last window-1 bytes it has
+// read, since a match may begin there and end in data not yet received.
+type rewriteReader struct {
+	src     io.Reader
+	rule    *rewriteRule
+	pending []byte // read but not yet rewritten
+	out     []byte // rewritten and waiting to be returned
+	err     error  // from src, returned once pending and out are drained
+}
+
+// Read implements io.Reader
+func (r *rewriteReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			if len(r.pending) == 0 {
+				return 0, r.err
+			}
+			r.process(true)
+			continue
+		}
+		r.fill()
+		r.process(r.err != nil)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads from src until pending holds more than a window or src runs dry
+func (r *rewriteReader) fill() {
+	for len(r.pending) < r.rule.window+rewriteReadSize && r.err == nil {
+		r.pending = slices.Grow(r.pending, rewriteReadSize)
+		n, err := r.src.Read(r.pending[len(r.pending):cap(r.pending)])
+		r.pending = r.pending[:len(r.pending)+n]
+		r.err = err
+		if n > 0 && len(r.pending) >= r.rule.window {
+			return
+		}
+	}
+}
+
+// process rewrites the matches that start before the held-back tail, or all of them at the end
+func (r *rewriteReader) process(final bool) {
+	cut := len(r.pending)
+	if !final {
+		cut -= r.rule.window - 1
+		if cut <= 0 {
+			return
+		}
+	}
+
+	var out []byte
+	pos := 0
+	for _, m := range r.rule.matches(r.pending) {
+		if m[0] >= cut {
+			break
+		}
+		out = append(out, r.pending[pos:m[0]]...)
+		out = r.rule.expand(out, r.pending, m)
+		pos = m[1]
+	}
+	if pos < cut {
+		out = append(out, r.pending[pos:cut]...)
+		pos = cut
+	}
+
+	r.out = out
+	r.pending = append(r.pending[:0], r.pending[pos:]...)
+}
+
+// matches returns the submatch indexes of every non-overlapping match in b
+func (rule *rewriteRule) matches(b []byte) [][]int {
+	if rule.re != nil {
+		return rule.re.FindAllSubmatchIndex(b, -1)
+	}
+	var out [][]int
+	for start := 0; ; {
+		i := bytes.Index(b[start:], rule.literal)
+		if i < 0 {
+			return out
+		}
+		out = append(out, []int{start + i, start + i + len(rule.literal)})
+		start += i + len(rule.literal)
+	}
+}
+
+// expand appends the replacement for match m of src to dst
+func (rule *rewriteRule) expand(dst, src []byte, m []int) []byte {
+	if rule.re != nil {
+		return rule.re.Expand(dst, rule.replace, src, m)
+	}
+	return append(dst, rule.replace...)
+}
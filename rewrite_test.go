@@ -0,0 +1,197 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// rewriteBody runs body through the rules of cfg, read from upstream one byte at a time
+func rewriteBody(t *testing.T, cfg *BodyRewriteConfig, body string) string {
+	t.Helper()
+	b, err := newBodyRewriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:          io.NopCloser(iotest.OneByteReader(strings.NewReader(body))),
+		ContentLength: int64(len(body)),
+		Request:       &http.Request{Method: http.MethodGet},
+	}
+	if err := b.modifyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestRewriteSplitReads(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []RewriteRuleConfig
+		body  string
+		want  string
+	}{
+		{
+			name:  "literal",
+			rules: []RewriteRuleConfig{{Find: "http://internal.test", Replace: "https://example.com"}},
+			body:  `<a href="http://internal.test/a">http://internal.test</a>http://internal.tes`,
+			want:  `<a href="https://example.com/a">https://example.com</a>http://internal.tes`,
+		},
+		{
+			name:  "literal at both ends",
+			rules: []RewriteRuleConfig{{Find: "ab", Replace: "xyz"}},
+			body:  "abcabab",
+			want:  "xyzcxyzxyz",
+		},
+		{
+			name:  "regex",
+			rules: []RewriteRuleConfig{{Find: `user-(\d+)`, Replace: "account-$1", Regex: true}},
+			body:  "user-12, user-345 and user-",
+			want:  "account-12, account-345 and user-",
+		},
+		{
+			name:  "regex named group",
+			rules: []RewriteRuleConfig{{Find: `(?P<host>[a-z]+)\.internal`, Replace: "${host}.example.com", Regex: true}},
+			body:  "api.internal, cdn.internal",
+			want:  "api.example.com, cdn.example.com",
+		},
+		{
+			name: "chained",
+			rules: []RewriteRuleConfig{
+				{Find: "cat", Replace: "dog"},
+				{Find: "dog", Replace: "bird"},
+			},
+			body: "cat dog",
+			want: "bird bird",
+		},
+		{
+			name:  "no match",
+			rules: []RewriteRuleConfig{{Find: "absent", Replace: "x"}},
+			body:  "nothing to see",
+			want:  "nothing to see",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteBody(t, &BodyRewriteConfig{Rules: tt.rules}, tt.body); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteMaxMatch(t *testing.T) {
+	cfg := &BodyRewriteConfig{
+		MaxMatch: 8,
+		Rules:    []RewriteRuleConfig{{Find: `<!--[^>]*-->`, Replace: "", Regex: true}},
+	}
+	// A comment that fits in max_match is removed; a longer one is never seen whole
+	body := "a<!--x-->b<!-- longer than eight -->c"
+	want := "ab<!-- longer than eight -->c"
+	if got := rewriteBody(t, cfg, body); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRewritePassThrough(t *testing.T) {
+	b, err := newBodyRewriter(&BodyRewriteConfig{Rules: []RewriteRuleConfig{{Find: "old", Replace: "new"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		body     string
+		wantBody string
+		wantETag string
+		wantLen  int64
+	}{
+		{
+			name:     "rewritten",
+			status:   http.StatusOK,
+			header:   http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}, "Content-Length": {"7"}},
+			body:     "old old",
+			wantBody: "new new",
+			wantETag: `W/"v1"`,
+			wantLen:  -1,
+		},
+		{
+			name:     "weak etag kept",
+			status:   http.StatusOK,
+			header:   http.Header{"Content-Type": {"text/plain"}, "Etag": {`W/"v1"`}},
+			body:     "old",
+			wantBody: "new",
+			wantETag: `W/"v1"`,
+			wantLen:  -1,
+		},
+		{
+			name:     "identity encoding",
+			status:   http.StatusOK,
+			header:   http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"identity"}, "Etag": {`"v1"`}},
+			body:     "old",
+			wantBody: "new",
+			wantETag: `W/"v1"`,
+			wantLen:  -1,
+		},
+		{
+			name:     "gzip",
+			status:   http.StatusOK,
+			header:   http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}, "Etag": {`"v1"`}, "Content-Length": {"3"}},
+			body:     "old",
+			wantBody: "old",
+			wantETag: `"v1"`,
+			wantLen:  3,
+		},
+		{
+			name:     "partial",
+			status:   http.StatusPartialContent,
+			header:   http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-2/10"}, "Etag": {`"v1"`}, "Content-Length": {"3"}},
+			body:     "old",
+			wantBody: "old",
+			wantETag: `"v1"`,
+			wantLen:  3,
+		},
+		{
+			name:     "other type",
+			status:   http.StatusOK,
+			header:   http.Header{"Content-Type": {"image/png"}, "Etag": {`"v1"`}, "Content-Length": {"3"}},
+			body:     "old",
+			wantBody: "old",
+			wantETag: `"v1"`,
+			wantLen:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				Header:        tt.header,
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+				Request:       &http.Request{Method: http.MethodGet},
+			}
+			if err := b.modifyResponse(resp); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantBody || resp.Header.Get("ETag") != tt.wantETag || resp.ContentLength != tt.wantLen {
+				t.Errorf("body %q, ETag %q, length %d; want %q, %q, %d", got, resp.Header.Get("ETag"), resp.ContentLength, tt.wantBody, tt.wantETag, tt.wantLen)
+			}
+			if tt.wantLen < 0 && resp.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length %q left on a rewritten body", resp.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
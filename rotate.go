@@ -0,0 +1,165 @@
+package proxygo
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files so they sort oldest first
+const backupTimeFormat = "20060102T150405.000"
+
+// rotatingFile is an append-only log file that is renamed to path.<timestamp> once it
+// grows past maxSize. Rotated files can be gzipped and are pruned by count and age.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int           // rotated files kept; 0 keeps all
+	maxAge     time.Duration // rotated files older than this are removed; 0 keeps them
+	compress   bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	mill sync.Mutex // serializes compression and pruning, which run in the background
+}
+
+// openRotatingFile opens or creates path for appending
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge, compress: compress}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open (re)opens the current file and picks up its size
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would push the file past maxSize
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %w", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := f.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	// Compressing a large file should not hold up writers
+	go f.millBackups(backup)
+	return nil
+}
+
+// millBackups compresses the freshly rotated file if configured and prunes old backups
+func (f *rotatingFile) millBackups(backup string) {
+	f.mill.Lock()
+	defer f.mill.Unlock()
+
+	if f.compress {
+		if err := gzipFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation: failed to compress %s: %v\n", backup, err)
+		}
+	}
+
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, name := range matches {
+		stamp, _ := strings.CutSuffix(strings.TrimPrefix(name, f.path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	// Timestamps sort lexically; a ".gz" suffix does not change the order
+	sort.Strings(backups)
+	for i, name := range backups {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		tooMany := f.maxBackups > 0 && i < len(backups)-f.maxBackups
+		tooOld := f.maxAge > 0 && time.Since(info.ModTime()) > f.maxAge
+		if tooMany || tooOld {
+			os.Remove(name)
+		}
+	}
+}
+
+// gzipFile replaces name with name.gz
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(strings.TrimSuffix(dst.Name(), ".gz"))
+}
+
+// Close implements io.Closer
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,332 @@
+package proxygo
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// routeIDs numbers compiled routes, so each has an identity even when names repeat
+var routeIDs atomic.Uint64
+
+// RouteConfig mounts an upstream under a fixed path prefix
+type RouteConfig struct {
+	Name     string `json:"name"`
+	Prefix   string `json:"prefix"`   // e.g. "/app/"
+	Upstream string `json:"upstream"` // e.g. "http://app.internal"
+	Socket   string `json:"socket"`   // optional unix socket to dial instead of the upstream host
+
+	// Methods and Headers narrow the route to matching requests. Routes are tried longest
+	// prefix first and, for the same prefix, in config order; the first that matches wins.
+	Methods []string          `json:"methods,omitempty"` // e.g. ["GET", "HEAD"]; empty for any method
+	Headers map[string]string `json:"headers,omitempty"` // values the request must send, e.g. {"X-Env": "staging"}; "*" for any value
+
+	// UpstreamHeaders are set on every request to the upstream, e.g. {"Authorization": "Bearer ${secret:orders-token}"}
+	UpstreamHeaders map[string]string `json:"upstream_headers,omitempty"`
+
+	// Mandatory makes /readyz fail while the upstream is unreachable
+	Mandatory bool `json:"mandatory"`
+
+	// ContentFilter replaces the global content filter for this route
+	ContentFilter *ContentFilterConfig `json:"content_filter,omitempty"`
+
+	// ErrorPages replaces the global error rendering for this route
+	ErrorPages *ErrorPagesConfig `json:"error_pages,omitempty"`
+
+	// BodyRewrite replaces the global body rewrite rules for this route
+	BodyRewrite *BodyRewriteConfig `json:"body_rewrite,omitempty"`
+
+	// SecurityHeaders replaces the global response hardening for this route
+	SecurityHeaders *SecurityHeadersConfig `json:"security_headers,omitempty"`
+
+	// Validation rejects request bodies that do not match a JSON Schema or OpenAPI spec
+	Validation *ValidationConfig `json:"validation,omitempty"`
+
+	// Warmup keeps upstream connections open ahead of traffic
+	Warmup *WarmupConfig `json:"warmup,omitempty"`
+
+	// Hedging duplicates idempotent requests the upstream is slow to answer
+	Hedging *HedgingConfig `json:"hedging,omitempty"`
+
+	// AWSSigning signs requests to the upstream with AWS Signature Version 4
+	AWSSigning *AWSSigningConfig `json:"aws_signing,omitempty"`
+
+	// Diff compares responses with a candidate upstream, such as a new API version
+	Diff *DiffConfig `json:"diff,omitempty"`
+
+	// WriteQueue stores writes on disk while the upstream is down and replays them later
+	WriteQueue *WriteQueueConfig `json:"write_queue,omitempty"`
+
+	// Split sends a percentage of clients to other upstreams, for canary rollouts
+	Split *SplitConfig `json:"split,omitempty"`
+
+	// NegativeCache replaces the global negative caching of the response cache for this route
+	NegativeCache *NegativeCacheConfig `json:"negative_cache,omitempty"`
+}
+
+// Route is a compiled RouteConfig
+type Route struct {
+	Name      string
+	Prefix    string
+	Upstream  *url.URL
+	Socket    string
+	Methods   []string      // empty for any method
+	Headers   []headerMatch // sorted by name
+	Filter    *contentFilter
+	Errors    *errorRenderer   // nil to use the global renderer
+	Rewrite   *bodyRewriter    // nil to use the global rewrite rules
+	Validator *bodyValidator   // nil when bodies are not validated
+	Security  *securityHeaders // nil to use the global response hardening
+	Warmup    *connWarmer      // nil when connections are only opened on demand
+	Hedging   *hedgePolicy     // nil when requests are sent once
+	Signer    *awsSigner       // nil when requests are sent unsigned
+	Differ    *responseDiffer  // nil when responses are not compared
+	Queue     *queuePolicy     // nil when writes fail with the upstream
+	Split     *trafficSplit    // nil when every request goes to Upstream
+	Negative  *negativePolicy  // nil to use the global negative caching
+	Mandatory bool
+
+	UpstreamHeaders []upstreamHeader // sorted by name
+
+	id uint64 // unique among compiled routes, unlike the name
+}
+
+// upstreamHeader is a header set on requests to a route's upstream
+type upstreamHeader struct {
+	name  string // canonical form
+	value string // may refer to secrets
+}
+
+// headerMatch is a header a route requires
+type headerMatch struct {
+	name  string // canonical form
+	value string // "*" for any value
+}
+
+// router matches requests against the configured routes
+type router struct {
+	routes []*Route // sorted by descending prefix length so the longest prefix wins
+}
+
+// newRouter compiles the route configs into a router
+func newRouter(configs []RouteConfig) (*router, error) {
+	rt := &router{}
+	for i, rc := range configs {
+		route, err := compileRoute(rc)
+		if err != nil {
+			name := rc.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			return nil, fmt.Errorf("route %s: %w", name, err)
+		}
+		rt.routes = append(rt.routes, route)
+	}
+
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].Prefix) > len(rt.routes[j].Prefix)
+	})
+	return rt, nil
+}
+
+// compileRoute validates a single route config
+func compileRoute(rc RouteConfig) (*Route, error) {
+	if !strings.HasPrefix(rc.Prefix, "/") {
+		return nil, fmt.Errorf("prefix must start with /")
+	}
+
+	upstream := rc.Upstream
+	if upstream == "" && rc.Socket != "" {
+		// Unix socket daemons rarely care about the Host header
+		upstream = "http://localhost"
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream: %w", err)
+	}
+	// file:// URLs name a local path and have no host
+	if u.Scheme == "" || (u.Host == "" && u.Scheme != "file") {
+		return nil, fmt.Errorf("upstream must be an absolute URL")
+	}
+
+	var errorPages *errorRenderer
+	if rc.ErrorPages != nil {
+		if errorPages, err = newErrorRenderer(rc.ErrorPages); err != nil {
+			return nil, err
+		}
+	}
+
+	validator, err := newBodyValidator(rc.Validation)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrite, err := newBodyRewriter(rc.BodyRewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	security, err := newSecurityHeaders(rc.SecurityHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	warmer, err := newConnWarmer(rc.Warmup)
+	if err != nil {
+		return nil, err
+	}
+
+	hedging, err := newHedgePolicy(rc.Hedging)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := newAWSSigner(rc.AWSSigning)
+	if err != nil {
+		return nil, err
+	}
+
+	differ, err := newResponseDiffer(rc.Diff)
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []string
+	for _, method := range rc.Methods {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		methods = append(methods, strings.ToUpper(method))
+	}
+	var headers []headerMatch
+	for name, value := range rc.Headers {
+		if name == "" || value == "" {
+			return nil, fmt.Errorf("headers: name and value are required, \"*\" for any value")
+		}
+		headers = append(headers, headerMatch{name: http.CanonicalHeaderKey(name), value: value})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+	var upstreamHeaders []upstreamHeader
+	for name, value := range rc.UpstreamHeaders {
+		if name == "" || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("upstream_headers: invalid header %q", name)
+		}
+		upstreamHeaders = append(upstreamHeaders, upstreamHeader{name: http.CanonicalHeaderKey(name), value: value})
+	}
+	sort.Slice(upstreamHeaders, func(i, j int) bool { return upstreamHeaders[i].name < upstreamHeaders[j].name })
+
+	queue, err := newQueuePolicy(rc.WriteQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	split, err := newTrafficSplit(rc.Split)
+	if err != nil {
+		return nil, err
+	}
+	if split != nil && (u.Scheme == "file" || rc.Socket != "") {
+		return nil, fmt.Errorf("split: the route's own upstream must be http or https")
+	}
+
+	negative, err := newNegativePolicy(rc.NegativeCache)
+	if err != nil {
+		return nil, err
+	}
+
+	name := rc.Name
+	if name == "" {
+		name = rc.Prefix
+	}
+	return &Route{
+		Name:      name,
+		Prefix:    rc.Prefix,
+		Upstream:  u,
+		Socket:    rc.Socket,
+		Methods:   methods,
+		Headers:   headers,
+		Filter:    newContentFilter(rc.ContentFilter),
+		Errors:    errorPages,
+		Rewrite:   rewrite,
+		Validator: validator,
+		Security:  security,
+		Warmup:    warmer,
+		Hedging:   hedging,
+		Signer:    signer,
+		Differ:    differ,
+		Queue:     queue,
+		Split:     split,
+		Negative:  negative,
+		Mandatory: rc.Mandatory,
+
+		UpstreamHeaders: upstreamHeaders,
+
+		id: routeIDs.Add(1),
+	}, nil
+}
+
+// match returns the first route whose prefix and conditions r meets, and the path
+// relative to the upstream. tr, when set, records every route tried under the router name.
+func (rt *router) match(r *http.Request, tr *routeTrace, name string) (*Route, string) {
+	for _, route := range rt.routes {
+		rest, ok := matchPrefix(r.URL.Path, route.Prefix)
+		if !ok {
+			continue
+		}
+		reason := route.admits(r)
+		tr.add(name, route, reason)
+		if reason == "" {
+			return route, singleJoiningSlash(route.Upstream.Path, rest)
+		}
+	}
+	return nil, ""
+}
+
+// admits returns why r fails the route's method and header conditions, or "" when it meets them
+func (route *Route) admits(r *http.Request) string {
+	if len(route.Methods) > 0 && !slices.Contains(route.Methods, r.Method) {
+		return fmt.Sprintf("method %s is not one of %s", r.Method, strings.Join(route.Methods, ", "))
+	}
+	for _, hm := range route.Headers {
+		values := r.Header.Values(hm.name)
+		if len(values) == 0 {
+			return fmt.Sprintf("header %s is missing", hm.name)
+		}
+		if hm.value != "*" && !slices.Contains(values, hm.value) {
+			return fmt.Sprintf("header %s is %q, not %q", hm.name, values[0], hm.value)
+		}
+	}
+	return ""
+}
+
+// matchPrefix reports whether path falls under prefix on a segment boundary
+func matchPrefix(path, prefix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	rest := path[len(prefix):]
+	if strings.HasSuffix(prefix, "/") {
+		return "/" + rest, true
+	}
+	// "/app" must match "/app" and "/app/x" but not "/apple"
+	if rest == "" || strings.HasPrefix(rest, "/") {
+		return "/" + strings.TrimPrefix(rest, "/"), true
+	}
+	return "", false
+}
+
+// singleJoiningSlash joins two URL paths with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
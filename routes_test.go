@@ -0,0 +1,108 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newNamedUpstream starts an upstream answering with its name and the path it was asked for
+func newNamedUpstream(t *testing.T, name string) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.URL.Path)
+	}))
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+func TestRouteConditions(t *testing.T) {
+	h := newTestHandler(t, `{
+		"virtual_hosts": [{"name": "beta", "hosts": ["app.example.com"], "headers": {"X-Beta": "*"}, "upstream": "`+newNamedUpstream(t, "beta")+`"}],
+		"routes": [
+			{"name": "staging", "prefix": "/api/", "headers": {"x-env": "staging"}, "upstream": "`+newNamedUpstream(t, "staging")+`"},
+			{"name": "writes", "prefix": "/api/", "methods": ["post", "PUT"], "upstream": "`+newNamedUpstream(t, "writes")+`"},
+			{"name": "api", "prefix": "/api/", "upstream": "`+newNamedUpstream(t, "api")+`"},
+			{"name": "reads", "prefix": "/api/orders/", "methods": ["GET"], "upstream": "`+newNamedUpstream(t, "reads")+`"}
+		]}`)
+
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		path   string
+		header []string // name, value pairs
+		want   string
+	}{
+		{name: "plain", method: http.MethodGet, path: "/api/x", want: "api /x"},
+		{name: "header", method: http.MethodGet, path: "/api/x", header: []string{"X-Env", "staging"}, want: "staging /x"},
+		{name: "other header value", method: http.MethodGet, path: "/api/x", header: []string{"X-Env", "prod"}, want: "api /x"},
+		{name: "header before method", method: http.MethodPost, path: "/api/x", header: []string{"X-Env", "staging"}, want: "staging /x"},
+		{name: "method", method: http.MethodPut, path: "/api/x", want: "writes /x"},
+		{name: "longer prefix first", method: http.MethodGet, path: "/api/orders/1", want: "reads /1"},
+		{name: "longer prefix with a failed condition", method: http.MethodDelete, path: "/api/orders/1", want: "api /orders/1"},
+		{name: "vhost condition met", method: http.MethodGet, host: "app.example.com", path: "/api/x", header: []string{"X-Beta", "1"}, want: "beta /api/x"},
+		{name: "vhost falls through", method: http.MethodGet, host: "app.example.com", path: "/api/x", want: "api /x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			for i := 0; i < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Body.String() != tt.want {
+				t.Errorf("%d %q, want %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteConditionsConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		rc   RouteConfig
+		err  string
+	}{
+		{name: "empty method", rc: RouteConfig{Methods: []string{""}}, err: `invalid method ""`},
+		{name: "bad method", rc: RouteConfig{Methods: []string{"GET /"}}, err: `invalid method "GET /"`},
+		{name: "empty header value", rc: RouteConfig{Headers: map[string]string{"X-Env": ""}}, err: "headers: name and value are required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rc.Name, tt.rc.Prefix, tt.rc.Upstream = "api", "/api/", "http://api.internal"
+			_, err := newRouter([]RouteConfig{tt.rc})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("newRouter: %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRouteAdmits(t *testing.T) {
+	route := &Route{Methods: []string{"GET", "HEAD"}, Headers: []headerMatch{{name: "X-Env", value: "staging"}, {name: "X-Team", value: "*"}}}
+	tests := []struct {
+		method string
+		header http.Header
+		want   string
+	}{
+		{method: "GET", header: http.Header{"X-Env": {"staging"}, "X-Team": {"a"}}},
+		{method: "HEAD", header: http.Header{"X-Env": {"prod", "staging"}, "X-Team": {""}}},
+		{method: "POST", header: http.Header{"X-Env": {"staging"}, "X-Team": {"a"}}, want: "method POST is not one of GET, HEAD"},
+		{method: "GET", header: http.Header{"X-Team": {"a"}}, want: "header X-Env is missing"},
+		{method: "GET", header: http.Header{"X-Env": {"prod"}, "X-Team": {"a"}}, want: `header X-Env is "prod", not "staging"`},
+		{method: "GET", header: http.Header{"X-Env": {"staging"}}, want: "header X-Team is missing"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Method: tt.method, Header: tt.header}
+		if got := route.admits(r); got != tt.want {
+			t.Errorf("%s %v: admits = %q, want %q", tt.method, tt.header, got, tt.want)
+		}
+	}
+}
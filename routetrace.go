@@ -0,0 +1,106 @@
+package proxygo
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routeStep is one route tried while resolving a request: every route whose prefix the
+// path falls under, in the order they were tried
+type routeStep struct {
+	Router  string `json:"router"` // "vhost", "tenant" or "routes"
+	Route   string `json:"route"`
+	Prefix  string `json:"prefix"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"` // why the conditions failed
+}
+
+// routeTrace collects the steps of one resolution; a nil trace records nothing
+type routeTrace struct {
+	steps []routeStep
+}
+
+// add records that route was tried, with reason "" when it matched
+func (tr *routeTrace) add(router string, route *Route, reason string) {
+	if tr == nil {
+		return
+	}
+	tr.steps = append(tr.steps, routeStep{Router: router, Route: route.Name, Prefix: route.Prefix, Matched: reason == "", Reason: reason})
+}
+
+// traceResult is the body of GET /routes/trace
+type traceResult struct {
+	Method       string      `json:"method"`
+	Host         string      `json:"host"`
+	Path         string      `json:"path"`
+	Tenant       string      `json:"tenant,omitempty"`
+	Steps        []routeStep `json:"steps"`
+	Route        string      `json:"route,omitempty"`    // matched route; empty for unix, alias and path-embedded targets
+	Upstream     string      `json:"upstream,omitempty"` // with credentials redacted
+	Socket       string      `json:"socket,omitempty"`
+	UpstreamPath string      `json:"upstream_path,omitempty"`
+	Error        string      `json:"error,omitempty"` // why the request would be refused
+}
+
+// traceRoute handles GET /routes/trace?method=&host=&path=&header=Name:value, reporting which
+// route a request would be sent to without sending it. header may repeat.
+func (a *adminAPI) traceRoute(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	method := strings.ToUpper(q.Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	requestPath := q.Get("path")
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	u, err := url.ParseRequestURI(requestPath)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_path", err.Error())
+		return
+	}
+	req := &http.Request{Method: method, URL: u, Host: q.Get("host"), Header: make(http.Header)}
+	for _, header := range q["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			writeJSONError(w, http.StatusBadRequest, "invalid_header", "header must be Name:value")
+			return
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	h := a.proxy
+	result := traceResult{Method: method, Host: req.Host, Path: u.Path, Steps: []routeStep{}}
+	var tn *tenant
+	if h.tenants != nil {
+		var keyID string
+		if h.keys != nil {
+			keyID = h.keys.keyID(req)
+		}
+		if tn, err = h.tenants.identify(req, keyID); err != nil {
+			result.Error = err.Error()
+			writeJSON(w, http.StatusOK, result)
+			return
+		}
+		if tn != nil {
+			result.Tenant = tn.ID
+		}
+	}
+
+	tr := &routeTrace{}
+	target, err := h.traceTarget(req, tn, tr)
+	result.Steps = append(result.Steps, tr.steps...)
+	if err != nil {
+		result.Error = err.Error()
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	if target.Route != nil {
+		result.Route = target.Route.Name
+	}
+	result.Upstream = target.URL.Redacted()
+	result.Socket = target.Socket
+	result.UpstreamPath = target.Path
+	writeJSON(w, http.StatusOK, result)
+}
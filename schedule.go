@@ -0,0 +1,199 @@
+package proxygo
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultScheduleMessage is the 503 message of a closed window without its own
+const defaultScheduleMessage = "Closed for scheduled maintenance"
+
+// scheduleLookahead bounds the search for the end of a window, for Retry-After
+const scheduleLookahead = 7 * 24 * time.Hour
+
+// ScheduleConfig changes how requests are handled during a recurring window. Schedules
+// are applied by the "schedule" middleware, so listeners need it in their profile.
+type ScheduleConfig struct {
+	Name      string   `json:"name"`
+	Window    string   `json:"window"`     // cron expression; the window is every minute it matches, e.g. "* 9-17 * * 1-5"
+	Timezone  string   `json:"timezone"`   // IANA zone the window is read in, e.g. "Europe/Berlin"; default local time
+	Routes    []string `json:"routes"`     // route names it applies to; empty for every request
+	Closed    bool     `json:"closed"`     // answer 503 during the window, e.g. for maintenance
+	Message   string   `json:"message"`    // sent with the 503; default "Closed for scheduled maintenance"
+	RateLimit float64  `json:"rate_limit"` // requests per second per client during the window, 0 for unlimited
+	Burst     int      `json:"burst"`      // default the rate limit rounded up
+}
+
+// schedule is one compiled window
+type schedule struct {
+	name    string
+	window  *cronSchedule
+	loc     *time.Location
+	routes  []string
+	closed  bool
+	message string
+	rate    float64
+	burst   float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket // by client, while the window is open
+	lastSweep time.Time
+}
+
+// scheduleTable is the active set of schedules, replaced as a whole on reload
+type scheduleTable struct {
+	schedules []*schedule
+	byRoute   bool // whether any schedule is limited to routes
+}
+
+// newScheduleTable compiles the schedules, returning nil when there are none
+func newScheduleTable(configs []ScheduleConfig) (*scheduleTable, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	t := &scheduleTable{}
+	for i, sc := range configs {
+		name := sc.Name
+		if name == "" {
+			name = fmt.Sprintf("schedule-%d", i)
+		}
+		window, err := parseCron(sc.Window)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", name, err)
+		}
+		if window.every > 0 {
+			return nil, fmt.Errorf("schedule %s: window must be a cron expression, not @every", name)
+		}
+		loc := time.Local
+		if sc.Timezone != "" {
+			if loc, err = time.LoadLocation(sc.Timezone); err != nil {
+				return nil, fmt.Errorf("schedule %s: %w", name, err)
+			}
+		}
+		if !sc.Closed && sc.RateLimit <= 0 {
+			return nil, fmt.Errorf("schedule %s: set closed or rate_limit", name)
+		}
+		s := &schedule{
+			name:      name,
+			window:    window,
+			loc:       loc,
+			routes:    sc.Routes,
+			closed:    sc.Closed,
+			message:   sc.Message,
+			rate:      sc.RateLimit,
+			burst:     float64(sc.Burst),
+			buckets:   make(map[string]*tokenBucket),
+			lastSweep: time.Now(),
+		}
+		if s.message == "" {
+			s.message = defaultScheduleMessage
+		}
+		if s.burst <= 0 {
+			s.burst = math.Ceil(s.rate)
+		}
+		t.schedules = append(t.schedules, s)
+		t.byRoute = t.byRoute || len(sc.Routes) > 0
+	}
+	return t, nil
+}
+
+// open reports whether now falls in the window
+func (s *schedule) open(now time.Time) bool {
+	return s.window.matches(now.In(s.loc))
+}
+
+// closesAt returns when the window containing now ends, or the zero time when it does
+// not end within the lookahead
+func (s *schedule) closesAt(now time.Time) time.Time {
+	t := now.In(s.loc).Truncate(time.Minute)
+	for limit := t.Add(scheduleLookahead); t.Before(limit); t = t.Add(time.Minute) {
+		if !s.window.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// allow takes a token from client's bucket for this window
+func (s *schedule) allow(client string, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) > bucketIdleTTL {
+		for id, b := range s.buckets {
+			b.mu.Lock()
+			idle := now.Sub(b.lastUsed) > bucketIdleTTL
+			b.mu.Unlock()
+			if idle {
+				delete(s.buckets, id)
+			}
+		}
+		s.lastSweep = now
+	}
+	bucket, ok := s.buckets[client]
+	if !ok {
+		bucket = newTokenBucket(s.rate, s.burst)
+		s.buckets[client] = bucket
+	}
+	s.mu.Unlock()
+
+	n, wait := bucket.reserve(1)
+	return n > 0, wait
+}
+
+// check returns the rejection for a request to route from client at now, if any: the
+// first open window that closes the route wins, then every open limit must admit it
+func (t *scheduleTable) check(route, client string, now time.Time) (*schedule, *keyError) {
+	for _, s := range t.schedules {
+		if len(s.routes) > 0 && !slices.Contains(s.routes, route) {
+			continue
+		}
+		if !s.open(now) {
+			continue
+		}
+		if s.closed {
+			kerr := &keyError{status: http.StatusServiceUnavailable, code: "scheduled_closure", message: s.message}
+			if end := s.closesAt(now); !end.IsZero() {
+				kerr.retryAfter = end.Sub(now)
+			}
+			return s, kerr
+		}
+		if ok, wait := s.allow(client, now); !ok {
+			return s, &keyError{status: http.StatusTooManyRequests, code: "rate_limited", message: "the request rate allowed during " + s.name + " is exceeded", retryAfter: wait}
+		}
+	}
+	return nil, nil
+}
+
+// scheduleMiddleware applies the active schedules before the request reaches the proxy
+func scheduleMiddleware(h *ProxyHandler) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := h.schedules.Load()
+			if t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r, info := withRequestInfo(r)
+			var route string
+			if t.byRoute {
+				if target, err := h.resolveTarget(r, nil); err == nil && target.Route != nil {
+					route = target.Route.Name
+				}
+			}
+			s, kerr := t.check(route, info.ClientID, time.Now())
+			if kerr == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h.scheduleRejects.inc(s.name, kerr.code)
+			if kerr.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(kerr.retryAfter.Seconds()))))
+			}
+			h.writeError(w, r, nil, kerr.status, kerr.code, kerr.message)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package proxygo
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestScheduleClosed(t *testing.T) {
+	table, err := newScheduleTable([]ScheduleConfig{
+		{Name: "office", Window: "* 9-17 * * 1-5", Timezone: "Europe/Berlin", Routes: []string{"api"}, Closed: true},
+		{Name: "sunday", Window: "* * * * 7", Routes: []string{"batch"}, Closed: true},
+		{Name: "always", Window: "* * * * *", Routes: []string{"legacy"}, Closed: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-06-03 is a Monday; Berlin is two hours ahead of UTC in June
+	monday := func(hour, minute int) time.Time { return time.Date(2024, 6, 3, hour, minute, 0, 0, time.UTC) }
+	sunday := time.Date(2024, 6, 9, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		route      string
+		now        time.Time
+		closed     bool
+		retryAfter time.Duration
+	}{
+		{name: "before the window in Berlin", route: "api", now: monday(6, 59)},
+		{name: "window opens in Berlin", route: "api", now: monday(7, 0), closed: true, retryAfter: 9 * time.Hour},
+		{name: "closing soon", route: "api", now: monday(15, 45), closed: true, retryAfter: 15 * time.Minute},
+		{name: "after the window in Berlin", route: "api", now: monday(16, 0)},
+		{name: "other route", route: "web", now: monday(12, 0)},
+		{name: "sunday as 7 on a monday", route: "batch", now: monday(12, 0)},
+		{name: "sunday as 7 on a sunday", route: "batch", now: sunday, closed: true, retryAfter: 12 * time.Hour},
+		{name: "window without an end", route: "legacy", now: monday(12, 0), closed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, kerr := table.check(tt.route, "client", tt.now)
+			if !tt.closed {
+				if kerr != nil {
+					t.Fatalf("rejected with %d %s, want admitted", kerr.status, kerr.code)
+				}
+				return
+			}
+			if kerr == nil || kerr.status != http.StatusServiceUnavailable || kerr.code != "scheduled_closure" {
+				t.Fatalf("got %+v, want a scheduled closure", kerr)
+			}
+			if kerr.retryAfter != tt.retryAfter {
+				t.Errorf("retry after %s, want %s", kerr.retryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestScheduleRateLimit(t *testing.T) {
+	table, err := newScheduleTable([]ScheduleConfig{
+		{Name: "nightly", Window: "* 0-5 * * *", Timezone: "UTC", RateLimit: 0.001, Burst: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	night := time.Date(2024, 6, 3, 2, 0, 0, 0, time.UTC)
+	day := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+
+	for i := range 2 {
+		if _, kerr := table.check("", "alice", night); kerr != nil {
+			t.Fatalf("request %d within the burst: %d %s", i, kerr.status, kerr.code)
+		}
+	}
+	_, kerr := table.check("", "alice", night)
+	if kerr == nil || kerr.status != http.StatusTooManyRequests || kerr.retryAfter <= 0 {
+		t.Fatalf("over the limit: got %+v, want 429 with a retry delay", kerr)
+	}
+
+	// Each client has its own bucket, and the limit only holds during the window
+	if _, kerr := table.check("", "bob", night); kerr != nil {
+		t.Errorf("another client: %d %s, want admitted", kerr.status, kerr.code)
+	}
+	if _, kerr := table.check("", "alice", day); kerr != nil {
+		t.Errorf("outside the window: %d %s, want admitted", kerr.status, kerr.code)
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for name, sc := range map[string]ScheduleConfig{
+		"bad window":        {Window: "* * * *", Closed: true},
+		"never open":        {Window: "* * 31 2 *", Closed: true},
+		"@every window":     {Window: "@every 1h", Closed: true},
+		"unknown timezone":  {Window: "* * * * *", Timezone: "Mars/Olympus", Closed: true},
+		"nothing to change": {Window: "* * * * *"},
+	} {
+		if _, err := newScheduleTable([]ScheduleConfig{sc}); err == nil {
+			t.Errorf("%s: accepted, want an error", name)
+		}
+	}
+}
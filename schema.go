@@ -0,0 +1,434 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSchemaDepth stops runaway recursion through self-referencing schemas
+const maxSchemaDepth = 64
+
+// jsonSchema is a parsed JSON Schema document covering the commonly used keywords of
+// draft-07 and 2020-12, plus the OpenAPI 3.0 nullable and boolean exclusive bounds
+type jsonSchema struct {
+	root     any // the whole document, which $ref pointers are resolved against
+	schema   any // the schema to apply, root itself or a node inside an OpenAPI document
+	patterns map[string]*regexp.Regexp
+}
+
+// compileSchema prepares schema, a node within root, checking refs and patterns up front
+func compileSchema(root, schema any) (*jsonSchema, error) {
+	s := &jsonSchema{root: root, schema: schema, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.check(schema, "#", 0, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// check walks the schema, following each $ref once, so a broken document fails at
+// load rather than per request
+func (s *jsonSchema) check(node any, at string, depth int, seenRefs map[string]bool) error {
+	if depth > maxSchemaDepth {
+		return nil
+	}
+	switch n := node.(type) {
+	case map[string]any:
+		if ref, ok := n["$ref"].(string); ok && !seenRefs[ref] {
+			seenRefs[ref] = true
+			target, err := s.resolve(ref)
+			if err != nil {
+				return fmt.Errorf("%s: %w", at, err)
+			}
+			if err := s.check(target, ref, depth+1, seenRefs); err != nil {
+				return err
+			}
+		}
+		if p, ok := n["pattern"].(string); ok {
+			if err := s.compilePattern(p); err != nil {
+				return fmt.Errorf("%s/pattern: %w", at, err)
+			}
+		}
+		if pp, ok := n["patternProperties"].(map[string]any); ok {
+			for p := range pp {
+				if err := s.compilePattern(p); err != nil {
+					return fmt.Errorf("%s/patternProperties: %w", at, err)
+				}
+			}
+		}
+		for k, v := range n {
+			// Enum and const values are data, not schemas
+			if k == "enum" || k == "const" || k == "default" || k == "example" || k == "examples" {
+				continue
+			}
+			if err := s.check(v, at+"/"+k, depth+1, seenRefs); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, v := range n {
+			if err := s.check(v, at+"/"+strconv.Itoa(i), depth+1, seenRefs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compilePattern caches a pattern keyword's regexp
+func (s *jsonSchema) compilePattern(p string) error {
+	if _, ok := s.patterns[p]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return err
+	}
+	s.patterns[p] = re
+	return nil
+}
+
+// resolve follows a local JSON pointer such as "#/components/schemas/Pet"
+func (s *jsonSchema) resolve(ref string) (any, error) {
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("only local $ref values are supported, got %q", ref)
+	}
+	node := s.root
+	if pointer == "" {
+		return node, nil
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch n := node.(type) {
+		case map[string]any:
+			next, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("$ref %q does not resolve", ref)
+			}
+			node = next
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("$ref %q does not resolve", ref)
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("$ref %q does not resolve", ref)
+		}
+	}
+	return node, nil
+}
+
+// validate returns the ways value violates the schema, each prefixed with its JSON pointer
+func (s *jsonSchema) validate(value any) []string {
+	var problems []string
+	s.apply(s.schema, value, "", 0, &problems)
+	return problems
+}
+
+// apply checks value against one schema node, appending violations to problems
+func (s *jsonSchema) apply(node, value any, at string, depth int, problems *[]string) {
+	fail := func(format string, args ...any) {
+		where := at
+		if where == "" {
+			where = "/"
+		}
+		*problems = append(*problems, where+": "+fmt.Sprintf(format, args...))
+	}
+	if depth > maxSchemaDepth {
+		fail("schema nests too deeply")
+		return
+	}
+
+	schema, ok := node.(map[string]any)
+	if !ok {
+		// Boolean schemas: true accepts everything, false nothing
+		if b, isBool := node.(bool); isBool && !b {
+			fail("no value is allowed here")
+		}
+		return
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, _ := s.resolve(ref) // checked at compile time
+		s.apply(target, value, at, depth+1, problems)
+	}
+
+	if value == nil && schema["nullable"] == true {
+		return
+	}
+	if t, ok := schema["type"]; ok && !typeMatches(t, value) {
+		fail("expected %s, got %s", describeType(t), jsonTypeOf(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok && !containsJSON(enum, value) {
+		fail("value is not one of the allowed values")
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("value does not equal the required constant")
+	}
+
+	switch v := value.(type) {
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if min, ok := number(schema["minLength"]); ok && n < min {
+			fail("shorter than %v characters", min)
+		}
+		if max, ok := number(schema["maxLength"]); ok && n > max {
+			fail("longer than %v characters", max)
+		}
+		if p, ok := schema["pattern"].(string); ok && !s.patterns[p].MatchString(v) {
+			fail("does not match pattern %q", p)
+		}
+	case float64:
+		s.applyNumber(schema, v, fail)
+	case []any:
+		s.applyArray(schema, v, at, depth, problems, fail)
+	case map[string]any:
+		s.applyObject(schema, v, at, depth, problems, fail)
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			s.apply(sub, value, at, depth+1, problems)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok && s.countMatches(anyOf, value, at, depth) == 0 {
+		fail("does not match any of the allowed schemas")
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		if n := s.countMatches(oneOf, value, at, depth); n != 1 {
+			fail("matches %d of the schemas where exactly one is required", n)
+		}
+	}
+	if not, ok := schema["not"]; ok && s.countMatches([]any{not}, value, at, depth) == 1 {
+		fail("matches a schema it must not match")
+	}
+}
+
+// applyNumber checks the numeric keywords
+func (s *jsonSchema) applyNumber(schema map[string]any, v float64, fail func(string, ...any)) {
+	if min, ok := number(schema["minimum"]); ok {
+		// OpenAPI 3.0 spells an exclusive bound as a boolean next to minimum
+		if schema["exclusiveMinimum"] == true && v <= min {
+			fail("must be greater than %v", min)
+		} else if v < min {
+			fail("must be at least %v", min)
+		}
+	}
+	if max, ok := number(schema["maximum"]); ok {
+		if schema["exclusiveMaximum"] == true && v >= max {
+			fail("must be less than %v", max)
+		} else if v > max {
+			fail("must be at most %v", max)
+		}
+	}
+	if min, ok := number(schema["exclusiveMinimum"]); ok && v <= min {
+		fail("must be greater than %v", min)
+	}
+	if max, ok := number(schema["exclusiveMaximum"]); ok && v >= max {
+		fail("must be less than %v", max)
+	}
+	if m, ok := number(schema["multipleOf"]); ok && m > 0 {
+		if q := v / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", m)
+		}
+	}
+}
+
+// applyArray checks the array keywords and the items
+func (s *jsonSchema) applyArray(schema map[string]any, v []any, at string, depth int, problems *[]string, fail func(string, ...any)) {
+	n := float64(len(v))
+	if min, ok := number(schema["minItems"]); ok && n < min {
+		fail("fewer than %v items", min)
+	}
+	if max, ok := number(schema["maxItems"]); ok && n > max {
+		fail("more than %v items", max)
+	}
+	if schema["uniqueItems"] == true {
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if reflect.DeepEqual(v[i], v[j]) {
+					fail("items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+
+	// Tuple validation is prefixItems in 2020-12 and an items array in draft-07
+	prefix, _ := schema["prefixItems"].([]any)
+	if tuple, ok := schema["items"].([]any); ok {
+		prefix = tuple
+	}
+	for i, item := range v {
+		switch {
+		case i < len(prefix):
+			s.apply(prefix[i], item, at+"/"+strconv.Itoa(i), depth+1, problems)
+		case schema["items"] != nil && len(prefix) == 0:
+			s.apply(schema["items"], item, at+"/"+strconv.Itoa(i), depth+1, problems)
+		case schema["additionalItems"] != nil:
+			s.apply(schema["additionalItems"], item, at+"/"+strconv.Itoa(i), depth+1, problems)
+		}
+	}
+}
+
+// applyObject checks the object keywords and the properties
+func (s *jsonSchema) applyObject(schema map[string]any, v map[string]any, at string, depth int, problems *[]string, fail func(string, ...any)) {
+	n := float64(len(v))
+	if min, ok := number(schema["minProperties"]); ok && n < min {
+		fail("fewer than %v properties", min)
+	}
+	if max, ok := number(schema["maxProperties"]); ok && n > max {
+		fail("more than %v properties", max)
+	}
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := v[key]; !present {
+					fail("missing required property %q", key)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	patternProps, _ := schema["patternProperties"].(map[string]any)
+	additional, hasAdditional := schema["additionalProperties"]
+
+	// Walk keys in order so error messages are stable
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := at + "/" + strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+		matched := false
+		if sub, ok := properties[key]; ok {
+			s.apply(sub, v[key], child, depth+1, problems)
+			matched = true
+		}
+		for p, sub := range patternProps {
+			if s.patterns[p].MatchString(key) {
+				s.apply(sub, v[key], child, depth+1, problems)
+				matched = true
+			}
+		}
+		if !matched && hasAdditional {
+			if additional == false {
+				fail("property %q is not allowed", key)
+			} else {
+				s.apply(additional, v[key], child, depth+1, problems)
+			}
+		}
+	}
+}
+
+// countMatches reports how many of schemas value satisfies
+func (s *jsonSchema) countMatches(schemas []any, value any, at string, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		var problems []string
+		s.apply(sub, value, at, depth+1, &problems)
+		if len(problems) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// typeMatches checks the type keyword, which is a name or a list of names
+func typeMatches(t, value any) bool {
+	switch t := t.(type) {
+	case string:
+		return typeNameMatches(t, value)
+	case []any:
+		for _, name := range t {
+			if s, ok := name.(string); ok && typeNameMatches(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// typeNameMatches checks a single JSON Schema type name
+func typeNameMatches(name string, value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return name == "null"
+	case bool:
+		return name == "boolean"
+	case string:
+		return name == "string"
+	case float64:
+		return name == "number" || (name == "integer" && v == math.Trunc(v))
+	case []any:
+		return name == "array"
+	case map[string]any:
+		return name == "object"
+	}
+	return false
+}
+
+// jsonTypeOf names the JSON type of a decoded value
+func jsonTypeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+// describeType renders the type keyword for an error message
+func describeType(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, 0, len(list))
+		for _, n := range list {
+			names = append(names, fmt.Sprint(n))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// number reads a numeric keyword
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// containsJSON reports whether value deep-equals one of the list entries
+func containsJSON(list []any, value any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSONDocument parses a schema or OpenAPI document into generic values
+func decodeJSONDocument(data []byte) (any, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,192 @@
+package proxygo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSchema is a draft-07 schema exercising the keywords the validator supports
+const testSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 2, "maxLength": 8, "pattern": "^[a-z]+$"},
+		"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+		"score": {"type": "number", "multipleOf": 0.5},
+		"email": {"type": ["string", "null"]},
+		"kind": {"enum": ["cat", "dog"]},
+		"version": {"const": 2},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3, "uniqueItems": true},
+		"point": {"type": "array", "items": [{"type": "number"}, {"type": "number"}], "additionalItems": false},
+		"owner": {"$ref": "#/definitions/owner"},
+		"id": {"oneOf": [{"type": "integer"}, {"type": "string", "pattern": "^[0-9]+$"}]},
+		"labels": {"type": "object", "patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": {"type": "boolean"}},
+		"a/b": {"not": {"type": "null"}}
+	},
+	"definitions": {
+		"owner": {"type": "object", "required": ["id"], "properties": {"id": {"anyOf": [{"type": "integer"}, {"$ref": "#/definitions/uuid"}]}}},
+		"uuid": {"type": "string", "minLength": 36, "maxLength": 36}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	spec, err := loadJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid", `{"name": "rex", "age": 3, "score": 1.5, "email": null, "kind": "dog", "version": 2,
+			"tags": ["a", "b"], "point": [1, 2], "owner": {"id": 7}, "id": "42", "labels": {"x-a": "1", "b": true}, "a/b": 1}`, nil},
+		{"not an object", `[]`, []string{"/: expected object, got array"}},
+		{"missing and extra", `{"name": "rex", "extra": 1}`, []string{
+			`/: missing required property "age"`,
+			`/: property "extra" is not allowed`,
+		}},
+		{"string keywords", `{"name": "R", "age": 1}`, []string{
+			"/name: shorter than 2 characters",
+			`/name: does not match pattern "^[a-z]+$"`,
+		}},
+		{"string counts characters", `{"name": "ééééééééé", "age": 1}`, []string{
+			"/name: longer than 8 characters",
+			`/name: does not match pattern "^[a-z]+$"`,
+		}},
+		{"number keywords", `{"name": "rex", "age": 150, "score": 0.7}`, []string{
+			"/age: must be less than 150",
+			"/score: must be a multiple of 0.5",
+		}},
+		{"integer", `{"name": "rex", "age": 1.5}`, []string{"/age: expected integer, got number"}},
+		{"negative", `{"name": "rex", "age": -1}`, []string{"/age: must be at least 0"}},
+		{"type list", `{"name": "rex", "age": 1, "email": 3}`, []string{"/email: expected string or null, got number"}},
+		{"enum and const", `{"name": "rex", "age": 1, "kind": "cow", "version": 3}`, []string{
+			"/kind: value is not one of the allowed values",
+			"/version: value does not equal the required constant",
+		}},
+		{"array keywords", `{"name": "rex", "age": 1, "tags": ["a", "a", 1, "b"]}`, []string{
+			"/tags: more than 3 items",
+			"/tags: items 0 and 1 are equal",
+			"/tags/2: expected string, got number",
+		}},
+		{"tuple", `{"name": "rex", "age": 1, "point": [1, "2", 3]}`, []string{
+			"/point/1: expected number, got string",
+			"/point/2: no value is allowed here",
+		}},
+		{"ref", `{"name": "rex", "age": 1, "owner": {}}`, []string{`/owner: missing required property "id"`}},
+		{"nested ref in anyOf", `{"name": "rex", "age": 1, "owner": {"id": "short"}}`, []string{
+			"/owner/id: does not match any of the allowed schemas",
+		}},
+		{"oneOf none", `{"name": "rex", "age": 1, "id": "x1"}`, []string{
+			"/id: matches 0 of the schemas where exactly one is required",
+		}},
+		{"pattern and additional properties", `{"name": "rex", "age": 1, "labels": {"x-a": 1, "b": "no"}}`, []string{
+			"/labels/b: expected boolean, got string",
+			"/labels/x-a: expected string, got number",
+		}},
+		{"not, with an escaped pointer", `{"name": "rex", "age": 1, "a/b": null}`, []string{
+			"/a~1b: matches a schema it must not match",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := decodeJSONDocument([]byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			schema, _ := spec.schemaFor("POST", "/", "application/json")
+			if got := schema.validate(doc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validate(%s)\n got %q\nwant %q", tt.doc, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaOpenAPI(t *testing.T) {
+	spec, err := loadOpenAPI([]byte(`{
+		"openapi": "3.0.3",
+		"servers": [{"url": "https://api.example.com/v1/"}],
+		"paths": {
+			"/pets/{id}": {"put": {"requestBody": {"$ref": "#/components/requestBodies/Pet"}}},
+			"/pets/mine": {"put": {"requestBody": {"content": {"application/json": {"schema": {"type": "object", "maxProperties": 0}}}}}}
+		},
+		"components": {
+			"requestBodies": {"Pet": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}}}},
+			"schemas": {"Pet": {"type": "object", "properties": {
+				"weight": {"type": "number", "minimum": 0, "exclusiveMinimum": true},
+				"nick": {"type": "string", "nullable": true}
+			}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, mediaType string
+		doc                     string
+		required                bool
+		want                    []string
+		none                    bool // no schema applies
+	}{
+		{method: "PUT", path: "/v1/pets/7", mediaType: "application/json", doc: `{"weight": 0, "nick": null}`, required: true,
+			want: []string{"/weight: must be greater than 0"}},
+		{method: "PUT", path: "/v1/pets/7", mediaType: "application/vnd.pet+json", doc: `{"weight": 1, "nick": 2}`, required: true,
+			want: []string{"/nick: expected string, got number"}},
+		{method: "PUT", path: "/v1/pets/mine", mediaType: "application/json", doc: `{"a": 1}`,
+			want: []string{"/: more than 0 properties"}},
+		{method: "POST", path: "/v1/pets/7", none: true},
+		{method: "PUT", path: "/v1/pets", none: true},
+	}
+	for _, tt := range tests {
+		schema, required := spec.schemaFor(tt.method, tt.path, tt.mediaType)
+		if tt.none {
+			if schema != nil {
+				t.Errorf("schemaFor(%s %s) found a schema, want none", tt.method, tt.path)
+			}
+			continue
+		}
+		if schema == nil {
+			t.Errorf("schemaFor(%s %s %s) found no schema", tt.method, tt.path, tt.mediaType)
+			continue
+		}
+		if required != tt.required {
+			t.Errorf("schemaFor(%s %s) required = %v, want %v", tt.method, tt.path, required, tt.required)
+		}
+		doc, _ := decodeJSONDocument([]byte(tt.doc))
+		if got := schema.validate(doc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: validate(%s)\n got %q\nwant %q", tt.method, tt.path, tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestSchemaCompileErrors(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{`{"$ref": "#/definitions/missing"}`, `#: $ref "#/definitions/missing" does not resolve`},
+		{`{"$ref": "other.json#/a"}`, `only local $ref values are supported`},
+		{`{"properties": {"a": {"pattern": "("}}}`, `#/properties/a/pattern: error parsing regexp`},
+		{`{"patternProperties": {"[": {}}}`, `#/patternProperties: error parsing regexp`},
+	}
+	for _, tt := range tests {
+		_, err := loadJSONSchema([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadJSONSchema(%s) = %v, want an error containing %q", tt.schema, err, tt.want)
+		}
+	}
+
+	// A schema referring to itself compiles and stops at the depth limit
+	spec, err := loadJSONSchema([]byte(`{"type": "object", "properties": {"next": {"$ref": "#"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := decodeJSONDocument([]byte(`{"next": {"next": {"next": 1}}}`))
+	if got, want := spec.schema.validate(doc), []string{"/next/next/next: expected object, got number"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("validate = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errOutsideFilesRoot is returned for file:// targets that name a path outside the files root
+var errOutsideFilesRoot = errors.New("path is outside the files root")
+
+// FTPConfig lets targets use ftp:// URLs, served read-only: files are fetched with RETR
+// and paths ending in a slash are listed. Off unless enabled.
+type FTPConfig struct {
+	Enabled bool     `json:"enabled"`
+	Timeout Duration `json:"timeout"` // for connecting and for each control reply; default 30s
+}
+
+// FilesConfig lets targets use file:// URLs, served read-only from paths under Root the
+// way a static file server would. Off unless enabled.
+type FilesConfig struct {
+	Enabled bool   `json:"enabled"`
+	Root    string `json:"root"` // absolute directory; symlinks cannot lead out of it
+}
+
+// fileTransport serves file:// requests from beneath a root directory
+type fileTransport struct {
+	prefix string // the root as a file URL path, e.g. /srv/public
+	files  http.RoundTripper
+}
+
+// newFileTransport returns nil when file:// targets are disabled
+func newFileTransport(cfg *FilesConfig) (*fileTransport, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if !filepath.IsAbs(cfg.Root) {
+		return nil, fmt.Errorf("files: root must be an absolute path")
+	}
+	root, err := os.OpenRoot(cfg.Root)
+	if err != nil {
+		return nil, fmt.Errorf("files: %w", err)
+	}
+
+	// Windows roots such as C:\srv appear in file URLs as /C:/srv
+	prefix := filepath.ToSlash(filepath.Clean(cfg.Root))
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return &fileTransport{prefix: strings.TrimSuffix(prefix, "/"), files: http.NewFileTransportFS(rootFS{root.FS()})}, nil
+}
+
+// rootFS reports paths that would leave the root, such as symlinks pointing out of it,
+// as forbidden; the file server would otherwise answer them with a 500
+type rootFS struct {
+	fs.FS
+}
+
+// Open implements fs.FS
+func (r rootFS) Open(name string) (fs.File, error) {
+	f, err := r.FS.Open(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f, err
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if resp := readOnlyResponse(req); resp != nil {
+		return resp, nil
+	}
+
+	name := path.Clean(req.URL.Path)
+	rest, ok := strings.CutPrefix(name, t.prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return nil, fmt.Errorf("%w: %s", errOutsideFilesRoot, name)
+	}
+
+	// The file server works relative to the root; keep the trailing slash that marks a directory
+	out := req.Clone(req.Context())
+	out.URL.Path = "/" + strings.TrimPrefix(rest, "/")
+	if strings.HasSuffix(req.URL.Path, "/") && !strings.HasSuffix(out.URL.Path, "/") {
+		out.URL.Path += "/"
+	}
+	out.URL.RawPath = ""
+	return t.files.RoundTrip(out)
+}
+
+// readOnlyResponse refuses methods other than GET and HEAD, returning nil for those
+func readOnlyResponse(req *http.Request) *http.Response {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return nil
+	}
+	resp := textResponse(req, http.StatusMethodNotAllowed, "Method not allowed")
+	resp.Header.Set("Allow", "GET, HEAD")
+	return resp
+}
+
+// textResponse builds a plain text response to req
+func textResponse(req *http.Request, status int, text string) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	text += "\n"
+	return localResponse(req, status, header, io.NopCloser(strings.NewReader(text)), int64(len(text)))
+}
+
+// localResponse builds a response to req that proxygo produces itself; length is -1 when unknown
+func localResponse(req *http.Request, status int, header http.Header, body io.ReadCloser, length int64) *http.Response {
+	if length >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
@@ -0,0 +1,327 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr/vm"
+)
+
+// Script limits per request
+const (
+	defaultScriptTimeout  = 5 * time.Millisecond
+	defaultScriptMaxNodes = 500
+)
+
+// ScriptConfig is a list of rules written as expr-lang expressions (https://expr-lang.org)
+// that can send a routed request to another upstream, change its headers or refuse it.
+// Expressions read request attributes (method, host, path, query, scheme, client,
+// client_ip, country, tenant, route, upstream), call header(name), param(name),
+// cookie(name) and claim(name), the string builtins, in_cidr(ip, cidr) and hash(s). They
+// have no variables, loops or access to anything else, and every request gets a time
+// budget. Reloadable on SIGHUP.
+type ScriptConfig struct {
+	Name     string             `json:"name"`
+	Routes   []string           `json:"routes"`    // route names it runs for; empty for every request that matched a route
+	Rules    []ScriptRuleConfig `json:"rules"`     // tried in order
+	Timeout  Duration           `json:"timeout"`   // per request across the rules; default 5ms
+	MaxNodes int                `json:"max_nodes"` // syntax tree nodes per expression; default 500
+	OnError  string             `json:"on_error"`  // "reject" (default) answers 500, "continue" proxies the request as if the script had not run
+}
+
+// ScriptRuleConfig applies its actions to requests its condition holds for
+type ScriptRuleConfig struct {
+	When     string            `json:"when"`     // boolean expression, e.g. "method == 'POST' && header('X-Beta') == 'on'"; empty always applies
+	Upstream string            `json:"upstream"` // expression computing the upstream URL, e.g. "'http://' + lower(header('X-Region')) + '.internal'"
+	Headers  map[string]string `json:"headers"`  // request header to expression; a result of "" or nil removes the header
+	Reject   int               `json:"reject"`   // answer with this status instead of proxying
+	Message  string            `json:"message"`  // expression for the rejection message; default the status text
+	Stop     bool              `json:"stop"`     // skip the rules after this one when it applies
+}
+
+// scriptSet is the active list of scripts, replaced as a whole on reload
+type scriptSet struct {
+	scripts []*script
+}
+
+// script is one compiled ScriptConfig
+type script struct {
+	name      string
+	routes    []string
+	rules     []scriptRule
+	timeout   time.Duration
+	failClose bool
+}
+
+// scriptRule is one compiled rule
+type scriptRule struct {
+	when     *vm.Program // nil to always apply
+	upstream *vm.Program
+	headers  []scriptHeader // sorted by name
+	reject   int
+	message  *vm.Program
+	stop     bool
+}
+
+// scriptHeader sets or removes one request header
+type scriptHeader struct {
+	name  string
+	value *vm.Program
+}
+
+// scriptDecision is what a script decided for one request, applied only once every rule
+// ran without error
+type scriptDecision struct {
+	upstream *url.URL
+	headers  []scriptHeaderChange
+	reject   int
+	message  string
+	actions  []string // for metrics: "upstream", "headers", "reject"
+}
+
+// scriptHeaderChange is one evaluated header action; value "" removes the header
+type scriptHeaderChange struct {
+	name, value string
+}
+
+// newScriptSet compiles the scripts, returning nil when there are none; routes are the
+// names scripts may be limited to
+func newScriptSet(configs []ScriptConfig, routes []*Route) (*scriptSet, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	set := &scriptSet{}
+	for i, sc := range configs {
+		name := sc.Name
+		if name == "" {
+			name = fmt.Sprintf("script-%d", i)
+		}
+		s, err := compileScript(name, sc, routes)
+		if err != nil {
+			return nil, fmt.Errorf("script %s: %w", name, err)
+		}
+		set.scripts = append(set.scripts, s)
+	}
+	return set, nil
+}
+
+// compileScript compiles one script's rules
+func compileScript(name string, sc ScriptConfig, routes []*Route) (*script, error) {
+	if len(sc.Rules) == 0 {
+		return nil, fmt.Errorf("rules is required")
+	}
+	for _, route := range sc.Routes {
+		if !slices.ContainsFunc(routes, func(r *Route) bool { return r.Name == route }) {
+			return nil, fmt.Errorf("unknown route %q", route)
+		}
+	}
+	s := &script{name: name, routes: sc.Routes, timeout: time.Duration(sc.Timeout)}
+	if s.timeout <= 0 {
+		s.timeout = defaultScriptTimeout
+	}
+	maxNodes := sc.MaxNodes
+	if maxNodes <= 0 {
+		maxNodes = defaultScriptMaxNodes
+	}
+	switch sc.OnError {
+	case "", "reject":
+		s.failClose = true
+	case "continue":
+	default:
+		return nil, fmt.Errorf("unknown on_error %q: expected reject or continue", sc.OnError)
+	}
+
+	compile := func(source string, asBool bool) (*vm.Program, error) {
+		if strings.TrimSpace(source) == "" {
+			return nil, nil
+		}
+		return compileExpr(source, maxNodes, asBool)
+	}
+	for i, rc := range sc.Rules {
+		var rule scriptRule
+		var err error
+		if rule.when, err = compile(rc.When, true); err != nil {
+			return nil, fmt.Errorf("rule #%d when: %w", i, err)
+		}
+		if rule.upstream, err = compile(rc.Upstream, false); err != nil {
+			return nil, fmt.Errorf("rule #%d upstream: %w", i, err)
+		}
+		for header, source := range rc.Headers {
+			value, err := compile(source, false)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d header %s: %w", i, header, err)
+			}
+			if value == nil {
+				return nil, fmt.Errorf("rule #%d header %s: expression is required; use nil to remove it", i, header)
+			}
+			rule.headers = append(rule.headers, scriptHeader{name: http.CanonicalHeaderKey(header), value: value})
+		}
+		sort.Slice(rule.headers, func(a, b int) bool { return rule.headers[a].name < rule.headers[b].name })
+		if rc.Reject != 0 && (rc.Reject < 400 || rc.Reject > 599) {
+			return nil, fmt.Errorf("rule #%d: reject must be a 4xx or 5xx status", i)
+		}
+		rule.reject = rc.Reject
+		if rule.message, err = compile(rc.Message, false); err != nil {
+			return nil, fmt.Errorf("rule #%d message: %w", i, err)
+		}
+		if rule.message != nil && rule.reject == 0 {
+			return nil, fmt.Errorf("rule #%d: message needs reject", i)
+		}
+		if rule.upstream == nil && len(rule.headers) == 0 && rule.reject == 0 {
+			return nil, fmt.Errorf("rule #%d: set upstream, headers or reject", i)
+		}
+		rule.stop = rc.Stop
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// appliesTo reports whether s runs for requests to route
+func (s *script) appliesTo(route string) bool {
+	return len(s.routes) == 0 || slices.Contains(s.routes, route)
+}
+
+// scriptEnv exposes the request to the expressions of one script run
+func scriptEnv(r *http.Request, target *proxyTarget, info *requestInfo, claims jwtClaims) *exprEnv {
+	env := newExprEnv(map[string]func(name string) string{
+		"header": r.Header.Get,
+		"param":  r.URL.Query().Get,
+		"cookie": func(name string) string {
+			if c, err := r.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		},
+		"claim": claims.stringClaim,
+	})
+	env.Method, env.Host, env.Path, env.Query = r.Method, r.Host, r.URL.Path, r.URL.RawQuery
+	env.Scheme = "http"
+	if r.TLS != nil {
+		env.Scheme = "https"
+	}
+	env.Client, env.ClientIP, env.Country, env.Tenant = info.ClientID, info.ClientIP, info.Country, info.Tenant
+	env.Route, env.Upstream = target.Route.Name, target.URL.String()
+	return env
+}
+
+// run evaluates the rules for a request
+func (s *script) run(env *exprEnv) (*scriptDecision, error) {
+	env.deadline = time.Now().Add(s.timeout)
+	d := &scriptDecision{}
+	for i, rule := range s.rules {
+		// Evaluations only look at the clock when they build strings, so check it between them too
+		if time.Now().After(env.deadline) {
+			return nil, fmt.Errorf("rule #%d: %w", i, errExprDeadline)
+		}
+		if rule.when != nil {
+			v, err := evalExpr(rule.when, env)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d when: %w", i, err)
+			}
+			if !v.(bool) {
+				continue
+			}
+		}
+
+		if rule.upstream != nil {
+			v, err := evalExpr(rule.upstream, env)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d upstream: %w", i, err)
+			}
+			u, err := url.Parse(exprString(v))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("rule #%d upstream: %q is not an http or https URL", i, exprString(v))
+			}
+			d.upstream = u
+			d.actions = append(d.actions, "upstream")
+			env.Upstream = u.String()
+		}
+		for _, header := range rule.headers {
+			v, err := evalExpr(header.value, env)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d header %s: %w", i, header.name, err)
+			}
+			value := exprString(v)
+			if strings.ContainsAny(value, "\r\n\x00") {
+				return nil, fmt.Errorf("rule #%d header %s: value contains a line break or NUL", i, header.name)
+			}
+			d.headers = append(d.headers, scriptHeaderChange{name: header.name, value: value})
+		}
+		if len(rule.headers) > 0 {
+			d.actions = append(d.actions, "headers")
+		}
+		if rule.reject != 0 {
+			d.reject = rule.reject
+			d.message = http.StatusText(rule.reject)
+			if rule.message != nil {
+				v, err := evalExpr(rule.message, env)
+				if err != nil {
+					return nil, fmt.Errorf("rule #%d message: %w", i, err)
+				}
+				d.message = exprString(v)
+			}
+			d.actions = append(d.actions, "reject")
+			return d, nil
+		}
+		if rule.stop {
+			break
+		}
+	}
+	return d, nil
+}
+
+// runScripts runs every script for the request's route in order, each seeing the changes
+// of the ones before, and reports whether the request was answered
+func (h *ProxyHandler) runScripts(w http.ResponseWriter, r *http.Request, target *proxyTarget, info *requestInfo, claims jwtClaims) bool {
+	set := h.scripts.Load()
+	if set == nil || target.Route == nil {
+		return false
+	}
+	for _, s := range set.scripts {
+		if !s.appliesTo(target.Route.Name) {
+			continue
+		}
+		d, err := s.run(scriptEnv(r, target, info, claims))
+		if err != nil {
+			h.scriptActions.inc(s.name, "error")
+			if errors.Is(err, errExprDeadline) {
+				err = fmt.Errorf("%w (%s)", err, s.timeout)
+			}
+			h.logger.Printf("Script %s failed for %s %s: %v", s.name, r.Method, r.URL.Path, err)
+			if s.failClose {
+				h.writeError(w, r, target, http.StatusInternalServerError, "script_error", "The request could not be routed")
+				return true
+			}
+			continue
+		}
+		for _, action := range d.actions {
+			h.scriptActions.inc(s.name, action)
+		}
+		if d.reject != 0 {
+			h.logger.Printf("Script %s rejected %s %s with %d", s.name, r.Method, r.URL.Path, d.reject)
+			h.audit(r, auditEvent{Event: auditRequestDenied, Status: d.reject, Reason: "script", Details: map[string]string{"script": s.name}})
+			h.writeError(w, r, target, d.reject, "script_rejected", d.message)
+			return true
+		}
+		for _, change := range d.headers {
+			if change.value == "" {
+				r.Header.Del(change.name)
+			} else {
+				r.Header.Set(change.name, change.value)
+			}
+		}
+		if d.upstream != nil {
+			rest, _ := matchPrefix(r.URL.Path, target.Route.Prefix)
+			target.URL = d.upstream
+			target.Path = singleJoiningSlash(d.upstream.Path, rest)
+			target.Socket = ""
+		}
+	}
+	return false
+}
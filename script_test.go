@@ -0,0 +1,53 @@
+package proxygo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestScriptUpstreamChecks checks that an upstream picked by a script faces the loop and
+// API key host checks the route's own upstream passed
+func TestScriptUpstreamChecks(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+	other := strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+
+	keyFile := writeTestKeys(t, &APIKey{ID: "local", Hash: hashKey("secret"), AllowedHosts: []string{"127.0.0.1"}})
+	h := newTestHandler(t, `{
+		"listeners": [{"name": "http", "address": "127.0.0.1:18080"}],
+		"api_keys": {"file": "`+keyFile+`"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}],
+		"scripts": [{"rules": [
+			{"when": "header('X-To') == 'self'", "upstream": "'http://127.0.0.1:18080'"},
+			{"when": "header('X-To') == 'other'", "upstream": "'`+other+`'"},
+			{"when": "header('X-To') == 'same'", "upstream": "'`+upstream.URL+`/v2'"}
+		]}]
+	}`)
+
+	tests := []struct {
+		to     string
+		status int
+		hits   int32
+	}{
+		{to: "self", status: http.StatusLoopDetected},
+		{to: "other", status: http.StatusForbidden},
+		{to: "same", status: http.StatusOK, hits: 1},
+	}
+	for _, tt := range tests {
+		hits.Store(0)
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		req.Header.Set("X-API-Key", "secret")
+		req.Header.Set("X-To", tt.to)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status || hits.Load() != tt.hits {
+			t.Errorf("to %s: status %d with %d upstream requests, want %d with %d", tt.to, rec.Code, hits.Load(), tt.status, tt.hits)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for fetching secrets
+const (
+	defaultSecretRefresh = 5 * time.Minute
+	secretFetchTimeout   = 10 * time.Second
+)
+
+// secretRefPattern matches a reference to a secret in a config string
+var secretRefPattern = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+
+// SecretsConfig names credentials kept in external stores. Config strings that carry
+// upstream credentials, the values of a route's upstream_headers and its aws_signing
+// keys, refer to them as ${secret:name}. Every secret is fetched at startup, which fails
+// if one cannot be, and fetched again on a schedule; a failed refresh keeps the last value.
+type SecretsConfig struct {
+	Refresh Duration                `json:"refresh"` // how often secrets are fetched again; default 5m
+	Vault   *VaultConfig            `json:"vault,omitempty"`
+	AWS     *AWSSecretsConfig       `json:"aws,omitempty"`
+	List    map[string]SecretConfig `json:"list"` // secrets by the name references use
+}
+
+// SecretConfig is where one secret is kept
+type SecretConfig struct {
+	Source  string   `json:"source"`  // "env", "file", "vault" or "aws"
+	Name    string   `json:"name"`    // env: the variable
+	Path    string   `json:"path"`    // file: the file, read whole less a trailing newline; vault: the secret, e.g. "secret/data/orders"
+	ID      string   `json:"id"`      // aws: name or ARN of the secret
+	Field   string   `json:"field"`   // vault: the key in the secret's data; aws: a key in a JSON secret string
+	Refresh Duration `json:"refresh"` // overrides secrets.refresh for this secret
+}
+
+// VaultConfig reaches a HashiCorp Vault server; KV version 1 and 2 secrets can be read
+type VaultConfig struct {
+	Address   string `json:"address"`    // default VAULT_ADDR
+	Token     string `json:"token"`      // default VAULT_TOKEN
+	TokenFile string `json:"token_file"` // read on every fetch, so an agent can renew the token
+	Namespace string `json:"namespace"`  // Vault Enterprise namespace
+}
+
+// AWSSecretsConfig reaches AWS Secrets Manager with the credentials aws_signing uses
+// when it has no static keys: the environment, the container endpoint or the instance role
+type AWSSecretsConfig struct {
+	Region   string `json:"region"`   // default AWS_REGION
+	Endpoint string `json:"endpoint"` // default https://secretsmanager.<region>.amazonaws.com
+}
+
+// secretStore holds the current value of every configured secret
+type secretStore struct {
+	vault     *VaultConfig
+	awsRegion string
+	awsURL    string
+	client    *http.Client
+	logger    *log.Logger
+
+	secrets map[string]*secret
+
+	refreshes *metricVec
+}
+
+// secret is one configured secret and its current value
+type secret struct {
+	name    string
+	cfg     SecretConfig
+	refresh time.Duration
+
+	mu      sync.RWMutex
+	value   string
+	fetched time.Time
+}
+
+// newSecretStore validates cfg without fetching anything; it returns nil when no secrets
+// are configured
+func newSecretStore(cfg *SecretsConfig, logger *log.Logger, metrics *metricsRegistry) (*secretStore, error) {
+	if cfg == nil || len(cfg.List) == 0 {
+		return nil, nil
+	}
+	refresh := time.Duration(cfg.Refresh)
+	if refresh < 0 {
+		return nil, errors.New("secrets: refresh must not be negative")
+	}
+	if refresh == 0 {
+		refresh = defaultSecretRefresh
+	}
+	s := &secretStore{
+		client:  &http.Client{Timeout: secretFetchTimeout},
+		logger:  logger,
+		secrets: make(map[string]*secret, len(cfg.List)),
+	}
+
+	var err error
+	for name, sc := range cfg.List {
+		if name == "" || strings.ContainsAny(name, "{}$") {
+			return nil, fmt.Errorf("secrets: invalid secret name %q", name)
+		}
+		switch sc.Source {
+		case "env":
+			if sc.Name == "" {
+				return nil, fmt.Errorf("secrets: %s: env needs name", name)
+			}
+		case "file":
+			if sc.Path == "" {
+				return nil, fmt.Errorf("secrets: %s: file needs path", name)
+			}
+		case "vault":
+			if sc.Path == "" || sc.Field == "" {
+				return nil, fmt.Errorf("secrets: %s: vault needs path and field", name)
+			}
+			if s.vault == nil {
+				if s.vault, err = vaultSettings(cfg.Vault); err != nil {
+					return nil, err
+				}
+			}
+		case "aws":
+			if sc.ID == "" {
+				return nil, fmt.Errorf("secrets: %s: aws needs id", name)
+			}
+			if s.awsURL == "" {
+				if s.awsRegion, s.awsURL, err = awsSecretsSettings(cfg.AWS); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("secrets: %s: unknown source %q: expected env, file, vault or aws", name, sc.Source)
+		}
+		if sc.Refresh < 0 {
+			return nil, fmt.Errorf("secrets: %s: refresh must not be negative", name)
+		}
+		sec := &secret{name: name, cfg: sc, refresh: time.Duration(sc.Refresh)}
+		if sec.refresh == 0 {
+			sec.refresh = refresh
+		}
+		s.secrets[name] = sec
+	}
+
+	s.refreshes = metrics.counter("proxygo_secret_refreshes_total", "Fetches of secrets from their store, by result.", "secret", "result")
+	metrics.gaugeFunc("proxygo_secret_age_seconds", "Time since each secret was last fetched successfully.", []string{"secret"}, func() []sample {
+		now := time.Now()
+		out := make([]sample, 0, len(s.secrets))
+		for _, sec := range s.secrets {
+			sec.mu.RLock()
+			fetched := sec.fetched
+			sec.mu.RUnlock()
+			if !fetched.IsZero() {
+				out = append(out, sample{labels: []string{sec.name}, value: now.Sub(fetched).Seconds()})
+			}
+		}
+		return out
+	})
+	return s, nil
+}
+
+// vaultSettings fills in the Vault defaults from the environment
+func vaultSettings(cfg *VaultConfig) (*VaultConfig, error) {
+	v := VaultConfig{}
+	if cfg != nil {
+		v = *cfg
+	}
+	if v.Address == "" {
+		v.Address = os.Getenv("VAULT_ADDR")
+	}
+	if v.Address == "" {
+		return nil, errors.New("secrets: vault: address is required when VAULT_ADDR is not set")
+	}
+	v.Address = strings.TrimSuffix(v.Address, "/")
+	if v.Token == "" && v.TokenFile == "" {
+		v.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if v.Token == "" && v.TokenFile == "" {
+		return nil, errors.New("secrets: vault: token or token_file is required when VAULT_TOKEN is not set")
+	}
+	return &v, nil
+}
+
+// awsSecretsSettings returns the region and endpoint of Secrets Manager
+func awsSecretsSettings(cfg *AWSSecretsConfig) (region, endpoint string, err error) {
+	if cfg != nil {
+		region, endpoint = cfg.Region, cfg.Endpoint
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return "", "", errors.New("secrets: aws: region is required when AWS_REGION is not set")
+	}
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	return region, strings.TrimSuffix(endpoint, "/") + "/", nil
+}
+
+// load fetches every secret once, failing on the first that cannot be fetched
+func (s *secretStore) load(ctx context.Context) error {
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.refresh(ctx, s.secrets[name]); err != nil {
+			return fmt.Errorf("secrets: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// run refreshes every secret on its schedule until ctx is done
+func (s *secretStore) run(ctx context.Context) {
+	for _, sec := range s.secrets {
+		go func() {
+			ticker := time.NewTicker(sec.refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					// The last value keeps being used until a fetch succeeds again
+					if err := s.refresh(ctx, sec); err != nil {
+						s.logger.Printf("Refreshing secret %s failed, keeping the previous value: %v", sec.name, err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// refresh fetches sec from its store and makes the new value current
+func (s *secretStore) refresh(ctx context.Context, sec *secret) error {
+	ctx, cancel := context.WithTimeout(ctx, secretFetchTimeout)
+	defer cancel()
+	value, err := s.fetch(ctx, sec.cfg)
+	if err == nil && value == "" {
+		err = errors.New("secret is empty")
+	}
+	if err != nil {
+		s.refreshes.inc(sec.name, "error")
+		return err
+	}
+	sec.mu.Lock()
+	changed := sec.value != "" && sec.value != value
+	sec.value, sec.fetched = value, time.Now()
+	sec.mu.Unlock()
+	s.refreshes.inc(sec.name, "ok")
+	if changed {
+		s.logger.Printf("Secret %s rotated", sec.name)
+	}
+	return nil
+}
+
+// fetch reads a secret from its store
+func (s *secretStore) fetch(ctx context.Context, sc SecretConfig) (string, error) {
+	switch sc.Source {
+	case "env":
+		value, ok := os.LookupEnv(sc.Name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", sc.Name)
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(sc.Path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "vault":
+		return s.fetchVault(ctx, sc)
+	case "aws":
+		return s.fetchAWS(ctx, sc)
+	}
+	return "", fmt.Errorf("unknown source %q", sc.Source)
+}
+
+// fetchVault reads a field of a Vault KV secret
+func (s *secretStore) fetchVault(ctx context.Context, sc SecretConfig) (string, error) {
+	token := s.vault.Token
+	if s.vault.TokenFile != "" {
+		data, err := os.ReadFile(s.vault.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.vault.Address+"/v1/"+strings.TrimPrefix(sc.Path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if s.vault.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.vault.Namespace)
+	}
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := s.getJSON(req, &body); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	data := body.Data
+	// KV version 2 nests the secret's data, next to its metadata
+	if nested, ok := data["data"]; ok {
+		if _, ok := data["metadata"]; ok {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return "", fmt.Errorf("vault: %w", err)
+			}
+		}
+	}
+	return secretField(data, sc.Field)
+}
+
+// fetchAWS reads a secret from AWS Secrets Manager
+func (s *secretStore) fetchAWS(ctx context.Context, sc SecretConfig) (string, error) {
+	creds, err := defaultAWSCredentials.retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+	payload, _ := json.Marshal(map[string]string{"SecretId": sc.ID})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.awsURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	sum := sha256.Sum256(payload)
+	creds.signV4(req, s.awsRegion, "secretsmanager", hex.EncodeToString(sum[:]), time.Now())
+
+	var body struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := s.getJSON(req, &body); err != nil {
+		return "", fmt.Errorf("aws secrets manager: %w", err)
+	}
+	if sc.Field == "" {
+		return body.SecretString, nil
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body.SecretString), &data); err != nil {
+		return "", fmt.Errorf("aws secrets manager: field %s: the secret is not a JSON object", sc.Field)
+	}
+	return secretField(data, sc.Field)
+}
+
+// getJSON sends req and decodes a successful JSON response into v
+func (s *secretStore) getJSON(req *http.Request, v any) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, v)
+}
+
+// secretField returns a field of a secret's data; strings are used as they are and other
+// JSON values as their encoding
+func secretField(data map[string]json.RawMessage, field string) (string, error) {
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("no field %s in the secret", field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return string(raw), nil
+	}
+	return value, nil
+}
+
+// secretRefs returns the names of the secrets s refers to
+func secretRefs(s string) []string {
+	var names []string
+	for _, m := range secretRefPattern.FindAllStringSubmatch(s, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// expand replaces the secret references in s with the current values
+func (s *secretStore) expand(v string) (string, error) {
+	var missing []string
+	out := secretRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		name := secretRefPattern.FindStringSubmatch(ref)[1]
+		if s != nil {
+			if sec, ok := s.secrets[name]; ok {
+				sec.mu.RLock()
+				defer sec.mu.RUnlock()
+				return sec.value
+			}
+		}
+		missing = append(missing, name)
+		return ""
+	})
+	if missing != nil {
+		return "", fmt.Errorf("unknown secret %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// checkRefs reports references to secrets that are not configured
+func (s *secretStore) checkRefs(routes []*Route) error {
+	for _, route := range routes {
+		for _, name := range route.secretRefs() {
+			if s == nil || s.secrets[name] == nil {
+				return fmt.Errorf("route %s: unknown secret %s", route.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// secretRefs returns the names of the secrets the route's upstream credentials refer to
+func (route *Route) secretRefs() []string {
+	var names []string
+	for _, uh := range route.UpstreamHeaders {
+		names = append(names, secretRefs(uh.value)...)
+	}
+	if route.Signer != nil && route.Signer.keys != nil {
+		keys := route.Signer.keys
+		names = append(names, secretRefs(keys.AccessKeyID+keys.SecretAccessKey+keys.SessionToken)...)
+	}
+	return names
+}
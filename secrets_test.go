@@ -0,0 +1,80 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSecretsStayWithTheirTenant(t *testing.T) {
+	t.Setenv("PROXYGO_TEST_ACME_TOKEN", "acme-token")
+	t.Setenv("PROXYGO_TEST_GLOBEX_TOKEN", "globex-token")
+
+	// The upstream holds requests for /live until released, so concurrent ones overlap
+	release := make(chan struct{})
+	upstream := newCacheUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/live" {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "data for "+r.Header.Get("Authorization"))
+	})
+
+	// Both tenants have a route named api to the same upstream, each with its own credentials
+	h := newTestHandler(t, `{"cache": {"enabled": true}, "coalesce": {"enabled": true},
+		"secrets": {"list": {
+			"acme-token": {"source": "env", "name": "PROXYGO_TEST_ACME_TOKEN"},
+			"globex-token": {"source": "env", "name": "PROXYGO_TEST_GLOBEX_TOKEN"}}},
+		"tenants": {"list": [
+			{"id": "acme", "hosts": ["acme.test"], "routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`",
+				"upstream_headers": {"Authorization": "Bearer ${secret:acme-token}"}}]},
+			{"id": "globex", "hosts": ["globex.test"], "routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`",
+				"upstream_headers": {"Authorization": "Bearer ${secret:globex-token}"}}]}
+		]}}`)
+
+	get := func(host, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Requests in flight together are not coalesced across tenants
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	concurrent := map[string]*httptest.ResponseRecorder{}
+	for _, host := range []string{"acme.test", "globex.test", "acme.test", "globex.test"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := get(host, "/api/live")
+			mu.Lock()
+			defer mu.Unlock()
+			if prev, ok := concurrent[host]; ok && prev.Body.String() != w.Body.String() {
+				t.Errorf("%s: %q and %q for the same tenant", host, prev.Body, w.Body)
+			}
+			concurrent[host] = w
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for host, want := range map[string]string{"acme.test": "data for Bearer acme-token", "globex.test": "data for Bearer globex-token"} {
+		if w := concurrent[host]; w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("concurrent %s: %d %q, want %q", host, w.Code, w.Body, want)
+		}
+	}
+	if n := upstream.hits.Load(); n != 2 {
+		t.Errorf("%d upstream requests, want one per tenant", n)
+	}
+
+	// Nor is one tenant answered from what the other's credentials fetched
+	checkCached(t, "acme", get("acme.test", "/api/items"), http.StatusOK, "data for Bearer acme-token", "MISS")
+	checkCached(t, "globex", get("globex.test", "/api/items"), http.StatusOK, "data for Bearer globex-token", "MISS")
+	checkCached(t, "acme cached", get("acme.test", "/api/items"), http.StatusOK, "data for Bearer acme-token", "HIT")
+	checkCached(t, "globex cached", get("globex.test", "/api/items"), http.StatusOK, "data for Bearer globex-token", "HIT")
+}
@@ -0,0 +1,96 @@
+package proxygo
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHSTSMaxAge is how long browsers remember to use https only
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// upstreamFingerprintHeaders reveal the upstream's software and are always stripped in
+// hardening mode. Hop-by-hop headers never reach clients: the reverse proxy drops them.
+var upstreamFingerprintHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+
+// SecurityHeadersConfig hardens proxied responses: it adds browser security headers
+// and strips headers that fingerprint the upstream. Upstream values win unless Override is set.
+type SecurityHeadersConfig struct {
+	HSTSMaxAge            Duration `json:"hsts_max_age"`            // sent on TLS connections only; default 1 year, negative disables
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"` // add includeSubDomains
+	HSTSPreload           bool     `json:"hsts_preload"`            // add preload
+	FrameOptions          string   `json:"frame_options"`           // "DENY" (default), "SAMEORIGIN" or "off"
+	ContentSecurityPolicy string   `json:"content_security_policy"` // sent when set
+	Override              bool     `json:"override"`                // replace security headers the upstream already set
+	StripHeaders          []string `json:"strip_headers"`           // removed in addition to Server, X-Powered-By and friends
+}
+
+// securityHeaders is a compiled SecurityHeadersConfig
+type securityHeaders struct {
+	hsts     string // Strict-Transport-Security value, "" when disabled
+	set      [][2]string
+	strip    []string
+	override bool
+}
+
+// newSecurityHeaders compiles cfg, returning nil when hardening is disabled
+func newSecurityHeaders(cfg *SecurityHeadersConfig) (*securityHeaders, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	s := &securityHeaders{
+		set:      [][2]string{{"X-Content-Type-Options", "nosniff"}},
+		strip:    append(append([]string{}, upstreamFingerprintHeaders...), cfg.StripHeaders...),
+		override: cfg.Override,
+	}
+
+	if maxAge := time.Duration(cfg.HSTSMaxAge); maxAge >= 0 {
+		if maxAge == 0 {
+			maxAge = defaultHSTSMaxAge
+		}
+		s.hsts = "max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10)
+		if cfg.HSTSIncludeSubdomains {
+			s.hsts += "; includeSubDomains"
+		}
+		if cfg.HSTSPreload {
+			s.hsts += "; preload"
+		}
+	}
+
+	switch frame := strings.ToUpper(cfg.FrameOptions); frame {
+	case "", "DENY", "SAMEORIGIN":
+		if frame == "" {
+			frame = "DENY"
+		}
+		s.set = append(s.set, [2]string{"X-Frame-Options", frame})
+	case "OFF":
+	default:
+		return nil, fmt.Errorf("security_headers: frame_options must be DENY, SAMEORIGIN or off, got %q", cfg.FrameOptions)
+	}
+
+	if cfg.ContentSecurityPolicy != "" {
+		s.set = append(s.set, [2]string{"Content-Security-Policy", cfg.ContentSecurityPolicy})
+	}
+	return s, nil
+}
+
+// modifyResponse applies the headers to an upstream response
+func (s *securityHeaders) modifyResponse(resp *http.Response) error {
+	for _, name := range s.strip {
+		resp.Header.Del(name)
+	}
+
+	headers := s.set
+	// Browsers ignore HSTS received over plain http
+	if s.hsts != "" && resp.Request != nil && resp.Request.TLS != nil {
+		headers = append(headers[:len(headers):len(headers)], [2]string{"Strict-Transport-Security", s.hsts})
+	}
+	for _, h := range headers {
+		if s.override || resp.Header.Get(h[0]) == "" {
+			resp.Header.Set(h[0], h[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package proxygo
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      SecurityHeadersConfig
+		tls      bool
+		upstream http.Header
+		want     http.Header // the response headers afterwards
+	}{
+		{
+			name: "defaults over https", tls: true,
+			upstream: http.Header{"Server": {"nginx"}, "X-Powered-By": {"PHP"}, "Content-Type": {"text/html"}},
+			want: http.Header{
+				"Content-Type":              {"text/html"},
+				"X-Content-Type-Options":    {"nosniff"},
+				"X-Frame-Options":           {"DENY"},
+				"Strict-Transport-Security": {"max-age=31536000"},
+			},
+		},
+		{
+			name: "no hsts over http",
+			want: http.Header{"X-Content-Type-Options": {"nosniff"}, "X-Frame-Options": {"DENY"}},
+		},
+		{
+			name: "hsts options", tls: true,
+			cfg: SecurityHeadersConfig{HSTSMaxAge: Duration(time.Hour), HSTSIncludeSubdomains: true, HSTSPreload: true, FrameOptions: "off"},
+			want: http.Header{
+				"X-Content-Type-Options":    {"nosniff"},
+				"Strict-Transport-Security": {"max-age=3600; includeSubDomains; preload"},
+			},
+		},
+		{
+			name: "hsts disabled", tls: true,
+			cfg: SecurityHeadersConfig{HSTSMaxAge: Duration(-1), FrameOptions: "sameorigin", ContentSecurityPolicy: "default-src 'self'"},
+			want: http.Header{
+				"X-Content-Type-Options":  {"nosniff"},
+				"X-Frame-Options":         {"SAMEORIGIN"},
+				"Content-Security-Policy": {"default-src 'self'"},
+			},
+		},
+		{
+			name:     "upstream values win",
+			cfg:      SecurityHeadersConfig{ContentSecurityPolicy: "default-src 'self'"},
+			upstream: http.Header{"X-Frame-Options": {"SAMEORIGIN"}, "Content-Security-Policy": {"default-src *"}},
+			want: http.Header{
+				"X-Content-Type-Options":  {"nosniff"},
+				"X-Frame-Options":         {"SAMEORIGIN"},
+				"Content-Security-Policy": {"default-src *"},
+			},
+		},
+		{
+			name:     "override",
+			cfg:      SecurityHeadersConfig{ContentSecurityPolicy: "default-src 'self'", Override: true},
+			upstream: http.Header{"X-Frame-Options": {"SAMEORIGIN"}, "Content-Security-Policy": {"default-src *"}},
+			want: http.Header{
+				"X-Content-Type-Options":  {"nosniff"},
+				"X-Frame-Options":         {"DENY"},
+				"Content-Security-Policy": {"default-src 'self'"},
+			},
+		},
+		{
+			name:     "extra stripped headers",
+			cfg:      SecurityHeadersConfig{StripHeaders: []string{"X-Backend"}},
+			upstream: http.Header{"X-Backend": {"app-3"}, "X-Aspnet-Version": {"4.0"}},
+			want:     http.Header{"X-Content-Type-Options": {"nosniff"}, "X-Frame-Options": {"DENY"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSecurityHeaders(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			resp := &http.Response{Header: http.Header{}, Request: req}
+			for name, values := range tt.upstream {
+				resp.Header[name] = values
+			}
+			s.modifyResponse(resp)
+			if !reflect.DeepEqual(resp.Header, tt.want) {
+				t.Errorf("headers %v, want %v", resp.Header, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersConfig(t *testing.T) {
+	if s, err := newSecurityHeaders(nil); s != nil || err != nil {
+		t.Errorf("newSecurityHeaders(nil) = %v, %v; want hardening disabled", s, err)
+	}
+	_, err := newSecurityHeaders(&SecurityHeadersConfig{FrameOptions: "ALLOW-FROM https://example.com"})
+	if err == nil || !strings.Contains(err.Error(), "frame_options must be DENY, SAMEORIGIN or off") {
+		t.Errorf("newSecurityHeaders: %v, want a frame_options error", err)
+	}
+}
+
+func TestRouteSecurityHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "Express")
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"security_headers": {},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"},
+			{"name": "embed", "prefix": "/embed/", "upstream": "`+upstream.URL+`", "security_headers": {"frame_options": "off"}}]}`)
+
+	tests := []struct {
+		path  string
+		frame string
+	}{
+		{path: "/api/x", frame: "DENY"},
+		{path: "/embed/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got := w.Header().Get("X-Frame-Options"); got != tt.frame {
+				t.Errorf("X-Frame-Options %q, want %q", got, tt.frame)
+			}
+			if got := w.Header().Get("X-Powered-By"); got != "" {
+				t.Errorf("X-Powered-By %q reached the client", got)
+			}
+		})
+	}
+}
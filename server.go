@@ -0,0 +1,233 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take to drain on shutdown
+const shutdownTimeout = 15 * time.Second
+
+// adminListenerName names the admin API listener, so no configured listener may use it
+const adminListenerName = "admin"
+
+// listenerServer pairs a configured listener with the server that serves it
+type listenerServer struct {
+	cfg    ListenerConfig
+	server *http.Server
+	ln     net.Listener
+	h3     *http3Listener // also serving over QUIC, or nil
+}
+
+// close releases the sockets of a listener that never started serving
+func (s *listenerServer) close() {
+	s.ln.Close()
+	if s.h3 != nil {
+		s.h3.pc.Close()
+	}
+}
+
+// openListeners binds every configured listener, closing already opened ones on failure
+func openListeners(cfg *Config, handler *ProxyHandler) ([]*listenerServer, error) {
+	var servers []*listenerServer
+	for _, lc := range cfg.Listeners {
+		ln, err := listen(lc)
+		if err != nil {
+			for _, s := range servers {
+				s.close()
+			}
+			return nil, fmt.Errorf("listener %q: %w", lc.Name, err)
+		}
+
+		server := &http.Server{
+			Handler:  buildChain(handler, cfg.Profiles[lc.Profile], handler),
+			ErrorLog: handler.logger,
+		}
+		if lc.TLS != nil {
+			cert, err := loadKeyPair(lc.TLS.CertFile, lc.TLS.KeyFile)
+			if err != nil {
+				ln.Close()
+				for _, s := range servers {
+					s.close()
+				}
+				return nil, fmt.Errorf("listener %q: %w", lc.Name, err)
+			}
+			handler.listenerCerts = append(handler.listenerCerts, cert)
+			// Virtual hosts present their own certificates; the listener's is the fallback
+			server.TLSConfig = handler.vhosts.tlsConfig(cert)
+			if err := clientAuth(server.TLSConfig, lc.TLS); err != nil {
+				ln.Close()
+				for _, s := range servers {
+					s.close()
+				}
+				return nil, fmt.Errorf("listener %q: %w", lc.Name, err)
+			}
+		}
+		if lc.H2C {
+			// Accept HTTP/2 with prior knowledge so plaintext gRPC clients can connect
+			protocols := new(http.Protocols)
+			protocols.SetHTTP1(true)
+			protocols.SetHTTP2(true)
+			protocols.SetUnencryptedHTTP2(true)
+			server.Protocols = protocols
+		}
+
+		ls := &listenerServer{cfg: lc, ln: ln, server: server}
+		if lc.HTTP3 {
+			if ls.h3, err = newHTTP3Listener(lc, server); err != nil {
+				ln.Close()
+				for _, s := range servers {
+					s.close()
+				}
+				return nil, fmt.Errorf("listener %q: http3: %w", lc.Name, err)
+			}
+		}
+		servers = append(servers, ls)
+	}
+
+	// The admin API gets its own listener so it is never exposed on the proxy ports
+	if cfg.Admin != nil {
+		lc := ListenerConfig{Name: adminListenerName, Network: "tcp", Address: cfg.Admin.Address}
+		ln, err := listen(lc)
+		if err != nil {
+			for _, s := range servers {
+				s.close()
+			}
+			return nil, fmt.Errorf("admin listener: %w", err)
+		}
+		servers = append(servers, &listenerServer{
+			cfg:    lc,
+			ln:     ln,
+			server: &http.Server{Handler: newAdminAPI(handler, cfg.Admin), ErrorLog: handler.logger},
+		})
+	}
+	return servers, nil
+}
+
+// exampleURL returns the base URL of the first TCP proxy listener for the startup log,
+// or "" when the proxy only listens on unix sockets
+func exampleURL(servers []*listenerServer) string {
+	for _, s := range servers {
+		addr, ok := s.ln.Addr().(*net.TCPAddr)
+		if !ok || s.cfg.Name == adminListenerName {
+			continue
+		}
+		host := "localhost"
+		if !addr.IP.IsUnspecified() {
+			host = addr.IP.String()
+		}
+		scheme := "http"
+		if s.cfg.TLS != nil {
+			scheme = "https"
+		}
+		return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(addr.Port))
+	}
+	return ""
+}
+
+// listen opens the socket described by lc
+func listen(lc ListenerConfig) (net.Listener, error) {
+	// A socket handed over by the process being upgraded is already bound
+	if ln := takeInherited(lc); ln != nil {
+		// Adopted unix sockets are not unlinked by default; this process owns the path now
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		return ln, nil
+	}
+	// Likewise a socket systemd bound for us through socket activation
+	if ln := takeSystemd(lc); ln != nil {
+		return ln, nil
+	}
+	if lc.Network == "unix" {
+		// Remove a stale socket left behind by a previous run
+		if err := os.Remove(lc.Address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return net.Listen(lc.Network, lc.Address)
+}
+
+// listenPacket opens the datagram socket described by lc, preferring one handed over by
+// the process being upgraded or bound by systemd, like listen
+func listenPacket(lc ListenerConfig) (net.PacketConn, error) {
+	if pc := takeInheritedPacket(lc); pc != nil {
+		return pc, nil
+	}
+	if pc := takeSystemdPacket(lc); pc != nil {
+		return pc, nil
+	}
+	return net.ListenPacket(lc.Network, lc.Address)
+}
+
+// serveAll serves every listener until ctx is cancelled or one of them fails,
+// then shuts all of them down together
+func serveAll(ctx context.Context, handler *ProxyHandler, servers []*listenerServer) error {
+	errCh := make(chan error, 2*len(servers))
+	for _, s := range servers {
+		if s.h3 != nil {
+			go func(s *listenerServer) {
+				handler.logger.Printf("Listener %q serving HTTP/3 on udp://%s", s.cfg.Name, s.cfg.Address)
+				if err := s.h3.server.Serve(s.h3.pc); !errors.Is(err, http.ErrServerClosed) {
+					errCh <- fmt.Errorf("listener %q: http3: %w", s.cfg.Name, err)
+				}
+			}(s)
+		}
+		go func(s *listenerServer) {
+			handler.logger.Printf("Listener %q serving on %s://%s", s.cfg.Name, s.cfg.Network, s.cfg.Address)
+
+			var err error
+			if s.cfg.TLS != nil {
+				// The certificates come from the server's TLSConfig
+				err = s.server.ServeTLS(s.ln, "", "")
+			} else {
+				err = s.server.Serve(s.ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("listener %q: %w", s.cfg.Name, err)
+			}
+		}(s)
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		handler.logger.Printf("Shutting down %d listener(s)", len(servers))
+	case serveErr = <-errCh:
+		handler.logger.Printf("Listener failed, shutting down: %v", serveErr)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *listenerServer) {
+			defer wg.Done()
+			if err := s.server.Shutdown(shutdownCtx); err != nil {
+				handler.logger.Printf("Listener %q shutdown: %v", s.cfg.Name, err)
+			}
+		}(s)
+		if s.h3 != nil {
+			wg.Add(1)
+			go func(s *listenerServer) {
+				defer wg.Done()
+				if err := s.h3.server.Shutdown(shutdownCtx); err != nil {
+					handler.logger.Printf("Listener %q HTTP/3 shutdown: %v", s.cfg.Name, err)
+				}
+				s.h3.pc.Close()
+			}(s)
+		}
+	}
+	wg.Wait()
+
+	return serveErr
+}
@@ -0,0 +1,212 @@
+package proxygo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSignedURLTTL is the lifetime of links signed without an explicit ttl
+const defaultSignedURLTTL = time.Hour
+
+// SignedURLsConfig admits requests whose URL carries a valid HMAC signature, so
+// time-limited links can be handed out without client credentials
+type SignedURLsConfig struct {
+	Secret     string   `json:"secret,omitempty"` // HMAC-SHA256 key; anyone holding it can mint links
+	DefaultTTL Duration `json:"default_ttl"`      // lifetime of links signed without a ttl; default 1h
+}
+
+// urlSigner signs and verifies proxy links of the form /https://host/path?...&exp=<unix>&sig=<mac>.
+// A link is only valid on the proxy host it was signed for.
+type urlSigner struct {
+	secret     []byte
+	defaultTTL time.Duration
+}
+
+// newURLSigner returns nil when signed URLs are disabled
+func newURLSigner(cfg *SignedURLsConfig) (*urlSigner, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("signed_urls: secret is required")
+	}
+	s := &urlSigner{secret: []byte(cfg.Secret), defaultTTL: time.Duration(cfg.DefaultTTL)}
+	if s.defaultTTL <= 0 {
+		s.defaultTTL = defaultSignedURLTTL
+	}
+	return s, nil
+}
+
+// mac computes the signature over the proxy host, the path, the other query parameters
+// in order, and the expiry
+func (s *urlSigner) mac(host, path, rawQuery, exp string) string {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(canonicalSignedHost(host) + "\n" + path + "?" + rawQuery + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// canonicalSignedHost lowercases host and drops a default port, so a link keeps working
+// whether or not the client spells those out
+func canonicalSignedHost(host string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil && (port == "80" || port == "443") {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+	return host
+}
+
+// sign returns link with exp and sig appended; host is the proxy host the link will be
+// opened on, link is a proxy path such as "/https://cdn.example.com/file.zip?v=2", and
+// ttl 0 selects the default lifetime
+func (s *urlSigner) sign(host, link string, ttl time.Duration) (string, time.Time, error) {
+	if host == "" {
+		return "", time.Time{}, errors.New("the proxy host the link is for is required")
+	}
+	if !strings.HasPrefix(link, "/") {
+		link = "/" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	base, _, _ := splitSignature(u.RawQuery)
+	if base != u.RawQuery {
+		return "", time.Time{}, errors.New("link already carries exp or sig parameters")
+	}
+	if ttl <= 0 {
+		ttl = s.defaultTTL
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	query := "exp=" + exp + "&sig=" + s.mac(host, u.Path, u.RawQuery, exp)
+	if u.RawQuery != "" {
+		query = u.RawQuery + "&" + query
+	}
+	return u.EscapedPath() + "?" + query, expires, nil
+}
+
+// verify checks the signature on r. It returns false without error when the request
+// is not signed, and strips exp and sig from the query when it is.
+func (s *urlSigner) verify(r *http.Request) (bool, error) {
+	base, exp, sig := splitSignature(r.URL.RawQuery)
+	if sig == "" {
+		return false, nil
+	}
+	// A link grants read access only
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true, errors.New("signed links only allow GET and HEAD")
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.mac(r.Host, r.URL.Path, base, exp))) {
+		return true, errors.New("invalid link signature")
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return true, errors.New("link expired")
+	}
+
+	// The upstream sees the query the link was signed for
+	r.URL.RawQuery = base
+	return true, nil
+}
+
+// splitSignature separates the exp and sig parameters from the rest of a raw query,
+// keeping the other parameters exactly as written
+func splitSignature(rawQuery string) (base, exp, sig string) {
+	var kept []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "exp":
+			exp = value
+		case "sig":
+			sig = value
+		default:
+			if part != "" {
+				kept = append(kept, part)
+			}
+		}
+	}
+	return strings.Join(kept, "&"), exp, sig
+}
+
+// signURL handles POST /signed-urls
+func (a *adminAPI) signURL(w http.ResponseWriter, r *http.Request) {
+	if a.proxy.signer == nil {
+		writeJSONError(w, http.StatusNotFound, "signed_urls_disabled", "signed_urls is not configured")
+		return
+	}
+
+	var body struct {
+		Host string   `json:"host"` // proxy host the link is for
+		URL  string   `json:"url"`
+		TTL  Duration `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	link, expires, err := a.proxy.signer.sign(body.Host, body.URL, time.Duration(body.TTL))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_url", err.Error())
+		return
+	}
+
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: "url_signed", Details: map[string]string{"host": body.Host, "url": body.URL, "expires_at": expires.UTC().Format(time.RFC3339)}})
+	writeJSON(w, http.StatusOK, map[string]any{"url": link, "expires_at": expires.UTC()})
+}
+
+// runSign implements `proxygo sign`, printing a signed link for each argument
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the proxy config file")
+	host := fs.String("host", "", "proxy host the links are for, e.g. proxy.example.com")
+	ttl := fs.Duration("ttl", 0, "link lifetime, default signed_urls.default_ttl")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || *host == "" {
+		fmt.Fprintln(os.Stderr, "usage: proxygo sign [-config file] -host proxy.example.com [-ttl 1h] /https://host/path ...")
+		return 2
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	signer, err := newURLSigner(cfg.SignedURLs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if signer == nil {
+		fmt.Fprintln(os.Stderr, "signed_urls is not configured")
+		return 1
+	}
+
+	for _, link := range fs.Args() {
+		signed, _, err := signer.sign(*host, link, *ttl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", link, err)
+			return 1
+		}
+		fmt.Println(signed)
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package proxygo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURLs(t *testing.T) {
+	s, err := newURLSigner(&SignedURLsConfig{Secret: "test-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, expires, err := s.sign("proxy.example.com", "/https://cdn.example.com/file.zip?v=2&lang=en", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(expires); until <= 0 || until > time.Minute {
+		t.Errorf("expires in %s, want within a minute", until)
+	}
+	// An expiry in the past, signed properly
+	exp := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	expired := "/https://cdn.example.com/file.zip?exp=" + exp + "&sig=" + s.mac("proxy.example.com", "/https://cdn.example.com/file.zip", "", exp)
+
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		link   string
+		signed bool
+		err    string
+	}{
+		{name: "valid", link: link, signed: true},
+		{name: "head", method: http.MethodHead, link: link, signed: true},
+		{name: "host case and default port", host: "Proxy.Example.com:443", link: link, signed: true},
+		{name: "unsigned", link: "/https://cdn.example.com/file.zip"},
+		{name: "expired", link: expired, signed: true, err: "link expired"},
+		{name: "tampered query", link: strings.Replace(link, "v=2", "v=3", 1), signed: true, err: "invalid link signature"},
+		{name: "dropped parameter", link: strings.Replace(link, "&lang=en", "", 1), signed: true, err: "invalid link signature"},
+		{name: "tampered path", link: strings.Replace(link, "file.zip", "other.zip", 1), signed: true, err: "invalid link signature"},
+		{name: "tampered expiry", link: strings.Replace(link, "exp=", "exp=9", 1), signed: true, err: "invalid link signature"},
+		{name: "post", method: http.MethodPost, link: link, signed: true, err: "only allow GET and HEAD"},
+		{name: "other host", host: "other-proxy.example.com", link: link, signed: true, err: "invalid link signature"},
+		{name: "other port", host: "proxy.example.com:8443", link: link, signed: true, err: "invalid link signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, host := tt.method, tt.host
+			if method == "" {
+				method = http.MethodGet
+			}
+			if host == "" {
+				host = "proxy.example.com"
+			}
+			r := httptest.NewRequest(method, tt.link, nil)
+			r.Host = host
+			signed, err := s.verify(r)
+			if signed != tt.signed || (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("verify = %v, %v; want %v, %q", signed, err, tt.signed, tt.err)
+			}
+			// The upstream gets the query the link was signed for
+			if signed && err == nil && r.URL.RawQuery != "v=2&lang=en" {
+				t.Errorf("query after verify = %q", r.URL.RawQuery)
+			}
+		})
+	}
+
+	if _, _, err := s.sign("proxy.example.com", link, 0); err == nil {
+		t.Error("signing a signed link succeeded")
+	}
+	if _, _, err := s.sign("", "/https://cdn.example.com/", 0); err == nil {
+		t.Error("signing without a host succeeded")
+	}
+}
@@ -0,0 +1,368 @@
+package proxygo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SLO defaults
+const (
+	defaultSLOWindow      = 30 * 24 * time.Hour
+	defaultSLOMinRequests = 20
+	maxSLOBucket          = time.Minute
+	sloBucketsPerWindow   = 5 // the shortest window is split into at least this many buckets
+)
+
+// defaultSLOAlerts are the usual multi-window burn rate alerts: a fast burn that spends
+// 2% of a 30 day budget in an hour, and a slower one that spends 5% in six hours
+var defaultSLOAlerts = []SLOAlertConfig{
+	{BurnRate: 14.4, LongWindow: Duration(time.Hour), ShortWindow: Duration(5 * time.Minute)},
+	{BurnRate: 6, LongWindow: Duration(6 * time.Hour), ShortWindow: Duration(30 * time.Minute)},
+}
+
+// SLOConfig is a service level objective for some routes: the share of requests that
+// must succeed, and optionally within a latency. The proxy keeps rolling counts in
+// memory, so they start over on restart. Not reloadable.
+type SLOConfig struct {
+	Name        string           `json:"name"`
+	Routes      []string         `json:"routes"`       // route names it covers; empty for every request with an upstream
+	Objective   float64          `json:"objective"`    // share of good requests, e.g. 0.999
+	Latency     Duration         `json:"latency"`      // slower responses count as bad; 0 judges by status alone
+	Window      Duration         `json:"window"`       // period the error budget covers; default 720h
+	Alerts      []SLOAlertConfig `json:"alerts"`       // default 14.4x over 1h and 5m, and 6x over 6h and 30m
+	MinRequests int              `json:"min_requests"` // short windows with fewer requests do not alert; default 20
+}
+
+// SLOAlertConfig notifies when the error budget burns at least BurnRate times faster
+// than the SLO allows over both windows. The long window keeps blips from alerting and
+// the short one lets the alert stop soon after a recovery.
+type SLOAlertConfig struct {
+	BurnRate    float64  `json:"burn_rate"`
+	LongWindow  Duration `json:"long_window"`
+	ShortWindow Duration `json:"short_window"` // default a twelfth of long_window
+}
+
+// sloTracker keeps the rolling counts of every SLO
+type sloTracker struct {
+	slos     []*slo
+	interval time.Duration // how often alerts are evaluated: the smallest bucket
+	requests *metricVec
+}
+
+// slo is one compiled SLOConfig with its counts
+type slo struct {
+	name        string
+	routes      []string
+	objective   float64
+	latency     time.Duration
+	window      time.Duration
+	alerts      []*sloAlert
+	minRequests int64
+	bucket      time.Duration
+
+	mu      sync.Mutex
+	buckets []sloBucket // ring covering the longest window
+}
+
+// sloAlert is one compiled SLOAlertConfig
+type sloAlert struct {
+	burnRate  float64
+	long      time.Duration
+	short     time.Duration
+	condition string // e.g. "14.4x over 1h and 5m", naming the alert in metrics
+	firing    atomic.Bool
+}
+
+// sloBucket counts the requests of one bucket period
+type sloBucket struct {
+	period    int64 // start of the period in buckets since the epoch
+	good, bad int64
+}
+
+// newSLOTracker returns nil when no SLO is configured; routes are the names SLOs may cover
+func newSLOTracker(configs []SLOConfig, routes []*Route, metrics *metricsRegistry) (*sloTracker, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	t := &sloTracker{requests: metrics.counter("proxygo_slo_requests_total", "Requests counted by SLOs, by result.", "slo", "result")}
+	names := make(map[string]bool)
+	for i, sc := range configs {
+		name := sc.Name
+		if name == "" {
+			name = fmt.Sprintf("slo-%d", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("slos: duplicate name %q", name)
+		}
+		names[name] = true
+		s, err := compileSLO(name, sc, routes)
+		if err != nil {
+			return nil, fmt.Errorf("slo %s: %w", name, err)
+		}
+		t.slos = append(t.slos, s)
+		if t.interval == 0 || s.bucket < t.interval {
+			t.interval = s.bucket
+		}
+	}
+	t.registerMetrics(metrics)
+	return t, nil
+}
+
+// compileSLO validates one SLO and sizes its buckets to its shortest window
+func compileSLO(name string, sc SLOConfig, routes []*Route) (*slo, error) {
+	if sc.Objective <= 0 || sc.Objective >= 1 {
+		return nil, fmt.Errorf("objective must be between 0 and 1, e.g. 0.999")
+	}
+	for _, route := range sc.Routes {
+		if !slices.ContainsFunc(routes, func(r *Route) bool { return r.Name == route }) {
+			return nil, fmt.Errorf("unknown route %q", route)
+		}
+	}
+	s := &slo{
+		name:        name,
+		routes:      sc.Routes,
+		objective:   sc.Objective,
+		latency:     time.Duration(sc.Latency),
+		window:      time.Duration(sc.Window),
+		minRequests: int64(sc.MinRequests),
+	}
+	if s.latency < 0 {
+		return nil, fmt.Errorf("latency must not be negative")
+	}
+	if s.window <= 0 {
+		s.window = defaultSLOWindow
+	}
+	if s.minRequests <= 0 {
+		s.minRequests = defaultSLOMinRequests
+	}
+
+	alerts := sc.Alerts
+	if alerts == nil {
+		alerts = defaultSLOAlerts
+	}
+	shortest, longest := s.window, s.window
+	for i, ac := range alerts {
+		a := &sloAlert{burnRate: ac.BurnRate, long: time.Duration(ac.LongWindow), short: time.Duration(ac.ShortWindow)}
+		if a.burnRate <= 0 || a.long <= 0 {
+			return nil, fmt.Errorf("alert #%d: burn_rate and long_window are required", i)
+		}
+		if a.short <= 0 {
+			a.short = a.long / 12
+		}
+		if a.short > a.long {
+			return nil, fmt.Errorf("alert #%d: short_window must not exceed long_window", i)
+		}
+		a.condition = fmt.Sprintf("%sx over %s and %s", strconv.FormatFloat(a.burnRate, 'f', -1, 64), sloWindowLabel(a.long), sloWindowLabel(a.short))
+		s.alerts = append(s.alerts, a)
+		shortest, longest = min(shortest, a.short), max(longest, a.long)
+	}
+
+	s.bucket = min(max(shortest/sloBucketsPerWindow, time.Second), maxSLOBucket)
+	s.buckets = make([]sloBucket, longest/s.bucket+1)
+	return s, nil
+}
+
+// sloWindowLabel formats a window compactly for labels and messages, e.g. "1h" or "30m"
+func sloWindowLabel(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+// covers reports whether the SLO counts requests to route
+func (s *slo) covers(route string) bool {
+	return len(s.routes) == 0 || slices.Contains(s.routes, route)
+}
+
+// observe counts a finished request towards every SLO covering its route. Requests the
+// client abandoned say nothing about the service and are left out.
+func (t *sloTracker) observe(target *proxyTarget, status int, elapsed time.Duration) {
+	if status == statusClientClosedRequest {
+		return
+	}
+	route := routeName(target)
+	now := time.Now()
+	for _, s := range t.slos {
+		if !s.covers(route) {
+			continue
+		}
+		good := status < http.StatusInternalServerError && (s.latency == 0 || elapsed <= s.latency)
+		s.record(now, good)
+		if good {
+			t.requests.inc(s.name, "good")
+		} else {
+			t.requests.inc(s.name, "bad")
+		}
+	}
+}
+
+// record adds one request to the current bucket
+func (s *slo) record(now time.Time, good bool) {
+	period := now.UnixNano() / int64(s.bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[period%int64(len(s.buckets))]
+	if b.period != period {
+		*b = sloBucket{period: period}
+	}
+	if good {
+		b.good++
+	} else {
+		b.bad++
+	}
+}
+
+// counts sums the requests of the window ending now
+func (s *slo) counts(now time.Time, window time.Duration) (good, bad int64) {
+	last := now.UnixNano() / int64(s.bucket)
+	first := last - int64(window/s.bucket) + 1
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for period := max(first, last-int64(len(s.buckets))+1); period <= last; period++ {
+		if b := s.buckets[period%int64(len(s.buckets))]; b.period == period {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	return good, bad
+}
+
+// burnRate is how many times faster than allowed the window spent the error budget;
+// ok is false when the window saw no requests
+func (s *slo) burnRate(now time.Time, window time.Duration) (rate float64, total int64, ok bool) {
+	good, bad := s.counts(now, window)
+	total = good + bad
+	if total == 0 {
+		return 0, 0, false
+	}
+	return float64(bad) / float64(total) / (1 - s.objective), total, true
+}
+
+// windows lists the distinct windows the SLO reports on, shortest first
+func (s *slo) windows() []time.Duration {
+	windows := []time.Duration{s.window}
+	for _, a := range s.alerts {
+		windows = append(windows, a.long, a.short)
+	}
+	slices.Sort(windows)
+	return slices.Compact(windows)
+}
+
+// registerMetrics exposes ratios, burn rates and budgets computed at scrape time
+func (t *sloTracker) registerMetrics(metrics *metricsRegistry) {
+	metrics.gaugeFunc("proxygo_slo_success_ratio", "Share of good requests per SLO and rolling window; absent for windows without requests.",
+		[]string{"slo", "window"}, func() []sample {
+			var out []sample
+			now := time.Now()
+			for _, s := range t.slos {
+				for _, w := range s.windows() {
+					if good, bad := s.counts(now, w); good+bad > 0 {
+						out = append(out, sample{labels: []string{s.name, sloWindowLabel(w)}, value: float64(good) / float64(good+bad)})
+					}
+				}
+			}
+			return out
+		})
+	metrics.gaugeFunc("proxygo_slo_burn_rate", "How many times faster than the SLO allows the error budget is spent, per rolling window.",
+		[]string{"slo", "window"}, func() []sample {
+			var out []sample
+			now := time.Now()
+			for _, s := range t.slos {
+				for _, w := range s.windows() {
+					if rate, _, ok := s.burnRate(now, w); ok {
+						out = append(out, sample{labels: []string{s.name, sloWindowLabel(w)}, value: rate})
+					}
+				}
+			}
+			return out
+		})
+	metrics.gaugeFunc("proxygo_slo_error_budget_remaining", "Share of the error budget left over the SLO window; negative once overspent.",
+		[]string{"slo"}, func() []sample {
+			var out []sample
+			now := time.Now()
+			for _, s := range t.slos {
+				rate, _, _ := s.burnRate(now, s.window)
+				out = append(out, sample{labels: []string{s.name}, value: 1 - rate})
+			}
+			return out
+		})
+	metrics.gaugeFunc("proxygo_slo_alert_firing", "Whether an SLO burn rate alert currently holds, by SLO and alert condition.",
+		[]string{"slo", "alert"}, func() []sample {
+			var out []sample
+			for _, s := range t.slos {
+				for _, a := range s.alerts {
+					value := 0.0
+					if a.firing.Load() {
+						value = 1
+					}
+					out = append(out, sample{labels: []string{s.name, a.condition}, value: value})
+				}
+			}
+			return out
+		})
+}
+
+// run evaluates the burn rate alerts until ctx is done, notifying through n when one
+// starts to hold and, spaced by the cooldown, while it keeps holding
+func (t *sloTracker) run(ctx context.Context, n *notifier) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, s := range t.slos {
+				s.evaluate(now, n)
+			}
+		}
+	}
+}
+
+// evaluate checks every alert of the SLO
+func (s *slo) evaluate(now time.Time, n *notifier) {
+	for _, a := range s.alerts {
+		long, _, longOK := s.burnRate(now, a.long)
+		short, requests, shortOK := s.burnRate(now, a.short)
+		holds := longOK && shortOK && requests >= s.minRequests && long >= a.burnRate && short >= a.burnRate
+
+		a.firing.Store(holds)
+		if !holds || n == nil {
+			continue
+		}
+		good, bad := s.counts(now, s.window)
+		budget := 1.0
+		if good+bad > 0 {
+			budget = 1 - float64(bad)/float64(good+bad)/(1-s.objective)
+		}
+		left := fmt.Sprintf("%.1f%% of the %s budget is left", budget*100, sloWindowLabel(s.window))
+		if budget <= 0 {
+			left = fmt.Sprintf("the %s budget is spent", sloWindowLabel(s.window))
+		}
+		n.notify(notification{
+			Event:   eventSLOBurnRate,
+			Subject: s.name + " " + a.condition,
+			Message: fmt.Sprintf("SLO %s is burning its error budget %.1fx over %s and %.1fx over %s, alerting at %sx; %s",
+				s.name, long, sloWindowLabel(a.long), short, sloWindowLabel(a.short), strconv.FormatFloat(a.burnRate, 'f', -1, 64), left),
+			Details: map[string]string{
+				"slo":              s.name,
+				"objective":        strconv.FormatFloat(s.objective, 'f', -1, 64),
+				"burn_rate_long":   strconv.FormatFloat(long, 'f', 2, 64),
+				"burn_rate_short":  strconv.FormatFloat(short, 'f', 2, 64),
+				"long_window":      sloWindowLabel(a.long),
+				"short_window":     sloWindowLabel(a.short),
+				"budget_remaining": strconv.FormatFloat(budget, 'f', 4, 64),
+			},
+		}, n.cooldown)
+	}
+}
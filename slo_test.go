@@ -0,0 +1,232 @@
+package proxygo
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOConfig(t *testing.T) {
+	routes := []*Route{{Name: "api"}}
+	tests := []struct {
+		name       string
+		sc         SLOConfig
+		conditions []string
+		bucket     time.Duration
+		err        string
+	}{
+		{name: "defaults", sc: SLOConfig{Objective: 0.999}, conditions: []string{"14.4x over 1h and 5m", "6x over 6h and 30m"}, bucket: time.Minute},
+		{name: "default short window", sc: SLOConfig{Objective: 0.99, Alerts: []SLOAlertConfig{{BurnRate: 2, LongWindow: Duration(time.Hour)}}}, conditions: []string{"2x over 1h and 5m"}, bucket: time.Minute},
+		{name: "short windows", sc: SLOConfig{Objective: 0.99, Alerts: []SLOAlertConfig{{BurnRate: 10, LongWindow: Duration(2 * time.Minute), ShortWindow: Duration(10 * time.Second)}}}, conditions: []string{"10x over 2m and 10s"}, bucket: 2 * time.Second},
+		{name: "smallest bucket", sc: SLOConfig{Objective: 0.99, Alerts: []SLOAlertConfig{{BurnRate: 10, LongWindow: Duration(time.Minute), ShortWindow: Duration(2 * time.Second)}}}, conditions: []string{"10x over 1m and 2s"}, bucket: time.Second},
+		{name: "route", sc: SLOConfig{Objective: 0.99, Routes: []string{"api"}}, conditions: []string{"14.4x over 1h and 5m", "6x over 6h and 30m"}, bucket: time.Minute},
+		{name: "objective of 1", sc: SLOConfig{Objective: 1}, err: "objective must be between 0 and 1, e.g. 0.999"},
+		{name: "percentage", sc: SLOConfig{Objective: 99.9}, err: "objective must be between 0 and 1, e.g. 0.999"},
+		{name: "unknown route", sc: SLOConfig{Objective: 0.99, Routes: []string{"apl"}}, err: `unknown route "apl"`},
+		{name: "negative latency", sc: SLOConfig{Objective: 0.99, Latency: Duration(-time.Second)}, err: "latency must not be negative"},
+		{name: "no burn rate", sc: SLOConfig{Objective: 0.99, Alerts: []SLOAlertConfig{{LongWindow: Duration(time.Hour)}}}, err: "alert #0: burn_rate and long_window are required"},
+		{name: "short window too long", sc: SLOConfig{Objective: 0.99, Alerts: []SLOAlertConfig{{BurnRate: 2, LongWindow: Duration(time.Hour), ShortWindow: Duration(2 * time.Hour)}}}, err: "alert #0: short_window must not exceed long_window"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := compileSLO("api", tt.sc, routes)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("compileSLO: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var conditions []string
+			for _, a := range s.alerts {
+				conditions = append(conditions, a.condition)
+			}
+			if !slices.Equal(conditions, tt.conditions) {
+				t.Errorf("alerts %q, want %q", conditions, tt.conditions)
+			}
+			if s.bucket != tt.bucket {
+				t.Errorf("bucket %s, want %s", s.bucket, tt.bucket)
+			}
+			if s.window != defaultSLOWindow || s.minRequests != defaultSLOMinRequests {
+				t.Errorf("window %s and min requests %d, want the defaults", s.window, s.minRequests)
+			}
+		})
+	}
+
+	if _, err := newSLOTracker([]SLOConfig{{Objective: 0.9}, {Name: "slo-0", Objective: 0.9}}, routes, newMetricsRegistry()); err == nil || err.Error() != `slos: duplicate name "slo-0"` {
+		t.Errorf("newSLOTracker: %v, want the duplicate default name", err)
+	}
+	tracker, err := newSLOTracker([]SLOConfig{
+		{Name: "slow", Objective: 0.9},
+		{Name: "fast", Objective: 0.9, Alerts: []SLOAlertConfig{{BurnRate: 10, LongWindow: Duration(time.Minute), ShortWindow: Duration(10 * time.Second)}}},
+	}, routes, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker.interval != 2*time.Second {
+		t.Errorf("alerts evaluated every %s, want the smallest bucket", tracker.interval)
+	}
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	s, err := compileSLO("api", SLOConfig{Objective: 0.9, Window: Duration(time.Hour), Alerts: []SLOAlertConfig{{BurnRate: 5, LongWindow: Duration(time.Hour), ShortWindow: Duration(5 * time.Minute)}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	for range 10 {
+		s.record(now.Add(-45*time.Minute), false)
+	}
+	for i := range 10 {
+		s.record(now, i > 0)
+	}
+
+	tests := []struct {
+		name   string
+		at     time.Duration // after now
+		window time.Duration
+		good   int64
+		bad    int64
+		rate   float64
+	}{
+		{name: "short window", window: 5 * time.Minute, good: 9, bad: 1, rate: 1},
+		{name: "long window", window: time.Hour, good: 9, bad: 11, rate: 5.5},
+		{name: "short window later", at: 5 * time.Minute, window: 5 * time.Minute},
+		{name: "long window later", at: 20 * time.Minute, window: time.Hour, good: 9, bad: 1, rate: 1},
+		{name: "long window past everything", at: 2 * time.Hour, window: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := now.Add(tt.at)
+			if good, bad := s.counts(at, tt.window); good != tt.good || bad != tt.bad {
+				t.Errorf("counts %d good %d bad, want %d and %d", good, bad, tt.good, tt.bad)
+			}
+			rate, total, ok := s.burnRate(at, tt.window)
+			if ok != (tt.good+tt.bad > 0) || total != tt.good+tt.bad || math.Abs(rate-tt.rate) > 1e-9 {
+				t.Errorf("burn rate %v of %d requests (%v), want %v", rate, total, ok, tt.rate)
+			}
+		})
+	}
+	if got := s.windows(); !slices.Equal(got, []time.Duration{5 * time.Minute, time.Hour}) {
+		t.Errorf("windows %v", got)
+	}
+}
+
+func TestSLOAlert(t *testing.T) {
+	s, err := compileSLO("api", SLOConfig{Objective: 0.9, Window: Duration(time.Hour), MinRequests: 10, Alerts: []SLOAlertConfig{{BurnRate: 5, LongWindow: Duration(time.Hour), ShortWindow: Duration(5 * time.Minute)}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newTestNotifier(t, &NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://hooks.internal"}}})
+	queue := n.webhooks[0].queue
+	start := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		name      string
+		at        time.Duration
+		good, bad int
+		firing    bool
+		notified  bool
+	}{
+		{name: "too few requests", bad: 5},
+		{name: "burning", at: time.Minute, bad: 5, firing: true, notified: true},
+		{name: "still burning within the cooldown", at: 2 * time.Minute, good: 10, firing: true},
+		{name: "recovered", at: 8 * time.Minute, good: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start.Add(tt.at)
+			for range tt.good {
+				s.record(now, true)
+			}
+			for range tt.bad {
+				s.record(now, false)
+			}
+			s.evaluate(now, n)
+			if got := s.alerts[0].firing.Load(); got != tt.firing {
+				t.Errorf("firing %v, want %v", got, tt.firing)
+			}
+			if got := len(queue) == 1; got != tt.notified {
+				t.Fatalf("notified %v, want %v", got, tt.notified)
+			}
+			if !tt.notified {
+				return
+			}
+			ev := <-queue
+			if ev.Event != eventSLOBurnRate || ev.Subject != "api 5x over 1h and 5m" ||
+				ev.Message != "SLO api is burning its error budget 10.0x over 1h and 10.0x over 5m, alerting at 5x; the 1h budget is spent" {
+				t.Errorf("notification %+v", ev)
+			}
+			if ev.Details["burn_rate_short"] != "10.00" || ev.Details["short_window"] != "5m" || ev.Details["objective"] != "0.9" {
+				t.Errorf("details %v", ev.Details)
+			}
+		})
+	}
+}
+
+func TestSLOObserve(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(60 * time.Millisecond)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	h := newTestHandler(t, `{"slos": [
+			{"name": "api", "routes": ["api"], "objective": 0.99, "latency": "50ms"},
+			{"name": "all", "objective": 0.99}
+		],
+		"routes": [
+			{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"},
+			{"name": "other", "prefix": "/other/", "upstream": "`+upstream.URL+`"}
+		]}`)
+
+	tests := []struct {
+		path   string
+		api    string // result counted by the api SLO; empty when it is not covered
+		all    string
+		status int
+	}{
+		{path: "/api/ok", api: "good", all: "good", status: http.StatusOK},
+		{path: "/api/missing", api: "good", all: "good", status: http.StatusNotFound},
+		{path: "/api/fail", api: "bad", all: "bad", status: http.StatusServiceUnavailable},
+		{path: "/api/slow", api: "bad", all: "good", status: http.StatusOK},
+		{path: "/other/fail", all: "bad", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(strings.TrimPrefix(tt.path, "/"), func(t *testing.T) {
+			before := map[string]float64{}
+			for _, key := range []string{"api/good", "api/bad", "all/good", "all/bad"} {
+				name, result, _ := strings.Cut(key, "/")
+				before[key] = h.slos.requests.value(name, result)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			for key, was := range before {
+				name, result, _ := strings.Cut(key, "/")
+				want := was
+				if (name == "api" && tt.api == result) || (name == "all" && tt.all == result) {
+					want++
+				}
+				if got := h.slos.requests.value(name, result); got != want {
+					t.Errorf("%s counted %v %s requests, want %v", name, got-was, result, want-was)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// sniHelloTimeout bounds how long a passthrough client may take to send its ClientHello
+const sniHelloTimeout = 10 * time.Second
+
+// SNIRouteConfig sends TLS connections for some server names to one backend
+type SNIRouteConfig struct {
+	Hosts    []string `json:"hosts"`    // e.g. "app.example.com" or "*.example.com"
+	Upstream string   `json:"upstream"` // host:port of the backend, which terminates TLS itself
+}
+
+// sniTable maps server names to backends, exact names before wildcards
+type sniTable struct {
+	exact     map[string]string
+	wildcards []sniPattern // in config order
+}
+
+// sniPattern is a wildcard server name with its backend
+type sniPattern struct {
+	pattern  string
+	upstream string
+}
+
+// newSNITable compiles the passthrough routes, returning nil when there are none
+func newSNITable(routes []SNIRouteConfig) (*sniTable, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	t := &sniTable{exact: make(map[string]string)}
+	for i, rc := range routes {
+		if len(rc.Hosts) == 0 {
+			return nil, fmt.Errorf("sni route #%d: hosts is required", i)
+		}
+		if _, _, err := net.SplitHostPort(rc.Upstream); err != nil {
+			return nil, fmt.Errorf("sni route #%d: upstream must be host:port: %w", i, err)
+		}
+		for _, host := range normalizeHosts(rc.Hosts) {
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("sni route #%d: invalid host pattern %q", i, host)
+			}
+			if strings.ContainsAny(host, "*?[") {
+				t.wildcards = append(t.wildcards, sniPattern{pattern: host, upstream: rc.Upstream})
+			} else if _, ok := t.exact[host]; !ok {
+				t.exact[host] = rc.Upstream
+			}
+		}
+	}
+	return t, nil
+}
+
+// upstreamFor returns the backend for serverName, or "" when no route matches
+func (t *sniTable) upstreamFor(serverName string) string {
+	name := normalizeHost(serverName)
+	if upstream, ok := t.exact[name]; ok {
+		return upstream
+	}
+	for _, w := range t.wildcards {
+		if ok, _ := path.Match(w.pattern, name); ok {
+			return w.upstream
+		}
+	}
+	return ""
+}
+
+// errHelloRead stops the handshake once the ClientHello has been parsed
+var errHelloRead = errors.New("client hello read")
+
+// peekClientHello reads the client's ClientHello and returns the server name it asks
+// for, "" when it sends none, along with every byte read so it can be replayed to the
+// backend. The handshake itself is left to the backend.
+func peekClientHello(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	conn.SetReadDeadline(time.Now().Add(sniHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, fmt.Errorf("not a TLS client hello: %w", err)
+	}
+	return hello.ServerName, read.Bytes(), nil
+}
+
+// helloConn feeds the TLS library what the client sent and refuses what it would
+// answer, so the handshake goes no further than parsing the ClientHello
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// Read implements net.Conn
+func (c helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write implements net.Conn
+func (c helloConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Close implements net.Conn; the client connection stays open for the backend
+func (c helloConn) Close() error {
+	return nil
+}
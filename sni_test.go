@@ -0,0 +1,170 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSNITable(t *testing.T) {
+	table, err := newSNITable([]SNIRouteConfig{
+		{Hosts: []string{"*.example.com"}, Upstream: "wild:443"},
+		{Hosts: []string{"a.example.com", "B.Example.com"}, Upstream: "ab:443"},
+		{Hosts: []string{"*.b.example.com"}, Upstream: "deep:443"},
+		{Hosts: []string{"a.example.com"}, Upstream: "second:443"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "a.example.com", want: "ab:443"},
+		{serverName: "b.example.com.", want: "ab:443"},
+		{serverName: "c.example.com", want: "wild:443"},
+		// path.Match's * does not stop at dots, so the first wildcard takes it
+		{serverName: "x.b.example.com", want: "wild:443"},
+		{serverName: "example.com"},
+		{serverName: ""},
+	}
+	for _, tt := range tests {
+		if got := table.upstreamFor(tt.serverName); got != tt.want {
+			t.Errorf("upstreamFor(%q) = %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestSNIConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  StreamConfig
+		err  string
+	}{
+		{name: "no hosts", cfg: StreamConfig{Listen: ":443", SNI: []SNIRouteConfig{{Upstream: "app:443"}}}, err: "hosts is required"},
+		{name: "bad upstream", cfg: StreamConfig{Listen: ":443", SNI: []SNIRouteConfig{{Hosts: []string{"a"}, Upstream: "app"}}}, err: "upstream must be host:port"},
+		{name: "bad pattern", cfg: StreamConfig{Listen: ":443", SNI: []SNIRouteConfig{{Hosts: []string{"[a-"}, Upstream: "app:443"}}}, err: "invalid host pattern"},
+		{name: "udp", cfg: StreamConfig{Network: "udp", Listen: ":443", SNI: []SNIRouteConfig{{Hosts: []string{"a"}, Upstream: "app:443"}}}, err: "sni routing needs a tcp stream"},
+		{name: "bad fallback", cfg: StreamConfig{Listen: ":443", Upstream: "app", SNI: []SNIRouteConfig{{Hosts: []string{"a"}, Upstream: "app:443"}}}, err: "upstream must be host:port"},
+		{name: "no fallback", cfg: StreamConfig{Listen: ":443", SNI: []SNIRouteConfig{{Hosts: []string{"a"}, Upstream: "app:443"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validate: %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// newTLSBackend starts a TLS server that greets every client with name, and returns its
+// address and certificate
+func newTLSBackend(t *testing.T, name string) (string, []byte) {
+	t.Helper()
+	certFile, keyFile := writeTestCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name)
+			}()
+		}
+	}()
+	return ln.Addr().String(), cert.Certificate[0]
+}
+
+func TestSNIPassthrough(t *testing.T) {
+	a, aCert := newTLSBackend(t, "a")
+	b, bCert := newTLSBackend(t, "b")
+	fallback, fallbackCert := newTLSBackend(t, "fallback")
+	routes := []SNIRouteConfig{
+		{Hosts: []string{"a.example.com"}, Upstream: a},
+		{Hosts: []string{"b.example.com", "*.b.example.com"}, Upstream: b},
+	}
+
+	tests := []struct {
+		name       string
+		upstream   string // the stream's fallback
+		serverName string
+		want       string // greeting; "" when the connection is closed
+		cert       []byte
+		result     string // counted connection result
+	}{
+		{name: "exact", serverName: "a.example.com", want: "a", cert: aCert, result: "accepted"},
+		{name: "wildcard", serverName: "x.b.example.com", want: "b", cert: bCert, result: "accepted"},
+		{name: "unmatched", serverName: "c.example.com", result: "unmatched"},
+		{name: "no server name", result: "unmatched"},
+		{name: "fallback", upstream: fallback, serverName: "c.example.com", want: "fallback", cert: fallbackCert, result: "accepted"},
+		{name: "fallback without server name", upstream: fallback, want: "fallback", cert: fallbackCert, result: "accepted"},
+		{name: "routes win over the fallback", upstream: fallback, serverName: "a.example.com", want: "a", cert: aCert, result: "accepted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startStream(t, StreamConfig{Upstream: tt.upstream, SNI: routes})
+			raw, err := net.Dial("tcp", s.addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			// The backends' certificates name no host; the test checks which one answered
+			conn := tls.Client(raw, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			err = conn.Handshake()
+			if tt.want == "" {
+				if err == nil {
+					t.Fatal("handshake succeeded without a backend")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(conn.ConnectionState().PeerCertificates[0].Raw, tt.cert) {
+					t.Error("handshake with the wrong backend")
+				}
+				if greeting, _ := io.ReadAll(conn); string(greeting) != tt.want {
+					t.Errorf("greeting %q, want %q", greeting, tt.want)
+				}
+			}
+			waitUntil(t, tt.result+" counted", func() bool { return s.h.streamConns.value("test", tt.result) == 1 })
+		})
+	}
+
+	t.Run("not tls", func(t *testing.T) {
+		s := startStream(t, StreamConfig{Upstream: fallback, SNI: routes})
+		conn, err := net.Dial("tcp", s.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n")
+		if got, _ := io.ReadAll(conn); len(got) != 0 {
+			t.Errorf("plain text got %q", got)
+		}
+		waitUntil(t, "failed counted", func() bool { return s.h.streamConns.value("test", "failed") == 1 })
+	})
+}
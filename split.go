@@ -0,0 +1,168 @@
+package proxygo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Split defaults
+const (
+	defaultSplitCookie  = "proxygo_split"
+	defaultSplitPrimary = "primary"
+	splitCookieMaxAge   = 30 * 24 * time.Hour
+	splitBuckets        = 10000 // percentages resolve to 0.01%
+)
+
+// SplitConfig divides a route's traffic between its own upstream and other variants, for
+// canary rollouts and A/B tests. Each client is assigned a point on the split from a
+// seed, so it keeps its variant while the percentages stay put, and moving them only
+// reassigns the clients between the old and new boundaries.
+type SplitConfig struct {
+	Variants []VariantConfig `json:"variants"`
+	Primary  string          `json:"primary"` // variant name of the route's own upstream, which takes the remaining share; default "primary"
+	By       string          `json:"by"`      // seed: "cookie" (default) sets a random one on first visit, "client" hashes the client ID
+	Cookie   string          `json:"cookie"`  // cookie holding the seed; default "proxygo_split"
+}
+
+// VariantConfig is one alternative upstream of a split route
+type VariantConfig struct {
+	Name     string  `json:"name"`
+	Upstream string  `json:"upstream"` // e.g. "http://app-v2.internal"
+	Percent  float64 `json:"percent"`  // share of clients, e.g. 10 for a 90/10 canary
+}
+
+// trafficSplit is a compiled SplitConfig
+type trafficSplit struct {
+	primary  string
+	variants []splitVariant
+	cookie   string // "" to seed by client ID
+}
+
+// splitVariant is a variant with the end of its range of buckets
+type splitVariant struct {
+	name     string
+	upstream *url.URL
+	until    int
+}
+
+// newTrafficSplit compiles cfg, returning nil when the route is not split
+func newTrafficSplit(cfg *SplitConfig) (*trafficSplit, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if len(cfg.Variants) == 0 {
+		return nil, fmt.Errorf("split: variants is required")
+	}
+	s := &trafficSplit{primary: cfg.Primary}
+	if s.primary == "" {
+		s.primary = defaultSplitPrimary
+	}
+	switch cfg.By {
+	case "", "cookie":
+		s.cookie = cfg.Cookie
+		if s.cookie == "" {
+			s.cookie = defaultSplitCookie
+		}
+	case "client":
+		if cfg.Cookie != "" {
+			return nil, fmt.Errorf("split: cookie needs by \"cookie\"")
+		}
+	default:
+		return nil, fmt.Errorf("split: unknown by %q: expected cookie or client", cfg.By)
+	}
+
+	names := map[string]bool{s.primary: true}
+	var total float64
+	for i, vc := range cfg.Variants {
+		if vc.Name == "" {
+			return nil, fmt.Errorf("split: variant #%d: name is required", i)
+		}
+		if names[vc.Name] {
+			return nil, fmt.Errorf("split: duplicate variant name %q", vc.Name)
+		}
+		names[vc.Name] = true
+		u, err := url.Parse(vc.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("split: variant %s: upstream must be an http or https URL", vc.Name)
+		}
+		if vc.Percent < 0 {
+			return nil, fmt.Errorf("split: variant %s: percent must not be negative", vc.Name)
+		}
+		total += vc.Percent
+		s.variants = append(s.variants, splitVariant{name: vc.Name, upstream: u, until: int(total * splitBuckets / 100)})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("split: variant percentages add up to %g, more than 100", total)
+	}
+	return s, nil
+}
+
+// splitBucket places seed on route's split, in [0, splitBuckets)
+func splitBucket(route, seed string) int {
+	h := fnv.New32a()
+	h.Write([]byte(route + "\x00" + seed))
+	return int(h.Sum32() % splitBuckets)
+}
+
+// choose returns the variant for seed on route, nil meaning the primary upstream
+func (s *trafficSplit) choose(route, seed string) *splitVariant {
+	bucket := splitBucket(route, seed)
+	for i := range s.variants {
+		if bucket < s.variants[i].until {
+			return &s.variants[i]
+		}
+	}
+	return nil
+}
+
+// seed returns the value a request is assigned by, setting the cookie on w when the
+// client has none yet
+func (s *trafficSplit) seed(w http.ResponseWriter, r *http.Request, clientID string) string {
+	if s.cookie == "" {
+		return clientID
+	}
+	if c, err := r.Cookie(s.cookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	var b [12]byte
+	rand.Read(b[:])
+	value := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(splitCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return value
+}
+
+// applySplit points target at the variant the request is assigned to and returns the
+// variant's name
+func (h *ProxyHandler) applySplit(w http.ResponseWriter, r *http.Request, target *proxyTarget, clientID string) string {
+	route := target.Route
+	v := route.Split.choose(route.Name, route.Split.seed(w, r, clientID))
+	if v == nil {
+		return route.Split.primary
+	}
+	rest, _ := matchPrefix(r.URL.Path, route.Prefix)
+	target.URL = v.upstream
+	target.Path = singleJoiningSlash(v.upstream.Path, rest)
+	target.Socket = ""
+	return v.name
+}
+
+// statusClass groups a status code as "2xx", "5xx" and so on
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
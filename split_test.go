@@ -0,0 +1,122 @@
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplitSticky(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	stable, canary := newUpstream("stable"), newUpstream("canary")
+	h := newTestHandler(t, `{"routes": [{"name": "checkout", "prefix": "/checkout/", "upstream": "`+stable.URL+`",
+		"split": {"primary": "stable", "variants": [{"name": "canary", "upstream": "`+canary.URL+`", "percent": 50}]}}]}`)
+
+	get := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/checkout/cart", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Each new client is given a seed, and every later request with it reaches the same variant
+	seen := map[string]bool{}
+	for i := range 40 {
+		first := get(nil)
+		cookies := first.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != defaultSplitCookie {
+			t.Fatalf("client %d: cookies %v, want the split seed", i, cookies)
+		}
+		seen[first.Body.String()] = true
+		for range 3 {
+			w := get(cookies[0])
+			if w.Body.String() != first.Body.String() {
+				t.Fatalf("client %d: %q after %q", i, w.Body, first.Body)
+			}
+			if len(w.Result().Cookies()) != 0 {
+				t.Errorf("client %d: seed set again", i)
+			}
+		}
+	}
+	if !seen["stable /cart"] || !seen["canary /cart"] {
+		t.Errorf("variants reached %v, want both of a 50/50 split", seen)
+	}
+}
+
+func TestSplitRebalance(t *testing.T) {
+	newSplit := func(percents ...float64) *trafficSplit {
+		t.Helper()
+		cfg := &SplitConfig{By: "client"}
+		for i, p := range percents {
+			cfg.Variants = append(cfg.Variants, VariantConfig{Name: fmt.Sprintf("v%d", i), Upstream: "http://v.internal", Percent: p})
+		}
+		s, err := newTrafficSplit(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	name := func(v *splitVariant) string {
+		if v == nil {
+			return "primary"
+		}
+		return v.name
+	}
+
+	tests := []struct {
+		name     string
+		from, to []float64
+	}{
+		{name: "canary grows", from: []float64{10}, to: []float64{30}},
+		{name: "canary shrinks", from: []float64{30}, to: []float64{5}},
+		{name: "first of two grows", from: []float64{10, 10}, to: []float64{20, 10}},
+		{name: "second of two grows", from: []float64{10, 10}, to: []float64{10, 25}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := newSplit(tt.from...), newSplit(tt.to...)
+			moved := 0
+			for i := range 5000 {
+				seed := fmt.Sprintf("192.0.2.%d", i)
+				before, after := name(from.choose("checkout", seed)), name(to.choose("checkout", seed))
+				if before == after {
+					continue
+				}
+				moved++
+				// A client only changes variant when a boundary moved across its bucket
+				bucket := splitBucket("checkout", seed)
+				crossed := false
+				for j := range from.variants {
+					lo, hi := min(from.variants[j].until, to.variants[j].until), max(from.variants[j].until, to.variants[j].until)
+					crossed = crossed || (bucket >= lo && bucket < hi)
+				}
+				if !crossed {
+					t.Errorf("%s in bucket %d moved from %s to %s though no boundary crossed it", seed, bucket, before, after)
+				}
+			}
+			if moved == 0 {
+				t.Error("no client moved")
+			}
+		})
+	}
+
+	// With the percentages unchanged, no one moves
+	a, b := newSplit(10, 20), newSplit(10, 20)
+	for i := range 1000 {
+		seed := fmt.Sprintf("client-%d", i)
+		if name(a.choose("checkout", seed)) != name(b.choose("checkout", seed)) {
+			t.Fatalf("%s: assignment changed without a change to the split", seed)
+		}
+	}
+}
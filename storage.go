@@ -0,0 +1,168 @@
+package proxygo
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ObjectStorageConfig configures the stores behind s3:// and gs:// route upstreams, written
+// as s3://bucket/prefix. They are reachable through configured routes only, never through
+// path-embedded targets, so clients cannot spend the proxy's credentials on other buckets.
+type ObjectStorageConfig struct {
+	S3  *StorageConfig `json:"s3"`  // also used for S3-compatible stores such as MinIO
+	GCS *StorageConfig `json:"gcs"` // Cloud Storage through its S3-compatible XML API
+}
+
+// StorageConfig describes an S3-compatible endpoint and the credentials that sign requests to it
+type StorageConfig struct {
+	Endpoint        string `json:"endpoint"`          // default https://s3.<region>.amazonaws.com, or https://storage.googleapis.com for GCS
+	Region          string `json:"region"`            // default us-east-1 or AWS_REGION, or auto for GCS
+	PathStyle       bool   `json:"path_style"`        // put the bucket in the path rather than the host name, as most self-hosted stores expect
+	AccessKeyID     string `json:"access_key_id"`     // GCS: an HMAC key; S3 falls back to AWS_ACCESS_KEY_ID
+	SecretAccessKey string `json:"secret_access_key"` // S3 falls back to AWS_SECRET_ACCESS_KEY
+	SessionToken    string `json:"session_token"`     // for temporary credentials; S3 falls back to AWS_SESSION_TOKEN
+}
+
+// objectStore is a compiled StorageConfig; requests are unsigned without credentials,
+// which suits public buckets
+type objectStore struct {
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
+	creds     *awsCredentials
+}
+
+// newObjectStores compiles the stores for each upstream scheme
+func newObjectStores(cfg *ObjectStorageConfig) (map[string]*objectStore, error) {
+	if cfg == nil {
+		cfg = &ObjectStorageConfig{}
+	}
+	env := StorageConfig{
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	s3 := env
+	if cfg.S3 != nil {
+		s3 = *cfg.S3
+		if s3.Region == "" {
+			s3.Region = env.Region
+		}
+		if s3.AccessKeyID == "" {
+			s3.AccessKeyID, s3.SecretAccessKey, s3.SessionToken = env.AccessKeyID, env.SecretAccessKey, env.SessionToken
+		}
+	}
+	if s3.Region == "" {
+		s3.Region = "us-east-1"
+	}
+	if s3.Endpoint == "" {
+		s3.Endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+	}
+
+	gcs := StorageConfig{}
+	if cfg.GCS != nil {
+		gcs = *cfg.GCS
+	}
+	if gcs.Region == "" {
+		gcs.Region = "auto"
+	}
+	if gcs.Endpoint == "" {
+		gcs.Endpoint = "https://storage.googleapis.com"
+	}
+
+	stores := make(map[string]*objectStore)
+	for scheme, sc := range map[string]StorageConfig{"s3": s3, "gs": gcs} {
+		store, err := newObjectStore(sc)
+		if err != nil {
+			return nil, fmt.Errorf("object storage %s: %w", scheme, err)
+		}
+		stores[scheme] = store
+	}
+	return stores, nil
+}
+
+// newObjectStore compiles one store
+func newObjectStore(cfg StorageConfig) (*objectStore, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an absolute http(s) URL")
+	}
+	if (cfg.AccessKeyID == "") != (cfg.SecretAccessKey == "") {
+		return nil, fmt.Errorf("access_key_id and secret_access_key go together")
+	}
+	store := &objectStore{endpoint: u, region: cfg.Region, pathStyle: cfg.PathStyle}
+	if cfg.AccessKeyID != "" {
+		store.creds = &awsCredentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken}
+	}
+	return store, nil
+}
+
+// objectURL returns the URL of key in bucket, its path encoded the way SigV4 signs it
+func (s *objectStore) objectURL(bucket, key string) *url.URL {
+	// Dotted bucket names do not match the store's wildcard certificate
+	pathStyle := s.pathStyle || (s.endpoint.Scheme == "https" && strings.Contains(bucket, "."))
+	u := &url.URL{Scheme: s.endpoint.Scheme, Host: bucket + "." + s.endpoint.Host}
+	objectPath := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + key
+	if pathStyle {
+		u.Host = s.endpoint.Host
+		objectPath = strings.TrimSuffix(s.endpoint.Path, "/") + "/" + bucket + "/" + key
+	}
+	u.Path = objectPath
+	u.RawPath = awsURIEscape(objectPath, false)
+	return u
+}
+
+// storageTransport turns GET and HEAD requests into object reads, passing Range and
+// conditional headers through so the store answers them itself
+type storageTransport struct {
+	store *objectStore
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. The director leaves the bucket in the URL host
+// and the object key in its path.
+func (t *storageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if resp := readOnlyResponse(req); resp != nil {
+		return resp, nil
+	}
+	// Bucket listings are not exposed
+	key := strings.TrimPrefix(req.URL.Path, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		return textResponse(req, http.StatusNotFound, "Not found"), nil
+	}
+
+	out := req.Clone(req.Context())
+	out.URL = t.store.objectURL(req.URL.Host, key)
+	out.Host = out.URL.Host
+	// Query parameters select other operations, such as ?acl, and client headers must
+	// not reach the signature
+	for name := range out.Header {
+		lower := strings.ToLower(name)
+		if lower == "authorization" || strings.HasPrefix(lower, "x-amz-") || strings.HasPrefix(lower, "x-goog-") {
+			out.Header.Del(name)
+		}
+	}
+	if t.store.creds != nil {
+		t.store.creds.signV4(out, t.store.region, "s3", emptyPayloadHash, time.Now())
+	}
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	// Store internals stay behind the proxy; user metadata is part of the object
+	for name := range resp.Header {
+		lower := strings.ToLower(name)
+		if (strings.HasPrefix(lower, "x-amz-") && !strings.HasPrefix(lower, "x-amz-meta-")) ||
+			(strings.HasPrefix(lower, "x-goog-") && !strings.HasPrefix(lower, "x-goog-meta-")) {
+			resp.Header.Del(name)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,162 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestObjectURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoint  string
+		pathStyle bool
+		bucket    string
+		key       string
+		want      string
+	}{
+		{name: "virtual host", endpoint: "https://s3.eu-west-1.amazonaws.com", bucket: "assets", key: "img/a.png", want: "https://assets.s3.eu-west-1.amazonaws.com/img/a.png"},
+		{name: "path style", endpoint: "http://minio.internal:9000", pathStyle: true, bucket: "assets", key: "img/a.png", want: "http://minio.internal:9000/assets/img/a.png"},
+		{name: "dotted bucket", endpoint: "https://s3.amazonaws.com", bucket: "assets.example.com", key: "a.png", want: "https://s3.amazonaws.com/assets.example.com/a.png"},
+		{name: "endpoint path", endpoint: "http://gateway.internal/storage/", pathStyle: true, bucket: "b", key: "k", want: "http://gateway.internal/storage/b/k"},
+		{name: "escaped key", endpoint: "https://s3.amazonaws.com", bucket: "b", key: "a b+c=d.txt", want: "https://b.s3.amazonaws.com/a%20b%2Bc%3Dd.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newObjectStore(StorageConfig{Endpoint: tt.endpoint, PathStyle: tt.pathStyle})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := store.objectURL(tt.bucket, tt.key).String(); got != tt.want {
+				t.Errorf("objectURL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObjectStoresConfig(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-central-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	tests := []struct {
+		name     string
+		cfg      *ObjectStorageConfig
+		s3       string // endpoint of the s3 store
+		s3Region string
+		gs       string
+		err      string
+	}{
+		{name: "defaults", s3: "https://s3.eu-central-1.amazonaws.com", s3Region: "eu-central-1", gs: "https://storage.googleapis.com"},
+		{
+			name: "configured", cfg: &ObjectStorageConfig{S3: &StorageConfig{Endpoint: "http://minio:9000", Region: "local"}, GCS: &StorageConfig{Endpoint: "http://fake-gcs"}},
+			s3: "http://minio:9000", s3Region: "local", gs: "http://fake-gcs",
+		},
+		{name: "bad endpoint", cfg: &ObjectStorageConfig{S3: &StorageConfig{Endpoint: "minio:9000"}}, err: "endpoint must be an absolute http(s) URL"},
+		{name: "half credentials", cfg: &ObjectStorageConfig{GCS: &StorageConfig{AccessKeyID: "GOOG1"}}, err: "access_key_id and secret_access_key go together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores, err := newObjectStores(tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("newObjectStores: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s3 := stores["s3"]; s3.endpoint.String() != tt.s3 || s3.region != tt.s3Region {
+				t.Errorf("s3 store %s in %s, want %s in %s", s3.endpoint, s3.region, tt.s3, tt.s3Region)
+			}
+			if gs := stores["gs"]; gs.endpoint.String() != tt.gs || gs.region != "auto" {
+				t.Errorf("gs store %s in %s, want %s in auto", gs.endpoint, gs.region, tt.gs)
+			}
+		})
+	}
+}
+
+func TestStorageRoute(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+	var seen *http.Request
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		// Check the signature the way the store would
+		check := r.Clone(r.Context())
+		check.Header.Del("Authorization")
+		creds.authorize(check, "us-east-1", "s3", r.Header.Get("X-Amz-Content-Sha256"), r.Header.Get("X-Amz-Date"))
+		if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("X-Amz-Request-Id", "4442587FB7D0A2F9")
+		w.Header().Set("X-Amz-Meta-Owner", "web")
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Header.Get("Range") == "bytes=0-3" {
+			w.Header().Set("Content-Range", "bytes 0-3/11")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "hell")
+			return
+		}
+		io.WriteString(w, "hello world")
+	}))
+	defer store.Close()
+	h := newTestHandler(t, `{"object_storage": {"s3": {"endpoint": "`+store.URL+`", "path_style": true, "region": "us-east-1",
+			"access_key_id": "AKIDEXAMPLE", "secret_access_key": "secret"}},
+		"routes": [{"name": "assets", "prefix": "/assets/", "upstream": "s3://site-assets/public"}]}`)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header []string // name, value pairs
+		status int
+		body   string
+		path   string // the object path the store saw; "" when it was not asked
+	}{
+		{name: "get", method: http.MethodGet, target: "/assets/css/app.css", status: 200, body: "hello world", path: "/site-assets/public/css/app.css"},
+		{name: "range", method: http.MethodGet, target: "/assets/a.txt", header: []string{"Range", "bytes=0-3"}, status: 206, body: "hell", path: "/site-assets/public/a.txt"},
+		{name: "head", method: http.MethodHead, target: "/assets/a.txt", status: 200, path: "/site-assets/public/a.txt"},
+		{name: "escaped key", method: http.MethodGet, target: "/assets/my%20file.txt", status: 200, body: "hello world", path: "/site-assets/public/my%20file.txt"},
+		{
+			name: "client credentials dropped", method: http.MethodGet, target: "/assets/a.txt", status: 200, body: "hello world", path: "/site-assets/public/a.txt",
+			header: []string{"Authorization", "Bearer client", "X-Amz-Security-Token", "stolen"},
+		},
+		{name: "listing", method: http.MethodGet, target: "/assets/css/", status: http.StatusNotFound},
+		{name: "write", method: http.MethodPut, target: "/assets/a.txt", status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = nil
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for i := 0; i < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Fatalf("%d %q, want %d %q", w.Code, w.Body, tt.status, tt.body)
+			}
+			if tt.path == "" {
+				if seen != nil {
+					t.Errorf("the store was asked for %s", seen.URL)
+				}
+				return
+			}
+			if seen == nil || seen.URL.EscapedPath() != tt.path {
+				t.Fatalf("store saw %v, want %s", seen, tt.path)
+			}
+			if seen.Header.Get("X-Amz-Security-Token") != "" {
+				t.Errorf("client security token reached the store")
+			}
+			// Store internals stay behind the proxy; object metadata does not
+			if w.Header().Get("X-Amz-Request-Id") != "" || w.Header().Get("X-Amz-Meta-Owner") != "web" {
+				t.Errorf("response headers %v", w.Header())
+			}
+		})
+	}
+}
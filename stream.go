@@ -0,0 +1,463 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stream defaults
+const (
+	defaultStreamIdleTimeout = 5 * time.Minute
+	defaultStreamDialTimeout = 10 * time.Second
+	streamDatagramSize       = 64 << 10
+)
+
+// StreamConfig forwards raw TCP connections or UDP datagrams received on a listener to
+// one fixed upstream, for databases and protocols that are not HTTP. Like the HTTP
+// listeners, stream sockets are taken over from systemd and passed on by binary upgrades.
+type StreamConfig struct {
+	Name        string           `json:"name"`
+	Network     string           `json:"network"`      // "tcp" (default) or "udp"
+	Listen      string           `json:"listen"`       // address to accept on, e.g. ":5432"
+	Upstream    string           `json:"upstream"`     // host:port every connection is forwarded to; with sni, those matching no route
+	SNI         []SNIRouteConfig `json:"sni"`          // TLS passthrough: route by the ClientHello's server name without terminating TLS
+	MaxConns    int              `json:"max_conns"`    // concurrent connections, or UDP clients; 0 for unlimited
+	IdleTimeout Duration         `json:"idle_timeout"` // closes connections with no traffic either way; default 5m
+	DialTimeout Duration         `json:"dial_timeout"` // for connecting to the upstream; default 10s
+}
+
+// validate checks the settings normalize cannot default
+func (c *StreamConfig) validate() error {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+	if c.Network != "tcp" && c.Network != "udp" {
+		return fmt.Errorf("unsupported network %q", c.Network)
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("missing listen address")
+	}
+	if len(c.SNI) > 0 && c.Network != "tcp" {
+		return fmt.Errorf("sni routing needs a tcp stream")
+	}
+	// With sni the upstream only takes unmatched names; without one they are refused
+	if c.Upstream != "" || len(c.SNI) == 0 {
+		if _, _, err := net.SplitHostPort(c.Upstream); err != nil {
+			return fmt.Errorf("upstream must be host:port: %w", err)
+		}
+	}
+	if _, err := newSNITable(c.SNI); err != nil {
+		return err
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("max_conns must not be negative")
+	}
+	return nil
+}
+
+// streamProxy serves one configured stream
+type streamProxy struct {
+	cfg   StreamConfig
+	h     *ProxyHandler
+	ln    net.Listener   // TCP streams
+	pc    net.PacketConn // UDP streams
+	idle  time.Duration
+	dial  time.Duration
+	slots chan struct{} // one per open connection; nil when unlimited
+	sni   *sniTable     // nil unless the stream routes TLS by server name
+
+	active atomic.Int64
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}  // open client and upstream TCP connections
+	sessions map[string]*udpSession // UDP clients by address
+}
+
+// udpSession relays the datagrams of one UDP client through its own upstream socket
+type udpSession struct {
+	client  net.Addr
+	up      net.Conn
+	start   time.Time
+	last    atomic.Int64 // unix nanoseconds of the last datagram either way
+	in, out atomic.Int64
+}
+
+// openStreams binds every configured stream, closing already opened ones on failure
+func openStreams(cfg *Config, handler *ProxyHandler) ([]*streamProxy, error) {
+	var streams []*streamProxy
+	for _, sc := range cfg.Streams {
+		s := &streamProxy{
+			cfg:      sc,
+			h:        handler,
+			idle:     time.Duration(sc.IdleTimeout),
+			dial:     time.Duration(sc.DialTimeout),
+			conns:    make(map[net.Conn]struct{}),
+			sessions: make(map[string]*udpSession),
+		}
+		if s.idle <= 0 {
+			s.idle = defaultStreamIdleTimeout
+		}
+		if s.dial <= 0 {
+			s.dial = defaultStreamDialTimeout
+		}
+		if sc.MaxConns > 0 {
+			s.slots = make(chan struct{}, sc.MaxConns)
+		}
+		sni, err := newSNITable(sc.SNI)
+		if err != nil {
+			for _, s := range streams {
+				s.close()
+			}
+			return nil, fmt.Errorf("stream %q: %w", sc.Name, err)
+		}
+		s.sni = sni
+
+		lc := ListenerConfig{Name: sc.Name, Network: sc.Network, Address: sc.Listen}
+		if sc.Network == "udp" {
+			s.pc, err = listenPacket(lc)
+		} else {
+			s.ln, err = listen(lc)
+		}
+		if err != nil {
+			for _, s := range streams {
+				s.close()
+			}
+			return nil, fmt.Errorf("stream %q: %w", sc.Name, err)
+		}
+		streams = append(streams, s)
+	}
+	handler.streams = streams
+	return streams, nil
+}
+
+// serveStreams runs every stream until ctx is done, then stops accepting and gives open
+// connections until the shutdown timeout to finish. The returned channel is closed once
+// they have.
+func serveStreams(ctx context.Context, handler *ProxyHandler, streams []*streamProxy) <-chan struct{} {
+	done := make(chan struct{})
+	for _, s := range streams {
+		to := s.cfg.Upstream
+		if s.sni != nil {
+			to = "backends by SNI"
+		}
+		handler.logger.Printf("Stream %q forwarding %s://%s to %s", s.cfg.Name, s.cfg.Network, s.cfg.Listen, to)
+		if s.pc != nil {
+			go s.serveUDP()
+		} else {
+			go s.serveTCP()
+		}
+	}
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		for _, s := range streams {
+			s.close()
+		}
+		deadline := time.After(shutdownTimeout)
+		for _, s := range streams {
+			drained := make(chan struct{})
+			go func() {
+				s.wg.Wait()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+			case <-deadline:
+				handler.logger.Printf("Stream %q: closing %d connection(s) still open", s.cfg.Name, s.active.Load())
+				s.closeConns()
+				<-drained
+			}
+		}
+	}()
+	return done
+}
+
+// close stops accepting; UDP sessions end with the socket they reply through
+func (s *streamProxy) close() {
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.pc != nil {
+		s.pc.Close()
+		s.closeConns()
+	}
+}
+
+// closeConns cuts every open connection and UDP session
+func (s *streamProxy) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+	for _, sess := range s.sessions {
+		sess.up.Close()
+	}
+}
+
+// acquire takes a connection slot, reporting false when the stream is full
+func (s *streamProxy) acquire() bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release gives back a slot taken by acquire
+func (s *streamProxy) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// serveTCP accepts connections until the listener is closed
+func (s *streamProxy) serveTCP() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Typically out of file descriptors; pause rather than spin
+			s.h.logger.Printf("Stream %q accept: %v", s.cfg.Name, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !s.acquire() {
+			s.h.streamConns.inc(s.cfg.Name, "rejected")
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.release()
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP connects client to the upstream and copies both ways until both are done
+func (s *streamProxy) handleTCP(client net.Conn) {
+	defer client.Close()
+	upstream := s.cfg.Upstream
+	var serverName string
+	var hello []byte
+	if s.sni != nil {
+		var err error
+		if serverName, hello, err = peekClientHello(client); err != nil {
+			s.h.streamConns.inc(s.cfg.Name, "failed")
+			s.h.logger.Printf("Stream %q: %s: %v", s.cfg.Name, client.RemoteAddr(), err)
+			return
+		}
+		if u := s.sni.upstreamFor(serverName); u != "" {
+			upstream = u
+		}
+		if upstream == "" {
+			s.h.streamConns.inc(s.cfg.Name, "unmatched")
+			return
+		}
+	}
+	up, err := net.DialTimeout("tcp", upstream, s.dial)
+	if err != nil {
+		s.h.streamConns.inc(s.cfg.Name, "failed")
+		s.h.logger.Printf("Stream %q: upstream %s: %v", s.cfg.Name, upstream, err)
+		return
+	}
+	defer up.Close()
+	s.h.streamConns.inc(s.cfg.Name, "accepted")
+
+	s.mu.Lock()
+	s.conns[client], s.conns[up] = struct{}{}, struct{}{}
+	s.mu.Unlock()
+	s.active.Add(1)
+	defer func() {
+		s.active.Add(-1)
+		s.mu.Lock()
+		delete(s.conns, client)
+		delete(s.conns, up)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	var last atomic.Int64
+	last.Store(start.UnixNano())
+	var in, out int64
+	// The backend gets the ClientHello the routing decision was made on
+	if len(hello) > 0 {
+		if _, err := up.Write(hello); err != nil {
+			return
+		}
+		in = int64(len(hello))
+		s.h.streamBytes.add(float64(in), s.cfg.Name, "in")
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		in += s.pipe(up, client, &last, "in")
+	}()
+	go func() {
+		defer wg.Done()
+		out = s.pipe(client, up, &last, "out")
+	}()
+	wg.Wait()
+	line := fmt.Sprintf("%s TCP stream=%s %dB in %dB out %s", client.RemoteAddr(), s.cfg.Name, in, out, time.Since(start))
+	if serverName != "" {
+		line += " sni=" + serverName
+	}
+	s.h.accessLog.Print(line)
+}
+
+// pipe copies src to dst until src ends or the connection has been idle too long, and
+// returns the bytes copied. An orderly end is passed on as a half-close, so protocols
+// that keep answering after the client stops sending still work; any other end cuts
+// both sides.
+func (s *streamProxy) pipe(dst, src net.Conn, last *atomic.Int64, direction string) int64 {
+	buf := s.h.buffers.Get()
+	defer s.h.buffers.Put(buf)
+
+	var n int64
+	for {
+		src.SetReadDeadline(time.Now().Add(s.idle))
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			last.Store(time.Now().UnixNano())
+			dst.SetWriteDeadline(time.Now().Add(s.idle))
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+			s.h.streamBytes.add(float64(nw), s.cfg.Name, direction)
+			if werr != nil {
+				dst.Close()
+				src.Close()
+				return n
+			}
+		}
+		if err == nil {
+			continue
+		}
+		// Only idle when neither direction has moved for the whole timeout
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, last.Load())) < s.idle {
+			continue
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && errors.Is(err, io.EOF) {
+			cw.CloseWrite()
+			return n
+		}
+		dst.Close()
+		src.Close()
+		return n
+	}
+}
+
+// serveUDP relays datagrams until the socket is closed
+func (s *streamProxy) serveUDP() {
+	buf := make([]byte, streamDatagramSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.h.logger.Printf("Stream %q read: %v", s.cfg.Name, err)
+			continue
+		}
+		sess := s.session(addr)
+		if sess == nil {
+			continue
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if _, err := sess.up.Write(buf[:n]); err != nil {
+			continue
+		}
+		sess.in.Add(int64(n))
+		s.h.streamBytes.add(float64(n), s.cfg.Name, "in")
+	}
+}
+
+// session returns the session of the client at addr, starting one for a new client;
+// nil means the datagram is dropped
+func (s *streamProxy) session(addr net.Addr) *udpSession {
+	key := addr.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[key]; ok {
+		return sess
+	}
+	if !s.acquire() {
+		s.h.streamConns.inc(s.cfg.Name, "rejected")
+		return nil
+	}
+	up, err := net.DialTimeout("udp", s.cfg.Upstream, s.dial)
+	if err != nil {
+		s.release()
+		s.h.streamConns.inc(s.cfg.Name, "failed")
+		s.h.logger.Printf("Stream %q: upstream %s: %v", s.cfg.Name, s.cfg.Upstream, err)
+		return nil
+	}
+	s.h.streamConns.inc(s.cfg.Name, "accepted")
+	sess := &udpSession{client: addr, up: up, start: time.Now()}
+	s.sessions[key] = sess
+	s.active.Add(1)
+	s.wg.Add(1)
+	go s.relayReplies(key, sess)
+	return sess
+}
+
+// relayReplies sends the upstream's datagrams back to the client until the session idles out
+func (s *streamProxy) relayReplies(key string, sess *udpSession) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+		sess.up.Close()
+		s.active.Add(-1)
+		s.release()
+		s.h.accessLog.Printf("%s UDP stream=%s %dB in %dB out %s", sess.client, s.cfg.Name, sess.in.Load(), sess.out.Load(), time.Since(sess.start))
+	}()
+
+	buf := make([]byte, streamDatagramSize)
+	for {
+		sess.up.SetReadDeadline(time.Now().Add(s.idle))
+		n, err := sess.up.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, sess.last.Load())) < s.idle {
+				continue
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Refused datagrams surface here; the client may still be sending
+			continue
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if _, err := s.pc.WriteTo(buf[:n], sess.client); err != nil {
+			return
+		}
+		sess.out.Add(int64(n))
+		s.h.streamBytes.add(float64(n), s.cfg.Name, "out")
+	}
+}
+
+// streamSamples reports the open connections of every stream
+func (h *ProxyHandler) streamSamples() []sample {
+	out := make([]sample, 0, len(h.streams))
+	for _, s := range h.streams {
+		out = append(out, sample{labels: []string{s.cfg.Name}, value: float64(s.active.Load())})
+	}
+	return out
+}
@@ -0,0 +1,262 @@
+package proxygo
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startStream serves sc in front of upstream and returns the stream
+func startStream(t *testing.T, sc StreamConfig) *streamProxy {
+	t.Helper()
+	h := newTestHandler(t, `{}`)
+	if sc.Name == "" {
+		sc.Name = "test"
+	}
+	sc.Listen = "127.0.0.1:0"
+	cfg := &Config{Streams: []StreamConfig{sc}}
+	if err := cfg.Streams[0].validate(); err != nil {
+		t.Fatal(err)
+	}
+	streams, err := openStreams(cfg, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := serveStreams(ctx, h, streams)
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return streams[0]
+}
+
+// addr returns the address the stream accepts on
+func (s *streamProxy) addr() string {
+	if s.pc != nil {
+		return s.pc.LocalAddr().String()
+	}
+	return s.ln.Addr().String()
+}
+
+// newTCPUpstream serves every connection with handle
+func newTCPUpstream(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// waitUntil polls cond until it holds, failing the test after a few seconds
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStreamMaxConns(t *testing.T) {
+	upstream := newTCPUpstream(t, func(c net.Conn) { io.Copy(c, c) })
+	s := startStream(t, StreamConfig{Upstream: upstream, MaxConns: 1})
+
+	// echo checks that conn is forwarded, or that the stream cut it
+	echo := func(conn net.Conn, forwarded bool) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("x"))
+		buf := make([]byte, 1)
+		_, err := conn.Read(buf)
+		if forwarded && err != nil {
+			t.Fatalf("forwarded connection: %v", err)
+		}
+		if !forwarded && err == nil {
+			t.Fatal("connection over max_conns was forwarded")
+		}
+	}
+
+	first, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(first, true)
+	second, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(second, false)
+	second.Close()
+	if got := s.h.streamConns.value("test", "rejected"); got != 1 {
+		t.Errorf("%v rejected, want 1", got)
+	}
+
+	// Closing the first frees its slot
+	first.Close()
+	waitUntil(t, "the first connection to end", func() bool { return s.active.Load() == 0 })
+	third, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	echo(third, true)
+	if got := s.h.streamConns.value("test", "accepted"); got != 2 {
+		t.Errorf("%v accepted, want 2", got)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	// The upstream talks for twice the timeout while the client only listens
+	upstream := newTCPUpstream(t, func(c net.Conn) {
+		for range 8 {
+			time.Sleep(idle / 4)
+			if _, err := c.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, c)
+	})
+	s := startStream(t, StreamConfig{Upstream: upstream, IdleTimeout: Duration(idle)})
+
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	// The client never sent a byte, but replies kept the connection open until it went quiet
+	if string(got) != "xxxxxxxx" {
+		t.Errorf("read %q before the connection closed, want 8 bytes", got)
+	}
+	waitUntil(t, "the connection to end", func() bool { return s.active.Load() == 0 })
+	if got := s.h.streamBytes.value("test", "out"); got != 8 {
+		t.Errorf("%v bytes out, want 8", got)
+	}
+}
+
+func TestStreamIdleClose(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	upstream := newTCPUpstream(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	s := startStream(t, StreamConfig{Upstream: upstream, IdleTimeout: Duration(idle)})
+
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetDeadline(start.Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from a silent upstream")
+	}
+	if elapsed := time.Since(start); elapsed < idle {
+		t.Errorf("closed after %v, before the %v idle timeout", elapsed, idle)
+	}
+	waitUntil(t, "the connection to end", func() bool { return s.active.Load() == 0 })
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	// The upstream answers only once the client has finished sending
+	upstream := newTCPUpstream(t, func(c net.Conn) {
+		req, _ := io.ReadAll(c)
+		c.Write([]byte("got " + string(req)))
+	})
+	s := startStream(t, StreamConfig{Upstream: upstream})
+
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "got request" {
+		t.Fatalf("read %q, %v; want the reply after the half-close", got, err)
+	}
+
+	waitUntil(t, "the connection to end", func() bool { return s.active.Load() == 0 })
+	if in, out := s.h.streamBytes.value("test", "in"), s.h.streamBytes.value("test", "out"); in != 7 || out != 11 {
+		t.Errorf("%v bytes in, %v out; want 7 and 11", in, out)
+	}
+}
+
+func TestStreamUDPSessions(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := up.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			up.WriteTo(buf[:n], addr)
+		}
+	}()
+	s := startStream(t, StreamConfig{Network: "udp", Upstream: up.LocalAddr().String(), IdleTimeout: Duration(idle)})
+
+	conn, err := net.Dial("udp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip := func(msg string) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("read %q, %v; want %q echoed", buf[:n], err, msg)
+		}
+	}
+
+	roundTrip("one")
+	roundTrip("two")
+	if got := s.active.Load(); got != 1 {
+		t.Errorf("%d sessions, want 1", got)
+	}
+	waitUntil(t, "the session to expire", func() bool { return s.active.Load() == 0 })
+
+	// The same client starts a new session after expiry
+	roundTrip("three")
+	if got := s.h.streamConns.value("test", "accepted"); got != 2 {
+		t.Errorf("%v sessions accepted, want 2", got)
+	}
+	// A reply is counted just after it is sent
+	waitUntil(t, "11 bytes each way", func() bool {
+		return s.h.streamBytes.value("test", "in") == 11 && s.h.streamBytes.value("test", "out") == 11
+	})
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package proxygo
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog is unavailable where log/syslog is not supported
+func dialSyslog(spec string, security bool) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+package proxygo
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog connects to the local system logger ("local") or a remote one ("udp://host:514").
+// Security logs go to the auth facility, everything else to daemon.
+func dialSyslog(spec string, security bool) (io.WriteCloser, error) {
+	priority := syslog.LOG_INFO | syslog.LOG_DAEMON
+	if security {
+		priority = syslog.LOG_INFO | syslog.LOG_AUTH
+	}
+	if spec == "local" {
+		return syslog.New(priority, "proxygo")
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog address %q: expected \"local\" or udp://host:port", spec)
+	}
+	return syslog.Dial(u.Scheme, u.Host, priority, "proxygo")
+}
@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+
+package proxygo
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		security bool
+		priority string // facility*8 + severity
+	}{
+		{name: "daemon", priority: "<30>"},
+		{name: "auth", security: true, priority: "<38>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+
+			sink, err := openLogSink(LogSinkConfig{Type: "syslog", Address: "udp://" + pc.LocalAddr().String()}, tt.security)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			if _, err := sink.Write([]byte("denied\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 1024)
+			pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := string(buf[:n])
+			if !strings.HasPrefix(msg, tt.priority) || !strings.Contains(msg, "proxygo") || !strings.HasSuffix(msg, "denied\n") {
+				t.Errorf("received %q, want priority %s", msg, tt.priority)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package proxygo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdListeners holds sockets passed in by systemd socket activation
+var systemdListeners []systemdListener
+
+// systemdListener is one activated socket and the FileDescriptorName systemd gave it
+type systemdListener struct {
+	name string
+	ln   net.Listener
+	pc   net.PacketConn // set instead of ln for datagram sockets
+}
+
+// addr returns the address the socket is bound to
+func (sl systemdListener) addr() net.Addr {
+	if sl.pc != nil {
+		return sl.pc.LocalAddr()
+	}
+	return sl.ln.Addr()
+}
+
+// adoptSystemdListeners wraps the sockets described by LISTEN_FDS, when they are meant
+// for this process, so listen can use them instead of binding
+func adoptSystemdListeners() error {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	// Children such as upgraded binaries must not pick these up again
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	nameList := strings.Split(names, ":")
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "systemd")
+		var sl systemdListener
+		sl.ln, err = net.FileListener(f)
+		if err != nil {
+			// UDP streams are activated through ListenDatagram sockets
+			var perr error
+			if sl.pc, perr = net.FilePacketConn(f); perr == nil {
+				err = nil
+			}
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("activated socket %d: %w", 3+i, err)
+		}
+		if i < len(nameList) {
+			sl.name = nameList[i]
+		}
+		systemdListeners = append(systemdListeners, sl)
+	}
+	return nil
+}
+
+// takeSystemd returns and forgets the activated socket for lc, matched by
+// FileDescriptorName first and by bound address otherwise
+func takeSystemd(lc ListenerConfig) net.Listener {
+	if sl, ok := takeActivated(lc, false); ok {
+		return sl.ln
+	}
+	return nil
+}
+
+// takeSystemdPacket is takeSystemd for datagram sockets
+func takeSystemdPacket(lc ListenerConfig) net.PacketConn {
+	if sl, ok := takeActivated(lc, true); ok {
+		return sl.pc
+	}
+	return nil
+}
+
+// takeActivated removes the activated stream or datagram socket matching lc
+func takeActivated(lc ListenerConfig, packet bool) (systemdListener, bool) {
+	match := -1
+	for i, sl := range systemdListeners {
+		if (sl.pc != nil) != packet {
+			continue
+		}
+		if sl.name == lc.Name {
+			match = i
+			break
+		}
+		if match < 0 && sameAddr(sl.addr(), lc) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return systemdListener{}, false
+	}
+	sl := systemdListeners[match]
+	systemdListeners = append(systemdListeners[:match], systemdListeners[match+1:]...)
+	return sl, true
+}
+
+// sameAddr reports whether a bound socket address satisfies the configured one
+func sameAddr(addr net.Addr, lc ListenerConfig) bool {
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return lc.Network == "unix" && a.Name == lc.Address
+	case *net.TCPAddr:
+		if !strings.HasPrefix(lc.Network, "tcp") {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(lc.Network, lc.Address)
+		if err != nil || want.Port != a.Port {
+			return false
+		}
+		return sameIP(want.IP, a.IP)
+	case *net.UDPAddr:
+		if !strings.HasPrefix(lc.Network, "udp") {
+			return false
+		}
+		want, err := net.ResolveUDPAddr(lc.Network, lc.Address)
+		if err != nil || want.Port != a.Port {
+			return false
+		}
+		return sameIP(want.IP, a.IP)
+	}
+	return false
+}
+
+// sameIP reports whether a bound IP satisfies the configured one; ":8080" is satisfied
+// by a socket bound to any wildcard address
+func sameIP(want, bound net.IP) bool {
+	if want == nil || want.IsUnspecified() {
+		return bound.IsUnspecified()
+	}
+	return want.Equal(bound)
+}
+
+// closeUnusedSystemd closes activated sockets no listener was configured for
+func closeUnusedSystemd(logger *log.Logger) {
+	for _, sl := range systemdListeners {
+		logger.Printf("Closing unused activated socket %s (%s)", sl.addr(), sl.name)
+		if sl.pc != nil {
+			sl.pc.Close()
+		} else {
+			sl.ln.Close()
+		}
+	}
+	systemdListeners = nil
+}
+
+// sdNotify sends a state update to the service manager; it is a no-op outside systemd
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdReloading tells the service manager a reload has started; Type=notify-reload needs
+// the monotonic timestamp to pair it with the READY=1 that follows
+func sdReloading() error {
+	state := "RELOADING=1"
+	if usec, ok := monotonicUsec(); ok {
+		state += "\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+	}
+	return sdNotify(state)
+}
+
+// runWatchdog pings the systemd watchdog at half its timeout until ctx is done
+func runWatchdog(ctx context.Context, logger *log.Logger) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Printf("Watchdog notification failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package proxygo
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTakeSystemd(t *testing.T) {
+	listen := func(network, address string) net.Listener {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	named := listen("tcp", "127.0.0.1:0")
+	unnamed := listen("tcp", "127.0.0.1:0")
+	wildcard := listen("tcp", ":0")
+	socket := filepath.Join(t.TempDir(), "activated.sock")
+	unix := listen("unix", socket)
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	wildcardPort := strconv.Itoa(wildcard.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name   string
+		lc     ListenerConfig
+		packet bool
+		want   net.Addr // nil when nothing matches
+	}{
+		{name: "by name", lc: ListenerConfig{Name: "web", Network: "tcp", Address: "127.0.0.1:1"}, want: named.Addr()},
+		{name: "by address", lc: ListenerConfig{Name: "other", Network: "tcp", Address: unnamed.Addr().String()}, want: unnamed.Addr()},
+		{name: "wildcard address", lc: ListenerConfig{Name: "listener-0", Network: "tcp", Address: ":" + wildcardPort}, want: wildcard.Addr()},
+		{name: "specific address against wildcard socket", lc: ListenerConfig{Name: "listener-0", Network: "tcp", Address: "127.0.0.1:" + wildcardPort}},
+		{name: "unix", lc: ListenerConfig{Name: "listener-0", Network: "unix", Address: socket}, want: unix.Addr()},
+		{name: "stream wants no datagram socket", lc: ListenerConfig{Name: "listener-0", Network: "tcp", Address: udp.LocalAddr().String()}},
+		{name: "datagram", lc: ListenerConfig{Name: "stream-0", Network: "udp", Address: udp.LocalAddr().String()}, packet: true, want: udp.LocalAddr()},
+		{name: "unknown", lc: ListenerConfig{Name: "api", Network: "tcp", Address: "127.0.0.1:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			systemdListeners = []systemdListener{
+				{name: "web", ln: named},
+				{name: "unix", ln: unix},
+				{ln: unnamed},
+				{ln: wildcard},
+				{name: "dns", pc: udp},
+			}
+			defer func() { systemdListeners = nil }()
+
+			var got net.Addr
+			if tt.packet {
+				if pc := takeSystemdPacket(tt.lc); pc != nil {
+					got = pc.LocalAddr()
+				}
+			} else if ln := takeSystemd(tt.lc); ln != nil {
+				got = ln.Addr()
+			}
+			if got != tt.want && (got == nil || tt.want == nil || got.String() != tt.want.String()) {
+				t.Fatalf("took %v, want %v", got, tt.want)
+			}
+			if got != nil && len(systemdListeners) != 4 {
+				t.Errorf("%d sockets left, want the taken one forgotten", len(systemdListeners))
+			}
+		})
+	}
+}
+
+func TestAdoptSystemdListeners(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+		err  bool
+	}{
+		{name: "not activated"},
+		{name: "meant for another process", pid: "1", fds: "2"},
+		{name: "invalid count", pid: strconv.Itoa(os.Getpid()), fds: "two", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			t.Setenv("LISTEN_FDNAMES", "web:dns")
+			err := adoptSystemdListeners()
+			if (err != nil) != tt.err {
+				t.Fatalf("adoptSystemdListeners: %v, want error %v", err, tt.err)
+			}
+			if len(systemdListeners) != 0 {
+				t.Errorf("adopted %d sockets", len(systemdListeners))
+			}
+			// Children must not see the sockets again
+			if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+				t.Errorf("activation environment left set")
+			}
+		})
+	}
+}
+
+// listenNotify binds a notify socket, points NOTIFY_SOCKET at it and returns it
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	addr := name
+	if name[0] == '@' {
+		addr = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+// readNotify returns the next state sent to conn
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	tests := []struct {
+		name   string
+		socket string
+	}{
+		{name: "path", socket: filepath.Join(t.TempDir(), "notify.sock")},
+		{name: "abstract", socket: "@proxygo-test-" + strconv.Itoa(os.Getpid())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := listenNotify(t, tt.socket)
+			if err := sdNotify("READY=1"); err != nil {
+				t.Fatal(err)
+			}
+			if got := readNotify(t, conn); got != "READY=1" {
+				t.Errorf("state %q, want READY=1", got)
+			}
+
+			if err := sdReloading(); err != nil {
+				t.Fatal(err)
+			}
+			got := readNotify(t, conn)
+			if _, ok := monotonicUsec(); ok && !strings.HasPrefix(got, "RELOADING=1\nMONOTONIC_USEC=") {
+				t.Errorf("state %q, want RELOADING=1 with a timestamp", got)
+			} else if !strings.HasPrefix(got, "RELOADING=1") {
+				t.Errorf("state %q, want RELOADING=1", got)
+			}
+		})
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("outside systemd: %v", err)
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	tests := []struct {
+		name  string
+		pid   string
+		pings bool
+	}{
+		{name: "this process", pid: strconv.Itoa(os.Getpid()), pings: true},
+		{name: "any process", pings: true},
+		{name: "another process", pid: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := listenNotify(t, filepath.Join(t.TempDir(), "notify.sock"))
+			t.Setenv("WATCHDOG_USEC", "20000")
+			t.Setenv("WATCHDOG_PID", tt.pid)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runWatchdog(ctx, log.New(io.Discard, "", 0))
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			if !tt.pings {
+				// runWatchdog returns at once when the watchdog is not ours
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("watchdog running for another process")
+				}
+				return
+			}
+			for range 2 {
+				if got := readNotify(t, conn); got != "WATCHDOG=1" {
+					t.Fatalf("state %q, want WATCHDOG=1", got)
+				}
+			}
+		})
+	}
+}
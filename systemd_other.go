@@ -0,0 +1,6 @@
+//go:build !linux
+
+package proxygo
+
+// monotonicUsec is only needed under systemd, which runs on Linux
+func monotonicUsec() (int64, bool) { return 0, false }
@@ -0,0 +1,250 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errAliasInConfig is returned when the admin API tries to remove a config-defined alias
+var errAliasInConfig = errors.New("alias is defined in the config file")
+
+// TargetsConfig controls how path-embedded targets are interpreted
+type TargetsConfig struct {
+	DefaultScheme string            `json:"default_scheme"` // scheme for targets written without one, e.g. "https"; empty requires a scheme
+	Aliases       map[string]string `json:"aliases"`        // shorthand first path segments, e.g. "gh": "https://api.github.com"
+	AliasesFile   string            `json:"aliases_file"`   // where aliases managed through the admin API are persisted
+}
+
+// targetAlias is one shorthand target
+type targetAlias struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Source string `json:"source"` // "config" or "admin"
+	url    *url.URL
+}
+
+// targetTable holds the default scheme and the alias table; both are reloadable
+type targetTable struct {
+	mu            sync.RWMutex
+	defaultScheme string
+	config        map[string]*targetAlias
+	managed       map[string]*targetAlias // set through the admin API; override config aliases
+	file          string
+}
+
+// newTargetTable compiles the targets config and loads admin-managed aliases from disk
+func newTargetTable(cfg *TargetsConfig) (*targetTable, error) {
+	t := &targetTable{managed: make(map[string]*targetAlias)}
+	if err := t.update(cfg); err != nil {
+		return nil, err
+	}
+	if cfg == nil || cfg.AliasesFile == "" {
+		return t, nil
+	}
+
+	t.file = cfg.AliasesFile
+	data, err := os.ReadFile(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aliases file: %w", err)
+	}
+	var stored map[string]string
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse aliases file: %w", err)
+	}
+	for name, target := range stored {
+		alias, err := compileAlias(name, target, "admin")
+		if err != nil {
+			return nil, fmt.Errorf("aliases file: %w", err)
+		}
+		t.managed[name] = alias
+	}
+	return t, nil
+}
+
+// update replaces the config-defined part of the table, keeping admin-managed aliases
+func (t *targetTable) update(cfg *TargetsConfig) error {
+	if cfg == nil {
+		cfg = &TargetsConfig{}
+	}
+	if s := cfg.DefaultScheme; s != "" && s != "http" && s != "https" {
+		return fmt.Errorf("targets: default_scheme must be http or https")
+	}
+
+	aliases := make(map[string]*targetAlias, len(cfg.Aliases))
+	for name, target := range cfg.Aliases {
+		alias, err := compileAlias(name, target, "config")
+		if err != nil {
+			return fmt.Errorf("targets: %w", err)
+		}
+		aliases[name] = alias
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.defaultScheme = cfg.DefaultScheme
+	t.config = aliases
+	return nil
+}
+
+// compileAlias validates an alias name and its absolute target URL
+func compileAlias(name, target, source string) (*targetAlias, error) {
+	if name == "" || strings.ContainsAny(name, "/:") {
+		return nil, fmt.Errorf("alias %q: names must be a single path segment without ':'", name)
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("alias %q: target must be an absolute http(s) URL", name)
+	}
+	return &targetAlias{Name: name, Target: target, Source: source, url: u}, nil
+}
+
+// resolve maps /alias/rest to the alias target, reporting false when the first segment is not an alias
+func (t *targetTable) resolve(requestPath string) (*proxyTarget, bool) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(requestPath, "/"), "/")
+
+	t.mu.RLock()
+	alias, ok := t.managed[name]
+	if !ok {
+		alias, ok = t.config[name]
+	}
+	t.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	// /gh maps to the alias target itself, /gh/ and /gh/x to paths beneath it
+	upstreamPath := alias.url.Path
+	if rest != "" || strings.HasSuffix(requestPath, name+"/") {
+		upstreamPath = singleJoiningSlash(alias.url.Path, "/"+rest)
+	}
+	if upstreamPath == "" {
+		upstreamPath = "/"
+	}
+	upstream := &url.URL{Scheme: alias.url.Scheme, Host: alias.url.Host, User: alias.url.User}
+	return &proxyTarget{URL: upstream, Path: upstreamPath}, true
+}
+
+// scheme returns the default scheme for targets written without one
+func (t *targetTable) scheme() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.defaultScheme
+}
+
+// list returns every alias, admin-managed ones shadowing config ones
+func (t *targetTable) list() []*targetAlias {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var out []*targetAlias
+	for name, alias := range t.config {
+		if _, shadowed := t.managed[name]; !shadowed {
+			out = append(out, alias)
+		}
+	}
+	for _, alias := range t.managed {
+		out = append(out, alias)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// set adds or replaces an admin-managed alias
+func (t *targetTable) set(name, target string) (*targetAlias, error) {
+	alias, err := compileAlias(name, target, "admin")
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.managed[name] = alias
+	return alias, t.saveLocked()
+}
+
+// remove deletes an admin-managed alias; config aliases can only be removed from the config
+func (t *targetTable) remove(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.managed[name]; !ok {
+		if _, ok := t.config[name]; ok {
+			return fmt.Errorf("%w: %q", errAliasInConfig, name)
+		}
+		return fmt.Errorf("unknown alias %q", name)
+	}
+	delete(t.managed, name)
+	return t.saveLocked()
+}
+
+// saveLocked persists the admin-managed aliases if a file is configured; callers hold t.mu
+func (t *targetTable) saveLocked() error {
+	if t.file == "" {
+		return nil
+	}
+	stored := make(map[string]string, len(t.managed))
+	for name, alias := range t.managed {
+		stored[name] = alias.Target
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(t.file, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save aliases: %w", err)
+	}
+	return nil
+}
+
+// listAliases handles GET /aliases
+func (a *adminAPI) listAliases(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.proxy.targets.list())
+}
+
+// setAlias handles PUT /aliases/{name} with a {"target": "https://..."} body
+func (a *adminAPI) setAlias(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+
+	alias, err := a.proxy.targets.set(r.PathValue("name"), body.Target)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_alias", err.Error())
+		return
+	}
+
+	a.proxy.logger.Printf("Admin: set alias %q to %s", alias.Name, alias.url.Redacted())
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: "alias_set", Details: map[string]string{"alias": alias.Name, "target": alias.url.Redacted()}})
+	writeJSON(w, http.StatusOK, alias)
+}
+
+// deleteAlias handles DELETE /aliases/{name}
+func (a *adminAPI) deleteAlias(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := a.proxy.targets.remove(name); err != nil {
+		if errors.Is(err, errAliasInConfig) {
+			writeJSONError(w, http.StatusConflict, "alias_in_config", err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+
+	a.proxy.logger.Printf("Admin: removed alias %q", name)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusNoContent, Reason: "alias_removed", Details: map[string]string{"alias": name}})
+	w.WriteHeader(http.StatusNoContent)
+}
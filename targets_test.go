@@ -0,0 +1,139 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTargetAliases(t *testing.T) {
+	table, err := newTargetTable(&TargetsConfig{Aliases: map[string]string{
+		"gh":   "https://api.github.com",
+		"docs": "http://user@docs.internal:8080/v2/",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string // upstream URL and path; "" when the path is not an alias
+	}{
+		{path: "/gh", want: "https://api.github.com/"},
+		{path: "/gh/", want: "https://api.github.com/"},
+		{path: "/gh/repos/x", want: "https://api.github.com/repos/x"},
+		{path: "/gh/repos/x/", want: "https://api.github.com/repos/x/"},
+		{path: "/docs", want: "http://user@docs.internal:8080/v2/"},
+		{path: "/docs/intro", want: "http://user@docs.internal:8080/v2/intro"},
+		{path: "/ghost/x"},
+		{path: "/https://api.github.com/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			target, ok := table.resolve(tt.path)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("resolve(%q) = %s%s, want no alias", tt.path, target.URL, target.Path)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("resolve(%q): no alias", tt.path)
+			}
+			if got := target.URL.String() + target.Path; got != tt.want {
+				t.Errorf("resolve(%q) = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetsConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  TargetsConfig
+		err  string
+	}{
+		{name: "valid", cfg: TargetsConfig{DefaultScheme: "https", Aliases: map[string]string{"gh": "https://api.github.com"}}},
+		{name: "bad scheme", cfg: TargetsConfig{DefaultScheme: "ftp"}, err: "default_scheme must be http or https"},
+		{name: "nested name", cfg: TargetsConfig{Aliases: map[string]string{"g/h": "https://api.github.com"}}, err: "single path segment"},
+		{name: "name with colon", cfg: TargetsConfig{Aliases: map[string]string{"unix:x": "https://api.github.com"}}, err: "single path segment"},
+		{name: "relative target", cfg: TargetsConfig{Aliases: map[string]string{"gh": "api.github.com"}}, err: "absolute http(s) URL"},
+		{name: "file target", cfg: TargetsConfig{Aliases: map[string]string{"gh": "file:///srv"}}, err: "absolute http(s) URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTargetTable(&tt.cfg)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("newTargetTable: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("newTargetTable: %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAliasAdmin(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aliases.json")
+	h := newTestHandler(t, `{"admin": {"address": "127.0.0.1:0", "token": "secret"},
+		"targets": {"aliases": {"gh": "https://api.github.com"}, "aliases_file": "`+file+`"}}`)
+	admin := newAdminAPI(h, h.config.Load().Admin)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "set", method: http.MethodPut, path: "/aliases/ex", body: `{"target": "https://example.com/api"}`, status: http.StatusOK},
+		{name: "set invalid", method: http.MethodPut, path: "/aliases/bad", body: `{"target": "example.com"}`, status: http.StatusBadRequest, code: "invalid_alias"},
+		{name: "remove config alias", method: http.MethodDelete, path: "/aliases/gh", status: http.StatusConflict, code: "alias_in_config"},
+		{name: "remove unknown", method: http.MethodDelete, path: "/aliases/nope", status: http.StatusNotFound, code: "not_found"},
+		{name: "shadow config alias", method: http.MethodPut, path: "/aliases/gh", body: `{"target": "https://github.example.com"}`, status: http.StatusOK},
+		{name: "remove shadowing alias", method: http.MethodDelete, path: "/aliases/gh", status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), `"error":"`+tt.code+`"`) {
+				t.Errorf("body %s, want error %q", w.Body, tt.code)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/aliases", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	var aliases []targetAlias
+	if err := json.Unmarshal(w.Body.Bytes(), &aliases); err != nil {
+		t.Fatal(err)
+	}
+	want := []targetAlias{
+		{Name: "ex", Target: "https://example.com/api", Source: "admin"},
+		{Name: "gh", Target: "https://api.github.com", Source: "config"},
+	}
+	if len(aliases) != len(want) || aliases[0] != want[0] || aliases[1] != want[1] {
+		t.Errorf("aliases %+v, want %+v", aliases, want)
+	}
+
+	// Managed aliases survive a restart
+	table, err := newTargetTable(&TargetsConfig{AliasesFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, ok := table.resolve("/ex/items"); !ok || target.URL.Host != "example.com" || target.Path != "/api/items" {
+		t.Errorf("after reload, resolve(/ex/items) = %v %v", target, ok)
+	}
+}
@@ -0,0 +1,394 @@
+package proxygo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errTenantInConfig is returned when the admin API tries to remove a config-defined tenant
+var errTenantInConfig = errors.New("tenant is defined in the config file")
+
+// TenantsConfig splits the proxy into tenants, each with its own routes, limits and usage
+type TenantsConfig struct {
+	File     string         `json:"file"`     // where tenants managed through the admin API are persisted
+	Required bool           `json:"required"` // reject requests that match no tenant
+	List     []TenantConfig `json:"list"`
+}
+
+// TenantConfig describes one tenant. A request belongs to the tenant owning its API key,
+// else to the tenant whose hosts match its Host header.
+type TenantConfig struct {
+	ID             string        `json:"id"`
+	Hosts          []string      `json:"hosts"`           // inbound host patterns, e.g. "acme.proxy.example.com" or "*.acme.example.com"
+	APIKeys        []string      `json:"api_keys"`        // IDs of the API keys that belong to the tenant
+	Routes         []RouteConfig `json:"routes"`          // private routes, matched before the global ones
+	RateLimit      float64       `json:"rate_limit"`      // requests per second across the tenant, 0 for unlimited
+	Burst          int           `json:"burst"`           // request burst, defaults to the rate rounded up
+	AllowedHosts   []string      `json:"allowed_hosts"`   // upstream host patterns the tenant may reach; empty allows all
+	AllowedClients []string      `json:"allowed_clients"` // client IPs or CIDRs; empty allows all
+}
+
+// tenant is a compiled TenantConfig
+type tenant struct {
+	TenantConfig
+	Source string `json:"source"` // "config" or "admin"
+
+	router  *router
+	clients []*net.IPNet
+}
+
+// tenantTable holds the config-defined and admin-managed tenants; the former are reloadable
+type tenantTable struct {
+	required bool
+	file     string
+
+	mu       sync.RWMutex
+	config   map[string]*tenant
+	managed  map[string]*tenant // set through the admin API; override config tenants
+	limiters map[string]*tokenBucket
+
+	cluster *clusterState // nil when rate limits are counted by this instance alone
+}
+
+// openTenantTable compiles the tenants config and loads admin-managed tenants from
+// disk, returning nil when tenants are not configured
+func openTenantTable(cfg *TenantsConfig) (*tenantTable, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	t := &tenantTable{
+		required: cfg.Required,
+		file:     cfg.File,
+		managed:  make(map[string]*tenant),
+		limiters: make(map[string]*tokenBucket),
+	}
+	if err := t.update(cfg); err != nil {
+		return nil, err
+	}
+	if t.file == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var stored []TenantConfig
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+	for _, tc := range stored {
+		tn, err := compileTenant(tc, "admin")
+		if err != nil {
+			return nil, fmt.Errorf("tenants file: %w", err)
+		}
+		t.managed[tn.ID] = tn
+	}
+	return t, nil
+}
+
+// update replaces the config-defined tenants, keeping admin-managed ones
+func (t *tenantTable) update(cfg *TenantsConfig) error {
+	if cfg == nil {
+		cfg = &TenantsConfig{}
+	}
+	tenants := make(map[string]*tenant, len(cfg.List))
+	for _, tc := range cfg.List {
+		tn, err := compileTenant(tc, "config")
+		if err != nil {
+			return fmt.Errorf("tenants: %w", err)
+		}
+		if _, dup := tenants[tn.ID]; dup {
+			return fmt.Errorf("tenants: duplicate tenant %q", tn.ID)
+		}
+		tenants[tn.ID] = tn
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.required = cfg.Required
+	t.config = tenants
+	return nil
+}
+
+// compileTenant validates a tenant and compiles its routes
+func compileTenant(tc TenantConfig, source string) (*tenant, error) {
+	if tc.ID == "" || strings.ContainsAny(tc.ID, "/ ") {
+		return nil, fmt.Errorf("tenant %q: ids must be non-empty and contain no '/' or spaces", tc.ID)
+	}
+	rt, err := newRouter(tc.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", tc.ID, err)
+	}
+	// Metrics and logs tell the tenants' routes apart
+	for _, route := range rt.routes {
+		route.Name = tc.ID + "/" + route.Name
+	}
+
+	tn := &tenant{TenantConfig: tc, Source: source, router: rt}
+	tn.Hosts = slices.Clone(tc.Hosts)
+	for i, host := range tn.Hosts {
+		tn.Hosts[i] = strings.ToLower(host)
+	}
+	for _, client := range tc.AllowedClients {
+		if !strings.Contains(client, "/") {
+			if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+				client += "/32"
+			} else {
+				client += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: invalid allowed client %q", tc.ID, client)
+		}
+		tn.clients = append(tn.clients, ipNet)
+	}
+	return tn, nil
+}
+
+// activeLocked returns every tenant sorted by ID, admin-managed ones shadowing config ones; callers hold t.mu
+func (t *tenantTable) activeLocked() []*tenant {
+	out := make([]*tenant, 0, len(t.config)+len(t.managed))
+	for id, tn := range t.config {
+		if _, shadowed := t.managed[id]; !shadowed {
+			out = append(out, tn)
+		}
+	}
+	for _, tn := range t.managed {
+		out = append(out, tn)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// identify returns the tenant r belongs to, or nil. keyID is the ID of the request's
+// valid API key, or "".
+func (t *tenantTable) identify(r *http.Request, keyID string) (*tenant, error) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	t.mu.RLock()
+	tenants := t.activeLocked()
+	required := t.required
+	t.mu.RUnlock()
+
+	if keyID != "" {
+		for _, tn := range tenants {
+			if slices.Contains(tn.APIKeys, keyID) {
+				return tn, nil
+			}
+		}
+	}
+	// Exact host names beat wildcards
+	for _, tn := range tenants {
+		if slices.Contains(tn.Hosts, host) {
+			return tn, nil
+		}
+	}
+	// The longest matching wildcard wins, so *.acme.example.com is not
+	// lost to a *.example.com tenant that sorts first
+	var match *tenant
+	longest := 0
+	for _, tn := range tenants {
+		for _, pattern := range tn.Hosts {
+			if ok, _ := path.Match(pattern, host); ok && len(pattern) > longest {
+				match, longest = tn, len(pattern)
+			}
+		}
+	}
+	if match != nil {
+		return match, nil
+	}
+
+	if required {
+		return nil, &keyError{status: http.StatusForbidden, code: "unknown_tenant", message: "the request does not belong to any tenant"}
+	}
+	return nil, nil
+}
+
+// admit enforces the tenant's client allowlist, upstream allowlist and rate limit
+func (t *tenantTable) admit(ctx context.Context, tn *tenant, clientIP, upstreamHost string) *keyError {
+	if len(tn.clients) > 0 {
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !slices.ContainsFunc(tn.clients, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return &keyError{status: http.StatusForbidden, code: "client_not_allowed", message: "this client may not use tenant " + tn.ID}
+		}
+	}
+	if !hostAllowed(tn.AllowedHosts, upstreamHost) {
+		return &keyError{status: http.StatusForbidden, code: "host_not_allowed", message: fmt.Sprintf("tenant %s may not reach %s", tn.ID, upstreamHost)}
+	}
+
+	if tn.RateLimit > 0 {
+		burst := float64(tn.Burst)
+		if burst < 1 {
+			burst = math.Ceil(tn.RateLimit)
+		}
+		if t.cluster != nil {
+			if ok, wait, err := t.cluster.allow(ctx, "tenant", tn.ID, tn.RateLimit, burst); err == nil {
+				if !ok {
+					return &keyError{status: http.StatusTooManyRequests, code: "rate_limited", message: "the request rate of tenant " + tn.ID + " is exceeded", retryAfter: wait}
+				}
+				return nil
+			}
+		}
+		t.mu.Lock()
+		bucket, ok := t.limiters[tn.ID]
+		if !ok {
+			bucket = newTokenBucket(tn.RateLimit, burst)
+			t.limiters[tn.ID] = bucket
+		}
+		t.mu.Unlock()
+		// Limits changed by a reload or the admin API apply to the existing bucket
+		bucket.setRate(tn.RateLimit, burst)
+		if n, wait := bucket.reserve(1); n == 0 {
+			return &keyError{status: http.StatusTooManyRequests, code: "rate_limited", message: "the request rate of tenant " + tn.ID + " is exceeded", retryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// routes returns the routes of every tenant
+func (t *tenantTable) routes() []*Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var out []*Route
+	for _, tn := range t.activeLocked() {
+		out = append(out, tn.router.routes...)
+	}
+	return out
+}
+
+// list returns every tenant
+func (t *tenantTable) list() []*tenant {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.activeLocked()
+}
+
+// set adds or replaces an admin-managed tenant
+func (t *tenantTable) set(tc TenantConfig) (*tenant, error) {
+	tn, err := compileTenant(tc, "admin")
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.managed[tn.ID] = tn
+	return tn, t.saveLocked()
+}
+
+// remove deletes an admin-managed tenant; config tenants can only be removed from the config
+func (t *tenantTable) remove(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.managed[id]; !ok {
+		if _, ok := t.config[id]; ok {
+			return fmt.Errorf("%w: %q", errTenantInConfig, id)
+		}
+		return fmt.Errorf("unknown tenant %q", id)
+	}
+	delete(t.managed, id)
+	delete(t.limiters, id)
+	return t.saveLocked()
+}
+
+// saveLocked persists the admin-managed tenants if a file is configured; callers hold t.mu
+func (t *tenantTable) saveLocked() error {
+	if t.file == "" {
+		return nil
+	}
+	stored := make([]TenantConfig, 0, len(t.managed))
+	for _, tn := range t.managed {
+		stored = append(stored, tn.TenantConfig)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(t.file, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save tenants: %w", err)
+	}
+	return nil
+}
+
+// tenantsEnabled answers 404 when tenants are not configured
+func (a *adminAPI) tenantsEnabled(w http.ResponseWriter) bool {
+	if a.proxy.tenants == nil {
+		writeJSONError(w, http.StatusNotFound, "tenants_disabled", "tenants is not configured")
+		return false
+	}
+	return true
+}
+
+// listTenants handles GET /tenants
+func (a *adminAPI) listTenants(w http.ResponseWriter, r *http.Request) {
+	if !a.tenantsEnabled(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.tenants.list())
+}
+
+// setTenant handles PUT /tenants/{id} with a tenant definition body
+func (a *adminAPI) setTenant(w http.ResponseWriter, r *http.Request) {
+	if !a.tenantsEnabled(w) {
+		return
+	}
+
+	var tc TenantConfig
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&tc); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	tc.ID = r.PathValue("id")
+
+	tn, err := a.proxy.tenants.set(tc)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_tenant", err.Error())
+		return
+	}
+
+	a.proxy.logger.Printf("Admin: set tenant %q", tn.ID)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusOK, Reason: "tenant_set", Details: map[string]string{"tenant": tn.ID}})
+	writeJSON(w, http.StatusOK, tn)
+}
+
+// deleteTenant handles DELETE /tenants/{id}
+func (a *adminAPI) deleteTenant(w http.ResponseWriter, r *http.Request) {
+	if !a.tenantsEnabled(w) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := a.proxy.tenants.remove(id); err != nil {
+		if errors.Is(err, errTenantInConfig) {
+			writeJSONError(w, http.StatusConflict, "tenant_in_config", err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+
+	a.proxy.logger.Printf("Admin: removed tenant %q", id)
+	a.proxy.audit(r, auditEvent{Event: auditAdminAction, Status: http.StatusNoContent, Reason: "tenant_removed", Details: map[string]string{"tenant": id}})
+	w.WriteHeader(http.StatusNoContent)
+}
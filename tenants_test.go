@@ -0,0 +1,144 @@
+package proxygo
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantIdentify(t *testing.T) {
+	table, err := openTenantTable(&TenantsConfig{List: []TenantConfig{
+		{ID: "acme", Hosts: []string{"acme.example.com"}, APIKeys: []string{"acme-key"}},
+		{ID: "globex", Hosts: []string{"globex.example.com", "*.globex.example.com"}, APIKeys: []string{"globex-key"}},
+		{ID: "catchall", Hosts: []string{"*.example.com"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		keyID  string
+		tenant string // "" for no tenant
+	}{
+		{name: "host", host: "acme.example.com", tenant: "acme"},
+		{name: "host with port and case", host: "ACME.Example.com:8443", tenant: "acme"},
+		{name: "wildcard host", host: "api.globex.example.com", tenant: "globex"},
+		{name: "exact host beats an earlier wildcard", host: "globex.example.com", tenant: "globex"},
+		{name: "catch-all wildcard", host: "initech.example.com", tenant: "catchall"},
+		{name: "wildcard needs a subdomain", host: "example.com"},
+		{name: "no match", host: "acme.example.org"},
+		{name: "key beats host", host: "globex.example.com", keyID: "acme-key", tenant: "acme"},
+		{name: "unknown key falls back to host", host: "globex.example.com", keyID: "other-key", tenant: "globex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			tn, err := table.identify(r, tt.keyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if tn != nil {
+				got = tn.ID
+			}
+			if got != tt.tenant {
+				t.Errorf("tenant %q, want %q", got, tt.tenant)
+			}
+		})
+	}
+
+	// An admin-managed tenant replaces the config one with the same ID
+	if _, err := table.set(TenantConfig{ID: "acme", Hosts: []string{"acme.test"}}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "acme.example.com"
+	if tn, _ := table.identify(r, "acme-key"); tn == nil || tn.ID != "catchall" {
+		t.Errorf("shadowed config tenant still matched: %v", tn)
+	}
+	if err := table.remove("globex"); !errors.Is(err, errTenantInConfig) {
+		t.Errorf("removing a config tenant: err = %v", err)
+	}
+
+	// Unmatched requests are refused when a tenant is required
+	table.update(&TenantsConfig{Required: true})
+	r.Host = "nobody.example.org"
+	var kerr *keyError
+	if _, err := table.identify(r, ""); !errors.As(err, &kerr) || kerr.status != http.StatusForbidden || kerr.code != "unknown_tenant" {
+		t.Errorf("required tenant: err = %v", err)
+	}
+}
+
+// TestTenantIsolation checks that one tenant's routes, allowlists and rate limit never
+// apply to another tenant's requests or to requests outside any tenant
+func TestTenantIsolation(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	acme, globex, shared := newUpstream("acme"), newUpstream("globex"), newUpstream("shared")
+	keyFile := writeTestKeys(t, &APIKey{ID: "acme-key", Hash: hashKey("acme-secret")})
+
+	h := newTestHandler(t, `{
+		"api_keys": {"file": "`+keyFile+`"},
+		"routes": [{"name": "shared", "prefix": "/shared/", "upstream": "`+shared.URL+`"}],
+		"tenants": {"list": [
+			{"id": "acme", "hosts": ["acme.test"], "api_keys": ["acme-key"], "rate_limit": 0.001, "burst": 2,
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+acme.URL+`"}]},
+			{"id": "globex", "hosts": ["globex.test"], "allowed_clients": ["192.0.2.0/24"],
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+globex.URL+`"}]},
+			{"id": "initech", "hosts": ["initech.test"], "allowed_clients": ["10.0.0.0/8"],
+				"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+globex.URL+`"}]}
+		]}
+	}`)
+
+	get := func(host, path, secret string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = host
+		if secret != "" {
+			r.Header.Set("X-API-Key", secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	steps := []struct {
+		name   string
+		host   string
+		path   string
+		secret string
+		status int
+		body   string // expected body of a 200
+	}{
+		{name: "acme route", host: "acme.test", path: "/api/items", status: http.StatusOK, body: "acme /items"},
+		{name: "globex route with the same prefix", host: "globex.test", path: "/api/items", status: http.StatusOK, body: "globex /items"},
+		{name: "global route for a tenant", host: "globex.test", path: "/shared/items", status: http.StatusOK, body: "shared /items"},
+		{name: "tenant route outside the tenant", host: "other.test", path: "/api/items", status: http.StatusBadRequest},
+		{name: "acme by API key on the globex host", host: "globex.test", path: "/api/items", secret: "acme-secret", status: http.StatusOK, body: "acme /items"},
+
+		// acme's burst of two is now spent, whichever way its requests were identified
+		{name: "acme over its rate", host: "acme.test", path: "/api/items", status: http.StatusTooManyRequests},
+		{name: "acme key over its rate", host: "globex.test", path: "/shared/items", secret: "acme-secret", status: http.StatusTooManyRequests},
+		{name: "globex unaffected", host: "globex.test", path: "/api/items", status: http.StatusOK, body: "globex /items"},
+		{name: "no tenant unaffected", host: "other.test", path: "/shared/items", status: http.StatusOK, body: "shared /items"},
+
+		// Client allowlists belong to their tenant alone
+		{name: "initech refuses the client", host: "initech.test", path: "/api/items", status: http.StatusForbidden},
+		{name: "globex admits the client", host: "globex.test", path: "/api/again", status: http.StatusOK, body: "globex /again"},
+	}
+	for _, step := range steps {
+		status, body := get(step.host, step.path, step.secret)
+		if status != step.status || (step.status == http.StatusOK && body != step.body) {
+			t.Errorf("%s: status %d, body %q; want %d %q", step.name, status, body, step.status, step.body)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// transportPool hands out the upstream transports: shared TCP ones plus one per unix socket.
+// The transports are rebuilt when the pool settings change.
+type transportPool struct {
+	dialer *net.Dialer
+	stats  *poolStats
+	tls    *tlsStats
+
+	mu       sync.Mutex
+	settings PoolConfig
+	tcp      *http.Transport
+	grpc     *http.Transport // HTTP/2 only, cleartext (h2c) for http:// upstreams
+	grpcTLS  *http.Transport // HTTP/2 only over TLS
+	unix     map[unixTransportKey]*http.Transport
+
+	sessions     tls.ClientSessionCache // shared by the transports and kept across rebuilds
+	sessionsSize int
+
+	ftp   *ftpTransport  // nil unless ftp:// targets are enabled
+	files *fileTransport // nil unless file:// targets are enabled
+
+	stores map[string]*objectStore // by upstream scheme, s3 and gs
+}
+
+// unixTransportKey identifies a unix socket transport
+type unixTransportKey struct {
+	socket string
+	grpc   bool
+}
+
+// newTransportPool creates a pool whose TCP transport mirrors http.DefaultTransport.
+// control, when set, may veto each upstream address right before it is dialed.
+func newTransportPool(control func(network, address string, c syscall.RawConn) error, settings *PoolConfig) *transportPool {
+	p := &transportPool{
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   control,
+		},
+		stats: newPoolStats(),
+		tls:   newTLSStats(),
+	}
+	if settings != nil {
+		p.settings = *settings
+	}
+	p.rebuild()
+	return p
+}
+
+// rebuild creates fresh transports from p.settings; callers hold p.mu or own p exclusively
+func (p *transportPool) rebuild() {
+	tcp := http.DefaultTransport.(*http.Transport).Clone()
+	tcp.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return p.stats.track(address)(p.dialer.DialContext(ctx, network, address))
+	}
+	p.settings.apply(tcp)
+	// Handshakes made through an HTTP proxy use TLSClientConfig and are not counted
+	tlsConfig := &tls.Config{ClientSessionCache: p.sessionCache()}
+	tcp.TLSClientConfig = tlsConfig
+	tcp.DialTLSContext = p.dialTLS(tlsConfig, tcp.TLSHandshakeTimeout, []string{"h2", "http/1.1"})
+
+	p.tcp = tcp
+	p.grpc = withHTTP2Only(tcp.Clone(), false)
+	p.grpcTLS = withHTTP2Only(tcp.Clone(), true)
+	p.grpcTLS.DialTLSContext = p.dialTLS(tlsConfig, tcp.TLSHandshakeTimeout, []string{"h2"})
+	p.unix = make(map[unixTransportKey]*http.Transport)
+}
+
+// tune swaps in transports built with new settings. Requests in flight finish on the
+// old transports, whose idle connections are closed.
+func (p *transportPool) tune(settings PoolConfig) {
+	p.mu.Lock()
+	old := []*http.Transport{p.tcp, p.grpc, p.grpcTLS}
+	for _, tr := range p.unix {
+		old = append(old, tr)
+	}
+	p.settings = settings
+	p.rebuild()
+	p.mu.Unlock()
+
+	for _, tr := range old {
+		tr.CloseIdleConnections()
+	}
+}
+
+// currentSettings returns the active pool settings
+func (p *transportPool) currentSettings() PoolConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings
+}
+
+// idleLimit is how many idle connections the pool keeps per upstream
+func (p *transportPool) idleLimit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.settings.MaxIdleConnsPerHost == 0 {
+		return http.DefaultMaxIdleConnsPerHost
+	}
+	return p.settings.MaxIdleConnsPerHost
+}
+
+// withHTTP2Only restricts tr to HTTP/2, over TLS or with prior knowledge (h2c)
+func withHTTP2Only(tr *http.Transport, overTLS bool) *http.Transport {
+	protocols := new(http.Protocols)
+	if overTLS {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	tr.Protocols = protocols
+	return tr
+}
+
+// forTarget returns the transport that reaches the given target.
+// gRPC requests must stay on HTTP/2 end to end so trailers survive.
+func (p *transportPool) forTarget(t *proxyTarget, grpc bool) http.RoundTripper {
+	// Other schemes are answered by proxygo itself or translated to HTTP; disabled ones fail as unsupported
+	switch {
+	case t.URL.Scheme == "ftp" && p.ftp != nil:
+		return p.ftp
+	case t.URL.Scheme == "file" && p.files != nil:
+		return p.files
+	case p.stores[t.URL.Scheme] != nil && t.Route != nil:
+		store := p.stores[t.URL.Scheme]
+		return &storageTransport{store: store, next: p.forTarget(&proxyTarget{URL: store.endpoint}, false)}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t.Socket == "" {
+		tr := p.tcp
+		switch {
+		case grpc && t.URL.Scheme == "https":
+			tr = p.grpcTLS
+		case grpc:
+			tr = p.grpc
+		}
+		return &trackedTransport{RoundTripper: tr, stats: p.stats}
+	}
+
+	key := unixTransportKey{socket: t.Socket, grpc: grpc}
+	if tr, ok := p.unix[key]; ok {
+		return &trackedTransport{RoundTripper: tr, stats: p.stats, host: "unix:" + t.Socket}
+	}
+
+	// Every connection of this transport goes to the socket, whatever the URL host says
+	socket := t.Socket
+	tr := p.tcp.Clone()
+	tr.Proxy = nil
+	tr.DialTLSContext = nil // TLS over the socket is handshaken by the transport itself
+	tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return p.stats.track("unix:" + socket)(d.DialContext(ctx, "unix", socket))
+	}
+	if grpc {
+		tr = withHTTP2Only(tr, false)
+	}
+	p.unix[key] = tr
+	return &trackedTransport{RoundTripper: tr, stats: p.stats, host: "unix:" + socket}
+}
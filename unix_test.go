@@ -0,0 +1,56 @@
+package proxygo
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newUnixUpstream serves on a unix socket, echoing the path it was asked for
+func newUnixUpstream(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	upstream.Listener = ln
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return socket
+}
+
+func TestUnixUpstream(t *testing.T) {
+	socket := newUnixUpstream(t)
+	other := filepath.Join(t.TempDir(), "other.sock")
+	h := newTestHandler(t, `{"unix_sockets": ["`+socket+`"],
+		"routes": [{"name": "app", "prefix": "/app/", "upstream": "http://app.internal/v1/", "socket": "`+socket+`"}]}`)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		body   string
+	}{
+		{name: "route", target: "/app/items?page=2", status: http.StatusOK, body: "/v1/items?page=2"},
+		{name: "unix target", target: "/unix:" + socket + "/api/items?page=2", status: http.StatusOK, body: "/api/items?page=2"},
+		{name: "unix target root", target: "/unix:" + socket, status: http.StatusOK, body: "/"},
+		{name: "socket not listed", target: "/unix:" + other + "/api/items", status: http.StatusBadRequest},
+		{name: "socket prefix only", target: "/unix:" + socket + "x/api", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Errorf("%d %q, want %d %q", w.Code, w.Body.String(), tt.status, tt.body)
+			}
+		})
+	}
+}
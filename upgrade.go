@@ -0,0 +1,106 @@
+package proxygo
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment a parent process sets when handing its listeners to an upgraded binary
+const (
+	envInheritedListeners = "PROXYGO_LISTENERS" // comma-separated network://address, one per fd from 3
+	envUpgradeReadyFD     = "PROXYGO_READY_FD"  // pipe the child writes to once its listeners are bound
+)
+
+// Sockets passed in by the previous process, keyed by listenerKey
+var (
+	inheritedListeners = map[string]net.Listener{}
+	inheritedPackets   = map[string]net.PacketConn{} // UDP streams
+)
+
+// listenerKey identifies a socket independently of the listener's configured name
+func listenerKey(network, address string) string {
+	return network + "://" + address
+}
+
+// adoptInheritedListeners wraps the file descriptors described by the environment
+// as listeners for listen to pick up
+func adoptInheritedListeners() error {
+	spec := os.Getenv(envInheritedListeners)
+	os.Unsetenv(envInheritedListeners)
+	if spec == "" {
+		return nil
+	}
+	for i, key := range strings.Split(spec, ",") {
+		f := os.NewFile(uintptr(3+i), key)
+		var err error
+		if strings.HasPrefix(key, "udp") {
+			var pc net.PacketConn
+			if pc, err = net.FilePacketConn(f); err == nil {
+				inheritedPackets[key] = pc
+			}
+		} else {
+			var ln net.Listener
+			if ln, err = net.FileListener(f); err == nil {
+				inheritedListeners[key] = ln
+			}
+		}
+		// Both dup the descriptor, so the original is not needed either way
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited listener %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// takeInherited returns and forgets the inherited socket for lc, if any
+func takeInherited(lc ListenerConfig) net.Listener {
+	key := listenerKey(lc.Network, lc.Address)
+	ln, ok := inheritedListeners[key]
+	if ok {
+		delete(inheritedListeners, key)
+	}
+	return ln
+}
+
+// takeInheritedPacket returns and forgets the inherited datagram socket for lc, if any
+func takeInheritedPacket(lc ListenerConfig) net.PacketConn {
+	key := listenerKey(lc.Network, lc.Address)
+	pc, ok := inheritedPackets[key]
+	if ok {
+		delete(inheritedPackets, key)
+	}
+	return pc
+}
+
+// closeUnusedInherited closes inherited sockets the new config no longer listens on
+func closeUnusedInherited() {
+	for key, ln := range inheritedListeners {
+		ln.Close()
+		delete(inheritedListeners, key)
+	}
+	for key, pc := range inheritedPackets {
+		pc.Close()
+		delete(inheritedPackets, key)
+	}
+}
+
+// notifyUpgradeParent tells the process that started this one that it may stop accepting
+func notifyUpgradeParent() error {
+	spec := os.Getenv(envUpgradeReadyFD)
+	os.Unsetenv(envUpgradeReadyFD)
+	if spec == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(spec)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", envUpgradeReadyFD, spec)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte("ready\n"))
+	return err
+}
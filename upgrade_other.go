@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package proxygo
+
+import "context"
+
+// watchUpgrade is a no-op: passing listening sockets to a new process needs Unix fd inheritance
+func watchUpgrade(ctx context.Context, handler *ProxyHandler, servers []*listenerServer, streams []*streamProxy, handoff func()) {
+}
@@ -0,0 +1,173 @@
+//go:build !windows && !plan9
+
+package proxygo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeTimeout bounds how long the new binary may take to bind its listeners
+const upgradeTimeout = 30 * time.Second
+
+// watchUpgrade starts the on-disk binary with this process's listeners and stream sockets
+// on every SIGUSR2. Once the new process is ready, handoff is called so this one drains
+// and exits.
+func watchUpgrade(ctx context.Context, handler *ProxyHandler, servers []*listenerServer, streams []*streamProxy, handoff func()) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr2:
+		}
+
+		pid, err := handler.upgrade(servers, streams)
+		if err != nil {
+			// Keep serving with the current binary
+			handler.logger.Printf("Binary upgrade failed: %v", err)
+			continue
+		}
+		handler.logger.Printf("Handed listeners to upgraded process %d, draining", pid)
+		handoff()
+		return
+	}
+}
+
+// upgrade execs the current executable with the listening sockets attached and
+// waits for it to report that it is serving
+func (h *ProxyHandler) upgrade(servers []*listenerServer, streams []*streamProxy) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	keys := make([]string, 0, 2*len(servers)+len(streams))
+	pass := func(kind, name string, socket any, key string) error {
+		fl, ok := socket.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s %q cannot be passed on", kind, name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", kind, name, err)
+		}
+		files = append(files, f)
+		keys = append(keys, key)
+		return nil
+	}
+	for _, s := range servers {
+		if err := pass("listener", s.cfg.Name, s.ln, listenerKey(s.cfg.Network, s.cfg.Address)); err != nil {
+			return 0, err
+		}
+		if s.h3 != nil {
+			if err := pass("listener", s.cfg.Name, s.h3.pc, listenerKey("udp", s.cfg.Address)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, s := range streams {
+		var socket any = s.ln
+		if s.pc != nil {
+			socket = s.pc
+		}
+		if err := pass("stream", s.cfg.Name, socket, listenerKey(s.cfg.Network, s.cfg.Listen)); err != nil {
+			return 0, err
+		}
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	// Persist counters so the new process starts from the current state
+	h.flushState()
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case envInheritedListeners, envUpgradeReadyFD:
+		case "WATCHDOG_PID":
+			// The child becomes the main process and takes over the watchdog
+		default:
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envInheritedListeners+"="+strings.Join(keys, ","),
+		envUpgradeReadyFD+"="+strconv.Itoa(3+len(files)))
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	// Starting the child switched the shared sockets to blocking mode; put them back so
+	// this process's Accept calls stay on the poller and Shutdown can interrupt them
+	for _, f := range files {
+		setNonblock(f)
+	}
+	if err != nil {
+		return 0, err
+	}
+	h.logger.Printf("Started upgraded process %d from %s", cmd.Process.Pid, exe)
+
+	// The pipe reaches EOF early if the child exits before binding its listeners
+	result := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(ready).ReadString('\n')
+		if err == nil && line != "ready\n" {
+			err = fmt.Errorf("unexpected readiness message %q", line)
+		}
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("not ready after %s", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("upgraded process %d: %w", cmd.Process.Pid, err)
+	}
+	// Reap the child if it exits while this process is still draining
+	go cmd.Wait()
+
+	// The socket file now belongs to the new process as well
+	for _, s := range servers {
+		if ul, ok := s.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
+
+// setNonblock puts the open file description behind f back into non-blocking mode
+func setNonblock(f *os.File) {
+	if rc, err := f.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), true) })
+	}
+}
@@ -0,0 +1,129 @@
+//go:build !windows && !plan9
+
+package proxygo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// envUpgradeTestChild makes the test binary act as the upgraded process
+const envUpgradeTestChild = "PROXYGO_UPGRADE_TEST_CHILD"
+
+func TestBinaryUpgrade(t *testing.T) {
+	h := newTestHandler(t, `{}`)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "proxygo.sock")
+	unix, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []*listenerServer{
+		{cfg: ListenerConfig{Name: "web", Network: "tcp", Address: tcp.Addr().String()}, ln: tcp},
+		{cfg: ListenerConfig{Name: "local", Network: "unix", Address: socket}, ln: unix},
+	}
+
+	// The upgrade re-executes the test binary, which runs TestUpgradeChild only
+	t.Setenv(envUpgradeTestChild, "1")
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestUpgradeChild$"}
+	defer func() { os.Args = args }()
+
+	pid, err := h.upgrade(servers, nil)
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if pid == os.Getpid() {
+		t.Fatalf("upgrade reported this process")
+	}
+	// Draining closes the old process's listeners; the sockets stay open in the new one
+	tcp.Close()
+	unix.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("socket file removed by the old process: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		url    string
+	}{
+		{name: "tcp", client: http.DefaultClient, url: "http://" + servers[0].cfg.Address + "/"},
+		{
+			name: "unix",
+			client: &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", socket)
+			}}},
+			url: "http://localhost/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if want := fmt.Sprintf("upgraded %d", pid); string(body) != want {
+				t.Errorf("body %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+// TestUpgradeChild is the upgraded process of TestBinaryUpgrade: it serves every
+// inherited listener until each has answered one request
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv(envUpgradeTestChild) == "" {
+		t.Skip("runs as the child of TestBinaryUpgrade")
+	}
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "upgrade child:", err)
+		os.Exit(1)
+	}
+	if err := adoptInheritedListeners(); err != nil {
+		fail(err)
+	}
+	listeners := make([]net.Listener, 0, len(inheritedListeners))
+	for _, ln := range inheritedListeners {
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 0 {
+		fail(fmt.Errorf("no inherited listeners"))
+	}
+
+	answered := make(chan struct{}, len(listeners))
+	for _, ln := range listeners {
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "upgraded %d", os.Getpid())
+			answered <- struct{}{}
+		})}
+		go srv.Serve(ln)
+	}
+	if err := notifyUpgradeParent(); err != nil {
+		fail(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for range listeners {
+		select {
+		case <-answered:
+		case <-timeout:
+			fail(fmt.Errorf("not every listener was used"))
+		}
+	}
+	// Let the last response reach the client
+	time.Sleep(100 * time.Millisecond)
+	os.Exit(0)
+}
@@ -0,0 +1,323 @@
+package proxygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for upload tracking
+const (
+	defaultUploadMinSize  = 1 << 20
+	defaultUploadChunk    = 32 << 10
+	defaultUploadInterval = time.Second
+	defaultUploadStall    = 30 * time.Second
+)
+
+// Upload states in progress events and the admin API
+const (
+	uploadProgress   = "progress"
+	uploadStalled    = "stalled"
+	uploadSent       = "sent" // the whole body was forwarded and the upstream has yet to answer
+	uploadCompleted  = "completed"
+	uploadIncomplete = "incomplete" // the request ended before the whole body was forwarded
+)
+
+// UploadsConfig tracks large request bodies as they are forwarded. Bodies are read in
+// chunks of chunk_size and only as fast as the upstream accepts them, so a slow upstream
+// slows the client down through TCP flow control instead of the proxy buffering. Progress
+// is published to the dashboard event stream and as metrics, and uploads that stop moving
+// are reported as stalled.
+type UploadsConfig struct {
+	MinSize          ByteSize `json:"min_size"`          // bodies at least this large, or of unknown length, are tracked; default 1MB
+	ChunkSize        ByteSize `json:"chunk_size"`        // most bytes read from the client at once; default 32KB
+	ProgressInterval Duration `json:"progress_interval"` // how often progress is published; default 1s
+	StallTimeout     Duration `json:"stall_timeout"`     // an upload forwarding nothing for this long is stalled; default 30s
+}
+
+// uploadEvent is the progress of one upload, as published to the dashboard and listed by the admin API
+type uploadEvent struct {
+	ID       string    `json:"id"` // request ID
+	Time     time.Time `json:"time"`
+	State    string    `json:"state"`
+	Client   string    `json:"client"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Route    string    `json:"route,omitempty"`
+	Bytes    int64     `json:"bytes"`           // forwarded to the upstream so far
+	Total    int64     `json:"total,omitempty"` // declared length; absent for chunked bodies
+	Rate     float64   `json:"rate_bps"`        // bytes per second over the last interval
+	Duration float64   `json:"duration_ms"`
+}
+
+// uploadTracker follows the uploads in flight
+type uploadTracker struct {
+	minSize  int64
+	chunk    int
+	interval time.Duration
+	stall    time.Duration
+	logger   *log.Logger
+	feed     *trafficFeed // nil without the dashboard
+
+	mu     sync.Mutex
+	active map[*upload]struct{}
+
+	bytes    *metricVec
+	finished *metricVec
+}
+
+// upload is one tracked request body
+type upload struct {
+	id, client, method, host, path, route string
+	total                                 int64
+	start                                 time.Time
+
+	forwarded atomic.Int64
+	eof       atomic.Bool
+	done      sync.Once
+
+	// Owned by the tracker's mutex
+	lastBytes    int64
+	lastProgress time.Time
+	rate         float64
+	stalled      bool
+}
+
+// newUploadTracker returns nil when upload tracking is disabled
+func newUploadTracker(cfg *UploadsConfig, logger *log.Logger, feed *trafficFeed, metrics *metricsRegistry) (*uploadTracker, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.MinSize < 0 || cfg.ChunkSize < 0 || cfg.ProgressInterval < 0 || cfg.StallTimeout < 0 {
+		return nil, errors.New("uploads: sizes and durations must not be negative")
+	}
+	t := &uploadTracker{
+		minSize:  int64(cfg.MinSize),
+		chunk:    int(cfg.ChunkSize),
+		interval: time.Duration(cfg.ProgressInterval),
+		stall:    time.Duration(cfg.StallTimeout),
+		logger:   logger,
+		feed:     feed,
+		active:   make(map[*upload]struct{}),
+	}
+	if t.minSize == 0 {
+		t.minSize = defaultUploadMinSize
+	}
+	if t.chunk == 0 {
+		t.chunk = defaultUploadChunk
+	}
+	if t.interval == 0 {
+		t.interval = defaultUploadInterval
+	}
+	if t.stall == 0 {
+		t.stall = defaultUploadStall
+	}
+	if t.stall < t.interval {
+		return nil, fmt.Errorf("uploads: stall_timeout %s is shorter than progress_interval %s", t.stall, t.interval)
+	}
+
+	t.bytes = metrics.counter("proxygo_upload_bytes_total", "Bytes of tracked uploads forwarded to upstreams.", "route")
+	t.finished = metrics.counter("proxygo_uploads_total", "Tracked uploads that ended, by whether the whole body was forwarded.", "route", "result")
+	metrics.gaugeFunc("proxygo_uploads_active", "Tracked uploads in flight.", nil, func() []sample {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return []sample{{value: float64(len(t.active))}}
+	})
+	metrics.gaugeFunc("proxygo_uploads_stalled", "Tracked uploads in flight that forwarded nothing for stall_timeout.", nil, func() []sample {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		stalled := 0
+		for u := range t.active {
+			if u.stalled {
+				stalled++
+			}
+		}
+		return []sample{{value: float64(stalled)}}
+	})
+	return t, nil
+}
+
+// track starts following the body of r if it is large enough, replacing it with one that
+// counts what is forwarded. Call the returned func once the request is done.
+func (t *uploadTracker) track(r *http.Request, target *proxyTarget) func() {
+	if r.Body == nil || r.Body == http.NoBody || (r.ContentLength >= 0 && r.ContentLength < t.minSize) {
+		return func() {}
+	}
+	_, info := withRequestInfo(r)
+	now := time.Now()
+	u := &upload{
+		id:           info.RequestID,
+		client:       info.ClientID,
+		method:       r.Method,
+		host:         target.URL.Host,
+		path:         r.URL.Path,
+		route:        routeName(target),
+		total:        max(r.ContentLength, 0),
+		start:        now,
+		lastProgress: now,
+	}
+	t.mu.Lock()
+	t.active[u] = struct{}{}
+	t.mu.Unlock()
+
+	r.Body = &uploadReader{ReadCloser: r.Body, upload: u, tracker: t}
+	return func() { t.finish(u) }
+}
+
+// finish removes u from the uploads in flight and publishes how it ended
+func (t *uploadTracker) finish(u *upload) {
+	u.done.Do(func() {
+		t.mu.Lock()
+		delete(t.active, u)
+		ev := t.event(u, time.Now())
+		t.mu.Unlock()
+
+		ev.State = uploadIncomplete
+		if u.sent() {
+			ev.State = uploadCompleted
+		} else {
+			t.logger.Printf("Upload %s %s from %s ended after %dB of %s", u.method, u.path, u.client, ev.Bytes, uploadTotal(u))
+		}
+		t.finished.inc(u.route, ev.State)
+		t.publish(ev)
+	})
+}
+
+// event describes u; the caller holds t.mu
+func (t *uploadTracker) event(u *upload, now time.Time) uploadEvent {
+	state := uploadProgress
+	switch {
+	case u.sent():
+		state = uploadSent
+	case u.stalled:
+		state = uploadStalled
+	}
+	return uploadEvent{
+		ID:       u.id,
+		Time:     now,
+		State:    state,
+		Client:   u.client,
+		Method:   u.method,
+		Host:     u.host,
+		Path:     u.path,
+		Route:    u.route,
+		Bytes:    u.forwarded.Load(),
+		Total:    u.total,
+		Rate:     u.rate,
+		Duration: float64(now.Sub(u.start).Microseconds()) / 1000,
+	}
+}
+
+// publish hands ev to the dashboard, if it is enabled
+func (t *uploadTracker) publish(ev uploadEvent) {
+	if t.feed != nil {
+		t.feed.publishUpload(ev)
+	}
+}
+
+// run publishes the progress of every upload in flight each interval until ctx is done
+func (t *uploadTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, ev := range t.tick(now) {
+				t.publish(ev)
+			}
+		}
+	}
+}
+
+// tick updates the rate and stall state of every upload in flight
+func (t *uploadTracker) tick(now time.Time) []uploadEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := make([]uploadEvent, 0, len(t.active))
+	for u := range t.active {
+		forwarded := u.forwarded.Load()
+		u.rate = float64(forwarded-u.lastBytes) / t.interval.Seconds()
+		if forwarded > u.lastBytes {
+			if u.stalled {
+				t.logger.Printf("Upload %s %s from %s resumed at %dB", u.method, u.path, u.client, forwarded)
+			}
+			u.lastProgress, u.stalled = now, false
+		} else if !u.stalled && !u.sent() && now.Sub(u.lastProgress) >= t.stall {
+			u.stalled = true
+			t.logger.Printf("Upload %s %s from %s stalled at %dB of %s", u.method, u.path, u.client, forwarded, uploadTotal(u))
+		}
+		u.lastBytes = forwarded
+		events = append(events, t.event(u, now))
+	}
+	return events
+}
+
+// snapshot lists the uploads in flight, oldest first
+func (t *uploadTracker) snapshot() []uploadEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	out := make([]uploadEvent, 0, len(t.active))
+	for u := range t.active {
+		out = append(out, t.event(u, now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Duration > out[j].Duration })
+	return out
+}
+
+// sent reports whether the whole body of u was forwarded
+func (u *upload) sent() bool {
+	return u.eof.Load() || u.total > 0 && u.forwarded.Load() >= u.total
+}
+
+// uploadTotal formats the declared length of an upload for log lines
+func uploadTotal(u *upload) string {
+	if u.total == 0 {
+		return "unknown length"
+	}
+	return fmt.Sprintf("%dB", u.total)
+}
+
+// uploadReader counts the bytes of a tracked body as the transport forwards them. Reads
+// are capped at the chunk size; the transport only reads again once the upstream took
+// the previous chunk.
+type uploadReader struct {
+	io.ReadCloser
+	upload  *upload
+	tracker *uploadTracker
+}
+
+// Read implements io.Reader
+func (r *uploadReader) Read(p []byte) (int, error) {
+	if len(p) > r.tracker.chunk {
+		p = p[:r.tracker.chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.upload.forwarded.Add(int64(n))
+		r.tracker.bytes.add(float64(n), r.upload.route)
+	}
+	if err == io.EOF {
+		r.upload.eof.Store(true)
+	}
+	return n, err
+}
+
+// listUploads handles GET /uploads
+func (a *adminAPI) listUploads(w http.ResponseWriter, r *http.Request) {
+	if a.proxy.uploads == nil {
+		writeJSONError(w, http.StatusNotFound, "uploads_disabled", "set uploads to track uploads")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.uploads.snapshot())
+}
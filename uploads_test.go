@@ -0,0 +1,236 @@
+package proxygo
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadSettings are the settings of an uploadTracker
+type uploadSettings struct {
+	minSize         int64
+	chunk           int
+	interval, stall time.Duration
+}
+
+func TestUploadsConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  UploadsConfig
+		want uploadSettings
+		err  string
+	}{
+		{name: "defaults", want: uploadSettings{minSize: defaultUploadMinSize, chunk: defaultUploadChunk, interval: defaultUploadInterval, stall: defaultUploadStall}},
+		{name: "set", cfg: UploadsConfig{MinSize: 1024, ChunkSize: 512, ProgressInterval: Duration(time.Second), StallTimeout: Duration(time.Second)},
+			want: uploadSettings{minSize: 1024, chunk: 512, interval: time.Second, stall: time.Second}},
+		{name: "negative", cfg: UploadsConfig{ChunkSize: -1}, err: "uploads: sizes and durations must not be negative"},
+		{name: "stall shorter than the interval", cfg: UploadsConfig{ProgressInterval: Duration(time.Minute)}, err: "uploads: stall_timeout 30s is shorter than progress_interval 1m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, err := newUploadTracker(&tt.cfg, log.New(io.Discard, "", 0), nil, newMetricsRegistry())
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("newUploadTracker: %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := uploadSettings{minSize: tracker.minSize, chunk: tracker.chunk, interval: tracker.interval, stall: tracker.stall}
+			if got != tt.want {
+				t.Errorf("settings %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if tracker, err := newUploadTracker(nil, nil, nil, newMetricsRegistry()); tracker != nil || err != nil {
+		t.Errorf("newUploadTracker(nil) = %v, %v", tracker, err)
+	}
+}
+
+func TestUploadTrack(t *testing.T) {
+	tracker, err := newUploadTracker(&UploadsConfig{MinSize: 100, ChunkSize: 10}, log.New(io.Discard, "", 0), nil, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &proxyTarget{URL: &url.URL{Scheme: "http", Host: "api.internal"}, Route: &Route{Name: "api"}}
+
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		read    int // bytes the transport reads before the request ends; -1 for all
+		tracked bool
+		result  string
+	}{
+		{name: "small", body: strings.Repeat("x", 99), read: -1},
+		{name: "empty chunked", chunked: true, read: -1},
+		{name: "large", body: strings.Repeat("x", 100), read: -1, tracked: true, result: uploadCompleted},
+		{name: "chunked", body: strings.Repeat("x", 20), chunked: true, read: -1, tracked: true, result: uploadCompleted},
+		{name: "cut short", body: strings.Repeat("x", 150), read: 40, tracked: true, result: uploadIncomplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/files", strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			if tt.body == "" {
+				r.Body = http.NoBody
+			}
+			forwarded := tracker.bytes.value("api")
+			finished := tracker.finished.value("api", tt.result)
+			done := tracker.track(r, target)
+			if got := len(tracker.snapshot()); (got != 0) != tt.tracked {
+				t.Fatalf("%d uploads in flight", got)
+			}
+
+			buf := make([]byte, 64)
+			read := 0
+			for tt.read < 0 || read < tt.read {
+				n, err := r.Body.Read(buf)
+				if tt.tracked && n > 10 {
+					t.Fatalf("read %d bytes at once, more than the chunk size", n)
+				}
+				read += n
+				if err != nil {
+					break
+				}
+			}
+			done()
+			done() // a second call does nothing
+
+			if len(tracker.snapshot()) != 0 {
+				t.Errorf("uploads still in flight: %+v", tracker.snapshot())
+			}
+			if !tt.tracked {
+				return
+			}
+			if got := tracker.bytes.value("api") - forwarded; got != float64(read) {
+				t.Errorf("%v bytes counted, want %d", got, read)
+			}
+			if got := tracker.finished.value("api", tt.result) - finished; got != 1 {
+				t.Errorf("%v uploads counted as %s, want 1", got, tt.result)
+			}
+		})
+	}
+}
+
+func TestUploadTick(t *testing.T) {
+	tracker, err := newUploadTracker(&UploadsConfig{MinSize: 1, ChunkSize: 10, ProgressInterval: Duration(time.Second), StallTimeout: Duration(3 * time.Second)},
+		log.New(io.Discard, "", 0), nil, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 100)))
+	defer tracker.track(r, &proxyTarget{URL: &url.URL{Scheme: "http", Host: "api.internal"}})()
+	start := time.Now()
+
+	tests := []struct {
+		at    time.Duration
+		read  int // bytes forwarded since the last tick
+		state string
+		bytes int64
+		rate  float64
+	}{
+		{at: time.Second, read: 30, state: uploadProgress, bytes: 30, rate: 30},
+		{at: 2 * time.Second, state: uploadProgress, bytes: 30},
+		{at: 4 * time.Second, state: uploadStalled, bytes: 30},
+		{at: 5 * time.Second, read: 20, state: uploadProgress, bytes: 50, rate: 20},
+		{at: 6 * time.Second, read: 50, state: uploadSent, bytes: 100, rate: 50},
+		{at: 20 * time.Second, state: uploadSent, bytes: 100},
+	}
+	buf := make([]byte, 10)
+	for _, tt := range tests {
+		for range tt.read / 10 {
+			if _, err := r.Body.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		events := tracker.tick(start.Add(tt.at))
+		if len(events) != 1 {
+			t.Fatalf("at %s: %d events, want 1", tt.at, len(events))
+		}
+		ev := events[0]
+		if ev.State != tt.state || ev.Bytes != tt.bytes || ev.Rate != tt.rate || ev.Total != 100 || ev.Path != "/upload" || ev.Host != "api.internal" {
+			t.Errorf("at %s: %+v, want %s at %dB and %vB/s", tt.at, ev, tt.state, tt.bytes, tt.rate)
+		}
+	}
+}
+
+func TestUploadsAdmin(t *testing.T) {
+	received := make(chan int, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		received <- len(body)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		config string
+		status int
+	}{
+		{name: "disabled", status: http.StatusNotFound},
+		{name: "enabled", config: `"uploads": {"min_size": "1KB"},`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, `{`+tt.config+`
+				"admin": {"address": "127.0.0.1:0", "token": "secret"},
+				"routes": [{"name": "files", "prefix": "/files/", "upstream": "`+upstream.URL+`"}]}`)
+			admin := newAdminAPI(h, h.config.Load().Admin)
+			list := func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, "/uploads", nil)
+				r.Header.Set("Authorization", "Bearer secret")
+				w := httptest.NewRecorder()
+				admin.ServeHTTP(w, r)
+				return w
+			}
+			if w := list(); w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			proxied := make(chan int, 1)
+			go func() {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/files/big.bin", strings.NewReader(strings.Repeat("x", 4096))))
+				proxied <- w.Code
+			}()
+			var uploads []uploadEvent
+			waitUntil(t, "the upload to be listed", func() bool {
+				uploads = nil
+				json.Unmarshal(list().Body.Bytes(), &uploads)
+				return len(uploads) == 1
+			})
+			if got := uploads[0]; got.Method != http.MethodPut || got.Path != "/files/big.bin" || got.Route != "files" || got.Total != 4096 || got.ID == "" {
+				t.Errorf("listed %+v", got)
+			}
+			close(release)
+			if n := <-received; n != 4096 {
+				t.Errorf("upstream received %dB", n)
+			}
+			if code := <-proxied; code != http.StatusOK {
+				t.Errorf("upload answered %d", code)
+			}
+			if got := h.uploads.finished.value("files", uploadCompleted); got != 1 {
+				t.Errorf("%v completed uploads", got)
+			}
+			if w := list(); strings.TrimSpace(w.Body.String()) != "[]" {
+				t.Errorf("still listed: %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package proxygo
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultTLSSessionCache is how many upstream TLS sessions are kept for resumption
+const defaultTLSSessionCache = 256
+
+// hostTLSStats counts the TLS handshakes made to one upstream address
+type hostTLSStats struct {
+	full    int64
+	resumed int64
+	failed  int64
+	seconds float64 // time spent in successful handshakes
+}
+
+// tlsStats tracks upstream TLS handshakes per address ("host:port"). Unlike poolStats
+// it keeps hosts after their connections close, as its numbers are counters.
+type tlsStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostTLSStats
+}
+
+// newTLSStats creates empty stats
+func newTLSStats() *tlsStats {
+	return &tlsStats{hosts: make(map[string]*hostTLSStats)}
+}
+
+// record counts one handshake to host
+func (s *tlsStats) record(host string, resumed bool, took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs, ok := s.hosts[host]
+	if !ok {
+		hs = &hostTLSStats{}
+		s.hosts[host] = hs
+	}
+	switch {
+	case err != nil:
+		hs.failed++
+		return
+	case resumed:
+		hs.resumed++
+	default:
+		hs.full++
+	}
+	hs.seconds += took.Seconds()
+}
+
+// upstreamTLSStats is the per-host view served by the admin API
+type upstreamTLSStats struct {
+	Host            string  `json:"host"`
+	Handshakes      int64   `json:"handshakes"` // successful ones, full and resumed
+	Resumed         int64   `json:"resumed"`
+	Failed          int64   `json:"failed"`
+	ResumptionRatio float64 `json:"resumption_ratio"` // resumed share of the successful handshakes
+	AvgHandshakeMs  float64 `json:"avg_handshake_ms"`
+}
+
+// snapshot reports every host that was handshaken with
+func (s *tlsStats) snapshot() []upstreamTLSStats {
+	s.mu.Lock()
+	out := make([]upstreamTLSStats, 0, len(s.hosts))
+	for host, hs := range s.hosts {
+		st := upstreamTLSStats{Host: host, Handshakes: hs.full + hs.resumed, Resumed: hs.resumed, Failed: hs.failed}
+		if st.Handshakes > 0 {
+			st.ResumptionRatio = float64(hs.resumed) / float64(st.Handshakes)
+			st.AvgHandshakeMs = hs.seconds * 1000 / float64(st.Handshakes)
+		}
+		out = append(out, st)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// handshakeSamples exposes the handshake counts by host and outcome
+func (s *tlsStats) handshakeSamples() []sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []sample
+	for host, hs := range s.hosts {
+		out = append(out,
+			sample{labels: []string{host, "full"}, value: float64(hs.full)},
+			sample{labels: []string{host, "resumed"}, value: float64(hs.resumed)},
+			sample{labels: []string{host, "failed"}, value: float64(hs.failed)})
+	}
+	return out
+}
+
+// secondsSamples exposes the time spent in successful handshakes by host
+func (s *tlsStats) secondsSamples() []sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []sample
+	for host, hs := range s.hosts {
+		out = append(out, sample{labels: []string{host}, value: hs.seconds})
+	}
+	return out
+}
+
+// ratioSamples exposes the resumption ratio by host
+func (s *tlsStats) ratioSamples() []sample {
+	var out []sample
+	for _, st := range s.snapshot() {
+		if st.Handshakes > 0 {
+			out = append(out, sample{labels: []string{st.Host}, value: st.ResumptionRatio})
+		}
+	}
+	return out
+}
+
+// sessionCache returns the client session cache for the settings, keeping the current
+// one while its size is unchanged so a retune does not throw the sessions away; callers
+// hold p.mu or own p exclusively
+func (p *transportPool) sessionCache() tls.ClientSessionCache {
+	size := p.settings.TLSSessionCache
+	if size == 0 {
+		size = defaultTLSSessionCache
+	}
+	if size < 0 {
+		p.sessions, p.sessionsSize = nil, 0
+		return nil
+	}
+	if p.sessions == nil || p.sessionsSize != size {
+		p.sessions, p.sessionsSize = tls.NewLRUClientSessionCache(size), size
+	}
+	return p.sessions
+}
+
+// dialTLS returns a DialTLSContext that handshakes itself so every handshake can be
+// timed and checked for resumption. nextProtos is the ALPN offer of the transport.
+func (p *transportPool) dialTLS(config *tls.Config, timeout time.Duration, nextProtos []string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := p.stats.track(address)(p.dialer.DialContext(ctx, network, address))
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cfg := config.Clone()
+		cfg.ServerName = host
+		cfg.NextProtos = nextProtos
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		tc := tls.Client(conn, cfg)
+		start := time.Now()
+		err = tc.HandshakeContext(ctx)
+		p.tls.record(address, tc.ConnectionState().DidResume, time.Since(start), err)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
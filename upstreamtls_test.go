@@ -0,0 +1,109 @@
+package proxygo
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamTLSResumption(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	host := upstream.Listener.Addr().String()
+
+	tests := []struct {
+		name    string
+		pool    PoolConfig
+		trusted bool
+		want    upstreamTLSStats
+	}{
+		{name: "resumed", trusted: true, want: upstreamTLSStats{Host: host, Handshakes: 4, Resumed: 3, ResumptionRatio: 0.75}},
+		{name: "cache disabled", pool: PoolConfig{TLSSessionCache: -1}, trusted: true, want: upstreamTLSStats{Host: host, Handshakes: 4}},
+		{name: "untrusted", want: upstreamTLSStats{Host: host, Failed: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTransportPool(nil, &tt.pool)
+			if tt.trusted {
+				// The TLS dialer handshakes with a clone of the transport's config
+				p.tcp.TLSClientConfig.RootCAs = roots
+			}
+			client := &http.Client{Transport: p.tcp}
+			for range 4 {
+				resp, err := client.Get(upstream.URL)
+				if err != nil {
+					if tt.trusted {
+						t.Fatal(err)
+					}
+					continue
+				}
+				proto, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(proto) != "HTTP/2.0" {
+					t.Errorf("upstream spoke %s, want HTTP/2.0", proto)
+				}
+				// Every request needs a new connection, and so a handshake
+				p.tcp.CloseIdleConnections()
+			}
+
+			stats := p.tls.snapshot()
+			if len(stats) != 1 {
+				t.Fatalf("stats for %d hosts, want 1", len(stats))
+			}
+			got := stats[0]
+			if got.Handshakes > 0 && got.AvgHandshakeMs <= 0 {
+				t.Errorf("average handshake %vms", got.AvgHandshakeMs)
+			}
+			got.AvgHandshakeMs = 0
+			if got != tt.want {
+				t.Errorf("stats %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSSessionCacheRetune(t *testing.T) {
+	p := newTransportPool(nil, nil)
+	cache := p.sessions
+	if cache == nil || p.sessionsSize != defaultTLSSessionCache {
+		t.Fatalf("session cache of %d, want %d", p.sessionsSize, defaultTLSSessionCache)
+	}
+
+	tests := []struct {
+		name  string
+		size  int
+		kept  bool // the same cache carries on
+		empty bool // resumption is off
+	}{
+		{name: "other settings", size: 0, kept: true},
+		{name: "same size", size: defaultTLSSessionCache, kept: true},
+		{name: "resized", size: 16},
+		{name: "disabled", size: -1, empty: true},
+		{name: "enabled again", size: 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := p.sessions
+			p.tune(PoolConfig{MaxIdleConnsPerHost: 4, TLSSessionCache: tt.size})
+			if kept := p.sessions == before; kept != tt.kept {
+				t.Errorf("cache kept: %v, want %v", kept, tt.kept)
+			}
+			if (p.sessions == nil) != tt.empty {
+				t.Errorf("cache %v, want disabled %v", p.sessions, tt.empty)
+			}
+			for _, tr := range []*http.Transport{p.tcp, p.grpc, p.grpcTLS} {
+				if tr.TLSClientConfig.ClientSessionCache != p.sessions {
+					t.Error("a transport does not share the pool's session cache")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package proxygo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageFlushInterval is how often usage buckets are persisted
+const usageFlushInterval = 30 * time.Second
+
+// defaultUsageRetentionDays bounds how much history the usage file keeps
+const defaultUsageRetentionDays = 90
+
+// UsageConfig enables persistent per-client and per-upstream usage accounting
+type UsageConfig struct {
+	File          string `json:"file"`
+	RetentionDays int    `json:"retention_days"` // default 90
+}
+
+// usageCounters accumulates traffic for one client or upstream
+type usageCounters struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`  // request bodies received from clients
+	BytesOut int64 `json:"bytes_out"` // response bodies sent to clients
+}
+
+// add folds other into c
+func (c *usageCounters) add(other usageCounters) {
+	c.Requests += other.Requests
+	c.BytesIn += other.BytesIn
+	c.BytesOut += other.BytesOut
+}
+
+// usageBucket holds one hour of traffic
+type usageBucket struct {
+	Hour      time.Time                 `json:"hour"`
+	Clients   map[string]*usageCounters `json:"clients"`
+	Upstreams map[string]*usageCounters `json:"upstreams"`
+	Tenants   map[string]*usageCounters `json:"tenants,omitempty"`
+}
+
+// usageTracker records traffic in hourly buckets and persists them to a JSON file
+type usageTracker struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	buckets map[int64]*usageBucket // keyed by the hour's unix time
+	dirty   bool
+}
+
+// openUsageTracker loads the usage file, returning nil when accounting is disabled
+func openUsageTracker(cfg *UsageConfig) (*usageTracker, error) {
+	if cfg == nil || cfg.File == "" {
+		return nil, nil
+	}
+
+	days := cfg.RetentionDays
+	if days <= 0 {
+		days = defaultUsageRetentionDays
+	}
+	t := &usageTracker{
+		path:      cfg.File,
+		retention: time.Duration(days) * 24 * time.Hour,
+		buckets:   make(map[int64]*usageBucket),
+	}
+
+	buckets, err := readUsageFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		t.buckets[b.Hour.Unix()] = b
+	}
+	return t, nil
+}
+
+// readUsageFile loads the persisted buckets; a missing file is empty history
+func readUsageFile(path string) ([]*usageBucket, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+
+	var buckets []*usageBucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to parse usage file: %w", err)
+	}
+	return buckets, nil
+}
+
+// record adds one finished request to the current hour; tenant is "" outside multi-tenant setups
+func (t *usageTracker) record(client, upstream, tenant string, bytesIn, bytesOut int64) {
+	hour := time.Now().UTC().Truncate(time.Hour)
+	delta := usageCounters{Requests: 1, BytesIn: bytesIn, BytesOut: bytesOut}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.buckets[hour.Unix()]
+	if !ok {
+		b = &usageBucket{Hour: hour, Clients: map[string]*usageCounters{}, Upstreams: map[string]*usageCounters{}}
+		t.buckets[hour.Unix()] = b
+	}
+	addCounters(b.Clients, client, delta)
+	addCounters(b.Upstreams, upstream, delta)
+	if tenant != "" {
+		// Buckets written before tenants existed have no map
+		if b.Tenants == nil {
+			b.Tenants = map[string]*usageCounters{}
+		}
+		addCounters(b.Tenants, tenant, delta)
+	}
+	t.dirty = true
+}
+
+// addCounters adds delta to m[name], creating the entry
+func addCounters(m map[string]*usageCounters, name string, delta usageCounters) {
+	c, ok := m[name]
+	if !ok {
+		c = &usageCounters{}
+		m[name] = c
+	}
+	c.add(delta)
+}
+
+// flush drops expired buckets and persists the rest if anything changed
+func (t *usageTracker) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.retention)
+	for key, b := range t.buckets {
+		if b.Hour.Before(cutoff) {
+			delete(t.buckets, key)
+			t.dirty = true
+		}
+	}
+	if !t.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(t.sortedBuckets())
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(t.path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	t.dirty = false
+	return nil
+}
+
+// sortedBuckets returns the buckets oldest first; callers hold t.mu
+func (t *usageTracker) sortedBuckets() []*usageBucket {
+	out := make([]*usageBucket, 0, len(t.buckets))
+	for _, b := range t.buckets {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hour.Before(out[j].Hour) })
+	return out
+}
+
+// run periodically flushes usage until ctx is done
+func (t *usageTracker) run(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.flush(); err != nil {
+				logger.Printf("Usage flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// report summarises the in-memory buckets between from and to
+func (t *usageTracker) report(from, to time.Time) *usageReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return buildUsageReport(t.sortedBuckets(), from, to)
+}
+
+// usageRow is one line of a usage report
+type usageRow struct {
+	Name string `json:"name"`
+	usageCounters
+}
+
+// usageReport totals usage per client, per upstream and per tenant over a time range
+type usageReport struct {
+	From      time.Time  `json:"from"`
+	To        time.Time  `json:"to"`
+	Total     usageRow   `json:"total"`
+	Clients   []usageRow `json:"clients"`
+	Upstreams []usageRow `json:"upstreams"`
+	Tenants   []usageRow `json:"tenants,omitempty"`
+}
+
+// buildUsageReport sums the hourly buckets that start within [from, to)
+func buildUsageReport(buckets []*usageBucket, from, to time.Time) *usageReport {
+	clients := map[string]*usageCounters{}
+	upstreams := map[string]*usageCounters{}
+	tenants := map[string]*usageCounters{}
+	report := &usageReport{From: from, To: to, Total: usageRow{Name: "total"}}
+
+	for _, b := range buckets {
+		if b.Hour.Before(from.Truncate(time.Hour)) || !b.Hour.Before(to) {
+			continue
+		}
+		for name, c := range b.Clients {
+			addCounters(clients, name, *c)
+			report.Total.add(*c)
+		}
+		for name, c := range b.Upstreams {
+			addCounters(upstreams, name, *c)
+		}
+		for name, c := range b.Tenants {
+			addCounters(tenants, name, *c)
+		}
+	}
+
+	report.Clients = usageRows(clients)
+	report.Upstreams = usageRows(upstreams)
+	if len(tenants) > 0 {
+		report.Tenants = usageRows(tenants)
+	}
+	return report
+}
+
+// usageRows turns a counter map into rows sorted by bytes sent, largest first
+func usageRows(m map[string]*usageCounters) []usageRow {
+	rows := make([]usageRow, 0, len(m))
+	for name, c := range m {
+		rows = append(rows, usageRow{Name: name, usageCounters: *c})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].BytesOut != rows[j].BytesOut {
+			return rows[i].BytesOut > rows[j].BytesOut
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	return rows
+}
+
+// parseReportRange reads from/to values, accepting RFC 3339 timestamps or plain dates.
+// The defaults cover the last 24 hours.
+func parseReportRange(fromValue, toValue string) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	from = to.Add(-24 * time.Hour)
+
+	parse := func(v string) (time.Time, error) {
+		if ts, err := time.Parse(time.RFC3339, v); err == nil {
+			return ts, nil
+		}
+		return time.Parse(time.DateOnly, v)
+	}
+
+	if fromValue != "" {
+		if from, err = parse(fromValue); err != nil {
+			return from, to, fmt.Errorf("invalid from %q: expected RFC 3339 or YYYY-MM-DD", fromValue)
+		}
+	}
+	if toValue != "" {
+		if to, err = parse(toValue); err != nil {
+			return from, to, fmt.Errorf("invalid to %q: expected RFC 3339 or YYYY-MM-DD", toValue)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// handleUsage serves GET /usage?from=...&to=... on the admin API
+func (a *adminAPI) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if a.proxy.usage == nil {
+		writeJSONError(w, http.StatusNotFound, "usage_disabled", "usage is not configured")
+		return
+	}
+
+	from, to, err := parseReportRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_range", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.usage.report(from, to))
+}
@@ -0,0 +1,174 @@
+package proxygo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageRecorded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "0123456789")
+	}))
+	defer upstream.Close()
+	file := filepath.Join(t.TempDir(), "usage.json")
+	h := newTestHandler(t, `{"usage": {"file": "`+file+`"},
+		"routes": [{"name": "api", "prefix": "/api/", "upstream": "`+upstream.URL+`"}]}`)
+
+	send := func(client, body string) {
+		r := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader(body))
+		r.RemoteAddr = client + ":1234"
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	send("192.0.2.1", "hello")
+	send("192.0.2.1", "")
+	send("192.0.2.2", "hi")
+	if err := h.usage.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The report is built from what was persisted
+	reopened, err := openUsageTracker(&UsageConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	report := reopened.report(now.Add(-time.Hour), now.Add(time.Hour))
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	want := []struct {
+		rows []usageRow
+		name string
+		want usageCounters
+	}{
+		{rows: []usageRow{report.Total}, name: "total", want: usageCounters{Requests: 3, BytesIn: 7, BytesOut: 30}},
+		{rows: report.Clients, name: "192.0.2.1", want: usageCounters{Requests: 2, BytesIn: 5, BytesOut: 20}},
+		{rows: report.Clients, name: "192.0.2.2", want: usageCounters{Requests: 1, BytesIn: 2, BytesOut: 10}},
+		{rows: report.Upstreams, name: host, want: usageCounters{Requests: 3, BytesIn: 7, BytesOut: 30}},
+	}
+	for _, tt := range want {
+		found := false
+		for _, row := range tt.rows {
+			if row.Name == tt.name {
+				found = true
+				if row.usageCounters != tt.want {
+					t.Errorf("%s: %+v, want %+v", tt.name, row.usageCounters, tt.want)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: no row in %+v", tt.name, tt.rows)
+		}
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	hour := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	bucket := func(at time.Time, client string, out int64, tenant string) *usageBucket {
+		c := &usageCounters{Requests: 1, BytesIn: 1, BytesOut: out}
+		b := &usageBucket{Hour: at, Clients: map[string]*usageCounters{client: c}, Upstreams: map[string]*usageCounters{"api": c}}
+		if tenant != "" {
+			b.Tenants = map[string]*usageCounters{tenant: c}
+		}
+		return b
+	}
+	buckets := []*usageBucket{
+		bucket(hour.Add(-2*time.Hour), "a", 10, ""),
+		bucket(hour, "b", 30, "acme"),
+		bucket(hour.Add(time.Hour), "a", 20, "acme"),
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		total    usageCounters
+		clients  string // names, largest first
+		tenants  string
+	}{
+		{name: "all", from: hour.Add(-24 * time.Hour), to: hour.Add(24 * time.Hour), total: usageCounters{3, 3, 60}, clients: "a b", tenants: "acme"},
+		{name: "from mid-hour includes that hour", from: hour.Add(30 * time.Minute), to: hour.Add(24 * time.Hour), total: usageCounters{2, 2, 50}, clients: "b a", tenants: "acme"},
+		{name: "to is exclusive", from: hour.Add(-24 * time.Hour), to: hour, total: usageCounters{1, 1, 10}, clients: "a"},
+		{name: "empty", from: hour.Add(24 * time.Hour), to: hour.Add(48 * time.Hour), total: usageCounters{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := buildUsageReport(buckets, tt.from, tt.to)
+			if report.Total.usageCounters != tt.total {
+				t.Errorf("total %+v, want %+v", report.Total.usageCounters, tt.total)
+			}
+			if got := usageRowNames(report.Clients); got != tt.clients {
+				t.Errorf("clients %q, want %q", got, tt.clients)
+			}
+			if got := usageRowNames(report.Tenants); got != tt.tenants {
+				t.Errorf("tenants %q, want %q", got, tt.tenants)
+			}
+		})
+	}
+}
+
+// usageRowNames lists the names of rows in order
+func usageRowNames(rows []usageRow) string {
+	var names []string
+	for _, row := range rows {
+		names = append(names, row.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestUsageRetention(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	u, err := openUsageTracker(&UsageConfig{File: file, RetentionDays: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Hour)
+	u.buckets[old.Unix()] = &usageBucket{Hour: old, Clients: map[string]*usageCounters{"a": {Requests: 1}}}
+	u.record("a", "api", "", 0, 0)
+	if err := u.flush(); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := readUsageFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || !buckets[0].Hour.After(old) {
+		t.Errorf("%d bucket(s) kept, want only the current hour", len(buckets))
+	}
+}
+
+func TestParseReportRange(t *testing.T) {
+	tests := []struct {
+		from, to string
+		wantFrom string
+		wantTo   string
+		err      bool
+	}{
+		{from: "2026-03-01", to: "2026-03-02", wantFrom: "2026-03-01T00:00:00Z", wantTo: "2026-03-02T00:00:00Z"},
+		{from: "2026-03-01T10:00:00+02:00", to: "2026-03-01T12:00:00Z", wantFrom: "2026-03-01T10:00:00+02:00", wantTo: "2026-03-01T12:00:00Z"},
+		{from: "2026-03-02", to: "2026-03-01", err: true},
+		{from: "2026-03-01", to: "2026-03-01", err: true},
+		{from: "yesterday", err: true},
+		{from: "2026-03-01", to: "03/02/2026", err: true},
+	}
+	for _, tt := range tests {
+		from, to, err := parseReportRange(tt.from, tt.to)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseReportRange(%q, %q) accepted", tt.from, tt.to)
+			}
+			continue
+		}
+		if err != nil || from.Format(time.RFC3339) != tt.wantFrom || to.Format(time.RFC3339) != tt.wantTo {
+			t.Errorf("parseReportRange(%q, %q) = %v, %v, %v", tt.from, tt.to, from, to, err)
+		}
+	}
+
+	// Both default to the last day
+	from, to, err := parseReportRange("", "")
+	if err != nil || to.Sub(from) != 24*time.Hour || time.Since(to) > time.Minute {
+		t.Errorf("default range %v to %v, %v", from, to, err)
+	}
+}
@@ -0,0 +1,336 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultValidationMaxBody bounds the request bodies buffered for validation
+	defaultValidationMaxBody = 1 << 20
+	// schemaReloadInterval is how often schema files are checked for changes
+	schemaReloadInterval = 2 * time.Second
+	// maxReportedProblems limits how many violations a 422 response lists
+	maxReportedProblems = 5
+)
+
+// ValidationConfig checks JSON request bodies on a route before they reach the upstream.
+// Exactly one of Schema and OpenAPI is set; both files are reloaded when they change.
+type ValidationConfig struct {
+	Schema  string   `json:"schema"`   // JSON Schema file applied to every JSON request body
+	OpenAPI string   `json:"openapi"`  // OpenAPI 3 document in JSON; each operation's requestBody schema applies
+	MaxBody ByteSize `json:"max_body"` // larger bodies are rejected with 413; default 1MB
+}
+
+// bodyValidator holds the current compiled spec for one route
+type bodyValidator struct {
+	file    string
+	openAPI bool
+	maxBody int64
+
+	mu        sync.RWMutex
+	spec      *validationSpec
+	modTime   time.Time
+	failedMod time.Time // version that last failed to load, so it is reported once
+}
+
+// validationSpec is a loaded schema file or OpenAPI document
+type validationSpec struct {
+	schema     *jsonSchema     // plain JSON Schema mode
+	operations []*apiOperation // OpenAPI mode
+	basePath   string          // path of the first OpenAPI server URL
+}
+
+// apiOperation is an OpenAPI operation with a request body
+type apiOperation struct {
+	method   string
+	segments []string // path template split on "/", with "{param}" segments
+	required bool
+	schemas  map[string]*jsonSchema // by media type
+}
+
+// newBodyValidator loads the route's spec, returning nil when validation is disabled
+func newBodyValidator(cfg *ValidationConfig) (*bodyValidator, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if (cfg.Schema == "") == (cfg.OpenAPI == "") {
+		return nil, errors.New("validation: set exactly one of schema and openapi")
+	}
+	v := &bodyValidator{file: cfg.Schema, maxBody: int64(cfg.MaxBody)}
+	if cfg.OpenAPI != "" {
+		v.file, v.openAPI = cfg.OpenAPI, true
+	}
+	if v.maxBody <= 0 {
+		v.maxBody = defaultValidationMaxBody
+	}
+	if _, err := v.reload(); err != nil {
+		return nil, fmt.Errorf("validation: %w", err)
+	}
+	return v, nil
+}
+
+// reload re-reads the spec file when its modification time changed, reporting
+// whether a new spec was installed
+func (v *bodyValidator) reload() (bool, error) {
+	info, err := os.Stat(v.file)
+	if err != nil {
+		return false, err
+	}
+	v.mu.RLock()
+	unchanged := v.spec != nil && (info.ModTime().Equal(v.modTime) || info.ModTime().Equal(v.failedMod))
+	v.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(v.file)
+	if err != nil {
+		return false, err
+	}
+	var spec *validationSpec
+	if v.openAPI {
+		spec, err = loadOpenAPI(data)
+	} else {
+		spec, err = loadJSONSchema(data)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err != nil {
+		v.failedMod = info.ModTime()
+		return false, fmt.Errorf("%s: %w", v.file, err)
+	}
+	v.spec, v.modTime = spec, info.ModTime()
+	return true, nil
+}
+
+// loadJSONSchema compiles a standalone schema document
+func loadJSONSchema(data []byte) (*validationSpec, error) {
+	doc, err := decodeJSONDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := compileSchema(doc, doc)
+	if err != nil {
+		return nil, err
+	}
+	return &validationSpec{schema: schema}, nil
+}
+
+// loadOpenAPI compiles the request body schemas of every operation in the document
+func loadOpenAPI(data []byte) (*validationSpec, error) {
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("expected an OpenAPI 3 document, got version %q", doc.OpenAPI)
+	}
+	root, err := decodeJSONDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &validationSpec{}
+	if len(doc.Servers) > 0 {
+		if u, err := url.Parse(doc.Servers[0].URL); err == nil {
+			spec.basePath = strings.TrimSuffix(u.Path, "/")
+		}
+	}
+
+	paths, _ := root.(map[string]any)["paths"].(map[string]any)
+	for template, item := range paths {
+		methods, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		for method, op := range methods {
+			opMap, ok := op.(map[string]any)
+			if !ok {
+				continue
+			}
+			body, ok := opMap["requestBody"].(map[string]any)
+			if !ok {
+				continue
+			}
+			// Request bodies are commonly shared through components
+			if ref, ok := body["$ref"].(string); ok {
+				resolved, err := (&jsonSchema{root: root}).resolve(ref)
+				if body, ok = resolved.(map[string]any); err != nil || !ok {
+					return nil, fmt.Errorf("%s %s: requestBody $ref %q does not resolve", method, template, ref)
+				}
+			}
+
+			operation := &apiOperation{
+				method:   strings.ToUpper(method),
+				segments: strings.Split(strings.Trim(template, "/"), "/"),
+				required: body["required"] == true,
+				schemas:  make(map[string]*jsonSchema),
+			}
+			content, _ := body["content"].(map[string]any)
+			for mediaType, media := range content {
+				mediaMap, _ := media.(map[string]any)
+				schemaNode, ok := mediaMap["schema"]
+				if !ok || !isJSONMediaType(mediaType) {
+					continue
+				}
+				schema, err := compileSchema(root, schemaNode)
+				if err != nil {
+					return nil, fmt.Errorf("%s %s: %w", method, template, err)
+				}
+				operation.schemas[mediaType] = schema
+			}
+			spec.operations = append(spec.operations, operation)
+		}
+	}
+
+	// Literal segments beat parameters, so /pets/mine wins over /pets/{id}
+	sort.SliceStable(spec.operations, func(i, j int) bool {
+		return literalSegments(spec.operations[i].segments) > literalSegments(spec.operations[j].segments)
+	})
+	return spec, nil
+}
+
+// literalSegments counts the non-parameter segments of a path template
+func literalSegments(segments []string) int {
+	n := 0
+	for _, s := range segments {
+		if !strings.HasPrefix(s, "{") {
+			n++
+		}
+	}
+	return n
+}
+
+// matches reports whether the operation handles method and path
+func (op *apiOperation) matches(method string, segments []string) bool {
+	if op.method != method || len(op.segments) != len(segments) {
+		return false
+	}
+	for i, s := range op.segments {
+		if !strings.HasPrefix(s, "{") && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// schemaFor picks the schema that applies to a request, or nil when none does
+func (spec *validationSpec) schemaFor(method, path, mediaType string) (schema *jsonSchema, required bool) {
+	if spec.schema != nil {
+		return spec.schema, false
+	}
+
+	path = strings.TrimPrefix(path, spec.basePath)
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, op := range spec.operations {
+		if !op.matches(method, segments) {
+			continue
+		}
+		if s, ok := op.schemas[mediaType]; ok {
+			return s, op.required
+		}
+		// A generic application/json entry also covers vendor +json types
+		return op.schemas["application/json"], op.required
+	}
+	return nil, false
+}
+
+// isJSONMediaType reports whether a media type carries JSON
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// checkBody validates r's body against the spec for path and restores the body for
+// the upstream. It returns the result for metrics and the rejection, if any.
+func (v *bodyValidator) checkBody(r *http.Request, path string) (string, *keyError) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	hasBody := r.Body != nil && r.Body != http.NoBody
+
+	v.mu.RLock()
+	spec := v.spec
+	v.mu.RUnlock()
+	schema, required := spec.schemaFor(r.Method, path, mediaType)
+	if !hasBody {
+		if required {
+			return "invalid", &keyError{status: http.StatusUnprocessableEntity, code: "invalid_body", message: "request body is required"}
+		}
+		return "skipped", nil
+	}
+	// Non-JSON bodies, and operations the spec does not describe, pass through
+	if schema == nil || !isJSONMediaType(mediaType) {
+		return "skipped", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, v.maxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return "invalid", &keyError{status: http.StatusBadRequest, code: "invalid_body", message: "failed to read request body"}
+	}
+	if int64(len(body)) > v.maxBody {
+		return "too_large", &keyError{status: http.StatusRequestEntityTooLarge, code: "body_too_large", message: "request body exceeds the validation limit"}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if len(body) == 0 && !required {
+		return "skipped", nil
+	}
+
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "invalid", &keyError{status: http.StatusUnprocessableEntity, code: "invalid_body", message: "request body is not valid JSON: " + err.Error()}
+	}
+	if problems := schema.validate(value); len(problems) > 0 {
+		if len(problems) > maxReportedProblems {
+			problems = append(problems[:maxReportedProblems], fmt.Sprintf("and %d more", len(problems)-maxReportedProblems))
+		}
+		return "invalid", &keyError{status: http.StatusUnprocessableEntity, code: "invalid_body", message: "request body does not match the schema: " + strings.Join(problems, "; ")}
+	}
+	return "valid", nil
+}
+
+// watchSchemas reloads changed schema files for every validating route until ctx is done
+func (h *ProxyHandler) watchSchemas(ctx context.Context) {
+	ticker := time.NewTicker(schemaReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Tenant routes come and go through the admin API, so look them up each time
+		for _, route := range h.allRoutes() {
+			if route.Validator == nil {
+				continue
+			}
+			changed, err := route.Validator.reload()
+			if err != nil {
+				// Keep validating against the previous version
+				h.logger.Printf("Route %s: schema reload failed: %v", route.Name, err)
+				h.schemaReloads.inc(route.Name, "failed")
+			} else if changed {
+				h.logger.Printf("Route %s: reloaded schema from %s", route.Name, route.Validator.file)
+				h.schemaReloads.inc(route.Name, "applied")
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package proxygo
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+// VirtualHostConfig routes requests by their Host header, as a conventional reverse proxy
+// would. Route settings apply as for path routes; the prefix defaults to "/".
+type VirtualHostConfig struct {
+	Hosts []string   `json:"hosts"`         // e.g. "api.mycompany.dev" or "*.mycompany.dev"
+	TLS   *TLSConfig `json:"tls,omitempty"` // certificate TLS listeners present when the client asks for one of Hosts
+	RouteConfig
+}
+
+// vhostTable maps inbound host names to routes and SNI certificates
+type vhostTable struct {
+	exact     map[string]*router
+	wildcards []vhostPattern // in config order
+	certs     []vhostCert
+}
+
+// vhostPattern is a wildcard host with its routes
+type vhostPattern struct {
+	pattern string
+	router  *router
+}
+
+// vhostCert is a certificate and the host patterns it is presented for
+type vhostCert struct {
+	hosts []string
+	cert  *keyPair
+}
+
+// newVhostTable compiles the virtual hosts, returning nil when none are configured
+func newVhostTable(configs []VirtualHostConfig) (*vhostTable, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	t := &vhostTable{exact: make(map[string]*router)}
+	routers := make(map[string]*router)
+	for i, vc := range configs {
+		name := vc.Name
+		if name == "" && len(vc.Hosts) > 0 {
+			name = vc.Hosts[0]
+		}
+		if len(vc.Hosts) == 0 {
+			return nil, fmt.Errorf("virtual host #%d: hosts is required", i)
+		}
+		rc := vc.RouteConfig
+		rc.Name = name
+		if rc.Prefix == "" {
+			rc.Prefix = "/"
+		}
+		route, err := compileRoute(rc)
+		if err != nil {
+			return nil, fmt.Errorf("virtual host %s: %w", name, err)
+		}
+
+		for _, host := range vc.Hosts {
+			host = normalizeHost(host)
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("virtual host %s: invalid host pattern %q", name, host)
+			}
+			rt, ok := routers[host]
+			if !ok {
+				rt = &router{}
+				routers[host] = rt
+				if strings.ContainsAny(host, "*?[") {
+					t.wildcards = append(t.wildcards, vhostPattern{pattern: host, router: rt})
+				} else {
+					t.exact[host] = rt
+				}
+			}
+			rt.routes = append(rt.routes, route)
+		}
+
+		if vc.TLS != nil {
+			cert, err := loadKeyPair(vc.TLS.CertFile, vc.TLS.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("virtual host %s: %w", name, err)
+			}
+			t.certs = append(t.certs, vhostCert{hosts: normalizeHosts(vc.Hosts), cert: cert})
+		}
+	}
+
+	// Hosts split across several entries by prefix still pick the longest prefix first
+	for _, rt := range routers {
+		sort.SliceStable(rt.routes, func(i, j int) bool {
+			return len(rt.routes[i].Prefix) > len(rt.routes[j].Prefix)
+		})
+	}
+	return t, nil
+}
+
+// normalizeHost lowercases host and drops its port and any trailing dot
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// normalizeHosts applies normalizeHost to every entry
+func normalizeHosts(hosts []string) []string {
+	out := make([]string, len(hosts))
+	for i, h := range hosts {
+		out[i] = normalizeHost(h)
+	}
+	return out
+}
+
+// routerFor returns the routes of the virtual host serving host, exact names before wildcards
+func (t *vhostTable) routerFor(host string) *router {
+	host = normalizeHost(host)
+	if rt, ok := t.exact[host]; ok {
+		return rt
+	}
+	for _, w := range t.wildcards {
+		if ok, _ := path.Match(w.pattern, host); ok {
+			return w.router
+		}
+	}
+	return nil
+}
+
+// routes returns every virtual host route once
+func (t *vhostTable) routes() []*Route {
+	seen := make(map[*Route]bool)
+	var out []*Route
+	collect := func(rt *router) {
+		for _, route := range rt.routes {
+			if !seen[route] {
+				seen[route] = true
+				out = append(out, route)
+			}
+		}
+	}
+	for _, rt := range t.exact {
+		collect(rt)
+	}
+	for _, w := range t.wildcards {
+		collect(w.router)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// getCertificate picks the certificate for the SNI name, falling back to the
+// listener's own certificate when no virtual host claims it
+func (t *vhostTable) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeHost(hello.ServerName)
+	if name == "" {
+		return nil, nil
+	}
+	for _, c := range t.certs {
+		for _, host := range c.hosts {
+			if host == name {
+				return c.cert.get(), nil
+			}
+		}
+	}
+	for _, c := range t.certs {
+		for _, host := range c.hosts {
+			if ok, _ := path.Match(host, name); ok {
+				return c.cert.get(), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// tlsConfig returns the server TLS config for a listener presenting own unless a virtual
+// host claims the SNI name. Both are looked up per handshake, so reloaded certificates
+// apply to new connections.
+func (t *vhostTable) tlsConfig(own *keyPair) *tls.Config {
+	return &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if t != nil {
+			if cert, _ := t.getCertificate(hello); cert != nil {
+				return cert, nil
+			}
+		}
+		return own.get(), nil
+	}}
+}
@@ -0,0 +1,121 @@
+package proxygo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	upstream := func(name string) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	h := newTestHandler(t, `{
+		"virtual_hosts": [
+			{"hosts": ["api.example.com"], "upstream": "`+upstream("api")+`"},
+			{"name": "api-v2", "hosts": ["api.example.com"], "prefix": "/v2/", "upstream": "`+upstream("v2")+`"},
+			{"hosts": ["*.example.com", "example.org"], "upstream": "`+upstream("wildcard")+`"}
+		],
+		"routes": [{"name": "paths", "prefix": "/app/", "upstream": "`+upstream("paths")+`"}]}`)
+
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{host: "api.example.com", path: "/users", want: "api /users"},
+		{host: "API.Example.com.:8443", path: "/users", want: "api /users"},
+		{host: "api.example.com", path: "/v2/users", want: "v2 /users"},
+		{host: "www.example.com", path: "/", want: "wildcard /"},
+		{host: "example.org", path: "/x", want: "wildcard /x"},
+		{host: "example.com", path: "/app/x", want: "paths /x"},
+		{host: "proxy.internal", path: "/app/x", want: "paths /x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Body.String() != tt.want {
+				t.Errorf("%d %q, want %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestVirtualHostsConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  VirtualHostConfig
+		err  string
+	}{
+		{name: "no hosts", cfg: VirtualHostConfig{RouteConfig: RouteConfig{Upstream: "http://app.internal"}}, err: "hosts is required"},
+		{name: "bad pattern", cfg: VirtualHostConfig{Hosts: []string{"[a-"}, RouteConfig: RouteConfig{Upstream: "http://app.internal"}}, err: "invalid host pattern"},
+		{name: "bad route", cfg: VirtualHostConfig{Hosts: []string{"app.example.com"}}, err: "virtual host app.example.com:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newVhostTable([]VirtualHostConfig{tt.cfg})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("newVhostTable: %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVirtualHostCertificates(t *testing.T) {
+	now := time.Now()
+	// Distinct validity periods make the certificates tell apart
+	apiCert, apiKey := writeTestCertValid(t, now.Add(-time.Hour), now.Add(time.Hour))
+	wildCert, wildKey := writeTestCertValid(t, now.Add(-2*time.Hour), now.Add(time.Hour))
+	ownCert, ownKey := writeTestCertValid(t, now.Add(-3*time.Hour), now.Add(time.Hour))
+	table, err := newVhostTable([]VirtualHostConfig{
+		{Hosts: []string{"*.example.com"}, TLS: &TLSConfig{CertFile: wildCert, KeyFile: wildKey}, RouteConfig: RouteConfig{Upstream: "http://wild.internal"}},
+		{Hosts: []string{"api.example.com"}, TLS: &TLSConfig{CertFile: apiCert, KeyFile: apiKey}, RouteConfig: RouteConfig{Upstream: "http://api.internal"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := loadKeyPair(ownCert, ownKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := table.tlsConfig(own)
+
+	tests := []struct {
+		serverName string
+		certFile   string
+		keyFile    string
+	}{
+		{serverName: "api.example.com", certFile: apiCert, keyFile: apiKey},
+		{serverName: "API.example.com.", certFile: apiCert, keyFile: apiKey},
+		{serverName: "www.example.com", certFile: wildCert, keyFile: wildKey},
+		{serverName: "example.net", certFile: ownCert, keyFile: ownKey},
+		{serverName: "", certFile: ownCert, keyFile: ownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			want, err := tls.LoadX509KeyPair(tt.certFile, tt.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Certificate[0], want.Certificate[0]) {
+				t.Errorf("SNI %q got the wrong certificate", tt.serverName)
+			}
+		})
+	}
+}
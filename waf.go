@@ -0,0 +1,298 @@
+package proxygo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// defaultWAFMaxHeaderBytes bounds a single header line under the headers rule set
+	defaultWAFMaxHeaderBytes = 8 << 10
+	// defaultWAFMaxHeaders bounds the number of header lines under the headers rule set
+	defaultWAFMaxHeaders = 100
+
+	wafModeBlock  = "block"
+	wafModeReport = "report"
+)
+
+// WAFConfig blocks suspicious requests before any other work is done for them.
+// In report mode matches are logged and counted but the request proceeds.
+type WAFConfig struct {
+	Mode           string          `json:"mode"`             // "block" (default) or "report"
+	RuleSets       []string        `json:"rule_sets"`        // built-in sets: traversal, sqli, xss, headers; default all
+	DisabledRules  []string        `json:"disabled_rules"`   // built-in rule IDs to switch off, e.g. "sqli-comment"
+	Rules          []WAFRuleConfig `json:"rules"`            // custom rules, checked after the built-in ones
+	MaxHeaderBytes ByteSize        `json:"max_header_bytes"` // longest header line allowed by the headers set; default 8KB
+	MaxHeaders     int             `json:"max_headers"`      // most header lines allowed by the headers set; default 100
+}
+
+// WAFRuleConfig is a custom pattern rule
+type WAFRuleConfig struct {
+	ID      string `json:"id"`
+	Field   string `json:"field"`   // "path", "query" or "header:<Name>"
+	Pattern string `json:"pattern"` // regular expression matched against the decoded field
+	Mode    string `json:"mode"`    // overrides the global mode, e.g. "report" while trialling a rule
+}
+
+// wafRule is one compiled check
+type wafRule struct {
+	id      string
+	field   string
+	pattern *regexp.Regexp
+	report  bool
+}
+
+// builtinWAFRules are the pattern rules of each built-in set; the headers set is
+// a size check and has no patterns
+var builtinWAFRules = map[string][]WAFRuleConfig{
+	"traversal": {
+		{ID: "traversal-dotdot", Field: "path", Pattern: `(^|[/\\])\.\.([/\\]|$)`},
+		{ID: "traversal-dotdot-query", Field: "query", Pattern: `(^|[/\\=])\.\.[/\\]`},
+		{ID: "traversal-null-byte", Field: "path", Pattern: `\x00`},
+		{ID: "traversal-sensitive-file", Field: "query", Pattern: `(?i)(/etc/(passwd|shadow)|\bwin\.ini\b|\bboot\.ini\b)`},
+	},
+	"sqli": {
+		{ID: "sqli-union", Field: "query", Pattern: `(?i)\bunion\b(\s|/\*.*?\*/)+(all\s+)?select\b`},
+		{ID: "sqli-tautology", Field: "query", Pattern: `(?i)['"]\s*(or|and)\s+['"]?\w+['"]?\s*=\s*['"]?\w+`},
+		{ID: "sqli-stacked", Field: "query", Pattern: `(?i);\s*(drop|delete|insert|update|truncate|alter)\s+`},
+		{ID: "sqli-comment", Field: "query", Pattern: `['"]\s*(--|#|/\*)`},
+		{ID: "sqli-timing", Field: "query", Pattern: `(?i)\b(sleep|benchmark|pg_sleep|waitfor\s+delay)\s*\(`},
+	},
+	"xss": {
+		{ID: "xss-script", Field: "query", Pattern: `(?i)<\s*script\b`},
+		{ID: "xss-handler", Field: "query", Pattern: `(?i)<[^>]*\son(error|load|mouseover|focus)\s*=`},
+		{ID: "xss-js-uri", Field: "query", Pattern: `(?i)javascript\s*:`},
+	},
+}
+
+// waf is a compiled WAFConfig
+type waf struct {
+	rules          []wafRule
+	checkHeaders   bool
+	maxHeaderBytes int
+	maxHeaders     int
+	report         bool // global report-only mode, applied to the size checks
+
+	hits *metricVec
+}
+
+// wafMatch describes the rule a request tripped
+type wafMatch struct {
+	rule   string
+	detail string
+	report bool
+}
+
+// newWAF compiles cfg, returning nil when request filtering is disabled
+func newWAF(cfg *WAFConfig, metrics *metricsRegistry) (*waf, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	globalReport, err := wafReportMode(cfg.Mode, false)
+	if err != nil {
+		return nil, fmt.Errorf("waf: %w", err)
+	}
+
+	w := &waf{
+		maxHeaderBytes: int(cfg.MaxHeaderBytes),
+		maxHeaders:     cfg.MaxHeaders,
+		report:         globalReport,
+		hits:           metrics.counter("proxygo_waf_hits_total", "Requests that matched a WAF rule, by rule and action.", "rule", "action"),
+	}
+	if w.maxHeaderBytes <= 0 {
+		w.maxHeaderBytes = defaultWAFMaxHeaderBytes
+	}
+	if w.maxHeaders <= 0 {
+		w.maxHeaders = defaultWAFMaxHeaders
+	}
+
+	sets := cfg.RuleSets
+	if len(sets) == 0 {
+		sets = []string{"traversal", "sqli", "xss", "headers"}
+	}
+	var configs []WAFRuleConfig
+	for _, set := range sets {
+		if set == "headers" {
+			w.checkHeaders = true
+			continue
+		}
+		rules, ok := builtinWAFRules[set]
+		if !ok {
+			return nil, fmt.Errorf("waf: unknown rule set %q", set)
+		}
+		for _, rule := range rules {
+			if !slices.Contains(cfg.DisabledRules, rule.ID) {
+				configs = append(configs, rule)
+			}
+		}
+	}
+	configs = append(configs, cfg.Rules...)
+
+	seen := make(map[string]bool)
+	for _, rc := range configs {
+		if rc.ID == "" {
+			return nil, errors.New("waf: rule without id")
+		}
+		if seen[rc.ID] {
+			return nil, fmt.Errorf("waf: duplicate rule id %q", rc.ID)
+		}
+		seen[rc.ID] = true
+		if rc.Field != "path" && rc.Field != "query" && !strings.HasPrefix(rc.Field, "header:") {
+			return nil, fmt.Errorf("waf: rule %s: unknown field %q", rc.ID, rc.Field)
+		}
+		pattern, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("waf: rule %s: %w", rc.ID, err)
+		}
+		report, err := wafReportMode(rc.Mode, globalReport)
+		if err != nil {
+			return nil, fmt.Errorf("waf: rule %s: %w", rc.ID, err)
+		}
+		w.rules = append(w.rules, wafRule{id: rc.ID, field: rc.Field, pattern: pattern, report: report})
+	}
+	return w, nil
+}
+
+// wafReportMode parses a mode setting, with "" meaning fallback
+func wafReportMode(mode string, fallback bool) (bool, error) {
+	switch mode {
+	case "":
+		return fallback, nil
+	case wafModeBlock:
+		return false, nil
+	case wafModeReport:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown mode %q", mode)
+}
+
+// inspect runs every rule against r. It returns the first blocking match, or nil when
+// the request may proceed, together with every report-only match along the way.
+func (w *waf) inspect(r *http.Request) (block *wafMatch, reported []wafMatch) {
+	hit := func(m wafMatch) bool {
+		if m.report {
+			w.hits.inc(m.rule, "reported")
+			reported = append(reported, m)
+			return false
+		}
+		w.hits.inc(m.rule, "blocked")
+		block = &m
+		return true
+	}
+
+	if w.checkHeaders {
+		if n := headerLines(r.Header); n > w.maxHeaders {
+			if hit(wafMatch{rule: "headers-count", detail: fmt.Sprintf("%d header lines", n), report: w.report}) {
+				return
+			}
+		}
+	sizes:
+		for name, values := range r.Header {
+			for _, v := range values {
+				if len(name)+len(v) > w.maxHeaderBytes {
+					if hit(wafMatch{rule: "headers-size", detail: fmt.Sprintf("header %s is %d bytes", name, len(v)), report: w.report}) {
+						return
+					}
+					break sizes
+				}
+			}
+		}
+	}
+
+	// Attackers encode payloads to slip past filters, so patterns see the decoded forms
+	path := decodeTwice(r.URL.EscapedPath(), false)
+	query := decodeTwice(r.URL.RawQuery, true)
+	for _, rule := range w.rules {
+		var values []string
+		switch {
+		case rule.field == "path":
+			values = []string{path}
+		case rule.field == "query":
+			values = []string{query}
+		default:
+			values = r.Header.Values(strings.TrimPrefix(rule.field, "header:"))
+		}
+		for _, v := range values {
+			if loc := rule.pattern.FindStringIndex(v); loc != nil {
+				detail := fmt.Sprintf("%s matched %q", rule.field, truncate(v[loc[0]:loc[1]], 64))
+				if hit(wafMatch{rule: rule.id, detail: detail, report: rule.report}) {
+					return
+				}
+				break
+			}
+		}
+	}
+	return
+}
+
+// headerLines counts the header lines of a request
+func headerLines(h http.Header) int {
+	n := 0
+	for _, values := range h {
+		n += len(values)
+	}
+	return n
+}
+
+// decodeTwice percent-decodes s up to two times; plus also decodes + as a space, as in
+// queries. Malformed escapes are kept as they are, so one bad escape cannot hide the
+// payload next to it.
+func decodeTwice(s string, plus bool) string {
+	for range 2 {
+		decoded := unescapeLenient(s, plus)
+		if decoded == s {
+			break
+		}
+		s = decoded
+	}
+	return s
+}
+
+// unescapeLenient decodes every valid %XX escape in s and leaves the rest alone
+func unescapeLenient(s string, plus bool) string {
+	if !strings.ContainsRune(s, '%') && (!plus || !strings.ContainsRune(s, '+')) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%' && i+2 < len(s) && ishex(s[i+1]) && ishex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c == '+' && plus:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ishex reports whether c is a hexadecimal digit
+func ishex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// unhex returns the value of hexadecimal digit c
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// truncate shortens s to at most n bytes for logs
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
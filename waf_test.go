@@ -0,0 +1,94 @@
+package proxygo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWAFRules(t *testing.T) {
+	w, err := newWAF(&WAFConfig{}, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+		want   string // rule that blocks the request, "" to let it through
+	}{
+		// One request for each built-in rule
+		{name: "dotdot", target: "/files/../etc/passwd", want: "traversal-dotdot"},
+		{name: "dotdot query", target: "/download?file=../secret", want: "traversal-dotdot-query"},
+		{name: "null byte", target: "/files/report.pdf%00.txt", want: "traversal-null-byte"},
+		{name: "sensitive file", target: "/view?file=/etc/shadow", want: "traversal-sensitive-file"},
+		{name: "union", target: "/items?id=1+UNION+ALL+SELECT+password", want: "sqli-union"},
+		{name: "tautology", target: "/items?q='+or+1=1", want: "sqli-tautology"},
+		{name: "stacked", target: "/items?id=1;+DROP+TABLE+users", want: "sqli-stacked"},
+		{name: "comment", target: "/login?user=admin'--", want: "sqli-comment"},
+		{name: "timing", target: "/items?id=1+AND+SLEEP(5)", want: "sqli-timing"},
+		{name: "script", target: "/search?q=<script>alert(1)</script>", want: "xss-script"},
+		{name: "handler", target: "/search?q=<img+src=x+onerror=alert(1)>", want: "xss-handler"},
+		{name: "js uri", target: "/redirect?to=javascript:alert(1)", want: "xss-js-uri"},
+		{name: "header count", target: "/", header: http.Header{"X-Many": make([]string, defaultWAFMaxHeaders+1)}, want: "headers-count"},
+		{name: "header size", target: "/", header: http.Header{"X-Big": {strings.Repeat("a", defaultWAFMaxHeaderBytes)}}, want: "headers-size"},
+
+		// Encoded payloads are decoded before matching, whatever else is in the query
+		{name: "encoded", target: "/items?q=%27%20or%201=1", want: "sqli-tautology"},
+		{name: "double encoded", target: "/items?q=%2527%2520or%25201=1", want: "sqli-tautology"},
+		{name: "encoded path", target: "/files/%2e%2e/etc/passwd", want: "traversal-dotdot"},
+		{name: "bad escape after", target: "/items?q=%27%20or%201=1&x=%zz", want: "sqli-tautology"},
+		{name: "bad escape before", target: "/items?x=%&q=%27%20or%201=1", want: "sqli-tautology"},
+
+		{name: "clean", target: "/items?q=shoes+size%3D42&page=2"},
+		{name: "clean bad escape", target: "/items?q=100%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			block, reported := w.inspect(r)
+			got := ""
+			if block != nil {
+				got = block.rule
+			}
+			if got != tt.want || len(reported) != 0 {
+				t.Errorf("blocked by %q, %d reported; want %q", got, len(reported), tt.want)
+			}
+		})
+	}
+}
+
+func TestWAFReportMode(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/items?q=%27%20or%201=1&x=<script>", nil)
+
+	// In report mode every match is reported and none blocks
+	w, err := newWAF(&WAFConfig{Mode: wafModeReport}, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, reported := w.inspect(r)
+	if block != nil || len(reported) != 2 || reported[0].rule != "sqli-tautology" || reported[1].rule != "xss-script" {
+		t.Errorf("report mode: block %v, reported %v", block, reported)
+	}
+
+	// A rule's own mode overrides the global one
+	w, err = newWAF(&WAFConfig{
+		RuleSets: []string{"xss"},
+		Rules:    []WAFRuleConfig{{ID: "trial", Field: "query", Pattern: `or\s+1=1`, Mode: wafModeReport}},
+	}, newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, reported = w.inspect(r)
+	if block == nil || block.rule != "xss-script" || len(reported) != 0 {
+		t.Errorf("blocking rule before the trial: block %v, reported %v", block, reported)
+	}
+	block, reported = w.inspect(httptest.NewRequest(http.MethodGet, "/items?q=%27%20or%201=1", nil))
+	if block != nil || len(reported) != 1 || reported[0].rule != "trial" {
+		t.Errorf("trial rule: block %v, reported %v", block, reported)
+	}
+}
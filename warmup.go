@@ -0,0 +1,181 @@
+package proxygo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWarmupConnections = 2
+	defaultWarmupInterval    = 30 * time.Second
+	warmupTick               = time.Second
+	warmupTimeout            = 10 * time.Second
+)
+
+// WarmupConfig keeps connections to a route's upstream open ahead of traffic, so the
+// first requests after startup or a quiet spell skip the dial and TLS handshake
+type WarmupConfig struct {
+	Connections int      `json:"connections"` // idle connections to keep open; default 2, capped by pool.max_idle_conns_per_host
+	Path        string   `json:"path"`        // requested with HEAD to open each connection; default "/"
+	Interval    Duration `json:"interval"`    // how often connections closed by idle expiry are replaced; default 30s
+}
+
+// connWarmer is a compiled WarmupConfig
+type connWarmer struct {
+	connections int
+	path        string
+	interval    time.Duration
+
+	next   time.Time   // owned by the warmup loop
+	busy   atomic.Bool // a warmup pass is running
+	capped bool        // the pool limit warning was logged; only touched while busy
+}
+
+// newConnWarmer returns nil when the route is not warmed
+func newConnWarmer(cfg *WarmupConfig) (*connWarmer, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Connections < 0 || cfg.Interval < 0 {
+		return nil, fmt.Errorf("warmup connections and interval cannot be negative")
+	}
+	w := &connWarmer{connections: cfg.Connections, path: cfg.Path, interval: time.Duration(cfg.Interval)}
+	if w.connections == 0 {
+		w.connections = defaultWarmupConnections
+	}
+	if w.path == "" {
+		w.path = "/"
+	}
+	if w.interval == 0 {
+		w.interval = defaultWarmupInterval
+	}
+	return w, nil
+}
+
+// runWarmup warms every route that asks for it at startup and again whenever its interval
+// elapses, until ctx is done. Tenant routes come and go, so routes are looked up each tick.
+func (h *ProxyHandler) runWarmup(ctx context.Context) {
+	ticker := time.NewTicker(warmupTick)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, route := range h.allRoutes() {
+			w := route.Warmup
+			if w == nil || now.Before(w.next) || !w.busy.CompareAndSwap(false, true) {
+				continue
+			}
+			w.next = now.Add(w.interval)
+			go func() {
+				defer w.busy.Store(false)
+				h.warmRoute(ctx, route)
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmRoute sends the warmup requests concurrently, so each one that finds no idle
+// connection dials its own and leaves it in the pool. HTTP/2 upstreams multiplex
+// every request onto a single connection.
+func (h *ProxyHandler) warmRoute(ctx context.Context, route *Route) {
+	w := route.Warmup
+	connections := w.connections
+	if limit := h.transports.idleLimit(); connections > limit {
+		if !w.capped {
+			h.logger.Printf("Route %s: warmup wants %d connections but the pool keeps %d idle; raise pool.max_idle_conns_per_host", route.Name, connections, limit)
+			w.capped = true
+		}
+		connections = limit
+	}
+
+	target := &proxyTarget{URL: route.Upstream, Path: w.path, Socket: route.Socket, Route: route}
+	transport := h.transports.forTarget(target, false)
+	ctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var dialed atomic.Int64
+	errs := make(chan error, connections)
+	for range connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reused, err := warmConnection(ctx, transport, target)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !reused {
+				dialed.Add(1)
+				h.warmupDials.inc(route.Name)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if err, failed := <-errs; failed {
+		h.logger.Printf("Route %s: warmup failed: %v", route.Name, err)
+	}
+	if n := dialed.Load(); n > 0 {
+		h.logger.Printf("Route %s: opened %d warm upstream connections", route.Name, n)
+	}
+}
+
+// warmConnection sends one HEAD request and reports whether it reused a pooled connection
+func warmConnection(ctx context.Context, transport http.RoundTripper, target *proxyTarget) (bool, error) {
+	var reused bool
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+
+	u := *target.URL
+	u.User = nil
+	u.Path = target.Path
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Host = hostHeader(target.URL)
+	if target.URL.User != nil {
+		password, _ := target.URL.User.Password()
+		req.SetBasicAuth(target.URL.User.Username(), password)
+	}
+	req.Header.Set("User-Agent", "proxygo-warmup")
+
+	// Any answer will do: the connection is what we are after
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return reused, nil
+}
+
+// connReuseTransport counts whether each proxied request found a warm pooled connection
+// or had to dial a cold one
+type connReuseTransport struct {
+	http.RoundTripper
+	route  string
+	counts *metricVec
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *connReuseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		state := "cold"
+		if info.Reused {
+			state = "warm"
+		}
+		t.counts.inc(t.route, state)
+	}}
+	return t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
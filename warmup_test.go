@@ -0,0 +1,111 @@
+package proxygo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		pool   string // pool config, "" for none
+		warmup string
+		dials  int // connections the first warmup opens
+	}{
+		{name: "default", warmup: `{}`, dials: defaultWarmupConnections},
+		{name: "connections", pool: `{"max_idle_conns_per_host": 4}`, warmup: `{"connections": 3, "path": "/health"}`, dials: 3},
+		{name: "capped by the pool", pool: `{"max_idle_conns_per_host": 1}`, warmup: `{"connections": 3}`, dials: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns atomic.Int64
+			var path atomic.Value
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead && r.UserAgent() == "proxygo-warmup" {
+					path.Store(r.URL.Path)
+					// Keep every warmup request in flight long enough to need its own connection
+					time.Sleep(20 * time.Millisecond)
+				}
+			}))
+			upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			upstream.Start()
+			defer upstream.Close()
+
+			config := `{"routes": [{"name": "api", "prefix": "/api/", "upstream": "` + upstream.URL + `", "warmup": ` + tt.warmup + `}]`
+			if tt.pool != "" {
+				config += `, "pool": ` + tt.pool
+			}
+			h := newTestHandler(t, config+"}")
+			route := h.allRoutes()[0]
+
+			h.warmRoute(context.Background(), route)
+			if got := int(conns.Load()); got != tt.dials {
+				t.Errorf("warmup opened %d connections, want %d", got, tt.dials)
+			}
+			if got := h.warmupDials.value("api"); got != float64(tt.dials) {
+				t.Errorf("warmup dials metric %v, want %d", got, tt.dials)
+			}
+			if want := route.Warmup.path; path.Load() != want {
+				t.Errorf("warmup requested %v, want %s", path.Load(), want)
+			}
+
+			// Traffic finds the warm connections
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/x", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if warm, cold := h.connReuse.value("api", "warm"), h.connReuse.value("api", "cold"); warm != 1 || cold != 0 {
+				t.Errorf("requests on warm/cold connections %v/%v, want 1/0", warm, cold)
+			}
+
+			// A second pass reuses what is still open
+			h.warmRoute(context.Background(), route)
+			if got := int(conns.Load()); got != tt.dials {
+				t.Errorf("after another pass, %d connections, want %d", got, tt.dials)
+			}
+		})
+	}
+}
+
+func TestWarmupConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *WarmupConfig
+		want *connWarmer
+		err  bool
+	}{
+		{name: "off"},
+		{name: "defaults", cfg: &WarmupConfig{}, want: &connWarmer{connections: defaultWarmupConnections, path: "/", interval: defaultWarmupInterval}},
+		{
+			name: "set",
+			cfg:  &WarmupConfig{Connections: 5, Path: "/ping", Interval: Duration(time.Minute)},
+			want: &connWarmer{connections: 5, path: "/ping", interval: time.Minute},
+		},
+		{name: "negative connections", cfg: &WarmupConfig{Connections: -1}, err: true},
+		{name: "negative interval", cfg: &WarmupConfig{Interval: Duration(-time.Second)}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newConnWarmer(tt.cfg)
+			if (err != nil) != tt.err {
+				t.Fatalf("newConnWarmer: %v, want error %v", err, tt.err)
+			}
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil,
+				got.connections != tt.want.connections || got.path != tt.want.path || got.interval != tt.want.interval:
+				t.Errorf("newConnWarmer = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package proxygo
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Notification defaults
+const (
+	defaultWebhookTimeout    = 5 * time.Second
+	defaultWebhookRetries    = 3
+	defaultWebhookPerHour    = 30
+	defaultNotifyCooldown    = 15 * time.Minute
+	defaultErrorRateWindow   = time.Minute
+	defaultErrorRateRequests = 20
+	defaultErrorRateWindows  = 3
+	webhookQueueSize         = 64
+	webhookMaxBackoff        = 30 * time.Second
+	certCheckInterval        = time.Hour
+	certNotifyInterval       = 24 * time.Hour // a certificate warning repeats daily until it is renewed
+)
+
+// Notification events
+const (
+	eventCertExpiry   = "cert_expiry"          // a served certificate expires within the warning window
+	eventErrorRate    = "error_rate"           // the share of 5xx responses stayed above the threshold
+	eventReloadFailed = "config_reload_failed" // a config reload was rejected and the old config kept
+	eventSLOBurnRate  = "slo_burn_rate"        // an SLO spends its error budget faster than an alert allows
+)
+
+// notificationEvents are the events a webhook may subscribe to
+var notificationEvents = []string{eventCertExpiry, eventErrorRate, eventReloadFailed, eventSLOBurnRate}
+
+// NotificationsConfig sends operational events to webhooks. Notifications are rate
+// limited twice: an event about the same subject is sent once per cooldown, and each
+// webhook takes at most max_per_hour messages. Not reloadable.
+type NotificationsConfig struct {
+	Webhooks         []WebhookConfig `json:"webhooks"`
+	Cooldown         Duration        `json:"cooldown"`           // minimum gap between events about the same subject; default 15m
+	CertExpiry       Duration        `json:"cert_expiry"`        // warn when a certificate expires within this; default the admin cert_expiry_window, else 7 days
+	ErrorRate        float64         `json:"error_rate"`         // share of 5xx responses, e.g. 0.05, that counts as failing; 0 disables error_rate
+	ErrorWindow      Duration        `json:"error_window"`       // responses are counted per window of this length; default 1m
+	ErrorWindows     int             `json:"error_windows"`      // consecutive failing windows before notifying; default 3
+	ErrorMinRequests int             `json:"error_min_requests"` // windows with fewer responses are not judged; default 20
+}
+
+// WebhookConfig is one notification endpoint
+type WebhookConfig struct {
+	Name       string            `json:"name"`
+	URL        string            `json:"url"`
+	Format     string            `json:"format"`       // "generic" (default) posts the event as JSON, "slack" posts an incoming webhook message
+	Events     []string          `json:"events"`       // events to send; empty for all
+	Headers    map[string]string `json:"headers"`      // added to every request, e.g. Authorization
+	Timeout    Duration          `json:"timeout"`      // per attempt; default 5s
+	Retries    int               `json:"retries"`      // further attempts after a failure, with backoff from 1s; default 3, -1 for none
+	MaxPerHour int               `json:"max_per_hour"` // messages beyond this are dropped; default 30
+}
+
+// notification is one operational event, and the body of a generic webhook
+type notification struct {
+	Event    string            `json:"event"`
+	Time     time.Time         `json:"time"`
+	Instance string            `json:"instance"` // host name of the proxy that sent it
+	Subject  string            `json:"subject"`  // what the event is about, e.g. a certificate file
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// webhook delivers notifications to one endpoint from its own queue
+type webhook struct {
+	name    string
+	url     string
+	slack   bool
+	events  []string
+	headers map[string]string
+	retries int
+	client  *http.Client
+	limit   *tokenBucket
+	queue   chan notification
+}
+
+// notifier decides which events are worth sending and hands them to the webhooks
+type notifier struct {
+	webhooks   []*webhook
+	cooldown   time.Duration
+	certWindow time.Duration
+	instance   string
+	logger     *log.Logger
+	results    *metricVec
+
+	errorRate   float64
+	errorWindow time.Duration
+	windows     int
+	minRequests int64
+	responses   atomic.Int64 // in the current window
+	failures    atomic.Int64 // 5xx responses in the current window
+
+	mu   sync.Mutex
+	sent map[string]time.Time // last notification by event and subject
+}
+
+// newNotifier returns nil when no webhook is configured
+func newNotifier(cfg *NotificationsConfig, admin *AdminConfig, logger *log.Logger, metrics *metricsRegistry) (*notifier, error) {
+	if cfg == nil || len(cfg.Webhooks) == 0 {
+		return nil, nil
+	}
+	n := &notifier{
+		cooldown:    time.Duration(cfg.Cooldown),
+		certWindow:  time.Duration(cfg.CertExpiry),
+		logger:      logger,
+		errorRate:   cfg.ErrorRate,
+		errorWindow: time.Duration(cfg.ErrorWindow),
+		windows:     cfg.ErrorWindows,
+		minRequests: int64(cfg.ErrorMinRequests),
+		sent:        make(map[string]time.Time),
+		results: metrics.counter("proxygo_notifications_total",
+			"Webhook notifications by webhook, event and result.", "webhook", "event", "result"),
+	}
+	n.instance, _ = os.Hostname()
+	if n.cooldown <= 0 {
+		n.cooldown = defaultNotifyCooldown
+	}
+	if n.certWindow <= 0 {
+		n.certWindow = defaultCertExpiryWindow
+		if admin != nil && admin.CertExpiryWindow > 0 {
+			n.certWindow = time.Duration(admin.CertExpiryWindow)
+		}
+	}
+	if n.errorRate < 0 || n.errorRate > 1 {
+		return nil, fmt.Errorf("notifications: error_rate must be between 0 and 1")
+	}
+	if n.errorWindow <= 0 {
+		n.errorWindow = defaultErrorRateWindow
+	}
+	if n.windows <= 0 {
+		n.windows = defaultErrorRateWindows
+	}
+	if n.minRequests <= 0 {
+		n.minRequests = defaultErrorRateRequests
+	}
+
+	names := make(map[string]bool)
+	for i, wc := range cfg.Webhooks {
+		name := wc.Name
+		if name == "" {
+			name = fmt.Sprintf("webhook-%d", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("notifications: duplicate webhook name %q", name)
+		}
+		names[name] = true
+		if u, err := url.Parse(wc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook %s: url must be an http or https URL", name)
+		}
+		if wc.Format != "" && wc.Format != "generic" && wc.Format != "slack" {
+			return nil, fmt.Errorf("webhook %s: unknown format %q", name, wc.Format)
+		}
+		for _, event := range wc.Events {
+			if !slices.Contains(notificationEvents, event) {
+				return nil, fmt.Errorf("webhook %s: unknown event %q", name, event)
+			}
+		}
+		timeout := time.Duration(wc.Timeout)
+		if timeout <= 0 {
+			timeout = defaultWebhookTimeout
+		}
+		retries := wc.Retries
+		if retries == 0 {
+			retries = defaultWebhookRetries
+		}
+		perHour := wc.MaxPerHour
+		if perHour <= 0 {
+			perHour = defaultWebhookPerHour
+		}
+		n.webhooks = append(n.webhooks, &webhook{
+			name:    name,
+			url:     wc.URL,
+			slack:   wc.Format == "slack",
+			events:  wc.Events,
+			headers: wc.Headers,
+			retries: max(retries, 0),
+			client:  &http.Client{Timeout: timeout},
+			limit:   newTokenBucket(float64(perHour)/3600, float64(perHour)),
+			queue:   make(chan notification, webhookQueueSize),
+		})
+	}
+	return n, nil
+}
+
+// wants reports whether the webhook subscribes to event
+func (w *webhook) wants(event string) bool {
+	return len(w.events) == 0 || slices.Contains(w.events, event)
+}
+
+// notify queues ev for every subscribed webhook, unless the same event about the same
+// subject was sent within cooldown
+func (n *notifier) notify(ev notification, cooldown time.Duration) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Instance = n.instance
+
+	key := ev.Event + "\x00" + ev.Subject
+	n.mu.Lock()
+	last, seen := n.sent[key]
+	recent := seen && ev.Time.Sub(last) < cooldown
+	if !recent {
+		n.sent[key] = ev.Time
+	}
+	n.mu.Unlock()
+
+	for _, w := range n.webhooks {
+		if !w.wants(ev.Event) {
+			continue
+		}
+		switch {
+		case recent:
+			n.results.inc(w.name, ev.Event, "suppressed")
+		case !w.take():
+			n.results.inc(w.name, ev.Event, "rate_limited")
+		default:
+			select {
+			case w.queue <- ev:
+			default:
+				n.results.inc(w.name, ev.Event, "dropped")
+			}
+		}
+	}
+}
+
+// take spends one of the webhook's hourly messages
+func (w *webhook) take() bool {
+	got, _ := w.limit.reserve(1)
+	return got > 0
+}
+
+// observe counts a finished response towards the error rate
+func (n *notifier) observe(status int) {
+	if n.errorRate <= 0 {
+		return
+	}
+	n.responses.Add(1)
+	if status >= http.StatusInternalServerError {
+		n.failures.Add(1)
+	}
+}
+
+// run delivers notifications and watches certificates and the error rate until ctx is done
+func (n *notifier) run(ctx context.Context, certs func() []*keyPair) {
+	for _, w := range n.webhooks {
+		go n.deliver(ctx, w)
+	}
+
+	certTicker := time.NewTicker(certCheckInterval)
+	defer certTicker.Stop()
+	errorTicker := time.NewTicker(n.errorWindow)
+	defer errorTicker.Stop()
+
+	failing := 0
+	n.checkCertificates(certs())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-certTicker.C:
+			n.checkCertificates(certs())
+		case <-errorTicker.C:
+			responses, failures := n.responses.Swap(0), n.failures.Swap(0)
+			if n.errorRate <= 0 || responses < n.minRequests {
+				failing = 0
+				continue
+			}
+			rate := float64(failures) / float64(responses)
+			if rate < n.errorRate {
+				failing = 0
+				continue
+			}
+			// While the streak lasts, the cooldown spaces out the reminders
+			if failing++; failing < n.windows {
+				continue
+			}
+			n.notify(notification{
+				Event:   eventErrorRate,
+				Subject: "responses",
+				Message: fmt.Sprintf("%.1f%% of responses were 5xx over the last %s, above %.1f%% for %d windows",
+					rate*100, n.errorWindow, n.errorRate*100, failing),
+				Details: map[string]string{
+					"responses": fmt.Sprint(responses),
+					"failures":  fmt.Sprint(failures),
+					"window":    n.errorWindow.String(),
+				},
+			}, n.cooldown)
+		}
+	}
+}
+
+// checkCertificates warns about every certificate expiring within the window
+func (n *notifier) checkCertificates(pairs []*keyPair) {
+	now := time.Now()
+	for _, p := range pairs {
+		cert := p.get()
+		if cert == nil || len(cert.Certificate) == 0 {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+		remaining := leaf.NotAfter.Sub(now)
+		if remaining >= n.certWindow {
+			continue
+		}
+		message := fmt.Sprintf("certificate %s expires %s, in %s", p.certFile, leaf.NotAfter.UTC().Format(time.RFC3339), remaining.Round(time.Minute))
+		if remaining <= 0 {
+			message = fmt.Sprintf("certificate %s expired %s", p.certFile, leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+		n.notify(notification{
+			Event:   eventCertExpiry,
+			Subject: p.certFile,
+			Message: message,
+			Details: map[string]string{
+				"subject":   leaf.Subject.CommonName,
+				"not_after": leaf.NotAfter.UTC().Format(time.RFC3339),
+			},
+		}, max(n.cooldown, certNotifyInterval))
+	}
+}
+
+// deliver posts the webhook's queued notifications one at a time until ctx is done
+func (n *notifier) deliver(ctx context.Context, w *webhook) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.queue:
+			result := "sent"
+			if err := w.send(ctx, ev); err != nil {
+				result = "failed"
+				n.logger.Printf("Webhook %s: %s notification failed: %v", w.name, ev.Event, err)
+			}
+			n.results.inc(w.name, ev.Event, result)
+		}
+	}
+}
+
+// send posts ev, retrying with backoff while the endpoint fails or asks us to slow down
+func (w *webhook) send(ctx context.Context, ev notification) error {
+	body, err := w.payload(ev)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil || !retry || attempt >= w.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// payload renders ev in the webhook's format
+func (w *webhook) payload(ev notification) ([]byte, error) {
+	if !w.slack {
+		return json.Marshal(ev)
+	}
+	text := fmt.Sprintf("*proxygo %s* on %s: %s", ev.Event, ev.Instance, ev.Message)
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// post makes one delivery attempt, reporting whether a failure is worth retrying
+func (w *webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "proxygo")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Other client errors mean the request is wrong and will not get better with retries
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("%s answered %s", w.name, resp.Status)
+}
+
+// notify sends an operational event to the webhooks, if any are configured
+func (h *ProxyHandler) notify(ev notification) {
+	if h.notifier != nil {
+		h.notifier.notify(ev, h.notifier.cooldown)
+	}
+}
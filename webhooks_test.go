@@ -0,0 +1,258 @@
+package proxygo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestNotifier builds a notifier for cfg that logs nowhere
+func newTestNotifier(t *testing.T, cfg *NotificationsConfig) *notifier {
+	t.Helper()
+	n, err := newNotifier(cfg, nil, log.New(io.Discard, "", 0), newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// webhookRecorder is a webhook endpoint answering with the statuses given, then 200,
+// and keeping every request body it was sent
+type webhookRecorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func newWebhookRecorder(t *testing.T, statuses ...int) *webhookRecorder {
+	rec := &webhookRecorder{statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.bodies = append(rec.bodies, string(body))
+		rec.headers = append(rec.headers, r.Header)
+		if len(rec.statuses) > 0 {
+			w.WriteHeader(rec.statuses[0])
+			rec.statuses = rec.statuses[1:]
+		}
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// received returns the bodies posted so far
+func (rec *webhookRecorder) received() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.bodies...)
+}
+
+func TestNotifierConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  NotificationsConfig
+		err  string
+	}{
+		{name: "error rate", cfg: NotificationsConfig{ErrorRate: 1.5, Webhooks: []WebhookConfig{{URL: "http://hooks.internal"}}}, err: "error_rate must be between 0 and 1"},
+		{name: "duplicate", cfg: NotificationsConfig{Webhooks: []WebhookConfig{{Name: "ops", URL: "http://a.internal"}, {Name: "ops", URL: "http://b.internal"}}}, err: `duplicate webhook name "ops"`},
+		{name: "url", cfg: NotificationsConfig{Webhooks: []WebhookConfig{{URL: "hooks.internal/x"}}}, err: "webhook webhook-0: url must be an http or https URL"},
+		{name: "format", cfg: NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://hooks.internal", Format: "teams"}}}, err: `unknown format "teams"`},
+		{name: "event", cfg: NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://hooks.internal", Events: []string{"breaker_open"}}}}, err: `unknown event "breaker_open"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newNotifier(&tt.cfg, nil, log.New(io.Discard, "", 0), newMetricsRegistry())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("newNotifier: %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	n := newTestNotifier(t, &NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://hooks.internal"}}})
+	if n.cooldown != defaultNotifyCooldown || n.certWindow != defaultCertExpiryWindow || n.webhooks[0].retries != defaultWebhookRetries {
+		t.Errorf("defaults: cooldown %s, cert window %s, retries %d", n.cooldown, n.certWindow, n.webhooks[0].retries)
+	}
+	n, err := newNotifier(&NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://hooks.internal", Retries: -1}}},
+		&AdminConfig{CertExpiryWindow: Duration(48 * time.Hour)}, log.New(io.Discard, "", 0), newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.certWindow != 48*time.Hour || n.webhooks[0].retries != 0 {
+		t.Errorf("cert window %s and retries %d, want the admin window and none", n.certWindow, n.webhooks[0].retries)
+	}
+	if n, _ := newNotifier(&NotificationsConfig{}, nil, nil, newMetricsRegistry()); n != nil {
+		t.Error("notifier without webhooks")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		events   []string
+		statuses []int // answers before the endpoint succeeds
+		retries  int
+		posts    int    // requests the endpoint gets
+		result   string // counted outcome; "" when the webhook does not subscribe
+		want     string // in the delivered body
+	}{
+		{name: "generic", posts: 1, result: "sent", want: `"subject":"/etc/proxygo.json","message":"reload failed"`},
+		{name: "slack", format: "slack", posts: 1, result: "sent", want: `{"text":"*proxygo config_reload_failed* on `},
+		{name: "not subscribed", events: []string{eventCertExpiry}},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable}, posts: 2, result: "sent"},
+		{name: "not retried", statuses: []int{http.StatusBadRequest}, posts: 1, result: "failed"},
+		{name: "retries spent", statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, retries: -1, posts: 1, result: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newWebhookRecorder(t, tt.statuses...)
+			n := newTestNotifier(t, &NotificationsConfig{Webhooks: []WebhookConfig{{
+				Name: "ops", URL: rec.URL, Format: tt.format, Events: tt.events, Retries: tt.retries,
+				Headers: map[string]string{"Authorization": "Bearer hook"},
+			}}})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go n.run(ctx, func() []*keyPair { return nil })
+
+			n.notify(notification{Event: eventReloadFailed, Subject: "/etc/proxygo.json", Message: "reload failed"}, time.Minute)
+			if tt.result == "" {
+				time.Sleep(50 * time.Millisecond)
+				if got := rec.received(); len(got) != 0 {
+					t.Errorf("unsubscribed webhook received %q", got)
+				}
+				return
+			}
+			waitUntil(t, tt.result+" counted", func() bool { return n.results.value("ops", eventReloadFailed, tt.result) == 1 })
+			got := rec.received()
+			if len(got) != tt.posts {
+				t.Fatalf("%d posts, want %d", len(got), tt.posts)
+			}
+			if !strings.Contains(got[0], tt.want) {
+				t.Errorf("body %s, want %s", got[0], tt.want)
+			}
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if h := rec.headers[0]; h.Get("Authorization") != "Bearer hook" || h.Get("Content-Type") != "application/json" {
+				t.Errorf("headers %v", h)
+			}
+		})
+	}
+}
+
+func TestNotifyLimits(t *testing.T) {
+	n := newTestNotifier(t, &NotificationsConfig{Webhooks: []WebhookConfig{{Name: "ops", URL: "http://hooks.internal", MaxPerHour: 2}}})
+	start := time.Now()
+	tests := []struct {
+		subject string
+		at      time.Duration // after start
+		result  string        // "queued" when handed to the webhook
+	}{
+		{subject: "a", result: "queued"},
+		{subject: "a", at: time.Minute, result: "suppressed"},
+		{subject: "b", at: time.Minute, result: "queued"},
+		{subject: "a", at: time.Hour, result: "rate_limited"},
+	}
+	for _, tt := range tests {
+		queued := len(n.webhooks[0].queue)
+		n.notify(notification{Event: eventErrorRate, Subject: tt.subject, Time: start.Add(tt.at)}, 15*time.Minute)
+		if tt.result == "queued" {
+			if len(n.webhooks[0].queue) != queued+1 {
+				t.Errorf("%s at %s not queued", tt.subject, tt.at)
+			}
+			continue
+		}
+		if n.results.value("ops", eventErrorRate, tt.result) != 1 {
+			t.Errorf("%s at %s not %s", tt.subject, tt.at, tt.result)
+		}
+	}
+}
+
+func TestCheckCertificates(t *testing.T) {
+	now := time.Now()
+	pair := func(notAfter time.Time) *keyPair {
+		certFile, keyFile := writeTestCertValid(t, now.Add(-time.Hour), notAfter)
+		p, err := loadKeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	soon, later, expired := pair(now.Add(48*time.Hour)), pair(now.Add(30*24*time.Hour)), pair(now.Add(-time.Minute))
+	n := newTestNotifier(t, &NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://hooks.internal"}}})
+
+	n.checkCertificates([]*keyPair{soon, later, expired})
+	// Checked again within the day: nothing new
+	n.checkCertificates([]*keyPair{soon, later, expired})
+	queue := n.webhooks[0].queue
+	if len(queue) != 2 {
+		t.Fatalf("%d notifications, want 2", len(queue))
+	}
+	for _, want := range []struct{ subject, message string }{
+		{subject: soon.certFile, message: "certificate " + soon.certFile + " expires "},
+		{subject: expired.certFile, message: "certificate " + expired.certFile + " expired "},
+	} {
+		ev := <-queue
+		if ev.Event != eventCertExpiry || ev.Subject != want.subject || !strings.HasPrefix(ev.Message, want.message) {
+			t.Errorf("notification %+v, want %s", ev, want.message)
+		}
+	}
+}
+
+func TestErrorRateNotification(t *testing.T) {
+	rec := newWebhookRecorder(t)
+	n := newTestNotifier(t, &NotificationsConfig{
+		ErrorRate: 0.5, ErrorWindow: Duration(20 * time.Millisecond), ErrorWindows: 2, ErrorMinRequests: 4,
+		Webhooks: []WebhookConfig{{Name: "ops", URL: rec.URL}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.run(ctx, func() []*keyPair { return nil })
+
+	// Healthy traffic and too little traffic never notify
+	tests := []struct {
+		statuses []int
+		gap      time.Duration
+	}{
+		{statuses: []int{200, 200, 200, 502}, gap: time.Millisecond},
+		{statuses: []int{502}, gap: 15 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); time.Sleep(tt.gap) {
+			for _, status := range tt.statuses {
+				n.observe(status)
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		if got := rec.received(); len(got) != 0 {
+			t.Fatalf("notified for %v every %s: %q", tt.statuses, tt.gap, got)
+		}
+	}
+
+	// A sustained failure notifies once per cooldown
+	for end := time.Now().Add(200 * time.Millisecond); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		n.observe(http.StatusBadGateway)
+		n.observe(http.StatusOK)
+	}
+	waitUntil(t, "the error rate notification", func() bool { return len(rec.received()) > 0 })
+	got := rec.received()
+	if len(got) != 1 {
+		t.Fatalf("%d notifications, want 1", len(got))
+	}
+	var ev notification
+	if err := json.Unmarshal([]byte(got[0]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != eventErrorRate || !strings.HasPrefix(ev.Message, "50.0% of responses were 5xx") {
+		t.Errorf("notification %+v", ev)
+	}
+}